@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
 	"go.uber.org/zap"
@@ -127,6 +128,7 @@ type Reconciler struct {
 	// Using a shared kafkaClusterAdmin does not work currently because of an issue with
 	// Shopify/sarama, see https://github.com/Shopify/sarama/issues/1162.
 	kafkaClusterAdmin    sarama.ClusterAdmin
+	knownBrokerCount     int32 // The number of brokers last reported by the Kafka cluster (accessed atomically)
 	kafkachannelLister   listers.KafkaChannelLister
 	kafkachannelInformer cache.SharedIndexInformer
 	deploymentLister     appsv1listers.DeploymentLister
@@ -552,9 +554,17 @@ func (r *Reconciler) reconcileTopic(ctx context.Context, channel *v1beta1.KafkaC
 	//        take precedence.
 	retentionMillisString := strconv.FormatInt(r.kafkaConfig.EventingKafka.Kafka.Topic.DefaultRetentionMillis, 10)
 
+	replicationFactor := commonconfig.ReplicationFactor(channel, r.kafkaConfig.EventingKafka, logger)
+	numPartitions := commonconfig.NumPartitions(channel, r.kafkaConfig.EventingKafka, logger)
+	brokerCount := r.brokerCount(kafkaClusterAdmin, logger)
+	if err := commonconfig.ValidateTopicSettings(numPartitions, replicationFactor, brokerCount, logger); err != nil {
+		logger.Errorw("Invalid topic settings", zap.String("topic", topicName), zap.Error(err))
+		return err
+	}
+
 	err := kafkaClusterAdmin.CreateTopic(topicName, &sarama.TopicDetail{
-		ReplicationFactor: commonconfig.ReplicationFactor(channel, r.kafkaConfig.EventingKafka, logger),
-		NumPartitions:     commonconfig.NumPartitions(channel, r.kafkaConfig.EventingKafka, logger),
+		ReplicationFactor: replicationFactor,
+		NumPartitions:     numPartitions,
 		ConfigEntries: map[string]*string{
 			constants.KafkaTopicConfigRetentionMs: &retentionMillisString,
 		},
@@ -569,6 +579,21 @@ func (r *Reconciler) reconcileTopic(ctx context.Context, channel *v1beta1.KafkaC
 	return err
 }
 
+// brokerCount returns the number of brokers in the Kafka cluster, or zero if the cluster could not be described.
+// Since a new cluster admin connects for each reconciliation, the count is only logged when it has changed.
+func (r *Reconciler) brokerCount(kafkaClusterAdmin sarama.ClusterAdmin, logger *zap.SugaredLogger) int {
+	brokers, _, err := kafkaClusterAdmin.DescribeCluster()
+	if err != nil {
+		logger.Warnw("Failed to describe the Kafka cluster", zap.Error(err))
+		return 0
+	}
+	count := len(brokers)
+	if previous := atomic.SwapInt32(&r.knownBrokerCount, int32(count)); previous != int32(count) {
+		logger.Infow("Kafka cluster broker count", zap.Int("brokers", count), zap.Int32("previous", previous))
+	}
+	return count
+}
+
 func (r *Reconciler) deleteTopic(ctx context.Context, channel *v1beta1.KafkaChannel, kafkaClusterAdmin sarama.ClusterAdmin) error {
 	logger := logging.FromContext(ctx)
 
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -433,6 +434,21 @@ func TestTopicExists(t *testing.T) {
 	}, zap.L()))
 }
 
+func TestBrokerCount(t *testing.T) {
+	r := &Reconciler{}
+	logger := zap.NewNop().Sugar()
+	brokers := []*sarama.Broker{sarama.NewBroker("b1:9092"), sarama.NewBroker("b2:9092")}
+
+	assert.Equal(t, 2, r.brokerCount(&mockClusterAdmin{mockBrokers: brokers}, logger))
+	assert.Equal(t, int32(2), r.knownBrokerCount)
+	assert.Equal(t, 1, r.brokerCount(&mockClusterAdmin{mockBrokers: brokers[:1]}, logger))
+	assert.Equal(t, int32(1), r.knownBrokerCount)
+
+	// A cluster that cannot be described has an unknown number of brokers (which does not change the known count)
+	assert.Equal(t, 0, r.brokerCount(&mockClusterAdmin{mockDescribeErr: fmt.Errorf("describe error")}, logger))
+	assert.Equal(t, int32(1), r.knownBrokerCount)
+}
+
 func TestDeploymentUpdatedOnImageChange(t *testing.T) {
 	kcKey := testNS + "/" + kcName
 	row := TableRow{
@@ -745,6 +761,8 @@ func TestDeploymentUpdatedOnConfigMapHashChange(t *testing.T) {
 type mockClusterAdmin struct {
 	mockCreateTopicFunc func(topic string, detail *sarama.TopicDetail, validateOnly bool) error
 	mockDeleteTopicFunc func(topic string) error
+	mockBrokers         []*sarama.Broker
+	mockDescribeErr     error
 }
 
 func (ca *mockClusterAdmin) AlterPartitionReassignments(topic string, assignment [][]int32) error {
@@ -842,7 +860,7 @@ func (ca *mockClusterAdmin) ListConsumerGroupOffsets(group string, topicPartitio
 }
 
 func (ca *mockClusterAdmin) DescribeCluster() (brokers []*sarama.Broker, controllerID int32, err error) {
-	return nil, 0, nil
+	return ca.mockBrokers, 0, ca.mockDescribeErr
 }
 
 // Delete a consumer group.
@@ -32,8 +32,9 @@ import (
 // a pass-through to the Sarama ClusterAdmin with some additional functionality layered on top.
 //
 
-// Ensure The KafkaAdminClient Struct Implements The AdminClientInterface
+// Ensure The KafkaAdminClient Struct Implements The AdminClientInterface & BrokerCounter
 var _ types.AdminClientInterface = &KafkaAdminClient{}
+var _ types.BrokerCounter = &KafkaAdminClient{}
 
 // Kafka AdminClient Definition
 type KafkaAdminClient struct {
@@ -92,6 +93,18 @@ func (k KafkaAdminClient) DeleteTopic(_ context.Context, topicName string) *sara
 	}
 }
 
+// Sarama Pass-Through Function For Counting The Brokers In The Cluster
+func (k KafkaAdminClient) BrokerCount() (int, error) {
+	if k.clusterAdmin == nil {
+		return 0, fmt.Errorf("unable to describe cluster due to invalid ClusterAdmin - check Kafka authorization secrets")
+	}
+	brokers, _, err := k.clusterAdmin.DescribeCluster()
+	if err != nil {
+		return 0, err
+	}
+	return len(brokers), nil
+}
+
 // Sarama Pass-Through Function For Closing ClusterAdmin
 func (k KafkaAdminClient) Close() error {
 	if k.clusterAdmin == nil {
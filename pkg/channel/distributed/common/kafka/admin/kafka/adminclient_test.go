@@ -18,6 +18,7 @@ package kafka
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"testing"
 
@@ -205,6 +206,48 @@ func TestDeleteTopicInvalidAdminClient(t *testing.T) {
 	assert.Equal(t, errMsg, *resultTopicError.ErrMsg)
 }
 
+// Test The BrokerCount() Functionality
+func TestBrokerCount(t *testing.T) {
+
+	// Test Logger
+	logger := logtesting.TestLogger(t).Desugar()
+
+	// Test Data
+	brokers := []*sarama.Broker{sarama.NewBroker("b1:9092"), sarama.NewBroker("b2:9092")}
+	describeErr := fmt.Errorf("describe error")
+
+	for _, testCase := range []struct {
+		name        string
+		brokers     []*sarama.Broker
+		err         error
+		expectCount int
+	}{
+		{name: "Success", brokers: brokers, expectCount: 2},
+		{name: "Error", brokers: []*sarama.Broker{}, err: describeErr},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+
+			// Create A Mock Sarama ClusterAdmin To Test Against
+			mockClusterAdmin := &MockClusterAdmin{}
+			mockClusterAdmin.On("DescribeCluster").Return(testCase.brokers, testCase.err)
+
+			// Create A New Kafka AdminClient To Test
+			adminClient := &KafkaAdminClient{logger: logger, clusterAdmin: mockClusterAdmin}
+
+			// Perform The Test & Verify The Results
+			count, err := adminClient.BrokerCount()
+			assert.Equal(t, testCase.expectCount, count)
+			assert.Equal(t, testCase.err, err)
+			mockClusterAdmin.AssertExpectations(t)
+		})
+	}
+
+	// Without A ClusterAdmin The Count Is Unknown
+	count, err := (&KafkaAdminClient{logger: logger}).BrokerCount()
+	assert.Equal(t, 0, count)
+	assert.NotNil(t, err)
+}
+
 // Test The Close() Functionality
 func TestClose(t *testing.T) {
 
@@ -333,7 +376,8 @@ func (m *MockClusterAdmin) DeleteConsumerGroup(group string) error {
 }
 
 func (m *MockClusterAdmin) DescribeCluster() (brokers []*sarama.Broker, controllerID int32, err error) {
-	panic("implement me")
+	args := m.Called()
+	return args.Get(0).([]*sarama.Broker), 0, args.Error(1)
 }
 
 func (m *MockClusterAdmin) DescribeUserScramCredentials(users []string) ([]*sarama.DescribeUserScramCredentialsResult, error) {
@@ -38,3 +38,8 @@ type AdminClientInterface interface {
 	DeleteTopic(context.Context, string) *sarama.TopicError
 	Close() error
 }
+
+// BrokerCounter Is Implemented By AdminClients Which Can Report The Number Of Brokers In The Cluster
+type BrokerCounter interface {
+	BrokerCount() (int, error)
+}
@@ -59,6 +59,7 @@ type Reconciler struct {
 	serviceLister        corev1listers.ServiceLister
 	adminMutex           *sync.Mutex
 	kafkaConfigMapHash   string
+	knownBrokerCount     int32 // The Number Of Brokers Last Reported By The Kafka Cluster (Accessed Atomically)
 }
 
 var (
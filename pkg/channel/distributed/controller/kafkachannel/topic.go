@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
 	"go.uber.org/zap"
@@ -28,6 +29,7 @@ import (
 	"knative.dev/pkg/logging"
 
 	kafkav1beta1 "knative.dev/eventing-kafka/pkg/apis/messaging/v1beta1"
+	"knative.dev/eventing-kafka/pkg/channel/distributed/common/kafka/admin/types"
 	"knative.dev/eventing-kafka/pkg/channel/distributed/controller/constants"
 	"knative.dev/eventing-kafka/pkg/channel/distributed/controller/event"
 	"knative.dev/eventing-kafka/pkg/channel/distributed/controller/util"
@@ -54,8 +56,11 @@ func (r *Reconciler) reconcileKafkaTopic(ctx context.Context, channel *kafkav1be
 	//        take precedence.
 	retentionMillis := r.config.Kafka.Topic.DefaultRetentionMillis
 
-	// Create The Topic (Handles Case Where Already Exists)
-	err := r.createTopic(ctx, topicName, numPartitions, replicationFactor, retentionMillis)
+	// Create The Topic (Handles Case Where Already Exists) If The Configuration Is Valid
+	err := config.ValidateTopicSettings(numPartitions, replicationFactor, r.brokerCount(logger), logger)
+	if err == nil {
+		err = r.createTopic(ctx, topicName, numPartitions, replicationFactor, retentionMillis)
+	}
 
 	// Log Results & Return Status
 	if err != nil {
@@ -69,6 +74,24 @@ func (r *Reconciler) reconcileKafkaTopic(ctx context.Context, channel *kafkav1be
 	return err
 }
 
+// brokerCount Returns The Number Of Brokers In The Kafka Cluster (Zero If Unknown), Logging It Only When It
+// Changes Since A New AdminClient Is Connected For Each Reconciliation
+func (r *Reconciler) brokerCount(logger *zap.SugaredLogger) int {
+	counter, ok := r.adminClient.(types.BrokerCounter)
+	if !ok {
+		return 0
+	}
+	count, err := counter.BrokerCount()
+	if err != nil {
+		logger.Warn("Failed To Determine The Number Of Brokers In The Kafka Cluster", zap.Error(err))
+		return 0
+	}
+	if previous := atomic.SwapInt32(&r.knownBrokerCount, int32(count)); previous != int32(count) {
+		logger.Info("Kafka Cluster Broker Count", zap.Int("Brokers", count), zap.Int32("Previous", previous))
+	}
+	return count
+}
+
 // finalizeKafkaTopic Finalizes The Kafka Topic Associated With The Specified Channel
 func (r *Reconciler) finalizeKafkaTopic(ctx context.Context, channel *kafkav1beta1.KafkaChannel) error {
 
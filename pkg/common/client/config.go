@@ -32,28 +32,113 @@ import (
 	"knative.dev/pkg/logging"
 )
 
+// MinMetadataRefreshFrequency is the lowest accepted value for WithMetadataRefreshFrequency.  Every refresh is a
+// metadata request to the brokers from each client, so a shorter interval would put significant load on the
+// cluster for little gain in responsiveness.
+const MinMetadataRefreshFrequency = time.Second
+
+// MaxChannelBufferSize is the highest accepted value for WithChannelBufferSize.  The Sarama default is 256.  Sarama
+// keeps a buffered channel of that many messages for each consumed partition (and for its internal fetch results and
+// the producer input), so a larger buffer allows more messages to be fetched ahead of the handler, improving the
+// throughput of bursty or high-latency consumption, at the cost of a memory use that grows with the buffer size
+// times the number of partitions (and the message size).  A smaller buffer lowers the memory use and the number of
+// messages that are fetched but not yet handled when a rebalance revokes a partition.
+const MaxChannelBufferSize = 10000
+
+// NetTimeouts are the Sarama network timeouts that WithNetTimeouts sets.  The Sarama default for each of them is
+// 30 seconds.  Between 5 and 60 seconds is a sensible range: shorter timeouts detect a failed broker (and move on
+// to a new partition leader) sooner, but cause spurious failures on high-latency links, while longer ones make
+// failover correspondingly slower.  The read timeout in particular must stay well above the consumer's
+// MaxWaitTime and the group's session timeout, or fetches and joins time out while the broker is still answering.
+type NetTimeouts struct {
+	DialTimeout  time.Duration // How long to wait for the initial connection to a broker
+	ReadTimeout  time.Duration // How long to wait for a response from a broker
+	WriteTimeout time.Duration // How long to wait for a request to be sent to a broker
+}
+
+// The accepted range of the RebalanceRetry backoff.  Sarama retries a failed join at once if the backoff is zero, so
+// a group whose coordinator is still loading (or moving) exhausts its retries within moments, while a backoff of
+// more than a minute leaves a partition unconsumed for several minutes when the retries are needed.
+const (
+	MinRebalanceRetryBackoff = 100 * time.Millisecond
+	MaxRebalanceRetryBackoff = time.Minute
+)
+
+// RebalanceRetry is the number of times, and the interval at which, a consumer group retries joining the group
+// (or syncing its assignment) when the attempt fails, which WithRebalanceRetry sets.  The Sarama defaults are
+// 4 retries and a 2 second backoff, so a group gives up joining after about 10 seconds.  Large groups, whose
+// rebalances take longer (especially with many members joining at once, e.g. on a rolling restart), may need more
+// retries or a longer backoff.  Values that are too low show up as Consume returning errors such as
+// "kafka server: The coordinator is loading and hence can't process requests" or "kafka server: A rebalance for
+// the group is in progress", and as repeated restarts of the consume loop while the rest of the group is stable.
+type RebalanceRetry struct {
+	Max     int           // How many times to retry a failed join or sync, which must be positive
+	Backoff time.Duration // How long to wait between the retries, between the Min and MaxRebalanceRetryBackoff
+}
+
 type KafkaAuthConfig struct {
 	TLS  *KafkaTlsConfig
 	SASL *KafkaSaslConfig
 }
 
 type KafkaTlsConfig struct {
-	Cacert   string
-	Usercert string
-	Userkey  string
+	Cacert     string
+	Usercert   string
+	Userkey    string
+	ServerName string // If present, the name that the broker certificates are verified against instead of the broker host
 }
 
 type KafkaSaslConfig struct {
-	User     string
-	Password string
-	SaslType string
+	User      string
+	Password  string
+	SaslType  string
+	TokenPath string // Location of the token file used with the OAUTHBEARER SaslType
+
+	// If present, the encrypted password, which supersedes the Password field (see SealPassword)
+	SealedPassword *SealedPassword
+}
+
+// SealPassword encrypts the Password in memory and empties the plaintext field.  This is optional; the password
+// is only decrypted when the sarama config is built.  Go strings cannot be zeroed, so the original Password string
+// remains in memory until it is garbage collected; to avoid it, seal a byte slice with NewSealedPassword (which
+// zeroes that slice) instead.  See SealedPassword for the other limitations of this approach.
+func (c *KafkaSaslConfig) SealPassword() error {
+	sealed, err := NewSealedPassword([]byte(c.Password))
+	if err != nil {
+		return err
+	}
+	c.SealedPassword = sealed
+	c.Password = ""
+	return nil
+}
+
+// GetPassword returns the plaintext password, decrypting it first if it has been sealed.  Anything that hands
+// the password to sarama must use this instead of reading the Password field directly.
+func (c *KafkaSaslConfig) GetPassword() (string, error) {
+	if c.SealedPassword != nil {
+		return c.SealedPassword.Open()
+	}
+	return c.Password, nil
 }
 
 // HasSameSettings returns true if all of the SASL settings in the provided config are the same as in this struct
 func (c *KafkaSaslConfig) HasSameSettings(saramaConfig *sarama.Config) bool {
+	password, err := c.GetPassword()
+	if err != nil {
+		return false
+	}
 	return saramaConfig.Net.SASL.User == c.User &&
-		saramaConfig.Net.SASL.Password == c.Password &&
-		string(saramaConfig.Net.SASL.Mechanism) == c.SaslType
+		saramaConfig.Net.SASL.Password == password &&
+		string(saramaConfig.Net.SASL.Mechanism) == c.SaslType &&
+		tokenPath(saramaConfig) == c.TokenPath
+}
+
+// tokenPath returns the path of the token file used by the sarama config's FileTokenProvider, if any
+func tokenPath(saramaConfig *sarama.Config) string {
+	if provider, ok := saramaConfig.Net.SASL.TokenProvider.(*FileTokenProvider); ok {
+		return provider.Path()
+	}
+	return ""
 }
 
 // HasSameBrokers returns true if all of the brokers in the slice are present and in the same order as
@@ -90,7 +175,7 @@ func HasSameBrokers(brokerString string, brokers []string) bool {
 // - apply defaults
 // - apply settings from YAML string
 // - apply settings from KafkaAuthConfig
-// - apply individual settings like version, clientId
+// - apply individual settings like version, clientId, metadata refresh frequency
 type ConfigBuilder interface {
 	// WithExisting makes the builder use an existing Sarama
 	// config as a base.
@@ -118,6 +203,39 @@ type ConfigBuilder interface {
 	// (if provided) or in the YAML-string
 	WithClientId(clientId string) ConfigBuilder
 
+	// WithMetadataRefreshFrequency makes the builder set how often
+	// the cluster metadata (e.g. partition leaders and counts) is
+	// refreshed, regardless what's set in the existing config
+	// (if provided) or in the YAML-string.  The Sarama default
+	// is 10 minutes; values below MinMetadataRefreshFrequency
+	// cause Build to return an error.
+	WithMetadataRefreshFrequency(frequency time.Duration) ConfigBuilder
+
+	// WithNetTimeouts makes the builder set the dial, read and
+	// write network timeouts, regardless what's set in the existing
+	// config (if provided) or in the YAML-string.  See NetTimeouts
+	// for the defaults and recommended values; a timeout that is
+	// not positive causes Build to return an error.
+	WithNetTimeouts(timeouts NetTimeouts) ConfigBuilder
+
+	// WithChannelBufferSize makes the builder set the number of
+	// events buffered in the internal and external channels (e.g.
+	// the messages of each consumed partition), regardless what's
+	// set in the existing config (if provided) or in the YAML-string.
+	// See MaxChannelBufferSize for the default and the tradeoffs; a
+	// size that is negative or above the maximum causes Build to
+	// return an error.
+	WithChannelBufferSize(size int) ConfigBuilder
+
+	// WithRebalanceRetry makes the builder set how many times, and
+	// how often, a consumer group retries a failed attempt to join
+	// the group, regardless what's set in the existing config (if
+	// provided) or in the YAML-string.  See RebalanceRetry for the
+	// defaults and the symptoms of values that are too low; a
+	// maximum that is not positive or a backoff outside the accepted
+	// range causes Build to return an error.
+	WithRebalanceRetry(retry RebalanceRetry) ConfigBuilder
+
 	// Build builds the Sarama config with the given context.
 	// Context is used for getting the config at the moment.
 	Build(ctx context.Context) (*sarama.Config, error)
@@ -134,6 +252,11 @@ type configBuilder struct {
 	clientId string
 	yaml     string
 	auth     *KafkaAuthConfig
+
+	metadataRefreshFrequency *time.Duration
+	netTimeouts              *NetTimeouts
+	channelBufferSize        *int
+	rebalanceRetry           *RebalanceRetry
 }
 
 func (b *configBuilder) WithExisting(existing *sarama.Config) ConfigBuilder {
@@ -156,6 +279,26 @@ func (b *configBuilder) WithClientId(clientId string) ConfigBuilder {
 	return b
 }
 
+func (b *configBuilder) WithMetadataRefreshFrequency(frequency time.Duration) ConfigBuilder {
+	b.metadataRefreshFrequency = &frequency
+	return b
+}
+
+func (b *configBuilder) WithNetTimeouts(timeouts NetTimeouts) ConfigBuilder {
+	b.netTimeouts = &timeouts
+	return b
+}
+
+func (b *configBuilder) WithChannelBufferSize(size int) ConfigBuilder {
+	b.channelBufferSize = &size
+	return b
+}
+
+func (b *configBuilder) WithRebalanceRetry(retry RebalanceRetry) ConfigBuilder {
+	b.rebalanceRetry = &retry
+	return b
+}
+
 func (b *configBuilder) FromYaml(saramaSettingsYamlString string) ConfigBuilder {
 	b.yaml = saramaSettingsYamlString
 	return b
@@ -234,6 +377,10 @@ func (b *configBuilder) Build(ctx context.Context) (*sarama.Config, error) {
 				}
 				config.Net.TLS.Config = tlsConfig
 			}
+			// e.g. brokers behind a load balancer whose certificates do not name the host that is connected to
+			if b.auth.TLS.ServerName != "" {
+				config.Net.TLS.Config = withServerName(config.Net.TLS.Config, b.auth.TLS.ServerName)
+			}
 		}
 		// SASL
 		if b.auth.SASL != nil {
@@ -243,6 +390,9 @@ func (b *configBuilder) Build(ctx context.Context) (*sarama.Config, error) {
 			// if SaslType is not provided we are defaulting to PLAIN
 			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
 
+			// An existing config may still reference the TokenProvider of its previous (OAUTHBEARER) settings
+			config.Net.SASL.TokenProvider = nil
+
 			if b.auth.SASL.SaslType == sarama.SASLTypeSCRAMSHA256 {
 				config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &XDGSCRAMClient{HashGeneratorFcn: SHA256} }
 				config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
@@ -252,6 +402,15 @@ func (b *configBuilder) Build(ctx context.Context) (*sarama.Config, error) {
 				config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &XDGSCRAMClient{HashGeneratorFcn: SHA512} }
 				config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
 			}
+
+			// OAUTHBEARER tokens are read from a file (e.g. a projected service-account token) that may be rotated
+			if b.auth.SASL.SaslType == sarama.SASLTypeOAuth {
+				if b.auth.SASL.TokenPath == "" {
+					return nil, fmt.Errorf("the %s SASL type requires a token path", sarama.SASLTypeOAuth)
+				}
+				config.Net.SASL.TokenProvider = NewFileTokenProvider(b.auth.SASL.TokenPath)
+				config.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+			}
 			config.Net.SASL.User = b.auth.SASL.User
 		}
 	}
@@ -263,17 +422,76 @@ func (b *configBuilder) Build(ctx context.Context) (*sarama.Config, error) {
 	if b.clientId != "" {
 		config.ClientID = b.clientId
 	}
+	if b.metadataRefreshFrequency != nil {
+		if *b.metadataRefreshFrequency < MinMetadataRefreshFrequency {
+			return nil, fmt.Errorf("metadata refresh frequency %v is below the minimum of %v", *b.metadataRefreshFrequency, MinMetadataRefreshFrequency)
+		}
+		config.Metadata.RefreshFrequency = *b.metadataRefreshFrequency
+	}
+	if b.netTimeouts != nil {
+		if err := b.netTimeouts.validate(); err != nil {
+			return nil, err
+		}
+		config.Net.DialTimeout = b.netTimeouts.DialTimeout
+		config.Net.ReadTimeout = b.netTimeouts.ReadTimeout
+		config.Net.WriteTimeout = b.netTimeouts.WriteTimeout
+	}
+	if b.channelBufferSize != nil {
+		if *b.channelBufferSize < 0 || *b.channelBufferSize > MaxChannelBufferSize {
+			return nil, fmt.Errorf("channel buffer size %d is outside the accepted range of 0 to %d", *b.channelBufferSize, MaxChannelBufferSize)
+		}
+		config.ChannelBufferSize = *b.channelBufferSize
+	}
+	if b.rebalanceRetry != nil {
+		if err := b.rebalanceRetry.validate(); err != nil {
+			return nil, err
+		}
+		config.Consumer.Group.Rebalance.Retry.Max = b.rebalanceRetry.Max
+		config.Consumer.Group.Rebalance.Retry.Backoff = b.rebalanceRetry.Backoff
+	}
 
 	logger := logging.FromContext(ctx)
 	logger.Infof("Built Sarama config: %+v", config)
 
 	if b.auth != nil && b.auth.SASL != nil {
-		config.Net.SASL.Password = b.auth.SASL.Password
+		password, err := b.auth.SASL.GetPassword()
+		if err != nil {
+			return nil, err
+		}
+		config.Net.SASL.Password = password
 	}
 
 	return config, nil
 }
 
+// validate returns an error naming the first of the timeouts that is not a positive duration
+func (t NetTimeouts) validate() error {
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"dial", t.DialTimeout},
+		{"read", t.ReadTimeout},
+		{"write", t.WriteTimeout},
+	} {
+		if timeout.value <= 0 {
+			return fmt.Errorf("net %s timeout %v is not a positive duration", timeout.name, timeout.value)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the maximum is not positive or the backoff is outside the accepted range
+func (r RebalanceRetry) validate() error {
+	if r.Max <= 0 {
+		return fmt.Errorf("rebalance retry max %d is not positive", r.Max)
+	}
+	if r.Backoff < MinRebalanceRetryBackoff || r.Backoff > MaxRebalanceRetryBackoff {
+		return fmt.Errorf("rebalance retry backoff %v is outside the accepted range of %v to %v", r.Backoff, MinRebalanceRetryBackoff, MaxRebalanceRetryBackoff)
+	}
+	return nil
+}
+
 // ConfigEqual is a convenience function to determine if two given sarama.Config structs are identical aside
 // from unserializable fields (e.g. function pointers).  To ignore parts of the sarama.Config struct, pass
 // them in as the "ignore" parameter.
@@ -312,8 +530,15 @@ func ConfigEqual(config1, config2 *sarama.Config, ignore ...interface{}) bool {
 // default TLS handshake does, except it skips hostname verification. It must
 // be used with InsecureSkipVerify.
 func verifyCertSkipHostname(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return verifyCertWithName(roots, "")
+}
+
+// verifyCertWithName verifies certificates in the same way as verifyCertSkipHostname, except that the leaf
+// certificate must be valid for the given name (if it is not empty).  It must be used with InsecureSkipVerify.
+func verifyCertWithName(roots *x509.CertPool, name string) func([][]byte, [][]*x509.Certificate) error {
 	return func(certs [][]byte, _ [][]*x509.Certificate) error {
 		opts := x509.VerifyOptions{
+			DNSName:       name,
 			Roots:         roots,
 			CurrentTime:   time.Now(),
 			Intermediates: x509.NewCertPool(),
@@ -338,6 +563,23 @@ func verifyCertSkipHostname(roots *x509.CertPool) func([][]byte, [][]*x509.Certi
 	}
 }
 
+// withServerName returns a copy of the *tls.Config (or a new one, if it is nil) whose ServerName is the given one,
+// so that the broker certificates are verified against that name (which is also sent as the SNI) instead of the
+// host of the broker address.  The config of newTLSConfig skips the hostname verification, so it is made to verify
+// the server name instead.
+func withServerName(config *tls.Config, serverName string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.ServerName = serverName
+	if config.InsecureSkipVerify && config.VerifyPeerCertificate != nil {
+		config.VerifyPeerCertificate = verifyCertWithName(config.RootCAs, serverName)
+	}
+	return config
+}
+
 // NewTLSConfig returns a *tls.Config using the given ceClient cert, ceClient key,
 // and CA certificate. If none are appropriate, a nil *tls.Config is returned.
 func newTLSConfig(clientCert, clientKey, caCert string) (*tls.Config, error) {
@@ -25,6 +25,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"math/big"
 	"regexp"
 	"strings"
@@ -462,6 +463,237 @@ Metadata:
 	assert.False(t, config.Net.TLS.Enable)
 }
 
+func TestBuildSaramaConfigWithOAuthTokenFile(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+
+	// A token path is required for OAUTHBEARER
+	_, err := NewConfigBuilder().
+		WithDefaults().
+		WithAuth(&KafkaAuthConfig{SASL: &KafkaSaslConfig{SaslType: sarama.SASLTypeOAuth}}).
+		Build(ctx)
+	assert.NotNil(t, err)
+
+	config, err := NewConfigBuilder().
+		WithDefaults().
+		WithAuth(&KafkaAuthConfig{SASL: &KafkaSaslConfig{SaslType: sarama.SASLTypeOAuth, TokenPath: "/test/token/path"}}).
+		Build(ctx)
+	assert.Nil(t, err)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeOAuth), config.Net.SASL.Mechanism)
+	provider, ok := config.Net.SASL.TokenProvider.(*FileTokenProvider)
+	assert.True(t, ok)
+	assert.Equal(t, "/test/token/path", provider.Path())
+
+	// Changing the auth settings of the config releases the provider of the previous ones
+	config, err = NewConfigBuilder().
+		WithExisting(config).
+		WithAuth(&KafkaAuthConfig{SASL: &KafkaSaslConfig{SaslType: sarama.SASLTypePlaintext, User: "user", Password: "password"}}).
+		Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypePlaintext), config.Net.SASL.Mechanism)
+	assert.Nil(t, config.Net.SASL.TokenProvider)
+}
+
+func TestBuildSaramaConfigWithSealedPassword(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+
+	saslConfig := &KafkaSaslConfig{User: "USERNAME", Password: "PASSWORD"}
+	assert.Nil(t, saslConfig.SealPassword())
+	assert.Equal(t, "", saslConfig.Password)
+	assert.NotNil(t, saslConfig.SealedPassword)
+
+	config, err := NewConfigBuilder().
+		WithDefaults().
+		WithAuth(&KafkaAuthConfig{SASL: saslConfig}).
+		Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "USERNAME", config.Net.SASL.User)
+	assert.Equal(t, "PASSWORD", config.Net.SASL.Password)
+}
+
+func TestBuildSaramaConfigWithMetadataRefreshFrequency(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+
+	for _, testCase := range []struct {
+		name      string
+		frequency time.Duration
+		expectErr bool
+	}{
+		{
+			name:      "Below Minimum",
+			frequency: 500 * time.Millisecond,
+			expectErr: true,
+		},
+		{
+			name:      "Zero",
+			expectErr: true,
+		},
+		{
+			name:      "Minimum",
+			frequency: MinMetadataRefreshFrequency,
+		},
+		{
+			name:      "Valid",
+			frequency: 30 * time.Second,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config, err := NewConfigBuilder().
+				WithDefaults().
+				FromYaml("metadata:\n  refreshFrequency: 600000000000\n").
+				WithMetadataRefreshFrequency(testCase.frequency).
+				Build(ctx)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if !testCase.expectErr {
+				assert.Equal(t, testCase.frequency, config.Metadata.RefreshFrequency)
+			}
+		})
+	}
+
+	// Not calling WithMetadataRefreshFrequency leaves the sarama default
+	config, err := NewConfigBuilder().WithDefaults().Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.NewConfig().Metadata.RefreshFrequency, config.Metadata.RefreshFrequency)
+}
+
+func TestBuildSaramaConfigWithNetTimeouts(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+	valid := NetTimeouts{DialTimeout: 5 * time.Second, ReadTimeout: 45 * time.Second, WriteTimeout: 10 * time.Second}
+
+	for _, testCase := range []struct {
+		name      string
+		modify    func(*NetTimeouts)
+		expectErr string
+	}{
+		{
+			name:   "Valid",
+			modify: func(*NetTimeouts) {},
+		},
+		{
+			name:      "Zero Dial",
+			modify:    func(timeouts *NetTimeouts) { timeouts.DialTimeout = 0 },
+			expectErr: "net dial timeout",
+		},
+		{
+			name:      "Negative Read",
+			modify:    func(timeouts *NetTimeouts) { timeouts.ReadTimeout = -time.Second },
+			expectErr: "net read timeout",
+		},
+		{
+			name:      "Zero Write",
+			modify:    func(timeouts *NetTimeouts) { timeouts.WriteTimeout = 0 },
+			expectErr: "net write timeout",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			timeouts := valid
+			testCase.modify(&timeouts)
+			config, err := NewConfigBuilder().
+				WithDefaults().
+				FromYaml("net:\n  dialTimeout: 60000000000\n  readTimeout: 60000000000\n").
+				WithNetTimeouts(timeouts).
+				Build(ctx)
+			if testCase.expectErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), testCase.expectErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, timeouts.DialTimeout, config.Net.DialTimeout)
+			assert.Equal(t, timeouts.ReadTimeout, config.Net.ReadTimeout)
+			assert.Equal(t, timeouts.WriteTimeout, config.Net.WriteTimeout)
+		})
+	}
+
+	// Not calling WithNetTimeouts leaves the sarama defaults
+	config, err := NewConfigBuilder().WithDefaults().Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.NewConfig().Net.DialTimeout, config.Net.DialTimeout)
+	assert.Equal(t, sarama.NewConfig().Net.ReadTimeout, config.Net.ReadTimeout)
+	assert.Equal(t, sarama.NewConfig().Net.WriteTimeout, config.Net.WriteTimeout)
+}
+
+func TestBuildSaramaConfigWithChannelBufferSize(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+
+	for _, testCase := range []struct {
+		name      string
+		size      int
+		expectErr bool
+	}{
+		{name: "Unbuffered", size: 0},
+		{name: "Valid", size: 1024},
+		{name: "Maximum", size: MaxChannelBufferSize},
+		{name: "Negative", size: -1, expectErr: true},
+		{name: "Above Maximum", size: MaxChannelBufferSize + 1, expectErr: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config, err := NewConfigBuilder().
+				WithDefaults().
+				FromYaml("channelBufferSize: 512\n").
+				WithChannelBufferSize(testCase.size).
+				Build(ctx)
+			if testCase.expectErr {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "channel buffer size")
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.size, config.ChannelBufferSize)
+		})
+	}
+
+	// Not calling WithChannelBufferSize leaves the sarama default
+	config, err := NewConfigBuilder().WithDefaults().Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.NewConfig().ChannelBufferSize, config.ChannelBufferSize)
+}
+
+func TestBuildSaramaConfigWithRebalanceRetry(t *testing.T) {
+	logger := logtesting.TestLogger(t)
+	ctx := logging.WithLogger(context.TODO(), logger)
+
+	for _, testCase := range []struct {
+		name      string
+		retry     RebalanceRetry
+		expectErr string
+	}{
+		{name: "Valid", retry: RebalanceRetry{Max: 10, Backoff: 5 * time.Second}},
+		{name: "Minimum Backoff", retry: RebalanceRetry{Max: 1, Backoff: MinRebalanceRetryBackoff}},
+		{name: "Maximum Backoff", retry: RebalanceRetry{Max: 1, Backoff: MaxRebalanceRetryBackoff}},
+		{name: "Zero Max", retry: RebalanceRetry{Max: 0, Backoff: time.Second}, expectErr: "rebalance retry max"},
+		{name: "Negative Max", retry: RebalanceRetry{Max: -1, Backoff: time.Second}, expectErr: "rebalance retry max"},
+		{name: "Backoff Too Short", retry: RebalanceRetry{Max: 4, Backoff: 0}, expectErr: "rebalance retry backoff"},
+		{name: "Backoff Too Long", retry: RebalanceRetry{Max: 4, Backoff: MaxRebalanceRetryBackoff + time.Second}, expectErr: "rebalance retry backoff"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config, err := NewConfigBuilder().
+				WithDefaults().
+				FromYaml("consumer:\n  group:\n    rebalance:\n      retry:\n        max: 2\n").
+				WithRebalanceRetry(testCase.retry).
+				Build(ctx)
+			if testCase.expectErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), testCase.expectErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.retry.Max, config.Consumer.Group.Rebalance.Retry.Max)
+			assert.Equal(t, testCase.retry.Backoff, config.Consumer.Group.Rebalance.Retry.Backoff)
+		})
+	}
+
+	// Not calling WithRebalanceRetry leaves the sarama defaults
+	config, err := NewConfigBuilder().WithDefaults().Build(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.NewConfig().Consumer.Group.Rebalance.Retry, config.Consumer.Group.Rebalance.Retry)
+}
+
 // Verify that comparisons of sarama config structs function as expected
 func TestSaramaConfigEqual(t *testing.T) {
 	logger := logtesting.TestLogger(t)
@@ -786,6 +1018,74 @@ func TestVerifyCertSkipHostname(t *testing.T) {
 	}
 }
 
+func TestVerifyCertWithName(t *testing.T) {
+	cert, _ := generateCert(t)
+	certPem, _ := pem.Decode([]byte(cert))
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM([]byte(cert))
+
+	// Without a name this is the same as verifyCertSkipHostname
+	assert.Nil(t, verifyCertWithName(caCertPool, "")([][]byte{certPem.Bytes}, nil))
+
+	// The generated certificate is not valid for any name
+	err := verifyCertWithName(caCertPool, "broker.example.com")([][]byte{certPem.Bytes}, nil)
+	assert.NotNil(t, err)
+	var hostnameErr x509.HostnameError
+	assert.True(t, errors.As(err, &hostnameErr))
+}
+
+func TestBuildSaramaConfigWithTLSServerName(t *testing.T) {
+	ctx := logging.WithLogger(context.TODO(), logtesting.TestLogger(t))
+	cert, key := generateCert(t)
+
+	for _, testCase := range []struct {
+		name       string
+		tlsConfig  *KafkaTlsConfig
+		expectName string
+		expectCA   bool
+	}{
+		{
+			name:      "No Server Name",
+			tlsConfig: &KafkaTlsConfig{},
+		},
+		{
+			name:       "Server Name Without CA Cert",
+			tlsConfig:  &KafkaTlsConfig{ServerName: "broker.example.com"},
+			expectName: "broker.example.com",
+		},
+		{
+			name:       "Server Name With CA Cert",
+			tlsConfig:  &KafkaTlsConfig{Cacert: cert, Usercert: cert, Userkey: key, ServerName: "broker.example.com"},
+			expectName: "broker.example.com",
+			expectCA:   true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config, err := NewConfigBuilder().WithDefaults().WithAuth(&KafkaAuthConfig{TLS: testCase.tlsConfig}).Build(ctx)
+			assert.Nil(t, err)
+			assert.True(t, config.Net.TLS.Enable)
+			if testCase.expectName == "" {
+				assert.Nil(t, config.Net.TLS.Config)
+				return
+			}
+			assert.NotNil(t, config.Net.TLS.Config)
+			assert.Equal(t, testCase.expectName, config.Net.TLS.Config.ServerName)
+			if testCase.expectCA {
+				// The certificates of the CA are verified against the server name rather than skipping it
+				assert.Len(t, config.Net.TLS.Config.Certificates, 1)
+				certPem, _ := pem.Decode([]byte(cert))
+				err = config.Net.TLS.Config.VerifyPeerCertificate([][]byte{certPem.Bytes}, nil)
+				var hostnameErr x509.HostnameError
+				assert.True(t, errors.As(err, &hostnameErr))
+			} else {
+				assert.False(t, config.Net.TLS.Config.InsecureSkipVerify)
+				assert.Nil(t, config.Net.TLS.Config.VerifyPeerCertificate)
+			}
+		})
+	}
+}
+
 func TestHasSameSettings(t *testing.T) {
 	authConfig := &KafkaAuthConfig{SASL: &KafkaSaslConfig{User: "user1", Password: "password1", SaslType: sarama.SASLTypeOAuth}}
 	saramaConfig := sarama.NewConfig()
@@ -797,6 +1097,12 @@ func TestHasSameSettings(t *testing.T) {
 	assert.False(t, authConfig.SASL.HasSameSettings(saramaConfig))
 	saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
 	assert.True(t, authConfig.SASL.HasSameSettings(saramaConfig))
+	authConfig.SASL.TokenPath = "/test/token/path"
+	assert.False(t, authConfig.SASL.HasSameSettings(saramaConfig))
+	saramaConfig.Net.SASL.TokenProvider = NewFileTokenProvider("/test/token/path")
+	assert.True(t, authConfig.SASL.HasSameSettings(saramaConfig))
+	assert.Nil(t, authConfig.SASL.SealPassword())
+	assert.True(t, authConfig.SASL.HasSameSettings(saramaConfig))
 }
 
 func TestHasSameBrokers(t *testing.T) {
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// SealedPassword holds a password encrypted in memory (AES-256-GCM, with a random key generated for each
+// SealedPassword) so that the plaintext does not remain in the heap for the lifetime of the process.
+//
+// This is a defense-in-depth measure with real limitations: the key is stored in the same process memory as
+// the ciphertext, so anything able to read all of the memory can still recover the password.  Also, sarama
+// requires the plaintext password as a string in its config, and Go strings cannot be zeroed, so the decrypted
+// copy handed to sarama remains in memory for as long as that config does.
+type SealedPassword struct {
+	key        []byte
+	nonce      []byte
+	ciphertext []byte
+}
+
+// NewSealedPassword encrypts the given password and zeroes the plaintext buffer
+func NewSealedPassword(plaintext []byte) (*SealedPassword, error) {
+	defer zero(plaintext)
+	sealed := &SealedPassword{key: make([]byte, 32)}
+	if _, err := rand.Read(sealed.key); err != nil {
+		return nil, fmt.Errorf("failed to generate sealed password key: %w", err)
+	}
+	gcm, err := sealed.gcm()
+	if err != nil {
+		return nil, err
+	}
+	sealed.nonce = make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(sealed.nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate sealed password nonce: %w", err)
+	}
+	sealed.ciphertext = gcm.Seal(nil, sealed.nonce, plaintext, nil)
+	return sealed, nil
+}
+
+// Open decrypts the password, zeroing the intermediate plaintext buffer once the returned string is created
+func (s *SealedPassword) Open() (string, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, s.nonce, s.ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt sealed password: %w", err)
+	}
+	defer zero(plaintext)
+	return string(plaintext), nil
+}
+
+// gcm returns the AEAD cipher that uses the key of this SealedPassword
+func (s *SealedPassword) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sealed password cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// zero overwrites the contents of the given buffer
+func zero(buffer []byte) {
+	for i := range buffer {
+		buffer[i] = 0
+	}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealedPassword(t *testing.T) {
+	plaintext := []byte("test-password")
+	sealed, err := NewSealedPassword(plaintext)
+	assert.Nil(t, err)
+
+	// The plaintext buffer is zeroed and the ciphertext does not contain the password
+	assert.Equal(t, make([]byte, len("test-password")), plaintext)
+	assert.False(t, bytes.Contains(sealed.ciphertext, []byte("test-password")))
+
+	password, err := sealed.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, "test-password", password)
+
+	// Tampered ciphertext fails to decrypt
+	sealed.ciphertext[0] ^= 0xff
+	_, err = sealed.Open()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// FileTokenProvider is a sarama.AccessTokenProvider that reads an OAUTHBEARER token from a file, such as
+// a Kubernetes projected service-account token.  The kubelet rotates these files in place, so the file is
+// re-read whenever its modification time or size changes; otherwise the cached token is returned.
+type FileTokenProvider struct {
+	path    string
+	lock    sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// Verify that the FileTokenProvider satisfies the sarama.AccessTokenProvider interface
+var _ sarama.AccessTokenProvider = (*FileTokenProvider)(nil)
+
+// NewFileTokenProvider returns a FileTokenProvider that reads the token from the given path
+func NewFileTokenProvider(path string) *FileTokenProvider {
+	return &FileTokenProvider{path: path}
+}
+
+// Path returns the location of the token file used by this provider
+func (p *FileTokenProvider) Path() string {
+	return p.path
+}
+
+// Token returns the current contents of the token file, re-reading it if it has changed since the last call
+func (p *FileTokenProvider) Token() (*sarama.AccessToken, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	info, err := os.Stat(p.path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("kafka token file %s does not exist", p.path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat kafka token file %s: %w", p.path, err)
+	}
+
+	if p.token == "" || !info.ModTime().Equal(p.modTime) || info.Size() != p.size {
+		data, err := ioutil.ReadFile(p.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kafka token file %s: %w", p.path, err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return nil, fmt.Errorf("kafka token file %s is empty", p.path)
+		}
+		p.token = token
+		p.modTime = info.ModTime()
+		p.size = info.Size()
+	}
+
+	return &sarama.AccessToken{Token: p.token}, nil
+}
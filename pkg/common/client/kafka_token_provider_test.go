@@ -0,0 +1,65 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTokenProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-token")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kafka-token")
+
+	provider := NewFileTokenProvider(path)
+	assert.Equal(t, path, provider.Path())
+
+	// Nonexistent file
+	_, err = provider.Token()
+	assert.NotNil(t, err)
+
+	// Empty file
+	assert.Nil(t, ioutil.WriteFile(path, []byte{}, 0600))
+	_, err = provider.Token()
+	assert.NotNil(t, err)
+
+	// Valid token (trailing whitespace is removed)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token-1\n"), 0600))
+	token, err := provider.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token.Token)
+
+	// Rotated token is picked up when the file changes
+	assert.Nil(t, ioutil.WriteFile(path, []byte("token-two"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	token, err = provider.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-two", token.Token)
+
+	// Removed file is reported rather than returning the stale token
+	assert.Nil(t, os.Remove(path))
+	_, err = provider.Token()
+	assert.NotNil(t, err)
+}
@@ -18,25 +18,28 @@ import (
 )
 
 const (
-	TlsEnabled   = "tls.enabled"
-	TlsCacert    = "ca.crt"
-	TlsUsercert  = "user.crt"
-	TlsUserkey   = "user.key"
-	SaslUser     = "user"
-	SaslType     = "saslType"
-	SaslPassword = "password"
+	TlsEnabled    = "tls.enabled"
+	TlsCacert     = "ca.crt"
+	TlsUsercert   = "user.crt"
+	TlsUserkey    = "user.key"
+	TlsServerName = "tls.serverName"
+	SaslUser      = "user"
+	SaslType      = "saslType"
+	SaslPassword  = "password"
 )
 
-// parseTls allows backward-compatibility with older consolidated channel secrets
+// parseTls allows backward-compatibility with older consolidated channel secrets.  The optional tls.serverName
+// overrides the name that the broker certificates are verified against (which is otherwise the broker host).
 func parseTls(secret *corev1.Secret, kafkaAuthConfig *client.KafkaAuthConfig) {
 
 	// self-signed CERTs we need CA CERT, USER CERT and KEY
 	if string(secret.Data[TlsCacert]) != "" {
 		// We have a self-signed TLS cert
 		tls := &client.KafkaTlsConfig{
-			Cacert:   string(secret.Data[TlsCacert]),
-			Usercert: string(secret.Data[TlsUsercert]),
-			Userkey:  string(secret.Data[TlsUserkey]),
+			Cacert:     string(secret.Data[TlsCacert]),
+			Usercert:   string(secret.Data[TlsUsercert]),
+			Userkey:    string(secret.Data[TlsUserkey]),
+			ServerName: string(secret.Data[TlsServerName]),
 		}
 		kafkaAuthConfig.TLS = tls
 	} else {
@@ -48,7 +51,7 @@ func parseTls(secret *corev1.Secret, kafkaAuthConfig *client.KafkaAuthConfig) {
 		}
 		if tlsEnabled {
 			// Looks like TLS is desired/enabled:
-			kafkaAuthConfig.TLS = &client.KafkaTlsConfig{}
+			kafkaAuthConfig.TLS = &client.KafkaTlsConfig{ServerName: string(secret.Data[TlsServerName])}
 		}
 	}
 }
@@ -99,10 +102,20 @@ func GetAuthConfigFromSecret(secret *corev1.Secret) *client.KafkaAuthConfig {
 		saslType = sarama.SASLTypePlaintext
 	}
 
+	// An OAUTHBEARER token is not stored in the secret; it is read from a (projected) file that the kubelet rotates
+	tokenPath := ""
+	if saslType == sarama.SASLTypeOAuth {
+		tokenPath = string(secret.Data[constants.KafkaSecretKeyTokenPath])
+		if tokenPath == "" {
+			tokenPath = constants.DefaultKafkaTokenPath
+		}
+	}
+
 	authConfig.SASL = &client.KafkaSaslConfig{
-		User:     username,
-		Password: string(secret.Data[constants.KafkaSecretKeyPassword]),
-		SaslType: saslType,
+		User:      username,
+		Password:  string(secret.Data[constants.KafkaSecretKeyPassword]),
+		SaslType:  saslType,
+		TokenPath: tokenPath,
 	}
 
 	return &authConfig
@@ -115,6 +128,9 @@ func NumPartitions(channel *kafkav1beta1.KafkaChannel, configuration *EventingKa
 		logger.Debug("Kafka Channel Spec 'NumPartitions' Not Specified - Using Default", zap.Int32("Value", configuration.Kafka.Topic.DefaultNumPartitions))
 		value = configuration.Kafka.Topic.DefaultNumPartitions
 	}
+	if value <= 0 {
+		logger.Warn("Kafka Channel 'NumPartitions' Is Not Positive - Check The Spec And The ConfigMap Default", zap.Int32("Value", value))
+	}
 	return value
 }
 
@@ -125,5 +141,26 @@ func ReplicationFactor(channel *kafkav1beta1.KafkaChannel, configuration *Eventi
 		logger.Debug("Kafka Channel Spec 'ReplicationFactor' Not Specified - Using Default", zap.Int16("Value", configuration.Kafka.Topic.DefaultReplicationFactor))
 		value = configuration.Kafka.Topic.DefaultReplicationFactor
 	}
+	if value <= 0 {
+		logger.Warn("Kafka Channel 'ReplicationFactor' Is Not Positive - Check The Spec And The ConfigMap Default", zap.Int16("Value", value))
+	}
 	return value
 }
+
+// ValidateTopicSettings Verifies That The NumPartitions & ReplicationFactor Values Can Be Used To Create A Topic, So
+// That A Misconfiguration Is Reported Before The Topic-Creation Request.  If The Number Of Brokers In The Cluster Is
+// Known (brokerCount Greater Than Zero) A ReplicationFactor Exceeding It Is Logged As A Warning (The Cluster May Be
+// Scaled Up Before The Request).
+func ValidateTopicSettings(numPartitions int32, replicationFactor int16, brokerCount int, logger *zap.SugaredLogger) error {
+	if numPartitions <= 0 {
+		return fmt.Errorf("invalid topic settings: NumPartitions must be positive (is the defaultNumPartitions configured?), got %d", numPartitions)
+	}
+	if replicationFactor <= 0 {
+		return fmt.Errorf("invalid topic settings: ReplicationFactor must be positive (is the defaultReplicationFactor configured?), got %d", replicationFactor)
+	}
+	if brokerCount > 0 && int(replicationFactor) > brokerCount {
+		logger.Warn("Kafka Topic 'ReplicationFactor' Exceeds The Number Of Brokers - Topic Creation Will Fail",
+			zap.Int16("ReplicationFactor", replicationFactor), zap.Int("Brokers", brokerCount))
+	}
+	return nil
+}
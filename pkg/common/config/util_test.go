@@ -8,6 +8,7 @@ import (
 	"knative.dev/eventing-kafka/pkg/common/constants"
 	"knative.dev/pkg/system"
 
+	"github.com/Shopify/sarama"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
@@ -162,6 +163,21 @@ func TestGetAuthConfigFromSecret(t *testing.T) {
 				SaslPassword: []byte("test-password"),
 			},
 		},
+		{
+			name: "Valid secret, backwards-compatibility, TLS with server name",
+			data: map[string][]byte{
+				TlsCacert:     []byte("test-cacert"),
+				TlsServerName: []byte("broker.example.com"),
+				TlsEnabled:    []byte("true"),
+			},
+		},
+		{
+			name: "Valid secret, backwards-compatibility, TLS with server name without CA cert",
+			data: map[string][]byte{
+				TlsEnabled:    []byte("true"),
+				TlsServerName: []byte("broker.example.com"),
+			},
+		},
 		{
 			name: "Valid secret, backwards-compatibility, SASL, Invalid TLS",
 			data: map[string][]byte{
@@ -170,6 +186,19 @@ func TestGetAuthConfigFromSecret(t *testing.T) {
 				SaslPassword: []byte("test-password"),
 			},
 		},
+		{
+			name: "Valid secret, OAUTHBEARER with token path",
+			data: map[string][]byte{
+				constants.KafkaSecretKeySaslType:  []byte(sarama.SASLTypeOAuth),
+				constants.KafkaSecretKeyTokenPath: []byte("/test/token/path"),
+			},
+		},
+		{
+			name: "Valid secret, OAUTHBEARER without token path",
+			data: map[string][]byte{
+				constants.KafkaSecretKeySaslType: []byte(sarama.SASLTypeOAuth),
+			},
+		},
 		{
 			name:      "Valid secret, backwards-compatibility, nil data",
 			data:      nil,
@@ -202,10 +231,20 @@ func TestGetAuthConfigFromSecret(t *testing.T) {
 				assertKey(t, testCase.data, constants.KafkaSecretKeySaslType, kafkaAuth.SASL.SaslType)
 				assertKey(t, testCase.data, SaslUser, kafkaAuth.SASL.User)
 				assertKey(t, testCase.data, SaslPassword, kafkaAuth.SASL.Password)
+				if kafkaAuth.SASL.SaslType == sarama.SASLTypeOAuth {
+					if _, ok := testCase.data[constants.KafkaSecretKeyTokenPath]; ok {
+						assertKey(t, testCase.data, constants.KafkaSecretKeyTokenPath, kafkaAuth.SASL.TokenPath)
+					} else {
+						assert.Equal(t, constants.DefaultKafkaTokenPath, kafkaAuth.SASL.TokenPath)
+					}
+				} else {
+					assert.Equal(t, "", kafkaAuth.SASL.TokenPath)
+				}
 				if kafkaAuth.TLS != nil {
 					assertKey(t, testCase.data, TlsCacert, kafkaAuth.TLS.Cacert)
 					assertKey(t, testCase.data, TlsUsercert, kafkaAuth.TLS.Usercert)
 					assertKey(t, testCase.data, TlsUserkey, kafkaAuth.TLS.Userkey)
+					assertKey(t, testCase.data, TlsServerName, kafkaAuth.TLS.ServerName)
 				}
 			}
 		})
@@ -257,3 +296,31 @@ func TestReplicationFactor(t *testing.T) {
 	actualReplicationFactor = ReplicationFactor(channel, configuration, logger)
 	assert.Equal(t, replicationFactor, actualReplicationFactor)
 }
+
+// Test The ValidateTopicSettings Functionality
+func TestValidateTopicSettings(t *testing.T) {
+
+	// Test Logger
+	logger := logtesting.TestLogger(t)
+
+	for _, testCase := range []struct {
+		name              string
+		numPartitions     int32
+		replicationFactor int16
+		brokerCount       int
+		expectErr         bool
+	}{
+		{name: "Valid", numPartitions: numPartitions, replicationFactor: replicationFactor},
+		{name: "Valid With Broker Count", numPartitions: numPartitions, replicationFactor: 3, brokerCount: 3},
+		{name: "Replication Exceeds Broker Count", numPartitions: numPartitions, replicationFactor: 3, brokerCount: 1},
+		{name: "Zero NumPartitions", replicationFactor: replicationFactor, expectErr: true},
+		{name: "Negative NumPartitions", numPartitions: -1, replicationFactor: replicationFactor, expectErr: true},
+		{name: "Zero ReplicationFactor", numPartitions: numPartitions, expectErr: true},
+		{name: "Negative ReplicationFactor", numPartitions: numPartitions, replicationFactor: -1, expectErr: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := ValidateTopicSettings(testCase.numPartitions, testCase.replicationFactor, testCase.brokerCount, logger)
+			assert.Equal(t, testCase.expectErr, err != nil)
+		})
+	}
+}
@@ -58,6 +58,11 @@ const (
 	KafkaSecretKeyPassword = "password"
 	// KafkaSecretKeySaslType is the SASL type key in the Kafka Auth Config Secret
 	KafkaSecretKeySaslType = "sasltype"
+	// KafkaSecretKeyTokenPath is the OAUTHBEARER token file path key in the Kafka Auth Config Secret
+	KafkaSecretKeyTokenPath = "tokenpath"
+
+	// DefaultKafkaTokenPath is the location of the projected service-account token used with OAUTHBEARER, if not overridden
+	DefaultKafkaTokenPath = "/var/run/secrets/tokens/kafka-token"
 
 	// KnativeLoggingConfigMapNameEnvVarKey Is The Environment Variable Used For Knative Logging Configuration
 	KnativeLoggingConfigMapNameEnvVarKey = "CONFIG_LOGGING_NAME" // Note - Matches value of configMapNameEnv constant in Knative.dev/pkg/logging !
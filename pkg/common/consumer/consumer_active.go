@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// SetActive stops all of the managed groups when active is false, and restarts them when it is true, so that only
+// the leader of a set of replicas consumes (e.g. when a leader election is lost and won again).  Unlike Shutdown
+// or Export, the groups stay under management while the manager is inactive, keeping their error channels, handlers
+// and options, and are restarted with the current settings of their clusters.
+//
+// The manager is active when it is created.  Only the groups that SetActive(false) stopped are restarted by
+// SetActive(true), so a group that was stopped via the control-protocol before the manager became inactive stays
+// stopped.  While the manager is inactive, a control-protocol start command is refused, and a stop command makes
+// the group stay stopped when the manager is activated again.  Reconfigure (and the other functions that restart
+// the groups of a cluster) only replaces the settings, which are used when the groups are restarted.  A group that
+// is started while the manager is inactive (e.g. via StartConsumerGroup or Import) consumes as usual until
+// SetActive(false) is called again.
+//
+// SetActive is idempotent: a repeated call stops (or restarts) the groups that were not stopped (or restarted) by
+// the previous one, such as those that were locked by a control-protocol command at the time.  The returned error
+// aggregates the failures of the individual groups; the manager changes its state regardless.  Calls are serialized
+// with each other and with the Reconfigure functions.
+func (m *kafkaConsumerGroupManagerImpl) SetActive(active bool) error {
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+
+	if active {
+		atomic.StoreInt32(&m.inactive, 0)
+		return m.resumeSuspendedGroups()
+	}
+	atomic.StoreInt32(&m.inactive, 1)
+	return m.suspendGroups()
+}
+
+// IsActive returns false if the manager has been made inactive via SetActive(false)
+func (m *kafkaConsumerGroupManagerImpl) IsActive() bool {
+	return atomic.LoadInt32(&m.inactive) == 0
+}
+
+// suspendGroups stops every managed group that is running and records it as suspended, so that it is restarted
+// by resumeSuspendedGroups.  The caller must hold the reconfigureLock.
+func (m *kafkaConsumerGroupManagerImpl) suspendGroups() error {
+	m.logger.Info("Deactivating Consumer Group Manager - Stopping All Managed Consumer Groups")
+	groupIds := m.getGroupIds()
+	sort.Strings(groupIds)
+	var errs error
+	for _, groupId := range groupIds {
+		managedGrp := m.getGroup(groupId)
+		if managedGrp == nil || managedGrp.isStopped() || managedGrp.isDead() {
+			continue // Neither running nor able to be restarted
+		}
+		// Marked before stopping, so that a control-protocol stop that arrives meanwhile still takes precedence
+		m.setSuspended(groupId, true)
+		err := m.stopConsumerGroup(&commands.CommandLock{Token: internalToken, LockBefore: true, UnlockAfter: true}, groupId)
+		if err != nil {
+			m.setSuspended(groupId, false)
+			errs = multierr.Append(errs, fmt.Errorf("could not stop consumer group with id '%s' - %w", groupId, err))
+		}
+	}
+	return errs
+}
+
+// resumeSuspendedGroups restarts the groups that suspendGroups stopped and that are still managed and stopped.
+// The caller must hold the reconfigureLock.
+func (m *kafkaConsumerGroupManagerImpl) resumeSuspendedGroups() error {
+	m.logger.Info("Activating Consumer Group Manager - Starting Suspended Consumer Groups")
+	var errs error
+	started := make(map[string]error)
+	for _, groupId := range m.startOrder(m.getSuspendedGroupIds()) {
+		managedGrp := m.getGroup(groupId)
+		if managedGrp == nil || !managedGrp.isStopped() {
+			m.setSuspended(groupId, false) // Closed, or started by something other than SetActive
+			continue
+		}
+		err := m.startWithDependencies(&commands.CommandLock{Token: internalToken, LockBefore: true, UnlockAfter: true}, groupId, started)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not start consumer group with id '%s' - %w", groupId, err))
+			continue
+		}
+		m.setSuspended(groupId, false)
+	}
+	return errs
+}
+
+// startRefusedWhileInactive returns true if a start with the given lock must be refused because the manager is
+// inactive, which is any start other than the internal ones of the manager
+func (m *kafkaConsumerGroupManagerImpl) startRefusedWhileInactive(lock *commands.CommandLock) bool {
+	return !m.IsActive() && (lock == nil || lock.Token != internalToken)
+}
+
+// setSuspended adds the groupId to, or removes it from, the set of suspended groups using the suspendLock mutex
+func (m *kafkaConsumerGroupManagerImpl) setSuspended(groupId string, suspended bool) {
+	m.suspendLock.Lock()
+	defer m.suspendLock.Unlock()
+	if !suspended {
+		delete(m.suspended, groupId)
+		return
+	}
+	if m.suspended == nil {
+		m.suspended = make(map[string]bool)
+	}
+	m.suspended[groupId] = true
+}
+
+// getSuspendedGroupIds returns a sorted snapshot of the suspended groupIds using the suspendLock mutex
+func (m *kafkaConsumerGroupManagerImpl) getSuspendedGroupIds() []string {
+	m.suspendLock.Lock()
+	defer m.suspendLock.Unlock()
+	groupIds := make([]string, 0, len(m.suspended))
+	for groupId := range m.suspended {
+		groupIds = append(groupIds, groupId)
+	}
+	sort.Strings(groupIds)
+	return groupIds
+}
+
+// logInactive logs that a restart of the groups was skipped because the manager is inactive
+func (m *kafkaConsumerGroupManagerImpl) logInactive(cluster string) {
+	m.logger.Info("Consumer Group Manager Inactive - Not Restarting Managed Consumer Groups", zap.String("Cluster", cluster))
+}
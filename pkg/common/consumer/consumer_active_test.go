@@ -0,0 +1,102 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+func TestSetActive(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	logger := zap.NewNop().Sugar()
+
+	// Record the brokers that each group was (re-)created with
+	var brokersLock sync.Mutex
+	brokers := make(map[string][]string)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		brokersLock.Lock()
+		defer brokersLock.Unlock()
+		brokers[groupID] = append(brokers[groupID], addrs...)
+		return &mockConsumerGroup{}, nil
+	}
+	groupBrokers := func(groupId string) []string {
+		brokersLock.Lock()
+		defer brokersLock.Unlock()
+		return brokers[groupId]
+	}
+
+	for _, groupId := range []string{"group-1", "group-2", "group-3", "group-locked"} {
+		assert.Nil(t, manager.StartConsumerGroup(groupId, []string{"topic"}, logger, mockMessageHandler{}))
+	}
+	// A group stopped via the control-protocol beforehand is not restarted on activation
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-3"))
+	// A group that is locked by a control-protocol client cannot be stopped until it is unlocked
+	clientLock := &commands.CommandLock{Token: "client-token", Timeout: time.Minute, LockBefore: true, UnlockAfter: true}
+	assert.Nil(t, impl.getGroup("group-locked").processLock(clientLock, true))
+
+	assert.True(t, manager.IsActive())
+	assert.NotNil(t, manager.SetActive(false))
+	assert.False(t, manager.IsActive())
+	assert.True(t, manager.IsStopped("group-1"))
+	assert.True(t, manager.IsStopped("group-2"))
+	assert.False(t, manager.IsStopped("group-locked"))
+
+	// Calling it again stops the groups that could not be stopped before
+	assert.Nil(t, impl.getGroup("group-locked").processLock(clientLock, false))
+	assert.Nil(t, manager.SetActive(false))
+	assert.True(t, manager.IsStopped("group-locked"))
+	assert.True(t, manager.IsManaged("group-1"))
+
+	// While inactive, control-protocol starts are refused, stops are kept, and Reconfigure restarts nothing
+	assert.NotNil(t, impl.startConsumerGroup(nil, "group-1"))
+	assert.True(t, manager.IsStopped("group-1"))
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-2"))
+	assert.Nil(t, manager.Reconfigure([]string{"b1"}, &sarama.Config{}))
+	assert.Empty(t, groupBrokers("group-1"))
+
+	// Activation restarts the suspended groups with the current settings
+	assert.Nil(t, manager.SetActive(true))
+	assert.True(t, manager.IsActive())
+	assert.False(t, manager.IsStopped("group-1"))
+	assert.False(t, manager.IsStopped("group-locked"))
+	assert.True(t, manager.IsStopped("group-2"))
+	assert.True(t, manager.IsStopped("group-3"))
+	assert.Equal(t, []string{"b1"}, groupBrokers("group-1"))
+	assert.Empty(t, groupBrokers("group-2"))
+
+	// Activating an active manager does nothing
+	assert.Nil(t, manager.SetActive(true))
+	assert.Equal(t, []string{"b1"}, groupBrokers("group-1"))
+
+	// The control-protocol can start groups again
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-2"))
+	assert.False(t, manager.IsStopped("group-2"))
+
+	for _, groupId := range []string{"group-1", "group-2", "group-3", "group-locked"} {
+		assert.Nil(t, manager.CloseConsumerGroup(groupId))
+	}
+}
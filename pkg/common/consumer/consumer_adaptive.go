@@ -0,0 +1,158 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// defaultAdaptiveRateInterval is the interval at which the adaptive rate limit is adjusted, if not specified
+const defaultAdaptiveRateInterval = 5 * time.Second
+
+// defaultAdaptiveErrorThreshold is the share of failed messages above which the adaptive rate limit is decreased,
+// if not specified
+const defaultAdaptiveErrorThreshold = 0.1
+
+// defaultAdaptiveDecreaseFactor is what the adaptive rate limit is multiplied by when it is decreased, if not specified
+const defaultAdaptiveDecreaseFactor = 0.5
+
+// AdaptiveRateLimitOptions contains the settings used by WithAdaptiveRateLimit
+type AdaptiveRateLimitOptions struct {
+	MinRate        float64       // The lowest rate that the limit is decreased to (default is 1% of the maximum rate)
+	ErrorThreshold float64       // The share of failed messages above which the rate is decreased (default is 0.1)
+	DecreaseFactor float64       // What the rate is multiplied by when it is decreased, below one (default is 0.5)
+	IncreaseStep   float64       // How much the rate is increased by (default is 10% of the maximum rate)
+	Interval       time.Duration // How often the rate is adjusted (default is five seconds)
+}
+
+// WithAdaptiveRateLimit caps the number of messages per second that are passed to the handler like WithRateLimit
+// (with a burst of one), but adjusts the cap to the failures of the handler, so that a ConsumerGroup backs off from
+// a struggling downstream without manual tuning.  The rate starts at maxRate, and at the end of each interval it is
+// multiplied by the DecreaseFactor if the share of the messages handled during the interval that failed is above
+// the ErrorThreshold, or otherwise increased by the IncreaseStep (additive increase, multiplicative decrease), staying
+// between the MinRate and maxRate.  A message fails if the handler returns an error (other than ErrSkipMessage), in
+// the same way as the errors sent to the errors channel.  The rate is adjusted when a message is handled after the
+// end of the interval, so it is not increased while nothing is consumed, and each adjustment is logged.  Each
+// ConsumerGroup that the option is given to has a limit of its own, which is shared by all of its partitions and
+// sessions, and it takes the place of WithRateLimit.  Default is no adaptive limit; a maxRate of zero or less also
+// means none, and the options that are out of range mean their defaults.
+func WithAdaptiveRateLimit(maxRate float64, options AdaptiveRateLimitOptions) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.adaptiveMaxRate = maxRate
+		handler.adaptiveOptions = options
+	}
+}
+
+// adaptiveRateLimiter adjusts the limit of a rate.Limiter to the share of the handled messages that failed
+type adaptiveRateLimiter struct {
+	limiter        *rate.Limiter
+	maxRate        float64
+	minRate        float64
+	errorThreshold float64
+	decreaseFactor float64
+	increaseStep   float64
+	interval       time.Duration
+
+	lock        sync.Mutex
+	windowStart time.Time // When the current interval started (zero until the first message is handled)
+	handled     int
+	failed      int
+}
+
+// newAdaptiveRateLimiter returns an adaptiveRateLimiter that starts at the maximum rate, with the defaults applied to
+// the options that are out of range, or nil if the maximum rate is zero or less
+func newAdaptiveRateLimiter(maxRate float64, options AdaptiveRateLimitOptions) *adaptiveRateLimiter {
+	if maxRate <= 0 {
+		return nil
+	}
+	if options.MinRate <= 0 || options.MinRate > maxRate {
+		options.MinRate = maxRate / 100
+	}
+	if options.ErrorThreshold <= 0 || options.ErrorThreshold >= 1 {
+		options.ErrorThreshold = defaultAdaptiveErrorThreshold
+	}
+	if options.DecreaseFactor <= 0 || options.DecreaseFactor >= 1 {
+		options.DecreaseFactor = defaultAdaptiveDecreaseFactor
+	}
+	if options.IncreaseStep <= 0 {
+		options.IncreaseStep = maxRate / 10
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultAdaptiveRateInterval
+	}
+	return &adaptiveRateLimiter{
+		limiter:        rate.NewLimiter(rate.Limit(maxRate), 1),
+		maxRate:        maxRate,
+		minRate:        options.MinRate,
+		errorThreshold: options.ErrorThreshold,
+		decreaseFactor: options.DecreaseFactor,
+		increaseStep:   options.IncreaseStep,
+		interval:       options.Interval,
+	}
+}
+
+// record counts a handled message (and whether it failed), and adjusts the rate if the interval has ended, returning
+// the new rate and whether it changed
+func (a *adaptiveRateLimiter) record(failed bool, now time.Time) (float64, bool) {
+	if a == nil {
+		return 0, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.windowStart.IsZero() {
+		a.windowStart = now
+	}
+	a.handled++
+	if failed {
+		a.failed++
+	}
+	if now.Sub(a.windowStart) < a.interval {
+		return 0, false
+	}
+
+	current := float64(a.limiter.Limit())
+	adjusted := current
+	if float64(a.failed)/float64(a.handled) > a.errorThreshold {
+		adjusted = current * a.decreaseFactor
+		if adjusted < a.minRate {
+			adjusted = a.minRate
+		}
+	} else {
+		adjusted = current + a.increaseStep
+		if adjusted > a.maxRate {
+			adjusted = a.maxRate
+		}
+	}
+	a.windowStart, a.handled, a.failed = now, 0, 0
+	if adjusted == current {
+		return current, false
+	}
+	a.limiter.SetLimitAt(now, rate.Limit(adjusted))
+	return adjusted, true
+}
+
+// recordOutcome counts the outcome of a handled message towards the adaptive rate limit (if any), and logs the
+// adjustments of the limit
+func (consumer *SaramaConsumerHandler) recordOutcome(err error) {
+	if adjusted, changed := consumer.adaptiveRate.record(err != nil, time.Now()); changed {
+		consumer.logger.Infow("Adapted rate limit to the handler failures", zap.Float64("rate", adjusted))
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWithAdaptiveRateLimit(t *testing.T) {
+	handler := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, WithAdaptiveRateLimit(0, AdaptiveRateLimitOptions{}))
+	assert.Nil(t, handler.adaptiveRate)
+
+	option := WithAdaptiveRateLimit(200, AdaptiveRateLimitOptions{MinRate: 300, ErrorThreshold: 1, DecreaseFactor: 2})
+	handler = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, option)
+	limiter := handler.adaptiveRate
+	assert.NotNil(t, limiter)
+	assert.Equal(t, 200.0, float64(limiter.limiter.Limit()))
+	assert.Equal(t, 2.0, limiter.minRate)
+	assert.Equal(t, defaultAdaptiveErrorThreshold, limiter.errorThreshold)
+	assert.Equal(t, defaultAdaptiveDecreaseFactor, limiter.decreaseFactor)
+	assert.Equal(t, 20.0, limiter.increaseStep)
+	assert.Equal(t, defaultAdaptiveRateInterval, limiter.interval)
+
+	// Each group that is given the option has its own limiter, which the sessions of the group share
+	other := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, option)
+	assert.NotSame(t, limiter, other.adaptiveRate)
+	other = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, withGroupState(&groupState{adaptiveRate: limiter}), option)
+	assert.Same(t, limiter, other.adaptiveRate)
+}
+
+func TestAdaptiveRateLimiter(t *testing.T) {
+	limiter := newAdaptiveRateLimiter(100, AdaptiveRateLimitOptions{MinRate: 20, ErrorThreshold: 0.25, IncreaseStep: 15, Interval: time.Second})
+	start := time.Now()
+	at := func(millis int) time.Time { return start.Add(time.Duration(millis) * time.Millisecond) }
+
+	// Healthy at the maximum rate, which is not exceeded
+	_, changed := limiter.record(false, at(0))
+	assert.False(t, changed)
+	_, changed = limiter.record(false, at(1000))
+	assert.False(t, changed)
+
+	// Half of the messages of the interval fail, so the rate is halved, twice, and then stays at the minimum
+	_, changed = limiter.record(true, at(1500))
+	assert.False(t, changed)
+	adjusted, changed := limiter.record(false, at(2000))
+	assert.True(t, changed)
+	assert.Equal(t, 50.0, adjusted)
+	limiter.record(true, at(2100))
+	adjusted, _ = limiter.record(false, at(3000))
+	assert.Equal(t, 25.0, adjusted)
+	limiter.record(true, at(3100))
+	adjusted, _ = limiter.record(true, at(4000))
+	assert.Equal(t, 20.0, adjusted)
+	assert.Equal(t, 20.0, float64(limiter.limiter.Limit()))
+
+	// A share of failures at the threshold is healthy, so the rate increases back to the maximum in steps
+	limiter.record(false, at(4100))
+	limiter.record(false, at(4200))
+	limiter.record(true, at(4300))
+	adjusted, _ = limiter.record(false, at(5000))
+	assert.Equal(t, 35.0, adjusted)
+	for millis := 6000; millis <= 10000; millis += 1000 {
+		adjusted, _ = limiter.record(false, at(millis))
+	}
+	assert.Equal(t, 100.0, adjusted)
+	assert.Equal(t, 100.0, float64(limiter.limiter.Limit()))
+
+	var none *adaptiveRateLimiter
+	_, changed = none.record(true, at(0))
+	assert.False(t, changed)
+}
+
+func TestAdaptiveRateLimitFailures(t *testing.T) {
+	messages := make([]*sarama.ConsumerMessage, 5)
+	for i := range messages {
+		messages[i] = &sarama.ConsumerMessage{Offset: int64(i)}
+	}
+	errorCh := make(chan error, len(messages))
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldErr: true}, errorCh,
+		WithRateLimit(1, 1), WithAdaptiveRateLimit(1000, AdaptiveRateLimitOptions{Interval: time.Nanosecond}))
+
+	// The adaptive limit is used instead of the fixed one, and is decreased by the failures
+	start := time.Now()
+	assert.Nil(t, cgh.ConsumeClaim(&mockConsumerGroupSession{}, multiMessageClaim{messages: messages}))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Len(t, errorCh, len(messages))
+	assert.Less(t, float64(cgh.adaptiveRate.limiter.Limit()), 1000.0)
+}
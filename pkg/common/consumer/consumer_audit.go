@@ -0,0 +1,221 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/zap"
+)
+
+// partitionMismatchesMetric is the name of the counter, in the MetricRegistry of the sarama config, of the messages
+// that arrived on a different partition than the one that their key routes to (see WithPartitionAudit).  As with the
+// join latency, the same count is also kept in a "consumer-partition-mismatches-for-group-<GroupId>" counter.
+const partitionMismatchesMetric = "consumer-partition-mismatches"
+
+// partitionCountRetryInterval is how long the partition audit waits before asking the brokers again for the number
+// of partitions of a topic after failing to obtain it, during which the messages of the topic are not audited
+const partitionCountRetryInterval = 30 * time.Second
+
+// partitionAuditConfig is the expected partitioner, and where the key comes from, of WithPartitionAudit
+type partitionAuditConfig struct {
+	partitioner sarama.PartitionerConstructor
+	keyHeader   string
+}
+
+// WithPartitionAudit checks, for each message, that the partition it arrived on is the one that the given
+// partitioner routes its key to, which detects producers that use a different partitioner (or number of partitions)
+// than the consumers expect.  The key is that of the message, or the value of the given header if keyHeader is not
+// empty.  Messages without a key, and partitioners that do not route consistently (such as the random partitioner),
+// are not audited.  The check is purely observational: a mismatch is logged and counted (see the
+// "consumer-partition-mismatches" counter in the MetricRegistry of the sarama config, if there is one), and the
+// message is handled as usual.  It runs as the outermost interceptor, so it sees the messages that the interceptors
+// of WithInterceptor do not pass on.  Since the number of partitions of each topic is obtained from the brokers, this
+// option has no effect on a ConsumerGroup that is not started by the factory, and the messages of a topic are not
+// audited for a while after the brokers failed to provide its number of partitions.  Default is no audit.
+func WithPartitionAudit(partitioner sarama.PartitionerConstructor, keyHeader string) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.partitionAudit = &partitionAuditConfig{partitioner: partitioner, keyHeader: keyHeader}
+	}
+}
+
+// partitionAuditor holds the state of the partition audit of a ConsumerGroup
+type partitionAuditor struct {
+	mismatches  int64 // Accessed atomically
+	createAdmin func() (sarama.ClusterAdmin, error)
+	all         gometrics.Counter
+	group       gometrics.Counter
+	lock        sync.Mutex                       // Also serializes the use of the partitioners, which are not goroutine-safe
+	partitions  map[string]int32                 // The number of partitions of each topic, as last obtained from the brokers
+	failures    map[string]partitionCountFailure // The last failure to obtain the number of partitions of each topic
+	partitioner map[string]sarama.Partitioner
+}
+
+// partitionCountFailure is a failure to obtain the number of partitions of a topic, which is not retried until the
+// partitionCountRetryInterval has passed
+type partitionCountFailure struct {
+	at  time.Time
+	err error
+}
+
+// newPartitionAuditor returns a partitionAuditor that also counts in the given registry, unless the registry is nil
+func newPartitionAuditor(registry gometrics.Registry, groupId string, createAdmin func() (sarama.ClusterAdmin, error)) *partitionAuditor {
+	auditor := &partitionAuditor{
+		createAdmin: createAdmin,
+		partitions:  make(map[string]int32),
+		failures:    make(map[string]partitionCountFailure),
+		partitioner: make(map[string]sarama.Partitioner),
+	}
+	if registry != nil {
+		auditor.all = registry.GetOrRegister(partitionMismatchesMetric, gometrics.NewCounter).(gometrics.Counter)
+		auditor.group = registry.GetOrRegister(groupMetricName(partitionMismatchesMetric, groupId), gometrics.NewCounter).(gometrics.Counter)
+	}
+	return auditor
+}
+
+// mismatchCount returns the number of messages that arrived on a different partition than expected
+func (a *partitionAuditor) mismatchCount() int64 {
+	return atomic.LoadInt64(&a.mismatches)
+}
+
+// recordMismatch counts a message that arrived on a different partition than expected
+func (a *partitionAuditor) recordMismatch() {
+	atomic.AddInt64(&a.mismatches, 1)
+	if a.all != nil {
+		a.all.Inc(1)
+		a.group.Inc(1)
+	}
+}
+
+// partitionCount returns the number of partitions of the topic, obtaining it from the brokers if it is not known or
+// if the message arrived on a partition beyond it (as happens when partitions are added to the topic).  A failure to
+// obtain it is returned again, without asking the brokers, until the partitionCountRetryInterval has passed.
+func (a *partitionAuditor) partitionCount(topic string, partition int32) (int32, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if count, ok := a.partitions[topic]; ok && partition < count {
+		return count, nil
+	}
+	if failure, ok := a.failures[topic]; ok && time.Since(failure.at) < partitionCountRetryInterval {
+		return 0, failure.err
+	}
+	count, err := a.listPartitionCount(topic)
+	if err != nil {
+		a.failures[topic] = partitionCountFailure{at: time.Now(), err: err}
+		return 0, err
+	}
+	delete(a.failures, topic)
+	a.partitions[topic] = count
+	return count, nil
+}
+
+// listPartitionCount obtains the number of partitions of the topic from the brokers
+func (a *partitionAuditor) listPartitionCount(topic string) (int32, error) {
+	admin, err := a.createAdmin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return 0, err
+	}
+	detail, ok := topics[topic]
+	if !ok {
+		return 0, fmt.Errorf("topic '%s' does not exist", topic)
+	}
+	return detail.NumPartitions, nil
+}
+
+// topicPartitioner returns the partitioner of the topic, created with the given constructor the first time.  The
+// partitioner must only be used via expectedPartition, since it is shared by the sessions of the ConsumerGroup.
+func (a *partitionAuditor) topicPartitioner(topic string, constructor sarama.PartitionerConstructor) sarama.Partitioner {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	partitioner, ok := a.partitioner[topic]
+	if !ok {
+		partitioner = constructor(topic)
+		a.partitioner[topic] = partitioner
+	}
+	return partitioner
+}
+
+// expectedPartition returns the partition that the partitioner routes the key to, given the number of partitions
+func (a *partitionAuditor) expectedPartition(partitioner sarama.Partitioner, topic string, key []byte, count int32) (int32, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return partitioner.Partition(&sarama.ProducerMessage{Topic: topic, Key: sarama.ByteEncoder(key)}, count)
+}
+
+// auditKey returns the key of the message that WithPartitionAudit routes by, or nil if there is none
+func (config *partitionAuditConfig) auditKey(message *sarama.ConsumerMessage) []byte {
+	if config.keyHeader == "" {
+		return message.Key
+	}
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == config.keyHeader {
+			return header.Value
+		}
+	}
+	return nil
+}
+
+// auditPartition is the Interceptor of WithPartitionAudit, which checks the partition of each message before passing
+// it on to the rest of the chain
+func (consumer *SaramaConsumerHandler) auditPartition(next HandleFunc) HandleFunc {
+	return func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+		consumer.checkPartition(message)
+		return next(ctx, message)
+	}
+}
+
+// checkPartition logs and counts the message if the key routes to a different partition than the one it arrived on
+func (consumer *SaramaConsumerHandler) checkPartition(message *sarama.ConsumerMessage) {
+	key := consumer.partitionAudit.auditKey(message)
+	if key == nil {
+		return
+	}
+	partitioner := consumer.partitionAuditor.topicPartitioner(message.Topic, consumer.partitionAudit.partitioner)
+	if !partitioner.RequiresConsistency() {
+		return
+	}
+	count, err := consumer.partitionAuditor.partitionCount(message.Topic, message.Partition)
+	if err != nil {
+		consumer.logger.Debugw("Could not obtain the number of partitions for the partition audit",
+			zap.String("topic", message.Topic), zap.Error(err))
+		return
+	}
+	expected, err := consumer.partitionAuditor.expectedPartition(partitioner, message.Topic, key, count)
+	if err != nil {
+		consumer.logger.Debugw("Could not determine the expected partition for the partition audit",
+			zap.String("topic", message.Topic), zap.Error(err))
+		return
+	}
+	if expected != message.Partition {
+		consumer.partitionAuditor.recordMismatch()
+		consumer.logger.Warnw("Message arrived on a different partition than its key routes to", zap.String("topic", message.Topic),
+			zap.Int32("partition", message.Partition), zap.Int32("expectedPartition", expected), zap.Int64("offset", message.Offset))
+	}
+}
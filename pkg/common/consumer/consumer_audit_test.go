@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// expectedPartition returns the partition that the hash partitioner routes the key to
+func expectedPartition(t *testing.T, key string, partitions int32) int32 {
+	partition, err := sarama.NewHashPartitioner("test-topic").Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key)}, partitions)
+	assert.Nil(t, err)
+	return partition
+}
+
+func TestPartitionAudit(t *testing.T) {
+	correct := expectedPartition(t, "key", 4)
+	wrong := (correct + 1) % 4
+	for _, testCase := range []struct {
+		name             string
+		partitioner      sarama.PartitionerConstructor
+		keyHeader        string
+		message          *sarama.ConsumerMessage
+		adminErr         error
+		expectMismatches int64
+	}{
+		{
+			name:        "Correct Partition",
+			partitioner: sarama.NewHashPartitioner,
+			message:     &sarama.ConsumerMessage{Topic: "test-topic", Partition: correct, Key: []byte("key")},
+		},
+		{
+			name:             "Wrong Partition",
+			partitioner:      sarama.NewHashPartitioner,
+			message:          &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong, Key: []byte("key")},
+			expectMismatches: 1,
+		},
+		{
+			name:        "Key Header",
+			partitioner: sarama.NewHashPartitioner,
+			keyHeader:   "partition-key",
+			message: &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong, Key: []byte("other"),
+				Headers: []*sarama.RecordHeader{{Key: []byte("partition-key"), Value: []byte("key")}}},
+			expectMismatches: 1,
+		},
+		{
+			name:        "Missing Key Header",
+			partitioner: sarama.NewHashPartitioner,
+			keyHeader:   "partition-key",
+			message:     &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong, Key: []byte("key")},
+		},
+		{
+			name:        "No Key",
+			partitioner: sarama.NewHashPartitioner,
+			message:     &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong},
+		},
+		{
+			name:        "Inconsistent Partitioner",
+			partitioner: sarama.NewRandomPartitioner,
+			message:     &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong, Key: []byte("key")},
+		},
+		{
+			name:        "Admin Error",
+			partitioner: sarama.NewHashPartitioner,
+			message:     &sarama.ConsumerMessage{Topic: "test-topic", Partition: wrong, Key: []byte("key")},
+			adminErr:    fmt.Errorf("list error"),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			admin := &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"test-topic": {NumPartitions: 4}}, err: testCase.adminErr}
+			registry := gometrics.NewRegistry()
+			auditor := newPartitionAuditor(registry, "group-id", func() (sarama.ClusterAdmin, error) { return admin, nil })
+			handled := false
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+				WithPartitionAudit(testCase.partitioner, testCase.keyHeader), withGroupState(&groupState{auditor: auditor}),
+				WithInterceptor(func(next HandleFunc) HandleFunc {
+					return func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+						handled = true
+						return false, nil // Short-circuits the chain, which does not prevent the audit
+					}
+				}))
+
+			_, err := cgh.handleMessage(context.Background(), mockMessageHandler{}, testCase.message)
+			assert.Nil(t, err)
+			assert.True(t, handled)
+			assert.Equal(t, testCase.expectMismatches, auditor.mismatchCount())
+			assert.Equal(t, testCase.expectMismatches, registry.Get(partitionMismatchesMetric).(gometrics.Counter).Count())
+			assert.Equal(t, testCase.expectMismatches, registry.Get(partitionMismatchesMetric+"-for-group-group-id").(gometrics.Counter).Count())
+		})
+	}
+}
+
+func TestPartitionAuditConcurrent(t *testing.T) {
+	admin := &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"test-topic": {NumPartitions: 4}}}
+	auditor := newPartitionAuditor(nil, "group-id", func() (sarama.ClusterAdmin, error) { return admin, nil })
+	_, _ = auditor.partitionCount("test-topic", 0) // So that the goroutines only share the partitioner
+
+	// The sessions of a ConsumerGroup share the auditor, and each of their partitions has a goroutine of its own
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+			WithPartitionAudit(sarama.NewHashPartitioner, ""), withGroupState(&groupState{auditor: auditor}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d", j)
+				message := &sarama.ConsumerMessage{Topic: "test-topic", Partition: expectedPartition(t, key, 4), Key: []byte(key)}
+				_, _ = cgh.handleMessage(context.Background(), mockMessageHandler{}, message)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(0), auditor.mismatchCount())
+}
+
+// countingTopicsClusterAdmin is a topicsClusterAdmin that counts the calls to ListTopics
+type countingTopicsClusterAdmin struct {
+	topicsClusterAdmin
+	lists int
+}
+
+func (a *countingTopicsClusterAdmin) ListTopics() (map[string]sarama.TopicDetail, error) {
+	a.lists++
+	return a.topicsClusterAdmin.ListTopics()
+}
+
+func TestPartitionCount(t *testing.T) {
+	admin := &countingTopicsClusterAdmin{topicsClusterAdmin: topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"test-topic": {NumPartitions: 2}}}}
+	auditor := newPartitionAuditor(nil, "group-id", func() (sarama.ClusterAdmin, error) { return admin, nil })
+
+	count, err := auditor.partitionCount("test-topic", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), count)
+	assert.True(t, admin.closed)
+	_, _ = auditor.partitionCount("test-topic", 0)
+	assert.Equal(t, 1, admin.lists) // Known, so not obtained again
+
+	// A partition beyond the known count means that partitions were added
+	admin.topics = map[string]sarama.TopicDetail{"test-topic": {NumPartitions: 3}}
+	count, err = auditor.partitionCount("test-topic", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), count)
+	assert.Equal(t, 2, admin.lists)
+
+	_, err = auditor.partitionCount("missing-topic", 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, admin.lists)
+
+	// A failure is not retried until the retry interval has passed
+	admin.topics = map[string]sarama.TopicDetail{"missing-topic": {NumPartitions: 1}}
+	_, err = auditor.partitionCount("missing-topic", 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, admin.lists)
+	auditor.failures["missing-topic"] = partitionCountFailure{at: time.Now().Add(-partitionCountRetryInterval)}
+	count, err = auditor.partitionCount("missing-topic", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), count)
+	assert.Equal(t, 4, admin.lists)
+
+	// Without a MetricRegistry, the mismatches are still counted
+	auditor.recordMismatch()
+	assert.Equal(t, int64(1), auditor.mismatchCount())
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/multierr"
+)
+
+// WithPreferredBrokers makes the factory bootstrap its ConsumerGroups from the given brokers (such as those in the
+// local region of a stretch cluster) rather than from all of its brokers, so that the initial metadata requests, and
+// the discovery of the group coordinator, go to the preferred brokers.  Sarama picks among the bootstrap brokers at
+// random, so their order is not significant, and the other brokers are still discovered (and used for fetching)
+// via the metadata.  If none of the preferred brokers can be reached, the group is created from all of the brokers
+// instead.  The preferred brokers must be among the brokers of the factory, otherwise creating a group fails (which
+// also applies to the brokers given to Reconfigure, since the factory options are kept).  Default is to bootstrap from
+// all of the brokers.
+func WithPreferredBrokers(brokers ...string) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.preferredBrokers = brokers
+	}
+}
+
+// checkPreferredBrokers returns an error if any of the preferred brokers is not among the brokers of the factory
+func (c kafkaConsumerGroupFactoryImpl) checkPreferredBrokers() error {
+	configured := make(map[string]bool, len(c.addrs))
+	for _, addr := range c.addrs {
+		configured[addr] = true
+	}
+	var unknown []string
+	for _, addr := range c.preferredBrokers {
+		if !configured[addr] {
+			unknown = append(unknown, addr)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("preferred brokers %v are not among the configured brokers %v", unknown, c.addrs)
+	}
+	return nil
+}
+
+// createPreferredConsumerGroup creates the sarama ConsumerGroup from the preferred brokers of the factory, if there
+// are any, and from all of its brokers if there are none (or none of them could be reached)
+func (c kafkaConsumerGroupFactoryImpl) createPreferredConsumerGroup(groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+	if len(c.preferredBrokers) == 0 {
+		return c.createConsumerGroupFrom(c.addrs, groupID, config)
+	}
+	if err := c.checkPreferredBrokers(); err != nil {
+		return nil, err
+	}
+	group, preferredErr := c.createConsumerGroupFrom(c.preferredBrokers, groupID, config)
+	if preferredErr == nil {
+		return group, nil
+	}
+	group, err := c.createConsumerGroupFrom(c.addrs, groupID, config)
+	if err != nil {
+		return nil, multierr.Append(fmt.Errorf("could not bootstrap from the preferred brokers: %w", preferredErr), err)
+	}
+	return group, nil
+}
+
+// createConsumerGroupFrom creates the sarama ConsumerGroup with the given bootstrap brokers, from the shared client
+// if the factory has one and the config is that of the factory
+func (c kafkaConsumerGroupFactoryImpl) createConsumerGroupFrom(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+	if c.sharedClient != nil && config == c.config {
+		return c.sharedClient.createConsumerGroup(addrs, c.brokerGroupId(groupID), config)
+	}
+	return newConsumerGroup(addrs, c.brokerGroupId(groupID), config)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferredBrokers(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name          string
+		preferred     []string
+		unreachable   bool
+		expectAttempt [][]string
+		expectErr     string
+	}{
+		{
+			name:          "No Preferred Brokers",
+			expectAttempt: [][]string{{"b1", "b2", "b3"}},
+		},
+		{
+			name:          "Preferred Brokers",
+			preferred:     []string{"b3", "b1"},
+			expectAttempt: [][]string{{"b3", "b1"}},
+		},
+		{
+			name:          "Preferred Brokers Unreachable",
+			preferred:     []string{"b2"},
+			unreachable:   true,
+			expectAttempt: [][]string{{"b2"}, {"b1", "b2", "b3"}},
+		},
+		{
+			name:      "Preferred Brokers Not Configured",
+			preferred: []string{"b1", "b4"},
+			expectErr: "preferred brokers [b4] are not among the configured brokers [b1 b2 b3]",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var attempts [][]string
+			newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+				attempts = append(attempts, addrs)
+				if testCase.unreachable && len(attempts) == 1 {
+					return nil, fmt.Errorf("out of brokers")
+				}
+				return &mockConsumerGroup{}, nil
+			}
+			factory := newConsumerGroupFactory([]string{"b1", "b2", "b3"}, sarama.NewConfig(), WithPreferredBrokers(testCase.preferred...))
+			group, err := factory.createConsumerGroup("group")
+			assert.Equal(t, testCase.expectAttempt, attempts)
+			if testCase.expectErr != "" {
+				assert.EqualError(t, err, testCase.expectErr)
+				assert.Nil(t, group)
+			} else {
+				assert.Nil(t, err)
+				assert.NotNil(t, group)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// minMemoryShare is the smallest share of the memory budget that a group is given, however many groups there are
+const minMemoryShare = 32 * 1024
+
+// WithMemoryBudget makes the manager keep the data buffered by all of its groups (those of every cluster) under the
+// given number of bytes, by dividing the budget equally among the running managed groups (a stopped group buffers
+// nothing).  The share of each group limits the size of its fetch requests (Consumer.Fetch.Default and
+// Consumer.Fetch.Min), and the channel buffers of its partitions (ChannelBufferSize) are reduced in the same
+// proportion as the fetch size.  The share is rounded down to a power of two (and is at least 32KiB), so that it only
+// changes when the number of groups roughly doubles or halves.  When a group is started (or restarted) or closed and
+// the share changes as a result, the manager restarts the running groups that were created with a different share
+// in the background, so that they are re-created with the new one; a stopped group is given the current share when
+// it is started, and its share is only divided among the others the next time a group is started or closed.
+// Consumer.Fetch.Max is not changed, so a message that is larger than the share is still consumed.  A group with a
+// share of the budget does not use the shared client of WithSharedClient, and the groups added via AddExistingGroup are
+// neither counted nor restarted.  This option has no effect on a factory that is not used by a manager.  Default is no
+// budget (non-positive values mean the same).
+func WithMemoryBudget(bytes int64) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.memoryBudget = bytes
+	}
+}
+
+// withMemoryShare returns the internal option that applies the current share of the memory budget to the config of
+// the group whenever its sarama ConsumerGroup is created, or nil if the manager has no budget
+func (m *kafkaConsumerGroupManagerImpl) withMemoryShare(groupId string) SaramaConsumerHandlerOption {
+	if m.getFactory().memoryBudget <= 0 {
+		return nil
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			share := m.memoryShare(groupId)
+			applyMemoryShare(config, share)
+			m.setAppliedShare(groupId, share)
+			return nil
+		})
+	}
+}
+
+// memoryShare returns the share of the memory budget of each running managed group, including the given one even if
+// it is not managed or running yet (since its config is created before it is added to the managed groups, or started)
+func (m *kafkaConsumerGroupManagerImpl) memoryShare(groupId string) int64 {
+	budget := m.getFactory().memoryBudget
+	groups := 0
+	included := false
+	m.groupLock.RLock()
+	for id, group := range m.groups {
+		if group.createGroupFn() == nil && (id == groupId || !group.isStopped()) {
+			groups++
+			included = included || id == groupId
+		}
+	}
+	m.groupLock.RUnlock()
+	if !included && groupId != "" {
+		groups++
+	}
+	if groups == 0 {
+		groups = 1
+	}
+	share := budget / int64(groups)
+	if share <= minMemoryShare {
+		return minMemoryShare
+	}
+	return int64(1) << (63 - bits.LeadingZeros64(uint64(share))) // Rounded down to a power of two
+}
+
+// applyMemoryShare limits the fetch size of the config to the share of the memory budget, and reduces the channel
+// buffer size in the same proportion
+func applyMemoryShare(config *sarama.Config, share int64) {
+	if share > math.MaxInt32 {
+		share = math.MaxInt32
+	}
+	fetch := int32(share)
+	if config.Consumer.Fetch.Default > fetch {
+		bufferSize := int64(config.ChannelBufferSize) * int64(fetch) / int64(config.Consumer.Fetch.Default)
+		if bufferSize < 1 {
+			bufferSize = 1
+		}
+		config.ChannelBufferSize = int(bufferSize)
+		config.Consumer.Fetch.Default = fetch
+	}
+	if config.Consumer.Fetch.Min > fetch {
+		config.Consumer.Fetch.Min = fetch
+	}
+}
+
+// appliedShare returns the share of the memory budget that the config of the group was last created with
+func (m *kafkaConsumerGroupManagerImpl) appliedShare(groupId string) (int64, bool) {
+	m.budgetLock.Lock()
+	defer m.budgetLock.Unlock()
+	share, ok := m.memoryShares[groupId]
+	return share, ok
+}
+
+// setAppliedShare records the share of the memory budget that the config of the group was created with
+func (m *kafkaConsumerGroupManagerImpl) setAppliedShare(groupId string, share int64) {
+	m.budgetLock.Lock()
+	defer m.budgetLock.Unlock()
+	if m.memoryShares == nil {
+		m.memoryShares = make(map[string]int64)
+	}
+	m.memoryShares[groupId] = share
+}
+
+// rebalanceMemoryBudget restarts the running groups that were created with a different share of the memory budget
+// than the current one, after a group was started or closed.  The restarts are serialized with Reconfigure, which
+// also stops and starts the groups, so it must be called in a goroutine of its own (and not while the caller may be
+// holding up a Reconfigure, such as while a group is being closed).
+func (m *kafkaConsumerGroupManagerImpl) rebalanceMemoryBudget() {
+	if factory := m.getFactory(); factory == nil || factory.memoryBudget <= 0 || m.isShutdown() || !m.IsActive() {
+		return
+	}
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+
+	m.budgetLock.Lock()
+	for groupId := range m.memoryShares {
+		if m.getGroup(groupId) == nil {
+			delete(m.memoryShares, groupId)
+		}
+	}
+	m.budgetLock.Unlock()
+
+	share := m.memoryShare("")
+	groupIds := m.getGroupIds()
+	sort.Strings(groupIds)
+	for _, groupId := range groupIds {
+		applied, ok := m.appliedShare(groupId)
+		if !ok || applied == share || m.IsStopped(groupId) || m.IsDead(groupId) {
+			continue
+		}
+		groupLogger := m.logger.With(zap.String("GroupId", groupId))
+		groupLogger.Info("Restarting Managed ConsumerGroup With New Share Of Memory Budget",
+			zap.Int64("PreviousShare", applied), zap.Int64("Share", share))
+		err := m.stopConsumerGroup(&commands.CommandLock{Token: internalToken, LockBefore: true}, groupId)
+		if err == nil {
+			err = m.startConsumerGroup(&commands.CommandLock{Token: internalToken, UnlockAfter: true}, groupId)
+		}
+		if err != nil {
+			groupLogger.Warn("Failed To Restart Managed ConsumerGroup With New Share Of Memory Budget", zap.Error(err))
+		}
+	}
+}
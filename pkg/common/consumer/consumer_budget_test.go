@@ -0,0 +1,174 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestApplyMemoryShare(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		share        int64
+		expectFetch  int32
+		expectMin    int32
+		expectBuffer int
+	}{
+		{
+			name:         "Share Above Fetch Size",
+			share:        4 * 1024 * 1024,
+			expectFetch:  1024 * 1024,
+			expectMin:    1,
+			expectBuffer: 256,
+		},
+		{
+			name:         "Share Below Fetch Size",
+			share:        256 * 1024,
+			expectFetch:  256 * 1024,
+			expectMin:    1,
+			expectBuffer: 64,
+		},
+		{
+			name:         "Smallest Buffer",
+			share:        1,
+			expectFetch:  1,
+			expectMin:    1,
+			expectBuffer: 1,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := sarama.NewConfig()
+			applyMemoryShare(config, testCase.share)
+			assert.Equal(t, testCase.expectFetch, config.Consumer.Fetch.Default)
+			assert.Equal(t, testCase.expectMin, config.Consumer.Fetch.Min)
+			assert.Equal(t, testCase.expectBuffer, config.ChannelBufferSize)
+		})
+	}
+}
+
+func TestMemoryShare(t *testing.T) {
+	manager := &kafkaConsumerGroupManagerImpl{groups: make(groupMap)}
+	manager.factory = &kafkaConsumerGroupFactoryImpl{memoryBudget: 3 * 1024 * 1024}
+	assert.Equal(t, int64(2*1024*1024), manager.memoryShare(""))
+	assert.Equal(t, int64(2*1024*1024), manager.memoryShare("group-1"))
+
+	started := &mockManagedGroup{}
+	started.On("createGroupFn").Return(nil)
+	started.On("isStopped").Return(false)
+	manager.groups["group-1"] = started
+	assert.Equal(t, int64(2*1024*1024), manager.memoryShare("group-1"))
+	assert.Equal(t, int64(1024*1024), manager.memoryShare("group-2"))
+
+	// Stopped groups are not counted, unless the share is that of the group itself (which is about to start)
+	stopped := &mockManagedGroup{}
+	stopped.On("createGroupFn").Return(nil)
+	stopped.On("isStopped").Return(true)
+	manager.groups["group-2"] = stopped
+	assert.Equal(t, int64(1024*1024), manager.memoryShare("group-2"))
+	assert.Equal(t, int64(2*1024*1024), manager.memoryShare(""))
+	delete(manager.groups, "group-2")
+
+	// Groups added via AddExistingGroup are not counted
+	existing := &mockManagedGroup{}
+	existing.On("createGroupFn").Return(createSaramaGroupFn(func() (sarama.ConsumerGroup, error) { return nil, nil }))
+	manager.groups["existing"] = existing
+	assert.Equal(t, int64(2*1024*1024), manager.memoryShare(""))
+
+	manager.factory.memoryBudget = 1024
+	assert.Equal(t, int64(minMemoryShare), manager.memoryShare(""))
+}
+
+func TestMemoryBudget(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	var lock sync.Mutex
+	fetchSizes := make(map[string][]int32)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetchSizes[groupID] = append(fetchSizes[groupID], config.Consumer.Fetch.Default)
+		return &closableConsumerGroup{closed: make(chan struct{})}, nil
+	}
+	getFetchSizes := func(groupId string) []int32 {
+		lock.Lock()
+		defer lock.Unlock()
+		return fetchSizes[groupId]
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig(),
+		WithMemoryBudget(1024*1024))
+
+	assert.Nil(t, manager.StartConsumerGroup("group-1", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Equal(t, []int32{1024 * 1024}, getFetchSizes("group-1"))
+
+	// Starting a second group halves the share, which restarts the first group in the background
+	assert.Nil(t, manager.StartConsumerGroup("group-2", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Equal(t, []int32{512 * 1024}, getFetchSizes("group-2"))
+	assert.Eventually(t, func() bool { return len(getFetchSizes("group-1")) == 2 }, shortTimeout, time.Millisecond)
+	assert.Equal(t, []int32{1024 * 1024, 512 * 1024}, getFetchSizes("group-1"))
+
+	// A stopped group is not restarted, but is given the current share when it is started
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-1"))
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-2", shortTimeout))
+	assert.Eventually(t, func() bool { _, ok := impl.appliedShare("group-2"); return !ok }, shortTimeout, time.Millisecond)
+	assert.Equal(t, []int32{1024 * 1024, 512 * 1024}, getFetchSizes("group-1"))
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-1"))
+	assert.Equal(t, []int32{1024 * 1024, 512 * 1024, 1024 * 1024}, getFetchSizes("group-1"))
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-1", shortTimeout))
+	assert.Eventually(t, func() bool { _, ok := impl.appliedShare("group-1"); return !ok }, shortTimeout, time.Millisecond)
+}
+
+func TestMemoryBudgetStoppedGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	var lock sync.Mutex
+	fetchSizes := make(map[string][]int32)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetchSizes[groupID] = append(fetchSizes[groupID], config.Consumer.Fetch.Default)
+		return &closableConsumerGroup{closed: make(chan struct{})}, nil
+	}
+	getFetchSizes := func(groupId string) []int32 {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]int32{}, fetchSizes[groupId]...)
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig(),
+		WithMemoryBudget(1024*1024))
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	// A stopped group does not count, so that the group started after it is given the whole budget
+	assert.Nil(t, manager.StartConsumerGroup("group-1", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-1"))
+	assert.Nil(t, manager.StartConsumerGroup("group-2", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Equal(t, []int32{1024 * 1024}, getFetchSizes("group-2"))
+
+	// Restarting the stopped group halves the share, which restarts the other group in the background
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-1"))
+	assert.Equal(t, []int32{1024 * 1024, 512 * 1024}, getFetchSizes("group-1"))
+	assert.Eventually(t, func() bool { return len(getFetchSizes("group-2")) == 2 }, shortTimeout, time.Millisecond)
+	assert.Equal(t, []int32{1024 * 1024, 512 * 1024}, getFetchSizes("group-2"))
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-1", shortTimeout))
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-2", shortTimeout))
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// channelConsumerCloseTimeout is how long the close function returned by StartChannelConsumer waits for the
+// consume goroutine of the group to exit
+const channelConsumerCloseTimeout = time.Minute
+
+// channelHandler is a KafkaConsumerHandler that passes the messages to a channel, marking each one as soon as it
+// has been received from the channel
+type channelHandler struct {
+	groupId  string
+	messages chan *sarama.ConsumerMessage
+	done     chan struct{} // Closed when the channel consumer is closed, so that no more messages are passed on
+}
+
+// Verify that the channelHandler satisfies the KafkaConsumerHandler interface
+var _ KafkaConsumerHandler = (*channelHandler)(nil)
+
+// Handle blocks until the message is received from the channel (returning true so that it is marked), or until
+// either the channel consumer is closed or the handler context is canceled (returning false, so that the message
+// is consumed again by the next session).  Once closed, no further messages are passed on, so an offset can never
+// be marked beyond a message that was not received.
+func (h *channelHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	select {
+	case <-h.done:
+		return false, nil
+	default:
+	}
+	select {
+	case h.messages <- message:
+		return true, nil
+	case <-h.done:
+		return false, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+}
+
+func (h *channelHandler) SetReady(int32, bool) {}
+
+func (h *channelHandler) GetConsumerGroup() string {
+	return h.groupId
+}
+
+// StartChannelConsumer starts a managed ConsumerGroup in the same manner as StartConsumerGroup, with a handler that
+// passes the consumed messages to the returned (unbuffered) channel instead of requiring a KafkaConsumerHandler.
+// A message is marked as soon as it is received from the channel, and consumption blocks until it is, so a slow
+// reader applies backpressure to the group.  The returned function closes the group, in the same manner as
+// CloseConsumerGroupAndWait; the channel itself is closed once the consume goroutine of the group has exited,
+// whether that is due to the close function, CloseConsumerGroup, Shutdown or the group giving up (see
+// WithMaxRestartAttempts), so the channel may simply be ranged over.  If the group is closed by anything other than
+// the close function while a message is waiting for the reader, that message is only released after the handler
+// timeout (see WithTimeout).
+func (m *kafkaConsumerGroupManagerImpl) StartChannelConsumer(groupId string, topics []string, logger *zap.SugaredLogger, options ...SaramaConsumerHandlerOption) (<-chan *sarama.ConsumerMessage, func() error, error) {
+	handler := &channelHandler{
+		groupId:  groupId,
+		messages: make(chan *sarama.ConsumerMessage),
+		done:     make(chan struct{}),
+	}
+	if err := m.StartConsumerGroup(groupId, topics, logger, handler, options...); err != nil {
+		return nil, nil, err
+	}
+
+	// No more messages are passed to the channel once the consume goroutine has exited
+	managedGrp := m.getGroup(groupId)
+	go func() {
+		if managedGrp != nil { // The group may already have been closed by something else
+			_ = managedGrp.waitForConsumeExit(time.Duration(math.MaxInt64))
+		}
+		close(handler.messages)
+	}()
+
+	var closeOnce sync.Once
+	var closeErr error
+	closeFn := func() error {
+		closeOnce.Do(func() {
+			close(handler.done) // Release any Handle call that is waiting for the reader
+			closeErr = m.CloseConsumerGroupAndWait(groupId, channelConsumerCloseTimeout)
+		})
+		return closeErr
+	}
+	return handler.messages, closeFn, nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// claimingConsumerGroup is a sarama.ConsumerGroup that passes its messages to the handler in the first session,
+// and then blocks in Consume until it is closed
+type claimingConsumerGroup struct {
+	mockConsumerGroup
+	messages  []*sarama.ConsumerMessage
+	claimOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (g *claimingConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	// The session ends when the group is closed, as it does for a sarama ConsumerGroup
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closed:
+			cancel()
+		case <-sessionCtx.Done():
+		}
+	}()
+	session := &committingSession{ctx: sessionCtx}
+	g.claimOnce.Do(func() {
+		_ = handler.Setup(session)
+		_ = handler.ConsumeClaim(session, multiMessageClaim{messages: g.messages})
+		_ = handler.Cleanup(session)
+	})
+	select {
+	case <-ctx.Done():
+	case <-g.closed:
+	}
+	return sarama.ErrClosedConsumerGroup
+}
+
+func (g *claimingConsumerGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return nil
+}
+
+func TestChannelHandler(t *testing.T) {
+	handler := &channelHandler{groupId: "group", messages: make(chan *sarama.ConsumerMessage), done: make(chan struct{})}
+	assert.Equal(t, "group", handler.GetConsumerGroup())
+	message := &sarama.ConsumerMessage{Offset: 1}
+
+	// A received message is marked
+	go func() { <-handler.messages }()
+	mark, err := handler.Handle(context.Background(), message)
+	assert.True(t, mark)
+	assert.Nil(t, err)
+
+	// A message that is not received before the handler context is canceled is not marked
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	mark, err = handler.Handle(ctx, message)
+	assert.False(t, mark)
+	assert.Nil(t, err)
+
+	// No messages are passed on once the channel consumer is closed, even if there is a reader
+	close(handler.done)
+	received := make(chan struct{})
+	go func() {
+		select {
+		case <-handler.messages:
+			close(received)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}()
+	mark, err = handler.Handle(context.Background(), message)
+	assert.False(t, mark)
+	assert.Nil(t, err)
+	select {
+	case <-received:
+		t.Fatal("message was passed on after the close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStartChannelConsumer(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name        string
+		read        int
+		closeByFunc bool
+		options     []SaramaConsumerHandlerOption
+	}{
+		{
+			name:        "All Messages Read",
+			read:        3,
+			closeByFunc: true,
+		},
+		{
+			name:        "Closed While Blocked",
+			read:        1,
+			closeByFunc: true,
+		},
+		{
+			name:    "Closed By Manager",
+			read:    2,
+			options: []SaramaConsumerHandlerOption{WithTimeout(10 * time.Millisecond)}, // Releases the blocked message
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			group := &claimingConsumerGroup{
+				messages: []*sarama.ConsumerMessage{{Offset: 0}, {Offset: 1}, {Offset: 2}},
+				closed:   make(chan struct{}),
+			}
+			newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+				return group, nil
+			}
+			manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+
+			messages, closeFn, err := manager.StartChannelConsumer("group", []string{"topic"}, zap.NewNop().Sugar(), testCase.options...)
+			assert.Nil(t, err)
+			assert.True(t, manager.IsManaged("group"))
+			for i := 0; i < testCase.read; i++ {
+				select {
+				case message := <-messages:
+					assert.Equal(t, int64(i), message.Offset)
+				case <-time.After(time.Second):
+					t.Fatal("message was not received")
+				}
+			}
+
+			if testCase.closeByFunc {
+				assert.Nil(t, closeFn())
+				assert.Nil(t, closeFn()) // Calling the close function again has no effect
+			} else {
+				assert.Nil(t, manager.CloseConsumerGroup("group"))
+			}
+			assert.False(t, manager.IsManaged("group"))
+
+			// The channel is closed once the consume goroutine exits
+			assert.Eventually(t, func() bool {
+				select {
+				case _, ok := <-messages:
+					return !ok
+				default:
+					return false
+				}
+			}, time.Second, 5*time.Millisecond)
+		})
+	}
+
+	// A group that cannot be started returns the error
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return nil, fmt.Errorf("factory error")
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	messages, closeFn, err := manager.StartChannelConsumer("group", []string{"topic"}, zap.NewNop().Sugar())
+	assert.NotNil(t, err)
+	assert.Nil(t, messages)
+	assert.Nil(t, closeFn)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// ErrorClass determines what the consume loop of a ConsumerGroup started by the KafkaConsumerGroupFactory does
+// when a session fails with an error (see WithErrorClassifier)
+type ErrorClass int
+
+const (
+	// ErrorClassTransient sends the error to the errors channel and starts another session, counting the failure
+	// towards the limit of WithMaxRestartAttempts
+	ErrorClassTransient ErrorClass = iota
+	// ErrorClassFatal sends the error to the errors channel and gives up at once, as if the limit of
+	// WithMaxRestartAttempts had been reached, so that the group is dead
+	ErrorClassFatal
+	// ErrorClassIgnore starts another session without sending the error to the errors channel or counting the failure
+	ErrorClassIgnore
+)
+
+// String returns a human-readable name of the class, for logging
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassFatal:
+		return "fatal"
+	case ErrorClassIgnore:
+		return "ignore"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(c))
+	}
+}
+
+// ErrorClassifier returns the ErrorClass of an error that a session of a ConsumerGroup failed with
+type ErrorClassifier func(err error) ErrorClass
+
+// DefaultErrorClassifier is the ErrorClassifier used when WithErrorClassifier is not given.  It classifies as fatal
+// the errors that another session of the same group cannot recover from (an invalid sarama config, or a topic or
+// group.id that the broker rejects as invalid), and every other error as transient, which includes authorization
+// failures since they may be resolved by changing the ACLs of the cluster while the group retries.
+func DefaultErrorClassifier(err error) ErrorClass {
+	var configErr sarama.ConfigurationError
+	if errors.As(err, &configErr) {
+		return ErrorClassFatal
+	}
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		switch kerr {
+		case sarama.ErrInvalidTopic, sarama.ErrInvalidGroupId, sarama.ErrUnsupportedVersion, sarama.ErrInconsistentGroupProtocol:
+			return ErrorClassFatal
+		}
+	}
+	return ErrorClassTransient
+}
+
+// WithErrorClassifier makes the consume loop of a ConsumerGroup started by the KafkaConsumerGroupFactory consult
+// the given classifier when a session fails with an error, to decide whether to retry (ErrorClassTransient), give
+// up (ErrorClassFatal) or retry without reporting the error (ErrorClassIgnore).  The classifier sees neither the
+// error that ends the loop when the group is closed nor the errors that the handler or sarama send to the errors
+// channel.  It is called from the consume loop, so it must be fast and must not block; an unknown ErrorClass is
+// treated as ErrorClassTransient.  Default is DefaultErrorClassifier.
+func WithErrorClassifier(classifier ErrorClassifier) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.errorClassifier = classifier
+	}
+}
+
+// classifyError returns the ErrorClass of an error that a session failed with, using the classifier of the
+// WithErrorClassifier option or the DefaultErrorClassifier
+func (consumer *SaramaConsumerHandler) classifyError(err error) ErrorClass {
+	classifier := consumer.errorClassifier
+	if classifier == nil {
+		classifier = DefaultErrorClassifier
+	}
+	switch class := classifier(err); class {
+	case ErrorClassFatal, ErrorClassIgnore:
+		return class
+	default:
+		return ErrorClassTransient
+	}
+}
+
+// recordFailedSession sends the error of a failed session to the errors channel and counts the failure, returning
+// the error (wrapping ErrGroupDead) that the consume loop gives up with if the error is fatal or the limit of
+// WithMaxRestartAttempts has been reached, or nil if the loop should start another session
+func (consumer *SaramaConsumerHandler) recordFailedSession(err error, class ErrorClass, failedSessions *int) error {
+	consumer.sendError(err)
+	*failedSessions++
+	if class == ErrorClassFatal {
+		consumer.logger.Errorw("Consume loop giving up after a fatal error", zap.Error(err))
+		return fmt.Errorf("%w: the session failed with a fatal error: %v", ErrGroupDead, err)
+	}
+	if maxAttempts := consumer.maxRestartAttempts; maxAttempts > 0 && *failedSessions >= maxAttempts {
+		consumer.logger.Errorw("Consume loop giving up after consecutive failed sessions", zap.Int("attempts", *failedSessions), zap.Error(err))
+		return fmt.Errorf("%w: %d consecutive sessions failed, the last with: %v", ErrGroupDead, *failedSessions, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(errors.New("consume error")))
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(sarama.ErrOutOfBrokers))
+	assert.Equal(t, ErrorClassTransient, DefaultErrorClassifier(sarama.ErrGroupAuthorizationFailed))
+	assert.Equal(t, ErrorClassFatal, DefaultErrorClassifier(sarama.ConfigurationError("invalid")))
+	assert.Equal(t, ErrorClassFatal, DefaultErrorClassifier(fmt.Errorf("wrapped: %w", sarama.ErrInvalidTopic)))
+	assert.Equal(t, ErrorClassFatal, DefaultErrorClassifier(sarama.ErrInvalidGroupId))
+}
+
+func TestErrorClassString(t *testing.T) {
+	assert.Equal(t, "transient", ErrorClassTransient.String())
+	assert.Equal(t, "fatal", ErrorClassFatal.String())
+	assert.Equal(t, "ignore", ErrorClassIgnore.String())
+	assert.Equal(t, "unknown(7)", ErrorClass(7).String())
+}
+
+func TestErrorClassifier(t *testing.T) {
+	errTransient, errFatal, errIgnore, errUnknown := errors.New("transient"), errors.New("fatal"), errors.New("ignore"), errors.New("unknown")
+	classifier := func(err error) ErrorClass {
+		switch err {
+		case errFatal:
+			return ErrorClassFatal
+		case errIgnore:
+			return ErrorClassIgnore
+		case errUnknown:
+			return ErrorClass(-1)
+		default:
+			return ErrorClassTransient
+		}
+	}
+
+	for _, testCase := range []struct {
+		name           string
+		results        []error
+		options        []SaramaConsumerHandlerOption
+		expectSessions int
+		expectErrs     []error
+		expectDead     bool
+	}{
+		{
+			name:           "Default Classifier",
+			results:        []error{errTransient, sarama.ConfigurationError("invalid"), errTransient},
+			expectSessions: 2,
+			expectErrs:     []error{errTransient, sarama.ConfigurationError("invalid"), ErrGroupDead},
+			expectDead:     true,
+		},
+		{
+			name:           "Transient And Unknown Errors Are Retried",
+			results:        []error{errTransient, errUnknown, errTransient},
+			options:        []SaramaConsumerHandlerOption{WithErrorClassifier(classifier)},
+			expectSessions: 4,
+			expectErrs:     []error{errTransient, errUnknown, errTransient},
+		},
+		{
+			name:           "Fatal Error Gives Up",
+			results:        []error{errTransient, errFatal, errTransient},
+			options:        []SaramaConsumerHandlerOption{WithErrorClassifier(classifier)},
+			expectSessions: 2,
+			expectErrs:     []error{errTransient, errFatal, ErrGroupDead},
+			expectDead:     true,
+		},
+		{
+			name:           "Ignored Errors Are Neither Reported Nor Counted",
+			results:        []error{errIgnore, errTransient, errIgnore, errIgnore, errTransient},
+			options:        []SaramaConsumerHandlerOption{WithErrorClassifier(classifier), WithMaxRestartAttempts(3)},
+			expectSessions: 6,
+			expectErrs:     []error{errTransient, errTransient},
+		},
+		{
+			name:           "Fatal Error Before The Restart Limit",
+			results:        []error{errFatal},
+			options:        []SaramaConsumerHandlerOption{WithErrorClassifier(classifier), WithMaxRestartAttempts(3)},
+			expectSessions: 1,
+			expectErrs:     []error{errFatal, ErrGroupDead},
+			expectDead:     true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+			sessions := 0
+			consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+				sessions++
+				if sessions > len(testCase.results) {
+					return sarama.ErrClosedConsumerGroup
+				}
+				return testCase.results[sessions-1]
+			}
+
+			group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{}, zap.NewNop().Sugar(),
+				mockMessageHandler{}, nil, testCase.options...)
+			var errs []error
+			for err := range group.handlerErrorChannel {
+				errs = append(errs, err)
+			}
+			<-group.state.done
+			assert.Equal(t, testCase.expectSessions, sessions)
+			assert.Len(t, errs, len(testCase.expectErrs))
+			for i := range errs {
+				assert.True(t, errors.Is(errs[i], testCase.expectErrs[i]), errs[i])
+			}
+			select {
+			case <-group.state.dead:
+				assert.True(t, testCase.expectDead)
+			default:
+				assert.False(t, testCase.expectDead)
+			}
+			group.cancel()
+		})
+	}
+}
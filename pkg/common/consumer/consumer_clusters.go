@@ -0,0 +1,152 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// DefaultCluster is the name of the cluster whose brokers and config are given to NewConsumerGroupManager, which
+// is used by the managed groups that are not started with the WithCluster option
+const DefaultCluster = ""
+
+// WithCluster makes the manager create the ConsumerGroup with the brokers and config of the named cluster, which
+// must have been registered via RegisterCluster.  The cluster of a managed group cannot be changed by SwapHandler.
+// This option has no effect on a ConsumerGroup that is not started by the manager.  Default is DefaultCluster.
+func WithCluster(name string) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.cluster = name
+	}
+}
+
+// clusterOf returns the name of the cluster given by the options (the last one, if there are several)
+func clusterOf(options []SaramaConsumerHandlerOption) string {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	return scratch.cluster
+}
+
+// RegisterCluster adds a named set of brokers and sarama config, which the groups started with the WithCluster
+// option consume from.  A cluster can only be registered once; use ReconfigureCluster to change its settings.
+func (m *kafkaConsumerGroupManagerImpl) RegisterCluster(name string, brokers []string, config *sarama.Config) error {
+	if name == DefaultCluster {
+		return fmt.Errorf("could not register cluster - the default cluster is given to the manager when it is created")
+	}
+	if len(brokers) == 0 || config == nil {
+		return fmt.Errorf("could not register cluster '%s' - brokers and config are required", name)
+	}
+
+	m.factoryLock.Lock()
+	defer m.factoryLock.Unlock()
+	if _, ok := m.clusters[name]; ok {
+		return fmt.Errorf("could not register cluster '%s' - cluster is already registered", name)
+	}
+	if m.clusters == nil {
+		m.clusters = make(map[string]*kafkaConsumerGroupFactoryImpl)
+	}
+	m.clusters[name] = m.newFactory(name, brokers, config)
+	m.logger.Info("Registered Kafka Cluster", zap.String("Cluster", name), zap.Strings("Brokers", brokers))
+	return nil
+}
+
+// ReconfigureCluster incorporates a new set of brokers and Sarama config settings for the named cluster in the
+// same manner as Reconfigure does for the default one, stopping and restarting only the groups of that cluster.
+func (m *kafkaConsumerGroupManagerImpl) ReconfigureCluster(name string, brokers []string, config *sarama.Config) error {
+	if _, err := m.getClusterFactory(name); err != nil {
+		return err
+	}
+	return m.reconfigureCluster(name, brokers, config).Err()
+}
+
+// ReconnectCluster restarts the managed groups of the named cluster (DefaultCluster for the groups that do not use
+// WithCluster) with its current brokers and config, in the same manner as ReconfigureCluster.  Sarama resolves a broker
+// address each time it dials it, but a client keeps its open connections (and the broker addresses learned from the
+// metadata) for as long as they work, so a change to the DNS records of the brokers (e.g. when the cluster is scaled)
+// is not picked up by a running group, nor when a Reconfigure is skipped because the settings are unchanged (as
+// ReconfigureAuth does for unchanged SASL settings).  Restarting a group creates a new sarama ConsumerGroup, whose new
+// client resolves every broker address afresh (as does the shared client of the cluster, if the manager was given
+// WithSharedClient).  The producer of a group started with WithProducer is not re-created.
+func (m *kafkaConsumerGroupManagerImpl) ReconnectCluster(name string) error {
+	if _, err := m.getClusterFactory(name); err != nil {
+		return err
+	}
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	return m.restartClusterGroups(name, func() {
+		// A shared client would outlive the restart, so the factory is replaced with one that creates a new client
+		if factory, err := m.getClusterFactory(name); err == nil && factory.sharedClient != nil {
+			m.setClusterFactory(name, m.newFactory(name, factory.addrs, factory.config))
+		}
+	}).Err()
+}
+
+// getClusterFactory returns the consumer group factory of the named cluster using the factoryLock mutex
+func (m *kafkaConsumerGroupManagerImpl) getClusterFactory(name string) (*kafkaConsumerGroupFactoryImpl, error) {
+	if name == DefaultCluster {
+		return m.getFactory(), nil
+	}
+	m.factoryLock.RLock()
+	defer m.factoryLock.RUnlock()
+	factory, ok := m.clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("cluster '%s' is not registered", name)
+	}
+	return factory, nil
+}
+
+// setClusterFactory replaces the consumer group factory of the named cluster using the factoryLock mutex
+func (m *kafkaConsumerGroupManagerImpl) setClusterFactory(name string, factory *kafkaConsumerGroupFactoryImpl) {
+	if name == DefaultCluster {
+		m.setFactory(factory)
+		return
+	}
+	m.factoryLock.Lock()
+	previous := m.clusters[name]
+	m.clusters[name] = factory
+	m.factoryLock.Unlock()
+	m.retireFactory(name, previous, factory)
+}
+
+// retireFactories closes the shared clients of the factories of all of the clusters (see WithSharedClient) once the
+// groups that use them have been closed, since the manager creates no more groups once it has been shut down
+func (m *kafkaConsumerGroupManagerImpl) retireFactories() {
+	m.factoryLock.RLock()
+	factories := map[string]*kafkaConsumerGroupFactoryImpl{DefaultCluster: m.factory}
+	for name, factory := range m.clusters {
+		factories[name] = factory
+	}
+	m.factoryLock.RUnlock()
+	for name, factory := range factories {
+		m.retireFactory(name, factory, nil)
+	}
+}
+
+// getClusterGroupIds returns a snapshot of the groupIds of the managed groups that consume from the named cluster
+func (m *kafkaConsumerGroupManagerImpl) getClusterGroupIds(name string) []string {
+	groupIds := make([]string, 0)
+	for _, groupId := range m.getGroupIds() {
+		if managedGrp := m.getGroup(groupId); managedGrp != nil && clusterOf(managedGrp.handlerOptions()) == name {
+			groupIds = append(groupIds, groupId)
+		}
+	}
+	return groupIds
+}
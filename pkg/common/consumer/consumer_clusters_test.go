@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRegisterCluster(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		cluster   string
+		brokers   []string
+		config    *sarama.Config
+		expectErr bool
+	}{
+		{
+			name:    "Valid Cluster",
+			cluster: "secondary",
+			brokers: []string{"b2"},
+			config:  sarama.NewConfig(),
+		},
+		{
+			name:      "Default Cluster",
+			cluster:   DefaultCluster,
+			brokers:   []string{"b2"},
+			config:    sarama.NewConfig(),
+			expectErr: true,
+		},
+		{
+			name:      "No Brokers",
+			cluster:   "secondary",
+			config:    sarama.NewConfig(),
+			expectErr: true,
+		},
+		{
+			name:      "No Config",
+			cluster:   "secondary",
+			brokers:   []string{"b2"},
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+			err := manager.RegisterCluster(testCase.cluster, testCase.brokers, testCase.config)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if !testCase.expectErr {
+				// A cluster can only be registered once
+				assert.NotNil(t, manager.RegisterCluster(testCase.cluster, testCase.brokers, testCase.config))
+			}
+		})
+	}
+}
+
+func TestClusterGroups(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	logger := zap.NewNop().Sugar()
+
+	// Record the brokers that each group was (re-)created with
+	var brokersLock sync.Mutex
+	brokers := make(map[string][]string)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		brokersLock.Lock()
+		defer brokersLock.Unlock()
+		brokers[groupID] = append(brokers[groupID], addrs...)
+		return &mockConsumerGroup{}, nil
+	}
+	groupBrokers := func(groupId string) []string {
+		brokersLock.Lock()
+		defer brokersLock.Unlock()
+		return brokers[groupId]
+	}
+
+	assert.Nil(t, manager.RegisterCluster("secondary", []string{"b2"}, &sarama.Config{}))
+	assert.Nil(t, manager.StartConsumerGroup("group-default", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Nil(t, manager.StartConsumerGroup("group-secondary", []string{"topic"}, logger, mockMessageHandler{}, WithCluster("secondary")))
+	assert.NotNil(t, manager.StartConsumerGroup("group-unknown", []string{"topic"}, logger, mockMessageHandler{}, WithCluster("unknown")))
+	assert.Empty(t, groupBrokers("group-default"))
+	assert.Equal(t, []string{"b2"}, groupBrokers("group-secondary"))
+
+	// Reconfiguring a cluster only restarts the groups of that cluster
+	assert.Nil(t, manager.ReconfigureCluster("secondary", []string{"b3"}, &sarama.Config{}))
+	assert.Equal(t, []string{"b2", "b3"}, groupBrokers("group-secondary"))
+	assert.Nil(t, manager.Reconfigure([]string{"b1"}, &sarama.Config{}))
+	assert.Equal(t, []string{"b1"}, groupBrokers("group-default"))
+	assert.Equal(t, []string{"b2", "b3"}, groupBrokers("group-secondary"))
+	assert.NotNil(t, manager.ReconfigureCluster("unknown", []string{"b3"}, &sarama.Config{}))
+
+	// Reconnecting a cluster re-creates only the groups of that cluster, with the current brokers
+	assert.Nil(t, manager.ReconnectCluster("secondary"))
+	assert.Equal(t, []string{"b1"}, groupBrokers("group-default"))
+	assert.Equal(t, []string{"b2", "b3", "b3"}, groupBrokers("group-secondary"))
+	assert.Nil(t, manager.ReconnectCluster(DefaultCluster))
+	assert.Equal(t, []string{"b1", "b1"}, groupBrokers("group-default"))
+	assert.Equal(t, []string{"b2", "b3", "b3"}, groupBrokers("group-secondary"))
+	assert.NotNil(t, manager.ReconnectCluster("unknown"))
+
+	// A swapped handler stays on the cluster of the group
+	assert.NotNil(t, manager.SwapHandler("group-secondary", mockMessageHandler{}, WithCluster("other")))
+	assert.Nil(t, manager.SwapHandler("group-secondary", mockMessageHandler{}))
+	assert.Equal(t, []ManagedGroupState{
+		{GroupId: "group-default", Topics: []string{"topic"}},
+		{GroupId: "group-secondary", Cluster: "secondary", Topics: []string{"topic"}},
+	}, manager.Export())
+
+	_, err := manager.Shutdown(context.Background())
+	assert.Nil(t, err)
+}
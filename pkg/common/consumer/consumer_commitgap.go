@@ -0,0 +1,241 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// commitGapReportInterval is how often the commit gaps of a managed group are reported to a CommitGapReporter
+const commitGapReportInterval = 30 * time.Second
+
+// CommitGapReporter may be implemented by a ConsumerGroupMetricsReporter (see WithMetricsReporter) to also receive
+// the commit gaps of the partitions of the groups.  The commit gap of a partition is the number of offsets that the
+// group has marked (i.e. processed) but not yet committed, which grows while commits are failing or not being made
+// at all, even though the messages are being consumed as usual.  Unlike the lag of PartitionLag, it does not depend
+// on the producers of the topic.
+type CommitGapReporter interface {
+	// CommitGap is called with the commit gap of a partition whenever its committed offset is confirmed: after each
+	// commit cycle that verifies its commits (see WithCommitRetry) or saves them (see WithOffsetStore), for each
+	// call of the CommitGap function of the manager, and periodically for every managed group
+	CommitGap(groupId string, topic string, partition int32, gap int64)
+	// CommitGapReleased is called when a session that claimed the partition ends, after which the gap of the
+	// partition is no longer tracked (until it is claimed again)
+	CommitGapReleased(groupId string, topic string, partition int32)
+}
+
+// partitionCommits is the highest offset marked in a partition, and the last offset confirmed as committed (both as
+// the next offset to be consumed)
+type partitionCommits struct {
+	marked    int64
+	committed int64
+}
+
+// commitGapTracker tracks the marked and committed offsets of the partitions of a ConsumerGroup, across the sessions
+// of its consume loop.  A nil commitGapTracker tracks nothing.
+type commitGapTracker struct {
+	lock       sync.Mutex
+	partitions map[topicPartition]*partitionCommits
+}
+
+// newCommitGapTracker returns a commitGapTracker with no partitions
+func newCommitGapTracker() *commitGapTracker {
+	return &commitGapTracker{partitions: make(map[topicPartition]*partitionCommits)}
+}
+
+// claimed records that a session began consuming the partition at the given offset, which was committed (unless it
+// is OffsetOldest or OffsetNewest, in which case nothing was committed and the first marked message is the start)
+func (t *commitGapTracker) claimed(topic string, partition int32, initialOffset int64) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := topicPartition{topic: topic, partition: partition}
+	if initialOffset < 0 {
+		delete(t.partitions, key)
+		return
+	}
+	t.partitions[key] = &partitionCommits{marked: initialOffset, committed: initialOffset}
+}
+
+// marked records the offset of a message that was marked
+func (t *commitGapTracker) marked(message *sarama.ConsumerMessage) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := topicPartition{topic: message.Topic, partition: message.Partition}
+	state, ok := t.partitions[key]
+	if !ok {
+		state = &partitionCommits{marked: message.Offset, committed: message.Offset}
+		t.partitions[key] = state
+	}
+	if message.Offset+1 > state.marked {
+		state.marked = message.Offset + 1
+	}
+}
+
+// released stops tracking the partitions of the given claims (keyed by topic), and returns those that were tracked
+func (t *commitGapTracker) released(claims map[string][]int32) []topicPartition {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var released []topicPartition
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			key := topicPartition{topic: topic, partition: partition}
+			if _, ok := t.partitions[key]; ok {
+				delete(t.partitions, key)
+				released = append(released, key)
+			}
+		}
+	}
+	return released
+}
+
+// confirmed records the offsets that are known to be committed, and returns the gaps of their partitions (those
+// that have not been claimed or marked are ignored)
+func (t *commitGapTracker) confirmed(offsets map[string]map[int32]int64) map[string]map[int32]int64 {
+	gaps := make(map[string]map[int32]int64)
+	if t == nil {
+		return gaps
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			state, ok := t.partitions[topicPartition{topic: topic, partition: partition}]
+			if !ok {
+				continue
+			}
+			if offset > state.committed {
+				state.committed = offset
+			}
+			if gaps[topic] == nil {
+				gaps[topic] = make(map[int32]int64)
+			}
+			gaps[topic][partition] = state.gap()
+		}
+	}
+	return gaps
+}
+
+// gaps returns the gaps of all of the partitions that have been claimed or marked
+func (t *commitGapTracker) gaps() map[string]map[int32]int64 {
+	gaps := make(map[string]map[int32]int64)
+	if t == nil {
+		return gaps
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, state := range t.partitions {
+		if gaps[key.topic] == nil {
+			gaps[key.topic] = make(map[int32]int64)
+		}
+		gaps[key.topic][key.partition] = state.gap()
+	}
+	return gaps
+}
+
+// gap returns the number of offsets that were marked after the committed one
+func (p *partitionCommits) gap() int64 {
+	if p.marked <= p.committed {
+		return 0
+	}
+	return p.marked - p.committed
+}
+
+// confirmCommitted records the offsets of a commit cycle that are known to be committed, and reports the gaps of
+// their partitions
+func (consumer *SaramaConsumerHandler) confirmCommitted(committed map[string]map[int32]int64) {
+	consumer.groupMetrics.commitGaps(consumer.commitGap.confirmed(committed))
+}
+
+// releaseCommitGaps stops tracking the partitions claimed by the session, which is ending, and reports their release
+func (consumer *SaramaConsumerHandler) releaseCommitGaps(session sarama.ConsumerGroupSession) {
+	consumer.groupMetrics.commitGapsReleased(consumer.commitGap.released(session.Claims()))
+}
+
+// CommitGap returns the commit gap of each partition of a managed group, keyed by topic and partition: the number of
+// offsets that the group has marked but that are not yet committed (see CommitGapReporter).  The committed offsets
+// are queried from the broker (or taken from the last successful Save, for a group with an OffsetStore), so the gap
+// is accurate even for commits that are made by sarama itself.  The partitions are those that the current session of
+// the group has claimed (or marked offsets of), as the partitions of a session are no longer tracked once it ends.
+// The offset that a session begins consuming a partition at counts as committed.  The gaps are also reported to the
+// metrics reporter, if it implements CommitGapReporter (which the manager also does periodically for every group).
+// A group added via AddExistingGroup has no partitions.
+func (m *kafkaConsumerGroupManagerImpl) CommitGap(groupId string) (map[string]map[int32]int64, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not get commit gap of consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return nil, fmt.Errorf("could not get commit gap of consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	tracker := managedGrp.state().commitGap
+	if tracker == nil {
+		return make(map[string]map[int32]int64), nil
+	}
+	if offsetStoreOf(managedGrp.handlerOptions()) == nil {
+		committed, err := m.CommittedOffsets(groupId)
+		if err != nil {
+			return nil, fmt.Errorf("could not get commit gap of consumer group with id '%s' - %w", groupId, err)
+		}
+		tracker.confirmed(committed)
+	}
+	gaps := tracker.gaps()
+	if factory := m.getFactory(); factory != nil {
+		newGroupMetrics(factory.metricsReporter, groupId).commitGaps(gaps)
+	}
+	return gaps, nil
+}
+
+// watchCommitGaps reports the commit gaps of a managed group to the CommitGapReporter of the factory periodically,
+// until the context is done (which happens when the group is closed)
+func (m *kafkaConsumerGroupManagerImpl) watchCommitGaps(ctx context.Context, groupId string) {
+	ticker := time.NewTicker(commitGapReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.reportCommitGaps(groupId)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reportCommitGaps reports the commit gaps of a managed group that is not stopped, as the CommitGap function does
+func (m *kafkaConsumerGroupManagerImpl) reportCommitGaps(groupId string) {
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil || managedGrp.isStopped() {
+		return
+	}
+	if _, err := m.CommitGap(groupId); err != nil {
+		m.logger.Warn("Failed To Report Commit Gaps Of Managed ConsumerGroup", zap.String("GroupId", groupId), zap.Error(err))
+	}
+}
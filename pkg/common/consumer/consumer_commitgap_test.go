@@ -0,0 +1,158 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// commitGapRecordingReporter is a recordingReporter that is also a CommitGapReporter
+type commitGapRecordingReporter struct {
+	recordingReporter
+}
+
+func (r *commitGapRecordingReporter) CommitGap(groupId string, topic string, partition int32, gap int64) {
+	r.record(fmt.Sprintf("gap %s %s/%d %d", groupId, topic, partition, gap))
+}
+
+func (r *commitGapRecordingReporter) CommitGapReleased(groupId string, topic string, partition int32) {
+	r.record(fmt.Sprintf("released %s %s/%d", groupId, topic, partition))
+}
+
+func TestCommitGapTracker(t *testing.T) {
+	tracker := newCommitGapTracker()
+
+	// A partition claimed at its committed offset has no gap until messages are marked
+	tracker.claimed("topic", 0, 10)
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 0}}, tracker.gaps())
+	for offset := int64(10); offset < 15; offset++ {
+		tracker.marked(&sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: offset})
+	}
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 5}}, tracker.gaps())
+
+	// Without a committed offset, the first marked message is the start of the gap
+	tracker.claimed("topic", 1, sarama.OffsetNewest)
+	tracker.marked(&sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 20})
+	tracker.marked(&sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 21})
+
+	// Confirmations only cover the known partitions, and never move the committed offset backwards
+	gaps := tracker.confirmed(map[string]map[int32]int64{"topic": {0: 13, 2: 4}, "other": {0: 1}})
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 2}}, gaps)
+	tracker.confirmed(map[string]map[int32]int64{"topic": {0: 11}})
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 2, 1: 2}}, tracker.gaps())
+
+	// A committed offset beyond the marked one (e.g. committed by another member) leaves no gap
+	tracker.confirmed(map[string]map[int32]int64{"topic": {1: 30}})
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 2, 1: 0}}, tracker.gaps())
+
+	// A new claim starts over
+	tracker.claimed("topic", 0, 40)
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 0, 1: 0}}, tracker.gaps())
+
+	// Released partitions are no longer tracked
+	released := tracker.released(map[string][]int32{"topic": {1, 3}})
+	assert.Equal(t, []topicPartition{{topic: "topic", partition: 1}}, released)
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 0}}, tracker.gaps())
+
+	var none *commitGapTracker
+	none.claimed("topic", 0, 1)
+	none.marked(&sarama.ConsumerMessage{Topic: "topic"})
+	assert.Empty(t, none.confirmed(map[string]map[int32]int64{"topic": {0: 1}}))
+	assert.Empty(t, none.gaps())
+	assert.Empty(t, none.released(map[string][]int32{"topic": {0}}))
+}
+
+func TestCommitGapOfCommitCycle(t *testing.T) {
+	reporter := &commitGapRecordingReporter{}
+	store := &memoryOffsetStore{offsets: map[string]map[int32]int64{}}
+	tracker := newCommitGapTracker()
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 10),
+		WithOffsetStore(store), withCommitInterval(time.Hour), withGroupState(&groupState{commitGap: tracker, metrics: newGroupMetrics(reporter, "consumer group")}))
+
+	session := &claimsSession{committingSession: committingSession{ctx: context.Background()}, claims: map[string][]int32{"topic": {0}}}
+	assert.Nil(t, cgh.Setup(session))
+	message := &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 7} // Claimed at offset zero
+	_ = cgh.ConsumeClaim(session, topicClaim{mockConsumerGroupClaim: mockConsumerGroupClaim{msg: message}, topic: "topic"})
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 8}}, tracker.gaps())
+
+	// The saved offsets are confirmed as committed, and then the partition is released along with the session
+	assert.Nil(t, cgh.Cleanup(session))
+	assert.Empty(t, tracker.gaps())
+	recorded := reporter.recorded()
+	assert.Contains(t, recorded, "gap consumer group topic/0 0")
+	assert.Equal(t, "released consumer group topic/0", recorded[len(recorded)-1])
+}
+
+func TestCommitGap(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+
+	manager, _, managedGrp, _ := getManagerWithMockGroup(t, "test-group-id", false)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	reporter := &commitGapRecordingReporter{}
+	impl.getFactory().metricsReporter = reporter
+
+	_, err := manager.CommitGap("")
+	assert.NotNil(t, err)
+	_, err = manager.CommitGap("unknown-group-id")
+	assert.NotNil(t, err)
+
+	// A group without a tracker has no partitions
+	gaps, err := manager.CommitGap("test-group-id")
+	assert.Nil(t, err)
+	assert.Empty(t, gaps)
+
+	tracker := newCommitGapTracker()
+	tracker.claimed("topic-1", 0, 5)
+	for offset := int64(5); offset < 12; offset++ {
+		tracker.marked(&sarama.ConsumerMessage{Topic: "topic-1", Partition: 0, Offset: offset})
+	}
+	managedGrp.state().commitGap = tracker
+
+	// The committed offsets are queried from the broker
+	admin := &offsetsClusterAdmin{response: &sarama.OffsetFetchResponse{Blocks: map[string]map[int32]*sarama.OffsetFetchResponseBlock{
+		"topic-1": {0: {Offset: 9}},
+	}}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+	gaps, err = manager.CommitGap("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[int32]int64{"topic-1": {0: 3}}, gaps)
+	assert.Equal(t, []string{"gap test-group-id topic-1/0 3"}, reporter.recorded())
+
+	// A failed query leaves the gaps as they were
+	admin.err = fmt.Errorf("list error")
+	_, err = manager.CommitGap("test-group-id")
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]map[int32]int64{"topic-1": {0: 3}}, tracker.gaps())
+
+	// The periodic report skips a stopped group
+	admin.err = nil
+	admin.response.Blocks["topic-1"][0].Offset = 10
+	impl.groups["test-group-id"].(*managedGroupImpl).stopped.Store(true)
+	impl.reportCommitGaps("test-group-id")
+	assert.Equal(t, []string{"gap test-group-id topic-1/0 3"}, reporter.recorded())
+	impl.groups["test-group-id"].(*managedGroupImpl).stopped.Store(false)
+	impl.reportCommitGaps("test-group-id")
+	assert.Equal(t, []string{"gap test-group-id topic-1/0 3", "gap test-group-id topic-1/0 2"}, reporter.recorded())
+}
@@ -0,0 +1,442 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// defaultCommitInterval is the sarama default for Consumer.Offsets.AutoCommit.Interval
+const defaultCommitInterval = time.Second
+
+// maxCommitRetryBackoff bounds the exponential backoff between the commit attempts of WithCommitRetry
+const maxCommitRetryBackoff = 10 * time.Second
+
+// defaultFinalCommitTimeout is the time WithFinalCommit waits for the final commit, if not specified
+const defaultFinalCommitTimeout = 5 * time.Second
+
+// errCommitNotApplied means that the broker has not stored the committed offsets, which sarama does not report
+// if the commit request failed because the group coordinator moved
+var errCommitNotApplied = errors.New("the committed offsets were not stored by the broker")
+
+// CommitCallback is invoked after each offset commit cycle of a session, with the offsets committed in that
+// cycle (by topic and partition, as the next offset to be consumed) and any error that prevented the commit.
+type CommitCallback func(groupId string, committed map[string]map[int32]int64, err error)
+
+// WithCommitCallback makes the consumer flush its marked offsets to the broker at the commit interval of the
+// sarama config (instead of waiting for sarama's own auto-commit) and invoke the callback after each flush,
+// including the flush of the offsets that remain when a session ends (such as at a rebalance).  The callback is
+// invoked in its own goroutine so that it cannot block the session.  Since sarama does not return the result of a
+// flush, each flush is verified by fetching the committed offsets from the broker, and the callback receives an
+// error if the broker did not store them (see WithCommitRetry to also retry such a flush).  A ConsumerGroup that
+// was not started by the factory cannot verify its commits, so its callback receives no error for them.  Default is
+// no callback.
+func WithCommitCallback(callback CommitCallback) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.commitCallback = callback
+	}
+}
+
+// CommitRetryError is passed to the CommitCallback if the offsets of a commit cycle could not be committed,
+// despite the retries allowed by the WithCommitRetry option
+type CommitRetryError struct {
+	Attempts int // The number of commit requests made, including the first one
+	Err      error
+}
+
+// Error returns the failure of the last commit attempt
+func (e *CommitRetryError) Error() string {
+	return fmt.Sprintf("offsets not committed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the failure of the last commit attempt
+func (e *CommitRetryError) Unwrap() error {
+	return e.Err
+}
+
+// WithCommitRetry makes the consumer verify each periodic commit of its marked offsets (see WithCommitCallback)
+// with an offset fetch request, and retry it up to maxRetries times if it failed transiently, such as when the
+// broker is briefly unavailable or the group coordinator moved.  The backoff between attempts starts at the given
+// duration and doubles each time, up to ten seconds.  Permanent errors (e.g. an unknown group) are not retried.
+// If the offsets still are not committed, a CommitRetryError is passed to the commit callback, if there is one.
+// The option also sets Consumer.Offsets.Retry.Max, which sarama uses (without backoff) for the final commit when
+// a session is released.  Default is no verification, leaving the retries to sarama (which retries that final
+// commit three times).
+func WithCommitRetry(maxRetries int, backoff time.Duration) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.commitRetry = true
+		handler.commitRetries = maxRetries
+		handler.commitBackoff = backoff
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			if maxRetries < 0 {
+				return fmt.Errorf("invalid number of commit retries: %d", maxRetries)
+			}
+			config.Consumer.Offsets.Retry.Max = maxRetries
+			return nil
+		})
+	}
+}
+
+// WithFinalCommit makes the consumer commit its marked offsets when a session ends, after the in-flight messages have
+// finished but before the partitions are released, so that the messages handled since the last commit are not
+// redelivered to whichever member the partitions are assigned to next.  A session ends not only when a managed group
+// is stopped or closed, but also at every rebalance, which revokes the partitions while the group keeps running (and
+// is frequent in large groups), so the commit applies to both.  Sarama only flushes the marked offsets itself on
+// release if Consumer.Offsets.AutoCommit is enabled, and without reporting the outcome, so the final commit is
+// verified by fetching the committed offsets from the broker (if the ConsumerGroup was started by the factory).
+// The commit is best-effort: Cleanup waits for it at most the given timeout (or five seconds, if the timeout is
+// not positive), and logs a warning if it did not finish in time or the broker did not store the offsets.  Any
+// commit callback receives the outcome of the final commit.  Default is no final commit by the consumer.
+func WithFinalCommit(timeout time.Duration) SaramaConsumerHandlerOption {
+	if timeout <= 0 {
+		timeout = defaultFinalCommitTimeout
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.finalCommitTimeout = timeout
+	}
+}
+
+// WithCommitEveryN makes the consumer commit its marked offsets after every n messages that it marks in a partition,
+// in addition to the periodic commits of sarama's auto-commit (or of WithCommitCallback), so that no more than n
+// messages of a partition are redelivered after a crash, however long they took to handle.  The commit is made by
+// the goroutine of the partition, which holds its next message until the commit has finished, and it covers the
+// marked offsets of all of the partitions of the session.  With WithCommitCallback or WithCommitRetry it is a commit
+// cycle of its own (which is reported to the callback), and with WithOffsetStore the offsets are saved to the store
+// instead.  The count of each partition starts over with every session, and no commit is made once the session has
+// ended (leaving the remaining offsets to the commit on release).  A value of n that is not positive is an error
+// when the ConsumerGroup is created.  Default is no count-based commits.
+func WithCommitEveryN(n int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		if n > 0 {
+			handler.commitCounter = &markCounter{n: n, counts: make(map[topicPartition]int)}
+		}
+		handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+			if n < 1 {
+				return fmt.Errorf("invalid number of messages per commit: %d", n)
+			}
+			return nil
+		})
+	}
+}
+
+// withClusterAdmin provides the means of creating the ClusterAdmin that verifies the commits of WithCommitRetry
+func withClusterAdmin(createAdmin func() (sarama.ClusterAdmin, error)) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.createAdmin = createAdmin
+	}
+}
+
+// withCommitInterval provides the commit interval of the sarama config used by the ConsumerGroup
+func withCommitInterval(interval time.Duration) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.commitInterval = interval
+	}
+}
+
+// commitTracker records the offsets that have been marked in a session and periodically commits them
+type commitTracker struct {
+	lock    sync.Mutex
+	pending map[string]map[int32]int64
+	cycle   sync.Mutex // Serializes the commit cycles of the ticker and WithCommitEveryN
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	admin   sarama.ClusterAdmin // Created when the first commit is verified, and closed when the tracker stops
+	saveErr error               // The outcome of the last Save of the OffsetStore (see WithOffsetStore)
+}
+
+// hasCommitCycles returns true if the marked offsets are committed by commit cycles of the consumer (with a commit
+// callback, retry or OffsetStore) rather than by sarama's auto-commit
+func (consumer *SaramaConsumerHandler) hasCommitCycles() bool {
+	return consumer.commitCallback != nil || consumer.commitRetry || consumer.offsetStore != nil
+}
+
+// startCommitTracker begins recording the marked offsets of the session, if they are committed by commit cycles or
+// by a final commit, and starts the periodic commit cycle in the former case
+func (consumer *SaramaConsumerHandler) startCommitTracker(session sarama.ConsumerGroupSession) {
+	if !consumer.hasCommitCycles() && consumer.finalCommitTimeout <= 0 {
+		return
+	}
+	tracker := &commitTracker{pending: make(map[string]map[int32]int64), stop: make(chan struct{})}
+	consumer.commits = tracker
+	if !consumer.hasCommitCycles() {
+		return // Only the final commit, when the tracker stops
+	}
+	interval := consumer.commitInterval
+	if interval <= 0 {
+		interval = defaultCommitInterval
+	}
+	tracker.stopped.Add(1)
+	go func() {
+		defer tracker.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				consumer.commit(session)
+			case <-tracker.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCommitTracker ends the periodic commit cycle and commits any remaining offsets
+func (consumer *SaramaConsumerHandler) stopCommitTracker(session sarama.ConsumerGroupSession) {
+	if consumer.commits == nil {
+		return
+	}
+	close(consumer.commits.stop)
+	consumer.commits.stopped.Wait()
+	consumer.commit(session)
+	if consumer.commits.admin != nil {
+		_ = consumer.commits.admin.Close()
+	}
+}
+
+// trackMarked records the offset of a message that was marked, to be reported at the next commit
+func (consumer *SaramaConsumerHandler) trackMarked(message *sarama.ConsumerMessage) {
+	if consumer.commits == nil {
+		return
+	}
+	consumer.commits.lock.Lock()
+	defer consumer.commits.lock.Unlock()
+	partitions, ok := consumer.commits.pending[message.Topic]
+	if !ok {
+		partitions = make(map[int32]int64)
+		consumer.commits.pending[message.Topic] = partitions
+	}
+	partitions[message.Partition] = message.Offset + 1
+}
+
+// markCounter counts the marked messages of each partition of a session, for WithCommitEveryN
+type markCounter struct {
+	n      int
+	lock   sync.Mutex
+	counts map[topicPartition]int
+}
+
+// mark counts a marked message, returning true (and starting the count of its partition over) if it is the nth one
+func (c *markCounter) mark(message *sarama.ConsumerMessage) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := topicPartition{topic: message.Topic, partition: message.Partition}
+	c.counts[key]++
+	if c.counts[key] < c.n {
+		return false
+	}
+	delete(c.counts, key)
+	return true
+}
+
+// reset starts the counts of all of the partitions over
+func (c *markCounter) reset() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts = make(map[topicPartition]int)
+}
+
+// commitIfDue commits the marked offsets of the session if the message is the nth one marked in its partition since
+// the last count-based commit (see WithCommitEveryN)
+func (consumer *SaramaConsumerHandler) commitIfDue(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) {
+	if !consumer.commitCounter.mark(message) || session.Context().Err() != nil {
+		return
+	}
+	if consumer.hasCommitCycles() {
+		consumer.commit(session)
+	} else {
+		session.Commit()
+	}
+}
+
+// commit flushes the marked offsets to the broker and reports them to the callback, if any were marked
+func (consumer *SaramaConsumerHandler) commit(session sarama.ConsumerGroupSession) {
+	consumer.commits.cycle.Lock()
+	defer consumer.commits.cycle.Unlock()
+	consumer.commits.lock.Lock()
+	committed := consumer.commits.pending
+	consumer.commits.pending = make(map[string]map[int32]int64)
+	consumer.commits.lock.Unlock()
+	if len(committed) == 0 {
+		return
+	}
+
+	groupId := ""
+	if handler, _ := consumer.getHandler(); handler != nil {
+		groupId = handler.GetConsumerGroup()
+	}
+	var err error
+	verified := consumer.offsetStore != nil || consumer.createAdmin != nil
+	if consumer.offsetStore != nil {
+		err = consumer.saveOffsets(groupId, committed)
+		consumer.commits.saveErr = err
+	} else if session.Context().Err() != nil && consumer.finalCommitTimeout > 0 {
+		err = consumer.finalCommit(session, groupId, committed)
+	} else {
+		err = consumer.commitWithRetry(session, groupId, committed)
+	}
+	if err == nil && verified {
+		consumer.confirmCommitted(committed)
+	}
+	consumer.logger.Debugw("Offset commit cycle finished", zap.String("groupId", groupId), zap.Any("committed", committed), zap.Error(err))
+	if consumer.commitCallback != nil {
+		go consumer.commitCallback(groupId, committed, err)
+	}
+}
+
+// finalCommit commits the marked offsets of a session that has ended and verifies that the broker stored them,
+// returning an error (and logging a warning) if it did not, or if the commit and its verification do not finish
+// within the timeout of WithFinalCommit.  A commit that times out carries on in the background, since sarama
+// provides no means of canceling it.
+func (consumer *SaramaConsumerHandler) finalCommit(session sarama.ConsumerGroupSession, groupId string, committed map[string]map[int32]int64) error {
+	done := make(chan error, 1)
+	go func() {
+		session.Commit()
+		if consumer.createAdmin == nil {
+			done <- nil // Cannot be verified
+			return
+		}
+		// A ClusterAdmin of its own, since the one of the commit tracker is closed if the commit times out
+		done <- consumer.verifyDrainCommit(groupId, committed)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(consumer.finalCommitTimeout):
+		err = fmt.Errorf("final offset commit did not finish within %v", consumer.finalCommitTimeout)
+	}
+	if err != nil {
+		consumer.logger.Warnw("Failed to commit the marked offsets before the session was released", zap.String("groupId", groupId), zap.Error(err))
+		return err
+	}
+	consumer.logger.Debugw("Final offset commit finished", zap.String("groupId", groupId))
+	return nil
+}
+
+// commitWithRetry commits the marked offsets of the session and verifies that the broker stored them (if the
+// ConsumerGroup was started by the factory), and if the WithCommitRetry option was given, repeats the commit after
+// a backoff while the failure is transient.  Since sarama keeps the offsets that it failed to commit, and a commit
+// without any new offsets sends no request, repeating it only resends the missing offsets.  The session may have
+// ended already, in which case the commit is made (before sarama releases the partitions) but not retried.
+func (consumer *SaramaConsumerHandler) commitWithRetry(session sarama.ConsumerGroupSession, groupId string, committed map[string]map[int32]int64) error {
+	backoff := consumer.commitBackoff
+	for attempts := 1; ; attempts++ {
+		session.Commit()
+		if !consumer.commitRetry && consumer.createAdmin == nil {
+			return nil // Cannot be verified
+		}
+		err := consumer.verifyCommitted(groupId, committed)
+		if err == nil {
+			return nil
+		}
+		if !consumer.commitRetry {
+			return err
+		}
+		if attempts > consumer.commitRetries || !isTransientCommitError(err) {
+			return &CommitRetryError{Attempts: attempts, Err: err}
+		}
+		consumer.logger.Infow("Offset commit failed - retrying", zap.String("groupId", groupId), zap.Int("attempt", attempts),
+			zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-session.Context().Done():
+			return &CommitRetryError{Attempts: attempts, Err: err}
+		}
+		if backoff *= 2; backoff > maxCommitRetryBackoff {
+			backoff = maxCommitRetryBackoff
+		}
+	}
+}
+
+// verifyCommitted checks the committed offsets with the ClusterAdmin of the commit tracker, creating it if needed
+func (consumer *SaramaConsumerHandler) verifyCommitted(groupId string, committed map[string]map[int32]int64) error {
+	if consumer.commits.admin == nil {
+		if consumer.createAdmin == nil {
+			return fmt.Errorf("commits cannot be verified for a ConsumerGroup that was not started by the factory")
+		}
+		admin, err := consumer.createAdmin()
+		if err != nil {
+			return err
+		}
+		consumer.commits.admin = admin
+	}
+	return consumer.checkCommitted(consumer.commits.admin, groupId, committed)
+}
+
+// checkCommitted fetches the offsets that the broker has stored for the group via the given ClusterAdmin, and
+// returns an error if any of them is older than the one that was committed
+func (consumer *SaramaConsumerHandler) checkCommitted(admin sarama.ClusterAdmin, groupId string, committed map[string]map[int32]int64) error {
+	partitions := make(map[string][]int32, len(committed))
+	for topic, offsets := range committed {
+		for partition := range offsets {
+			partitions[topic] = append(partitions[topic], partition)
+		}
+	}
+	if consumer.brokerGroupId != "" {
+		groupId = consumer.brokerGroupId
+	}
+	response, err := admin.ListConsumerGroupOffsets(groupId, partitions)
+	if err != nil {
+		return err
+	}
+	if response.Err != sarama.ErrNoError {
+		return response.Err
+	}
+	for topic, offsets := range committed {
+		for partition, offset := range offsets {
+			block := response.GetBlock(topic, partition)
+			if block == nil {
+				return errCommitNotApplied
+			}
+			if block.Err != sarama.ErrNoError {
+				return block.Err
+			}
+			if block.Offset < offset {
+				return errCommitNotApplied
+			}
+		}
+	}
+	return nil
+}
+
+// isTransientCommitError returns true if a commit that failed with the given error may succeed if it is repeated
+func isTransientCommitError(err error) bool {
+	var kerr sarama.KError
+	if !errors.As(err, &kerr) {
+		return true // Network errors, and commits that were dropped by sarama
+	}
+	switch kerr {
+	case sarama.ErrRequestTimedOut, sarama.ErrNotLeaderForPartition, sarama.ErrLeaderNotAvailable,
+		sarama.ErrOffsetsLoadInProgress, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrNotCoordinatorForConsumer,
+		sarama.ErrNetworkException, sarama.ErrRebalanceInProgress:
+		return true
+	default:
+		return false
+	}
+}
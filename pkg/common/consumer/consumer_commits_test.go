@@ -0,0 +1,475 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// committingSession is a mockConsumerGroupSession that counts commits and may be canceled
+type committingSession struct {
+	mockConsumerGroupSession
+	ctx     context.Context
+	commits int32
+}
+
+func (s *committingSession) Commit() {
+	atomic.AddInt32(&s.commits, 1)
+}
+
+func (s *committingSession) Context() context.Context {
+	return s.ctx
+}
+
+func TestCommitCallback(t *testing.T) {
+	type commitResult struct {
+		groupId   string
+		committed map[string]map[int32]int64
+		err       error
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		cancelSession bool
+		stored        *sarama.OffsetFetchResponse // The response of the offset fetch that verifies the commit, if any
+		expectErr     error
+	}{
+		{
+			name: "Commit During Session",
+		},
+		{
+			name:          "Session Ended",
+			cancelSession: true,
+		},
+		{
+			name:   "Commit Verified",
+			stored: offsetResponse(11, sarama.ErrNoError),
+		},
+		{
+			name:      "Commit Not Stored",
+			stored:    offsetResponse(4, sarama.ErrNoError),
+			expectErr: errCommitNotApplied,
+		},
+		{
+			name:          "Commit Not Stored Before Release",
+			cancelSession: true,
+			stored:        offsetResponse(4, sarama.ErrNoError),
+			expectErr:     errCommitNotApplied,
+		},
+		{
+			name:      "Commit Rejected",
+			stored:    offsetResponse(11, sarama.ErrNotCoordinatorForConsumer),
+			expectErr: sarama.ErrNotCoordinatorForConsumer,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			results := make(chan commitResult, 10)
+			callback := func(groupId string, committed map[string]map[int32]int64, err error) {
+				results <- commitResult{groupId: groupId, committed: committed, err: err}
+			}
+			options := []SaramaConsumerHandlerOption{WithCommitCallback(callback), withCommitInterval(time.Hour)}
+			if testCase.stored != nil {
+				admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{testCase.stored}}
+				options = append(options, withClusterAdmin(func() (sarama.ClusterAdmin, error) { return admin, nil }))
+			}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 1), options...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			session := &committingSession{ctx: ctx}
+			message := mockMessage
+			message.Topic = "test-topic"
+			message.Partition = 1
+			message.Offset = 10
+
+			_ = cgh.Setup(session)
+			_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &message})
+			if testCase.cancelSession {
+				cancel()
+			}
+			_ = cgh.Cleanup(session) // Commits the remaining offsets immediately instead of waiting for the interval
+
+			select {
+			case result := <-results:
+				assert.Equal(t, "consumer group", result.groupId)
+				assert.Equal(t, map[string]map[int32]int64{"test-topic": {1: 11}}, result.committed)
+				assert.ErrorIs(t, result.err, testCase.expectErr) // A nil expectErr requires a nil error
+			case <-time.After(shortTimeout):
+				assert.Fail(t, "commit callback was not invoked")
+			}
+			assert.Equal(t, int32(1), atomic.LoadInt32(&session.commits))
+			assert.Len(t, results, 0)
+		})
+	}
+}
+
+func TestCommitInterval(t *testing.T) {
+	commits := make(chan map[string]map[int32]int64, 10)
+	callback := func(groupId string, committed map[string]map[int32]int64, err error) {
+		commits <- committed
+	}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 1),
+		WithCommitCallback(callback), withCommitInterval(5*time.Millisecond))
+
+	session := &committingSession{ctx: context.Background()}
+	_ = cgh.Setup(session)
+	cgh.trackMarked(&sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 4})
+	select {
+	case committed := <-commits:
+		assert.Equal(t, map[string]map[int32]int64{"test-topic": {1: 5}}, committed)
+	case <-time.After(shortTimeout):
+		assert.Fail(t, "commit callback was not invoked at the interval")
+	}
+	_ = cgh.Cleanup(session)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&session.commits))
+}
+
+// blockingCommitSession is a committingSession whose Commit blocks until it is released
+type blockingCommitSession struct {
+	committingSession
+	release chan struct{}
+}
+
+func (s *blockingCommitSession) Commit() {
+	<-s.release
+	s.committingSession.Commit()
+}
+
+func TestFinalCommit(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		options       []SaramaConsumerHandlerOption
+		blockCommit   bool
+		withCallback  bool
+		stored        *sarama.OffsetFetchResponse // The response of the offset fetch that verifies the commit, if any
+		expectCommits int32
+		expectWarning bool
+		expectErr     error
+	}{
+		{
+			name: "No Final Commit",
+		},
+		{
+			name:          "Final Commit",
+			options:       []SaramaConsumerHandlerOption{WithFinalCommit(shortTimeout)},
+			expectCommits: 1,
+		},
+		{
+			name:          "Final Commit With Callback",
+			options:       []SaramaConsumerHandlerOption{WithFinalCommit(shortTimeout)},
+			withCallback:  true,
+			expectCommits: 1,
+		},
+		{
+			name:          "Final Commit Verified",
+			options:       []SaramaConsumerHandlerOption{WithFinalCommit(shortTimeout)},
+			withCallback:  true,
+			stored:        offsetResponse(2, sarama.ErrNoError),
+			expectCommits: 1,
+		},
+		{
+			name:          "Final Commit Not Stored",
+			options:       []SaramaConsumerHandlerOption{WithFinalCommit(shortTimeout)},
+			withCallback:  true,
+			stored:        offsetResponse(1, sarama.ErrNoError),
+			expectCommits: 1,
+			expectWarning: true,
+			expectErr:     errCommitNotApplied,
+		},
+		{
+			name:          "Final Commit Timeout",
+			options:       []SaramaConsumerHandlerOption{WithFinalCommit(10 * time.Millisecond)},
+			blockCommit:   true,
+			expectWarning: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			results := make(chan error, 10)
+			options := testCase.options
+			if testCase.stored != nil {
+				admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{testCase.stored}}
+				options = append(options, withClusterAdmin(func() (sarama.ClusterAdmin, error) { return admin, nil }))
+			}
+			if testCase.withCallback {
+				options = append(options, withCommitInterval(time.Hour), WithCommitCallback(func(_ string, _ map[string]map[int32]int64, err error) {
+					results <- err
+				}))
+			}
+			core, logs := observer.New(zapcore.WarnLevel)
+			cgh := NewConsumerHandler(zap.New(core).Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 1), options...)
+
+			// The session has already ended when Cleanup is called, as it is for a sarama ConsumerGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			session := &blockingCommitSession{committingSession: committingSession{ctx: ctx}, release: make(chan struct{})}
+			if !testCase.blockCommit {
+				close(session.release)
+			}
+			_ = cgh.Setup(session)
+			_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 1}})
+			cancel()
+
+			start := time.Now()
+			assert.Nil(t, cgh.Cleanup(session))
+			assert.Less(t, int64(time.Since(start)), int64(shortTimeout))
+			assert.Equal(t, testCase.expectCommits, atomic.LoadInt32(&session.commits))
+			assert.Equal(t, testCase.expectWarning, logs.Len() > 0)
+			if testCase.withCallback {
+				select {
+				case err := <-results:
+					assert.ErrorIs(t, err, testCase.expectErr) // A nil expectErr requires a nil error
+				case <-time.After(shortTimeout):
+					assert.Fail(t, "commit callback was not invoked")
+				}
+			}
+			if testCase.blockCommit {
+				close(session.release)
+			}
+		})
+	}
+}
+
+func TestFinalCommitOnRebalance(t *testing.T) {
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	stored := &sarama.OffsetFetchResponse{}
+	stored.AddBlock("test-topic", 0, &sarama.OffsetFetchResponseBlock{Offset: 3})
+	admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{stored}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	var sessions []*committingSession
+	consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+		if len(sessions) == 2 {
+			return sarama.ErrClosedConsumerGroup
+		}
+		// A rebalance ends the session (revoking its partitions) while the group keeps consuming
+		sessionCtx, cancel := context.WithCancel(ctx)
+		session := &committingSession{ctx: sessionCtx}
+		sessions = append(sessions, session)
+		_ = handler.Setup(session)
+		_ = handler.ConsumeClaim(session, mockConsumerGroupClaim{msg: &sarama.ConsumerMessage{Topic: "test-topic", Offset: int64(len(sessions))}})
+		cancel()
+		_ = handler.Cleanup(session)
+		return nil
+	}
+
+	group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{"test-topic"}, zap.NewNop().Sugar(),
+		mockMessageHandler{shouldMark: true}, nil, WithFinalCommit(shortTimeout))
+	<-group.state.done
+	assert.Len(t, sessions, 2)
+	for _, session := range sessions {
+		assert.Equal(t, int32(1), atomic.LoadInt32(&session.commits))
+	}
+	assert.Equal(t, 2, admin.fetches) // Each final commit was verified
+}
+
+// sequenceClusterAdmin is a sarama.ClusterAdmin that returns the given offset fetch responses in order (repeating
+// the last one)
+type sequenceClusterAdmin struct {
+	sarama.ClusterAdmin
+	responses []*sarama.OffsetFetchResponse
+	fetches   int
+	closed    bool
+	groupId   string // The group.id of the last fetch
+}
+
+func (a *sequenceClusterAdmin) ListConsumerGroupOffsets(groupId string, _ map[string][]int32) (*sarama.OffsetFetchResponse, error) {
+	a.groupId = groupId
+	a.fetches++
+	if a.fetches > len(a.responses) {
+		return a.responses[len(a.responses)-1], nil
+	}
+	return a.responses[a.fetches-1], nil
+}
+
+func (a *sequenceClusterAdmin) Close() error {
+	a.closed = true
+	return nil
+}
+
+// offsetResponse returns an OffsetFetchResponse with the offset of partition 1 of "test-topic"
+func offsetResponse(offset int64, err sarama.KError) *sarama.OffsetFetchResponse {
+	response := &sarama.OffsetFetchResponse{Err: err}
+	response.AddBlock("test-topic", 1, &sarama.OffsetFetchResponseBlock{Offset: offset, Err: sarama.ErrNoError})
+	return response
+}
+
+func TestCommitRetry(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		responses      []*sarama.OffsetFetchResponse
+		expectCommits  int32
+		expectAttempts int
+		expectErr      error
+	}{
+		{
+			name:          "Committed",
+			responses:     []*sarama.OffsetFetchResponse{offsetResponse(5, sarama.ErrNoError)},
+			expectCommits: 1,
+		},
+		{
+			name:          "Transient Failure Then Committed",
+			responses:     []*sarama.OffsetFetchResponse{offsetResponse(2, sarama.ErrNoError), offsetResponse(5, sarama.ErrNoError)},
+			expectCommits: 2,
+		},
+		{
+			name:           "Retries Exhausted",
+			responses:      []*sarama.OffsetFetchResponse{offsetResponse(2, sarama.ErrNoError)},
+			expectCommits:  3,
+			expectAttempts: 3,
+			expectErr:      errCommitNotApplied,
+		},
+		{
+			name:           "Permanent Failure",
+			responses:      []*sarama.OffsetFetchResponse{offsetResponse(2, sarama.ErrGroupIDNotFound)},
+			expectCommits:  1,
+			expectAttempts: 1,
+			expectErr:      sarama.ErrGroupIDNotFound,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			results := make(chan error, 1)
+			var callbackGroupId string
+			callback := func(groupId string, committed map[string]map[int32]int64, err error) {
+				callbackGroupId = groupId
+				results <- err
+			}
+			admin := &sequenceClusterAdmin{responses: testCase.responses}
+			createAdmin := func() (sarama.ClusterAdmin, error) { return admin, nil }
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1), WithCommitCallback(callback),
+				WithCommitRetry(2, time.Millisecond), withClusterAdmin(createAdmin), withCommitInterval(time.Hour),
+				withBrokerGroupId("broker-group"))
+
+			session := &committingSession{ctx: context.Background()}
+			_ = cgh.Setup(session)
+			cgh.trackMarked(&sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 4})
+			_ = cgh.Cleanup(session)
+
+			select {
+			case err := <-results:
+				if testCase.expectErr == nil {
+					assert.Nil(t, err)
+				} else {
+					var retryErr *CommitRetryError
+					assert.True(t, errors.As(err, &retryErr))
+					assert.Equal(t, testCase.expectAttempts, retryErr.Attempts)
+					assert.True(t, errors.Is(err, testCase.expectErr))
+				}
+			case <-time.After(shortTimeout):
+				assert.Fail(t, "commit callback was not invoked")
+			}
+			assert.Equal(t, testCase.expectCommits, atomic.LoadInt32(&session.commits))
+			assert.True(t, admin.closed)
+			// The offsets are fetched for the group.id on the broker, but the callback receives the GroupId of the handler
+			assert.Equal(t, "broker-group", admin.groupId)
+			assert.Equal(t, "consumer group", callbackGroupId)
+		})
+	}
+}
+
+func TestCommitRetryConfig(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	config, err := factory.groupConfig([]SaramaConsumerHandlerOption{WithCommitRetry(5, time.Second)})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, config.Consumer.Offsets.Retry.Max)
+	assert.Equal(t, 3, factory.config.Consumer.Offsets.Retry.Max)
+
+	_, err = factory.groupConfig([]SaramaConsumerHandlerOption{WithCommitRetry(-1, time.Second)})
+	assert.NotNil(t, err)
+}
+
+func TestCommitEveryN(t *testing.T) {
+	messages := make([]*sarama.ConsumerMessage, 7)
+	for i := range messages {
+		messages[i] = &sarama.ConsumerMessage{Topic: "topic", Offset: int64(i)}
+	}
+
+	// Without a commit tracker, the session is committed after every third marked message
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, nil, WithCommitEveryN(3))
+	session := &committingSession{ctx: context.Background()}
+	assert.Nil(t, cgh.Setup(session))
+	assert.Nil(t, cgh.ConsumeClaim(session, multiMessageClaim{messages: messages}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&session.commits))
+
+	// Messages that are not marked are not counted
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, WithCommitEveryN(3))
+	session = &committingSession{ctx: context.Background()}
+	assert.Nil(t, cgh.ConsumeClaim(session, multiMessageClaim{messages: messages}))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&session.commits))
+
+	// With a commit tracker, each count-based commit is a commit cycle of its own
+	results := make(chan map[string]map[int32]int64, 10)
+	callback := func(_ string, committed map[string]map[int32]int64, _ error) { results <- committed }
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, nil,
+		WithCommitEveryN(3), WithCommitCallback(callback), withCommitInterval(time.Hour))
+	session = &committingSession{ctx: context.Background()}
+	assert.Nil(t, cgh.Setup(session))
+	assert.Nil(t, cgh.ConsumeClaim(session, multiMessageClaim{messages: messages}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&session.commits))
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 3}}, <-results)
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 6}}, <-results)
+	assert.Nil(t, cgh.Cleanup(session))
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 7}}, <-results)
+
+	// No commit is made once the session has ended
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, nil, WithCommitEveryN(1))
+	session = &committingSession{ctx: ctx}
+	cgh.commitIfDue(session, messages[0])
+	assert.Equal(t, int32(0), atomic.LoadInt32(&session.commits))
+}
+
+func TestMarkCounter(t *testing.T) {
+	counter := &markCounter{n: 2, counts: make(map[topicPartition]int)}
+	assert.False(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 0}))
+	assert.False(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 1}))
+	assert.True(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 0}))
+	assert.False(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 0}))
+
+	// A new session starts the counts over
+	counter.reset()
+	assert.False(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 1}))
+	assert.True(t, counter.mark(&sarama.ConsumerMessage{Topic: "topic", Partition: 1}))
+
+	var none *markCounter
+	assert.False(t, none.mark(&sarama.ConsumerMessage{}))
+	none.reset()
+}
+
+func TestCommitEveryNConfig(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	_, err := factory.groupConfig([]SaramaConsumerHandlerOption{WithCommitEveryN(10)})
+	assert.Nil(t, err)
+
+	for _, n := range []int{0, -1} {
+		_, err = factory.groupConfig([]SaramaConsumerHandlerOption{WithCommitEveryN(n)})
+		assert.NotNil(t, err)
+		handler := SaramaConsumerHandler{}
+		WithCommitEveryN(n)(&handler)
+		assert.Nil(t, handler.commitCounter)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+)
+
+// maxDeadLetterHeaderValueLength is the number of bytes that the value of a failure metadata header is truncated
+// to, so that a long error string cannot make the dead letter record exceed the maximum message size
+const maxDeadLetterHeaderValueLength = 1024
+
+// DeadLetterHeaderKeys are the keys of the headers that WithDeadLetterHeaders adds to the messages sent to the
+// dead letter topic
+type DeadLetterHeaderKeys struct {
+	Topic     string // The topic that the message was consumed from
+	Partition string // The partition that the message was consumed from
+	Offset    string // The offset of the message in that partition
+	Error     string // The reason that the message was sent to the dead letter topic
+	Timestamp string // The time at which it was sent, in RFC 3339 format (UTC)
+	Attempts  string // The number of times that the message has failed (see WithDeadLetterHeaders)
+	GroupId   string // The group.id of the ConsumerGroup that consumed the message
+}
+
+// DefaultDeadLetterHeaderKeys returns the header keys that WithDeadLetterHeaders uses for the fields that are empty
+func DefaultDeadLetterHeaderKeys() DeadLetterHeaderKeys {
+	return DeadLetterHeaderKeys{
+		Topic:     "dlq-original-topic",
+		Partition: "dlq-original-partition",
+		Offset:    "dlq-original-offset",
+		Error:     "dlq-error",
+		Timestamp: "dlq-failed-at",
+		Attempts:  "dlq-attempts",
+		GroupId:   "dlq-consumer-group",
+	}
+}
+
+// WithDeadLetterHeaders makes the messages that are sent to the topic of the WithDeadLetterTopic option carry
+// headers describing the failure: the topic, partition and offset that the message was consumed from, the error,
+// the time, the number of attempts, and the group.id of the ConsumerGroup (as used with the broker).  The keys are
+// those of the given DeadLetterHeaderKeys, with those of DefaultDeadLetterHeaderKeys for its empty fields.  Each
+// value is truncated to 1024 bytes (at a UTF-8 character boundary).  A header of the original message with one of
+// these keys is replaced rather than repeated, except that the number of attempts of a message that already has
+// that header (e.g. one that is being re-processed from the dead letter topic) is incremented rather than
+// starting at one.  Default is no failure metadata headers.
+func WithDeadLetterHeaders(keys DeadLetterHeaderKeys) SaramaConsumerHandlerOption {
+	defaults := DefaultDeadLetterHeaderKeys()
+	for _, field := range []struct{ key, fallback *string }{
+		{&keys.Topic, &defaults.Topic},
+		{&keys.Partition, &defaults.Partition},
+		{&keys.Offset, &defaults.Offset},
+		{&keys.Error, &defaults.Error},
+		{&keys.Timestamp, &defaults.Timestamp},
+		{&keys.Attempts, &defaults.Attempts},
+		{&keys.GroupId, &defaults.GroupId},
+	} {
+		if *field.key == "" {
+			*field.key = *field.fallback
+		}
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.deadLetterHeaderKeys = &keys
+	}
+}
+
+// deadLetterHeaders returns the headers of the copy of the message that is sent to the dead letter topic because
+// of the given cause, which are the original headers plus any failure metadata headers
+func (consumer *SaramaConsumerHandler) deadLetterHeaders(message *sarama.ConsumerMessage, cause error) []sarama.RecordHeader {
+	keys := consumer.deadLetterHeaderKeys
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+7)
+	attempts := 1
+	for _, header := range message.Headers {
+		if header == nil {
+			continue
+		}
+		if keys != nil {
+			switch string(header.Key) {
+			case keys.Attempts:
+				if previous, err := strconv.Atoi(string(header.Value)); err == nil && previous > 0 {
+					attempts = previous + 1
+				}
+				continue
+			case keys.Topic, keys.Partition, keys.Offset, keys.Error, keys.Timestamp, keys.GroupId:
+				continue
+			}
+		}
+		headers = append(headers, *header)
+	}
+	if keys == nil {
+		return headers
+	}
+
+	groupId := consumer.brokerGroupId
+	if handler, _ := consumer.getHandler(); groupId == "" && handler != nil {
+		groupId = handler.GetConsumerGroup()
+	}
+	errorString := ""
+	if cause != nil {
+		errorString = cause.Error()
+	}
+	for _, metadata := range []struct{ key, value string }{
+		{keys.Topic, message.Topic},
+		{keys.Partition, strconv.FormatInt(int64(message.Partition), 10)},
+		{keys.Offset, strconv.FormatInt(message.Offset, 10)},
+		{keys.Error, errorString},
+		{keys.Timestamp, time.Now().UTC().Format(time.RFC3339Nano)},
+		{keys.Attempts, strconv.Itoa(attempts)},
+		{keys.GroupId, groupId},
+	} {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(metadata.key), Value: []byte(truncateHeaderValue(metadata.value))})
+	}
+	return headers
+}
+
+// truncateHeaderValue shortens the value to at most maxDeadLetterHeaderValueLength bytes without splitting a
+// UTF-8 character
+func truncateHeaderValue(value string) string {
+	if len(value) <= maxDeadLetterHeaderValueLength {
+		return value
+	}
+	cut := maxDeadLetterHeaderValueLength
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut]
+}
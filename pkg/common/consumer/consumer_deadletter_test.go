@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDeadLetterHeaders(t *testing.T) {
+	header := func(key string, value string) *sarama.RecordHeader {
+		return &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+	}
+	for _, testCase := range []struct {
+		name          string
+		options       []SaramaConsumerHandlerOption
+		headers       []*sarama.RecordHeader
+		cause         error
+		expectHeaders map[string]string
+	}{
+		{
+			name:          "No Metadata Headers",
+			headers:       []*sarama.RecordHeader{header("header", "1"), nil},
+			cause:         fmt.Errorf("failure"),
+			expectHeaders: map[string]string{"header": "1"},
+		},
+		{
+			name:    "Default Keys",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterHeaders(DeadLetterHeaderKeys{})},
+			headers: []*sarama.RecordHeader{header("header", "1")},
+			cause:   fmt.Errorf("failure"),
+			expectHeaders: map[string]string{
+				"header":                 "1",
+				"dlq-original-topic":     "topic",
+				"dlq-original-partition": "2",
+				"dlq-original-offset":    "42",
+				"dlq-error":              "failure",
+				"dlq-attempts":           "1",
+				"dlq-consumer-group":     "consumer group",
+			},
+		},
+		{
+			name: "Custom Keys And Broker Group Id",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterHeaders(DeadLetterHeaderKeys{Error: "x-error", GroupId: "x-group"}),
+				withBrokerGroupId("prod.consumer-group")},
+			cause: fmt.Errorf("failure"),
+			expectHeaders: map[string]string{
+				"dlq-original-topic":     "topic",
+				"dlq-original-partition": "2",
+				"dlq-original-offset":    "42",
+				"x-error":                "failure",
+				"dlq-attempts":           "1",
+				"x-group":                "prod.consumer-group",
+			},
+		},
+		{
+			name:    "Previously Dead-Lettered",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterHeaders(DeadLetterHeaderKeys{})},
+			headers: []*sarama.RecordHeader{header("dlq-attempts", "2"), header("dlq-error", "old failure"), header("dlq-original-topic", "dlq")},
+			cause:   fmt.Errorf("failure"),
+			expectHeaders: map[string]string{
+				"dlq-original-topic":     "topic",
+				"dlq-original-partition": "2",
+				"dlq-original-offset":    "42",
+				"dlq-error":              "failure",
+				"dlq-attempts":           "3",
+				"dlq-consumer-group":     "consumer group",
+			},
+		},
+		{
+			name:    "Truncated Error",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterHeaders(DeadLetterHeaderKeys{})},
+			cause:   fmt.Errorf("%s", "x"+strings.Repeat("é", 1000)),
+			expectHeaders: map[string]string{
+				"dlq-original-topic":     "topic",
+				"dlq-original-partition": "2",
+				"dlq-original-offset":    "42",
+				"dlq-error":              "x" + strings.Repeat("é", 511), // 1023 bytes, since a character cannot be split
+				"dlq-attempts":           "1",
+				"dlq-consumer-group":     "consumer group",
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			producer := &sendingProducer{}
+			options := append([]SaramaConsumerHandlerOption{WithDeadLetterTopic("dlq"), withGroupState(&groupState{producer: producer})}, testCase.options...)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1), options...)
+			message := &sarama.ConsumerMessage{Topic: "topic", Partition: 2, Offset: 42, Value: []byte("value"), Headers: testCase.headers}
+
+			before := time.Now()
+			assert.Nil(t, cgh.sendToDeadLetterTopic(message, testCase.cause))
+			assert.Len(t, producer.sent, 1)
+			headers := make(map[string]string)
+			for _, sent := range producer.sent[0].Headers {
+				_, repeated := headers[string(sent.Key)]
+				assert.False(t, repeated, string(sent.Key))
+				headers[string(sent.Key)] = string(sent.Value)
+			}
+
+			// The timestamp is the time of sending
+			if timestamp, ok := headers["dlq-failed-at"]; ok {
+				failedAt, err := time.Parse(time.RFC3339Nano, timestamp)
+				assert.Nil(t, err)
+				assert.False(t, failedAt.Before(before.Truncate(time.Second)))
+				assert.False(t, failedAt.After(time.Now()))
+				delete(headers, "dlq-failed-at")
+			} else {
+				assert.Len(t, testCase.options, 0)
+			}
+			assert.Equal(t, testCase.expectHeaders, headers)
+		})
+	}
+}
+
+func TestTruncateHeaderValue(t *testing.T) {
+	assert.Equal(t, "short", truncateHeaderValue("short"))
+	long := strings.Repeat("a", maxDeadLetterHeaderValueLength+10)
+	assert.Equal(t, long[:maxDeadLetterHeaderValueLength], truncateHeaderValue(long))
+}
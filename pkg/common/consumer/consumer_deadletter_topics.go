@@ -0,0 +1,141 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+const (
+	// DeadLetterTopicPlaceholder is replaced, in the topic of WithDeadLetterTopic, by the topic of the message
+	DeadLetterTopicPlaceholder = "{topic}"
+	// DeadLetterGroupPlaceholder is replaced, in the topic of WithDeadLetterTopic, by the GroupId of the ConsumerGroup
+	DeadLetterGroupPlaceholder = "{group}"
+)
+
+// maxTopicNameLength is the longest topic name that the brokers accept
+const maxTopicNameLength = 249
+
+// ErrInvalidDeadLetterTopic is wrapped by the error returned for a dead letter topic that is not a legal topic name
+var ErrInvalidDeadLetterTopic = errors.New("invalid dead letter topic")
+
+// WithDeadLetterTopicCreation makes the KafkaConsumerGroupFactory (and the manager) create the dead letter topics of
+// the WithDeadLetterTopic option that do not exist, with the given number of partitions and replication factor,
+// when the ConsumerGroup is started.  There is one such topic for each of the topics of the group if the name has
+// the DeadLetterTopicPlaceholder, and a single one otherwise.  As with WithTopicCheck, this is only done when the
+// group is first started, so the dead letter topics of the topics that a WithTopicPattern group subscribes to later
+// are not created.  If a topic cannot be created, the group is not started and an error is returned.  Default is no
+// creation.
+func WithDeadLetterTopicCreation(partitions int32, replicationFactor int16) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.deadLetterTopicDetail = &sarama.TopicDetail{NumPartitions: partitions, ReplicationFactor: replicationFactor}
+	}
+}
+
+// resolveDeadLetterTopic returns the dead letter topic of the given topic and GroupId, replacing the placeholders
+// in the name of the WithDeadLetterTopic option, and returns an error if the result is not a legal topic name
+func resolveDeadLetterTopic(name string, topic string, groupId string) (string, error) {
+	resolved := strings.NewReplacer(DeadLetterTopicPlaceholder, topic, DeadLetterGroupPlaceholder, groupId).Replace(name)
+	if err := validateTopicName(resolved); err != nil {
+		return "", fmt.Errorf("%w %q (from %q) - %v", ErrInvalidDeadLetterTopic, resolved, name, err)
+	}
+	return resolved, nil
+}
+
+// validateTopicName returns an error if the brokers would not accept the name of a topic
+func validateTopicName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("the name is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("the name cannot be %q", name)
+	case len(name) > maxTopicNameLength:
+		return fmt.Errorf("the name is longer than %d characters", maxTopicNameLength)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return fmt.Errorf("the name contains an illegal character %q", r)
+		}
+	}
+	return nil
+}
+
+// deadLetterTopicOf returns the dead letter topic that the message is sent to
+func (consumer *SaramaConsumerHandler) deadLetterTopicOf(message *sarama.ConsumerMessage) (string, error) {
+	groupId := ""
+	if handler, _ := consumer.getHandler(); handler != nil {
+		groupId = handler.GetConsumerGroup()
+	}
+	return resolveDeadLetterTopic(consumer.deadLetterTopic, message.Topic, groupId)
+}
+
+// createDeadLetterTopics creates the dead letter topics of the given topics that do not exist, if the
+// WithDeadLetterTopicCreation option is among the given ones
+func (c kafkaConsumerGroupFactoryImpl) createDeadLetterTopics(groupID string, topics []string, logger *zap.SugaredLogger, options ...SaramaConsumerHandlerOption) error {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	if scratch.deadLetterTopicDetail == nil || scratch.deadLetterTopic == "" {
+		return nil
+	}
+
+	var deadLetterTopics []string
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		deadLetterTopic, err := resolveDeadLetterTopic(scratch.deadLetterTopic, topic, groupID)
+		if err != nil {
+			return fmt.Errorf("could not start consumer group with id '%s' - %w", groupID, err)
+		}
+		if !seen[deadLetterTopic] {
+			seen[deadLetterTopic] = true
+			deadLetterTopics = append(deadLetterTopics, deadLetterTopic)
+		}
+	}
+	missing, err := c.missingTopics(deadLetterTopics, options)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	config, err := c.groupConfig(options)
+	if err != nil {
+		return err
+	}
+	admin, err := newClusterAdmin(c.addrs, config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+	for _, topic := range missing {
+		err = admin.CreateTopic(topic, scratch.deadLetterTopicDetail, false)
+		var topicErr *sarama.TopicError
+		if errors.As(err, &topicErr) && topicErr.Err == sarama.ErrTopicAlreadyExists {
+			continue // Created meanwhile
+		} else if err != nil {
+			return fmt.Errorf("could not create the dead letter topic %s of consumer group with id '%s': %w", topic, groupID, err)
+		}
+		logger.Infow("Created Dead Letter Topic Of ConsumerGroup", zap.String("GroupId", groupID), zap.String("Topic", topic))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// creatingClusterAdmin is a topicsClusterAdmin that also supports creating topics
+type creatingClusterAdmin struct {
+	*topicsClusterAdmin
+	created   []string
+	createErr error
+}
+
+func (a *creatingClusterAdmin) CreateTopic(topic string, detail *sarama.TopicDetail, _ bool) error {
+	if a.createErr != nil {
+		return a.createErr
+	}
+	a.created = append(a.created, topic)
+	a.topics[topic] = *detail
+	return nil
+}
+
+func TestResolveDeadLetterTopic(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		template  string
+		expect    string
+		expectErr bool
+	}{
+		{name: "Static", template: "dead-letters", expect: "dead-letters"},
+		{name: "Topic", template: "{topic}.dlq", expect: "orders.dlq"},
+		{name: "Topic And Group", template: "{group}_{topic}-dlq", expect: "group-1_orders-dlq"},
+		{name: "Repeated Placeholder", template: "{topic}.{topic}", expect: "orders.orders"},
+		{name: "Empty", template: "", expectErr: true},
+		{name: "Unknown Placeholder", template: "{partition}.dlq", expectErr: true},
+		{name: "Illegal Character", template: "{topic}/dlq", expectErr: true},
+		{name: "Dot", template: ".", expectErr: true},
+		{name: "Too Long", template: "{topic}." + strings.Repeat("x", maxTopicNameLength), expectErr: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			resolved, err := resolveDeadLetterTopic(testCase.template, "orders", "group-1")
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if testCase.expectErr {
+				assert.True(t, errors.Is(err, ErrInvalidDeadLetterTopic))
+			}
+			assert.Equal(t, testCase.expect, resolved)
+		})
+	}
+}
+
+func TestDeadLetterTopicTemplate(t *testing.T) {
+	// The template is validated when the config of the group is built
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig()}
+	_, err := factory.groupConfig([]SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}.dlq")})
+	assert.Nil(t, err)
+	_, err = factory.groupConfig([]SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}:dlq")})
+	assert.True(t, errors.Is(err, ErrInvalidDeadLetterTopic))
+
+	// Each message is sent to the dead letter topic of its own topic
+	producer := &sendingProducer{}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+		WithDeadLetterTopic("{topic}.dlq"), withGroupState(&groupState{producer: producer}))
+	for _, topic := range []string{"orders", "payments"} {
+		assert.Nil(t, cgh.sendToDeadLetterTopic(&sarama.ConsumerMessage{Topic: topic}, fmt.Errorf("failure")))
+	}
+	assert.Len(t, producer.sent, 2)
+	assert.Equal(t, "orders.dlq", producer.sent[0].Topic)
+	assert.Equal(t, "payments.dlq", producer.sent[1].Topic)
+
+	// A message whose dead letter topic is not legal is not sent (the GroupId of the mock handler has a space)
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+		WithDeadLetterTopic("{group}.dlq"), withGroupState(&groupState{producer: producer}))
+	err = cgh.sendToDeadLetterTopic(&sarama.ConsumerMessage{Topic: "orders"}, fmt.Errorf("failure"))
+	assert.True(t, errors.Is(err, ErrInvalidDeadLetterTopic))
+	assert.Len(t, producer.sent, 2)
+}
+
+func TestCreateDeadLetterTopics(t *testing.T) {
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+
+	for _, testCase := range []struct {
+		name          string
+		options       []SaramaConsumerHandlerOption
+		createErr     error
+		expectCreated []string
+		expectErr     bool
+	}{
+		{
+			name:    "No Creation",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}.dlq")},
+		},
+		{
+			name:    "No Dead Letter Topic",
+			options: []SaramaConsumerHandlerOption{WithDeadLetterTopicCreation(1, 1)},
+		},
+		{
+			name:          "Topic Per Source Topic",
+			options:       []SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}.dlq"), WithDeadLetterTopicCreation(3, 2)},
+			expectCreated: []string{"payments.dlq"}, // orders.dlq already exists
+		},
+		{
+			name:          "Single Topic",
+			options:       []SaramaConsumerHandlerOption{WithDeadLetterTopic("{group}.dlq"), WithDeadLetterTopicCreation(3, 2)},
+			expectCreated: []string{"group-id.dlq"},
+		},
+		{
+			name:          "Created Meanwhile",
+			options:       []SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}.dlq"), WithDeadLetterTopicCreation(3, 2)},
+			createErr:     &sarama.TopicError{Err: sarama.ErrTopicAlreadyExists},
+			expectCreated: nil,
+		},
+		{
+			name:      "Creation Fails",
+			options:   []SaramaConsumerHandlerOption{WithDeadLetterTopic("{topic}.dlq"), WithDeadLetterTopicCreation(3, 2)},
+			createErr: &sarama.TopicError{Err: sarama.ErrInvalidReplicationFactor},
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			admin := &creatingClusterAdmin{
+				topicsClusterAdmin: &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"orders": {}, "payments": {}, "orders.dlq": {}}},
+				createErr:          testCase.createErr,
+			}
+			newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+			err := factory.createDeadLetterTopics("group-id", []string{"orders", "payments"}, zap.NewNop().Sugar(), testCase.options...)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			assert.Equal(t, testCase.expectCreated, admin.created)
+			for _, created := range admin.created {
+				assert.Equal(t, sarama.TopicDetail{NumPartitions: 3, ReplicationFactor: 2}, admin.topics[created])
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// defaultDeferredStartInterval is the interval at which a deferred group checks its topics for data, if not specified
+const defaultDeferredStartInterval = 30 * time.Second
+
+// deferredStart contains the settings of the WithDeferredStart option
+type deferredStart struct {
+	interval  time.Duration // How often the topics are checked for data
+	threshold int64         // How many unconsumed messages the topics must have for the group to join
+}
+
+// WithDeferredStart makes StartConsumerGroup of the manager place the group under management without joining it
+// (or connecting to the brokers for it) while its topics have fewer than threshold messages that the group has not
+// consumed, so that a group of a mostly-idle topic does not hold its connections and membership while there is
+// nothing to consume.  The topics are checked when the group is started and then at the given interval, and once
+// they have enough messages, the group is started as if by a control-protocol start command and consumes as usual;
+// it is not deferred again when its topics are drained.  The unconsumed messages of a partition are those after
+// its committed offset (or all of its messages, if the group has not committed an offset for it).
+//
+// While its start is deferred, the group is stopped (see IsStopped), so anything that starts a stopped group, such
+// as a control-protocol start command or Reconfigure, also ends the deferral, and the group is not started while
+// the manager is inactive.  If the topics cannot be checked when the group is started, it joins right away rather
+// than risk never consuming; a failed check at the interval is logged and retried.  This option has no effect on a
+// factory that is not used by a manager.  Default is to join immediately; an interval that is not positive means 30
+// seconds, and a threshold of less than one means one.
+func WithDeferredStart(interval time.Duration, threshold int64) SaramaConsumerHandlerOption {
+	if interval <= 0 {
+		interval = defaultDeferredStartInterval
+	}
+	if threshold < 1 {
+		threshold = 1
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.deferredStart = &deferredStart{interval: interval, threshold: threshold}
+	}
+}
+
+// deferredStartOf returns the settings of the WithDeferredStart option among the given ones, if there is one
+func deferredStartOf(options []SaramaConsumerHandlerOption) *deferredStart {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	return scratch.deferredStart
+}
+
+// idleConsumerGroup is the sarama ConsumerGroup of a managed group while its start is deferred by WithDeferredStart.
+// It neither connects to the brokers nor joins the group, and its Consume call only returns when it is closed (or
+// its context is done).
+type idleConsumerGroup struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+	errors    chan error
+}
+
+var _ sarama.ConsumerGroup = (*idleConsumerGroup)(nil)
+
+// newIdleConsumerGroup returns an idleConsumerGroup that is open
+func newIdleConsumerGroup() *idleConsumerGroup {
+	return &idleConsumerGroup{closed: make(chan struct{}), errors: make(chan error)}
+}
+
+// Consume waits until the group is closed or the context is done
+func (g *idleConsumerGroup) Consume(ctx context.Context, _ []string, _ sarama.ConsumerGroupHandler) error {
+	select {
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Errors returns a channel that never receives an error, and is closed when the group is
+func (g *idleConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+// Close closes the group (and its errors channel), if it is not closed already
+func (g *idleConsumerGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		close(g.errors)
+	})
+	return nil
+}
+
+// deferStart returns the settings of the WithDeferredStart option of a new managed group if its start must be
+// deferred, because its topics do not have enough unconsumed messages, or nil otherwise
+func (m *kafkaConsumerGroupManagerImpl) deferStart(groupId string, topics []string, options []SaramaConsumerHandlerOption) *deferredStart {
+	deferred := deferredStartOf(options)
+	if deferred == nil {
+		return nil
+	}
+	pending, err := m.pendingMessages(groupId, options, topics)
+	if err != nil {
+		m.logger.Warn("Failed To Check The Topics Of New Managed ConsumerGroup For Data - Not Deferring Its Start",
+			zap.String("GroupId", groupId), zap.Error(err))
+		return nil
+	}
+	if pending >= deferred.threshold {
+		return nil
+	}
+	return deferred
+}
+
+// awaitTopicData checks the topics of a managed group whose start was deferred by WithDeferredStart at the interval
+// of the option, and starts the group once they have enough unconsumed messages.  It returns when the group has been
+// started (by this or anything else), or when the context is done (which happens when the group is closed).
+func (m *kafkaConsumerGroupManagerImpl) awaitTopicData(ctx context.Context, groupId string, deferred deferredStart) {
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	ticker := time.NewTicker(deferred.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		managedGrp := m.getGroup(groupId)
+		if managedGrp == nil || !managedGrp.isStopped() {
+			return // Closed, or started by something else
+		}
+		if !m.IsActive() {
+			continue
+		}
+		pending, err := m.pendingMessages(groupId, managedGrp.handlerOptions(), managedGrp.topics())
+		if err != nil {
+			groupLogger.Warn("Failed To Check The Topics Of Deferred ConsumerGroup For Data", zap.Error(err))
+			continue
+		}
+		if pending < deferred.threshold {
+			continue
+		}
+		groupLogger.Info("Topics Of Deferred ConsumerGroup Have Data - Starting The Group", zap.Int64("Pending", pending))
+		if err := m.startConsumerGroup(&commands.CommandLock{Token: internalToken}, groupId); err != nil {
+			groupLogger.Warn("Failed To Start Deferred ConsumerGroup", zap.Error(err))
+			continue
+		}
+		return
+	}
+}
+
+// pendingMessages returns the number of messages of the topics that the group has not consumed, which for each
+// partition is the number of messages after its committed offset, or all of its messages if there is none
+func (m *kafkaConsumerGroupManagerImpl) pendingMessages(groupId string, options []SaramaConsumerHandlerOption, topics []string) (int64, error) {
+	factory, err := m.getClusterFactory(clusterOf(options))
+	if err != nil {
+		return 0, err
+	}
+	admin, err := newClusterAdmin(factory.addrs, factory.config)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+	committed, err := admin.ListConsumerGroupOffsets(factory.brokerGroupId(groupId), nil)
+	if err != nil {
+		return 0, err
+	}
+	if committed.Err != sarama.ErrNoError {
+		return 0, committed.Err
+	}
+
+	client, err := newCommitClient(factory)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	var pending int64
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return 0, fmt.Errorf("could not get the partitions of topic %s: %w", topic, err)
+		}
+		for _, partition := range partitions {
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return 0, fmt.Errorf("could not get the newest offset of topic %s, partition %d: %w", topic, partition, err)
+			}
+			start := int64(-1)
+			if block := committed.GetBlock(topic, partition); block != nil && block.Err == sarama.ErrNoError {
+				start = block.Offset
+			}
+			if start < 0 {
+				if start, err = client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+					return 0, fmt.Errorf("could not get the oldest offset of topic %s, partition %d: %w", topic, partition, err)
+				}
+			}
+			if newest > start {
+				pending += newest - start
+			}
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWithDeferredStart(t *testing.T) {
+	assert.Nil(t, deferredStartOf(nil))
+	assert.Equal(t, &deferredStart{interval: time.Second, threshold: 5},
+		deferredStartOf([]SaramaConsumerHandlerOption{WithDeferredStart(time.Second, 5)}))
+	assert.Equal(t, &deferredStart{interval: defaultDeferredStartInterval, threshold: 1},
+		deferredStartOf([]SaramaConsumerHandlerOption{WithDeferredStart(0, 0)}))
+}
+
+func TestIdleConsumerGroup(t *testing.T) {
+	group := newIdleConsumerGroup()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, group.Consume(ctx, []string{"topic"}, nil))
+
+	consumed := make(chan error)
+	go func() { consumed <- group.Consume(context.Background(), []string{"topic"}, nil) }()
+	assert.Nil(t, group.Close())
+	assert.Nil(t, group.Close()) // Closing again is harmless
+	select {
+	case err := <-consumed:
+		assert.Equal(t, sarama.ErrClosedConsumerGroup, err)
+	case <-time.After(shortTimeout):
+		assert.Fail(t, "Consume did not return when the group was closed")
+	}
+	_, open := <-group.Errors()
+	assert.False(t, open)
+}
+
+// newDeferredStartBroker returns a MockBroker of a topic with two partitions (whose newest offsets are given), of
+// which the group "group" has committed the first at offset 10 and not the second
+func newDeferredStartBroker(t *testing.T, newest0 int64, newest1 int64) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	setDeferredStartOffsets(t, broker, newest0, newest1)
+	return broker
+}
+
+// setDeferredStartOffsets sets the responses of a MockBroker returned by newDeferredStartBroker
+func setDeferredStartOffsets(t *testing.T, broker *sarama.MockBroker, newest0 int64, newest1 int64) {
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetController(broker.BrokerID()).SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()).SetLeader("topic", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("topic", 0, sarama.OffsetOldest, 5).SetOffset("topic", 0, sarama.OffsetNewest, newest0).
+			SetOffset("topic", 1, sarama.OffsetOldest, 5).SetOffset("topic", 1, sarama.OffsetNewest, newest1),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "topic", 0, 10, "", sarama.ErrNoError).
+			SetOffset("group", "topic", 1, -1, "", sarama.ErrNoError),
+	})
+}
+
+func newDeferredStartConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_0_0
+	config.Metadata.Retry.Max = 0
+	return config
+}
+
+func TestPendingMessages(t *testing.T) {
+	broker := newDeferredStartBroker(t, 12, 8)
+	defer broker.Close()
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, newDeferredStartConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	// Two after the committed offset of the first partition, and every message of the second
+	pending, err := impl.pendingMessages("group", nil, []string{"topic"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), pending)
+
+	_, err = impl.pendingMessages("group", []SaramaConsumerHandlerOption{WithCluster("unknown")}, []string{"topic"})
+	assert.NotNil(t, err)
+}
+
+func TestDeferredStart(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	consumed := make(chan []string, 10)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &topicsConsumerGroup{consumed: consumed, closed: make(chan struct{})}, nil
+	}
+	broker := newDeferredStartBroker(t, 10, 5) // Nothing to consume
+	defer broker.Close()
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, newDeferredStartConfig())
+
+	// Without the option, the group joins immediately
+	assert.Nil(t, manager.StartConsumerGroup("immediate", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	select {
+	case <-consumed:
+	case <-time.After(shortTimeout):
+		assert.Fail(t, "group without a deferred start did not consume")
+	}
+	assert.False(t, manager.IsStopped("immediate"))
+
+	// While its topics have too few messages, the group is managed but stopped
+	assert.Nil(t, manager.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{},
+		WithDeferredStart(10*time.Millisecond, 3)))
+	assert.True(t, manager.IsManaged("group"))
+	assert.True(t, manager.IsStopped("group"))
+	setDeferredStartOffsets(t, broker, 12, 5)
+	select {
+	case topics := <-consumed:
+		assert.Fail(t, "group consumed before its topics had enough data", topics)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, manager.IsStopped("group"))
+
+	// Once they have enough, the group is started
+	setDeferredStartOffsets(t, broker, 13, 5)
+	select {
+	case topics := <-consumed:
+		assert.Equal(t, []string{"topic"}, topics)
+	case <-time.After(shortTimeout):
+		assert.Fail(t, "deferred group did not consume once its topics had data")
+	}
+	assert.False(t, manager.IsStopped("group"))
+
+	// A group whose topics already have enough data joins immediately
+	assert.Nil(t, manager.StartConsumerGroup("group-data", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{},
+		WithDeferredStart(time.Hour, 3)))
+	assert.False(t, manager.IsStopped("group-data"))
+
+	for _, groupId := range []string{"immediate", "group", "group-data"} {
+		assert.Nil(t, manager.CloseConsumerGroupAndWait(groupId, shortTimeout))
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// defaultDependencyTimeout is the time that Reconfigure and SetActive wait for a dependency to join before giving
+// up on starting its dependents
+const defaultDependencyTimeout = time.Minute
+
+// AddStartDependency declares that the group with the given groupId must only be started once the group that it
+// depends on is consuming, when the manager restarts several groups at once: Reconfigure (and the other functions
+// that restart the groups of a cluster) and SetActive(true) start the dependency first, and wait (for up to a minute)
+// for it to join its group before starting its dependents, and RollingReconfigure restarts the dependency before
+// its dependents.  If the dependency fails to start or join, its dependents are not started (and are reported as
+// failed).  A dependency that is not restarted along with its dependents (such as one of another cluster) is not
+// waited for, nor is a group added via AddExistingGroup, whose sessions the manager cannot observe.  The order of
+// the groups without dependencies between them is unchanged, and StartConsumerGroup is not affected, so the caller
+// remains responsible for the order of the first start.  The groups need not be managed yet, and a group may depend
+// on several others.  An error is returned if the dependency would create a cycle (including a group depending
+// on itself).
+func (m *kafkaConsumerGroupManagerImpl) AddStartDependency(groupId string, dependsOn string) error {
+	for _, id := range []string{groupId, dependsOn} {
+		if err := validateGroupId(id); err != nil {
+			return fmt.Errorf("could not add start dependency - %w", err)
+		}
+	}
+	m.dependencyLock.Lock()
+	defer m.dependencyLock.Unlock()
+	if path := m.dependencyPath(dependsOn, groupId); path != nil {
+		return fmt.Errorf("could not add start dependency of '%s' on '%s' - it would create the cycle %s", groupId, dependsOn,
+			strings.Join(append([]string{groupId}, path...), " -> "))
+	}
+	if m.dependencies == nil {
+		m.dependencies = make(map[string][]string)
+	}
+	for _, existing := range m.dependencies[groupId] {
+		if existing == dependsOn {
+			return nil
+		}
+	}
+	m.dependencies[groupId] = append(m.dependencies[groupId], dependsOn)
+	sort.Strings(m.dependencies[groupId])
+	return nil
+}
+
+// dependencyPath returns the groups from one group to another by following the dependencies (including both of
+// them), or nil if the other group cannot be reached.  The caller must hold the dependencyLock.
+func (m *kafkaConsumerGroupManagerImpl) dependencyPath(from string, to string) []string {
+	if from == to {
+		return []string{from}
+	}
+	for _, next := range m.dependencies[from] {
+		if path := m.dependencyPath(next, to); path != nil {
+			return append([]string{from}, path...)
+		}
+	}
+	return nil
+}
+
+// startDependencies returns the groups that the given group depends on
+func (m *kafkaConsumerGroupManagerImpl) startDependencies(groupId string) []string {
+	m.dependencyLock.RLock()
+	defer m.dependencyLock.RUnlock()
+	return append([]string(nil), m.dependencies[groupId]...)
+}
+
+// startOrder returns the given groupIds ordered so that every group follows the groups that it depends on, keeping
+// the given order otherwise.  The dependencies on groups that are not among the given ones are ignored.
+func (m *kafkaConsumerGroupManagerImpl) startOrder(groupIds []string) []string {
+	included := make(map[string]bool, len(groupIds))
+	for _, groupId := range groupIds {
+		included[groupId] = true
+	}
+	ordered := make([]string, 0, len(groupIds))
+	placed := make(map[string]bool, len(groupIds))
+	var place func(groupId string)
+	place = func(groupId string) {
+		if placed[groupId] {
+			return
+		}
+		placed[groupId] = true // AddStartDependency prevents cycles, so this only guards against repetition
+		for _, dependency := range m.startDependencies(groupId) {
+			if included[dependency] {
+				place(dependency)
+			}
+		}
+		ordered = append(ordered, groupId)
+	}
+	for _, groupId := range groupIds {
+		place(groupId)
+	}
+	return ordered
+}
+
+// awaitDependencies waits for the groups that the given group depends on, and that were started (or failed to
+// start) along with it, to join their groups.  It returns an error if one of them failed to start or to join.
+func (m *kafkaConsumerGroupManagerImpl) awaitDependencies(groupId string, started map[string]error, timeout time.Duration) error {
+	for _, dependency := range m.startDependencies(groupId) {
+		startErr, ok := started[dependency]
+		if !ok {
+			continue // Not started along with the group
+		}
+		if startErr != nil {
+			return fmt.Errorf("could not start consumer group with id '%s' - its dependency '%s' failed to start: %w", groupId, dependency, startErr)
+		}
+		managedGrp := m.getGroup(dependency)
+		if managedGrp == nil || managedGrp.createGroupFn() != nil {
+			continue // Closed meanwhile, or added via AddExistingGroup (whose sessions are not observable)
+		}
+		m.logger.Info("Waiting For Dependency Of Managed ConsumerGroup To Join", zap.String("GroupId", groupId), zap.String("Dependency", dependency))
+		if err := managedGrp.waitForJoin(timeout); err != nil {
+			return fmt.Errorf("could not start consumer group with id '%s' - its dependency '%s' is not ready: %w", groupId, dependency, err)
+		}
+	}
+	return nil
+}
+
+// startWithDependencies starts the given group as the startConsumerGroup function does, once its dependencies among
+// the started groups have joined, and records the outcome in the started map.  If a dependency is not ready, the
+// group is not started, and the internal lock is released if the given lock would have released it.
+func (m *kafkaConsumerGroupManagerImpl) startWithDependencies(lock *commands.CommandLock, groupId string, started map[string]error) error {
+	err := m.awaitDependencies(groupId, started, defaultDependencyTimeout)
+	if err == nil {
+		err = m.startConsumerGroup(lock, groupId)
+	} else {
+		m.logger.Warn("Not Starting Managed ConsumerGroup", zap.String("GroupId", groupId), zap.Error(err))
+		if lock.UnlockAfter && !lock.LockBefore {
+			// The group was locked when it was stopped, and would have been unlocked by the start
+			if unlockErr := m.unlockAfter(lock, groupId, m.getGroup(groupId)); unlockErr != nil {
+				m.logger.Warn("Failed To Unlock Managed ConsumerGroup", zap.String("GroupId", groupId), zap.Error(unlockErr))
+			}
+		}
+	}
+	started[groupId] = err
+	return err
+}
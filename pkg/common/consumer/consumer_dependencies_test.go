@@ -0,0 +1,131 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAddStartDependency(t *testing.T) {
+	manager := &kafkaConsumerGroupManagerImpl{logger: zap.NewNop()}
+	assert.Nil(t, manager.AddStartDependency("a", "b"))
+	assert.Nil(t, manager.AddStartDependency("b", "c"))
+	assert.Nil(t, manager.AddStartDependency("a", "c"))
+	assert.Nil(t, manager.AddStartDependency("a", "b")) // Repeated
+	assert.Equal(t, []string{"b", "c"}, manager.startDependencies("a"))
+
+	err := manager.AddStartDependency("c", "a")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "c -> a -> b -> c")
+	err = manager.AddStartDependency("a", "a")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "a -> a")
+	assert.True(t, errors.Is(manager.AddStartDependency("", "a"), ErrInvalidGroupId))
+	assert.Empty(t, manager.startDependencies("c"))
+}
+
+func TestStartOrder(t *testing.T) {
+	manager := &kafkaConsumerGroupManagerImpl{logger: zap.NewNop()}
+	assert.Nil(t, manager.AddStartDependency("a", "c"))
+	assert.Nil(t, manager.AddStartDependency("c", "d"))
+	assert.Nil(t, manager.AddStartDependency("b", "other")) // Not among the ordered groups
+	assert.Equal(t, []string{"d", "c", "a", "b", "e"}, manager.startOrder([]string{"a", "b", "c", "d", "e"}))
+	assert.Equal(t, []string{"c", "a", "b"}, manager.startOrder([]string{"a", "b", "c"}))
+	assert.Equal(t, []string{}, manager.startOrder([]string{}))
+}
+
+func TestAwaitDependencies(t *testing.T) {
+	errStart := errors.New("start error")
+	joined, notJoined := &mockManagedGroup{}, &mockManagedGroup{}
+	joined.On("createGroupFn").Return(nil)
+	joined.On("waitForJoin", shortTimeout).Return(nil)
+	notJoined.On("createGroupFn").Return(nil)
+	notJoined.On("waitForJoin", shortTimeout).Return(errors.New("timed out"))
+	manager := &kafkaConsumerGroupManagerImpl{logger: zap.NewNop(), groups: groupMap{"joined": joined, "not-joined": notJoined}}
+	for _, dependency := range []string{"joined", "not-joined", "failed", "not-started"} {
+		assert.Nil(t, manager.AddStartDependency("group-"+dependency, dependency))
+	}
+	started := map[string]error{"joined": nil, "not-joined": nil, "failed": errStart}
+
+	assert.Nil(t, manager.awaitDependencies("group-joined", started, shortTimeout))
+	assert.Nil(t, manager.awaitDependencies("group-not-started", started, shortTimeout))
+	err := manager.awaitDependencies("group-not-joined", started, shortTimeout)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "its dependency 'not-joined' is not ready")
+	assert.True(t, errors.Is(manager.awaitDependencies("group-failed", started, shortTimeout), errStart))
+}
+
+// joiningConsumerGroup is a closableConsumerGroup whose sessions are set up as soon as it consumes
+type joiningConsumerGroup struct {
+	closableConsumerGroup
+}
+
+func (g *joiningConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	_ = handler.Setup(&mockConsumerGroupSession{})
+	return g.closableConsumerGroup.Consume(ctx, topics, handler)
+}
+
+func TestReconfigureStartsDependenciesFirst(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	var lock sync.Mutex
+	var created []string
+	failing := map[string]bool{}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing[groupID] {
+			return nil, errors.New("create error")
+		}
+		created = append(created, groupID)
+		return &joiningConsumerGroup{closableConsumerGroup{closed: make(chan struct{})}}, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	for _, groupId := range []string{"a", "b", "c"} {
+		assert.Nil(t, manager.StartConsumerGroup(groupId, []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	}
+	assert.Nil(t, manager.AddStartDependency("a", "b"))
+
+	// The dependency is started before its dependent
+	lock.Lock()
+	created = nil
+	lock.Unlock()
+	assert.Nil(t, manager.Reconfigure([]string{}, sarama.NewConfig()))
+	assert.Equal(t, []string{"b", "a", "c"}, created)
+
+	// A dependent is not started if its dependency fails to start, and is left unlocked
+	lock.Lock()
+	created = nil
+	failing["b"] = true
+	lock.Unlock()
+	report, err := manager.ReconfigureWithReport([]string{}, sarama.NewConfig())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"c"}, created)
+	assert.Equal(t, ReconfigureRestartFailed, report.Groups[0].Outcome)
+	assert.Contains(t, report.Groups[0].Err.Error(), "its dependency 'b' failed to start")
+	assert.Equal(t, ReconfigureRestartFailed, report.Groups[1].Outcome)
+	assert.Equal(t, ReconfigureRestarted, report.Groups[2].Outcome)
+	assert.True(t, manager.IsStopped("a"))
+	assert.Equal(t, "", impl.getGroup("a").lockToken())
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// GroupStatus is the state of a managed group in a ManagerSnapshot
+type GroupStatus string
+
+const (
+	// GroupStatusRunning is a group that is consuming (or waiting to join, or for its topics)
+	GroupStatusRunning GroupStatus = "running"
+	// GroupStatusStopped is a group that was stopped, and has not been started again
+	GroupStatusStopped GroupStatus = "stopped"
+	// GroupStatusDead is a group whose consume loop gave up (see WithMaxRestartAttempts)
+	GroupStatusDead GroupStatus = "dead"
+)
+
+// ManagerSnapshot is the state of a manager and all of its groups, as returned by Describe.  It is serializable,
+// so it may be included in support bundles.
+type ManagerSnapshot struct {
+	Active          bool            `json:"active"`
+	Shutdown        bool            `json:"shutdown"`
+	ActiveConsumers int             `json:"activeConsumers"`
+	Groups          []GroupSnapshot `json:"groups"`
+}
+
+// GroupSnapshot is the state of a managed group in a ManagerSnapshot.  The activity counts (Restarts, Consumed and
+// DroppedErrors) and the LastError are those of the consume loop of the group since it was created by the manager,
+// so they are always empty for a group added via AddExistingGroup.
+type GroupSnapshot struct {
+	GroupId          string             `json:"groupId"`
+	Cluster          string             `json:"cluster,omitempty"`
+	Topics           []string           `json:"topics"`
+	Status           GroupStatus        `json:"status"`
+	LockedBy         string             `json:"lockedBy,omitempty"`         // The token of the control-protocol lock (if any)
+	Assignment       map[string][]int32 `json:"assignment,omitempty"`       // The partitions claimed by the current session
+	PausedPartitions map[string][]int32 `json:"pausedPartitions,omitempty"` // See PausePartitions
+	Restarts         int64              `json:"restarts"`                   // The sessions begun after a failed one
+	Consumed         int64              `json:"consumed"`                   // The messages received from the partitions
+	DroppedErrors    int64              `json:"droppedErrors"`              // See WithErrorChannel
+	LastError        string             `json:"lastError,omitempty"`        // The last error sent to the Errors() channel by the handler
+}
+
+// groupActivity counts the restarts and consumed messages of a ConsumerGroup, and keeps its last handler error,
+// for Describe.  A nil groupActivity records nothing.
+type groupActivity struct {
+	restarts  int64 // Accessed atomically
+	consumed  int64 // Accessed atomically
+	lock      sync.Mutex
+	lastError error
+}
+
+// restarted counts a session begun after a failed one
+func (a *groupActivity) restarted() {
+	if a != nil {
+		atomic.AddInt64(&a.restarts, 1)
+	}
+}
+
+// received counts a message received from a partition
+func (a *groupActivity) received() {
+	if a != nil {
+		atomic.AddInt64(&a.consumed, 1)
+	}
+}
+
+// failed records the last error of the group
+func (a *groupActivity) failed(err error) {
+	if a != nil {
+		a.lock.Lock()
+		a.lastError = err
+		a.lock.Unlock()
+	}
+}
+
+// describe adds the activity to the snapshot of the group
+func (a *groupActivity) describe(snapshot *GroupSnapshot) {
+	if a == nil {
+		return
+	}
+	snapshot.Restarts = atomic.LoadInt64(&a.restarts)
+	snapshot.Consumed = atomic.LoadInt64(&a.consumed)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.lastError != nil {
+		snapshot.LastError = a.lastError.Error()
+	}
+}
+
+// Describe returns the state of the manager and of every managed group (sorted by groupId) in a single snapshot,
+// for support tooling.  The snapshot contains exactly the groups that were managed at one point in time, and each
+// group is read while it can be neither stopped, started, closed, locked nor unlocked, so that its state is coherent
+// (waiting for such a transition that is under way to finish).  The activity counts of a group are those at the time
+// it is read.
+func (m *kafkaConsumerGroupManagerImpl) Describe() ManagerSnapshot {
+	snapshot := ManagerSnapshot{
+		Active:          m.IsActive(),
+		Shutdown:        m.isShutdown(),
+		ActiveConsumers: m.ActiveConsumers(),
+	}
+
+	// The groups are read after the groups map is unlocked, since a transition of a group may need the map
+	m.groupLock.RLock()
+	groups := make(map[string]managedGroup, len(m.groups))
+	for groupId, managedGrp := range m.groups {
+		groups[groupId] = managedGrp
+	}
+	m.groupLock.RUnlock()
+	snapshot.Groups = make([]GroupSnapshot, 0, len(groups))
+	for groupId, managedGrp := range groups {
+		snapshot.Groups = append(snapshot.Groups, describeGroup(groupId, managedGrp))
+	}
+	sort.Slice(snapshot.Groups, func(i, j int) bool { return snapshot.Groups[i].GroupId < snapshot.Groups[j].GroupId })
+	return snapshot
+}
+
+// describeGroup returns the snapshot of the managed group, taken while its state is locked
+func describeGroup(groupId string, managedGrp managedGroup) GroupSnapshot {
+	var snapshot GroupSnapshot
+	managedGrp.withStateLocked(func() {
+		snapshot = GroupSnapshot{
+			GroupId:  groupId,
+			Cluster:  clusterOf(managedGrp.handlerOptions()),
+			Topics:   managedGrp.topics(),
+			Status:   GroupStatusRunning,
+			LockedBy: managedGrp.lockToken(),
+		}
+		if managedGrp.isDead() {
+			snapshot.Status = GroupStatusDead
+		} else if managedGrp.isStopped() {
+			snapshot.Status = GroupStatusStopped
+		}
+		if pauser := managedGrp.state().pauser; pauser != nil {
+			snapshot.Assignment, snapshot.PausedPartitions = pauser.assignedAndPaused()
+		}
+		if overflow := managedGrp.state().overflow; overflow != nil {
+			snapshot.DroppedErrors = overflow.droppedCount()
+		}
+		managedGrp.state().activity.describe(&snapshot)
+	})
+	return snapshot
+}
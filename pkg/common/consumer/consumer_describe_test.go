@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestGroupActivity(t *testing.T) {
+	var nilActivity *groupActivity
+	nilActivity.restarted()
+	nilActivity.received()
+	nilActivity.failed(errors.New("ignored"))
+	snapshot := GroupSnapshot{}
+	nilActivity.describe(&snapshot)
+	assert.Equal(t, GroupSnapshot{}, snapshot)
+
+	activity := &groupActivity{}
+	activity.restarted()
+	activity.received()
+	activity.received()
+	activity.failed(errors.New("first"))
+	activity.failed(errors.New("second"))
+	activity.describe(&snapshot)
+	assert.Equal(t, GroupSnapshot{Restarts: 1, Consumed: 2, LastError: "second"}, snapshot)
+}
+
+func TestDescribe(t *testing.T) {
+	pauser := newPartitionPauser()
+	pauser.setAssigned(map[string][]int32{"topic": {2, 0, 1}})
+	assert.Nil(t, pauser.pause(map[string][]int32{"topic": {1}}))
+	overflow := &errorOverflow{}
+	overflow.recordDropped()
+	activity := &groupActivity{}
+	activity.received()
+	activity.failed(errors.New("handler error"))
+
+	running := &mockManagedGroup{}
+	running.On("handlerOptions").Return([]SaramaConsumerHandlerOption{WithCluster("other")})
+	running.On("topics").Return([]string{"topic"})
+	running.On("lockToken").Return("token")
+	running.On("isDead").Return(false)
+	running.On("isStopped").Return(false)
+	running.On("state").Return(&groupState{pauser: pauser, overflow: overflow, activity: activity})
+	running.On("withStateLocked").Return()
+
+	existing := &mockManagedGroup{}
+	existing.On("handlerOptions").Return(nil)
+	existing.On("topics").Return([]string{})
+	existing.On("lockToken").Return("")
+	existing.On("isDead").Return(false)
+	existing.On("isStopped").Return(true)
+	existing.On("state").Return(&groupState{})
+	existing.On("withStateLocked").Return()
+
+	manager := &kafkaConsumerGroupManagerImpl{
+		logger:          zap.NewNop(),
+		groups:          groupMap{"running": running, "existing": existing},
+		activeConsumers: new(int64),
+	}
+	snapshot := manager.Describe()
+	assert.Equal(t, ManagerSnapshot{
+		Active: true,
+		Groups: []GroupSnapshot{
+			{
+				GroupId: "existing",
+				Topics:  []string{},
+				Status:  GroupStatusStopped,
+			},
+			{
+				GroupId:          "running",
+				Cluster:          "other",
+				Topics:           []string{"topic"},
+				Status:           GroupStatusRunning,
+				LockedBy:         "token",
+				Assignment:       map[string][]int32{"topic": {0, 1, 2}},
+				PausedPartitions: map[string][]int32{"topic": {1}},
+				Consumed:         1,
+				DroppedErrors:    1,
+				LastError:        "handler error",
+			},
+		},
+	}, snapshot)
+
+	marshaled, err := json.Marshal(snapshot.Groups[0])
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"groupId":"existing","topics":[],"status":"stopped","restarts":0,"consumed":0,"droppedErrors":0}`, string(marshaled))
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// Deserializer decodes each message before it is passed to the handler (e.g. from JSON, Avro or Protobuf).  The
+// schemaregistry package provides one for the messages of the Confluent Schema Registry.
+type Deserializer interface {
+	Deserialize(message *sarama.ConsumerMessage) (interface{}, error)
+}
+
+// DeserializerFunc allows a function to be used as a Deserializer
+type DeserializerFunc func(message *sarama.ConsumerMessage) (interface{}, error)
+
+// Deserialize calls the function
+func (f DeserializerFunc) Deserialize(message *sarama.ConsumerMessage) (interface{}, error) {
+	return f(message)
+}
+
+// DeserializationErrorHandler is given each message that the Deserializer failed to decode, along with the error
+// of the Deserializer.  Returning nil skips the message, which is marked as if it had been handled; returning an
+// error fails the message, which is not marked, and the error is sent to the errors channel.  Either way the message
+// is not handled again: the claim (and the session) carry on with the next message, whose mark moves the committed
+// offset past the failed one, so a message that must not be lost has to be dealt with (e.g. sent to a dead letter
+// topic) by the DeserializationErrorHandler itself.
+type DeserializationErrorHandler func(message *sarama.ConsumerMessage, err error) error
+
+// DeserializationError is the error that a message which the Deserializer failed to decode is failed with, if
+// there is no DeserializationErrorHandler
+type DeserializationError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error // The error returned by the Deserializer
+}
+
+// Error returns the Deserializer error, prefixed with the topic, partition, and offset of the message
+func (e *DeserializationError) Error() string {
+	return fmt.Sprintf("could not deserialize message of topic %s, partition %d, offset %d: %v", e.Topic, e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the error returned by the Deserializer
+func (e *DeserializationError) Unwrap() error {
+	return e.Err
+}
+
+// deserializedValueKey is the key of the decoded message in the context passed to the KafkaConsumerHandler
+type deserializedValueKey struct{}
+
+// WithDeserializer decodes each message with the given Deserializer before it is passed to the handler (and to any
+// interceptors), which obtain the decoded value from the context (see DeserializedValue).  A message that cannot be
+// decoded is not passed to the handler: it is given to the DeserializationErrorHandler, if there is one (see
+// WithDeserializationErrorHandler), or failed with a DeserializationError otherwise, which (as with any handler
+// error) is sent to the errors channel, and the message is not marked.  The claim does not stop at such a message,
+// which is therefore skipped once a later message of the partition is marked.  Default is no deserialization.
+func WithDeserializer(deserializer Deserializer) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.deserializer = deserializer
+	}
+}
+
+// WithDeserializationErrorHandler handles the messages that the Deserializer of WithDeserializer fails to decode,
+// separately from the failures of the handler (such as by sending them to a dead letter topic for schema
+// mismatches), and decides whether each is skipped or failed.  Default is to fail the message with a
+// DeserializationError.
+func WithDeserializationErrorHandler(errorHandler DeserializationErrorHandler) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.deserializationErrorHandler = errorHandler
+	}
+}
+
+// DeserializedValue returns the value that the Deserializer of WithDeserializer decoded from the message being
+// handled, and false if there is no Deserializer
+func DeserializedValue(ctx context.Context) (interface{}, bool) {
+	value, ok := ctx.Value(deserializedValueKey{}).(deserializedValue)
+	return value.value, ok
+}
+
+// deserializedValue holds the decoded message in the context, so that a nil value can be told from none
+type deserializedValue struct {
+	value interface{}
+}
+
+// deserialize decodes the message with the Deserializer, if there is one, and returns the context with the decoded
+// value.  If the message cannot be decoded, handled is true and the remaining values are the outcome of the message.
+func (consumer *SaramaConsumerHandler) deserialize(ctx context.Context, message *sarama.ConsumerMessage) (decodedCtx context.Context, handled bool, mustMark bool, err error) {
+	if consumer.deserializer == nil {
+		return ctx, false, false, nil
+	}
+	value, err := consumer.deserializer.Deserialize(message)
+	if err == nil {
+		return context.WithValue(ctx, deserializedValueKey{}, deserializedValue{value: value}), false, false, nil
+	}
+
+	if consumer.deserializationErrorHandler == nil {
+		return ctx, true, false, &DeserializationError{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Err: err}
+	}
+	if handlerErr := consumer.deserializationErrorHandler(message, err); handlerErr != nil {
+		return ctx, true, false, handlerErr
+	}
+	consumer.logger.Debugw("Skipping a message that could not be deserialized", zap.String("topic", message.Topic),
+		zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Error(err))
+	return ctx, true, true, nil
+}
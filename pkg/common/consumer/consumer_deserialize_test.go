@@ -0,0 +1,121 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDeserializer(t *testing.T) {
+	errDecode, errHandler := errors.New("decode error"), errors.New("handler error")
+	decoded := DeserializerFunc(func(message *sarama.ConsumerMessage) (interface{}, error) {
+		return string(message.Value) + "-decoded", nil
+	})
+	failing := DeserializerFunc(func(message *sarama.ConsumerMessage) (interface{}, error) {
+		return nil, errDecode
+	})
+
+	for _, testCase := range []struct {
+		name          string
+		options       []SaramaConsumerHandlerOption
+		expectValue   interface{}
+		expectDecoded bool
+		expectHandled int32
+		expectMarked  bool
+		expectErr     error
+	}{
+		{
+			name:          "No Deserializer",
+			expectHandled: 1,
+			expectMarked:  true,
+		},
+		{
+			name:          "Decoded",
+			options:       []SaramaConsumerHandlerOption{WithDeserializer(decoded)},
+			expectValue:   string(mockMessage.Value) + "-decoded",
+			expectDecoded: true,
+			expectHandled: 1,
+			expectMarked:  true,
+		},
+		{
+			name:      "Failed Without Error Handler",
+			options:   []SaramaConsumerHandlerOption{WithDeserializer(failing)},
+			expectErr: errDecode,
+		},
+		{
+			name: "Skipped By Error Handler",
+			options: []SaramaConsumerHandlerOption{WithDeserializer(failing), WithDeserializationErrorHandler(
+				func(message *sarama.ConsumerMessage, err error) error { return nil })},
+			expectMarked: true,
+		},
+		{
+			name: "Failed By Error Handler",
+			options: []SaramaConsumerHandlerOption{WithDeserializer(failing), WithDeserializationErrorHandler(
+				func(message *sarama.ConsumerMessage, err error) error { return errHandler })},
+			expectErr: errHandler,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var value interface{}
+			var decodedOk bool
+			capture := func(next HandleFunc) HandleFunc {
+				return func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+					value, decodedOk = DeserializedValue(ctx)
+					return next(ctx, message)
+				}
+			}
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			errorCh := make(chan error, 1)
+			options := append([]SaramaConsumerHandlerOption{WithInterceptor(capture)}, testCase.options...)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, options...)
+
+			session := mockConsumerGroupSession{}
+			_ = cgh.ConsumeClaim(&session, mockConsumerGroupClaim{msg: &mockMessage})
+
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.Equal(t, testCase.expectMarked, session.marked)
+			assert.Equal(t, testCase.expectValue, value)
+			assert.Equal(t, testCase.expectDecoded, decodedOk)
+			if testCase.expectErr != nil {
+				var err error
+				select {
+				case err = <-errorCh:
+				default:
+				}
+				assert.True(t, errors.Is(err, testCase.expectErr))
+				var deserializationErr *DeserializationError
+				assert.Equal(t, testCase.expectErr == errDecode, errors.As(err, &deserializationErr))
+			} else {
+				assert.Empty(t, errorCh)
+			}
+			close(errorCh)
+		})
+	}
+}
+
+func TestDeserializationError(t *testing.T) {
+	err := &DeserializationError{Topic: "topic", Partition: 2, Offset: 42, Err: errors.New("bad schema")}
+	assert.Equal(t, "could not deserialize message of topic topic, partition 2, offset 42: bad schema", err.Error())
+	assert.Equal(t, "bad schema", errors.Unwrap(err).Error())
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// DrainCommitMode determines whether draining a managed group (see DrainConsumerGroup and Shutdown) confirms that
+// the offsets of the messages it processed were committed before returning
+type DrainCommitMode int
+
+const (
+	// BestEffortDrainCommit leaves the final commit of the marked offsets to sarama (or WithFinalCommit), without
+	// confirming that the broker stored them
+	BestEffortDrainCommit DrainCommitMode = iota
+	// ConfirmedDrainCommit makes the last session of the group commit its marked offsets synchronously once the
+	// in-flight messages have finished, and verify with an offset fetch request that the broker stored them.  The
+	// drain fails with a DrainCommitError if that is not confirmed before its deadline.
+	ConfirmedDrainCommit
+)
+
+// WithDrainCommitMode determines whether Shutdown confirms the final commit of each managed group (in the manner of
+// DrainConsumerGroup), reporting the groups whose commit was not confirmed as Unconfirmed.  It has no effect on a
+// factory that is used without a manager.  Default is BestEffortDrainCommit.
+func WithDrainCommitMode(mode DrainCommitMode) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.drainCommitMode = mode
+	}
+}
+
+// DrainCommitError is returned when a group drained with ConfirmedDrainCommit has closed, but the final commit of
+// its marked offsets could not be confirmed, so that some of its messages may be processed again after a restart
+type DrainCommitError struct {
+	GroupId string
+	Err     error
+}
+
+// Error returns the reason that the final commit was not confirmed
+func (e *DrainCommitError) Error() string {
+	return fmt.Sprintf("final offset commit of consumer group with id '%s' was not confirmed: %v", e.GroupId, e.Err)
+}
+
+// Unwrap returns the reason that the final commit was not confirmed
+func (e *DrainCommitError) Unwrap() error {
+	return e.Err
+}
+
+// drainCommitTracker records the offsets marked in the current session of a ConsumerGroup and, while a confirmed
+// drain is in progress, the outcome of the final commit of that session.
+type drainCommitTracker struct {
+	lock     sync.Mutex
+	marked   map[string]map[int32]int64 // The next offset to be consumed, by topic and partition
+	deadline time.Time                  // The deadline of the drain in progress (zero if there is none)
+	err      error                      // The outcome of the final commit of the drain in progress
+	reported bool                       // Whether a session ended and reported its final commit during the drain
+}
+
+// newDrainCommitTracker returns a drainCommitTracker with no drain in progress
+func newDrainCommitTracker() *drainCommitTracker {
+	return &drainCommitTracker{marked: make(map[string]map[int32]int64)}
+}
+
+// sessionStarted forgets the offsets marked in previous sessions, which were committed when they were released
+func (t *drainCommitTracker) sessionStarted() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.marked = make(map[string]map[int32]int64)
+}
+
+// mark records the offset of a message that was marked
+func (t *drainCommitTracker) mark(message *sarama.ConsumerMessage) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	partitions, ok := t.marked[message.Topic]
+	if !ok {
+		partitions = make(map[int32]int64)
+		t.marked[message.Topic] = partitions
+	}
+	partitions[message.Partition] = message.Offset + 1
+}
+
+// begin starts a confirmed drain, which must be finished by the given deadline
+func (t *drainCommitTracker) begin(deadline time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deadline = deadline
+	t.err = nil
+	t.reported = false
+}
+
+// draining returns the offsets marked in the current session and the deadline of the confirmed drain in progress,
+// or false if there is no such drain
+func (t *drainCommitTracker) draining() (map[string]map[int32]int64, time.Time, bool) {
+	if t == nil {
+		return nil, time.Time{}, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.deadline.IsZero() {
+		return nil, time.Time{}, false
+	}
+	marked := make(map[string]map[int32]int64, len(t.marked))
+	for topic, partitions := range t.marked {
+		marked[topic] = make(map[int32]int64, len(partitions))
+		for partition, offset := range partitions {
+			marked[topic][partition] = offset
+		}
+	}
+	return marked, t.deadline, true
+}
+
+// report records the outcome of the final commit of the drain in progress
+func (t *drainCommitTracker) report(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.err = err
+	t.reported = true
+}
+
+// result returns the outcome of the final commit of the drain, and whether it was verified at all.  If no session
+// ended during the drain (e.g. because the group was stopped) the error is nil but the commit was not verified.
+func (t *drainCommitTracker) result() (verified bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.reported && t.err == nil, t.err
+}
+
+// confirmDrainCommit commits the marked offsets of a session that ended during a confirmed drain, and verifies that
+// the broker stored them, returning an error if that is not confirmed before the deadline of the drain.  A commit
+// that misses the deadline carries on in the background, since sarama provides no means of canceling it.
+func (consumer *SaramaConsumerHandler) confirmDrainCommit(session sarama.ConsumerGroupSession, marked map[string]map[int32]int64, deadline time.Time) error {
+	if len(marked) == 0 {
+		return nil
+	}
+	groupId := ""
+	if handler, _ := consumer.getHandler(); handler != nil {
+		groupId = handler.GetConsumerGroup()
+	}
+	confirmed := make(chan error, 1) // Buffered so that a late confirmation does not block
+	go func() {
+		session.Commit()
+		confirmed <- consumer.verifyDrainCommit(groupId, marked)
+	}()
+	var err error
+	select {
+	case err = <-confirmed:
+	case <-time.After(time.Until(deadline)):
+		err = fmt.Errorf("final offset commit was not confirmed before the drain deadline")
+	}
+	if err != nil {
+		consumer.logger.Warnw("Failed to confirm the final offset commit of the drained group", zap.String("groupId", groupId), zap.Error(err))
+	} else {
+		consumer.logger.Debugw("Final offset commit of the drained group confirmed", zap.String("groupId", groupId), zap.Any("committed", marked))
+	}
+	return err
+}
+
+// verifyDrainCommit fetches the offsets that the broker has stored for the group with a ClusterAdmin of its own,
+// and returns an error if any of them is older than the one that was marked
+func (consumer *SaramaConsumerHandler) verifyDrainCommit(groupId string, marked map[string]map[int32]int64) error {
+	if consumer.createAdmin == nil {
+		return fmt.Errorf("commits cannot be verified for a ConsumerGroup that was not started by the factory")
+	}
+	admin, err := consumer.createAdmin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = admin.Close() }()
+	return consumer.checkCommitted(admin, groupId, marked)
+}
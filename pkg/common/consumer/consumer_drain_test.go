@@ -0,0 +1,251 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestConfirmDrainCommit(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		draining      bool
+		noMessage     bool
+		blockCommit   bool
+		response      *sarama.OffsetFetchResponse
+		expectFetches int
+		expectErr     error
+	}{
+		{
+			name:     "Not Draining",
+			response: offsetResponse(5, sarama.ErrNoError),
+		},
+		{
+			name:          "Confirmed",
+			draining:      true,
+			response:      offsetResponse(5, sarama.ErrNoError),
+			expectFetches: 1,
+		},
+		{
+			name:      "Nothing Marked",
+			draining:  true,
+			noMessage: true,
+			response:  offsetResponse(0, sarama.ErrNoError),
+		},
+		{
+			name:          "Not Stored",
+			draining:      true,
+			response:      offsetResponse(2, sarama.ErrNoError),
+			expectFetches: 1,
+			expectErr:     errCommitNotApplied,
+		},
+		{
+			name:        "Deadline Exceeded",
+			draining:    true,
+			blockCommit: true,
+			response:    offsetResponse(5, sarama.ErrNoError),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{testCase.response}}
+			tracker := newDrainCommitTracker()
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 1),
+				withGroupState(&groupState{drainCommits: tracker}), withClusterAdmin(func() (sarama.ClusterAdmin, error) { return admin, nil }))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			session := &blockingCommitSession{committingSession: committingSession{ctx: ctx}, release: make(chan struct{})}
+			if !testCase.blockCommit {
+				close(session.release)
+			}
+			_ = cgh.Setup(session)
+			if !testCase.noMessage {
+				_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 4}})
+			}
+			if testCase.draining {
+				tracker.begin(time.Now().Add(50 * time.Millisecond))
+			}
+			cancel()
+
+			assert.Nil(t, cgh.Cleanup(session))
+			verified, err := tracker.result()
+			assert.Equal(t, testCase.draining && err == nil, verified)
+			if testCase.blockCommit {
+				assert.NotNil(t, err)
+			} else if testCase.expectErr != nil {
+				assert.True(t, errors.Is(err, testCase.expectErr))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, testCase.expectFetches, admin.fetches)
+			if testCase.expectFetches > 0 {
+				assert.True(t, admin.closed)
+			}
+			if testCase.blockCommit {
+				close(session.release) // The commit that missed the deadline carries on in the background
+			}
+		})
+	}
+}
+
+// sessionConsumerGroup is a mockConsumerGroup whose Consume runs a session, marking the given message, which
+// lasts until the context is done
+type sessionConsumerGroup struct {
+	mockConsumerGroup
+	message *sarama.ConsumerMessage
+	marked  chan struct{}
+	commits int32
+}
+
+func (g *sessionConsumerGroup) Consume(ctx context.Context, _ []string, handler sarama.ConsumerGroupHandler) error {
+	session := &committingSession{ctx: ctx}
+	_ = handler.Setup(session)
+	_ = handler.ConsumeClaim(session, mockConsumerGroupClaim{msg: g.message})
+	close(g.marked)
+	<-ctx.Done()
+	err := handler.Cleanup(session)
+	atomic.StoreInt32(&g.commits, atomic.LoadInt32(&session.commits))
+	return err
+}
+
+func TestDrainConsumerGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	logger := zap.NewNop().Sugar()
+
+	for _, testCase := range []struct {
+		name          string
+		mode          DrainCommitMode
+		storedOffset  int64
+		expectCommits int32
+		expectFetches int
+		expectErr     bool
+	}{
+		{
+			name: "Best Effort",
+			mode: BestEffortDrainCommit,
+		},
+		{
+			name:          "Confirmed",
+			mode:          ConfirmedDrainCommit,
+			storedOffset:  5,
+			expectCommits: 1,
+			expectFetches: 1,
+		},
+		{
+			name:          "Not Confirmed",
+			mode:          ConfirmedDrainCommit,
+			storedOffset:  2,
+			expectCommits: 1,
+			expectFetches: 1,
+			expectErr:     true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			group := &sessionConsumerGroup{message: &sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 4}, marked: make(chan struct{})}
+			newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+				return group, nil
+			}
+			admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{offsetResponse(testCase.storedOffset, sarama.ErrNoError)}}
+			newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+			manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+
+			assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"test-topic"}, logger, mockMessageHandler{shouldMark: true}))
+			<-group.marked
+			err := manager.DrainConsumerGroup("group-id", shortTimeout, testCase.mode)
+			if testCase.expectErr {
+				var commitErr *DrainCommitError
+				assert.True(t, errors.As(err, &commitErr))
+				assert.Equal(t, "group-id", commitErr.GroupId)
+				assert.True(t, errors.Is(err, errCommitNotApplied))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.False(t, manager.IsManaged("group-id"))
+			assert.Equal(t, testCase.expectCommits, atomic.LoadInt32(&group.commits))
+			assert.Equal(t, testCase.expectFetches, admin.fetches)
+		})
+	}
+
+	// The final commit of a group that was not started by the manager cannot be confirmed, but it is still closed
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	assert.Nil(t, manager.AddExistingGroup("existing-group-id", &mockConsumerGroup{}, nil, nil, nil))
+	var commitErr *DrainCommitError
+	assert.True(t, errors.As(manager.DrainConsumerGroup("existing-group-id", shortTimeout, ConfirmedDrainCommit), &commitErr))
+	assert.False(t, manager.IsManaged("existing-group-id"))
+	assert.NotNil(t, manager.DrainConsumerGroup("unmanaged-group-id", shortTimeout, ConfirmedDrainCommit))
+}
+
+func TestShutdownConfirmedDrainCommit(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	group := &sessionConsumerGroup{message: &sarama.ConsumerMessage{Topic: "test-topic", Partition: 1, Offset: 4}, marked: make(chan struct{})}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return group, nil
+	}
+	admin := &sequenceClusterAdmin{responses: []*sarama.OffsetFetchResponse{offsetResponse(2, sarama.ErrNoError)}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{},
+		WithDrainCommitMode(ConfirmedDrainCommit))
+
+	assert.Nil(t, manager.StartConsumerGroup("group-unconfirmed", []string{"test-topic"}, zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}))
+	<-group.marked
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	result, err := manager.Shutdown(ctx)
+	assert.NotNil(t, err)
+	assert.Empty(t, result.Drained)
+	assert.Empty(t, result.ForceClosed)
+	assert.Equal(t, []string{"group-unconfirmed"}, result.Unconfirmed)
+}
+
+func TestShutdownUnverifiedDrainCommit(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig(),
+		WithDrainCommitMode(ConfirmedDrainCommit))
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	assert.Nil(t, manager.RegisterCluster("best-effort", []string{"b1"}, sarama.NewConfig()))
+	factory, err := impl.getClusterFactory("best-effort")
+	assert.Nil(t, err)
+	factory.drainCommitMode = BestEffortDrainCommit
+
+	// Neither stopped group has a session whose final commit could be verified, which only matters to the group
+	// whose cluster confirms the drain commits
+	logger := zap.NewNop().Sugar()
+	assert.Nil(t, manager.StartConsumerGroup("group-confirmed", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Nil(t, manager.StartConsumerGroup("group-best-effort", []string{"topic"}, logger, mockMessageHandler{}, WithCluster("best-effort")))
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-confirmed"))
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-best-effort"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := manager.Shutdown(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"group-best-effort"}, result.Drained)
+	assert.Empty(t, result.ForceClosed)
+	assert.Equal(t, []string{"group-confirmed"}, result.Unconfirmed)
+}
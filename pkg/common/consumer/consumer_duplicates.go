@@ -0,0 +1,102 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/zap"
+)
+
+// duplicateDeliveriesMetric is the name of the counter, in the MetricRegistry of the sarama config, that
+// counts the messages flagged as duplicates by WithDuplicateDetection
+const duplicateDeliveriesMetric = "consumer-duplicate-deliveries"
+
+// WithDuplicateDetection enables a diagnostic mode that remembers the highest offset processed for each partition
+// and logs a warning (and increments the "consumer-duplicate-deliveries" counter in the MetricRegistry of the sarama
+// config) whenever a message whose offset is at or below that one is delivered again, as happens when a rebalance
+// occurs before the offset of a processed message is committed.  This is purely observational; the message is
+// still passed to the handler.  The offsets are kept for as long as the ConsumerGroup is running, which costs
+// memory for each partition consumed.  Default is disabled.
+func WithDuplicateDetection() SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.detectDuplicates = true
+	}
+}
+
+// duplicateTracker remembers the highest processed offset of each topic and partition
+type duplicateTracker struct {
+	processed map[string]map[int32]int64
+	counter   gometrics.Counter
+	lock      sync.Mutex
+}
+
+// newDuplicateTracker returns a duplicateTracker that counts duplicates in the given registry (if non-nil)
+func newDuplicateTracker(registry gometrics.Registry) *duplicateTracker {
+	tracker := &duplicateTracker{processed: make(map[string]map[int32]int64)}
+	if registry != nil {
+		tracker.counter = gometrics.GetOrRegisterCounter(duplicateDeliveriesMetric, registry)
+	}
+	return tracker
+}
+
+// lastProcessed returns the highest offset processed for the partition of the message, and false if no
+// message of that partition has been processed yet
+func (d *duplicateTracker) lastProcessed(message *sarama.ConsumerMessage) (int64, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	offset, ok := d.processed[message.Topic][message.Partition]
+	return offset, ok
+}
+
+// recordProcessed updates the highest processed offset for the partition of the message
+func (d *duplicateTracker) recordProcessed(message *sarama.ConsumerMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.processed[message.Topic] == nil {
+		d.processed[message.Topic] = make(map[int32]int64)
+	}
+	if offset, ok := d.processed[message.Topic][message.Partition]; !ok || message.Offset > offset {
+		d.processed[message.Topic][message.Partition] = message.Offset
+	}
+}
+
+// checkDuplicate logs and counts the message if it has already been processed by this ConsumerGroup
+func (consumer *SaramaConsumerHandler) checkDuplicate(message *sarama.ConsumerMessage) {
+	if !consumer.detectDuplicates || consumer.duplicates == nil {
+		return
+	}
+	lastProcessed, ok := consumer.duplicates.lastProcessed(message)
+	if !ok || message.Offset > lastProcessed {
+		return
+	}
+	consumer.logger.Warnw("Likely duplicate delivery of a message that was already processed",
+		zap.String("topic", message.Topic), zap.Int32("partition", message.Partition),
+		zap.Int64("offset", message.Offset), zap.Int64("lastProcessed", lastProcessed))
+	if consumer.duplicates.counter != nil {
+		consumer.duplicates.counter.Inc(1)
+	}
+}
+
+// recordProcessed notes the message as processed, for the purpose of duplicate detection
+func (consumer *SaramaConsumerHandler) recordProcessed(message *sarama.ConsumerMessage) {
+	if consumer.detectDuplicates && consumer.duplicates != nil {
+		consumer.duplicates.recordProcessed(message)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDuplicateDetection(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		options         []SaramaConsumerHandlerOption
+		expectedCounter int64
+	}{
+		{
+			name: "Disabled",
+		},
+		{
+			name:            "Enabled",
+			options:         []SaramaConsumerHandlerOption{WithDuplicateDetection()},
+			expectedCounter: 2,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			registry := gometrics.NewRegistry()
+			tracker := newDuplicateTracker(registry)
+			errorCh := make(chan error, 1)
+			claimFor := func(offsets ...int64) multiMessageClaim {
+				claim := multiMessageClaim{}
+				for _, offset := range offsets {
+					claim.messages = append(claim.messages, &sarama.ConsumerMessage{Topic: "topic", Offset: offset})
+				}
+				return claim
+			}
+
+			// Simulate a rebalance that redelivers offsets 1 and 2 to a new session
+			options := append([]SaramaConsumerHandlerOption{withGroupState(&groupState{duplicates: tracker})}, testCase.options...)
+			for _, claim := range []multiMessageClaim{claimFor(0, 1, 2), claimFor(1, 2, 3)} {
+				cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, errorCh, options...)
+				_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, claim)
+			}
+
+			counter := gometrics.GetOrRegisterCounter(duplicateDeliveriesMetric, registry)
+			assert.Equal(t, testCase.expectedCounter, counter.Count())
+			close(errorCh)
+		})
+	}
+}
+
+func TestDuplicateTrackerWithoutRegistry(t *testing.T) {
+	tracker := newDuplicateTracker(nil)
+	message := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 5}
+	_, ok := tracker.lastProcessed(message)
+	assert.False(t, ok)
+
+	tracker.recordProcessed(message)
+	tracker.recordProcessed(&sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 3})
+	offset, ok := tracker.lastProcessed(message)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), offset)
+
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, WithDuplicateDetection(), withGroupState(&groupState{duplicates: tracker}))
+	cgh.checkDuplicate(message) // Must not panic without a counter
+}
@@ -18,15 +18,23 @@ package consumer
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 // newConsumerGroup is a wrapper for the Sarama NewConsumerGroup function, to facilitate unit testing
 var newConsumerGroup = sarama.NewConsumerGroup
 
+// newClusterAdmin is a wrapper for the Sarama NewClusterAdmin function, to facilitate unit testing
+var newClusterAdmin = sarama.NewClusterAdmin
+
 // consumeFunc is a function type that matches the Sarama ConsumerGroup's Consume function
 type consumeFunc func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error
 
@@ -35,9 +43,131 @@ type KafkaConsumerGroupFactory interface {
 	StartConsumerGroup(groupID string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) (sarama.ConsumerGroup, error)
 }
 
+// ErrorSources selects the errors that are sent to the Errors() channel of a ConsumerGroup started by the factory
+type ErrorSources int
+
+const (
+	// ErrorsFromAll sends both the handler errors and the sarama ConsumerGroup errors
+	ErrorsFromAll ErrorSources = iota
+	// ErrorsFromHandler sends only the errors returned by the handler (and by the consume loop, such as a failed
+	// session or ErrGroupDead)
+	ErrorsFromHandler
+	// ErrorsFromSarama sends only the errors of the sarama ConsumerGroup itself (e.g. failed fetches or commits)
+	ErrorsFromSarama
+)
+
+// WithErrorSources selects which errors the Errors() channel of the ConsumerGroup started by the factory carries.
+// Note that sarama only reports its own errors if Consumer.Return.Errors is enabled in the sarama config; otherwise
+// it merely logs them.  Excluded handler errors are discarded as they occur (they are still logged by the
+// handler), so the handler never blocks on them.  This option has no effect on the Errors() channel of a managed
+// group, which only carries the sarama errors.  Default is ErrorsFromAll.
+func WithErrorSources(sources ErrorSources) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.errorSources = sources
+	}
+}
+
+// ReturnErrorsPolicy determines what a KafkaConsumerGroupFactory (or KafkaConsumerGroupManager) does with a sarama
+// config that has Consumer.Return.Errors disabled, in which case sarama only logs the errors of a ConsumerGroup
+// (e.g. failed fetches or commits) and never sends them to its Errors() channel.
+type ReturnErrorsPolicy int
+
+const (
+	// WarnIfReturnErrorsDisabled logs a warning, leaving the sarama config as it is
+	WarnIfReturnErrorsDisabled ReturnErrorsPolicy = iota
+	// EnableReturnErrors enables Consumer.Return.Errors (in a copy of the sarama config) and logs a warning
+	EnableReturnErrors
+)
+
+// FactoryOption configures a KafkaConsumerGroupFactory, or the factories that a KafkaConsumerGroupManager uses
+type FactoryOption func(factory *kafkaConsumerGroupFactoryImpl)
+
+// WithReturnErrorsPolicy determines what the factory does if the sarama config has Consumer.Return.Errors disabled.
+// The warning is logged by the factory each time a ConsumerGroup is started, and by the manager whenever it is
+// given a new config.  Default is WarnIfReturnErrorsDisabled.
+func WithReturnErrorsPolicy(policy ReturnErrorsPolicy) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.returnErrorsPolicy = policy
+	}
+}
+
+// WithGroupIdTransformer makes the factory create each ConsumerGroup with the group.id that the transform function
+// returns for the requested GroupId (e.g. to add a tenant or environment prefix), so that the naming convention is
+// applied in one place rather than by every caller.  A manager given this option still identifies its groups by the
+// requested GroupId (in IsManaged, CloseConsumerGroup, the control-protocol commands, and so on), and BrokerGroupId
+// returns the transformed one.  The function must always return the same group.id for a given GroupId, since it is
+// applied again whenever a group is re-created.  Default is no transformation.
+func WithGroupIdTransformer(transform func(requested string) string) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.groupIdTransformer = transform
+	}
+}
+
 type kafkaConsumerGroupFactoryImpl struct {
 	config *sarama.Config
 	addrs  []string
+
+	groupIdTransformer func(requested string) string // Returns the group.id used with the broker (nil for the identity)
+
+	sharedClient *sharedClient // The client that the ConsumerGroups share (nil if each has its own)
+
+	drainCommitMode DrainCommitMode // Whether the Shutdown of a manager confirms the final commit of each group
+
+	supervision *supervision // How a manager re-creates the groups whose consume loop exited (nil if it does not)
+
+	metricsReporter ConsumerGroupMetricsReporter // Receives the activity of the ConsumerGroups (nil if there is none)
+
+	generationChurn *generationChurn // When the ConsumerGroups report their churn (nil for the default threshold)
+
+	versionCheck *versionCheck // Whether the Version of the config was checked against the brokers (nil for no check)
+
+	memoryBudget int64 // The bytes that a manager divides among its groups (non-positive for no budget)
+
+	preferredBrokers []string // The brokers that the ConsumerGroups are bootstrapped from (empty for all of the addrs)
+
+	returnErrorsPolicy  ReturnErrorsPolicy
+	returnErrorsEnabled bool // Whether the config was copied in order to enable Consumer.Return.Errors
+
+	activeConsumers *int64 // The number of running consume goroutines, shared by the factories of a manager (or nil)
+}
+
+// withActiveConsumerCounter is an internal option that makes the factory count its running consume goroutines in
+// the given counter, which outlives the factory (since the manager replaces its factories when reconfigured)
+func withActiveConsumerCounter(counter *int64) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.activeConsumers = counter
+	}
+}
+
+// countActiveConsumer adds the delta to the active consumer counter of the factory, if it has one
+func (c kafkaConsumerGroupFactoryImpl) countActiveConsumer(delta int64) {
+	if c.activeConsumers != nil {
+		atomic.AddInt64(c.activeConsumers, delta)
+	}
+}
+
+// newConsumerGroupFactory creates a factory with the given brokers and sarama config, as modified by the options
+func newConsumerGroupFactory(addrs []string, config *sarama.Config, options ...FactoryOption) *kafkaConsumerGroupFactoryImpl {
+	factory := &kafkaConsumerGroupFactoryImpl{addrs: addrs, config: config}
+	for _, option := range options {
+		option(factory)
+	}
+	if factory.returnErrorsPolicy == EnableReturnErrors && config != nil && !config.Consumer.Return.Errors {
+		enabled := *config
+		enabled.Consumer.Return.Errors = true
+		factory.config = &enabled
+		factory.returnErrorsEnabled = true
+	}
+	return factory
+}
+
+// warnReturnErrors logs a warning if the sarama config of the factory has (or had) Consumer.Return.Errors disabled
+func (c kafkaConsumerGroupFactoryImpl) warnReturnErrors(logger *zap.Logger) {
+	if c.returnErrorsEnabled {
+		logger.Warn("Consumer.Return.Errors Is Disabled In The Sarama Config - Enabling It So That ConsumerGroup Errors Are Reported")
+	} else if c.config != nil && !c.config.Consumer.Return.Errors {
+		logger.Warn("Consumer.Return.Errors Is Disabled In The Sarama Config - ConsumerGroup Errors Will Only Be Logged By Sarama And Never Reach The Errors Channel")
+	}
 }
 
 type customConsumerGroup struct {
@@ -45,11 +175,80 @@ type customConsumerGroup struct {
 	handlerErrorChannel chan error
 	sarama.ConsumerGroup
 	releasedCh chan bool
+	state      *groupState  // Shared by the sessions of the consume loop, and by the managed group (if any)
+	sources    ErrorSources // The errors that are sent to the Errors() channel
+	suppressed []error      // The sarama errors that are kept out of the Errors() channel
+	logger     *zap.SugaredLogger
 }
 
-// Errors merges handler errors chan and consumer group error chan
+// groupState holds what the factory creates for a ConsumerGroup along with its consume loop: the handler reference,
+// the producer, and the trackers that the handlers of the sessions record to and the manager reads from.  It
+// outlives the individual sessions (and therefore the handlers) of that group, so each handler is given the same
+// groupState (see withGroupState) rather than creating its own.  Fields are nil where the corresponding option
+// is not in effect.
+type groupState struct {
+	handlerRef   *handlerReference    // The handler used by the consume loop (may be swapped)
+	done         chan struct{}        // Closed when the consume goroutine has exited
+	dead         chan struct{}        // Closed if the consume loop gives up (see WithMaxRestartAttempts)
+	errors       <-chan error         // The handler errors, relayed by the managed group (nil if they are discarded)
+	producer     sarama.SyncProducer  // Closed along with the ConsumerGroup (nil if WithProducer was not given)
+	duplicates   *duplicateTracker    // The delivered offsets, for WithDuplicateDetection
+	pauser       *partitionPauser     // The paused partitions, for PausePartitions
+	joinLatency  *joinLatencyRecorder // The time taken by each session to join the group
+	drainCommits *drainCommitTracker  // The marked offsets of the sessions, for DrainConsumerGroup
+	overflow     *errorOverflow       // The handler errors dropped because the handlerErrorChannel was full
+	auditor      *partitionAuditor    // The partition mismatches, for WithPartitionAudit
+	metrics      *groupMetrics        // The activity reported to the ConsumerGroupMetricsReporter
+	activity     *groupActivity       // The restarts, messages and errors of the consume loop, for Describe
+	generations  *generationTracker   // The churn of the generations of the sessions
+	progress     *partitionProgress   // The progress of the claimed partitions, for stall detection
+	commitGap    *commitGapTracker    // The marked and committed offsets of the partitions, for CommitGap
+	replay       *replayTracker       // The partitions that have ended, for WithEndOffsets
+	oversized    gometrics.Counter    // The count of the oversized messages, for WithMaxMessageSize
+	rateLimiter  *rate.Limiter        // The limiter of WithRateLimit
+	adaptiveRate *adaptiveRateLimiter // The limiter of WithAdaptiveRateLimit
+}
+
+// withGroupState is an internal option that gives the handler the groupState of its ConsumerGroup
+func withGroupState(state *groupState) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.handlerRef = state.handlerRef
+		handler.producer = state.producer
+		handler.duplicates = state.duplicates
+		handler.pauser = state.pauser
+		handler.joinLatency = state.joinLatency
+		handler.drainCommits = state.drainCommits
+		handler.errorOverflow = state.overflow
+		handler.partitionAuditor = state.auditor
+		handler.groupMetrics = state.metrics
+		handler.activity = state.activity
+		handler.generations = state.generations
+		handler.progress = state.progress
+		handler.commitGap = state.commitGap
+		handler.replay = state.replay
+		handler.oversizedMessages = state.oversized
+		handler.rateLimiter = state.rateLimiter
+		handler.adaptiveRate = state.adaptiveRate
+	}
+}
+
+// Errors merges handler errors chan and consumer group error chan (or returns only one of them, as selected by
+// the WithErrorSources option)
 func (c *customConsumerGroup) Errors() <-chan error {
-	return mergeErrorChannels(c.ConsumerGroup.Errors(), c.handlerErrorChannel)
+	switch c.sources {
+	case ErrorsFromHandler:
+		return mergeErrorChannels(c.handlerErrorChannel)
+	case ErrorsFromSarama:
+		return mergeErrorChannels(c.saramaErrors())
+	default:
+		return mergeErrorChannels(c.saramaErrors(), c.handlerErrorChannel)
+	}
+}
+
+// saramaErrors returns the errors of the sarama ConsumerGroup, without those that are suppressed (see
+// WithSuppressedErrors)
+func (c *customConsumerGroup) saramaErrors() <-chan error {
+	return suppressErrors(c.ConsumerGroup.Errors(), c.suppressed, c.logger)
 }
 
 func (c *customConsumerGroup) Close() error {
@@ -58,69 +257,244 @@ func (c *customConsumerGroup) Close() error {
 	// Wait for graceful session claims release
 	<-c.releasedCh
 
-	return c.ConsumerGroup.Close()
+	err := c.ConsumerGroup.Close()
+	if c.state.producer != nil {
+		err = multierr.Append(err, c.state.producer.Close())
+	}
+	return err
 }
 
 var _ sarama.ConsumerGroup = (*customConsumerGroup)(nil)
 
 // StartConsumerGroup creates a new customConsumerGroup and starts a Consume goroutine on it
 func (c kafkaConsumerGroupFactoryImpl) StartConsumerGroup(groupID string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) (sarama.ConsumerGroup, error) {
-	consumerGroup, err := c.createConsumerGroup(groupID)
+	c.warnReturnErrors(logger.Desugar().With(zap.String("GroupId", groupID)))
+	if err := c.checkVersion(logger); err != nil {
+		return nil, err
+	}
+	if err := c.checkTopics(groupID, topics, logger, options...); err != nil {
+		return nil, err
+	}
+	if err := c.createDeadLetterTopics(groupID, topics, logger, options...); err != nil {
+		return nil, err
+	}
+	consumerGroup, err := c.createConsumerGroup(groupID, options...)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := c.createProducer(options...)
 	if err != nil {
+		_ = consumerGroup.Close()
 		return nil, err
 	}
 	// Start the consumerGroup.Consume function in a separate goroutine
-	return c.startExistingConsumerGroup(consumerGroup, consumerGroup.Consume, topics, logger, handler, options...), nil
+	return c.startExistingConsumerGroup(groupID, consumerGroup, consumerGroup.Consume, topics, logger, handler, producer, options...), nil
 }
 
 // createConsumerGroup creates a Sarama ConsumerGroup using the newConsumerGroup wrapper, with the
-// factory's internal brokers and sarama config.
-func (c kafkaConsumerGroupFactoryImpl) createConsumerGroup(groupID string) (sarama.ConsumerGroup, error) {
-	return newConsumerGroup(c.addrs, groupID, c.config)
+// factory's internal brokers and sarama config (as modified by any of the given options), or from the
+// shared client if the factory has one and the config is not modified.
+func (c kafkaConsumerGroupFactoryImpl) createConsumerGroup(groupID string, options ...SaramaConsumerHandlerOption) (sarama.ConsumerGroup, error) {
+	config, err := c.groupConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return c.createPreferredConsumerGroup(groupID, config)
+}
+
+// brokerGroupId returns the group.id that the factory uses with the broker for the requested GroupId
+func (c kafkaConsumerGroupFactoryImpl) brokerGroupId(groupID string) string {
+	if c.groupIdTransformer == nil {
+		return groupID
+	}
+	return c.groupIdTransformer(groupID)
+}
+
+// createProducer creates a sarama SyncProducer with the factory's internal brokers and sarama config (as modified
+// by any of the given options) if the WithProducer option is among them, and returns nil otherwise.
+func (c kafkaConsumerGroupFactoryImpl) createProducer(options ...SaramaConsumerHandlerOption) (sarama.SyncProducer, error) {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	if !scratch.producerRequested {
+		return nil, nil
+	}
+	groupConfig, err := c.groupConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	config := *groupConfig
+	config.Producer.Return.Successes = true // Required by the SyncProducer
+	return newSyncProducer(c.addrs, &config)
+}
+
+// createClusterAdmin creates a sarama ClusterAdmin with the factory's internal brokers and sarama config
+func (c kafkaConsumerGroupFactoryImpl) createClusterAdmin() (sarama.ClusterAdmin, error) {
+	return newClusterAdmin(c.addrs, c.config)
+}
+
+// groupConfig returns the factory's sarama config if none of the given options modify it, or a modified
+// copy of that config otherwise, so that the changes do not affect other ConsumerGroups.  The options that
+// only validate their settings are checked against the returned config.
+func (c kafkaConsumerGroupFactoryImpl) groupConfig(options []SaramaConsumerHandlerOption) (*sarama.Config, error) {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	config := c.config
+	if len(scratch.configModifiers) > 0 {
+		modified := *c.config
+		for _, modify := range scratch.configModifiers {
+			if err := modify(&modified); err != nil {
+				return nil, err
+			}
+		}
+		config = &modified
+	}
+	for _, validate := range scratch.configValidators {
+		if err := validate(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
 }
 
 // startExistingConsumerGroup creates a goroutine that begins a custom Consume loop on the provided ConsumerGroup
 // This loop is cancelable via the function provided in the returned customConsumerGroup.
 func (c kafkaConsumerGroupFactoryImpl) startExistingConsumerGroup(
+	groupID string,
 	saramaGroup sarama.ConsumerGroup,
 	consume consumeFunc,
 	topics []string,
 	logger *zap.SugaredLogger,
 	handler KafkaConsumerHandler,
+	producer sarama.SyncProducer,
 	options ...SaramaConsumerHandlerOption) *customConsumerGroup {
 
-	errorCh := make(chan error, 10)
-	releasedCh := make(chan bool)
+	errorCh := make(chan error, errorCapacityOf(options))
+	releasedCh := make(chan bool, 1) // Buffered so that the goroutine can exit even if Close() is never called
 	ctx, cancel := context.WithCancel(context.Background())
+	failedSessions := 0
 
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	state := &groupState{
+		handlerRef:   newHandlerReference(handler, options),
+		done:         make(chan struct{}),
+		dead:         make(chan struct{}),
+		producer:     producer,
+		duplicates:   newDuplicateTracker(c.config.MetricRegistry),
+		pauser:       newPartitionPauser(),
+		joinLatency:  newJoinLatencyRecorder(c.config.MetricRegistry, groupID, c.metricsReporter != nil),
+		drainCommits: newDrainCommitTracker(),
+		overflow:     newErrorOverflow(c.config.MetricRegistry, groupID, scratch.errorOverflowPolicy),
+		metrics:      newGroupMetrics(c.metricsReporter, groupID),
+		activity:     &groupActivity{},
+		generations:  newGenerationTracker(c.generationChurn),
+		commitGap:    newCommitGapTracker(),
+		replay:       newReplayTracker(scratch.endOffsets),
+		oversized:    newOversizedMessageCounter(c.config.MetricRegistry),
+		rateLimiter:  newRateLimiter(scratch.rateLimit, scratch.rateBurst),
+		adaptiveRate: newAdaptiveRateLimiter(scratch.adaptiveMaxRate, scratch.adaptiveOptions),
+	}
+	if scratch.partitionAudit != nil {
+		state.auditor = newPartitionAuditor(c.config.MetricRegistry, groupID, c.createClusterAdmin)
+	}
+	if scratch.stallThreshold > 0 {
+		state.progress = newPartitionProgress()
+	}
+	if scratch.errorSources == ErrorsFromSarama {
+		// Nobody reads the handler errors, so discard them rather than letting the handler block on a full channel
+		go func() {
+			for range errorCh {
+			}
+		}()
+	} else {
+		state.errors = errorCh
+	}
+
+	c.countActiveConsumer(1)
 	go func() {
 		defer func() {
+			c.countActiveConsumer(-1)
 			close(errorCh)
 			releasedCh <- true
+			close(state.done)
 		}()
 		for {
-			consumerHandler := NewConsumerHandler(logger, handler, errorCh, options...)
+			// Obtain the handler and options each time, as they may have been swapped since the last session
+			currentHandler, currentOptions, _ := state.handlerRef.get()
+
+			// Each session has its own context so that the handler can end it (causing a rejoin) without ending the loop
+			sessionCtx, cancelSession := context.WithCancel(ctx)
+			handlerOptions := append([]SaramaConsumerHandlerOption{withGroupState(state), withRejoin(cancelSession),
+				withCommitInterval(c.config.Consumer.Offsets.AutoCommit.Interval), withClusterAdmin(c.createClusterAdmin),
+				withBrokerGroupId(c.brokerGroupId(groupID))}, currentOptions...)
+			consumerHandler := NewConsumerHandler(logger, currentHandler, errorCh, handlerOptions...)
 
-			err := consume(ctx, topics, &consumerHandler)
+			state.joinLatency.consumeStarted()
+			err := consume(sessionCtx, topics, consumerHandler.wrapped())
+			cancelSession()
 			if err == sarama.ErrClosedConsumerGroup {
+				consumerHandler.reportJoin(err)
 				return
 			}
 			if err != nil {
-				errorCh <- err
+				consumerHandler.reportJoin(err)
+				if consumerHandler.isSuppressed(err) {
+					logger.Debugw("Suppressing the benign error of a failed session", zap.Error(err))
+				} else if class := consumerHandler.classifyError(err); class == ErrorClassIgnore {
+					logger.Debugw("Ignoring the error of a failed session", zap.Error(err))
+				} else if deadErr := consumerHandler.recordFailedSession(err, class, &failedSessions); deadErr != nil {
+					state.activity.failed(deadErr)
+					select {
+					case errorCh <- deadErr:
+					default: // Nobody is reading the errors, and the loop must not block on its way out
+					}
+					close(state.dead)
+					if consumerHandler.notifyEvent != nil {
+						consumerHandler.notifyEvent(GroupDead)
+					}
+					return
+				}
+				state.metrics.restarted()
+				state.activity.restarted()
+			} else {
+				failedSessions = 0
+			}
+			if state.replay.finished() {
+				logger.Info("All partitions reached their end offsets, ending the consume loop")
+				if consumerHandler.notifyEvent != nil {
+					consumerHandler.notifyEvent(GroupReplayFinished)
+				}
+				return
 			}
 
 			select {
 			case <-ctx.Done():
+				consumerHandler.reportJoin(fmt.Errorf("consume loop exited before joining the group"))
 				return
 			default:
 			}
 		}
 	}()
-	return &customConsumerGroup{cancel, errorCh, saramaGroup, releasedCh}
+	return &customConsumerGroup{
+		cancel:              cancel,
+		handlerErrorChannel: errorCh,
+		ConsumerGroup:       saramaGroup,
+		releasedCh:          releasedCh,
+		state:               state,
+		sources:             scratch.errorSources,
+		suppressed:          scratch.suppressed(),
+		logger:              logger,
+	}
 }
 
-func NewConsumerGroupFactory(addrs []string, config *sarama.Config) KafkaConsumerGroupFactory {
-	return kafkaConsumerGroupFactoryImpl{addrs: addrs, config: config}
+func NewConsumerGroupFactory(addrs []string, config *sarama.Config, options ...FactoryOption) KafkaConsumerGroupFactory {
+	return *newConsumerGroupFactory(addrs, config, options...)
 }
 
 var _ KafkaConsumerGroupFactory = (*kafkaConsumerGroupFactoryImpl)(nil)
@@ -21,9 +21,13 @@ import (
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 //------ Mocks
@@ -85,6 +89,15 @@ func mockedNewConsumerGroupFromClient(mockInputMessageCh chan *sarama.ConsumerMe
 	}
 }
 
+// unknownBalanceStrategy is a sarama.BalanceStrategy that is not one of the sarama strategies
+type unknownBalanceStrategy struct {
+	sarama.BalanceStrategy
+}
+
+func (unknownBalanceStrategy) Name() string {
+	return "unknown"
+}
+
 //------ Tests
 
 func TestErrorPropagationCustomConsumerGroup(t *testing.T) {
@@ -127,6 +140,131 @@ func TestErrorPropagationCustomConsumerGroup(t *testing.T) {
 	assertContainsError(t, errorsSlice, "consumer group error")
 }
 
+func TestErrorSources(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name         string
+		options      []SaramaConsumerHandlerOption
+		expectSarama bool
+		expectHandle bool
+	}{
+		{
+			name:         "Default",
+			expectSarama: true,
+			expectHandle: true,
+		},
+		{
+			name:         "All",
+			options:      []SaramaConsumerHandlerOption{WithErrorSources(ErrorsFromAll)},
+			expectSarama: true,
+			expectHandle: true,
+		},
+		{
+			name:         "Handler Only",
+			options:      []SaramaConsumerHandlerOption{WithErrorSources(ErrorsFromHandler)},
+			expectHandle: true,
+		},
+		{
+			name:         "Sarama Only",
+			options:      []SaramaConsumerHandlerOption{WithErrorSources(ErrorsFromSarama)},
+			expectSarama: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			newConsumerGroup = mockedNewConsumerGroupFromClient(nil, true, true, false, false)
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+			consumerGroup, err := factory.StartConsumerGroup("bla", []string{}, zap.NewNop().Sugar(), nil, testCase.options...)
+			assert.Nil(t, err)
+
+			errorsCh := consumerGroup.Errors()
+			received := make(map[string]bool)
+			timeout := time.After(100 * time.Millisecond)
+		collect:
+			for {
+				select {
+				case err, ok := <-errorsCh:
+					if !ok {
+						break collect
+					}
+					received[err.Error()] = true
+				case <-timeout:
+					break collect
+				}
+			}
+			consumerGroup.(*customConsumerGroup).cancel()
+			for err := range errorsCh {
+				received[err.Error()] = true
+			}
+			<-consumerGroup.(*customConsumerGroup).state.done
+
+			assert.Equal(t, testCase.expectSarama, received["consumer group error"])
+			assert.Equal(t, testCase.expectHandle, received["consumer group handler error"])
+		})
+	}
+}
+
+func TestReturnErrorsPolicy(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		returnErrors  bool
+		options       []FactoryOption
+		expectEnabled bool
+		expectWarning bool
+	}{
+		{
+			name:          "Enabled",
+			returnErrors:  true,
+			expectEnabled: true,
+		},
+		{
+			name:          "Disabled, Default Policy",
+			expectWarning: true,
+		},
+		{
+			name:          "Disabled, Warn",
+			options:       []FactoryOption{WithReturnErrorsPolicy(WarnIfReturnErrorsDisabled)},
+			expectWarning: true,
+		},
+		{
+			name:          "Disabled, Enable",
+			options:       []FactoryOption{WithReturnErrorsPolicy(EnableReturnErrors)},
+			expectEnabled: true,
+			expectWarning: true,
+		},
+		{
+			name:          "Enabled, Enable",
+			returnErrors:  true,
+			options:       []FactoryOption{WithReturnErrorsPolicy(EnableReturnErrors)},
+			expectEnabled: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := sarama.NewConfig()
+			config.Consumer.Return.Errors = testCase.returnErrors
+
+			// The factory warns when a group is started
+			core, logs := observer.New(zapcore.WarnLevel)
+			factory := NewConsumerGroupFactory([]string{"b1"}, config, testCase.options...).(kafkaConsumerGroupFactoryImpl)
+			assert.Equal(t, testCase.expectEnabled, factory.config.Consumer.Return.Errors)
+			assert.Equal(t, testCase.returnErrors, config.Consumer.Return.Errors) // The given config is never modified
+			factory.warnReturnErrors(zap.New(core))
+			assert.Equal(t, testCase.expectWarning, logs.Len() > 0)
+
+			// The manager warns when it is given the config, and applies the policy to the factories it creates
+			core, logs = observer.New(zapcore.WarnLevel)
+			manager := NewConsumerGroupManager(zap.New(core), getMockServerHandler(), []string{"b1"}, config, testCase.options...)
+			impl := manager.(*kafkaConsumerGroupManagerImpl)
+			assert.Equal(t, testCase.expectEnabled, impl.getFactory().config.Consumer.Return.Errors)
+			assert.Equal(t, testCase.expectWarning, logs.Len() > 0)
+			assert.Nil(t, manager.RegisterCluster("other", []string{"b2"}, config))
+			factoryOther, err := impl.getClusterFactory("other")
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.expectEnabled, factoryOther.config.Consumer.Return.Errors)
+		})
+	}
+}
+
 func assertContainsError(t *testing.T, collection []error, errorStr string) {
 	for _, el := range collection {
 		if el.Error() == errorStr {
@@ -165,8 +303,120 @@ func TestErrorWhileNewConsumerGroup(t *testing.T) {
 	err := <-consumerGroup.Errors()
 	// Wait for the goroutine inside of startExistingConsumerGroup to finish
 	<-consumerGroup.(*customConsumerGroup).releasedCh
+	<-consumerGroup.(*customConsumerGroup).state.done
 
 	if err == nil || err.Error() != "consume error" {
 		t.Errorf("Should contain an error with message consume error. Got %v", err)
 	}
 }
+
+func TestCreateConsumerGroupWithOptions(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	var groupConfig *sarama.Config
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		groupConfig = config
+		return &mockConsumerGroup{}, nil
+	}
+
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+
+	_, err := factory.createConsumerGroup("bla", WithTimeout(time.Second))
+	assert.Nil(t, err)
+	assert.Same(t, factory.config, groupConfig)
+
+	_, err = factory.createConsumerGroup("bla", WithClaimWorkers(2), WithCommitEveryN(10))
+	assert.Nil(t, err)
+	assert.Same(t, factory.config, groupConfig)
+
+	groupConfig = nil
+	_, err = factory.createConsumerGroup("bla", WithClaimWorkers(0))
+	assert.NotNil(t, err)
+	assert.Nil(t, groupConfig)
+
+	_, err = factory.createConsumerGroup("bla", WithOffsetOutOfRangePolicy(OffsetOutOfRangeResetOldest))
+	assert.Nil(t, err)
+	assert.NotSame(t, factory.config, groupConfig)
+	assert.Equal(t, sarama.OffsetOldest, groupConfig.Consumer.Offsets.Initial)
+	assert.Equal(t, sarama.OffsetNewest, factory.config.Consumer.Offsets.Initial)
+
+	_, err = factory.createConsumerGroup("bla", WithIsolationLevel(sarama.ReadCommitted))
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.ReadCommitted, groupConfig.Consumer.IsolationLevel)
+	assert.Equal(t, sarama.ReadUncommitted, factory.config.Consumer.IsolationLevel)
+
+	groupConfig = nil
+	_, err = factory.createConsumerGroup("bla", WithIsolationLevel(sarama.IsolationLevel(5)))
+	assert.NotNil(t, err)
+	assert.Nil(t, groupConfig)
+
+	_, err = factory.createConsumerGroup("bla", WithMaxPartitionFetchRecords(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, groupConfig.ChannelBufferSize)
+	assert.Equal(t, 256, factory.config.ChannelBufferSize)
+
+	groupConfig = nil
+	_, err = factory.createConsumerGroup("bla", WithMaxPartitionFetchRecords(0))
+	assert.NotNil(t, err)
+	assert.Nil(t, groupConfig)
+
+	_, err = factory.createConsumerGroup("bla", WithBalanceStrategy(sarama.BalanceStrategySticky))
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.BalanceStrategySticky, groupConfig.Consumer.Group.Rebalance.Strategy)
+	assert.Equal(t, sarama.BalanceStrategyRange, factory.config.Consumer.Group.Rebalance.Strategy)
+
+	for _, strategy := range []sarama.BalanceStrategy{nil, unknownBalanceStrategy{}} {
+		groupConfig = nil
+		_, err = factory.createConsumerGroup("bla", WithBalanceStrategy(strategy))
+		assert.NotNil(t, err)
+		assert.Nil(t, groupConfig)
+	}
+}
+
+func TestRejoinSession(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+
+	sessions := 0
+	consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+		sessions++
+		if sessions > 1 {
+			return sarama.ErrClosedConsumerGroup
+		}
+		// End the first session via the handler, as a reset policy would
+		handler.(*SaramaConsumerHandler).rejoin()
+		<-ctx.Done()
+		return nil
+	}
+
+	group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{}, zap.NewNop().Sugar(), mockMessageHandler{}, nil)
+	<-group.state.done
+	assert.Equal(t, 2, sessions)
+	group.cancel()
+}
+
+func TestMaxRestartAttempts(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+
+	// A session without an error resets the count, so only the last three failures are consecutive
+	results := []error{errors.New("consume error"), errors.New("consume error"), nil,
+		errors.New("consume error"), errors.New("consume error"), errors.New("consume error")}
+	sessions := 0
+	consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+		sessions++
+		if sessions > len(results) {
+			return sarama.ErrClosedConsumerGroup
+		}
+		return results[sessions-1]
+	}
+
+	group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{}, zap.NewNop().Sugar(),
+		mockMessageHandler{}, nil, WithMaxRestartAttempts(3))
+	var errs []error
+	for err := range group.handlerErrorChannel {
+		errs = append(errs, err)
+	}
+	<-group.state.done
+	assert.Equal(t, len(results), sessions)
+	assert.Len(t, errs, 6)
+	assert.True(t, errors.Is(errs[5], ErrGroupDead))
+	group.cancel()
+}
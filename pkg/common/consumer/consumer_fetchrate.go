@@ -0,0 +1,58 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// WithMaxFetchRate limits the number of fetch requests per second that the ConsumerGroup sends to each broker, so
+// that it does not poll a shared cluster more often than allowed.  Sarama has no limiter for its fetch requests, so
+// the limit is applied through the sarama config when the KafkaConsumerGroupFactory creates the group: the broker is
+// asked to hold each fetch for the interval between fetches (Consumer.MaxWaitTime is raised to 1/fetchesPerSecond,
+// rounded up to a millisecond) unless it has a full fetch of data to return (Consumer.Fetch.Min is raised to
+// Consumer.Fetch.Default).  The rate is therefore only exceeded for the partitions of a broker that receive more
+// than Consumer.Fetch.Default bytes per interval, where fetching sooner is what keeps the group from falling behind,
+// and a message may wait at the broker for up to the interval before it is fetched.  The interval must be shorter
+// than the Net.ReadTimeout of the config.  This limits the fetching rather than the handling of the messages (see
+// WithRateLimit for that).  The fetch requests are included in the "request-rate-for-broker-<id>" meters of the
+// MetricRegistry of the sarama config, if there is one.  Default is no limit (non-positive values mean the same).
+func WithMaxFetchRate(fetchesPerSecond float64) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		if fetchesPerSecond <= 0 {
+			return
+		}
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			interval := time.Duration(math.Ceil(float64(time.Second)/fetchesPerSecond/float64(time.Millisecond))) * time.Millisecond
+			if interval >= config.Net.ReadTimeout {
+				return fmt.Errorf("invalid max fetch rate: %g (the interval of %v between fetches must be shorter than the Net.ReadTimeout of %v)",
+					fetchesPerSecond, interval, config.Net.ReadTimeout)
+			}
+			if config.Consumer.MaxWaitTime < interval {
+				config.Consumer.MaxWaitTime = interval
+			}
+			if config.Consumer.Fetch.Min < config.Consumer.Fetch.Default {
+				config.Consumer.Fetch.Min = config.Consumer.Fetch.Default
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxFetchRate(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		rate            float64
+		maxWaitTime     time.Duration
+		expectErr       bool
+		expectMaxWait   time.Duration
+		expectFetchMin  int32
+		expectUnchanged bool
+	}{
+		{
+			name:            "No Limit",
+			rate:            0,
+			expectUnchanged: true,
+		},
+		{
+			name:           "Two Fetches Per Second",
+			rate:           2,
+			expectMaxWait:  500 * time.Millisecond,
+			expectFetchMin: 1024 * 1024,
+		},
+		{
+			name:           "Rounded Up To A Millisecond",
+			rate:           3,
+			expectMaxWait:  334 * time.Millisecond,
+			expectFetchMin: 1024 * 1024,
+		},
+		{
+			name:           "Longer Wait Is Kept",
+			rate:           10,
+			maxWaitTime:    time.Second,
+			expectMaxWait:  time.Second,
+			expectFetchMin: 1024 * 1024,
+		},
+		{
+			name:      "Interval Exceeds Read Timeout",
+			rate:      0.01,
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := sarama.NewConfig()
+			if testCase.maxWaitTime > 0 {
+				config.Consumer.MaxWaitTime = testCase.maxWaitTime
+			}
+			factory := kafkaConsumerGroupFactoryImpl{config: config}
+			groupConfig, err := factory.groupConfig([]SaramaConsumerHandlerOption{WithMaxFetchRate(testCase.rate)})
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if testCase.expectErr {
+				return
+			}
+			if testCase.expectUnchanged {
+				assert.Same(t, config, groupConfig)
+				return
+			}
+			assert.Equal(t, testCase.expectMaxWait, groupConfig.Consumer.MaxWaitTime)
+			assert.Equal(t, testCase.expectFetchMin, groupConfig.Consumer.Fetch.Min)
+			assert.Nil(t, groupConfig.Validate())
+
+			// The shared config is not changed
+			assert.Equal(t, int32(1), config.Consumer.Fetch.Min)
+		})
+	}
+}
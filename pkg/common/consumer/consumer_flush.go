@@ -0,0 +1,67 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultCloseFlushTimeout is the longest time that CloseConsumerGroup waits for the WithCloseFlush function
+const defaultCloseFlushTimeout = 30 * time.Second
+
+// CloseFlushFunc persists the work that a handler has buffered, before its ConsumerGroup is closed.  It should return
+// once the context is done.
+type CloseFlushFunc func(ctx context.Context) error
+
+// WithCloseFlush gives a handler that buffers its work (such as a window of messages) a last chance to persist it
+// when its managed group is closed intentionally, with CloseConsumerGroup (or any of the functions that close a group
+// in the same manner).  The flush is called once, before the sarama ConsumerGroup is closed (so the session is still
+// running, and the handler may still be receiving messages), with a context that is done after 30 seconds, or after
+// the timeout of CloseConsumerGroupAndWait or DrainConsumerGroup.  The group is closed regardless, and an error from
+// the flush is returned by the close function.  Unlike the Cleanup of the handler, which runs at the end of every
+// session (including those ended by a rebalance or a stop), the flush is not called when the group is stopped.
+// Default is no flush.
+func WithCloseFlush(flush CloseFlushFunc) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.closeFlush = flush
+	}
+}
+
+// closeFlushOf returns the WithCloseFlush function given by the options, if there is one
+func closeFlushOf(options []SaramaConsumerHandlerOption) CloseFlushFunc {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	return scratch.closeFlush
+}
+
+// flushGroup calls the WithCloseFlush function of the managed group, if it has one, waiting no longer than the timeout
+func flushGroup(managedGrp managedGroup, timeout time.Duration) error {
+	flush := closeFlushOf(managedGrp.handlerOptions())
+	if flush == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := flush(ctx); err != nil {
+		return fmt.Errorf("failed to flush the handler of the consumer group before closing it: %w", err)
+	}
+	return nil
+}
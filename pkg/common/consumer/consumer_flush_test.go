@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCloseFlush(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup) // must use if calling getManagerWithMockGroup in the test
+
+	for _, testCase := range []struct {
+		name     string
+		noFlush  bool
+		flushErr error
+		closeErr error
+		wait     bool
+	}{
+		{
+			name:    "No Flush",
+			noFlush: true,
+		},
+		{
+			name: "Flush Succeeds",
+		},
+		{
+			name:     "Flush Fails",
+			flushErr: errors.New("flush error"),
+		},
+		{
+			name:     "Flush And Close Fail",
+			flushErr: errors.New("flush error"),
+			closeErr: errors.New("close error"),
+		},
+		{
+			name:     "Flush Fails, Wait For Exit",
+			flushErr: errors.New("flush error"),
+			wait:     true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, group, managedGrp, server := getManagerWithMockGroup(t, "test-group-id", false)
+			closed := false
+			group.On("Close").Run(func(_ mock.Arguments) { closed = true }).Return(testCase.closeErr)
+			flushed := false
+			var deadline time.Time
+			if !testCase.noFlush {
+				flush := func(ctx context.Context) error {
+					assert.False(t, closed) // The flush must be called before the group is closed
+					flushed = true
+					deadline, _ = ctx.Deadline()
+					return testCase.flushErr
+				}
+				managedGrp.(*managedGroupImpl).handlerRef = newHandlerReference(nil, []SaramaConsumerHandlerOption{WithCloseFlush(flush)})
+			}
+			doneCh := make(chan struct{})
+			close(doneCh)
+			managedGrp.(*managedGroupImpl).consumeDone = doneCh
+
+			start := time.Now()
+			var err error
+			if testCase.wait {
+				err = manager.CloseConsumerGroupAndWait("test-group-id", time.Second)
+				assert.WithinDuration(t, start.Add(time.Second), deadline, 500*time.Millisecond)
+			} else {
+				err = manager.CloseConsumerGroup("test-group-id")
+				if !testCase.noFlush {
+					assert.WithinDuration(t, start.Add(defaultCloseFlushTimeout), deadline, time.Second)
+				}
+			}
+			assert.Equal(t, !testCase.noFlush, flushed)
+			assert.True(t, closed)
+			if testCase.flushErr != nil {
+				assert.ErrorIs(t, err, testCase.flushErr)
+			}
+			if testCase.closeErr != nil {
+				assert.ErrorIs(t, err, testCase.closeErr)
+				assert.True(t, manager.IsManaged("test-group-id"))
+			} else {
+				assert.Equal(t, testCase.flushErr == nil, err == nil)
+				assert.False(t, manager.IsManaged("test-group-id"))
+			}
+			server.AssertExpectations(t)
+		})
+	}
+}
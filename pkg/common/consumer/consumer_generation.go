@@ -0,0 +1,140 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The default generation churn threshold, which is conservative so that the rebalances of ordinary scaling and
+// rolling deployments are not reported
+const (
+	defaultGenerationChurnIncrements = 10
+	defaultGenerationChurnWindow     = 10 * time.Minute
+)
+
+// GenerationReporter may be implemented by a ConsumerGroupMetricsReporter (see WithMetricsReporter) to also receive
+// the generations of the groups, which the broker increments with every rebalance of a group.
+type GenerationReporter interface {
+	// GroupGeneration is called at the start of each session of a group, with the generation of the session
+	GroupGeneration(groupId string, generationId int32)
+	// GenerationChurn is called when the generation of a group has been incremented at least the threshold of
+	// WithGenerationChurnThreshold times within its window, which indicates a group that keeps rebalancing (such as
+	// one whose members exceed the max.poll.interval or session timeout).  It is called once when the threshold is
+	// reached, and not again until the increments within the window have dropped below it.
+	GenerationChurn(groupId string, increments int, window time.Duration)
+}
+
+// WithGenerationChurnThreshold sets how many times the generation of a ConsumerGroup may be incremented (i.e. the
+// group rebalanced) within the given window before the ConsumerGroup reports its churn:  a warning is logged, the
+// GenerationChurn function of the metrics reporter is called (if it implements GenerationReporter), and a managed
+// group sends a GroupGenerationChurn event.  The generation is that of the session of each Setup, so only the
+// rebalances that the ConsumerGroup takes part in are counted, once per session (a generation that was incremented
+// several times since the last session, such as while the group was stopped, counts as a single increment).  An
+// increments value below one disables the detection, and a window that is not positive means ten minutes.  Default
+// is ten increments within ten minutes.
+func WithGenerationChurnThreshold(increments int, window time.Duration) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		if window <= 0 {
+			window = defaultGenerationChurnWindow
+		}
+		factory.generationChurn = &generationChurn{increments: increments, window: window}
+	}
+}
+
+// generationChurn contains the settings of the WithGenerationChurnThreshold option
+type generationChurn struct {
+	increments int
+	window     time.Duration
+}
+
+// generationTracker tracks the generations of the sessions of a ConsumerGroup, across the sessions of its consume
+// loop, and detects when they are incremented too often.  A nil generationTracker tracks nothing.
+type generationTracker struct {
+	threshold int
+	window    time.Duration
+
+	lock       sync.Mutex
+	last       int32       // The generation of the last session
+	seen       bool        // Whether there has been a session yet
+	increments []time.Time // The times of the sessions within the window whose generation was incremented
+	churning   bool        // Whether the churn has been reported since the increments reached the threshold
+}
+
+// newGenerationTracker returns a generationTracker with the given settings (or the default ones if nil), or nil
+// if the detection is disabled
+func newGenerationTracker(churn *generationChurn) *generationTracker {
+	if churn == nil {
+		churn = &generationChurn{increments: defaultGenerationChurnIncrements, window: defaultGenerationChurnWindow}
+	}
+	if churn.increments < 1 {
+		return nil
+	}
+	return &generationTracker{threshold: churn.increments, window: churn.window}
+}
+
+// observe records the generation of a new session at the given time, and returns the number of increments within
+// the window if they have just reached the threshold (or zero otherwise)
+func (t *generationTracker) observe(generationId int32, now time.Time) int {
+	if t == nil {
+		return 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.seen && generationId > t.last {
+		// A generation that jumped ahead was also incremented by rebalances that this member missed (e.g. while it
+		// was stopped), whose times are unknown, so the session counts once like any other
+		t.increments = append(t.increments, now)
+	}
+	t.last, t.seen = generationId, true
+
+	expired := 0
+	for expired < len(t.increments) && now.Sub(t.increments[expired]) > t.window {
+		expired++
+	}
+	t.increments = t.increments[expired:]
+
+	if len(t.increments) < t.threshold {
+		t.churning = false
+		return 0
+	}
+	if t.churning {
+		return 0
+	}
+	t.churning = true
+	return len(t.increments)
+}
+
+// observeGeneration reports the generation of a new session, and its churn if the generation has just been
+// incremented too often
+func (consumer *SaramaConsumerHandler) observeGeneration(generationId int32) {
+	consumer.groupMetrics.generation(generationId)
+	increments := consumer.generations.observe(generationId, time.Now())
+	if increments == 0 {
+		return
+	}
+	consumer.logger.Warnw("ConsumerGroup generation is churning, the group keeps rebalancing",
+		zap.Int32("generation", generationId), zap.Int("increments", increments), zap.Duration("window", consumer.generations.window))
+	consumer.groupMetrics.generationChurn(increments, consumer.generations.window)
+	if consumer.notifyEvent != nil {
+		consumer.notifyEvent(GroupGenerationChurn)
+	}
+}
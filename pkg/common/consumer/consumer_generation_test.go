@@ -0,0 +1,111 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// generationRecordingReporter is a recordingReporter that is also a GenerationReporter
+type generationRecordingReporter struct {
+	recordingReporter
+}
+
+func (r *generationRecordingReporter) GroupGeneration(groupId string, generationId int32) {
+	r.record(fmt.Sprintf("generation %s %d", groupId, generationId))
+}
+func (r *generationRecordingReporter) GenerationChurn(groupId string, increments int, window time.Duration) {
+	r.record(fmt.Sprintf("churn %s %d %v", groupId, increments, window))
+}
+
+// generationSession is a mockConsumerGroupSession with a generation
+type generationSession struct {
+	mockConsumerGroupSession
+	generation int32
+}
+
+func (s *generationSession) GenerationID() int32 {
+	return s.generation
+}
+
+func TestWithGenerationChurnThreshold(t *testing.T) {
+	assert.Nil(t, newConsumerGroupFactory(nil, nil).generationChurn)
+	assert.Equal(t, &generationChurn{increments: 3, window: time.Minute},
+		newConsumerGroupFactory(nil, nil, WithGenerationChurnThreshold(3, time.Minute)).generationChurn)
+	assert.Equal(t, &generationChurn{increments: 3, window: defaultGenerationChurnWindow},
+		newConsumerGroupFactory(nil, nil, WithGenerationChurnThreshold(3, 0)).generationChurn)
+
+	assert.Equal(t, &generationTracker{threshold: defaultGenerationChurnIncrements, window: defaultGenerationChurnWindow},
+		newGenerationTracker(nil))
+	assert.Nil(t, newGenerationTracker(&generationChurn{increments: 0, window: time.Minute}))
+}
+
+func TestGenerationTracker(t *testing.T) {
+	// A nil tracker detects nothing
+	var tracker *generationTracker
+	assert.Equal(t, 0, tracker.observe(1, time.Now()))
+
+	tracker = newGenerationTracker(&generationChurn{increments: 3, window: time.Minute})
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	assert.Equal(t, 0, tracker.observe(5, at(0))) // The first session is not an increment
+	assert.Equal(t, 0, tracker.observe(6, at(1)))
+	assert.Equal(t, 0, tracker.observe(6, at(2))) // A session of the same generation is not an increment either
+	assert.Equal(t, 0, tracker.observe(7, at(3)))
+	assert.Equal(t, 3, tracker.observe(8, at(4)))   // The threshold is reached
+	assert.Equal(t, 0, tracker.observe(9, at(5)))   // and only reported once
+	assert.Equal(t, 0, tracker.observe(10, at(66))) // The earlier increments leave the window, re-arming the detection
+	assert.Equal(t, 0, tracker.observe(11, at(67)))
+	assert.Equal(t, 3, tracker.observe(12, at(68)))
+
+	// The increments that a member missed (e.g. while it was stopped) count as one
+	tracker = newGenerationTracker(&generationChurn{increments: 3, window: time.Minute})
+	assert.Equal(t, 0, tracker.observe(1, at(0)))
+	assert.Equal(t, 0, tracker.observe(100, at(1)))
+	assert.Len(t, tracker.increments, 1)
+}
+
+func TestGenerationChurn(t *testing.T) {
+	reporter := &generationRecordingReporter{}
+	tracker := newGenerationTracker(&generationChurn{increments: 2, window: time.Minute})
+	var events []EventIndex
+	for generation := int32(1); generation <= 4; generation++ {
+		cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+			withGroupState(&groupState{metrics: newGroupMetrics(reporter, "group-id"), generations: tracker}),
+			withEventNotifier(func(event EventIndex) {
+				if event == GroupGenerationChurn {
+					events = append(events, event)
+				}
+			}))
+		assert.Nil(t, cgh.Setup(&generationSession{generation: generation}))
+	}
+	assert.Equal(t, []string{"generation group-id 1", "generation group-id 2", "generation group-id 3",
+		"churn group-id 2 1m0s", "generation group-id 4"}, reporter.recorded())
+	assert.Equal(t, []EventIndex{GroupGenerationChurn}, events)
+
+	// A reporter that is not a GenerationReporter only receives the other activity
+	plainReporter := &recordingReporter{}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+		withGroupState(&groupState{metrics: newGroupMetrics(plainReporter, "group-id"), generations: tracker}))
+	assert.Nil(t, cgh.Setup(&generationSession{generation: 5}))
+	assert.Empty(t, plainReporter.recorded())
+}
@@ -18,23 +18,49 @@ package consumer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	kafkasarama "knative.dev/eventing-kafka/pkg/common/kafka/sarama"
 )
 
+// KafkaConsumerHandler is implemented by users of the SaramaConsumerHandler to process messages.
+//
+// Ordering contract: by default, messages from a single partition are passed to Handle one at a time, in offset
+// order, and the next message of that partition is not delivered until Handle returns for the previous one.  With
+// the WithMaxInFlightPerPartition option, Handle is still called in offset order but the calls for a partition may
+// overlap, and offsets are still marked in order.  With the WithClaimWorkers option, the messages of a partition
+// are handed to several workers, which handle them in any order, and offsets are still marked in order.  With the
+// WithTimestampOrdering option, the messages of the partitions claimed by a session are passed to Handle one at a
+// time, across partitions, in approximate timestamp order.  Otherwise, different partitions are consumed
+// concurrently, so Handle may be called from several goroutines at once, and there is no ordering between
+// messages of different partitions (even if they have the same key).  Messages are handled individually; there
+// is no batch delivery, so a handler that wants to parallelize work must not hand a message to another goroutine
+// and return early if it depends on the order of the messages with the same key.
 type KafkaConsumerHandler interface {
 	// When this function returns true, the consumer group offset is marked as consumed.
-	// The returned error is enqueued in errors channel.
+	// The returned error is enqueued in errors channel, unless it is (or wraps) ErrSkipMessage.
 	Handle(context context.Context, message *sarama.ConsumerMessage) (bool, error)
 	SetReady(partition int32, ready bool)
 	GetConsumerGroup() string
 }
 
+// ErrSkipMessage may be returned by the Handle function of a KafkaConsumerHandler to deliberately skip a message
+// that it chooses not to process (e.g. one that is filtered out or has expired).  The offset of the message is
+// marked regardless of the returned bool, and the error is neither logged as a failure nor enqueued in the errors
+// channel, so it does not trigger any error handling (such as a dead letter queue) of the user of the errors.
+var ErrSkipMessage = errors.New("message skipped by the handler")
+
 type SaramaConsumerLifecycleListener interface {
 	// Setup is invoked when the consumer is joining the session
 	Setup(sess sarama.ConsumerGroupSession)
@@ -55,6 +81,222 @@ func WithSaramaConsumerLifecycleListener(listener SaramaConsumerLifecycleListene
 	}
 }
 
+// HandleFunc is a function type that matches the KafkaConsumerHandler's Handle function
+type HandleFunc func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error)
+
+// Interceptor wraps a HandleFunc with cross-cutting behavior (tracing, metrics, logging, etc.), similar to
+// HTTP middleware.  An Interceptor may call next to continue the chain, modify the context first, or
+// short-circuit the chain by returning without calling next.
+type Interceptor func(next HandleFunc) HandleFunc
+
+// WithInterceptor adds an Interceptor around the handling of each message.  Interceptors are executed in the
+// order in which they are registered, so the first one registered is the outermost.  Default is no interceptors.
+func WithInterceptor(interceptor Interceptor) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.interceptors = append(handler.interceptors, interceptor)
+	}
+}
+
+// OffsetOutOfRangePolicy determines what the consumer does when sarama reports that the offset of a claimed
+// partition is out of range (for example, because retention has deleted the data past the committed offset)
+type OffsetOutOfRangePolicy int
+
+const (
+	// OffsetOutOfRangeDefault leaves the behavior to sarama, which resets the offset to Consumer.Offsets.Initial
+	// when a claim starts but stops consuming the partition if the error occurs during a session
+	OffsetOutOfRangeDefault OffsetOutOfRangePolicy = iota
+	// OffsetOutOfRangeResetOldest resets the offset to the oldest one available and resumes consuming
+	OffsetOutOfRangeResetOldest
+	// OffsetOutOfRangeResetNewest resets the offset to the newest one available and resumes consuming
+	OffsetOutOfRangeResetNewest
+	// OffsetOutOfRangeFail sends an error to the errors channel and leaves the partition unconsumed
+	OffsetOutOfRangeFail
+)
+
+// String returns a human-readable name of the policy, for logging
+func (p OffsetOutOfRangePolicy) String() string {
+	switch p {
+	case OffsetOutOfRangeDefault:
+		return "default"
+	case OffsetOutOfRangeResetOldest:
+		return "reset-oldest"
+	case OffsetOutOfRangeResetNewest:
+		return "reset-newest"
+	case OffsetOutOfRangeFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// WithOffsetOutOfRangePolicy configures how the consumer recovers when the offset of a partition is out of range.
+// The reset policies also set Consumer.Offsets.Initial for the ConsumerGroup, so they take effect when the
+// ConsumerGroup is created by the KafkaConsumerGroupFactory.  Default is OffsetOutOfRangeDefault.
+func WithOffsetOutOfRangePolicy(policy OffsetOutOfRangePolicy) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.offsetOutOfRangePolicy = policy
+		switch policy {
+		case OffsetOutOfRangeResetOldest:
+			handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+				config.Consumer.Offsets.Initial = sarama.OffsetOldest
+				return nil
+			})
+		case OffsetOutOfRangeResetNewest:
+			handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+				config.Consumer.Offsets.Initial = sarama.OffsetNewest
+				return nil
+			})
+		}
+	}
+}
+
+// WithMaxSessionDuration ends each session of a ConsumerGroup started by the KafkaConsumerGroupFactory after the
+// given duration, so that the consume loop rejoins the group and starts a fresh session.  Unlike closing the
+// group, this does not stop consumption for longer than a rebalance.  Default is zero (no forced rejoin).
+func WithMaxSessionDuration(duration time.Duration) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.maxSessionDuration = duration
+	}
+}
+
+// ErrGroupDead is wrapped by the error sent to the errors channel when the consume loop of a ConsumerGroup gives up
+// after the number of consecutive failed sessions allowed by WithMaxRestartAttempts, or after a session fails with
+// an error that is classified as fatal (see WithErrorClassifier)
+var ErrGroupDead = errors.New("consumer group is dead")
+
+// WithMaxRestartAttempts makes the consume loop of a ConsumerGroup started by the KafkaConsumerGroupFactory give up
+// after n consecutive sessions fail (that is, Consume returns an error), instead of retrying forever.  A session
+// that ends without an error resets the count, and one whose error is ignored (see WithErrorClassifier) is not
+// counted.  When the loop gives up, an error wrapping ErrGroupDead is sent to
+// the errors channel and, for a managed group, a GroupDead event is sent; the group remains managed, but it cannot
+// be started again, and must be closed and re-created.  Default is zero (unlimited attempts).
+func WithMaxRestartAttempts(n int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.maxRestartAttempts = n
+	}
+}
+
+// MessageError is the error sent to the errors channel, when WithMessageErrorContext is used, if the handler
+// fails to handle a message.  It identifies the message that the handler failed on.
+type MessageError struct {
+	GroupId   string
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error // The error returned by the handler
+}
+
+// Error returns the handler error, prefixed with the group, topic, partition, and offset of the message
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("group %s, topic %s, partition %d, offset %d: %v", e.GroupId, e.Topic, e.Partition, e.Offset, e.Err)
+}
+
+// Unwrap returns the error returned by the handler
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// WithMessageErrorContext wraps errors returned by the handler in a MessageError before sending them to the
+// errors channel.  Default is to send the handler errors unmodified.
+func WithMessageErrorContext() SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.messageErrorContext = true
+	}
+}
+
+// WithIsolationLevel sets the Consumer.IsolationLevel of the ConsumerGroup when it is created by the
+// KafkaConsumerGroupFactory, such as sarama.ReadCommitted for topics written with transactions, without
+// changing the shared config.  Default is the IsolationLevel of the factory's config.
+func WithIsolationLevel(level sarama.IsolationLevel) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			if level != sarama.ReadUncommitted && level != sarama.ReadCommitted {
+				return fmt.Errorf("invalid isolation level: %d", level)
+			}
+			config.Consumer.IsolationLevel = level
+			return nil
+		})
+	}
+}
+
+// WithBalanceStrategy sets the Consumer.Group.Rebalance.Strategy of the ConsumerGroup when it is created by the
+// KafkaConsumerGroupFactory, without changing the shared config.  The strategy must be one of the sarama range,
+// roundrobin or sticky strategies.  Note that sarama v1.29.1 advertises exactly one strategy when joining a group
+// (it has no list of strategies to negotiate), so all of the members of a group must use the same strategy, and
+// changing it requires every member to be restarted.  Default is the strategy of the factory's config.
+func WithBalanceStrategy(strategy sarama.BalanceStrategy) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			if strategy == nil {
+				return fmt.Errorf("invalid balance strategy: nil")
+			}
+			switch strategy.Name() {
+			case sarama.RangeBalanceStrategyName, sarama.RoundRobinBalanceStrategyName, sarama.StickyBalanceStrategyName:
+			default:
+				return fmt.Errorf("invalid balance strategy: %s", strategy.Name())
+			}
+			config.Consumer.Group.Rebalance.Strategy = strategy
+			return nil
+		})
+	}
+}
+
+// WithMaxPartitionFetchRecords limits the number of records that the ConsumerGroup buffers for each partition
+// ahead of the handler to n, by setting the ChannelBufferSize of the sarama config when the KafkaConsumerGroupFactory
+// creates the group.  Sarama sizes its fetch requests in bytes (Consumer.Fetch) rather than records, so a single
+// fetch may still return more than n records, but the partition consumer does not fetch again until the handler
+// has caught up, so each ConsumeClaim works through at most n buffered records at a time instead of large bursts.
+// This shapes throughput; to bound concurrency see WithMaxInFlightPerPartition.  The value of n must be positive.
+// Default is the ChannelBufferSize of the factory's config (256 in the sarama defaults).
+func WithMaxPartitionFetchRecords(n int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			if n <= 0 {
+				return fmt.Errorf("invalid max partition fetch records: %d (must be positive)", n)
+			}
+			config.ChannelBufferSize = n
+			return nil
+		})
+	}
+}
+
+// WithPanicRecovery controls whether a panic in the handler is recovered (and sent to the errors channel as a
+// MessageError, with the stack trace logged) or allowed to propagate.  Default is true (panics are recovered).
+func WithPanicRecovery(enabled bool) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.disablePanicRecovery = !enabled
+	}
+}
+
+// WithMaxInFlightPerPartition allows up to n messages of each partition to be in the handler at the same time,
+// for handlers that benefit from concurrency.  Once n messages are in flight, the consumer waits for the oldest
+// one to be handled before dispatching another, and offsets are always marked in order, so a message is never
+// marked before all of the earlier messages of its partition have been handled.  Default is 1 (sequential).
+func WithMaxInFlightPerPartition(n int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.maxInFlightPerPartition = n
+	}
+}
+
+// WithContextValues adds the given key/value pairs to the context passed to every Handle call, such as a tenant
+// ID or a configuration snapshot that the handler needs.  Since the values are part of the handler options, they
+// persist when a managed group is restarted.  A nil key, or one whose type is not comparable, is rejected when the
+// group is created (and left out of the context).  Default is to add no values.
+func WithContextValues(values map[interface{}]interface{}) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.contextValues = make(map[interface{}]interface{}, len(values))
+		for key, value := range values {
+			if key == nil || !reflect.TypeOf(key).Comparable() {
+				handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+					return fmt.Errorf("invalid context value key %v: must be non-nil and comparable", key)
+				})
+				continue
+			}
+			handler.contextValues[key] = value
+		}
+	}
+}
+
 // WithTimeout configures the request timeout. Default is set to 60s.
 func WithTimeout(timeout time.Duration) SaramaConsumerHandlerOption {
 	return func(handler *SaramaConsumerHandler) {
@@ -62,21 +304,344 @@ func WithTimeout(timeout time.Duration) SaramaConsumerHandlerOption {
 	}
 }
 
+// handlerReference provides synchronized access to a KafkaConsumerHandler (and the options used to
+// create the SaramaConsumerHandler around it) so that the handler may be swapped while a consume loop
+// is running.  The version is incremented on every change so that readers can detect a swap.
+type handlerReference struct {
+	lock    sync.RWMutex
+	handler KafkaConsumerHandler
+	options []SaramaConsumerHandlerOption
+	version int
+}
+
+// newHandlerReference returns a handlerReference initialized with the given handler and options
+func newHandlerReference(handler KafkaConsumerHandler, options []SaramaConsumerHandlerOption) *handlerReference {
+	return &handlerReference{handler: handler, options: options}
+}
+
+// get returns the current handler, options, and version, protected by the mutex
+func (r *handlerReference) get() (KafkaConsumerHandler, []SaramaConsumerHandlerOption, int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.handler, r.options, r.version
+}
+
+// set replaces the current handler and options, protected by the mutex
+func (r *handlerReference) set(handler KafkaConsumerHandler, options []SaramaConsumerHandlerOption) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handler = handler
+	r.options = options
+	r.version++
+}
+
+// withRejoin provides the function used to end the current session, so that the consume loop rejoins the group
+func withRejoin(rejoin func()) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.rejoin = rejoin
+	}
+}
+
+// withEventNotifier provides the function used to send events about the group to the manager
+func withEventNotifier(notify func(EventIndex)) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.notifyEvent = notify
+	}
+}
+
+// withConsumingNotifier provides the function called once every claim of a session has begun consuming
+func withConsumingNotifier(notify func()) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.notifyConsuming = notify
+	}
+}
+
+// sessionClaimed records the claims of a new session, which have yet to begin consuming
+func (consumer *SaramaConsumerHandler) sessionClaimed(claims map[string][]int32) {
+	count := 0
+	for _, partitions := range claims {
+		count += len(partitions)
+	}
+	atomic.StoreInt32(&consumer.pendingClaims, int32(count))
+	if count == 0 && consumer.notifyConsuming != nil {
+		consumer.notifyConsuming() // A member without partitions is consuming all it can
+	}
+}
+
+// claimStarted records that a claim of the session has begun consuming, and notifies the manager once all have
+func (consumer *SaramaConsumerHandler) claimStarted() {
+	if atomic.AddInt32(&consumer.pendingClaims, -1) == 0 && consumer.notifyConsuming != nil {
+		consumer.notifyConsuming()
+	}
+}
+
+// joinSignal reports the outcome of the first attempt of a consume loop to join its group, which is either
+// the first Setup call (success) or the first error returned from the consume function (failure)
+type joinSignal struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// newJoinSignal returns a joinSignal that has not yet reported an outcome
+func newJoinSignal() *joinSignal {
+	return &joinSignal{done: make(chan struct{})}
+}
+
+// report sets the outcome (a nil error meaning success) if one has not already been set
+func (s *joinSignal) report(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// wait blocks until an outcome has been reported, returning its error, or until the context is done
+func (s *joinSignal) wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withBrokerGroupId is an internal option that gives the handler the group.id of its ConsumerGroup on the broker,
+// which is used in place of the GroupId of the user handler when the committed offsets are fetched
+func withBrokerGroupId(groupId string) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.brokerGroupId = groupId
+	}
+}
+
+// withJoinSignal provides the joinSignal that the SaramaConsumerHandler and consume loop report to
+func withJoinSignal(signal *joinSignal) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.joinSignal = signal
+	}
+}
+
 // ConsumerHandler implements sarama.ConsumerGroupHandler and provides some glue code to simplify message handling
 // You must implement KafkaConsumerHandler and create a new SaramaConsumerHandler with it
 type SaramaConsumerHandler struct {
 	// The user message handler
 	handler KafkaConsumerHandler
 
+	// Optional reference that, if present, supersedes the handler field (used for swapping handlers)
+	handlerRef *handlerReference
+
 	// Request to sink timeout
 	timeout time.Duration
 
 	lifecycleListener SaramaConsumerLifecycleListener
 
+	// Interceptors wrapped around the user handler, outermost first
+	interceptors []Interceptor
+
+	// Wrappers around this handler when the factory passes it to Consume, outermost first
+	wrappers []HandlerWrapper
+
+	// Decodes each message before it is passed to the interceptors (nil for none), and handles the decoding failures
+	deserializer                Deserializer
+	deserializationErrorHandler DeserializationErrorHandler
+
+	// Checks that each message arrived on the partition its key routes to, using the auditor shared by the sessions
+	// of the ConsumerGroup (the audit is skipped if there is no auditor)
+	partitionAudit   *partitionAuditConfig
+	partitionAuditor *partitionAuditor
+
+	// Dispatches the messages to other handlers by the value of a header (nil if there is no routing)
+	headerRoutes *headerRoutes
+
+	// Modifications to the sarama config used when the factory creates the ConsumerGroup
+	configModifiers []func(*sarama.Config) error
+
+	// Checks of the options (against the sarama config, which they must not modify) when the factory creates the
+	// ConsumerGroup, which unlike the configModifiers do not require a config of its own
+	configValidators []func(*sarama.Config) error
+
+	// How to recover when the offset of a claimed partition is out of range
+	offsetOutOfRangePolicy OffsetOutOfRangePolicy
+
+	// Ends the current session so that the consume loop rejoins the group (nil if not started by the factory)
+	rejoin func()
+
+	// Sends events about the group to the manager (nil if the group is not managed)
+	notifyEvent func(EventIndex)
+
+	// Tells the manager that every claim of the session has begun consuming (nil if the group is not managed), and
+	// the number of claims of the session that have not begun yet (accessed atomically)
+	notifyConsuming func()
+	pendingClaims   int32
+
+	// If nonzero, the length of time after which a session is ended in order to rejoin the group
+	maxSessionDuration time.Duration
+	sessionTimer       *time.Timer
+
+	// If nonzero, the number of consecutive failed sessions after which the consume loop gives up
+	maxRestartAttempts int
+
+	// Decides whether the consume loop retries, gives up, or ignores the error of a failed session (nil for the default)
+	errorClassifier ErrorClassifier
+
+	// The benign errors that are kept out of the errors channel (nil for DefaultSuppressedErrors)
+	suppressedErrors *[]error
+
+	// If nonzero, the time after which the handling of a message is abandoned, and what to do with the message then
+	messageTimeout       time.Duration
+	messageTimeoutAction MessageTimeoutAction
+	deadLetterTopic      string
+
+	// The keys of the failure metadata headers added to the messages sent to the dead letter topic (nil for none)
+	deadLetterHeaderKeys *DeadLetterHeaderKeys
+	// The partitions and replication factor of the dead letter topics that the factory creates (nil for none)
+	deadLetterTopicDetail *sarama.TopicDetail
+
+	// If positive, the size of the largest message value passed to the handler, and the counter of the larger ones
+	// (nil if the sarama config has no MetricRegistry)
+	maxMessageSize    int
+	oversizedMessages gometrics.Counter
+
+	// The sources of the errors that the factory's ConsumerGroup sends to its Errors() channel
+	errorSources ErrorSources
+
+	// Whether to wrap handler errors in a MessageError
+	messageErrorContext bool
+
+	// Whether to let panics in the handler propagate instead of recovering from them
+	disablePanicRecovery bool
+
+	// The number of messages of a partition that may be handled concurrently (values below 1 mean 1)
+	maxInFlightPerPartition int
+
+	// The number of workers that handle the messages of a partition out of order (values below 2 mean none)
+	claimWorkers int
+
+	// If nonzero, the time that messages are buffered for in order to pass them to the handler in timestamp order
+	// (across partitions), and the largest number of messages buffered, using the reorderer of the session
+	reorderWindow      time.Duration
+	reorderMaxBuffered int
+	reorderer          *timestampReorderer
+
+	// Values added to the context passed to the handler
+	contextValues map[interface{}]interface{}
+
+	// The context that every handler context is derived from, holding the contextValues and the producer
+	baseContext context.Context
+
+	// Extracts the trace context of each message from its headers into the context passed to the handler (nil for none)
+	propagator Propagator
+
+	// Whether to check that the topics exist when the ConsumerGroup is started (and whether missing ones are an error)
+	topicCheck          bool
+	failOnMissingTopics bool
+
+	// The name of the cluster (registered with the manager) that a managed ConsumerGroup consumes from
+	cluster string
+
+	// The pattern that the topics of a managed ConsumerGroup match (empty for a fixed list), and how often it is resolved
+	topicPattern         string
+	topicPatternInterval time.Duration
+
+	// The group.id that the factory used with the broker, if it differs from that of the handler (see WithGroupIdTransformer)
+	brokerGroupId string
+
+	// The producer passed to the handler in the context, shared by the sessions of the ConsumerGroup
+	producerRequested bool
+	producer          sarama.SyncProducer
+
+	// Consulted before each message is passed to the handler, pausing the partition while it is not ready
+	readyGate             ReadyGate
+	readyGatePollInterval time.Duration
+
+	// The messages per second and burst of WithRateLimit, and the limiter of the ConsumerGroup that enforces them,
+	// which is consulted before each message is passed to the handler and shared by the partitions of the group
+	rateLimit   float64
+	rateBurst   int
+	rateLimiter *rate.Limiter
+
+	// The settings of WithAdaptiveRateLimit, and the limiter of the ConsumerGroup that is consulted instead of the
+	// rateLimiter, with a limit adjusted to the failures of the handler (nil for none)
+	adaptiveMaxRate float64
+	adaptiveOptions AdaptiveRateLimitOptions
+	adaptiveRate    *adaptiveRateLimiter
+
+	// The paused partitions of the ConsumerGroup, shared by its sessions (nil if pausing is not supported)
+	pauser *partitionPauser
+
+	// Whether to flag redelivered messages, using the tracker shared by the sessions of the ConsumerGroup
+	detectDuplicates bool
+	duplicates       *duplicateTracker
+
+	// Receives the outcome of the first attempt to join the group (nil if nobody is waiting for it)
+	joinSignal *joinSignal
+
+	// Records the time taken by each session to join the group (nil if the sarama config has no MetricRegistry)
+	joinLatency *joinLatencyRecorder
+
+	// Invoked after each offset commit cycle (the tracker is created for each session if this is not nil)
+	commitCallback CommitCallback
+	commitInterval time.Duration
+	commits        *commitTracker
+
+	// Whether (and how many times) to retry commits that were not stored, verified via a ClusterAdmin from createAdmin
+	commitRetry   bool
+	commitRetries int
+	commitBackoff time.Duration
+	createAdmin   func() (sarama.ClusterAdmin, error)
+
+	// Counts the marked messages of each partition, to commit after every n of them (nil for no count-based commits)
+	commitCounter *markCounter
+
+	// The longest time that Cleanup waits for the final commit of the marked offsets (zero means no final commit)
+	finalCommitTimeout time.Duration
+
+	// Where the offsets are loaded from and saved to instead of Kafka (nil to commit them to Kafka)
+	offsetStore OffsetStore
+
+	// Records the marked offsets of each session, and confirms their final commit while the group is being drained
+	drainCommits *drainCommitTracker
+
 	logger *zap.SugaredLogger
 
 	// Errors channel
 	errors chan error
+
+	// Reports the activity of the ConsumerGroup (nil if there is no ConsumerGroupMetricsReporter)
+	groupMetrics *groupMetrics
+
+	// Detects the churn of the generations of the sessions of the ConsumerGroup (nil if the detection is disabled)
+	generations *generationTracker
+
+	// The threshold of WithStalledPartitionDetection (zero for none), and the progress of the claimed partitions
+	// that the manager checks against it (nil without the detection)
+	stallThreshold time.Duration
+	progress       *partitionProgress
+
+	// The marked and committed offsets of the partitions of the ConsumerGroup (nil if the group was not started by
+	// the factory)
+	commitGap *commitGapTracker
+
+	// Records the activity of the ConsumerGroup for Describe (nil if the group was not started by the factory)
+	activity *groupActivity
+
+	// The offsets that the partitions begin and end at (nil for none), and the partitions that have been
+	// positioned or have ended
+	startOffsets map[string]map[int32]int64
+	endOffsets   map[string]map[int32]int64
+	replay       *replayTracker
+
+	// The capacity of the errors channel that the factory creates (nil for the default), what to do with an error
+	// when it is full, and the count of the errors that were dropped
+	errorCapacity       *int
+	errorOverflowPolicy ErrorOverflowPolicy
+	errorOverflow       *errorOverflow
+
+	// The function that the manager calls before closing the ConsumerGroup (nil for none)
+	closeFlush CloseFlushFunc
+
+	// The settings of the manager's checks for data before it starts the ConsumerGroup (nil to start it immediately)
+	deferredStart *deferredStart
 }
 
 type SaramaConsumerHandlerOption func(*SaramaConsumerHandler)
@@ -93,13 +658,108 @@ func NewConsumerHandler(logger *zap.SugaredLogger, handler KafkaConsumerHandler,
 	for _, f := range options {
 		f(&sch)
 	}
+	if sch.replay == nil && (len(sch.startOffsets) > 0 || len(sch.endOffsets) > 0) {
+		sch.replay = newReplayTracker(sch.endOffsets) // Not started by the factory, so this handler is used by every session
+	}
+	if sch.rateLimiter == nil {
+		sch.rateLimiter = newRateLimiter(sch.rateLimit, sch.rateBurst) // Likewise
+	}
+	if sch.adaptiveRate == nil {
+		sch.adaptiveRate = newAdaptiveRateLimiter(sch.adaptiveMaxRate, sch.adaptiveOptions)
+	}
+	sch.baseContext = sch.newBaseContext()
 
 	return sch
 }
 
+// getHandler returns the current user message handler and its version, which will be the one in the
+// handlerRef if it was provided, or the original handler otherwise (wrapped in the router of WithHeaderRouter, if any)
+func (consumer *SaramaConsumerHandler) getHandler() (KafkaConsumerHandler, int) {
+	handler, version := consumer.handler, 0
+	if consumer.handlerRef != nil {
+		handler, _, version = consumer.handlerRef.get()
+	}
+	if consumer.headerRoutes != nil && handler != nil {
+		return headerRouter{headerRoutes: consumer.headerRoutes, handler: handler}, version
+	}
+	return handler, version
+}
+
+// reportJoin reports the outcome of an attempt to join the group to the joinSignal, if there is one
+func (consumer *SaramaConsumerHandler) reportJoin(err error) {
+	if consumer.joinSignal != nil {
+		consumer.joinSignal.report(err)
+	}
+}
+
+// handleMessage passes the message to the handler (via any size limit, deserializer and interceptors).  Unless panic
+// recovery is disabled, a panic in the handler is recovered and returned as a MessageError, so the session continues.
+func (consumer *SaramaConsumerHandler) handleMessage(ctx context.Context, handler KafkaConsumerHandler, message *sarama.ConsumerMessage) (mustMark bool, err error) {
+	if !consumer.disablePanicRecovery {
+		defer func() {
+			if r := recover(); r != nil {
+				consumer.logger.Errorw("Recovered from a panic while handling a message", zap.String("topic", message.Topic),
+					zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Any("panic", r),
+					zap.ByteString("stack", debug.Stack()))
+				mustMark = false
+				err = &MessageError{GroupId: handler.GetConsumerGroup(), Topic: message.Topic, Partition: message.Partition,
+					Offset: message.Offset, Err: fmt.Errorf("panic in message handler: %v", r)}
+			}
+		}()
+	}
+	if handled, mustMark, err := consumer.skipOversized(message); handled {
+		return mustMark, err
+	}
+	ctx, handled, mustMark, err := consumer.deserialize(ctx, message)
+	if handled {
+		return mustMark, err
+	}
+	return consumer.intercept(handler)(ctx, message)
+}
+
+// intercept returns the Handle function of the given handler, wrapped in all of the interceptors (and in the
+// partition audit, outermost, if there is one)
+func (consumer *SaramaConsumerHandler) intercept(handler KafkaConsumerHandler) HandleFunc {
+	handle := HandleFunc(handler.Handle)
+	for i := len(consumer.interceptors) - 1; i >= 0; i-- {
+		handle = consumer.interceptors[i](handle)
+	}
+	if consumer.partitionAudit != nil && consumer.partitionAuditor != nil {
+		handle = consumer.auditPartition(handle)
+	}
+	return handle
+}
+
 // Setup is run at the beginning of a new session, before ConsumeClaim
 func (consumer *SaramaConsumerHandler) Setup(session sarama.ConsumerGroupSession) error {
 	consumer.logger.Info("setting up handler")
+	if err := consumer.loadStoredOffsets(session); err != nil {
+		consumer.logger.Errorw("Failed to load the offsets of the session from the offset store", zap.Error(err))
+		return err
+	}
+	consumer.applyStartOffsets(session)
+	if consumer.maxSessionDuration > 0 && consumer.rejoin != nil {
+		consumer.sessionTimer = time.AfterFunc(consumer.maxSessionDuration, func() {
+			consumer.logger.Infow("Maximum session duration reached, rejoining the group", zap.Duration("maxSessionDuration", consumer.maxSessionDuration))
+			consumer.rejoin()
+		})
+	}
+	consumer.startCommitTracker(session)
+	consumer.commitCounter.reset()
+	consumer.drainCommits.sessionStarted()
+	if consumer.reorderWindow > 0 {
+		consumer.reorderer = newTimestampReorderer(consumer, session)
+	}
+	if consumer.pauser != nil {
+		consumer.pauser.setAssigned(session.Claims())
+	}
+	consumer.reportJoin(nil)
+	consumer.joinLatency.joined()
+	consumer.observeGeneration(session.GenerationID())
+	if consumer.notifyEvent != nil {
+		consumer.notifyEvent(GroupJoined)
+	}
+	consumer.sessionClaimed(session.Claims())
 	consumer.lifecycleListener.Setup(session)
 	return nil
 }
@@ -107,11 +767,33 @@ func (consumer *SaramaConsumerHandler) Setup(session sarama.ConsumerGroupSession
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *SaramaConsumerHandler) Cleanup(session sarama.ConsumerGroupSession) error {
 	consumer.logger.Infow("Cleanup handler")
+	if consumer.sessionTimer != nil {
+		consumer.sessionTimer.Stop()
+	}
+	if consumer.reorderer != nil {
+		consumer.reorderer.stop() // Before the final commit, so that it includes the last released messages
+		consumer.reorderer = nil
+	}
+	if consumer.commits != nil {
+		consumer.stopCommitTracker(session)
+	}
+	if marked, deadline, ok := consumer.drainCommits.draining(); ok {
+		if consumer.offsetStore != nil {
+			consumer.drainCommits.report(consumer.lastSaveErr()) // Nothing is committed to Kafka
+		} else {
+			consumer.drainCommits.report(consumer.confirmDrainCommit(session, marked, deadline))
+		}
+	}
+	consumer.releaseCommitGaps(session)
+	if consumer.pauser != nil {
+		consumer.pauser.setAssigned(nil)
+	}
+	handler, _ := consumer.getHandler()
 	for t, ps := range session.Claims() {
 		for _, p := range ps {
 			consumer.logger.Debugw("Cleanup handler: Setting partition readiness to false", zap.String("topic", t),
 				zap.Int32("partition", p))
-			consumer.handler.SetReady(p, false)
+			handler.SetReady(p, false)
 		}
 	}
 	consumer.lifecycleListener.Cleanup(session)
@@ -120,15 +802,30 @@ func (consumer *SaramaConsumerHandler) Cleanup(session sarama.ConsumerGroupSessi
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (consumer *SaramaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	consumer.logger.Infow(fmt.Sprintf("Starting partition consumer, topic: %s, partition: %d, initialOffset: %d", claim.Topic(), claim.Partition(), claim.InitialOffset()), zap.String("ConsumeGroup", consumer.handler.GetConsumerGroup()))
-	consumer.handler.SetReady(claim.Partition(), true)
-	c := make(chan bool)
+	handler, handlerVersion := consumer.getHandler()
+	consumer.logger.Infow(fmt.Sprintf("Starting partition consumer, topic: %s, partition: %d, initialOffset: %d", claim.Topic(), claim.Partition(), claim.InitialOffset()), zap.String("ConsumeGroup", handler.GetConsumerGroup()))
+	handler.SetReady(claim.Partition(), true)
+	consumer.claimStarted()
+	var inFlight []*inFlightMessage
+	drain := consumer.newDrainDeadline()
+	if consumer.claimEnded(claim) {
+		consumer.logger.Infof("Partition %s/%d already reached its end offset", claim.Topic(), claim.Partition())
+		consumer.waitAfterEnd(session)
+		return nil
+	}
+	consumer.progress.claimed(claim)
+	consumer.commitGap.claimed(claim.Topic(), claim.Partition(), claim.InitialOffset())
+	defer consumer.progress.released(claim.Topic(), claim.Partition())
+	endOffset, bounded := consumer.endOffset(claim.Topic(), claim.Partition())
+	ended := false
+	dispatcher := consumer.newClaimDispatcher(session)
 
 	// NOTE:
 	// Do not move the code below to a goroutine.
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
 	for message := range claim.Messages() {
+		consumer.progress.received(message)
 
 		// Debug Log Kafka ConsumerMessage
 		if consumer.logger.Desugar().Core().Enabled(zap.DebugLevel) {
@@ -150,51 +847,239 @@ func (consumer *SaramaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroup
 			break
 		}
 
-		// We need to control when to cancel Handle calls so give it a downstream context
-		hctx, cancel := context.WithCancel(context.Background())
+		// Stop delivering the messages of the partition at its end offset (see WithEndOffsets)
+		if bounded && message.Offset >= endOffset {
+			consumer.reachEnd(claim)
+			ended = true
+			break
+		}
 
-		// Start Handle goroutine
-		go func() {
-			mustMark, err := consumer.handler.Handle(hctx, message)
+		// If the handler was swapped since the last message, the new one needs to know that this partition is ready
+		if current, currentVersion := consumer.getHandler(); currentVersion != handlerVersion {
+			consumer.logger.Infow("Consumer handler was swapped", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+			handler, handlerVersion = current, currentVersion
+			handler.SetReady(claim.Partition(), true)
+		}
 
-			if err != nil {
-				consumer.logger.Infow("Failure while handling a message", zap.String("topic", message.Topic), zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Error(err))
-				consumer.errors <- err
-				consumer.handler.SetReady(claim.Partition(), false)
-			}
+		// Hold the message while the partition is paused, or until the downstream is ready for it
+		if !consumer.waitForResume(session, claim) || !consumer.waitForReadyGate(session, claim) {
+			consumer.logger.Infof("Session closed for %s/%d while paused. Exiting ConsumeClaim ", claim.Topic(), claim.Partition())
+			break
+		}
 
-			c <- mustMark
-		}()
+		// Throttle the handling of messages to the rate limit of the group
+		if !consumer.waitForRateLimit(session) {
+			consumer.logger.Infof("Session closed for %s/%d while rate limited. Exiting ConsumeClaim ", claim.Topic(), claim.Partition())
+			break
+		}
 
-		var mustMark bool
-		select {
-		case mustMark = <-c:
-			// Handle returned gracefully, call cancel to free the context resources.
-			cancel()
-		case <-session.Context().Done():
-			// Consumer session canceled, wait for in-flight request to finish before we hit a rebalance timeout
-			select {
-			case <-time.After(consumer.timeout):
-				// Handle still didn't return, cancel the in-flight request
-				cancel()
-				// Unblock the Handle goroutine
-				mustMark = <-c
-			case mustMark = <-c:
-				// Handle returned gracefully, call cancel to free the context resources.
-				cancel()
+		consumer.groupMetrics.consumed(claim, message)
+		consumer.activity.received()
+		consumer.checkDuplicate(message)
+
+		// Leave the message to the reorderer, which passes it to the handler in timestamp order
+		if consumer.reorderer != nil {
+			if !consumer.reorderer.add(handler, claim, message) {
+				consumer.logger.Infof("Session closed for %s/%d while reordering. Exiting ConsumeClaim ", claim.Topic(), claim.Partition())
+				break
+			}
+		} else if dispatcher != nil {
+			if !dispatcher.dispatch(handler, claim, message) {
+				consumer.logger.Infof("Session closed for %s/%d while waiting for a worker. Exiting ConsumeClaim ", claim.Topic(), claim.Partition())
+				break
+			}
+		} else {
+			// Wait for the oldest message to be handled if the maximum number of messages are already in flight
+			inFlight = append(inFlight, consumer.startHandling(handler, claim, message, nil))
+			if len(inFlight) >= consumer.maxInFlight() {
+				consumer.finishHandling(session, inFlight[0], drain)
+				inFlight = inFlight[1:]
 			}
 		}
 
-		if mustMark {
-			session.MarkMessage(message, "") // Mark kafka message as processed
-			if consumer.logger.Desugar().Core().Enabled(zap.DebugLevel) {
-				consumer.logger.Debugw("Message marked", zap.String("topic", message.Topic), zap.Binary("value", message.Value))
-			}
+		// The message just before the end offset is the last one of the partition
+		if bounded && message.Offset >= endOffset-1 {
+			consumer.reachEnd(claim)
+			ended = true
+			break
 		}
 	}
 
+	// Wait for the remaining in-flight messages, in order, so that their offsets are marked in order
+	for _, pending := range inFlight {
+		consumer.finishHandling(session, pending, drain)
+	}
+	if dispatcher != nil {
+		dispatcher.finish()
+	}
+	if ended {
+		consumer.waitAfterEnd(session)
+		consumer.logger.Infof("Stopping partition consumer, topic: %s, partition: %d", claim.Topic(), claim.Partition())
+		return nil
+	}
+
+	// Sarama only closes the messages channel of a claim before the session ends if the partition consumer shut
+	// down because its offset was out of range
+	if session.Context().Err() == nil {
+		if consumer.reorderer != nil {
+			consumer.reorderer.drop(claim.Topic(), claim.Partition())
+		}
+		consumer.handleOffsetOutOfRange(handler, claim)
+	}
+
 	consumer.logger.Infof("Stopping partition consumer, topic: %s, partition: %d", claim.Topic(), claim.Partition())
 	return nil
 }
 
+// handleOffsetOutOfRange applies the OffsetOutOfRangePolicy to a claim that stopped because its offset was out of range
+func (consumer *SaramaConsumerHandler) handleOffsetOutOfRange(handler KafkaConsumerHandler, claim sarama.ConsumerGroupClaim) {
+	logger := consumer.logger.With(zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()),
+		zap.Stringer("policy", consumer.offsetOutOfRangePolicy))
+	switch consumer.offsetOutOfRangePolicy {
+	case OffsetOutOfRangeResetOldest, OffsetOutOfRangeResetNewest:
+		logger.Warn("Partition offset out of range, rejoining the group to reset it")
+		if consumer.notifyEvent != nil {
+			consumer.notifyEvent(GroupOffsetReset)
+		}
+		if consumer.rejoin != nil {
+			consumer.rejoin()
+		}
+	case OffsetOutOfRangeFail:
+		logger.Error("Partition offset out of range, no longer consuming the partition")
+		handler.SetReady(claim.Partition(), false)
+		consumer.sendError(fmt.Errorf("offset out of range for topic %s, partition %d: %w", claim.Topic(), claim.Partition(), sarama.ErrOffsetOutOfRange))
+	}
+}
+
+// inFlightMessage is a message that has been passed to the handler in its own goroutine
+type inFlightMessage struct {
+	message *sarama.ConsumerMessage
+	result  chan bool // Receives the mustMark value when the handler returns
+	cancel  context.CancelFunc
+}
+
+// decorateContext returns a context that carries the values given via the WithContextValues option, the
+// producer of the ConsumerGroup if there is one, and the trace context extracted from the message by the
+// WithPropagator option
+func (consumer *SaramaConsumerHandler) decorateContext(message *sarama.ConsumerMessage) context.Context {
+	ctx := consumer.baseContext
+	if ctx == nil {
+		ctx = consumer.newBaseContext() // A handler that was not created by NewConsumerHandler
+	}
+	return consumer.extractPropagated(ctx, message)
+}
+
+// newBaseContext returns a background context that carries the values given via the WithContextValues option and
+// the producer of the ConsumerGroup if there is one
+func (consumer *SaramaConsumerHandler) newBaseContext() context.Context {
+	ctx := context.Background()
+	for key, value := range consumer.contextValues {
+		ctx = context.WithValue(ctx, key, value)
+	}
+	if consumer.producer != nil {
+		ctx = context.WithValue(ctx, producerContextKey{}, consumer.producer)
+	}
+	return ctx
+}
+
+// maxInFlight returns the number of messages per partition that may be handled concurrently
+func (consumer *SaramaConsumerHandler) maxInFlight() int {
+	if consumer.maxInFlightPerPartition < 1 {
+		return 1
+	}
+	return consumer.maxInFlightPerPartition
+}
+
+// startHandling starts a goroutine that passes the message to the handler and reports any error, and then sends the
+// in-flight message to the returned channel (if it is not nil)
+func (consumer *SaramaConsumerHandler) startHandling(handler KafkaConsumerHandler, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage, returned chan<- *inFlightMessage) *inFlightMessage {
+	// We need to control when to cancel Handle calls so give it a downstream context
+	hctx, cancel := context.WithCancel(consumer.decorateContext(message))
+	pending := &inFlightMessage{message: message, result: make(chan bool, 1), cancel: cancel}
+
+	// Start Handle goroutine
+	go func() {
+		mustMark, err := consumer.handleWithTimeout(hctx, handler, message)
+
+		if errors.Is(err, ErrSkipMessage) {
+			consumer.logger.Debugw("Message skipped by the handler", zap.String("topic", message.Topic), zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset))
+			mustMark, err = true, nil
+		}
+		if err != nil {
+			consumer.logger.Infow("Failure while handling a message", zap.String("topic", message.Topic), zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Error(err))
+			var messageErr *MessageError
+			if consumer.messageErrorContext && !errors.As(err, &messageErr) {
+				err = &MessageError{GroupId: handler.GetConsumerGroup(), Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Err: err}
+			}
+			consumer.sendError(err)
+			handler.SetReady(claim.Partition(), false)
+		}
+		consumer.recordOutcome(err)
+
+		pending.result <- mustMark
+		if returned != nil {
+			returned <- pending
+		}
+	}()
+	return pending
+}
+
+// drainDeadline is the time by which the in-flight messages of a claim must have been handled once the session has
+// ended.  It is shared by all of them, so that draining a claim takes no longer than the handler timeout in total.
+type drainDeadline struct {
+	timeout time.Duration
+	at      time.Time // Zero until the first message is drained
+}
+
+// newDrainDeadline returns a drainDeadline of the handler timeout, which starts when the first message is drained
+func (consumer *SaramaConsumerHandler) newDrainDeadline() *drainDeadline {
+	return &drainDeadline{timeout: consumer.timeout}
+}
+
+// remaining returns how long is left to drain the in-flight messages, starting the deadline on the first call
+func (d *drainDeadline) remaining() time.Duration {
+	if d.at.IsZero() {
+		d.at = time.Now().Add(d.timeout)
+	}
+	return time.Until(d.at)
+}
+
+// finishHandling waits for the handler to return for an in-flight message, and marks the message if requested.  Once
+// the session has ended, the message is only waited for until the given drain deadline.
+func (consumer *SaramaConsumerHandler) finishHandling(session sarama.ConsumerGroupSession, pending *inFlightMessage, deadline *drainDeadline) {
+	var mustMark bool
+	select {
+	case mustMark = <-pending.result:
+		// Handle returned gracefully, call cancel to free the context resources.
+		pending.cancel()
+	case <-session.Context().Done():
+		// Consumer session canceled, wait for in-flight request to finish before we hit a rebalance timeout
+		timer := time.NewTimer(deadline.remaining())
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			// Handle still didn't return, cancel the in-flight request
+			pending.cancel()
+			// Unblock the Handle goroutine
+			mustMark = <-pending.result
+		case mustMark = <-pending.result:
+			// Handle returned gracefully, call cancel to free the context resources.
+			pending.cancel()
+		}
+	}
+
+	consumer.recordProcessed(pending.message)
+	if mustMark {
+		message := pending.message
+		session.MarkMessage(message, "") // Mark kafka message as processed
+		consumer.trackMarked(message)
+		consumer.commitGap.marked(message)
+		consumer.drainCommits.mark(message)
+		consumer.commitIfDue(session, message)
+		if consumer.logger.Desugar().Core().Enabled(zap.DebugLevel) {
+			consumer.logger.Debugw("Message marked", zap.String("topic", message.Topic), zap.Binary("value", message.Value))
+		}
+	}
+}
+
 var _ sarama.ConsumerGroupHandler = (*SaramaConsumerHandler)(nil)
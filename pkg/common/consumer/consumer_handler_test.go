@@ -20,9 +20,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
 
@@ -168,3 +171,529 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+type countingMessageHandler struct {
+	mockMessageHandler
+	handled int32
+	ready   int32
+}
+
+func (m *countingMessageHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	atomic.AddInt32(&m.handled, 1)
+	return m.mockMessageHandler.Handle(ctx, message)
+}
+
+func (m *countingMessageHandler) SetReady(_ int32, ready bool) {
+	if ready {
+		atomic.AddInt32(&m.ready, 1)
+	}
+}
+
+func TestSwappedHandler(t *testing.T) {
+	original := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+	swapped := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+	ref := newHandlerReference(original, nil)
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), original, errorCh, withGroupState(&groupState{handlerRef: ref}))
+
+	session := mockConsumerGroupSession{}
+	claim := mockConsumerGroupClaim{msg: &mockMessage}
+
+	ref.set(swapped, nil)
+	_ = cgh.Setup(&session)
+	_ = cgh.ConsumeClaim(&session, claim)
+	_ = cgh.Cleanup(&session)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&original.handled))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&swapped.handled))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&swapped.ready))
+	assert.True(t, session.marked)
+	close(errorCh)
+}
+
+func TestInterceptors(t *testing.T) {
+	var calls []string
+	recordingInterceptor := func(name string) Interceptor {
+		return func(next HandleFunc) HandleFunc {
+			return func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+				calls = append(calls, name+"-before")
+				mustMark, err := next(ctx, message)
+				calls = append(calls, name+"-after")
+				return mustMark, err
+			}
+		}
+	}
+	shortCircuit := func(next HandleFunc) HandleFunc {
+		return func(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+			calls = append(calls, "short-circuit")
+			return true, nil
+		}
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		options       []SaramaConsumerHandlerOption
+		expectCalls   []string
+		expectHandled int32
+	}{
+		{
+			name:          "No Interceptors",
+			expectHandled: 1,
+		},
+		{
+			name:          "Registration Order",
+			options:       []SaramaConsumerHandlerOption{WithInterceptor(recordingInterceptor("first")), WithInterceptor(recordingInterceptor("second"))},
+			expectCalls:   []string{"first-before", "second-before", "second-after", "first-after"},
+			expectHandled: 1,
+		},
+		{
+			name:        "Short Circuit",
+			options:     []SaramaConsumerHandlerOption{WithInterceptor(recordingInterceptor("first")), WithInterceptor(shortCircuit)},
+			expectCalls: []string{"first-before", "short-circuit", "first-after"},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			calls = nil
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, testCase.options...)
+
+			session := mockConsumerGroupSession{}
+			_ = cgh.ConsumeClaim(&session, mockConsumerGroupClaim{msg: &mockMessage})
+
+			assert.Equal(t, testCase.expectCalls, calls)
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.True(t, session.marked)
+			close(errorCh)
+		})
+	}
+}
+
+func TestOffsetOutOfRangePolicy(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		policy        OffsetOutOfRangePolicy
+		expectInitial int64
+		expectRejoin  bool
+		expectEvent   bool
+		expectError   bool
+	}{
+		{
+			name:          "Default",
+			policy:        OffsetOutOfRangeDefault,
+			expectInitial: sarama.OffsetNewest,
+		},
+		{
+			name:          "Reset Oldest",
+			policy:        OffsetOutOfRangeResetOldest,
+			expectInitial: sarama.OffsetOldest,
+			expectRejoin:  true,
+			expectEvent:   true,
+		},
+		{
+			name:          "Reset Newest",
+			policy:        OffsetOutOfRangeResetNewest,
+			expectInitial: sarama.OffsetNewest,
+			expectRejoin:  true,
+			expectEvent:   true,
+		},
+		{
+			name:          "Fail",
+			policy:        OffsetOutOfRangeFail,
+			expectInitial: sarama.OffsetNewest,
+			expectError:   true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rejoined := false
+			var events []EventIndex
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, errorCh,
+				WithOffsetOutOfRangePolicy(testCase.policy),
+				withRejoin(func() { rejoined = true }),
+				withEventNotifier(func(event EventIndex) { events = append(events, event) }))
+
+			// The mock claim closes its messages channel while the session context is still active,
+			// which is what sarama does when a partition offset is out of range
+			session := mockConsumerGroupSession{}
+			_ = cgh.ConsumeClaim(&session, mockConsumerGroupClaim{msg: &mockMessage})
+
+			config := sarama.NewConfig()
+			for _, modify := range cgh.configModifiers {
+				assert.Nil(t, modify(config))
+			}
+			assert.Equal(t, testCase.expectInitial, config.Consumer.Offsets.Initial)
+			assert.Equal(t, testCase.expectRejoin, rejoined)
+			if testCase.expectEvent {
+				assert.Equal(t, []EventIndex{GroupOffsetReset}, events)
+			} else {
+				assert.Nil(t, events)
+			}
+			if testCase.expectError {
+				err := <-errorCh
+				assert.True(t, errors.Is(err, sarama.ErrOffsetOutOfRange))
+			} else {
+				assert.Len(t, errorCh, 0)
+			}
+			close(errorCh)
+		})
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		duration     time.Duration
+		expectRejoin bool
+	}{
+		{name: "Default"},
+		{name: "Rejoin After Duration", duration: 5 * time.Millisecond, expectRejoin: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rejoined := make(chan struct{})
+			options := []SaramaConsumerHandlerOption{withRejoin(func() { close(rejoined) })}
+			if testCase.duration > 0 {
+				options = append(options, WithMaxSessionDuration(testCase.duration))
+			}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, options...)
+
+			session := mockConsumerGroupSession{}
+			_ = cgh.Setup(&session)
+			select {
+			case <-rejoined:
+				assert.True(t, testCase.expectRejoin)
+			case <-time.After(shortTimeout):
+				assert.False(t, testCase.expectRejoin)
+			}
+			_ = cgh.Cleanup(&session)
+		})
+	}
+}
+
+func TestMessageErrorContext(t *testing.T) {
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldErr: true}, errorCh, WithMessageErrorContext())
+
+	message := mockMessage
+	message.Topic = "test-topic"
+	message.Partition = 2
+	message.Offset = 42
+	_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, mockConsumerGroupClaim{msg: &message})
+
+	err := <-errorCh
+	var messageErr *MessageError
+	assert.True(t, errors.As(err, &messageErr))
+	assert.Equal(t, "consumer group", messageErr.GroupId)
+	assert.Equal(t, "test-topic", messageErr.Topic)
+	assert.Equal(t, int32(2), messageErr.Partition)
+	assert.Equal(t, int64(42), messageErr.Offset)
+	assert.Equal(t, "bla", errors.Unwrap(err).Error())
+	assert.Equal(t, "group consumer group, topic test-topic, partition 2, offset 42: bla", err.Error())
+	close(errorCh)
+}
+
+type panickingMessageHandler struct {
+	mockMessageHandler
+}
+
+func (m panickingMessageHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	panic("handler panic")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), panickingMessageHandler{}, errorCh)
+
+	message := mockMessage
+	message.Topic = "test-topic"
+	message.Partition = 1
+	message.Offset = 7
+	session := mockConsumerGroupSession{}
+	_ = cgh.ConsumeClaim(&session, mockConsumerGroupClaim{msg: &message})
+
+	err := <-errorCh
+	var messageErr *MessageError
+	assert.True(t, errors.As(err, &messageErr))
+	assert.Equal(t, "test-topic", messageErr.Topic)
+	assert.Equal(t, int32(1), messageErr.Partition)
+	assert.Equal(t, int64(7), messageErr.Offset)
+	assert.Contains(t, err.Error(), "handler panic")
+	assert.False(t, session.marked)
+
+	// With recovery disabled, the panic propagates out of handleMessage
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), panickingMessageHandler{}, errorCh, WithPanicRecovery(false))
+	assert.Panics(t, func() { _, _ = cgh.handleMessage(context.Background(), panickingMessageHandler{}, &message) })
+	close(errorCh)
+}
+
+// concurrentMessageHandler records the largest number of concurrent Handle calls, finishing later offsets first
+type concurrentMessageHandler struct {
+	mockMessageHandler
+	current int32
+	max     int32
+}
+
+func (m *concurrentMessageHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	current := atomic.AddInt32(&m.current, 1)
+	for {
+		max := atomic.LoadInt32(&m.max)
+		if current <= max || atomic.CompareAndSwapInt32(&m.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(time.Duration(10-message.Offset) * 5 * time.Millisecond)
+	atomic.AddInt32(&m.current, -1)
+	return true, nil
+}
+
+// markRecordingSession is a mockConsumerGroupSession that records the offsets of the marked messages
+type markRecordingSession struct {
+	mockConsumerGroupSession
+	offsets []int64
+}
+
+func (s *markRecordingSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.offsets = append(s.offsets, msg.Offset)
+}
+
+// multiMessageClaim is a mockConsumerGroupClaim that delivers several messages
+type multiMessageClaim struct {
+	mockConsumerGroupClaim
+	messages []*sarama.ConsumerMessage
+}
+
+func (m multiMessageClaim) Messages() <-chan *sarama.ConsumerMessage {
+	c := make(chan *sarama.ConsumerMessage, len(m.messages))
+	for _, message := range m.messages {
+		c <- message
+	}
+	close(c)
+	return c
+}
+
+func TestMaxInFlightPerPartition(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		options     []SaramaConsumerHandlerOption
+		expectedMax int32
+	}{
+		{
+			name:        "Default",
+			expectedMax: 1,
+		},
+		{
+			name:        "Zero",
+			options:     []SaramaConsumerHandlerOption{WithMaxInFlightPerPartition(0)},
+			expectedMax: 1,
+		},
+		{
+			name:        "Three",
+			options:     []SaramaConsumerHandlerOption{WithMaxInFlightPerPartition(3)},
+			expectedMax: 3,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var messages []*sarama.ConsumerMessage
+			for offset := int64(0); offset < 6; offset++ {
+				messages = append(messages, &sarama.ConsumerMessage{Offset: offset})
+			}
+			handler := &concurrentMessageHandler{}
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, testCase.options...)
+
+			session := markRecordingSession{}
+			_ = cgh.ConsumeClaim(&session, multiMessageClaim{messages: messages})
+
+			assert.Equal(t, testCase.expectedMax, atomic.LoadInt32(&handler.max))
+			assert.Equal(t, []int64{0, 1, 2, 3, 4, 5}, session.offsets)
+			close(errorCh)
+		})
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, WithTimeout(100*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	session := &committingSession{ctx: ctx}
+
+	// Three messages whose handler only returns once it is canceled
+	var canceled int32
+	var pending []*inFlightMessage
+	for offset := int64(0); offset < 3; offset++ {
+		message := &inFlightMessage{message: &sarama.ConsumerMessage{Offset: offset}, result: make(chan bool, 1)}
+		message.cancel = func() {
+			atomic.AddInt32(&canceled, 1)
+			message.result <- false
+		}
+		pending = append(pending, message)
+	}
+
+	// The messages share one deadline, rather than each being waited for the whole timeout
+	start := time.Now()
+	drain := cgh.newDrainDeadline()
+	for _, message := range pending {
+		cgh.finishHandling(session, message, drain)
+	}
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(100*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(250*time.Millisecond))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&canceled))
+}
+
+type contextKey string
+
+// contextRecordingHandler records the context passed to Handle
+type contextRecordingHandler struct {
+	mockMessageHandler
+	ctx chan context.Context
+}
+
+func (m contextRecordingHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	m.ctx <- ctx
+	return true, nil
+}
+
+func TestContextValues(t *testing.T) {
+	handler := contextRecordingHandler{ctx: make(chan context.Context, 2)}
+	errorCh := make(chan error, 1)
+	values := map[interface{}]interface{}{contextKey("tenant"): "tenant-1"}
+
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, WithContextValues(values))
+	values[contextKey("tenant")] = "modified"
+	_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, mockConsumerGroupClaim{msg: &mockMessage})
+	assert.Equal(t, "tenant-1", (<-handler.ctx).Value(contextKey("tenant")))
+
+	// Default adds nothing
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh)
+	_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, mockConsumerGroupClaim{msg: &mockMessage})
+	assert.Nil(t, (<-handler.ctx).Value(contextKey("tenant")))
+	close(errorCh)
+
+	// A nil key is left out of the context, and fails the validation of the group's config
+	cgh = NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, WithContextValues(map[interface{}]interface{}{nil: "value"}))
+	assert.Empty(t, cgh.contextValues)
+	assert.Len(t, cgh.configValidators, 1)
+	assert.NotNil(t, cgh.configValidators[0](sarama.NewConfig()))
+	assert.Equal(t, cgh.baseContext, cgh.decorateContext(&mockMessage))
+}
+
+// errorReturningHandler returns the given error (and does not request marking) for every message
+type errorReturningHandler struct {
+	mockMessageHandler
+	err error
+}
+
+func (m errorReturningHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	return false, m.err
+}
+
+func TestSkipMessage(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		err         error
+		expectMark  bool
+		expectError bool
+	}{
+		{
+			name:       "Skipped",
+			err:        ErrSkipMessage,
+			expectMark: true,
+		},
+		{
+			name:       "Skipped With Wrapped Sentinel",
+			err:        fmt.Errorf("message expired: %w", ErrSkipMessage),
+			expectMark: true,
+		},
+		{
+			name:        "Failed",
+			err:         errors.New("handler error"),
+			expectError: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), errorReturningHandler{err: testCase.err}, errorCh)
+			session := &markRecordingSession{}
+
+			_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &mockMessage})
+			assert.Equal(t, testCase.expectMark, len(session.offsets) == 1)
+			assert.Equal(t, testCase.expectError, len(errorCh) == 1)
+			close(errorCh)
+		})
+	}
+}
+
+// BenchmarkMaxPartitionFetchRecords feeds a partition in bursts of fetched records (as a sarama partition consumer
+// does when the channel has room) to a ConsumerGroup started by the factory with the option, so that each record takes
+// the full path from the claim through the handler of the group (and the session marks its offset).  It reports the
+// largest number of records that waited ahead of the handler in the claim's channel, which the ChannelBufferSize set
+// by WithMaxPartitionFetchRecords bounds.
+func BenchmarkMaxPartitionFetchRecords(b *testing.B) {
+	const fetchSize = 500 // Records returned by each simulated fetch
+	for _, maxRecords := range []int{0, 64, 8} {
+		name := fmt.Sprintf("MaxRecords=%d", maxRecords)
+		var options []SaramaConsumerHandlerOption
+		if maxRecords == 0 {
+			name = "Default"
+		} else {
+			options = append(options, WithMaxPartitionFetchRecords(maxRecords))
+		}
+		b.Run(name, func(b *testing.B) {
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig()}
+			config, err := factory.groupConfig(options)
+			assert.Nil(b, err)
+
+			messages := make(chan *sarama.ConsumerMessage, config.ChannelBufferSize)
+			maxBuffered := 0
+			feed := func() {
+				for sent := 0; sent < b.N; {
+					for i := 0; i < fetchSize && sent < b.N; i, sent = i+1, sent+1 {
+						messages <- &sarama.ConsumerMessage{Topic: "topic", Offset: int64(sent)}
+						if buffered := len(messages); buffered > maxBuffered {
+							maxBuffered = buffered
+						}
+					}
+				}
+				close(messages)
+			}
+
+			// The group runs a single session that consumes the claim until the feed is exhausted
+			consumed := false
+			consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+				if consumed {
+					return sarama.ErrClosedConsumerGroup
+				}
+				consumed = true
+				session := &claimsSession{committingSession: committingSession{ctx: ctx}, claims: map[string][]int32{"topic": {0}}}
+				if err := handler.Setup(session); err != nil {
+					return err
+				}
+				b.ResetTimer()
+				go feed()
+				err := handler.ConsumeClaim(session, channelClaim{messages: messages})
+				b.StopTimer()
+				_ = handler.Cleanup(session)
+				return err
+			}
+
+			group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{"topic"},
+				zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, nil, options...)
+			for range group.handlerErrorChannel {
+			}
+			<-group.state.done
+			group.cancel()
+			b.ReportMetric(float64(maxBuffered), "max-buffered")
+		})
+	}
+}
+
+// channelClaim is a mockConsumerGroupClaim that delivers the messages of an existing channel
+type channelClaim struct {
+	mockConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c channelClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
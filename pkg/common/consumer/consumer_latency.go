@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// joinLatencyMetric is the name of the histogram, in the MetricRegistry of the sarama config, that records the time
+// (in milliseconds) from the start of each consume call of a factory's ConsumerGroup to the Setup of its session,
+// which is how long the group spent (re)joining.  If the factory has a ConsumerGroupMetricsReporter, the same value is
+// also recorded in a "consumer-join-latency-in-ms-for-group-<GroupId>" histogram (as with the per-broker metrics of
+// sarama), which the StatsReporter of the metrics package exports alongside the sarama metrics.
+const joinLatencyMetric = "consumer-join-latency-in-ms"
+
+// The sample parameters of the sarama histograms, so that the join latency is reported in the same manner
+const (
+	joinLatencyReservoirSize = 1028
+	joinLatencyAlphaFactor   = 0.015
+)
+
+// joinLatencyRecorder times the attempts of a ConsumerGroup to join its group, across the sessions of its consume loop
+type joinLatencyRecorder struct {
+	all     gometrics.Histogram
+	group   gometrics.Histogram
+	started time.Time // The start of the current consume call (zero once its join has been recorded)
+	lock    sync.Mutex
+}
+
+// newJoinLatencyRecorder returns a joinLatencyRecorder that records in the given registry, or nil (which records
+// nothing) if the registry is nil.  The histogram of the group itself is only registered if perGroup is true.
+func newJoinLatencyRecorder(registry gometrics.Registry, groupId string, perGroup bool) *joinLatencyRecorder {
+	if registry == nil {
+		return nil
+	}
+	newHistogram := func() gometrics.Histogram {
+		return gometrics.NewHistogram(gometrics.NewExpDecaySample(joinLatencyReservoirSize, joinLatencyAlphaFactor))
+	}
+	recorder := &joinLatencyRecorder{
+		all: registry.GetOrRegister(joinLatencyMetric, newHistogram).(gometrics.Histogram),
+	}
+	if perGroup {
+		recorder.group = registry.GetOrRegister(groupMetricName(joinLatencyMetric, groupId), newHistogram).(gometrics.Histogram)
+	}
+	return recorder
+}
+
+// consumeStarted notes the start of a consume call
+func (r *joinLatencyRecorder) consumeStarted() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.started = time.Now()
+}
+
+// joined records the time since the start of the current consume call, if it has not been recorded already
+func (r *joinLatencyRecorder) joined() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started.IsZero() {
+		return
+	}
+	latency := time.Since(r.started).Milliseconds()
+	r.started = time.Time{}
+	r.all.Update(latency)
+	if r.group != nil {
+		r.group.Update(latency)
+	}
+}
+
+// groupMetricName returns the name of the per-group counterpart of the given metric
+func groupMetricName(metric string, groupId string) string {
+	return fmt.Sprintf("%s-for-group-%s", metric, groupId)
+}
+
+// unregisterGroupMetrics removes the per-group metrics of a ConsumerGroup from the given registry (if it is not nil),
+// so that the registry does not keep the metrics of every group that was ever closed
+func unregisterGroupMetrics(registry gometrics.Registry, groupId string) {
+	if registry == nil {
+		return
+	}
+	for _, metric := range []string{joinLatencyMetric, droppedErrorsMetric, partitionMismatchesMetric} {
+		registry.Unregister(groupMetricName(metric, groupId))
+	}
+}
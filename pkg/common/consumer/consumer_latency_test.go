@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestJoinLatency(t *testing.T) {
+	for _, testCase := range []struct {
+		name           string
+		reporter       ConsumerGroupMetricsReporter
+		expectPerGroup bool
+	}{
+		{name: "With Metrics Reporter", reporter: &recordingReporter{}, expectPerGroup: true},
+		{name: "Without Metrics Reporter", expectPerGroup: false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			registry := gometrics.NewRegistry()
+			config := sarama.NewConfig()
+			config.MetricRegistry = registry
+			factory := kafkaConsumerGroupFactoryImpl{config: config, addrs: []string{"b1"}, metricsReporter: testCase.reporter}
+
+			// Two sessions join after a delay, and one fails without joining (which records nothing)
+			sessions := 0
+			consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+				sessions++
+				switch sessions {
+				case 1, 3:
+					time.Sleep(20 * time.Millisecond)
+					_ = handler.Setup(&mockConsumerGroupSession{})
+					_ = handler.Setup(&mockConsumerGroupSession{}) // Only the first Setup of a consume call is recorded
+					return nil
+				case 2:
+					return errors.New("consume error")
+				}
+				return sarama.ErrClosedConsumerGroup
+			}
+
+			group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{}, zap.NewNop().Sugar(), mockMessageHandler{}, nil)
+			for range group.handlerErrorChannel {
+			}
+			<-group.state.done
+			group.cancel()
+
+			names := []string{joinLatencyMetric}
+			if testCase.expectPerGroup {
+				names = append(names, joinLatencyMetric+"-for-group-group")
+			} else {
+				assert.Nil(t, registry.Get(joinLatencyMetric+"-for-group-group"))
+			}
+			for _, name := range names {
+				histogram, ok := registry.Get(name).(gometrics.Histogram)
+				assert.True(t, ok, name)
+				if ok {
+					assert.Equal(t, int64(2), histogram.Count(), name)
+					assert.GreaterOrEqual(t, histogram.Min(), int64(20), name)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinLatencyWithoutRegistry(t *testing.T) {
+	recorder := newJoinLatencyRecorder(nil, "group", true)
+	assert.Nil(t, recorder)
+	// A nil recorder records nothing
+	recorder.consumeStarted()
+	recorder.joined()
+}
@@ -24,28 +24,76 @@ Usage:
 - Create a ServerHandler and call NewConsumerGroupManager()
 - Use the manager's StartConsumerGroup() and CloseConsumerGroup() functions instead of creating
   and closing sarama ConsumerGroups directly
+- StartConsumerGroupSync() is like StartConsumerGroup() but also waits for the group to be joined successfully
+- CloseConsumerGroupAndWait() is like CloseConsumerGroup() but also waits for the consume goroutine to exit
+- StartChannelConsumer() starts a managed group whose messages are received from a channel instead of a handler
+- DrainConsumerGroup() is like CloseConsumerGroupAndWait() but may also confirm that the final offset commit
+  of the group was stored by the broker (see ConfirmedDrainCommit)
+- Shutdown() closes all of the managed groups (e.g. on SIGTERM), waiting for them to drain until a deadline
 - Errors() obtains an error channel for the managed group (persists between stop/start actions)
+- PausePartitions() and ResumePartitions() pause and resume individual partitions of a managed group, and
+  PausedPartitions() returns the partitions that are paused
+- SwapHandler() replaces the handler of a managed group without restarting it (or causing a rebalance)
+- AddExistingGroup() and Consume() allow a custom KafkaConsumerGroupFactory to place its groups under management
+- DroppedErrors() returns the number of handler errors of a managed group that were dropped (see WithErrorChannel)
+- Describe() returns a serializable snapshot of the manager and all of its groups (e.g. for support bundles)
 - IsManaged() returns true if a given GroupId is under management
+- IsDead() returns true if the consume loop of a managed group gave up (see WithMaxRestartAttempts)
+- ActiveConsumers() returns the number of consume goroutines that are running (e.g. for detecting leaks)
+- Topics() returns the topics that a managed group consumes, which change over time for a group started with the
+  WithTopicPattern() option (restarting the group whenever the topics matching its pattern change)
+- AddStartDependency() makes the manager start a group only after another one is consuming, when it restarts
+  several groups at once (e.g. in Reconfigure() or SetActive())
+- CommittedOffsets() queries the broker for the offsets that a managed group has committed
+- CommitGap() returns the number of offsets of each partition that a managed group has marked but not committed
+- RestoreOffsets() commits a snapshot of offsets (e.g. from CommittedOffsets()) as those of a stopped managed group
+- BrokerGroupId() returns the group.id that a managed group uses with the broker (see WithGroupIdTransformer)
+- Ping() checks that the brokers of the default cluster can be reached and authenticated with
 - Reconfigure() allows you to change consumer factory settings (automatically stopping and
-  restarting all managed ConsumerGroups)
+  restarting all managed ConsumerGroups of the default cluster)
+- ReconfigureWithReport() is like Reconfigure() but also reports the outcome for each managed group
+- RollingReconfigure() is like Reconfigure() but restarts the managed ConsumerGroups one (or a few) at a time
+- ReconfigureAuth() is like Reconfigure() but only changes the authentication settings (e.g. rotated credentials)
+- RegisterCluster() adds a named set of brokers and config that groups started with the WithCluster() option
+  consume from, and ReconfigureCluster() is like Reconfigure() but changes them (restarting only those groups)
+- ReconnectCluster() restarts the groups of a cluster with new connections, keeping its settings (e.g. after the
+  DNS records of the brokers changed)
+- EnableSaramaLogging() writes the (process-wide) sarama logs via the manager's logger
+- Export() and Import() transfer the managed groups from one manager to another (e.g. on leader election)
+- SetActive() stops all of the managed groups and later restarts them, keeping them under management (e.g. while
+  a replica is not the leader), and IsActive() returns false while they are stopped this way
+
+Control-protocol commands identify a group only by its GroupId, so the GroupIds of all managed groups must be
+unique, even if the groups consume from different clusters.  A command is applied to the group regardless of its
+cluster, and a group that is started again after a stop is re-created with the current settings of its own cluster.
 */
 
 package consumer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/types"
 	ctrlservice "knative.dev/control-protocol/pkg/service"
+	"knative.dev/pkg/logging"
 
+	"knative.dev/eventing-kafka/pkg/common/client"
 	"knative.dev/eventing-kafka/pkg/common/controlprotocol"
 	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+	kafkasarama "knative.dev/eventing-kafka/pkg/common/kafka/sarama"
 )
 
 const (
@@ -53,6 +101,10 @@ const (
 	internalToken      = "internal-token"
 )
 
+// ErrInvalidGroupId is wrapped by the error that the manager returns for a GroupId that is empty, whitespace-only
+// or contains illegal characters, instead of managing a group that could never be matched again
+var ErrInvalidGroupId = errors.New("invalid consumer group id")
+
 // SubscriberStatus keeps track of the difference between active, failed, and stopped subscribers
 type SubscriberStatus struct {
 	Stopped bool  // A stopped subscriber is active but suspended ("paused") and is not processing events
@@ -82,22 +134,181 @@ const (
 	GroupStopped
 	GroupStarted
 	GroupClosed
+	GroupOffsetReset
+	GroupJoined
+	GroupDead
+	GroupLockExpired
+	GroupTopicsChanged
+	GroupExited
+	GroupRecreated
+	GroupReplayFinished
+	GroupGenerationChurn
+	GroupPartitionStalled
 )
 
+// defaultRollingGroupTimeout is the time RollingReconfigure waits for each group to begin consuming, if not specified
+const defaultRollingGroupTimeout = time.Minute
+
+// RollingReconfigureOptions contains the settings used by RollingReconfigure
+type RollingReconfigureOptions struct {
+	GroupTimeout time.Duration // How long to wait for each restarted group to begin consuming (default is one minute)
+	Concurrency  int           // How many groups may be restarting at the same time (default is one)
+}
+
+// RollingReconfigureError is returned by RollingReconfigure if a group could not be restarted, and
+// reports the progress that was made before the failure.  It is also returned if every group that was rolled
+// was restarted but some were skipped because they were locked, in which case FailedGroup is empty.
+type RollingReconfigureError struct {
+	Restarted    []string // Groups that were restarted (and began consuming) with the new configuration
+	FailedGroup  string   // The group that could not be restarted or did not begin consuming
+	OtherFailed  []string // Groups that also failed, while they were restarting along with the failed group
+	NotRestarted []string // Groups that were not restarted, because they were after the failed group
+	Locked       []string // Groups that were skipped, because they were locked (e.g. by a control-protocol command)
+	Err          error
+}
+
+// Error returns the failure of the group that stopped the rolling reconfiguration, or the skipped groups
+func (e *RollingReconfigureError) Error() string {
+	if e.FailedGroup == "" {
+		return fmt.Sprintf("rolling reconfigure skipped %d locked groups (%d restarted)", len(e.Locked), len(e.Restarted))
+	}
+	return fmt.Sprintf("rolling reconfigure failed on group %s (%d restarted, %d not restarted, %d locked): %v",
+		e.FailedGroup, len(e.Restarted), len(e.NotRestarted), len(e.Locked), e.Err)
+}
+
+// Unwrap returns the failure of the group that stopped the rolling reconfiguration
+func (e *RollingReconfigureError) Unwrap() error {
+	return e.Err
+}
+
+// ReconfigureOutcome is what happened to a managed group when the manager was reconfigured
+type ReconfigureOutcome int
+
+const (
+	// ReconfigureRestarted means that the group was stopped and restarted with the new configuration
+	ReconfigureRestarted ReconfigureOutcome = iota
+	// ReconfigureStopFailed means that the group could not be stopped (e.g. it was locked by another command), so
+	// it was not restarted and will use the new configuration when whatever stopped it restarts it
+	ReconfigureStopFailed
+	// ReconfigureRestartFailed means that the group was stopped, but could not be restarted
+	ReconfigureRestartFailed
+)
+
+// String returns a human-readable name of the outcome, for logging
+func (o ReconfigureOutcome) String() string {
+	switch o {
+	case ReconfigureRestarted:
+		return "restarted"
+	case ReconfigureStopFailed:
+		return "stop-failed"
+	case ReconfigureRestartFailed:
+		return "restart-failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// GroupReconfigureResult is the outcome of reconfiguring a single managed group
+type GroupReconfigureResult struct {
+	GroupId string
+	Outcome ReconfigureOutcome
+	Err     error // The reason that the group could not be stopped or restarted (nil if it was restarted)
+}
+
+// ReconfigureReport is returned by ReconfigureWithReport, with the results of the managed groups in GroupId order
+type ReconfigureReport struct {
+	Groups []GroupReconfigureResult
+}
+
+// Failed returns the GroupIds of the groups that were not restarted with the new configuration
+func (r ReconfigureReport) Failed() []string {
+	var failed []string
+	for _, result := range r.Groups {
+		if result.Outcome != ReconfigureRestarted {
+			failed = append(failed, result.GroupId)
+		}
+	}
+	return failed
+}
+
+// Err aggregates the errors of the groups that were not restarted (via multierr), or returns nil if there are none
+func (r ReconfigureReport) Err() error {
+	var errs error
+	for _, result := range r.Groups {
+		multierr.AppendInto(&errs, result.Err)
+	}
+	return errs
+}
+
+// ShutdownResult reports how the groups of the manager were closed by Shutdown
+type ShutdownResult struct {
+	Drained     []string // Groups that closed, and whose consume loop exited, before the context was done
+	ForceClosed []string // Groups that failed to close or had not finished when the context was done
+	Unconfirmed []string // Groups that drained, but whose final offset commit was not verified (see WithDrainCommitMode)
+}
+
+// ManagedGroupState is the exported state of a managed group, as returned by Export and accepted by Import.  It
+// is serializable, so it may be passed between processes.
+type ManagedGroupState struct {
+	GroupId string   `json:"groupId"`
+	Cluster string   `json:"cluster,omitempty"`
+	Topics  []string `json:"topics"`
+	Stopped bool     `json:"stopped"`
+}
+
+// HandlerResolver provides the handler (and options) that Import uses to start the group with the given groupId,
+// since handlers themselves cannot be exported
+type HandlerResolver func(groupId string) (KafkaConsumerHandler, []SaramaConsumerHandlerOption, error)
+
 // ManagerEvent is the struct used by the notification channel
 type ManagerEvent struct {
-	Event   EventIndex
-	GroupId string
+	Event     EventIndex
+	GroupId   string
+	Topic     string // The partition that the event is about (only for GroupPartitionStalled)
+	Partition int32
 }
 
 // KafkaConsumerGroupManager keeps track of Sarama consumer groups and handles messages from control-protocol clients
 type KafkaConsumerGroupManager interface {
 	Reconfigure(brokers []string, config *sarama.Config) error
+	ReconfigureWithReport(brokers []string, config *sarama.Config) (ReconfigureReport, error)
+	RollingReconfigure(brokers []string, config *sarama.Config, options RollingReconfigureOptions) error
+	ReconfigureAuth(authConfig *client.KafkaAuthConfig) error
+	RegisterCluster(name string, brokers []string, config *sarama.Config) error
+	ReconfigureCluster(name string, brokers []string, config *sarama.Config) error
+	ReconnectCluster(name string) error
 	StartConsumerGroup(groupId string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error
+	StartConsumerGroupSync(ctx context.Context, groupId string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error
+	StartChannelConsumer(groupId string, topics []string, logger *zap.SugaredLogger, options ...SaramaConsumerHandlerOption) (<-chan *sarama.ConsumerMessage, func() error, error)
 	CloseConsumerGroup(groupId string) error
+	CloseConsumerGroupAndWait(groupId string, timeout time.Duration) error
+	DrainConsumerGroup(groupId string, timeout time.Duration, mode DrainCommitMode) error
+	Shutdown(ctx context.Context) (ShutdownResult, error)
+	SwapHandler(groupId string, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error
+	PausePartitions(groupId string, assignments map[string][]int32) error
+	ResumePartitions(groupId string, assignments map[string][]int32) error
+	PausedPartitions(groupId string) (map[string][]int32, error)
+	DroppedErrors(groupId string) (int64, error)
+	Describe() ManagerSnapshot
+	AddExistingGroup(groupId string, group sarama.ConsumerGroup, topics []string, createGroup func() (sarama.ConsumerGroup, error), cancel func()) error
+	Consume(ctx context.Context, groupId string, topics []string, handler sarama.ConsumerGroupHandler) error
 	Errors(groupId string) <-chan error
 	IsManaged(groupId string) bool
+	Topics(groupId string) ([]string, error)
+	CommittedOffsets(groupId string) (map[string]map[int32]int64, error)
+	CommitGap(groupId string) (map[string]map[int32]int64, error)
+	RestoreOffsets(groupId string, offsets map[string]map[int32]int64) error
+	AddStartDependency(groupId string, dependsOn string) error
+	BrokerGroupId(groupId string) (string, error)
+	Ping(ctx context.Context) error
+	EnableSaramaLogging() bool
+	Export() []ManagedGroupState
+	Import(states []ManagedGroupState, logger *zap.SugaredLogger, resolver HandlerResolver) error
 	IsStopped(groupId string) bool
+	IsDead(groupId string) bool
+	ActiveConsumers() int
+	SetActive(active bool) error
+	IsActive() bool
 	GetNotificationChannel() <-chan ManagerEvent
 	ClearNotifications()
 }
@@ -108,29 +319,49 @@ type groupMap map[string]managedGroup
 // kafkaConsumerGroupManagerImpl is the primary implementation of a KafkaConsumerGroupManager, which
 // handles control protocol messages and stopping/starting ("pausing/resuming") of ConsumerGroups.
 type kafkaConsumerGroupManagerImpl struct {
-	logger         *zap.Logger
-	server         controlprotocol.ServerHandler
-	factory        *kafkaConsumerGroupFactoryImpl
-	groups         groupMap
-	groupLock      sync.RWMutex // Synchronizes write access to the groupMap
-	notifyChannels []chan ManagerEvent
-	eventLock      sync.Mutex
+	logger          *zap.Logger
+	server          controlprotocol.ServerHandler
+	factory         *kafkaConsumerGroupFactoryImpl
+	factoryOptions  []FactoryOption                           // Applied to each factory that the manager creates
+	activeConsumers *int64                                    // The number of running consume goroutines of all factories
+	clusters        map[string]*kafkaConsumerGroupFactoryImpl // The factories of the clusters other than the default one
+	factoryLock     sync.RWMutex                              // Synchronizes access to the factory and the clusters
+	reconfigureLock sync.Mutex                                // Serializes calls to Reconfigure
+	groups          groupMap
+	groupLock       sync.RWMutex // Synchronizes write access to the groupMap
+	notifyChannels  []chan ManagerEvent
+	eventLock       sync.Mutex
+	shutdown        int32               // Set to 1 (atomically) by Shutdown
+	inactive        int32               // Set to 1 (atomically) while the manager is inactive (see SetActive)
+	suspended       map[string]bool     // The groups stopped by SetActive(false), which SetActive(true) restarts
+	suspendLock     sync.Mutex          // Synchronizes access to the suspended groups
+	memoryShares    map[string]int64    // The share of the memory budget that each group was created with (see WithMemoryBudget)
+	budgetLock      sync.Mutex          // Synchronizes access to the memory shares
+	dependencies    map[string][]string // The groups that each group depends on (see AddStartDependency)
+	dependencyLock  sync.RWMutex        // Synchronizes access to the dependencies
 }
 
 // Verify that the kafkaConsumerGroupManagerImpl satisfies the KafkaConsumerGroupManager interface
 var _ KafkaConsumerGroupManager = (*kafkaConsumerGroupManagerImpl)(nil)
 
-// NewConsumerGroupManager returns a new kafkaConsumerGroupManagerImpl as a KafkaConsumerGroupManager interface
-func NewConsumerGroupManager(logger *zap.Logger, serverHandler controlprotocol.ServerHandler, brokers []string, config *sarama.Config) KafkaConsumerGroupManager {
+// NewConsumerGroupManager returns a new kafkaConsumerGroupManagerImpl as a KafkaConsumerGroupManager interface.
+// The factory options apply to every factory that the manager creates (including those of Reconfigure and the
+// registered clusters).
+func NewConsumerGroupManager(logger *zap.Logger, serverHandler controlprotocol.ServerHandler, brokers []string, config *sarama.Config, options ...FactoryOption) KafkaConsumerGroupManager {
 
 	manager := &kafkaConsumerGroupManagerImpl{
-		logger:    logger,
-		server:    serverHandler,
-		groups:    make(groupMap),
-		factory:   &kafkaConsumerGroupFactoryImpl{addrs: brokers, config: config},
-		groupLock: sync.RWMutex{},
-		eventLock: sync.Mutex{},
+		logger:          logger,
+		server:          serverHandler,
+		groups:          make(groupMap),
+		factoryOptions:  options,
+		activeConsumers: new(int64),
+		clusters:        make(map[string]*kafkaConsumerGroupFactoryImpl),
+		factoryLock:     sync.RWMutex{},
+		reconfigureLock: sync.Mutex{},
+		groupLock:       sync.RWMutex{},
+		eventLock:       sync.Mutex{},
 	}
+	manager.factory = manager.newFactory(DefaultCluster, brokers, config)
 
 	logger.Info("Registering Consumer Group Manager Control-Protocol Handlers")
 
@@ -152,6 +383,21 @@ func NewConsumerGroupManager(logger *zap.Logger, serverHandler controlprotocol.S
 			processAsyncGroupNotification(commandMessage, manager.startConsumerGroup)
 		})
 
+	// Add a handler that understands the ResetOffsetsOpCode and resets the offsets of the requested (stopped) group
+	serverHandler.AddAsyncHandler(
+		commands.ResetOffsetsOpCode,
+		commands.ResetOffsetsResultOpCode,
+		&commands.ConsumerGroupAsyncCommand{},
+		func(ctx context.Context, commandMessage ctrlservice.AsyncCommandMessage) {
+			processAsyncGroupNotification(commandMessage, func(lock *commands.CommandLock, groupId string) error {
+				offsetTime := commandMessage.ParsedCommand().(*commands.ConsumerGroupAsyncCommand).OffsetTime
+				if offsetTime == nil {
+					return fmt.Errorf("could not reset offsets of consumer group with id '%s' - the command has no offset time", groupId)
+				}
+				return manager.resetOffsets(lock, groupId, *offsetTime)
+			})
+		})
+
 	return manager
 }
 
@@ -178,6 +424,7 @@ func (m *kafkaConsumerGroupManagerImpl) ClearNotifications() {
 // notify will send the given ManagerEvent to all channels in the notifyChannels list
 func (m *kafkaConsumerGroupManagerImpl) notify(event ManagerEvent) {
 	m.logger.Debug("Notifying channels", zap.Int("count", len(m.notifyChannels)), zap.Any("event", event))
+	m.reportEvent(event)
 	for _, eventChan := range m.notifyChannels {
 		// Don't block if the receiver isn't listening
 		select {
@@ -189,45 +436,342 @@ func (m *kafkaConsumerGroupManagerImpl) notify(event ManagerEvent) {
 
 // Reconfigure will incorporate a new set of brokers and Sarama config settings into the manager
 // without requiring a new control-protocol server or losing the current map of managed groups.
-// It will stop and start all of the managed groups in the group map.
+// It will stop and start all of the managed groups of the default cluster.  Concurrent calls are serialized,
+// so a second call will block until the first has finished restarting the groups.
 func (m *kafkaConsumerGroupManagerImpl) Reconfigure(brokers []string, config *sarama.Config) error {
-	m.logger.Info("Reconfigure Consumer Group Manager - Stopping All Managed Consumer Groups")
-	var multiErr error
-	groupsToRestart := make([]string, 0, len(m.groups))
-	for groupId := range m.groups {
+	return m.reconfigureCluster(DefaultCluster, brokers, config).Err()
+}
+
+// ReconfigureWithReport incorporates a new set of brokers and Sarama config settings in the same manner as
+// Reconfigure, but also returns the outcome for each of the managed groups, so that the caller can act on the
+// individual failures (e.g. retry only the groups that failed to restart).  The returned error is the one that
+// Reconfigure would have returned, which is the same as the Err function of the report.
+func (m *kafkaConsumerGroupManagerImpl) ReconfigureWithReport(brokers []string, config *sarama.Config) (ReconfigureReport, error) {
+	report := m.reconfigureCluster(DefaultCluster, brokers, config)
+	return report, report.Err()
+}
+
+// reconfigureCluster replaces the brokers and config of the named cluster, stopping the managed groups of that
+// cluster first and restarting them afterwards
+func (m *kafkaConsumerGroupManagerImpl) reconfigureCluster(cluster string, brokers []string, config *sarama.Config) ReconfigureReport {
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	return m.reconfigureLocked(cluster, brokers, config)
+}
+
+// reconfigureLocked does the work of reconfigureCluster.  The caller must hold the reconfigureLock.
+func (m *kafkaConsumerGroupManagerImpl) reconfigureLocked(cluster string, brokers []string, config *sarama.Config) ReconfigureReport {
+	return m.restartClusterGroups(cluster, func() {
+		m.setClusterFactory(cluster, m.newFactory(cluster, brokers, config))
+	})
+}
+
+// restartClusterGroups stops the managed groups of the named cluster, calls the replaceFactory function (if non-nil)
+// and then restarts the groups, which creates new sarama ConsumerGroups (and clients) for them.  The caller must
+// hold the reconfigureLock.
+func (m *kafkaConsumerGroupManagerImpl) restartClusterGroups(cluster string, replaceFactory func()) ReconfigureReport {
+	if !m.IsActive() {
+		// The groups are stopped, and SetActive restarts them with whatever settings are current then
+		if replaceFactory != nil {
+			replaceFactory()
+		}
+		m.logInactive(cluster)
+		return ReconfigureReport{Groups: []GroupReconfigureResult{}}
+	}
+	logger := m.logger.With(zap.String("Cluster", cluster))
+	logger.Info("Reconfigure Consumer Group Manager - Stopping All Managed Consumer Groups")
+	groupIds := m.getClusterGroupIds(cluster)
+	sort.Strings(groupIds)
+	report := ReconfigureReport{Groups: make([]GroupReconfigureResult, 0, len(groupIds))}
+	for _, groupId := range groupIds {
 		err := m.stopConsumerGroup(&commands.CommandLock{Token: internalToken, LockBefore: true}, groupId)
 		if err != nil {
 			// If we couldn't stop a group, or failed to obtain a lock, note it as an error.  However,
 			// in a practical sense, the new brokers/config will be used when whatever locked the group
 			// restarts it anyway.
-			multierr.AppendInto(&multiErr, err)
+			report.Groups = append(report.Groups, GroupReconfigureResult{GroupId: groupId, Outcome: ReconfigureStopFailed, Err: err})
 		} else {
 			// Only attempt to restart groups that this function stopped
-			groupsToRestart = append(groupsToRestart, groupId)
+			report.Groups = append(report.Groups, GroupReconfigureResult{GroupId: groupId, Outcome: ReconfigureRestarted})
 		}
 	}
 
-	m.factory = &kafkaConsumerGroupFactoryImpl{addrs: brokers, config: config}
+	if replaceFactory != nil {
+		replaceFactory()
+	}
 
-	// Restart any groups this function stopped
-	m.logger.Info("Reconfigure Consumer Group Manager - Starting All Managed Consumer Groups")
-	for _, groupId := range groupsToRestart {
-		err := m.startConsumerGroup(&commands.CommandLock{Token: internalToken, UnlockAfter: true}, groupId)
+	// Restart any groups this function stopped, after the groups that they depend on
+	logger.Info("Reconfigure Consumer Group Manager - Starting All Managed Consumer Groups")
+	results := make(map[string]*GroupReconfigureResult, len(report.Groups))
+	stopped := make([]string, 0, len(report.Groups))
+	for index, result := range report.Groups {
+		if result.Outcome == ReconfigureRestarted {
+			results[result.GroupId] = &report.Groups[index]
+			stopped = append(stopped, result.GroupId)
+		}
+	}
+	started := make(map[string]error, len(stopped))
+	for _, groupId := range m.startOrder(stopped) {
+		err := m.startWithDependencies(&commands.CommandLock{Token: internalToken, UnlockAfter: true}, groupId, started)
 		if err != nil {
-			multierr.AppendInto(&multiErr, err)
+			results[groupId].Outcome = ReconfigureRestartFailed
+			results[groupId].Err = err
+		}
+	}
+	return report
+}
+
+// ReconfigureAuth applies the given TLS/SASL settings to a copy of the current sarama config of the default cluster
+// (using the client ConfigBuilder) and then reconfigures with it and the current brokers.  If the auth config has only
+// SASL settings, and they are the same as the current ones, nothing is done.
+func (m *kafkaConsumerGroupManagerImpl) ReconfigureAuth(authConfig *client.KafkaAuthConfig) error {
+	if authConfig == nil {
+		return fmt.Errorf("cannot reconfigure with a nil auth config")
+	}
+	// The lock is held throughout so that a concurrent Reconfigure is not undone with the brokers and settings
+	// that were current before it
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	factory := m.getFactory()
+	if authConfig.TLS == nil && authConfig.SASL != nil && authConfig.SASL.HasSameSettings(factory.config) {
+		m.logger.Info("Auth Settings Unchanged - Skipping Reconfigure")
+		return nil
+	}
+	configCopy := *factory.config
+
+	// Build logs the config, so the current secrets are removed from the copy (and restored afterwards if the
+	// SASL settings are not replaced)
+	sasl := configCopy.Net.SASL
+	configCopy.Net.SASL.Password = ""
+	configCopy.Net.SASL.TokenProvider = nil
+	configCopy.Net.SASL.SCRAMClientGeneratorFunc = nil
+	ctx := logging.WithLogger(context.Background(), m.logger.Sugar())
+	config, err := client.NewConfigBuilder().WithExisting(&configCopy).WithAuth(authConfig).Build(ctx)
+	if err != nil {
+		m.logger.Error("Failed To Apply New Auth Settings", zap.Error(err))
+		return err
+	}
+	if authConfig.SASL == nil {
+		config.Net.SASL.Password = sasl.Password
+		config.Net.SASL.TokenProvider = sasl.TokenProvider
+		config.Net.SASL.SCRAMClientGeneratorFunc = sasl.SCRAMClientGeneratorFunc
+	}
+	return m.reconfigureLocked(DefaultCluster, factory.addrs, config).Err()
+}
+
+// RollingReconfigure incorporates a new set of brokers and Sarama config settings in the same manner as
+// Reconfigure, but restarts the managed groups one at a time, waiting for each to rejoin and begin consuming all of
+// its claims before restarting the next, so that most groups keep consuming throughout.  Only the running groups of
+// the default cluster are restarted: a stopped group uses the new settings when it is started, and a group that is
+// locked (e.g. by a control-protocol command) is skipped and reported in the RollingReconfigureError, to be
+// restarted by whatever holds the lock.  With a Concurrency above one, up to that many groups are restarting at the
+// same time, and the next group is restarted as soon as one of them is consuming (a group that depends on another is
+// only restarted once that one is consuming).  If a group fails to restart or begin consuming, no further groups are
+// restarted (those that are already restarting are waited for) and a RollingReconfigureError is returned.
+func (m *kafkaConsumerGroupManagerImpl) RollingReconfigure(brokers []string, config *sarama.Config, options RollingReconfigureOptions) error {
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+
+	timeout := options.GroupTimeout
+	if timeout <= 0 {
+		timeout = defaultRollingGroupTimeout
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	m.logger.Info("Rolling Reconfigure Consumer Group Manager")
+	m.setFactory(m.newFactory(DefaultCluster, brokers, config))
+	if !m.IsActive() {
+		m.logInactive(DefaultCluster)
+		return nil
+	}
+
+	groupIds, locked := m.rollingGroupIds()
+	groupIds = m.startOrder(groupIds)
+	results := m.restartConsumerGroups(groupIds, concurrency, timeout)
+
+	var rollingErr *RollingReconfigureError
+	restarted := make([]string, 0, len(groupIds))
+	notRestarted := make([]string, 0)
+	for _, groupId := range groupIds {
+		err, ok := results[groupId]
+		switch {
+		case !ok:
+			notRestarted = append(notRestarted, groupId)
+		case err == nil:
+			restarted = append(restarted, groupId)
+		case rollingErr == nil:
+			rollingErr = &RollingReconfigureError{FailedGroup: groupId, Err: err}
+		default:
+			rollingErr.OtherFailed = append(rollingErr.OtherFailed, groupId)
 		}
 	}
-	return multiErr
+	if rollingErr == nil && len(locked) > 0 {
+		rollingErr = &RollingReconfigureError{}
+	}
+	if rollingErr != nil {
+		rollingErr.Restarted = restarted
+		rollingErr.NotRestarted = notRestarted
+		rollingErr.Locked = locked
+		return rollingErr
+	}
+	return nil
+}
+
+// rollingGroupIds returns the sorted groupIds of the default cluster that RollingReconfigure restarts, which are
+// those that are running and unlocked, and those that it skips because they are locked
+func (m *kafkaConsumerGroupManagerImpl) rollingGroupIds() (groupIds []string, locked []string) {
+	all := m.getClusterGroupIds(DefaultCluster)
+	sort.Strings(all)
+	for _, groupId := range all {
+		managedGrp := m.getGroup(groupId)
+		switch {
+		case managedGrp == nil || managedGrp.isStopped():
+			continue // Closed since the groupIds were obtained, or uses the new settings when it is started
+		case managedGrp.lockToken() != "":
+			m.logger.Warn("Rolling Reconfigure Skipping Locked Managed ConsumerGroup", zap.String("GroupId", groupId))
+			locked = append(locked, groupId)
+		default:
+			groupIds = append(groupIds, groupId)
+		}
+	}
+	return groupIds, locked
+}
+
+// restartConsumerGroups restarts the given groups in order, as the restartConsumerGroup function does, with up to
+// the given number of them restarting at the same time.  A group is only restarted once the groups that it depends
+// on (among the given ones) have finished restarting, and no further groups are restarted after one has failed.  It
+// returns the outcome of each group that was restarted.
+func (m *kafkaConsumerGroupManagerImpl) restartConsumerGroups(groupIds []string, concurrency int, timeout time.Duration) map[string]error {
+	var lock sync.Mutex
+	var waitGroup sync.WaitGroup
+	results := make(map[string]error, len(groupIds))
+	finished := make(map[string]chan struct{}, len(groupIds))
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, err := range results {
+			if err != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	slots := make(chan struct{}, concurrency)
+	for _, groupId := range groupIds {
+		for _, dependency := range m.startDependencies(groupId) {
+			if done, ok := finished[dependency]; ok {
+				<-done
+			}
+		}
+		slots <- struct{}{}
+		if failed() {
+			break
+		}
+		done := make(chan struct{})
+		finished[groupId] = done
+		waitGroup.Add(1)
+		go func(groupId string) {
+			defer waitGroup.Done()
+			err := m.restartConsumerGroup(groupId, timeout)
+			if err != nil {
+				m.logger.Error("Rolling Reconfigure Failed To Restart Managed ConsumerGroup", zap.String("GroupId", groupId), zap.Error(err))
+			}
+			lock.Lock()
+			results[groupId] = err
+			lock.Unlock()
+			close(done)
+			<-slots
+		}(groupId)
+	}
+	waitGroup.Wait()
+	return results
+}
+
+// restartConsumerGroup stops and starts a managed group, and waits for it to rejoin and begin consuming
+func (m *kafkaConsumerGroupManagerImpl) restartConsumerGroup(groupId string, timeout time.Duration) error {
+	if err := m.stopConsumerGroup(&commands.CommandLock{Token: internalToken, LockBefore: true}, groupId); err != nil {
+		return err
+	}
+	if err := m.startConsumerGroup(&commands.CommandLock{Token: internalToken, UnlockAfter: true}, groupId); err != nil {
+		return err
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return fmt.Errorf("consumer group with id '%s' was removed from the managed map during restart", groupId)
+	}
+	if managedGrp.createGroupFn() != nil {
+		return nil // The sessions of a group added via AddExistingGroup are not observable by the manager
+	}
+	return managedGrp.waitForConsuming(timeout)
 }
 
 // StartConsumerGroup uses the consumer factory to create a new ConsumerGroup, add it to the list
 // of managed groups (for start/stop functionality) and start the Consume loop.
 func (m *kafkaConsumerGroupManagerImpl) StartConsumerGroup(groupId string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error {
+	return m.newManagedConsumerGroup(groupId, topics, logger, handler, false, false, options...)
+}
+
+// newManagedConsumerGroup adds a new managed group as StartConsumerGroup does.  If stopped is true, the group is
+// created in the stopped state instead of being started, so it neither connects to the brokers nor joins the group
+// until it is started.  If ifAbsent is true, the new group is closed and an error returned if the groupId is already
+// managed, instead of replacing that group.
+func (m *kafkaConsumerGroupManagerImpl) newManagedConsumerGroup(groupId string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, stopped bool, ifAbsent bool, options ...SaramaConsumerHandlerOption) error {
+	if err := validateGroupId(groupId); err != nil {
+		return fmt.Errorf("could not start consumer group - %w", err)
+	}
 	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	if m.isShutdown() {
+		return fmt.Errorf("could not start consumer group with id '%s' - the manager has been shut down", groupId)
+	}
 	groupLogger.Info("Creating New Managed ConsumerGroup")
-	group, err := m.factory.createConsumerGroup(groupId)
+	factory, err := m.getClusterFactory(clusterOf(options))
+	if err != nil {
+		return fmt.Errorf("could not start consumer group with id '%s' - %w", groupId, err)
+	}
+	pattern, patternInterval, err := topicPatternOf(options)
+	if err != nil {
+		return fmt.Errorf("could not start consumer group with id '%s' - %w", groupId, err)
+	}
+	if pattern != nil {
+		if topics, err = factory.matchingTopics(pattern, options); err != nil {
+			groupLogger.Error("Failed To Resolve Topic Pattern Of New Managed ConsumerGroup", zap.Error(err))
+			return fmt.Errorf("could not resolve the topic pattern of consumer group with id '%s' - %w", groupId, err)
+		}
+		groupLogger.Info("Resolved Topic Pattern Of New Managed ConsumerGroup", zap.String("Pattern", pattern.String()), zap.Strings("Topics", topics))
+	}
+	if err = factory.checkTopics(groupId, topics, logger, options...); err != nil {
+		groupLogger.Error("Failed To Check Topics Of New Managed ConsumerGroup", zap.Error(err))
+		return err
+	}
+	if err = factory.createDeadLetterTopics(groupId, topics, logger, options...); err != nil {
+		groupLogger.Error("Failed To Create Dead Letter Topics Of New Managed ConsumerGroup", zap.Error(err))
+		return err
+	}
+	options = m.withManagerOptions(groupId, options)
+	var deferred *deferredStart
+	if !stopped {
+		deferred = m.deferStart(groupId, topics, options)
+	}
+	var group sarama.ConsumerGroup = newIdleConsumerGroup()
+	if deferred == nil && !stopped {
+		// A group that is not started now has its version checked by startConsumerGroup when it is
+		if err = factory.checkVersion(groupLogger.Sugar()); err != nil {
+			groupLogger.Error("Failed To Check Kafka Version For New Managed ConsumerGroup", zap.Error(err))
+			return err
+		}
+		if group, err = factory.createConsumerGroup(groupId, options...); err != nil {
+			groupLogger.Error("Failed To Create New Managed ConsumerGroup")
+			return err
+		}
+	}
+	producer, err := factory.createProducer(options...)
 	if err != nil {
-		groupLogger.Error("Failed To Create New Managed ConsumerGroup")
+		groupLogger.Error("Failed To Create Producer For New Managed ConsumerGroup", zap.Error(err))
+		_ = group.Close()
 		return err
 	}
 
@@ -238,40 +782,404 @@ func (m *kafkaConsumerGroupManagerImpl) StartConsumerGroup(groupId string, topic
 	// manager to continue to block in the Consume call while a group goes through a stop/start cycle.
 	consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
 		logger.Debug("Consuming Messages On managed Consumer Group", zap.String("GroupId", groupId))
-		return m.consume(ctx, groupId, topics, handler)
+		return m.Consume(ctx, groupId, topics, handler)
 	}
 
 	// The only thing we really want from the factory is the cancel function for the customConsumerGroup
-	customGroup := m.factory.startExistingConsumerGroup(group, consume, topics, logger, handler, options...)
-	managedGrp := createManagedGroup(ctx, m.logger, group, cancel, customGroup.cancel)
+	customGroup := factory.startExistingConsumerGroup(groupId, group, consume, topics, logger, handler, producer, options...)
+	managedGrp := createManagedGroup(ctx, groupLogger, group, cancel, customGroup.cancel, customGroup.state)
+	managedGrp.setTopics(topics)
+	if pattern != nil {
+		managedGrp.followTopics()
+	}
+	managedGrp.setLockExpiredNotifier(m.lockExpiredNotifier(groupId))
+	if deferred != nil {
+		_ = managedGrp.stop() // Closing an idleConsumerGroup cannot fail
+		groupLogger.Info("Deferring Start Of New Managed ConsumerGroup Until Its Topics Have Data")
+	} else if stopped {
+		_ = managedGrp.stop()
+		groupLogger.Info("Created New Managed ConsumerGroup In The Stopped State")
+	}
 
 	// Add the Sarama ConsumerGroup we obtained from the factory to the managed group map,
 	// so that it can be stopped and started via control-protocol messages.
-	m.setGroup(groupId, managedGrp)
+	if !ifAbsent {
+		m.setGroup(groupId, managedGrp)
+	} else if !m.setGroupIfAbsent(groupId, managedGrp) {
+		groupLogger.Warn("Managed ConsumerGroup Was Added Concurrently - Closing New Group")
+		_ = managedGrp.close()
+		return fmt.Errorf("could not start consumer group with id '%s' - group is already present in the managed map", groupId)
+	}
 	m.notify(ManagerEvent{Event: GroupCreated, GroupId: groupId})
+	if pattern != nil {
+		go m.followTopicPattern(ctx, groupId, pattern, patternInterval)
+	}
+	if deferred != nil {
+		go m.awaitTopicData(ctx, groupId, *deferred)
+	}
+	if threshold := stallThresholdOf(options); threshold > 0 {
+		go m.watchStalledPartitions(ctx, groupId, customGroup.state.progress, threshold)
+	}
+	if _, ok := factory.metricsReporter.(CommitGapReporter); ok {
+		go m.watchCommitGaps(ctx, groupId)
+	}
+	if factory.supervision != nil {
+		go m.superviseConsumerGroup(ctx, groupId, managedGrp, customGroup.state.done, logger, customGroup.state.handlerRef, *factory.supervision)
+	}
+	go m.rebalanceMemoryBudget()
+	return nil
+}
+
+// StartConsumerGroupSync starts a managed ConsumerGroup in the same manner as StartConsumerGroup, and then waits
+// until either the first session has been set up (returning nil) or the first attempt to consume has failed
+// (returning that error, after closing the group).  If the context is done first, the group is also closed.
+func (m *kafkaConsumerGroupManagerImpl) StartConsumerGroupSync(ctx context.Context, groupId string, topics []string, logger *zap.SugaredLogger, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error {
+	joined := newJoinSignal()
+	options = append(append([]SaramaConsumerHandlerOption{}, options...), withJoinSignal(joined))
+	if err := m.StartConsumerGroup(groupId, topics, logger, handler, options...); err != nil {
+		return err
+	}
+	if err := joined.wait(ctx); err != nil {
+		m.logger.Error("Managed ConsumerGroup Failed To Join", zap.String("GroupId", groupId), zap.Error(err))
+		_ = m.CloseConsumerGroup(groupId)
+		return err
+	}
 	return nil
 }
 
 // CloseConsumerGroup calls the Close function on the ConsumerGroup embedded in the managedGroup
 // associated with the given groupId, and also closes its managed errors channel.  It then removes the
-// group from management.
+// group from management.  If the group has a WithCloseFlush function, it is called first, and its error
+// is returned once the group has been closed.
 func (m *kafkaConsumerGroupManagerImpl) CloseConsumerGroup(groupId string) error {
+	flushErr, err := m.closeConsumerGroup(groupId, defaultCloseFlushTimeout)
+	return multierr.Append(flushErr, err)
+}
+
+// closeConsumerGroup closes the group as described by CloseConsumerGroup, waiting no longer than the
+// flushTimeout for its WithCloseFlush function.  It returns the error of the flush separately from the
+// error that kept the group from being closed.
+func (m *kafkaConsumerGroupManagerImpl) closeConsumerGroup(groupId string, flushTimeout time.Duration) (flushErr error, err error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not close consumer group - %w", err)
+	}
 	groupLogger := m.logger.With(zap.String("GroupId", groupId))
 	groupLogger.Info("Closing ConsumerGroup and removing from management")
 	managedGrp := m.getGroup(groupId)
 	if managedGrp == nil {
 		groupLogger.Warn("CloseConsumerGroup called on unmanaged group")
-		return fmt.Errorf("could not close consumer group with id '%s' - group is not present in the managed map", groupId)
+		return nil, fmt.Errorf("could not close consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	flushErr = flushGroup(managedGrp, flushTimeout)
+	if flushErr != nil {
+		groupLogger.Error("Failed To Flush Managed ConsumerGroup Before Closing", zap.Error(flushErr))
 	}
 	if err := managedGrp.close(); err != nil {
 		groupLogger.Error("Failed To Close Managed ConsumerGroup", zap.Error(err))
-		return err
+		return flushErr, err
+	}
+
+	if factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions())); err == nil {
+		unregisterGroupMetrics(factory.config.MetricRegistry, groupId)
 	}
 
 	// Remove this groupId from the map so that manager functions may not be called on it
 	m.removeGroup(groupId)
 	m.notify(ManagerEvent{Event: GroupClosed, GroupId: groupId})
+	go m.rebalanceMemoryBudget()
+
+	return flushErr, nil
+}
+
+// CloseConsumerGroupAndWait closes the managed group in the same manner as CloseConsumerGroup (using the
+// timeout for its WithCloseFlush function as well), and then waits for the background consume goroutine
+// of that group to exit, returning an error if it has not done so before the timeout expires.  This
+// guarantees that a new group with the same groupId will not overlap the old one.  If only the flush
+// failed, its error is returned once the consume goroutine has exited.
+func (m *kafkaConsumerGroupManagerImpl) CloseConsumerGroupAndWait(groupId string, timeout time.Duration) error {
+	managedGrp := m.getGroup(groupId)
+	flushErr, err := m.closeConsumerGroup(groupId, timeout)
+	if err != nil {
+		return multierr.Append(flushErr, err)
+	}
+	if err := managedGrp.waitForConsumeExit(timeout); err != nil {
+		m.logger.Error("Consume goroutine of closed ConsumerGroup did not exit", zap.String("GroupId", groupId), zap.Error(err))
+		return multierr.Append(flushErr, err)
+	}
+	return flushErr
+}
+
+// DrainConsumerGroup closes the managed group in the same manner as CloseConsumerGroupAndWait.  With the
+// ConfirmedDrainCommit mode, the session that ends when the group is closed also commits its marked offsets
+// synchronously (after its in-flight messages have finished) and verifies that the broker stored them, and a
+// DrainCommitError is returned if that was not confirmed before the timeout expired.  The group is closed and
+// removed from management regardless.  A group that is stopped has no session, so there is nothing to confirm.
+func (m *kafkaConsumerGroupManagerImpl) DrainConsumerGroup(groupId string, timeout time.Duration, mode DrainCommitMode) error {
+	_, err := m.drainConsumerGroup(groupId, timeout, mode)
+	return err
+}
+
+// drainConsumerGroup drains the managed group in the same manner as DrainConsumerGroup, and also returns whether
+// the final commit of the group was verified (which it never is without the ConfirmedDrainCommit mode)
+func (m *kafkaConsumerGroupManagerImpl) drainConsumerGroup(groupId string, timeout time.Duration, mode DrainCommitMode) (bool, error) {
+	var tracker *drainCommitTracker
+	managedGrp := m.getGroup(groupId)
+	if mode == ConfirmedDrainCommit && managedGrp != nil {
+		tracker = managedGrp.state().drainCommits
+		if tracker != nil {
+			tracker.begin(time.Now().Add(timeout))
+		}
+	}
+	if err := m.CloseConsumerGroupAndWait(groupId, timeout); err != nil {
+		return false, err
+	}
+	if mode != ConfirmedDrainCommit {
+		return false, nil
+	}
+	if tracker == nil {
+		return false, &DrainCommitError{GroupId: groupId, Err: fmt.Errorf("commits cannot be verified for a group that was not started by the manager")}
+	}
+	verified, err := tracker.result()
+	if err != nil {
+		return false, &DrainCommitError{GroupId: groupId, Err: err}
+	}
+	return verified, nil
+}
+
+// drainCommitModeOf returns the WithDrainCommitMode of the factory of the cluster that the managed group uses
+func (m *kafkaConsumerGroupManagerImpl) drainCommitModeOf(groupId string) DrainCommitMode {
+	if managedGrp := m.getGroup(groupId); managedGrp != nil {
+		if factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions())); err == nil {
+			return factory.drainCommitMode
+		}
+	}
+	return m.getFactory().drainCommitMode
+}
+
+// Shutdown closes every managed group in parallel, in the same manner as DrainConsumerGroup (with the mode of
+// the WithDrainCommitMode option of the group's cluster), so that each one drains (its sessions end, in-flight
+// messages finish within the handler timeout and the marked offsets are committed) before its consume loop exits.
+// Groups that have not finished when the context is done are removed from management without waiting any longer and
+// reported as force-closed; their close continues in the background, bounded by the handler timeout.  With the
+// ConfirmedDrainCommit mode, groups that closed but whose final commit was not confirmed are reported as unconfirmed,
+// as are those whose commit could not be verified at all (e.g. because they were stopped), although only the former
+// are reported as errors.  Once Shutdown has been called, no new groups may be started, and any further call returns
+// an error.  The returned error aggregates the failures of all of the groups.
+func (m *kafkaConsumerGroupManagerImpl) Shutdown(ctx context.Context) (ShutdownResult, error) {
+	if !atomic.CompareAndSwapInt32(&m.shutdown, 0, 1) {
+		return ShutdownResult{}, fmt.Errorf("the consumer group manager has already been shut down")
+	}
+	m.logger.Info("Shutting Down Consumer Group Manager")
+
+	wait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+
+	type closeResult struct {
+		groupId  string
+		mode     DrainCommitMode
+		verified bool
+		err      error
+	}
+	groupIds := m.getGroupIds()
+	sort.Strings(groupIds)
+	results := make(chan closeResult, len(groupIds)) // Buffered so that late closes do not block
+	for _, groupId := range groupIds {
+		go func(groupId string) {
+			mode := m.drainCommitModeOf(groupId)
+			verified, err := m.drainConsumerGroup(groupId, wait, mode)
+			results <- closeResult{groupId: groupId, mode: mode, verified: verified, err: err}
+		}(groupId)
+	}
 
+	var errs error
+	result := ShutdownResult{}
+	pending := make(map[string]bool, len(groupIds))
+	for _, groupId := range groupIds {
+		pending[groupId] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case closed := <-results:
+			delete(pending, closed.groupId)
+			var commitErr *DrainCommitError
+			if errors.As(closed.err, &commitErr) {
+				result.Unconfirmed = append(result.Unconfirmed, closed.groupId)
+				errs = multierr.Append(errs, closed.err)
+			} else if closed.err != nil {
+				result.ForceClosed = append(result.ForceClosed, closed.groupId)
+				errs = multierr.Append(errs, fmt.Errorf("consumer group with id '%s' did not drain: %w", closed.groupId, closed.err))
+			} else if closed.mode == ConfirmedDrainCommit && !closed.verified {
+				m.logger.Warn("Final Offset Commit Of Drained ConsumerGroup Was Not Verified", zap.String("GroupId", closed.groupId))
+				result.Unconfirmed = append(result.Unconfirmed, closed.groupId)
+			} else {
+				result.Drained = append(result.Drained, closed.groupId)
+			}
+		case <-ctx.Done():
+			for groupId := range pending {
+				m.logger.Warn("Forcing Close Of Managed ConsumerGroup", zap.String("GroupId", groupId))
+				m.removeGroup(groupId)
+				result.ForceClosed = append(result.ForceClosed, groupId)
+				errs = multierr.Append(errs, fmt.Errorf("consumer group with id '%s' did not drain: %w", groupId, ctx.Err()))
+			}
+			pending = nil
+		}
+	}
+	m.retireFactories()
+	sort.Strings(result.Drained)
+	sort.Strings(result.ForceClosed)
+	sort.Strings(result.Unconfirmed)
+	m.logger.Info("Consumer Group Manager Shut Down", zap.Strings("Drained", result.Drained), zap.Strings("ForceClosed", result.ForceClosed),
+		zap.Strings("Unconfirmed", result.Unconfirmed))
+	return result, errs
+}
+
+// isShutdown returns true if Shutdown has been called
+func (m *kafkaConsumerGroupManagerImpl) isShutdown() bool {
+	return atomic.LoadInt32(&m.shutdown) == 1
+}
+
+// SwapHandler replaces the KafkaConsumerHandler (and SaramaConsumerHandlerOptions) of the managed group
+// associated with the given groupId.  The new handler is used for the next message processed by the consume
+// loop, and the options are applied when the next session starts, so the group keeps its partition assignment.
+func (m *kafkaConsumerGroupManagerImpl) SwapHandler(groupId string, handler KafkaConsumerHandler, options ...SaramaConsumerHandlerOption) error {
+	if err := validateGroupId(groupId); err != nil {
+		return fmt.Errorf("could not swap handler for consumer group - %w", err)
+	}
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		groupLogger.Warn("SwapHandler called on unmanaged group")
+		return fmt.Errorf("could not swap handler for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	// The new handler stays on the cluster of the group, since the group is not re-created
+	cluster := clusterOf(managedGrp.handlerOptions())
+	if clusterOf(options) != DefaultCluster && clusterOf(options) != cluster {
+		return fmt.Errorf("could not swap handler for consumer group with id '%s' - the cluster of a group cannot be changed", groupId)
+	}
+	if cluster != DefaultCluster {
+		options = append([]SaramaConsumerHandlerOption{WithCluster(cluster)}, options...)
+	}
+	if err := managedGrp.swapHandler(handler, m.withManagerOptions(groupId, options)); err != nil {
+		groupLogger.Error("Failed To Swap Handler Of Managed ConsumerGroup", zap.Error(err))
+		return err
+	}
+	groupLogger.Info("Swapped Handler Of Managed ConsumerGroup")
+	return nil
+}
+
+// PausePartitions stops the delivery of messages from the given partitions (by topic) of a managed group, while
+// the other partitions of the group continue to be consumed, such as to isolate a partition with a message that
+// cannot be processed.  All of the partitions must be assigned to the group's current session; if any is not, no
+// partitions are paused and an error is returned.  A paused partition remains paused (even if a rebalance moves
+// it away and back) until ResumePartitions is called.
+func (m *kafkaConsumerGroupManagerImpl) PausePartitions(groupId string, assignments map[string][]int32) error {
+	pauser, err := m.getPartitionPauser(groupId, "pause")
+	if err != nil {
+		return err
+	}
+	if err = pauser.pause(assignments); err != nil {
+		m.logger.Warn("Failed To Pause Partitions", zap.String("GroupId", groupId), zap.Error(err))
+		return err
+	}
+	m.logger.Info("Paused Partitions", zap.String("GroupId", groupId), zap.Any("Partitions", assignments))
+	return nil
+}
+
+// ResumePartitions resumes the delivery of messages from the given partitions (by topic) of a managed group.
+// Resuming a partition that is not paused has no effect.
+func (m *kafkaConsumerGroupManagerImpl) ResumePartitions(groupId string, assignments map[string][]int32) error {
+	pauser, err := m.getPartitionPauser(groupId, "resume")
+	if err != nil {
+		return err
+	}
+	pauser.resume(assignments)
+	m.logger.Info("Resumed Partitions", zap.String("GroupId", groupId), zap.Any("Partitions", assignments))
+	return nil
+}
+
+// PausedPartitions returns the partitions (by topic) of a managed group that are paused via PausePartitions, which
+// is empty if none are.  The partitions stay paused while the whole group is stopped via the control-protocol (or
+// SetActive), so they are still returned then; a stopped group consumes no partitions at all, which IsStopped
+// reports.  A group added via AddExistingGroup never has paused partitions.
+func (m *kafkaConsumerGroupManagerImpl) PausedPartitions(groupId string) (map[string][]int32, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not get paused partitions for consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return nil, fmt.Errorf("could not get paused partitions for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	pauser := managedGrp.state().pauser
+	if pauser == nil {
+		return map[string][]int32{}, nil
+	}
+	return pauser.pausedPartitions(), nil
+}
+
+// getPartitionPauser returns the partitionPauser of a managed group, or an error (mentioning the given action)
+// if the group is not managed or was not started by the manager
+func (m *kafkaConsumerGroupManagerImpl) getPartitionPauser(groupId string, action string) (*partitionPauser, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not %s partitions for consumer group - %w", action, err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return nil, fmt.Errorf("could not %s partitions for consumer group with id '%s' - group is not present in the managed map", action, groupId)
+	}
+	pauser := managedGrp.state().pauser
+	if pauser == nil {
+		return nil, fmt.Errorf("could not %s partitions for consumer group with id '%s' - group was not started by the manager", action, groupId)
+	}
+	return pauser, nil
+}
+
+// AddExistingGroup places a ConsumerGroup that was created outside of the manager (e.g. by a custom
+// KafkaConsumerGroupFactory) under management, so that it can be stopped and started in the same manner as one
+// created by StartConsumerGroup.  The caller must satisfy the following contract:
+//   - The consume loop of the group must call the manager's Consume function instead of the Consume function of
+//     the group, since the manager closes and replaces the group when it is stopped and started.  Consume blocks
+//     while the group is stopped, and returns only when Consume on the current group returns for another reason.
+//   - createGroup is called to create a replacement ConsumerGroup (e.g. with new settings) when the group is
+//     started after a stop.  If it is nil, the manager's own factory settings are used.
+//   - cancel, if non-nil, is called by CloseConsumerGroup (before closing the group) and must end the consume loop.
+//
+// If the groupId is already managed, the group is closed in the same manner (calling cancel) and an error returned.
+// The errors of the group are relayed via the manager's Errors function.  SwapHandler and PausePartitions are not
+// supported for these groups, CloseConsumerGroupAndWait does not wait for the caller's consume loop, and
+// RollingReconfigure does not wait for them to rejoin (since the manager does not create their handler, it
+// cannot observe their sessions).
+func (m *kafkaConsumerGroupManagerImpl) AddExistingGroup(groupId string, group sarama.ConsumerGroup, topics []string, createGroup func() (sarama.ConsumerGroup, error), cancel func()) error {
+	if err := validateGroupId(groupId); err != nil {
+		return fmt.Errorf("could not add consumer group - %w", err)
+	}
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	if group == nil {
+		return fmt.Errorf("could not add consumer group with id '%s' - the group is nil", groupId)
+	}
+	if m.isShutdown() {
+		return fmt.Errorf("could not add consumer group with id '%s' - the manager has been shut down", groupId)
+	}
+	if createGroup == nil {
+		createGroup = func() (sarama.ConsumerGroup, error) {
+			return m.getFactory().createConsumerGroup(groupId)
+		}
+	}
+
+	ctx, cancelErrors := context.WithCancel(context.Background())
+	managedGrp := createManagedGroup(ctx, groupLogger, group, cancelErrors, cancel, nil)
+	managedGrp.setTopics(topics)
+	managedGrp.setCreateGroupFn(createGroup)
+	managedGrp.setLockExpiredNotifier(m.lockExpiredNotifier(groupId))
+
+	groupLogger.Info("Adding Existing ConsumerGroup To Management")
+	if !m.setGroupIfAbsent(groupId, managedGrp) {
+		groupLogger.Warn("AddExistingGroup called on managed group")
+		_ = managedGrp.close()
+		return fmt.Errorf("could not add consumer group with id '%s' - group is already present in the managed map", groupId)
+	}
+	m.notify(ManagerEvent{Event: GroupCreated, GroupId: groupId})
 	return nil
 }
 
@@ -291,6 +1199,159 @@ func (m *kafkaConsumerGroupManagerImpl) IsManaged(groupId string) bool {
 	return m.getGroup(groupId) != nil
 }
 
+// Topics returns a copy of the list of topics consumed by the managed group associated with the given groupId
+func (m *kafkaConsumerGroupManagerImpl) Topics(groupId string) ([]string, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not get topics for consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return nil, fmt.Errorf("could not get topics for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	return managedGrp.topics(), nil
+}
+
+// BrokerGroupId returns the group.id that the managed group identified by the given groupId uses with the broker,
+// which differs from the groupId if the manager was given the WithGroupIdTransformer option.  For a group added via
+// AddExistingGroup, this is the group.id of the replacement group that the manager creates when it is restarted.
+func (m *kafkaConsumerGroupManagerImpl) BrokerGroupId(groupId string) (string, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return "", fmt.Errorf("could not get broker group id for consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return "", fmt.Errorf("could not get broker group id for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+	if err != nil {
+		return "", err
+	}
+	return factory.brokerGroupId(groupId), nil
+}
+
+// CommittedOffsets queries the broker for the offsets committed by a managed group, keyed by topic and partition.
+// Partitions without a committed offset are omitted.  Since the broker is the source of this information, it
+// may be called whether the group is currently running or stopped.  Requires Kafka 0.10.2 or newer.
+func (m *kafkaConsumerGroupManagerImpl) CommittedOffsets(groupId string) (map[string]map[int32]int64, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return nil, fmt.Errorf("could not get committed offsets for consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return nil, fmt.Errorf("could not get committed offsets for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+
+	factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+	if err != nil {
+		return nil, err
+	}
+	admin, err := newClusterAdmin(factory.addrs, factory.config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := admin.Close(); closeErr != nil {
+			m.logger.Warn("Failed To Close Cluster Admin", zap.Error(closeErr))
+		}
+	}()
+
+	// A nil partition map requests the offsets of every partition the group has committed
+	response, err := admin.ListConsumerGroupOffsets(factory.brokerGroupId(groupId), nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.Err != sarama.ErrNoError {
+		return nil, response.Err
+	}
+
+	offsets := make(map[string]map[int32]int64, len(response.Blocks))
+	for topic, partitions := range response.Blocks {
+		for partition, block := range partitions {
+			if block.Err != sarama.ErrNoError {
+				return nil, fmt.Errorf("could not get committed offset for topic %s, partition %d: %w", topic, partition, block.Err)
+			}
+			if block.Offset < 0 {
+				continue // Nothing committed for this partition
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = make(map[int32]int64)
+			}
+			offsets[topic][partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// EnableSaramaLogging installs the manager's logger as the sarama logger, so that the low-level sarama logs are
+// written (at the Debug level) through the same logging pipeline as the manager's own.  The sarama logger is
+// global to the process, which means that this affects every sarama client, not only the groups of this manager.
+// Only one zap logger may be installed; if another manager (or anything else) has already installed one, this
+// returns false and leaves it in place.  Sarama logging is left as-is unless this is called.
+func (m *kafkaConsumerGroupManagerImpl) EnableSaramaLogging() bool {
+	if !kafkasarama.InstallZapSaramaLogger(m.logger) {
+		m.logger.Warn("Sarama Logger Already Installed - Not Replacing It")
+		return false
+	}
+	m.logger.Info("Installed Manager Logger For Sarama Logging")
+	return true
+}
+
+// Export returns the state of every managed group, sorted by groupId, so that another manager can take over
+// those groups via Import.  This does not affect the groups in this manager.  The exported state is the groupId,
+// topics and stopped status of each group; the handler, options, command locks, errors channel and any pending
+// notifications are not part of it.
+func (m *kafkaConsumerGroupManagerImpl) Export() []ManagedGroupState {
+	groupIds := m.getGroupIds()
+	sort.Strings(groupIds)
+	states := make([]ManagedGroupState, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		managedGrp := m.getGroup(groupId)
+		if managedGrp == nil {
+			continue // Closed since the groupIds were obtained
+		}
+		states = append(states, ManagedGroupState{
+			GroupId: groupId,
+			Cluster: clusterOf(managedGrp.handlerOptions()),
+			Topics:  managedGrp.topics(),
+			Stopped: managedGrp.isStopped(),
+		})
+	}
+	return states
+}
+
+// Import starts managing the groups in the given states (as exported from another manager), using the resolver
+// to obtain the handler for each group.  A group that was stopped is created in the stopped state, without joining
+// the group, and is started by the usual means (such as a StartConsumerGroup command).  Sarama does not support
+// static membership, so each imported group still rebalances when it joins; to keep consuming throughout a handover,
+// import the groups before closing them in the previous manager, which lets Kafka move the partitions from one
+// member to the other.
+// Groups that fail to import (or are already managed by this manager) are skipped and their errors are returned.
+func (m *kafkaConsumerGroupManagerImpl) Import(states []ManagedGroupState, logger *zap.SugaredLogger, resolver HandlerResolver) error {
+	var errs error
+	for _, state := range states {
+		if err := validateGroupId(state.GroupId); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not import consumer group - %w", err))
+			continue
+		}
+		if m.IsManaged(state.GroupId) { // Checked again when the group is added, in case it is started meanwhile
+			errs = multierr.Append(errs, fmt.Errorf("could not import consumer group with id '%s' - group is already present in the managed map", state.GroupId))
+			continue
+		}
+		handler, options, err := resolver(state.GroupId)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not resolve handler for consumer group with id '%s': %w", state.GroupId, err))
+			continue
+		}
+		if state.Cluster != DefaultCluster {
+			options = append([]SaramaConsumerHandlerOption{WithCluster(state.Cluster)}, options...)
+		}
+		if err = m.newManagedConsumerGroup(state.GroupId, state.Topics, logger, handler, state.Stopped, true, options...); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
 // IsStopped returns true if the given groupId corresponds to a stopped ConsumerGroup
 func (m *kafkaConsumerGroupManagerImpl) IsStopped(groupId string) bool {
 	group := m.getGroup(groupId)
@@ -301,10 +1362,35 @@ func (m *kafkaConsumerGroupManagerImpl) IsStopped(groupId string) bool {
 	return group.isStopped()
 }
 
+// IsDead returns true if the given groupId corresponds to a managed ConsumerGroup whose consume loop gave up after
+// the number of consecutive failed sessions allowed by WithMaxRestartAttempts
+func (m *kafkaConsumerGroupManagerImpl) IsDead(groupId string) bool {
+	group := m.getGroup(groupId)
+	if group == nil {
+		return false
+	}
+	return group.isDead()
+}
+
+// ActiveConsumers returns the number of consume goroutines of the groups started by the manager that are currently
+// running.  The goroutine of a group keeps running while the group is stopped (waiting for it to be started again),
+// so this is normally the number of managed groups, and a higher count after the groups have been closed indicates
+// a leak.  The consume loops of the groups added via AddExistingGroup belong to the caller and are not counted.
+func (m *kafkaConsumerGroupManagerImpl) ActiveConsumers() int {
+	if m.activeConsumers == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(m.activeConsumers))
+}
+
 // Consume calls the Consume method of a managed consumer group, using a loop to call it again if that
 // group is restarted by the manager.  If the Consume call is terminated by some other mechanism, the
-// result will be returned to the caller.
-func (m *kafkaConsumerGroupManagerImpl) consume(ctx context.Context, groupId string, topics []string, handler sarama.ConsumerGroupHandler) error {
+// result will be returned to the caller.  The consume loop of a group added via AddExistingGroup must call
+// this (in place of the Consume method of the group itself), as the one created by StartConsumerGroup does.
+func (m *kafkaConsumerGroupManagerImpl) Consume(ctx context.Context, groupId string, topics []string, handler sarama.ConsumerGroupHandler) error {
+	if err := validateGroupId(groupId); err != nil {
+		return fmt.Errorf("consume called with an invalid groupId - %w", err)
+	}
 	managedGrp := m.getGroup(groupId)
 	if managedGrp == nil {
 		return fmt.Errorf("consume called on nonexistent groupId '%s'", groupId)
@@ -317,15 +1403,17 @@ func (m *kafkaConsumerGroupManagerImpl) consume(ctx context.Context, groupId str
 func (m *kafkaConsumerGroupManagerImpl) stopConsumerGroup(lock *commands.CommandLock, groupId string) error {
 	groupLogger := m.logger.With(zap.String("GroupId", groupId))
 
+	// Look up the group once; the state change itself is synchronized by the managedGroup, not the groupLock
+	managedGrp := m.getGroup(groupId)
+
 	// Lock the managedGroup before stopping it, if lock.LockBefore is true
-	if err := m.lockBefore(lock, groupId); err != nil {
+	if err := m.lockBefore(lock, groupId, managedGrp); err != nil {
 		groupLogger.Error("Failed to lock consumer group prior to stopping", zap.Error(err))
 		return err
 	}
 
 	groupLogger.Info("Stopping Managed ConsumerGroup")
 
-	managedGrp := m.getGroup(groupId)
 	if managedGrp == nil {
 		groupLogger.Info("ConsumerGroup Not Managed - Ignoring Stop Request")
 		return fmt.Errorf("stop requested for consumer group not in managed list: %s", groupId)
@@ -335,9 +1423,12 @@ func (m *kafkaConsumerGroupManagerImpl) stopConsumerGroup(lock *commands.Command
 		groupLogger.Error("Failed to stop managed consumer group", zap.Error(err))
 		return err
 	}
+	if lock == nil || lock.Token != internalToken {
+		m.setSuspended(groupId, false) // A group stopped explicitly is not restarted by SetActive
+	}
 
 	// Unlock the managedGroup after stopping it, if lock.UnlockAfter is true
-	if err := m.unlockAfter(lock, groupId); err != nil {
+	if err := m.unlockAfter(lock, groupId, managedGrp); err != nil {
 		groupLogger.Error("Failed to unlock consumer group after stopping", zap.Error(err))
 		return err
 	}
@@ -349,21 +1440,45 @@ func (m *kafkaConsumerGroupManagerImpl) stopConsumerGroup(lock *commands.Command
 func (m *kafkaConsumerGroupManagerImpl) startConsumerGroup(lock *commands.CommandLock, groupId string) error {
 	groupLogger := m.logger.With(zap.String("GroupId", groupId))
 
+	// Look up the group once; the state change itself is synchronized by the managedGroup, not the groupLock
+	managedGrp := m.getGroup(groupId)
+
 	// Lock the managedGroup before starting it, if lock.LockBefore is true
-	if err := m.lockBefore(lock, groupId); err != nil {
+	if err := m.lockBefore(lock, groupId, managedGrp); err != nil {
 		groupLogger.Error("Failed to lock consumer group prior to starting", zap.Error(err))
 		return err
 	}
 
 	groupLogger.Info("Starting Managed ConsumerGroup")
-	managedGrp := m.getGroup(groupId)
 	if managedGrp == nil {
 		groupLogger.Info("ConsumerGroup Not Managed - Ignoring Start Request")
 		return fmt.Errorf("start requested for consumer group not in managed list: %s", groupId)
 	}
+	if managedGrp.isDead() {
+		groupLogger.Warn("ConsumerGroup Is Dead - Ignoring Start Request")
+		return fmt.Errorf("could not start consumer group with id '%s' - the group is dead and must be re-created", groupId)
+	}
+	if m.startRefusedWhileInactive(lock) {
+		groupLogger.Info("Consumer Group Manager Inactive - Ignoring Start Request")
+		return fmt.Errorf("could not start consumer group with id '%s' - the manager is inactive", groupId)
+	}
 
-	createGroup := func() (sarama.ConsumerGroup, error) {
-		return m.factory.createConsumerGroup(groupId)
+	createGroup := managedGrp.createGroupFn()
+	if createGroup == nil {
+		// The factory may have been replaced by Reconfigure since the group was created.  Its version check may ask
+		// the brokers, so it is done before the managed group is locked for the start.
+		factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+		if err != nil {
+			groupLogger.Error("Failed To Restart Managed ConsumerGroup", zap.Error(err))
+			return err
+		}
+		if err = factory.checkVersion(groupLogger.Sugar()); err != nil {
+			groupLogger.Error("Failed To Check Kafka Version Before Restarting Managed ConsumerGroup", zap.Error(err))
+			return err
+		}
+		createGroup = func() (sarama.ConsumerGroup, error) {
+			return factory.createConsumerGroup(groupId, managedGrp.handlerOptions()...)
+		}
 	}
 
 	// Instruct the managed group to use this new ConsumerGroup
@@ -374,14 +1489,99 @@ func (m *kafkaConsumerGroupManagerImpl) startConsumerGroup(lock *commands.Comman
 	}
 
 	// Unlock the managedGroup after starting it, if lock.UnlockAfter is true
-	if err = m.unlockAfter(lock, groupId); err != nil {
+	if err = m.unlockAfter(lock, groupId, managedGrp); err != nil {
 		groupLogger.Error("Failed to unlock consumer group after starting", zap.Error(err))
 		return err
 	}
 	m.notify(ManagerEvent{Event: GroupStarted, GroupId: groupId})
+	go m.rebalanceMemoryBudget() // The share of the other groups may have been given to this one while it was stopped
 	return nil
 }
 
+// withManagerOptions returns a copy of the given options with the addition of those that the manager
+// requires in the SaramaConsumerHandler of a managed group
+func (m *kafkaConsumerGroupManagerImpl) withManagerOptions(groupId string, options []SaramaConsumerHandlerOption) []SaramaConsumerHandlerOption {
+	notify := func(event EventIndex) {
+		if event == GroupJoined {
+			if managedGrp := m.getGroup(groupId); managedGrp != nil {
+				managedGrp.markJoined()
+			}
+		}
+		m.notify(ManagerEvent{Event: event, GroupId: groupId})
+		if event == GroupReplayFinished {
+			// Sent by the consume goroutine after its last session has ended, so the group can be closed from it
+			if err := m.CloseConsumerGroup(groupId); err != nil {
+				m.logger.Warn("Failed To Close Managed ConsumerGroup After Replay Finished", zap.String("GroupId", groupId), zap.Error(err))
+			}
+		}
+	}
+	consuming := func() {
+		if managedGrp := m.getGroup(groupId); managedGrp != nil {
+			managedGrp.markConsuming()
+		}
+	}
+	options = append(append([]SaramaConsumerHandlerOption{}, options...), withEventNotifier(notify), withConsumingNotifier(consuming))
+	if memoryShare := m.withMemoryShare(groupId); memoryShare != nil {
+		options = append(options, memoryShare)
+	}
+	return options
+}
+
+// lockExpiredNotifier returns the function that sends a GroupLockExpired event when the lock of the given group
+// is released by its timeout
+func (m *kafkaConsumerGroupManagerImpl) lockExpiredNotifier(groupId string) func() {
+	return func() {
+		m.notify(ManagerEvent{Event: GroupLockExpired, GroupId: groupId})
+	}
+}
+
+// newFactory creates a consumer group factory for the named cluster with the manager's factory options, warning
+// if its sarama config does not return the ConsumerGroup errors
+func (m *kafkaConsumerGroupManagerImpl) newFactory(cluster string, brokers []string, config *sarama.Config) *kafkaConsumerGroupFactoryImpl {
+	options := append(append([]FactoryOption{}, m.factoryOptions...), withActiveConsumerCounter(m.activeConsumers))
+	factory := newConsumerGroupFactory(brokers, config, options...)
+	factory.warnReturnErrors(m.logger.With(zap.String("Cluster", cluster)))
+	return factory
+}
+
+// getFactory returns the current consumer group factory using the factoryLock mutex
+func (m *kafkaConsumerGroupManagerImpl) getFactory() *kafkaConsumerGroupFactoryImpl {
+	m.factoryLock.RLock()
+	defer m.factoryLock.RUnlock()
+	return m.factory
+}
+
+// setFactory replaces the consumer group factory using the factoryLock mutex
+func (m *kafkaConsumerGroupManagerImpl) setFactory(factory *kafkaConsumerGroupFactoryImpl) {
+	m.factoryLock.Lock()
+	previous := m.factory
+	m.factory = factory
+	m.factoryLock.Unlock()
+	m.retireFactory(DefaultCluster, previous, factory)
+}
+
+// retireFactory closes the shared client of a factory that has been replaced (see WithSharedClient) once the groups
+// that use it have been closed, logging any failure to close it
+func (m *kafkaConsumerGroupManagerImpl) retireFactory(cluster string, previous *kafkaConsumerGroupFactoryImpl, replacement *kafkaConsumerGroupFactoryImpl) {
+	if previous == nil || previous == replacement {
+		return
+	}
+	if err := previous.retireSharedClient(); err != nil {
+		m.logger.Warn("Failed To Close Shared Client Of Replaced Consumer Group Factory", zap.String("Cluster", cluster), zap.Error(err))
+	}
+}
+
+// getGroupIds returns a snapshot of the groupIds in the groups map using the groupLock mutex
+func (m *kafkaConsumerGroupManagerImpl) getGroupIds() []string {
+	m.groupLock.RLock()
+	defer m.groupLock.RUnlock()
+	groupIds := make([]string, 0, len(m.groups))
+	for groupId := range m.groups {
+		groupIds = append(groupIds, groupId)
+	}
+	return groupIds
+}
+
 // getGroup returns a group from the groups map using the groupLock mutex
 func (m *kafkaConsumerGroupManagerImpl) getGroup(groupId string) managedGroup {
 	m.groupLock.RLock()
@@ -396,6 +1596,18 @@ func (m *kafkaConsumerGroupManagerImpl) setGroup(groupId string, group managedGr
 	m.groups[groupId] = group
 }
 
+// setGroupIfAbsent associates a group with a groupId in the groups map, as setGroup does, unless the groupId is
+// already present.  It returns false (leaving the map unchanged) in that case.
+func (m *kafkaConsumerGroupManagerImpl) setGroupIfAbsent(groupId string, group managedGroup) bool {
+	m.groupLock.Lock()
+	defer m.groupLock.Unlock()
+	if _, ok := m.groups[groupId]; ok {
+		return false
+	}
+	m.groups[groupId] = group
+	return true
+}
+
 // getGroup removes a group from the groups map by groupId, using the groupLock mutex
 func (m *kafkaConsumerGroupManagerImpl) removeGroup(groupId string) {
 	m.groupLock.Lock()
@@ -403,9 +1615,8 @@ func (m *kafkaConsumerGroupManagerImpl) removeGroup(groupId string) {
 	delete(m.groups, groupId)
 }
 
-// lockBefore will lock the managedGroup corresponding to the groupId, if lock.LockBefore is true
-func (m *kafkaConsumerGroupManagerImpl) lockBefore(lock *commands.CommandLock, groupId string) error {
-	group := m.getGroup(groupId)
+// lockBefore will lock the provided managedGroup, if lock.LockBefore is true
+func (m *kafkaConsumerGroupManagerImpl) lockBefore(lock *commands.CommandLock, groupId string, group managedGroup) error {
 	if group == nil {
 		m.logger.Warn("Attempted to lock a nonexistent group ID", zap.String("GroupId", groupId))
 		return nil // Can't lock a nonexistent group
@@ -413,9 +1624,8 @@ func (m *kafkaConsumerGroupManagerImpl) lockBefore(lock *commands.CommandLock, g
 	return group.processLock(lock, true)
 }
 
-// unlockAfter will unlock the managedGroup corresponding to the groupId, if lock.UnlockAfter is true
-func (m *kafkaConsumerGroupManagerImpl) unlockAfter(lock *commands.CommandLock, groupId string) error {
-	group := m.getGroup(groupId)
+// unlockAfter will unlock the provided managedGroup, if lock.UnlockAfter is true
+func (m *kafkaConsumerGroupManagerImpl) unlockAfter(lock *commands.CommandLock, groupId string, group managedGroup) error {
 	if group == nil {
 		m.logger.Warn("Attempted to unlock a nonexistent group ID", zap.String("GroupId", groupId))
 		return nil // Can't unlock a nonexistent group
@@ -435,6 +1645,10 @@ func processAsyncGroupNotification(commandMessage ctrlservice.AsyncCommandMessag
 		commandMessage.NotifyFailed(fmt.Errorf("version mismatch; expected %d but got %d", commands.ConsumerGroupAsyncCommandVersion, cmd.Version))
 		return
 	}
+	if err := validateGroupId(cmd.GroupId); err != nil {
+		commandMessage.NotifyFailed(err)
+		return
+	}
 	err := groupFunction(cmd.Lock, cmd.GroupId)
 	if err != nil {
 		commandMessage.NotifyFailed(err)
@@ -442,3 +1656,24 @@ func processAsyncGroupNotification(commandMessage ctrlservice.AsyncCommandMessag
 	}
 	commandMessage.NotifySuccess()
 }
+
+// validateGroupId returns an error wrapping ErrInvalidGroupId if the groupId could never identify a usable group:
+// an empty or whitespace-only groupId, one with leading or trailing whitespace (which is not trimmed, since the
+// control-protocol commands must name the group exactly), or one containing control or other non-printable
+// characters.  Kafka itself places no further restriction on the characters of a group.id.
+func validateGroupId(groupId string) error {
+	switch {
+	case groupId == "":
+		return fmt.Errorf("%w %q - the id is empty", ErrInvalidGroupId, groupId)
+	case strings.TrimSpace(groupId) == "":
+		return fmt.Errorf("%w %q - the id contains only whitespace", ErrInvalidGroupId, groupId)
+	case strings.TrimSpace(groupId) != groupId:
+		return fmt.Errorf("%w %q - the id has leading or trailing whitespace", ErrInvalidGroupId, groupId)
+	}
+	for _, r := range groupId {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return fmt.Errorf("%w %q - the id contains an illegal character %q", ErrInvalidGroupId, groupId, r)
+		}
+	}
+	return nil
+}
@@ -18,21 +18,29 @@ package consumer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	ctrl "knative.dev/control-protocol/pkg"
 	ctrlservice "knative.dev/control-protocol/pkg/service"
 	logtesting "knative.dev/pkg/logging/testing"
 
+	"knative.dev/eventing-kafka/pkg/common/client"
 	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
 	controltesting "knative.dev/eventing-kafka/pkg/common/controlprotocol/testing"
+	kafkasarama "knative.dev/eventing-kafka/pkg/common/kafka/sarama"
 	kafkatesting "knative.dev/eventing-kafka/pkg/common/kafka/testing"
 )
 
@@ -42,6 +50,7 @@ func TestNewConsumerGroupManager(t *testing.T) {
 	assert.NotNil(t, manager)
 	assert.NotNil(t, server.Router[commands.StopConsumerGroupOpCode])
 	assert.NotNil(t, server.Router[commands.StartConsumerGroupOpCode])
+	assert.NotNil(t, server.Router[commands.ResetOffsetsOpCode])
 	server.AssertExpectations(t)
 }
 
@@ -92,6 +101,372 @@ func TestReconfigure(t *testing.T) {
 	}
 }
 
+func TestReconfigureAuth(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name           string
+		auth           *client.KafkaAuthConfig
+		expectErr      bool
+		expectChange   bool
+		expectPassword string
+	}{
+		{
+			name:      "Nil Auth Config",
+			expectErr: true,
+		},
+		{
+			name:           "Same SASL Settings",
+			auth:           &client.KafkaAuthConfig{SASL: &client.KafkaSaslConfig{User: "user", Password: "password", SaslType: sarama.SASLTypePlaintext}},
+			expectPassword: "password",
+		},
+		{
+			name:           "Rotated Password",
+			auth:           &client.KafkaAuthConfig{SASL: &client.KafkaSaslConfig{User: "user", Password: "new-password", SaslType: sarama.SASLTypePlaintext}},
+			expectChange:   true,
+			expectPassword: "new-password",
+		},
+		{
+			name:           "TLS Settings Only",
+			auth:           &client.KafkaAuthConfig{TLS: &client.KafkaTlsConfig{}},
+			expectChange:   true,
+			expectPassword: "password",
+		},
+		{
+			name:      "Invalid Auth Config",
+			auth:      &client.KafkaAuthConfig{SASL: &client.KafkaSaslConfig{SaslType: sarama.SASLTypeOAuth}},
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, group, _, _ := getManagerWithMockGroup(t, "test-id1", false)
+			group.On("Close").Return(nil).Maybe()
+			impl := manager.(*kafkaConsumerGroupManagerImpl)
+			core, logs := observer.New(zap.InfoLevel)
+			impl.logger = zap.New(core)
+			originalConfig := sarama.NewConfig()
+			originalConfig.ClientID = "test-client-id"
+			originalConfig.Net.SASL.User = "user"
+			originalConfig.Net.SASL.Password = "password"
+			originalConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+			impl.setFactory(&kafkaConsumerGroupFactoryImpl{addrs: []string{"broker"}, config: originalConfig})
+
+			err := manager.ReconfigureAuth(testCase.auth)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			factory := impl.getFactory()
+			assert.Equal(t, testCase.expectChange, factory.config != originalConfig)
+			assert.Equal(t, []string{"broker"}, factory.addrs)
+			if !testCase.expectErr {
+				assert.Equal(t, testCase.expectPassword, factory.config.Net.SASL.Password)
+				assert.Equal(t, "test-client-id", factory.config.ClientID)
+			}
+			assert.Equal(t, "password", originalConfig.Net.SASL.Password) // The original config must not be modified
+			for _, entry := range logs.All() {
+				assert.False(t, strings.Contains(entry.Message, "password"), entry.Message) // Neither password is logged
+			}
+		})
+	}
+}
+
+func TestReconfigureAuthConcurrent(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	manager, group, _, _ := getManagerWithMockGroup(t, "test-id1", false)
+	group.On("Close").Return(nil).Maybe()
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		mockGroup := kafkatesting.NewMockConsumerGroup()
+		mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+		mockGroup.On("Close").Return(nil)
+		return mockGroup, nil
+	}
+	originalConfig := sarama.NewConfig()
+	originalConfig.Net.SASL.User = "user"
+	originalConfig.Net.SASL.Password = "password"
+	originalConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	impl.setFactory(&kafkaConsumerGroupFactoryImpl{addrs: []string{"old-broker"}, config: originalConfig})
+
+	// Run a Reconfigure with new brokers while ReconfigureAuth is building its config (which logs the result)
+	reconfigured := make(chan error, 1)
+	core, _ := observer.New(zap.InfoLevel)
+	impl.logger = zap.New(core, zap.Hooks(func(entry zapcore.Entry) error {
+		if strings.HasPrefix(entry.Message, "Built Sarama config") {
+			go func() { reconfigured <- manager.Reconfigure([]string{"new-broker"}, sarama.NewConfig()) }()
+			select {
+			case err := <-reconfigured:
+				reconfigured <- err
+			case <-time.After(100 * time.Millisecond): // Blocked until ReconfigureAuth has finished
+			}
+		}
+		return nil
+	}))
+
+	auth := &client.KafkaAuthConfig{SASL: &client.KafkaSaslConfig{User: "user", Password: "new-password", SaslType: sarama.SASLTypePlaintext}}
+	assert.Nil(t, manager.ReconfigureAuth(auth))
+	assert.Nil(t, <-reconfigured)
+	assert.Equal(t, []string{"new-broker"}, impl.getFactory().addrs) // Not reverted by ReconfigureAuth
+}
+
+func TestReconfigureConcurrent(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	const groupCount = 3
+	const reconfigureCount = 10
+
+	// Keep track of the config used for the most recent sarama ConsumerGroup created for each group ID
+	createdWith := make(map[string]*sarama.Config)
+	createdLock := sync.Mutex{}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		mockGroup := kafkatesting.NewMockConsumerGroup()
+		mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+		mockGroup.On("Close").Return(nil)
+		createdLock.Lock()
+		createdWith[groupID] = config
+		createdLock.Unlock()
+		return mockGroup, nil
+	}
+
+	// Lock timer goroutines may log after the test completes, so the test logger cannot be used here
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	for i := 0; i < groupCount; i++ {
+		groupId := fmt.Sprintf("test-group-%d", i)
+		// Use a handler-free managed group so that no consume loop competes with the stop/start cycle
+		group, err := impl.getFactory().createConsumerGroup(groupId)
+		assert.Nil(t, err)
+		impl.setGroup(groupId, createManagedGroup(context.Background(), impl.logger, group, func() {}, func() {}, nil))
+	}
+
+	waitGroup := sync.WaitGroup{}
+	waitGroup.Add(reconfigureCount)
+	for i := 0; i < reconfigureCount; i++ {
+		go func(index int) {
+			config := sarama.NewConfig()
+			config.ClientID = fmt.Sprintf("client-%d", index)
+			assert.Nil(t, manager.Reconfigure([]string{"new-broker"}, config))
+			waitGroup.Done()
+		}(i)
+	}
+	waitGroup.Wait()
+
+	lastConfig := impl.getFactory().config
+	for _, groupId := range impl.getGroupIds() {
+		assert.False(t, manager.IsStopped(groupId))
+		createdLock.Lock()
+		assert.Equal(t, lastConfig, createdWith[groupId])
+		createdLock.Unlock()
+	}
+}
+
+func TestRollingReconfigure(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name               string
+		concurrency        int
+		dependency         bool // Whether group-c depends on group-a
+		noJoinGroup        string
+		expectErr          bool
+		expectRestarted    []string
+		expectNotRestarted []string
+	}{
+		{
+			name:            "All Groups Restarted",
+			expectRestarted: []string{"group-a", "group-b", "group-c"},
+		},
+		{
+			name:               "Group Fails To Rejoin",
+			noJoinGroup:        "group-b",
+			expectErr:          true,
+			expectRestarted:    []string{"group-a"},
+			expectNotRestarted: []string{"group-c"},
+		},
+		{
+			name:            "All Groups Restarted Concurrently",
+			concurrency:     3,
+			expectRestarted: []string{"group-a", "group-b", "group-c"},
+		},
+		{
+			name:            "Two Groups Restarted Concurrently",
+			concurrency:     2,
+			expectRestarted: []string{"group-a", "group-b", "group-c"},
+		},
+		{
+			name:            "Dependent Group Waits For Its Dependency",
+			concurrency:     3,
+			dependency:      true,
+			expectRestarted: []string{"group-a", "group-b", "group-c"},
+		},
+		{
+			name:               "Group Fails To Rejoin While Others Restart",
+			concurrency:        2,
+			noJoinGroup:        "group-b",
+			expectErr:          true,
+			expectRestarted:    []string{"group-a", "group-c"},
+			expectNotRestarted: []string{},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			concurrency := testCase.concurrency
+			if concurrency == 0 {
+				concurrency = 1
+			}
+			var lock sync.Mutex
+			configs := make(map[string]*sarama.Config)
+			reconfigured := false
+			restarting := 0
+			maxRestarting := 0
+			joined := make(map[string]bool)    // The restarted groups that have rejoined
+			restartedBeforeDependency := false // Whether group-c was restarted before group-a had rejoined
+			newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+				lock.Lock()
+				configs[groupID] = config
+				join := !reconfigured || groupID != testCase.noJoinGroup
+				restart := reconfigured
+				if restart {
+					restarting++
+					if restarting > maxRestarting {
+						maxRestarting = restarting
+					}
+					if groupID == "group-c" && testCase.dependency {
+						restartedBeforeDependency = !joined["group-a"]
+					}
+				}
+				lock.Unlock()
+				var joinOnce sync.Once
+				mockGroup := kafkatesting.NewMockConsumerGroup()
+				mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+				mockGroup.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).
+					Run(func(args mock.Arguments) {
+						if restart && join {
+							// The group stops counting as restarting before the rolling reconfigure can observe the join
+							joinOnce.Do(func() {
+								lock.Lock()
+								restarting--
+								joined[groupID] = true
+								lock.Unlock()
+							})
+						}
+						if join {
+							_ = args.Get(2).(sarama.ConsumerGroupHandler).Setup(&mockConsumerGroupSession{})
+						}
+					})
+				mockGroup.On("Close").Return(nil)
+				return mockGroup, nil
+			}
+
+			manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+			groupIds := []string{"group-c", "group-a", "group-b"}
+			for _, groupId := range groupIds {
+				assert.Nil(t, manager.StartConsumerGroupSync(context.Background(), groupId, []string{}, zap.NewNop().Sugar(), mockMessageHandler{}))
+			}
+			if testCase.dependency {
+				assert.Nil(t, manager.AddStartDependency("group-c", "group-a"))
+			}
+
+			newConfig := sarama.NewConfig()
+			lock.Lock()
+			reconfigured = true
+			lock.Unlock()
+			err := manager.RollingReconfigure([]string{"new-broker"}, newConfig,
+				RollingReconfigureOptions{GroupTimeout: shortTimeout, Concurrency: testCase.concurrency})
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if testCase.expectErr {
+				var rollingErr *RollingReconfigureError
+				assert.True(t, errors.As(err, &rollingErr))
+				assert.Equal(t, testCase.expectRestarted, rollingErr.Restarted)
+				assert.Equal(t, testCase.noJoinGroup, rollingErr.FailedGroup)
+				assert.Empty(t, rollingErr.OtherFailed)
+				assert.Equal(t, testCase.expectNotRestarted, rollingErr.NotRestarted)
+			}
+
+			lock.Lock()
+			assert.GreaterOrEqual(t, maxRestarting, 1)
+			assert.LessOrEqual(t, maxRestarting, concurrency)
+			assert.False(t, restartedBeforeDependency)
+			for _, groupId := range testCase.expectRestarted {
+				assert.Same(t, newConfig, configs[groupId])
+			}
+			for _, groupId := range testCase.expectNotRestarted {
+				assert.NotSame(t, newConfig, configs[groupId])
+			}
+			lock.Unlock()
+
+			for _, groupId := range groupIds {
+				assert.Nil(t, manager.CloseConsumerGroupAndWait(groupId, time.Second))
+			}
+		})
+	}
+}
+
+func TestRollingReconfigureSkippedGroups(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	var lock sync.Mutex
+	configs := make(map[string]*sarama.Config)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		lock.Lock()
+		configs[groupID] = config
+		lock.Unlock()
+		mockGroup := kafkatesting.NewMockConsumerGroup()
+		mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+		mockGroup.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).
+			Run(func(args mock.Arguments) {
+				handler := args.Get(2).(sarama.ConsumerGroupHandler)
+				session := &claimsSession{committingSession: committingSession{ctx: context.Background()}, claims: map[string][]int32{"topic": {0}}}
+				_ = handler.Setup(session)
+				if groupID != "group-d" {
+					_ = handler.ConsumeClaim(session, topicClaim{mockConsumerGroupClaim: mockConsumerGroupClaim{}, topic: "topic"})
+				}
+			})
+		mockGroup.On("Close").Return(nil)
+		return mockGroup, nil
+	}
+
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	groupIds := []string{"group-a", "group-b", "group-c", "group-d"}
+	for _, groupId := range groupIds {
+		assert.Nil(t, manager.StartConsumerGroupSync(context.Background(), groupId, []string{}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	}
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-b"))
+	impl.getGroup("group-c").(*managedGroupImpl).lockedBy.Store("other-token")
+
+	// The stopped group is left alone, and the locked one is skipped without stopping the roll
+	newConfig := sarama.NewConfig()
+	err := manager.RollingReconfigure([]string{"new-broker"}, newConfig, RollingReconfigureOptions{GroupTimeout: shortTimeout})
+	var rollingErr *RollingReconfigureError
+	assert.True(t, errors.As(err, &rollingErr))
+	assert.Equal(t, []string{"group-a"}, rollingErr.Restarted)
+	assert.Equal(t, []string{"group-c"}, rollingErr.Locked)
+	assert.True(t, manager.IsStopped("group-b"))
+	lock.Lock()
+	assert.Same(t, newConfig, configs["group-a"])
+	assert.NotSame(t, newConfig, configs["group-b"])
+	assert.NotSame(t, newConfig, configs["group-c"])
+	lock.Unlock()
+
+	// A group that joins, but does not begin consuming its claims, fails the roll
+	assert.Equal(t, "group-d", rollingErr.FailedGroup)
+	assert.Contains(t, rollingErr.Err.Error(), "consuming")
+
+	// With only locked groups skipped, there is no failed group
+	impl.getGroup("group-c").(*managedGroupImpl).lockedBy.Store("")
+	impl.getGroup("group-a").(*managedGroupImpl).lockedBy.Store("other-token")
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-d", time.Second))
+	err = manager.RollingReconfigure([]string{"new-broker"}, newConfig, RollingReconfigureOptions{GroupTimeout: shortTimeout})
+	assert.True(t, errors.As(err, &rollingErr))
+	assert.Equal(t, "", rollingErr.FailedGroup)
+	assert.Equal(t, []string{"group-c"}, rollingErr.Restarted)
+	assert.Equal(t, []string{"group-a"}, rollingErr.Locked)
+	assert.Contains(t, err.Error(), "skipped 1 locked groups")
+
+	impl.getGroup("group-a").(*managedGroupImpl).lockedBy.Store("")
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-b")) // The mock group of a stopped group must not be closed again
+	for _, groupId := range groupIds[:3] {
+		assert.Nil(t, manager.CloseConsumerGroupAndWait(groupId, time.Second))
+	}
+}
+
 func TestStartConsumerGroup(t *testing.T) {
 	defer restoreNewConsumerGroup(newConsumerGroup)
 
@@ -115,16 +490,612 @@ func TestStartConsumerGroup(t *testing.T) {
 					return mockGroup, fmt.Errorf("factory error")
 				}
 				mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+				mockGroup.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(sarama.ErrClosedConsumerGroup).Maybe()
+				mockGroup.On("Close").Return(nil)
 				return mockGroup, nil
 			}
-			err := manager.StartConsumerGroup("testid", []string{}, nil, nil)
+			err := manager.StartConsumerGroup("testid", []string{}, zap.NewNop().Sugar(), nil)
 			assert.Equal(t, testCase.factoryErr, err != nil)
 			time.Sleep(5 * time.Millisecond) // Give the transferErrors routine a chance to call Errors()
+			if !testCase.factoryErr {
+				// Make sure the consume goroutine is finished before the test ends
+				assert.Nil(t, manager.CloseConsumerGroupAndWait("testid", time.Second))
+			}
 			mockGroup.AssertExpectations(t)
 		})
 	}
 }
 
+func TestStartConsumerGroupSync(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+
+	for _, testCase := range []struct {
+		name       string
+		factoryErr bool
+		consumeErr bool
+		noJoin     bool
+		expectErr  string
+	}{
+		{
+			name: "Successful Join",
+		},
+		{
+			name:       "Factory error",
+			factoryErr: true,
+			expectErr:  "factory error",
+		},
+		{
+			name:       "Consume Error",
+			consumeErr: true,
+			expectErr:  "consume error",
+		},
+		{
+			name:      "Context Timeout",
+			noJoin:    true,
+			expectErr: context.DeadlineExceeded.Error(),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+			newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+				if testCase.factoryErr {
+					return nil, fmt.Errorf("factory error")
+				}
+				if testCase.consumeErr || testCase.noJoin {
+					return &mockConsumerGroup{consumeMustReturnError: testCase.consumeErr}, nil
+				}
+				mockGroup := kafkatesting.NewMockConsumerGroup()
+				mockGroup.On("Errors").Return(mockGroup.ErrorChan)
+				mockGroup.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(sarama.ErrClosedConsumerGroup).
+					Run(func(args mock.Arguments) {
+						_ = args.Get(2).(sarama.ConsumerGroupHandler).Setup(&mockConsumerGroupSession{})
+					})
+				mockGroup.On("Close").Return(nil)
+				return mockGroup, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+			defer cancel()
+			err := manager.StartConsumerGroupSync(ctx, "testid", []string{}, zap.NewNop().Sugar(), mockMessageHandler{})
+			if testCase.expectErr != "" {
+				assert.NotNil(t, err)
+				assert.Equal(t, testCase.expectErr, err.Error())
+				assert.False(t, manager.IsManaged("testid"))
+			} else {
+				assert.Nil(t, err)
+				assert.True(t, manager.IsManaged("testid"))
+				assert.Nil(t, manager.CloseConsumerGroupAndWait("testid", time.Second))
+			}
+		})
+	}
+}
+
+func TestTopics(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+
+	_, err := manager.Topics("test-group-id")
+	assert.NotNil(t, err)
+
+	topics := []string{"topic-1", "topic-2"}
+	assert.Nil(t, manager.StartConsumerGroup("test-group-id", topics, zap.NewNop().Sugar(), mockMessageHandler{}))
+	topics[0] = "modified"
+	actual, err := manager.Topics("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic-1", "topic-2"}, actual)
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("test-group-id", time.Second))
+}
+
+// offsetsClusterAdmin is a sarama.ClusterAdmin that only supports listing consumer group offsets
+type offsetsClusterAdmin struct {
+	sarama.ClusterAdmin
+	response *sarama.OffsetFetchResponse
+	err      error
+	closed   bool
+	groupId  string // The group.id of the last request
+}
+
+func (a *offsetsClusterAdmin) ListConsumerGroupOffsets(groupId string, _ map[string][]int32) (*sarama.OffsetFetchResponse, error) {
+	a.groupId = groupId
+	return a.response, a.err
+}
+
+func (a *offsetsClusterAdmin) Close() error {
+	a.closed = true
+	return nil
+}
+
+func TestCommittedOffsets(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+
+	for _, testCase := range []struct {
+		name      string
+		groupId   string
+		response  *sarama.OffsetFetchResponse
+		adminErr  error
+		listErr   error
+		expected  map[string]map[int32]int64
+		expectErr bool
+	}{
+		{
+			name:      "Nonexistent GroupID",
+			expectErr: true,
+		},
+		{
+			name:      "Cluster Admin Error",
+			groupId:   "test-group-id",
+			adminErr:  fmt.Errorf("admin error"),
+			expectErr: true,
+		},
+		{
+			name:      "List Offsets Error",
+			groupId:   "test-group-id",
+			listErr:   fmt.Errorf("list error"),
+			expectErr: true,
+		},
+		{
+			name:      "Response Error",
+			groupId:   "test-group-id",
+			response:  &sarama.OffsetFetchResponse{Err: sarama.ErrNotCoordinatorForConsumer},
+			expectErr: true,
+		},
+		{
+			name:    "Partition Error",
+			groupId: "test-group-id",
+			response: &sarama.OffsetFetchResponse{Blocks: map[string]map[int32]*sarama.OffsetFetchResponseBlock{
+				"topic-1": {0: {Offset: 5, Err: sarama.ErrUnknownTopicOrPartition}},
+			}},
+			expectErr: true,
+		},
+		{
+			name:    "Committed Offsets",
+			groupId: "test-group-id",
+			response: &sarama.OffsetFetchResponse{Blocks: map[string]map[int32]*sarama.OffsetFetchResponseBlock{
+				"topic-1": {0: {Offset: 5}, 1: {Offset: -1}},
+				"topic-2": {0: {Offset: 12}},
+				"topic-3": {0: {Offset: -1}},
+			}},
+			expected: map[string]map[int32]int64{"topic-1": {0: 5}, "topic-2": {0: 12}},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, _, _, _ := getManagerWithMockGroup(t, testCase.groupId, false)
+			admin := &offsetsClusterAdmin{response: testCase.response, err: testCase.listErr}
+			newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) {
+				if testCase.adminErr != nil {
+					return nil, testCase.adminErr
+				}
+				return admin, nil
+			}
+
+			offsets, err := manager.CommittedOffsets(testCase.groupId)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			assert.Equal(t, testCase.expected, offsets)
+			if testCase.groupId != "" && testCase.adminErr == nil {
+				assert.True(t, admin.closed)
+			}
+		})
+	}
+}
+
+func TestGroupIdTransformer(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+
+	var createdIds []string
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		createdIds = append(createdIds, groupID)
+		return &mockConsumerGroup{}, nil
+	}
+	admin := &offsetsClusterAdmin{response: &sarama.OffsetFetchResponse{}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) {
+		return admin, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig(),
+		WithGroupIdTransformer(func(requested string) string { return "prod." + requested }))
+
+	_, err := manager.BrokerGroupId("test-group-id")
+	assert.NotNil(t, err)
+
+	// The group is created with the transformed id but managed under the requested one
+	assert.Nil(t, manager.StartConsumerGroup("test-group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Equal(t, []string{"prod.test-group-id"}, createdIds)
+	assert.True(t, manager.IsManaged("test-group-id"))
+	assert.False(t, manager.IsManaged("prod.test-group-id"))
+	brokerId, err := manager.BrokerGroupId("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "prod.test-group-id", brokerId)
+
+	// The committed offsets are those of the transformed id
+	_, err = manager.CommittedOffsets("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "prod.test-group-id", admin.groupId)
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("test-group-id", time.Second))
+	assert.False(t, manager.IsManaged("test-group-id"))
+
+	// Without the option the id is unchanged
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig()}
+	assert.Equal(t, "test-group-id", factory.brokerGroupId("test-group-id"))
+}
+
+func TestEnableSaramaLogging(t *testing.T) {
+	saramaLogger := sarama.Logger
+	defer func() {
+		kafkasarama.EnableSaramaLogging(false)
+		sarama.Logger = saramaLogger
+	}()
+
+	first := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	second := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	assert.True(t, first.EnableSaramaLogging())
+	assert.False(t, second.EnableSaramaLogging())
+}
+
+func TestExportImport(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	source, _, _, _ := getManagerWithMockGroup(t, "", false)
+	target, _, _, _ := getManagerWithMockGroup(t, "", false)
+	var lock sync.Mutex
+	created := map[string]int{}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		lock.Lock()
+		created[groupID]++
+		lock.Unlock()
+		return &mockConsumerGroup{}, nil
+	}
+	logger := zap.NewNop().Sugar()
+
+	assert.Nil(t, source.StartConsumerGroup("group-b", []string{"topic-2"}, logger, mockMessageHandler{}))
+	assert.Nil(t, source.StartConsumerGroup("group-a", []string{"topic-1"}, logger, mockMessageHandler{}))
+	assert.Nil(t, source.(*kafkaConsumerGroupManagerImpl).stopConsumerGroup(nil, "group-b"))
+
+	states := source.Export()
+	assert.Equal(t, []ManagedGroupState{
+		{GroupId: "group-a", Topics: []string{"topic-1"}},
+		{GroupId: "group-b", Topics: []string{"topic-2"}, Stopped: true},
+	}, states)
+
+	resolved := map[string]bool{}
+	resolver := func(groupId string) (KafkaConsumerHandler, []SaramaConsumerHandlerOption, error) {
+		if groupId == "group-c" {
+			return nil, nil, fmt.Errorf("unknown group")
+		}
+		resolved[groupId] = true
+		return mockMessageHandler{}, nil, nil
+	}
+
+	lock.Lock()
+	created = map[string]int{}
+	lock.Unlock()
+	err := target.Import(append(states, ManagedGroupState{GroupId: "group-c"}), logger, resolver)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "group-c")
+	assert.Equal(t, map[string]bool{"group-a": true, "group-b": true}, resolved)
+	assert.False(t, target.IsManaged("group-c"))
+	assert.False(t, target.IsStopped("group-a"))
+	assert.True(t, target.IsStopped("group-b"))
+	topics, err := target.Topics("group-a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic-1"}, topics)
+
+	// The stopped group was created without a ConsumerGroup, which is only created once it is started
+	lock.Lock()
+	assert.Equal(t, map[string]int{"group-a": 1}, created)
+	lock.Unlock()
+	assert.Nil(t, target.(*kafkaConsumerGroupManagerImpl).startConsumerGroup(nil, "group-b"))
+	assert.False(t, target.IsStopped("group-b"))
+	lock.Lock()
+	assert.Equal(t, map[string]int{"group-a": 1, "group-b": 1}, created)
+	lock.Unlock()
+
+	// Importing groups that are already managed fails without affecting them
+	err = target.Import(states[:1], logger, resolver)
+	assert.NotNil(t, err)
+	assert.True(t, target.IsManaged("group-a"))
+
+	// Exporting does not affect the source manager
+	assert.True(t, source.IsManaged("group-a"))
+	for _, manager := range []KafkaConsumerGroupManager{source, target} {
+		for _, groupId := range []string{"group-a", "group-b"} {
+			assert.Nil(t, manager.CloseConsumerGroupAndWait(groupId, time.Second))
+		}
+	}
+}
+
+// closeCountingGroup is a mockConsumerGroup that counts the calls to its Close function
+type closeCountingGroup struct {
+	mockConsumerGroup
+	closed int32
+}
+
+func (c *closeCountingGroup) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return c.mockConsumerGroup.Close()
+}
+
+func TestImportRacingStart(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	var lock sync.Mutex
+	var created []*closeCountingGroup
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		group := &closeCountingGroup{}
+		lock.Lock()
+		created = append(created, group)
+		lock.Unlock()
+		return group, nil
+	}
+	logger := zap.NewNop().Sugar()
+
+	// The group is started after Import has checked that it is not managed, but before Import adds it
+	resolver := func(groupId string) (KafkaConsumerHandler, []SaramaConsumerHandlerOption, error) {
+		assert.Nil(t, manager.StartConsumerGroup(groupId, []string{"topic-started"}, logger, mockMessageHandler{}))
+		return mockMessageHandler{}, nil, nil
+	}
+	err := manager.Import([]ManagedGroupState{{GroupId: "group-a", Topics: []string{"topic-imported"}}}, logger, resolver)
+	assert.NotNil(t, err)
+
+	// The started group is still managed, and the imported one was closed instead of being orphaned
+	topics, err := manager.Topics("group-a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic-started"}, topics)
+	lock.Lock()
+	assert.Len(t, created, 2)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&created[0].closed))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&created[1].closed))
+	lock.Unlock()
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-a", time.Second))
+}
+
+func TestDeadGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{consumeMustReturnError: true}, nil
+	}
+
+	assert.Nil(t, manager.StartConsumerGroup("group-dead", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}, WithMaxRestartAttempts(2)))
+	assert.Eventually(t, func() bool { return manager.IsDead("group-dead") }, time.Second, 5*time.Millisecond)
+	assert.True(t, manager.IsManaged("group-dead"))
+	assert.False(t, manager.IsDead("group-unknown"))
+
+	// A dead group cannot be restarted, but it can be closed
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-dead"))
+	assert.NotNil(t, impl.startConsumerGroup(nil, "group-dead"))
+	assert.Nil(t, manager.CloseConsumerGroup("group-dead"))
+}
+
+func TestActiveConsumers(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &claimingConsumerGroup{closed: make(chan struct{})}, nil
+	}
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	logger := zap.NewNop().Sugar()
+	assert.Equal(t, 0, manager.ActiveConsumers())
+
+	assert.Nil(t, manager.StartConsumerGroup("group-1", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Nil(t, manager.StartConsumerGroup("group-2", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Equal(t, 2, manager.ActiveConsumers())
+
+	// The goroutine of a group survives a stop/start cycle and a reconfigure
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-1"))
+	assert.Equal(t, 2, manager.ActiveConsumers())
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-1"))
+	assert.Nil(t, manager.Reconfigure([]string{}, &sarama.Config{}))
+	assert.Equal(t, 2, manager.ActiveConsumers())
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-1", time.Second))
+	assert.Equal(t, 1, manager.ActiveConsumers())
+
+	// The goroutine of a dead group exits
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{consumeMustReturnError: true}, nil
+	}
+	assert.Nil(t, manager.StartConsumerGroup("group-dead", []string{"topic"}, logger, mockMessageHandler{}, WithMaxRestartAttempts(1)))
+	assert.Eventually(t, func() bool { return manager.IsDead("group-dead") }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return manager.ActiveConsumers() == 1 }, time.Second, 5*time.Millisecond)
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-2", time.Second))
+	assert.Nil(t, manager.CloseConsumerGroup("group-dead"))
+	assert.Equal(t, 0, manager.ActiveConsumers())
+}
+
+func TestReconfigureWithReport(t *testing.T) {
+	// The error transfer of the groups outlives the test, so it must not log via the test logger
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	released := make(chan struct{})
+	close(released)
+	createGroup := func() (sarama.ConsumerGroup, error) { return &mockConsumerGroup{}, nil }
+	failCreateGroup := func() (sarama.ConsumerGroup, error) { return nil, fmt.Errorf("create error") }
+	closeErr := fmt.Errorf("close error")
+	assert.Nil(t, manager.AddExistingGroup("group-restarted", &mockConsumerGroup{}, nil, createGroup, nil))
+	assert.Nil(t, manager.AddExistingGroup("group-stop-failed", &closeControlledGroup{release: released, err: closeErr}, nil, createGroup, nil))
+	assert.Nil(t, manager.AddExistingGroup("group-restart-failed", &mockConsumerGroup{}, nil, failCreateGroup, nil))
+
+	report, err := manager.ReconfigureWithReport([]string{"new-broker"}, &sarama.Config{})
+	assert.NotNil(t, err)
+	assert.Equal(t, report.Err().Error(), err.Error())
+	assert.Len(t, report.Groups, 3)
+	assert.Equal(t, GroupReconfigureResult{GroupId: "group-restart-failed", Outcome: ReconfigureRestartFailed, Err: fmt.Errorf("create error")}, report.Groups[0])
+	assert.Equal(t, GroupReconfigureResult{GroupId: "group-restarted", Outcome: ReconfigureRestarted}, report.Groups[1])
+	assert.Equal(t, GroupReconfigureResult{GroupId: "group-stop-failed", Outcome: ReconfigureStopFailed, Err: closeErr}, report.Groups[2])
+	assert.Equal(t, []string{"group-restart-failed", "group-stop-failed"}, report.Failed())
+	assert.Equal(t, "restart-failed", ReconfigureRestartFailed.String())
+
+	assert.Nil(t, ReconfigureReport{}.Err())
+}
+
+// closeControlledGroup is a mockConsumerGroup whose Close blocks until released, and then returns the given error
+type closeControlledGroup struct {
+	mockConsumerGroup
+	release chan struct{}
+	err     error
+}
+
+func (g *closeControlledGroup) Close() error {
+	<-g.release
+	return g.err
+}
+
+func TestShutdown(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+	logger := zap.NewNop().Sugar()
+
+	released := make(chan struct{})
+	close(released)
+	blocking := &closeControlledGroup{release: make(chan struct{})}
+	assert.Nil(t, manager.StartConsumerGroup("group-drained", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Nil(t, manager.AddExistingGroup("group-blocking", blocking, nil, nil, nil))
+	assert.Nil(t, manager.AddExistingGroup("group-failing", &closeControlledGroup{release: released, err: fmt.Errorf("close error")}, nil, nil, nil))
+
+	// The force-closed group finishes closing in the background once released
+	blockingClosed := make(chan struct{})
+	notifications := manager.GetNotificationChannel()
+	go func() {
+		for event := range notifications {
+			if event.Event == GroupClosed && event.GroupId == "group-blocking" {
+				close(blockingClosed)
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	result, err := manager.Shutdown(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"group-drained"}, result.Drained)
+	assert.Equal(t, []string{"group-blocking", "group-failing"}, result.ForceClosed)
+	assert.False(t, manager.IsManaged("group-blocking"))
+	close(blocking.release)
+	<-blockingClosed
+
+	// The manager may only be shut down once, and does not accept new groups afterwards
+	_, err = manager.Shutdown(context.Background())
+	assert.NotNil(t, err)
+	assert.NotNil(t, manager.StartConsumerGroup("group-new", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.NotNil(t, manager.AddExistingGroup("group-new", &mockConsumerGroup{}, nil, nil, nil))
+}
+
+func TestPausePartitions(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+	partitions := map[string][]int32{"topic-1": {0}}
+
+	// Unmanaged groups and groups not started by the manager are rejected
+	assert.NotNil(t, manager.PausePartitions("test-group-id", partitions))
+	assert.NotNil(t, manager.ResumePartitions("test-group-id", partitions))
+	_, err := manager.PausedPartitions("test-group-id")
+	assert.NotNil(t, err)
+	assert.Nil(t, manager.AddExistingGroup("existing-group-id", &mockConsumerGroup{}, nil, nil, nil))
+	assert.NotNil(t, manager.PausePartitions("existing-group-id", partitions))
+	paused, err := manager.PausedPartitions("existing-group-id")
+	assert.Nil(t, err)
+	assert.Empty(t, paused)
+	assert.Nil(t, manager.CloseConsumerGroup("existing-group-id"))
+
+	assert.Nil(t, manager.StartConsumerGroup("test-group-id", []string{"topic-1"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	pauser := impl.getGroup("test-group-id").state().pauser
+	assert.NotNil(t, pauser)
+	assert.NotNil(t, manager.PausePartitions("test-group-id", partitions)) // Not assigned
+
+	pauser.setAssigned(map[string][]int32{"topic-1": {0, 1, 2}, "topic-2": {0}})
+	assert.Nil(t, manager.PausePartitions("test-group-id", map[string][]int32{"topic-1": {2, 0}, "topic-2": {0}}))
+	isPaused, _ := pauser.isPaused("topic-1", 0)
+	assert.True(t, isPaused)
+	paused, err = manager.PausedPartitions("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int32{"topic-1": {0, 2}, "topic-2": {0}}, paused)
+
+	// The paused partitions are still reported while the whole group is stopped
+	assert.Nil(t, impl.stopConsumerGroup(nil, "test-group-id"))
+	paused, err = manager.PausedPartitions("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int32{"topic-1": {0, 2}, "topic-2": {0}}, paused)
+	assert.Nil(t, impl.startConsumerGroup(nil, "test-group-id"))
+
+	// The returned map is a copy
+	paused["topic-1"][0] = 5
+	assert.Nil(t, manager.ResumePartitions("test-group-id", map[string][]int32{"topic-1": {0, 2}}))
+	isPaused, _ = pauser.isPaused("topic-1", 0)
+	assert.False(t, isPaused)
+	paused, err = manager.PausedPartitions("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]int32{"topic-2": {0}}, paused)
+	assert.Nil(t, manager.ResumePartitions("test-group-id", map[string][]int32{"topic-2": {0}}))
+	paused, err = manager.PausedPartitions("test-group-id")
+	assert.Nil(t, err)
+	assert.Empty(t, paused)
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("test-group-id", time.Second))
+}
+
+func TestAddExistingGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	assert.NotNil(t, manager.AddExistingGroup("test-group-id", nil, nil, nil, nil))
+
+	created := 0
+	createGroup := func() (sarama.ConsumerGroup, error) {
+		created++
+		return &mockConsumerGroup{}, nil
+	}
+	canceled := false
+	cancel := func() { canceled = true }
+	assert.Nil(t, manager.AddExistingGroup("test-group-id", &mockConsumerGroup{}, []string{"topic-1"}, createGroup, cancel))
+
+	// A group that is not added because the groupId is already managed is closed
+	duplicate := &closeCountingGroup{}
+	duplicateCanceled := false
+	assert.NotNil(t, manager.AddExistingGroup("test-group-id", duplicate, nil, createGroup, func() { duplicateCanceled = true }))
+	assert.Equal(t, int32(1), duplicate.closed)
+	assert.True(t, duplicateCanceled)
+	assert.False(t, canceled)
+	assert.True(t, manager.IsManaged("test-group-id"))
+	topics, err := manager.Topics("test-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic-1"}, topics)
+
+	// Restarting the group uses the provided createGroup function, and does not wait for a join
+	assert.Nil(t, impl.stopConsumerGroup(nil, "test-group-id"))
+	assert.True(t, manager.IsStopped("test-group-id"))
+	assert.Nil(t, impl.startConsumerGroup(nil, "test-group-id"))
+	assert.False(t, manager.IsStopped("test-group-id"))
+	assert.Nil(t, manager.RollingReconfigure([]string{"new-broker"}, sarama.NewConfig(), RollingReconfigureOptions{GroupTimeout: shortTimeout}))
+	assert.Equal(t, 2, created)
+
+	assert.NotNil(t, manager.SwapHandler("test-group-id", mockMessageHandler{}))
+	assert.Nil(t, manager.CloseConsumerGroup("test-group-id"))
+	assert.True(t, canceled)
+
+	// Without a createGroup function, the manager's factory is used to restart the group
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		created++
+		return &mockConsumerGroup{}, nil
+	}
+	assert.Nil(t, manager.AddExistingGroup("test-group-id", &mockConsumerGroup{}, nil, nil, nil))
+	assert.Nil(t, impl.stopConsumerGroup(nil, "test-group-id"))
+	assert.Nil(t, impl.startConsumerGroup(nil, "test-group-id"))
+	assert.Equal(t, 3, created)
+	assert.Nil(t, manager.CloseConsumerGroup("test-group-id"))
+}
+
 func TestCloseConsumerGroup(t *testing.T) {
 	defer restoreNewConsumerGroup(newConsumerGroup) // must use if calling getManagerWithMockGroup in the test
 
@@ -155,8 +1126,95 @@ func TestCloseConsumerGroup(t *testing.T) {
 				group.On("Close").Return(testCase.closeErr)
 				group.On("Errors").Return(make(chan error))
 			}
+			registry := gometrics.NewRegistry()
+			manager.(*kafkaConsumerGroupManagerImpl).getFactory().config.MetricRegistry = registry
+			newErrorOverflow(registry, testCase.groupId, DropNewestOnErrorOverflow)
 			err := manager.CloseConsumerGroup(testCase.groupId)
 			assert.Equal(t, testCase.expectErr, err != nil)
+			// The metrics of the group are only removed along with the group
+			assert.Equal(t, testCase.expectErr, registry.Get(droppedErrorsMetric+"-for-group-"+testCase.groupId) != nil)
+			server.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCloseConsumerGroupAndWait(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup) // must use if calling getManagerWithMockGroup in the test
+
+	for _, testCase := range []struct {
+		name      string
+		groupId   string
+		exit      bool
+		expectErr bool
+	}{
+		{
+			name:      "Nonexistent GroupID",
+			expectErr: true,
+		},
+		{
+			name:    "Consume Goroutine Exits",
+			groupId: "test-group-id",
+			exit:    true,
+		},
+		{
+			name:      "Consume Goroutine Does Not Exit",
+			groupId:   "test-group-id",
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, group, managedGrp, server := getManagerWithMockGroup(t, testCase.groupId, false)
+			if group != nil {
+				group.On("Close").Return(nil)
+				doneCh := make(chan struct{})
+				managedGrp.(*managedGroupImpl).consumeDone = doneCh
+				if testCase.exit {
+					close(doneCh)
+				}
+			}
+			err := manager.CloseConsumerGroupAndWait(testCase.groupId, 50*time.Millisecond)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			assert.False(t, manager.IsManaged(testCase.groupId))
+			server.AssertExpectations(t)
+		})
+	}
+}
+
+func TestSwapHandler(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup) // must use if calling getManagerWithMockGroup in the test
+
+	for _, testCase := range []struct {
+		name      string
+		groupId   string
+		handler   KafkaConsumerHandler
+		expectErr bool
+	}{
+		{
+			name:      "Nonexistent GroupID",
+			handler:   mockMessageHandler{},
+			expectErr: true,
+		},
+		{
+			name:    "Existing GroupID",
+			groupId: "test-group-id",
+			handler: mockMessageHandler{},
+		},
+		{
+			name:      "Existing GroupID, Nil Handler",
+			groupId:   "test-group-id",
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager, _, managedGrp, server := getManagerWithMockGroup(t, testCase.groupId, false)
+			err := manager.SwapHandler(testCase.groupId, testCase.handler, WithTimeout(time.Second))
+			assert.Equal(t, testCase.expectErr, err != nil)
+			if !testCase.expectErr {
+				handler, options, version := managedGrp.(*managedGroupImpl).handlerRef.get()
+				assert.Equal(t, testCase.handler, handler)
+				assert.Len(t, options, 3) // The swapped option plus the manager options
+				assert.Equal(t, 1, version)
+			}
 			server.AssertExpectations(t)
 		})
 	}
@@ -170,7 +1228,12 @@ func TestConsume(t *testing.T) {
 	}{
 		{
 			name:      "Nonexistent GroupID",
-			expectErr: "consume called on nonexistent groupId ''",
+			groupId:   "nonexistent-group-id",
+			expectErr: "consume called on nonexistent groupId 'nonexistent-group-id'",
+		},
+		{
+			name:      "Empty GroupID",
+			expectErr: `consume called with an invalid groupId - invalid consumer group id "" - the id is empty`,
 		},
 		{
 			name:    "Existing GroupID",
@@ -179,12 +1242,12 @@ func TestConsume(t *testing.T) {
 	} {
 		t.Run(testCase.name, func(t *testing.T) {
 			manager := &kafkaConsumerGroupManagerImpl{logger: logtesting.TestLogger(t).Desugar(), groups: make(groupMap)}
-			if testCase.groupId != "" {
+			if testCase.expectErr == "" {
 				mockGroup := &mockManagedGroup{}
 				mockGroup.On("consume", context.Background(), []string{"topic"}, nil).Return(nil)
 				manager.groups[testCase.groupId] = mockGroup
 			}
-			err := manager.consume(context.Background(), testCase.groupId, []string{"topic"}, nil)
+			err := manager.Consume(context.Background(), testCase.groupId, []string{"topic"}, nil)
 			if testCase.expectErr != "" {
 				assert.NotNil(t, err)
 				assert.Equal(t, testCase.expectErr, err.Error())
@@ -218,9 +1281,9 @@ func TestLockUnlockWrappers(t *testing.T) {
 				mockGroup.On("processLock", mock.Anything, mock.Anything).Return(fmt.Errorf("test error"))
 				manager.groups[testCase.groupId] = mockGroup
 			}
-			err := manager.lockBefore(nil, testCase.groupId)
+			err := manager.lockBefore(nil, testCase.groupId, manager.getGroup(testCase.groupId))
 			assert.Equal(t, testCase.expectErr, err != nil)
-			err = manager.unlockAfter(nil, testCase.groupId)
+			err = manager.unlockAfter(nil, testCase.groupId, manager.getGroup(testCase.groupId))
 			assert.Equal(t, testCase.expectErr, err != nil)
 		})
 	}
@@ -426,6 +1489,9 @@ func TestNotifications(t *testing.T) {
 				mockGroup.On("processLock", mock.Anything, true).Return(nil)
 				mockGroup.On("stop").Return(nil)
 				mockGroup.On("start", mock.Anything).Return(nil)
+				mockGroup.On("createGroupFn").Return(nil)
+				mockGroup.On("handlerOptions").Return([]SaramaConsumerHandlerOption(nil))
+				mockGroup.On("isDead").Return(false)
 				mockGroup.On("processLock", mock.Anything, false).Return(fmt.Errorf("unlock error"))
 				impl.groups[testCase.groupId] = mockGroup
 			}
@@ -547,6 +1613,73 @@ func TestManagerEvents(t *testing.T) {
 	}
 }
 
+func TestControlProtocolCommands(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		opcode      ctrl.OpCode
+		version     int16
+		groupId     string
+		expectError bool
+		expectStop  bool
+	}{
+		{
+			name:       "Stop Managed Group",
+			opcode:     commands.StopConsumerGroupOpCode,
+			version:    commands.ConsumerGroupAsyncCommandVersion,
+			groupId:    "test-group-id",
+			expectStop: true,
+		},
+		{
+			name:        "Stop Unmanaged Group",
+			opcode:      commands.StopConsumerGroupOpCode,
+			version:     commands.ConsumerGroupAsyncCommandVersion,
+			groupId:     "unmanaged-group-id",
+			expectError: true,
+		},
+		{
+			name:        "Stop Group, Empty GroupId",
+			opcode:      commands.StopConsumerGroupOpCode,
+			version:     commands.ConsumerGroupAsyncCommandVersion,
+			groupId:     "",
+			expectError: true,
+		},
+		{
+			name:        "Start Group, Whitespace GroupId",
+			opcode:      commands.StartConsumerGroupOpCode,
+			version:     commands.ConsumerGroupAsyncCommandVersion,
+			groupId:     " \t",
+			expectError: true,
+		},
+		{
+			name:        "Start Group, Version Mismatch",
+			opcode:      commands.StartConsumerGroupOpCode,
+			version:     commands.ConsumerGroupAsyncCommandVersion + 1,
+			groupId:     "test-group-id",
+			expectError: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := controltesting.NewFakeServerHandler()
+			manager := NewConsumerGroupManager(logtesting.TestLogger(t).Desugar(), server, []string{}, &sarama.Config{})
+			assert.True(t, server.HasHandler(commands.StopConsumerGroupOpCode))
+			assert.True(t, server.HasHandler(commands.StartConsumerGroupOpCode))
+
+			mockGroup, managedGrp := createMockAndManagedGroups(t)
+			mockGroup.On("Close").Return(nil)
+			manager.(*kafkaConsumerGroupManagerImpl).groups["test-group-id"] = managedGrp
+
+			result, err := server.SendAsyncCommand(context.Background(), testCase.opcode, &commands.ConsumerGroupAsyncCommand{
+				Version:   testCase.version,
+				CommandId: 1,
+				GroupId:   testCase.groupId,
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.expectError, result.Error != "")
+			assert.Equal(t, testCase.expectStop, manager.IsStopped("test-group-id"))
+		})
+	}
+}
+
 func TestProcessAsyncGroupNotification_BadMessage(t *testing.T) {
 	cmdFunctionCalled := false
 	cmdFunction := func(lock *commands.CommandLock, groupId string) error {
@@ -558,6 +1691,178 @@ func TestProcessAsyncGroupNotification_BadMessage(t *testing.T) {
 	assert.False(t, cmdFunctionCalled)
 }
 
+func TestValidateGroupId(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		groupId     string
+		expectError bool
+	}{
+		{name: "Valid", groupId: "kafka.default.my-subscription"},
+		{name: "Valid With Interior Space", groupId: "my group"},
+		{name: "Valid Unicode", groupId: "grüppe-ü"},
+		{name: "Empty", groupId: "", expectError: true},
+		{name: "Whitespace Only", groupId: " \t\n", expectError: true},
+		{name: "Leading Whitespace", groupId: " my-group", expectError: true},
+		{name: "Trailing Whitespace", groupId: "my-group\n", expectError: true},
+		{name: "Control Character", groupId: "my\x00group", expectError: true},
+		{name: "Interior Tab", groupId: "my\tgroup", expectError: true},
+		{name: "Invalid UTF-8", groupId: "my\xffgroup", expectError: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateGroupId(testCase.groupId)
+			assert.Equal(t, testCase.expectError, err != nil)
+			assert.Equal(t, testCase.expectError, errors.Is(err, ErrInvalidGroupId))
+		})
+	}
+}
+
+func TestInvalidGroupIdEntryPoints(t *testing.T) {
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	logger := zap.NewNop().Sugar()
+	for _, groupId := range []string{"", "  ", "bad\x07group"} {
+		assertInvalid := func(err error) {
+			assert.True(t, errors.Is(err, ErrInvalidGroupId), "groupId %q: %v", groupId, err)
+		}
+		assertInvalid(manager.StartConsumerGroup(groupId, []string{"topic"}, logger, mockMessageHandler{}))
+		assertInvalid(manager.StartConsumerGroupSync(context.Background(), groupId, []string{"topic"}, logger, mockMessageHandler{}))
+		_, _, err := manager.StartChannelConsumer(groupId, []string{"topic"}, logger)
+		assertInvalid(err)
+		assertInvalid(manager.CloseConsumerGroup(groupId))
+		assertInvalid(manager.CloseConsumerGroupAndWait(groupId, time.Second))
+		assertInvalid(manager.SwapHandler(groupId, mockMessageHandler{}))
+		assertInvalid(manager.PausePartitions(groupId, map[string][]int32{"topic": {0}}))
+		assertInvalid(manager.ResumePartitions(groupId, map[string][]int32{"topic": {0}}))
+		_, err = manager.PausedPartitions(groupId)
+		assertInvalid(err)
+		assertInvalid(manager.AddExistingGroup(groupId, &mockConsumerGroup{}, []string{"topic"}, nil, func() {}))
+		_, err = manager.Topics(groupId)
+		assertInvalid(err)
+		_, err = manager.CommittedOffsets(groupId)
+		assertInvalid(err)
+		assertInvalid(manager.Consume(context.Background(), groupId, []string{"topic"}, nil))
+		assertInvalid(manager.Import([]ManagedGroupState{{GroupId: groupId}}, logger, func(string) (KafkaConsumerHandler, []SaramaConsumerHandlerOption, error) {
+			t.Fatal("the resolver was called for an invalid groupId")
+			return nil, nil, nil
+		}))
+		assert.False(t, manager.IsManaged(groupId)) // No ghost group was created
+	}
+}
+
+// newGroupOperationsManager returns a manager with the given number of managed groups, for comparing the concurrent
+// group operations with the per-group locks against those serialized by one shared lock (as they were before)
+func newGroupOperationsManager(groupCount int) (*kafkaConsumerGroupManagerImpl, []string) {
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	groupIds := make([]string, groupCount)
+	for i := range groupIds {
+		groupIds[i] = fmt.Sprintf("benchmark-group-%d", i)
+		impl.setGroup(groupIds[i], createManagedGroup(context.Background(), impl.logger, &mockConsumerGroup{}, func() {}, func() {}, nil))
+	}
+	return impl, groupIds
+}
+
+// groupOperationCycle stops a group and starts it again, querying its state along the way, with each operation
+// serialized by the shared lock if there is one
+func groupOperationCycle(impl *kafkaConsumerGroupManagerImpl, groupId string, shared *sync.Mutex) {
+	serialized := func(operation func()) {
+		if shared != nil {
+			shared.Lock()
+			defer shared.Unlock()
+		}
+		operation()
+	}
+	serialized(func() { _ = impl.stopConsumerGroup(nil, groupId) })
+	serialized(func() { _ = impl.IsStopped(groupId) })
+	serialized(func() { _ = impl.startConsumerGroup(nil, groupId) })
+	serialized(func() { _ = impl.IsManaged(groupId) })
+}
+
+// BenchmarkGroupOperations measures concurrent stop/start cycles and queries across many managed groups, with the
+// per-group locks (where the groupLock is only held for map lookups, so operations on different groups do not wait
+// for each other) and with the baseline of every operation serialized by one shared lock
+func BenchmarkGroupOperations(b *testing.B) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+
+	for _, testCase := range []struct {
+		name   string
+		shared *sync.Mutex
+	}{
+		{name: "PerGroupLocks"},
+		{name: "SharedLock", shared: &sync.Mutex{}},
+	} {
+		b.Run(testCase.name, func(b *testing.B) {
+			impl, groupIds := newGroupOperationsManager(200)
+			counter := int64(0)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					groupOperationCycle(impl, groupIds[atomic.AddInt64(&counter, 1)%int64(len(groupIds))], testCase.shared)
+				}
+			})
+		})
+	}
+}
+
+func TestGroupOperationsMatchSharedLock(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+
+	// The same concurrent operations leave the groups in the same states with either kind of locking
+	states := func(shared *sync.Mutex) map[string]bool {
+		impl, groupIds := newGroupOperationsManager(20)
+		var wg sync.WaitGroup
+		for i, groupId := range groupIds {
+			wg.Add(1)
+			go func(i int, groupId string) {
+				defer wg.Done()
+				for cycle := 0; cycle < 10; cycle++ {
+					groupOperationCycle(impl, groupId, shared)
+				}
+				if i%2 == 0 {
+					_ = impl.stopConsumerGroup(nil, groupId)
+				}
+			}(i, groupId)
+		}
+		wg.Wait()
+		stopped := make(map[string]bool, len(groupIds))
+		for _, groupId := range impl.getGroupIds() {
+			stopped[groupId] = impl.IsStopped(groupId)
+		}
+		return stopped
+	}
+	expected := states(&sync.Mutex{})
+	assert.Len(t, expected, 20)
+	assert.Equal(t, expected, states(nil))
+}
+
+func TestWithManagerOptions(t *testing.T) {
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	notifications := manager.GetNotificationChannel()
+
+	userOptions := []SaramaConsumerHandlerOption{WithTimeout(time.Second)}
+	options := impl.withManagerOptions("test-group-id", userOptions)
+	assert.Len(t, userOptions, 1) // The caller's slice must not be modified
+	assert.Len(t, options, 3)
+
+	handler := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, options...)
+	assert.Equal(t, time.Second, handler.timeout)
+	assert.NotNil(t, handler.notifyEvent)
+	assert.NotNil(t, handler.notifyConsuming)
+
+	received := make(chan ManagerEvent, 1)
+	go func() { received <- <-notifications }()
+	time.Sleep(5 * time.Millisecond) // Let the receiver start, as notify does not block
+	handler.notifyEvent(GroupOffsetReset)
+	assert.Equal(t, ManagerEvent{Event: GroupOffsetReset, GroupId: "test-group-id"}, <-received)
+	manager.ClearNotifications()
+}
+
 // getManagerWithMockGroup creates a KafkaConsumerGroupManager and optionally seeds it with a mock consumer group
 func getManagerWithMockGroup(t *testing.T, groupId string, factoryErr bool) (KafkaConsumerGroupManager,
 	*kafkatesting.MockConsumerGroup,
@@ -585,7 +1890,7 @@ func getManagerWithMockGroup(t *testing.T, groupId string, factoryErr bool) (Kaf
 func createMockAndManagedGroups(t *testing.T) (*kafkatesting.MockConsumerGroup, *managedGroupImpl) {
 	mockGroup := kafkatesting.NewMockConsumerGroup()
 	mockGroup.On("Errors").Return(make(chan error))
-	managedGrp := createManagedGroup(context.Background(), logtesting.TestLogger(t).Desugar(), mockGroup, func() {}, func() {})
+	managedGrp := createManagedGroup(context.Background(), logtesting.TestLogger(t).Desugar(), mockGroup, func() {}, func() {}, &groupState{handlerRef: newHandlerReference(nil, nil)})
 	// let the transferErrors function start (otherwise AssertExpectations will randomly fail because Errors() isn't called)
 	time.Sleep(5 * time.Millisecond)
 	return mockGroup, managedGrp.(*managedGroupImpl)
@@ -595,6 +1900,7 @@ func getMockServerHandler() *controltesting.MockServerHandler {
 	server := controltesting.GetMockServerHandler()
 	server.On("AddAsyncHandler", commands.StopConsumerGroupOpCode, commands.StopConsumerGroupResultOpCode, mock.Anything, mock.Anything).Return()
 	server.On("AddAsyncHandler", commands.StartConsumerGroupOpCode, commands.StartConsumerGroupResultOpCode, mock.Anything, mock.Anything).Return()
+	server.On("AddAsyncHandler", commands.ResetOffsetsOpCode, commands.ResetOffsetsResultOpCode, mock.Anything, mock.Anything).Return()
 	server.Service.On("SendAndWaitForAck", commands.StopConsumerGroupOpCode, mock.Anything).Return(nil)
 	server.Service.On("SendAndWaitForAck", commands.StartConsumerGroupOpCode, mock.Anything).Return(nil)
 	server.Service.On("SendAndWaitForAck", commands.StopConsumerGroupResultOpCode, mock.Anything).Return(nil)
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// OffsetStore keeps the offsets of a ConsumerGroup outside of Kafka (see WithOffsetStore).  An offset is that of
+// the next message to consume from its partition, as with the offsets committed to Kafka.  Its functions are called
+// from the goroutines of the sessions of the group, so they must be safe for concurrent use.
+type OffsetStore interface {
+	// Load returns the stored offset of the partition, and false if there is none
+	Load(groupId string, topic string, partition int32) (int64, bool, error)
+	// Save stores the offsets of the partitions (by topic) that have been marked since the previous call, which may
+	// be done atomically (such as in a single transaction)
+	Save(groupId string, offsets map[string]map[int32]int64) error
+}
+
+// WithOffsetStore keeps the offsets of the ConsumerGroup in the given OffsetStore instead of committing them to
+// Kafka, such as to store them in the same database as the output of the handler.  When a session is set up, each
+// claimed partition begins at the offset that Load returns for it, and the offsets marked during the session are
+// passed to Save at the commit interval of the sarama config (Consumer.Offsets.AutoCommit.Interval), and once more
+// when the session ends.  Auto-commit is disabled in the config, so sarama commits nothing to Kafka, and a partition
+// that the store has no offset for begins at the offset of Consumer.Offsets.Initial (unless the group committed an
+// offset to Kafka before it used the store).  WithStartOffsets still takes precedence the first time a partition is
+// claimed.
+//
+// The consistency model is at-least-once, with the store in place of Kafka:  a message is only saved once it (and
+// every message before it) has been marked, and the messages after the last saved offset of a partition are
+// delivered again to whichever member claims it next, after a rebalance or a crash.  For exactly-once processing,
+// the handler can write the offset of each message along with its output, in the same transaction, in which case
+// Save may do nothing and Load returns the offsets that the handler wrote.
+//
+// If Load fails, the session is not set up (and the consume loop tries again, as with any failed session), so that
+// no partition begins at the wrong offset.  If Save fails, the error is sent to the errors channel and the offsets
+// are saved again at the next interval (unless later ones have been marked meanwhile); a failure of the final Save
+// of a session is only reported.  Any commit callback receives the outcome of each Save, and a confirmed drain (see
+// WithDrainCommitMode) that of the final Save.  Since nothing is committed to Kafka, WithFinalCommit and
+// WithCommitRetry have no effect, and the lag that Kafka tools report for the group is meaningless.  Default is to
+// commit the offsets to Kafka.
+func WithOffsetStore(store OffsetStore) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.offsetStore = store
+		handler.configModifiers = append(handler.configModifiers, func(config *sarama.Config) error {
+			config.Consumer.Offsets.AutoCommit.Enable = false
+			return nil
+		})
+	}
+}
+
+// offsetStoreOf returns the OffsetStore of the WithOffsetStore option among the given ones (nil if there is none)
+func offsetStoreOf(options []SaramaConsumerHandlerOption) OffsetStore {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	return scratch.offsetStore
+}
+
+// loadStoredOffsets moves the claimed partitions to the offsets of the OffsetStore, if there is one.  It must be
+// called by Setup, before sarama begins consuming the claims.
+func (consumer *SaramaConsumerHandler) loadStoredOffsets(session sarama.ConsumerGroupSession) error {
+	if consumer.offsetStore == nil {
+		return nil
+	}
+	handler, _ := consumer.getHandler()
+	groupId := handler.GetConsumerGroup()
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			offset, ok, err := consumer.offsetStore.Load(groupId, topic, partition)
+			if err != nil {
+				return fmt.Errorf("could not load the offset of topic %s, partition %d from the offset store: %w", topic, partition, err)
+			}
+			if !ok {
+				continue
+			}
+			moveOffset(session, topic, partition, offset)
+			consumer.logger.Debugw("Moved partition to its stored offset", zap.String("topic", topic), zap.Int32("partition", partition),
+				zap.Int64("offset", offset))
+		}
+	}
+	return nil
+}
+
+// saveOffsets passes the marked offsets to the OffsetStore.  If that fails, the offsets are tracked again (unless
+// later ones have been marked meanwhile), so that they are saved at the next commit, and the error is returned.
+func (consumer *SaramaConsumerHandler) saveOffsets(groupId string, offsets map[string]map[int32]int64) error {
+	err := consumer.offsetStore.Save(groupId, offsets)
+	if err == nil {
+		return nil
+	}
+	consumer.commits.lock.Lock()
+	for topic, partitions := range offsets {
+		pending, ok := consumer.commits.pending[topic]
+		if !ok {
+			pending = make(map[int32]int64)
+			consumer.commits.pending[topic] = pending
+		}
+		for partition, offset := range partitions {
+			if _, marked := pending[partition]; !marked {
+				pending[partition] = offset
+			}
+		}
+	}
+	consumer.commits.lock.Unlock()
+	err = fmt.Errorf("could not save offsets to the offset store: %w", err)
+	consumer.logger.Warnw("Failed to save offsets to the offset store", zap.Any("offsets", offsets), zap.Error(err))
+	consumer.sendError(err)
+	return err
+}
+
+// lastSaveErr returns the outcome of the last Save of the OffsetStore in the session (nil if there was none)
+func (consumer *SaramaConsumerHandler) lastSaveErr() error {
+	if consumer.commits == nil {
+		return nil
+	}
+	return consumer.commits.saveErr
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// memoryOffsetStore is an OffsetStore that keeps the offsets in memory, and fails while it has an error to return
+type memoryOffsetStore struct {
+	lock    sync.Mutex
+	offsets map[string]map[int32]int64
+	loadErr error
+	saveErr error
+	saves   int
+}
+
+func (s *memoryOffsetStore) Load(groupId string, topic string, partition int32) (int64, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if groupId != "consumer group" {
+		return 0, false, fmt.Errorf("unexpected group %s", groupId)
+	}
+	offset, ok := s.offsets[topic][partition]
+	return offset, ok, s.loadErr
+}
+
+func (s *memoryOffsetStore) Save(groupId string, offsets map[string]map[int32]int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saves++
+	if s.saveErr != nil {
+		err := s.saveErr
+		s.saveErr = nil // Fails once
+		return err
+	}
+	for topic, partitions := range offsets {
+		if s.offsets[topic] == nil {
+			s.offsets[topic] = make(map[int32]int64)
+		}
+		for partition, offset := range partitions {
+			s.offsets[topic][partition] = offset
+		}
+	}
+	return nil
+}
+
+func (s *memoryOffsetStore) stored() (map[string]map[int32]int64, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := make(map[string]map[int32]int64)
+	for topic, partitions := range s.offsets {
+		stored[topic] = make(map[int32]int64)
+		for partition, offset := range partitions {
+			stored[topic][partition] = offset
+		}
+	}
+	return stored, s.saves
+}
+
+// movingSession is a claimsSession that records the offsets that it is moved to
+type movingSession struct {
+	claimsSession
+	moves []string
+}
+
+func (s *movingSession) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.moves = append(s.moves, fmt.Sprintf("reset %s/%d %d", topic, partition, offset))
+}
+
+func (s *movingSession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.moves = append(s.moves, fmt.Sprintf("mark %s/%d %d", topic, partition, offset))
+}
+
+func TestWithOffsetStore(t *testing.T) {
+	handler := SaramaConsumerHandler{}
+	WithOffsetStore(&memoryOffsetStore{})(&handler)
+	config := sarama.NewConfig()
+	assert.Nil(t, handler.configModifiers[0](config))
+	assert.False(t, config.Consumer.Offsets.AutoCommit.Enable)
+}
+
+func TestOffsetStore(t *testing.T) {
+	store := &memoryOffsetStore{offsets: map[string]map[int32]int64{"topic": {0: 42}}}
+	errorCh := make(chan error, 10)
+	results := make(chan error, 10)
+	callback := func(_ string, _ map[string]map[int32]int64, err error) { results <- err }
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, errorCh,
+		WithOffsetStore(store), WithCommitCallback(callback), withCommitInterval(time.Hour), WithFinalCommit(time.Second))
+
+	// The stored offset is loaded, and the partition without one is left at its committed offset
+	session := &movingSession{claimsSession: claimsSession{committingSession: committingSession{ctx: context.Background()}, claims: map[string][]int32{"topic": {0, 1}}}}
+	assert.Nil(t, cgh.Setup(session))
+	assert.Equal(t, []string{"reset topic/0 42", "mark topic/0 42"}, session.moves)
+
+	// The marked offsets are saved when the session ends, without committing anything to Kafka
+	message := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 7}
+	_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: message})
+	assert.Nil(t, cgh.Cleanup(session))
+	stored, saves := store.stored()
+	assert.Equal(t, map[string]map[int32]int64{"topic": {0: 42, 1: 8}}, stored)
+	assert.Equal(t, 1, saves)
+	assert.Nil(t, <-results)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&session.commits))
+
+	// A failed load fails the Setup of the session
+	store.loadErr = fmt.Errorf("load error")
+	err := cgh.Setup(&movingSession{claimsSession: claimsSession{committingSession: committingSession{ctx: context.Background()}, claims: map[string][]int32{"topic": {0}}}})
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, store.loadErr))
+	close(errorCh)
+}
+
+func TestOffsetStoreSaveFailure(t *testing.T) {
+	saveErr := fmt.Errorf("save error")
+	store := &memoryOffsetStore{offsets: map[string]map[int32]int64{}, saveErr: saveErr}
+	errorCh := make(chan error, 10)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, errorCh,
+		WithOffsetStore(store), withCommitInterval(5*time.Millisecond))
+
+	session := &movingSession{claimsSession: claimsSession{committingSession: committingSession{ctx: context.Background()}}}
+	assert.Nil(t, cgh.Setup(session))
+	cgh.trackMarked(&sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 4})
+
+	// The failure is reported, and the offsets are saved again at the next interval
+	select {
+	case err := <-errorCh:
+		assert.True(t, errors.Is(err, saveErr))
+	case <-time.After(shortTimeout):
+		assert.Fail(t, "failed save was not reported")
+	}
+	assert.Eventually(t, func() bool {
+		stored, _ := store.stored()
+		return stored["topic"][0] == 5
+	}, shortTimeout, time.Millisecond)
+	assert.Nil(t, cgh.Cleanup(session))
+	assert.Nil(t, cgh.lastSaveErr())
+	close(errorCh)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// defaultErrorChannelCapacity is the number of handler errors buffered for a ConsumerGroup, if not specified
+const defaultErrorChannelCapacity = 10
+
+// droppedErrorsMetric is the name of the counter, in the MetricRegistry of the sarama config, of the handler errors
+// that were dropped because the error channel of their ConsumerGroup was full.  For a group whose WithErrorChannel
+// policy drops errors, the same count is also kept in a "consumer-dropped-errors-for-group-<GroupId>" counter.
+const droppedErrorsMetric = "consumer-dropped-errors"
+
+// ErrorOverflowPolicy determines what the handler of a ConsumerGroup started by the factory does with an error when
+// the handler error channel of the group is full, because the errors are not being read fast enough
+type ErrorOverflowPolicy int
+
+const (
+	// BlockOnErrorOverflow waits until there is room in the channel, which stalls the consumption of the partition
+	// whose message failed (and may cause the session to time out if it lasts too long)
+	BlockOnErrorOverflow ErrorOverflowPolicy = iota
+	// DropOldestOnErrorOverflow discards the oldest error in the channel to make room for the new one
+	DropOldestOnErrorOverflow
+	// DropNewestOnErrorOverflow discards the new error, keeping those already in the channel
+	DropNewestOnErrorOverflow
+)
+
+// WithErrorChannel sets the number of handler errors buffered for the ConsumerGroup (a negative capacity means the
+// default of 10) and what the handler does with an error when the buffer is full.  Dropping errors keeps a slow
+// reader of the Errors() channel from stalling the consumption; the dropped errors are still logged by the handler,
+// and counted (see DroppedErrors, and the "consumer-dropped-errors" counter in the MetricRegistry of the sarama
+// config, if there is one).  With an unbuffered channel, DropOldestOnErrorOverflow behaves as
+// DropNewestOnErrorOverflow, since there is no older error to discard.  Default is a capacity of 10 and
+// BlockOnErrorOverflow.
+func WithErrorChannel(capacity int, policy ErrorOverflowPolicy) SaramaConsumerHandlerOption {
+	if capacity < 0 {
+		capacity = defaultErrorChannelCapacity
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.errorCapacity = &capacity
+		handler.errorOverflowPolicy = policy
+	}
+}
+
+// errorCapacityOf returns the capacity of the handler error channel given by the options
+func errorCapacityOf(options []SaramaConsumerHandlerOption) int {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	if scratch.errorCapacity == nil {
+		return defaultErrorChannelCapacity
+	}
+	return *scratch.errorCapacity
+}
+
+// errorOverflow counts the handler errors of a ConsumerGroup that were dropped because its error channel was full
+type errorOverflow struct {
+	dropped int64      // Accessed atomically
+	evict   sync.Mutex // Serializes the handlers that discard the oldest error, so that each discards at most one
+	all     gometrics.Counter
+	group   gometrics.Counter
+}
+
+// newErrorOverflow returns an errorOverflow that also counts in the given registry, unless the registry is nil.  The
+// counter of the group itself is only registered if the policy of the group drops errors.
+func newErrorOverflow(registry gometrics.Registry, groupId string, policy ErrorOverflowPolicy) *errorOverflow {
+	overflow := &errorOverflow{}
+	if registry != nil {
+		overflow.all = registry.GetOrRegister(droppedErrorsMetric, gometrics.NewCounter).(gometrics.Counter)
+		if policy != BlockOnErrorOverflow {
+			overflow.group = registry.GetOrRegister(groupMetricName(droppedErrorsMetric, groupId), gometrics.NewCounter).(gometrics.Counter)
+		}
+	}
+	return overflow
+}
+
+// recordDropped counts an error that was dropped
+func (o *errorOverflow) recordDropped() {
+	atomic.AddInt64(&o.dropped, 1)
+	if o.all != nil {
+		o.all.Inc(1)
+	}
+	if o.group != nil {
+		o.group.Inc(1)
+	}
+}
+
+// droppedCount returns the number of errors that were dropped
+func (o *errorOverflow) droppedCount() int64 {
+	return atomic.LoadInt64(&o.dropped)
+}
+
+// sendError sends the error to the errors channel, applying the overflow policy of WithErrorChannel if the channel is
+// full.  The policy only applies to a handler whose ConsumerGroup was started by the factory.
+func (consumer *SaramaConsumerHandler) sendError(err error) {
+	consumer.groupMetrics.failed(err)
+	consumer.activity.failed(err)
+	policy := consumer.errorOverflowPolicy
+	if consumer.errorOverflow == nil || policy == BlockOnErrorOverflow {
+		consumer.errors <- err
+		return
+	}
+	select {
+	case consumer.errors <- err:
+		return
+	default:
+	}
+	if policy == DropNewestOnErrorOverflow || cap(consumer.errors) == 0 {
+		consumer.errorOverflow.recordDropped()
+		return
+	}
+
+	consumer.errorOverflow.evict.Lock()
+	defer consumer.errorOverflow.evict.Unlock()
+	for {
+		select {
+		case <-consumer.errors:
+			consumer.errorOverflow.recordDropped()
+		default: // Emptied by the reader in the meantime
+		}
+		select {
+		case consumer.errors <- err:
+			return
+		default: // Filled by another handler in the meantime
+		}
+	}
+}
+
+// DroppedErrors returns the number of handler errors of the managed group that were dropped because its error
+// channel was full (see WithErrorChannel).  It is zero for a group added via AddExistingGroup, whose errors are not
+// sent by the manager's handler.
+func (m *kafkaConsumerGroupManagerImpl) DroppedErrors(groupId string) (int64, error) {
+	if err := validateGroupId(groupId); err != nil {
+		return 0, fmt.Errorf("could not get dropped errors for consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return 0, fmt.Errorf("could not get dropped errors for consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	overflow := managedGrp.state().overflow
+	if overflow == nil {
+		return 0, nil
+	}
+	return overflow.droppedCount(), nil
+}
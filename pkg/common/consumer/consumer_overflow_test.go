@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestErrorCapacityOf(t *testing.T) {
+	assert.Equal(t, defaultErrorChannelCapacity, errorCapacityOf(nil))
+	assert.Equal(t, 0, errorCapacityOf([]SaramaConsumerHandlerOption{WithErrorChannel(0, BlockOnErrorOverflow)}))
+	assert.Equal(t, 100, errorCapacityOf([]SaramaConsumerHandlerOption{WithErrorChannel(100, DropNewestOnErrorOverflow)}))
+	assert.Equal(t, defaultErrorChannelCapacity, errorCapacityOf([]SaramaConsumerHandlerOption{WithErrorChannel(-1, DropNewestOnErrorOverflow)}))
+}
+
+func TestSendError(t *testing.T) {
+	errorA, errorB, errorC := fmt.Errorf("error-a"), fmt.Errorf("error-b"), fmt.Errorf("error-c")
+	for _, testCase := range []struct {
+		name          string
+		capacity      int
+		policy        ErrorOverflowPolicy
+		expectErrors  []error
+		expectDropped int64
+	}{
+		{
+			name:          "Drop Newest",
+			capacity:      2,
+			policy:        DropNewestOnErrorOverflow,
+			expectErrors:  []error{errorA, errorB},
+			expectDropped: 1,
+		},
+		{
+			name:          "Drop Oldest",
+			capacity:      2,
+			policy:        DropOldestOnErrorOverflow,
+			expectErrors:  []error{errorB, errorC},
+			expectDropped: 1,
+		},
+		{
+			name:          "Drop Oldest Unbuffered",
+			capacity:      0,
+			policy:        DropOldestOnErrorOverflow,
+			expectErrors:  []error{},
+			expectDropped: 3,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			registry := gometrics.NewRegistry()
+			overflow := newErrorOverflow(registry, "group-id", testCase.policy)
+			errorCh := make(chan error, testCase.capacity)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, errorCh,
+				WithErrorChannel(testCase.capacity, testCase.policy), withGroupState(&groupState{overflow: overflow}))
+
+			cgh.sendError(errorA)
+			cgh.sendError(errorB)
+			cgh.sendError(errorC)
+			close(errorCh)
+			received := []error{}
+			for err := range errorCh {
+				received = append(received, err)
+			}
+			assert.Equal(t, testCase.expectErrors, received)
+			assert.Equal(t, testCase.expectDropped, overflow.droppedCount())
+			assert.Equal(t, testCase.expectDropped, registry.Get(droppedErrorsMetric).(gometrics.Counter).Count())
+			assert.Equal(t, testCase.expectDropped, registry.Get(droppedErrorsMetric+"-for-group-group-id").(gometrics.Counter).Count())
+		})
+	}
+}
+
+func TestErrorOverflowGroupCounter(t *testing.T) {
+	registry := gometrics.NewRegistry()
+	newErrorOverflow(registry, "blocking", BlockOnErrorOverflow)
+	newErrorOverflow(registry, "dropping", DropNewestOnErrorOverflow)
+	assert.NotNil(t, registry.Get(droppedErrorsMetric))
+	assert.Nil(t, registry.Get(droppedErrorsMetric+"-for-group-blocking"))
+	assert.NotNil(t, registry.Get(droppedErrorsMetric+"-for-group-dropping"))
+
+	unregisterGroupMetrics(registry, "dropping")
+	assert.NotNil(t, registry.Get(droppedErrorsMetric))
+	assert.Nil(t, registry.Get(droppedErrorsMetric+"-for-group-dropping"))
+	unregisterGroupMetrics(nil, "dropping") // A nil registry has nothing to remove
+}
+
+func TestSendErrorBlocks(t *testing.T) {
+	overflow := newErrorOverflow(nil, "group-id", BlockOnErrorOverflow)
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, errorCh, withGroupState(&groupState{overflow: overflow}))
+
+	cgh.sendError(fmt.Errorf("error-a"))
+	sent := make(chan struct{})
+	go func() {
+		cgh.sendError(fmt.Errorf("error-b"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		assert.Fail(t, "error was sent to a full channel")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, "error-a", (<-errorCh).Error())
+	<-sent
+	assert.Equal(t, "error-b", (<-errorCh).Error())
+	assert.Equal(t, int64(0), overflow.droppedCount())
+}
+
+func TestDroppedErrors(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{},
+		WithErrorChannel(1, DropNewestOnErrorOverflow)))
+	dropped, err := manager.DroppedErrors("group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dropped)
+	impl.getGroup("group-id").state().overflow.recordDropped()
+	dropped, err = manager.DroppedErrors("group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), dropped)
+
+	assert.Nil(t, manager.AddExistingGroup("existing-group-id", &mockConsumerGroup{}, nil, nil, nil))
+	dropped, err = manager.DroppedErrors("existing-group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dropped)
+
+	_, err = manager.DroppedErrors("unmanaged-group-id")
+	assert.NotNil(t, err)
+	_, err = manager.DroppedErrors("")
+	assert.NotNil(t, err)
+}
+
+func TestManagedGroupHandlerErrors(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	const capacity = 2
+	const messageCount = 3 * capacity
+	messages := make([]*sarama.ConsumerMessage, messageCount)
+	for i := range messages {
+		messages[i] = &sarama.ConsumerMessage{Topic: "topic", Offset: int64(i)}
+	}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &claimingConsumerGroup{messages: messages, closed: make(chan struct{})}, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+
+	// More errors than the capacity of the handler error channel reach the Errors channel of the manager, without
+	// the handler blocking (which would keep the remaining errors from being sent at all)
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{shouldErr: true},
+		WithErrorChannel(capacity, BlockOnErrorOverflow)))
+	errorCh := manager.Errors("group-id")
+	for i := 0; i < messageCount; i++ {
+		select {
+		case err := <-errorCh:
+			assert.NotNil(t, err)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Timed out waiting for the handler error", "received %d of %d", i, messageCount)
+			return
+		}
+	}
+	dropped, err := manager.DroppedErrors("group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), dropped)
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-id", time.Second))
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// defaultTopicPatternInterval is the time between the resolutions of a topic pattern, if not specified
+const defaultTopicPatternInterval = time.Minute
+
+// internalTopicPrefix begins the names of the internal topics of Kafka (e.g. __consumer_offsets)
+const internalTopicPrefix = "__"
+
+// WithTopicPattern makes the manager subscribe the group to the topics whose names match the regular expression
+// (in full, so "orders\..*" matches "orders.eu" but not "old.orders.eu"), instead of the topics passed to
+// StartConsumerGroup.  The pattern is resolved against the topics known to the brokers of the group's cluster when
+// the group is started, and again at the given interval (or every minute, if the interval is not positive).
+// Internal topics, whose names begin with "__", never match.
+//
+// When the matching topics change, the group is stopped and started again (in the manner of a control-protocol
+// stop and start, which ends the session and causes a rebalance) so that it subscribes to the new set.  A group that
+// is stopped at the time only records the new set, which it subscribes to when it is next started.  While no topics
+// match, the group has no session rather than repeatedly failing to join, and it joins as soon as a matching topic
+// appears.  A failed resolution leaves the subscription unchanged.  This option has no effect on a ConsumerGroup that
+// is not started by the manager.  Default is the fixed list of topics passed to StartConsumerGroup.
+func WithTopicPattern(pattern string, interval time.Duration) SaramaConsumerHandlerOption {
+	if interval <= 0 {
+		interval = defaultTopicPatternInterval
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.topicPattern = pattern
+		handler.topicPatternInterval = interval
+	}
+}
+
+// topicPatternOf returns the compiled topic pattern given by the options (the last one, if there are several), and
+// its resolution interval, or nil if there is none
+func topicPatternOf(options []SaramaConsumerHandlerOption) (*regexp.Regexp, time.Duration, error) {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	if scratch.topicPattern == "" {
+		return nil, 0, nil
+	}
+	pattern, err := regexp.Compile("^(?:" + scratch.topicPattern + ")$")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid topic pattern '%s': %w", scratch.topicPattern, err)
+	}
+	return pattern, scratch.topicPatternInterval, nil
+}
+
+// matchingTopics returns the names of the topics known to the brokers that match the pattern, in sorted order
+func (c kafkaConsumerGroupFactoryImpl) matchingTopics(pattern *regexp.Regexp, options []SaramaConsumerHandlerOption) ([]string, error) {
+	config, err := c.groupConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := newClusterAdmin(c.addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	matching := []string{}
+	for topic := range existing {
+		if !strings.HasPrefix(topic, internalTopicPrefix) && pattern.MatchString(topic) {
+			matching = append(matching, topic)
+		}
+	}
+	sort.Strings(matching)
+	return matching, nil
+}
+
+// followTopicPattern resolves the topic pattern of the managed group at the given interval, until the context is
+// done (which happens when the group is closed)
+func (m *kafkaConsumerGroupManagerImpl) followTopicPattern(ctx context.Context, groupId string, pattern *regexp.Regexp, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.refreshTopicPattern(groupId, pattern)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshTopicPattern resolves the topic pattern of the managed group and, if the matching topics have changed,
+// subscribes the group to them by stopping and starting it.  If the restart fails, the previous topics are kept so
+// that it is attempted again at the next resolution.
+func (m *kafkaConsumerGroupManagerImpl) refreshTopicPattern(groupId string, pattern *regexp.Regexp) {
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil || managedGrp.isDead() {
+		return
+	}
+	options := managedGrp.handlerOptions()
+	factory, err := m.getClusterFactory(clusterOf(options))
+	if err != nil {
+		groupLogger.Warn("Failed To Resolve Topic Pattern Of Managed ConsumerGroup", zap.Error(err))
+		return
+	}
+	topics, err := factory.matchingTopics(pattern, options)
+	if err != nil {
+		groupLogger.Warn("Failed To Resolve Topic Pattern Of Managed ConsumerGroup", zap.Error(err))
+		return
+	}
+
+	// Serialized with Reconfigure and SetActive, which also stop and start the groups
+	m.reconfigureLock.Lock()
+	defer m.reconfigureLock.Unlock()
+	previous := managedGrp.topics()
+	if equalTopics(previous, topics) {
+		return
+	}
+	groupLogger.Info("Topics Matching Pattern Changed", zap.Strings("Previous", previous), zap.Strings("Topics", topics))
+	managedGrp.setTopics(topics)
+	if len(previous) > 0 && !managedGrp.isStopped() {
+		// A group without topics is waiting for them (and has no session), so only a running one must be restarted
+		err = m.stopConsumerGroup(&commands.CommandLock{Token: internalToken, LockBefore: true}, groupId)
+		if err == nil {
+			err = m.startConsumerGroup(&commands.CommandLock{Token: internalToken, UnlockAfter: true}, groupId)
+		}
+		if err != nil {
+			groupLogger.Warn("Failed To Restart Managed ConsumerGroup With Topics Matching Pattern", zap.Error(err))
+			managedGrp.setTopics(previous)
+			return
+		}
+	}
+	m.notify(ManagerEvent{Event: GroupTopicsChanged, GroupId: groupId})
+}
+
+// equalTopics returns true if the sorted lists of topics are the same
+func equalTopics(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTopicPatternOf(t *testing.T) {
+	pattern, interval, err := topicPatternOf(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, pattern)
+
+	pattern, interval, err = topicPatternOf([]SaramaConsumerHandlerOption{WithTopicPattern(`orders\..*`, 0)})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultTopicPatternInterval, interval)
+	assert.True(t, pattern.MatchString("orders.eu"))
+	assert.False(t, pattern.MatchString("old.orders.eu")) // The pattern must match the whole name
+
+	_, _, err = topicPatternOf([]SaramaConsumerHandlerOption{WithTopicPattern("orders(", time.Second)})
+	assert.NotNil(t, err)
+}
+
+func TestMatchingTopics(t *testing.T) {
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	admin := &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"orders.us": {}, "orders.eu": {}, "payments": {}, "__consumer_offsets": {}}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+
+	pattern, _, _ := topicPatternOf([]SaramaConsumerHandlerOption{WithTopicPattern(`orders\..*`, 0)})
+	topics, err := factory.matchingTopics(pattern, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders.eu", "orders.us"}, topics)
+	assert.True(t, admin.closed)
+
+	// Internal topics never match
+	pattern, _, _ = topicPatternOf([]SaramaConsumerHandlerOption{WithTopicPattern(`.*`, 0)})
+	topics, err = factory.matchingTopics(pattern, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders.eu", "orders.us", "payments"}, topics)
+
+	admin.err = fmt.Errorf("list error")
+	_, err = factory.matchingTopics(pattern, nil)
+	assert.NotNil(t, err)
+}
+
+// topicsConsumerGroup is a mockConsumerGroup that reports the topics of each Consume call, which lasts until the
+// context is done or the group is closed
+type topicsConsumerGroup struct {
+	mockConsumerGroup
+	consumed  chan []string
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (g *topicsConsumerGroup) Consume(ctx context.Context, topics []string, _ sarama.ConsumerGroupHandler) error {
+	g.consumed <- topics
+	select {
+	case <-ctx.Done():
+	case <-g.closed:
+	}
+	return nil
+}
+
+func (g *topicsConsumerGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return nil
+}
+
+func TestTopicPattern(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	consumed := make(chan []string, 10)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &topicsConsumerGroup{consumed: consumed, closed: make(chan struct{})}, nil
+	}
+	admin := &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"payments": {}}}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) { return admin, nil }
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	pattern, _, _ := topicPatternOf([]SaramaConsumerHandlerOption{WithTopicPattern(`orders\..*`, 0)})
+	expectConsumed := func(expected []string) {
+		select {
+		case topics := <-consumed:
+			assert.Equal(t, expected, topics)
+		case <-time.After(shortTimeout):
+			assert.Fail(t, "group did not consume", expected)
+		}
+	}
+	expectNotConsumed := func() {
+		select {
+		case topics := <-consumed:
+			assert.Fail(t, "group consumed unexpectedly", topics)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	notifications := manager.GetNotificationChannel()
+	topicsChanged := make(chan ManagerEvent, 10)
+	go func() {
+		for event := range notifications {
+			if event.Event == GroupTopicsChanged {
+				topicsChanged <- event
+			}
+		}
+	}()
+
+	assert.NotNil(t, manager.StartConsumerGroup("group-invalid", nil, zap.NewNop().Sugar(), mockMessageHandler{}, WithTopicPattern("orders(", 0)))
+
+	// While no topics match, the group does not consume (rather than failing repeatedly)
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"ignored"}, zap.NewNop().Sugar(), mockMessageHandler{},
+		WithTopicPattern(`orders\..*`, time.Hour)))
+	topics, err := manager.Topics("group-id")
+	assert.Nil(t, err)
+	assert.Empty(t, topics)
+	expectNotConsumed()
+	impl.refreshTopicPattern("group-id", pattern)
+	expectNotConsumed()
+
+	// A matching topic appears, which the waiting group consumes without a restart
+	admin.topics = map[string]sarama.TopicDetail{"payments": {}, "orders.eu": {}}
+	impl.refreshTopicPattern("group-id", pattern)
+	expectConsumed([]string{"orders.eu"})
+	assert.Equal(t, ManagerEvent{Event: GroupTopicsChanged, GroupId: "group-id"}, <-topicsChanged)
+
+	// An unchanged set of topics does not restart the group, and a failed resolution leaves the topics unchanged
+	impl.refreshTopicPattern("group-id", pattern)
+	admin.err = fmt.Errorf("list error")
+	impl.refreshTopicPattern("group-id", pattern)
+	admin.err = nil
+	expectNotConsumed()
+
+	// Another matching topic appears, so the group is restarted in order to consume it as well
+	admin.topics = map[string]sarama.TopicDetail{"orders.us": {}, "orders.eu": {}}
+	impl.refreshTopicPattern("group-id", pattern)
+	expectConsumed([]string{"orders.eu", "orders.us"})
+	topics, _ = manager.Topics("group-id")
+	assert.Equal(t, []string{"orders.eu", "orders.us"}, topics)
+	assert.False(t, manager.IsStopped("group-id"))
+
+	// The matching topics disappear, so the group is restarted and waits for them again
+	admin.topics = map[string]sarama.TopicDetail{}
+	impl.refreshTopicPattern("group-id", pattern)
+	expectNotConsumed()
+	assert.False(t, manager.IsStopped("group-id"))
+
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-id", shortTimeout))
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// partitionPauser keeps track of the partitions of a ConsumerGroup that are paused, and of the partitions that
+// are assigned to the current session (since only those may be paused).  Sarama v1.29.1 has no Pause/Resume
+// functions, so a paused partition is implemented by its ConsumeClaim not reading further messages; sarama stops
+// fetching for the partition once its buffer is full.
+type partitionPauser struct {
+	paused   map[string]map[int32]bool
+	assigned map[string][]int32
+	resumed  chan struct{} // Closed (and replaced) whenever partitions are resumed
+	lock     sync.Mutex
+}
+
+// newPartitionPauser returns a partitionPauser with no paused or assigned partitions
+func newPartitionPauser() *partitionPauser {
+	return &partitionPauser{
+		paused:  make(map[string]map[int32]bool),
+		resumed: make(chan struct{}),
+	}
+}
+
+// setAssigned records the partitions claimed by the current session (nil when there is no session)
+func (p *partitionPauser) setAssigned(claims map[string][]int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.assigned = claims
+}
+
+// pause pauses all of the given partitions, unless any of them is not assigned to the current session, in
+// which case none are paused and an error is returned.  A paused partition remains paused until it is resumed,
+// even if it is reassigned by a rebalance in the meantime.
+func (p *partitionPauser) pause(assignments map[string][]int32) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var unassigned []string
+	for topic, partitions := range assignments {
+		for _, partition := range partitions {
+			if !p.isAssigned(topic, partition) {
+				unassigned = append(unassigned, fmt.Sprintf("%s/%d", topic, partition))
+			}
+		}
+	}
+	if len(unassigned) > 0 {
+		sort.Strings(unassigned)
+		return fmt.Errorf("cannot pause partitions that are not assigned to this consumer: %v", unassigned)
+	}
+	for topic, partitions := range assignments {
+		if p.paused[topic] == nil {
+			p.paused[topic] = make(map[int32]bool)
+		}
+		for _, partition := range partitions {
+			p.paused[topic][partition] = true
+		}
+	}
+	return nil
+}
+
+// resume resumes the given partitions; resuming a partition that is not paused has no effect
+func (p *partitionPauser) resume(assignments map[string][]int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for topic, partitions := range assignments {
+		for _, partition := range partitions {
+			delete(p.paused[topic], partition)
+		}
+	}
+	close(p.resumed)
+	p.resumed = make(chan struct{})
+}
+
+// pausedPartitions returns a copy of the paused partitions (by topic, in ascending order)
+func (p *partitionPauser) pausedPartitions() map[string][]int32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pausedLocked()
+}
+
+// pausedLocked returns the partitions of pausedPartitions (the lock must be held)
+func (p *partitionPauser) pausedLocked() map[string][]int32 {
+	paused := make(map[string][]int32, len(p.paused))
+	for topic, partitions := range p.paused {
+		for partition := range partitions {
+			paused[topic] = append(paused[topic], partition)
+		}
+		if len(paused[topic]) > 0 {
+			sort.Slice(paused[topic], func(i, j int) bool { return paused[topic][i] < paused[topic][j] })
+		}
+	}
+	return paused
+}
+
+// assignedPartitions returns a copy of the partitions claimed by the current session (by topic, in ascending order)
+func (p *partitionPauser) assignedPartitions() map[string][]int32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.assignedLocked()
+}
+
+// assignedAndPaused returns the partitions of assignedPartitions and of pausedPartitions at the same point in time
+func (p *partitionPauser) assignedAndPaused() (assigned map[string][]int32, paused map[string][]int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.assignedLocked(), p.pausedLocked()
+}
+
+// assignedLocked returns the partitions of assignedPartitions (the lock must be held)
+func (p *partitionPauser) assignedLocked() map[string][]int32 {
+	assigned := make(map[string][]int32, len(p.assigned))
+	for topic, partitions := range p.assigned {
+		assigned[topic] = append([]int32{}, partitions...)
+		sort.Slice(assigned[topic], func(i, j int) bool { return assigned[topic][i] < assigned[topic][j] })
+	}
+	return assigned
+}
+
+// isAssigned returns true if the partition is claimed by the current session (the lock must be held)
+func (p *partitionPauser) isAssigned(topic string, partition int32) bool {
+	for _, assigned := range p.assigned[topic] {
+		if assigned == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// isPaused returns whether the partition is paused and, if so, a channel that is closed when partitions are resumed
+func (p *partitionPauser) isPaused(topic string, partition int32) (bool, <-chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused[topic][partition], p.resumed
+}
+
+// waitForResume blocks while the partition of the claim is paused, returning false if the session ends first
+func (consumer *SaramaConsumerHandler) waitForResume(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) bool {
+	if consumer.pauser == nil {
+		return true
+	}
+	logged := false
+	for {
+		paused, resumed := consumer.pauser.isPaused(claim.Topic(), claim.Partition())
+		if !paused {
+			if logged {
+				consumer.logger.Infow("Partition resumed", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+			}
+			return true
+		}
+		if !logged {
+			consumer.logger.Infow("Partition paused", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+			logged = true
+		}
+		select {
+		case <-session.Context().Done():
+			return false
+		case <-resumed:
+		}
+	}
+}
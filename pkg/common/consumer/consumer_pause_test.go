@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// claimsSession is a committingSession with a set of claimed partitions
+type claimsSession struct {
+	committingSession
+	claims map[string][]int32
+}
+
+func (s *claimsSession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+// topicClaim is a mockConsumerGroupClaim for a named topic
+type topicClaim struct {
+	mockConsumerGroupClaim
+	topic string
+}
+
+func (c topicClaim) Topic() string {
+	return c.topic
+}
+
+func TestPartitionPauser(t *testing.T) {
+	pauser := newPartitionPauser()
+
+	// Nothing is assigned yet
+	assert.NotNil(t, pauser.pause(map[string][]int32{"topic-1": {0}}))
+
+	pauser.setAssigned(map[string][]int32{"topic-1": {0, 1}, "topic-2": {0}})
+	err := pauser.pause(map[string][]int32{"topic-1": {1, 2}, "topic-3": {0}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "[topic-1/2 topic-3/0]")
+	paused, _ := pauser.isPaused("topic-1", 1)
+	assert.False(t, paused) // Nothing is paused if any partition is unassigned
+
+	assert.Nil(t, pauser.pause(map[string][]int32{"topic-1": {1}, "topic-2": {0}}))
+	paused, resumed := pauser.isPaused("topic-1", 1)
+	assert.True(t, paused)
+	paused, _ = pauser.isPaused("topic-1", 0)
+	assert.False(t, paused)
+
+	// Resuming (including a partition that is not paused) closes the resumed channel
+	pauser.resume(map[string][]int32{"topic-1": {1, 5}})
+	<-resumed
+	paused, _ = pauser.isPaused("topic-1", 1)
+	assert.False(t, paused)
+	paused, _ = pauser.isPaused("topic-2", 0)
+	assert.True(t, paused)
+
+	// A pause outlives the session
+	pauser.setAssigned(nil)
+	paused, _ = pauser.isPaused("topic-2", 0)
+	assert.True(t, paused)
+}
+
+func TestPausedPartitionConsumption(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		resume        bool
+		expectHandled int32
+	}{
+		{
+			name:          "Partition Resumed",
+			resume:        true,
+			expectHandled: 1,
+		},
+		{
+			name: "Session Ends While Paused",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			pauser := newPartitionPauser()
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, withGroupState(&groupState{pauser: pauser}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			session := &claimsSession{committingSession: committingSession{ctx: ctx}, claims: map[string][]int32{"topic-1": {0}}}
+			assert.Nil(t, cgh.Setup(session))
+			assert.Nil(t, pauser.pause(map[string][]int32{"topic-1": {0}}))
+
+			done := make(chan struct{})
+			go func() {
+				_ = cgh.ConsumeClaim(session, topicClaim{mockConsumerGroupClaim: mockConsumerGroupClaim{msg: &mockMessage}, topic: "topic-1"})
+				close(done)
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&handler.handled))
+
+			if testCase.resume {
+				pauser.resume(map[string][]int32{"topic-1": {0}})
+			} else {
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("ConsumeClaim did not return")
+			}
+			cancel()
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.Nil(t, cgh.Cleanup(session))
+			assert.NotNil(t, pauser.pause(map[string][]int32{"topic-1": {0}})) // No longer assigned
+			close(errorCh)
+		})
+	}
+}
+
+var _ sarama.ConsumerGroupSession = (*claimsSession)(nil)
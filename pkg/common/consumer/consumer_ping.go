@@ -0,0 +1,181 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"go.uber.org/multierr"
+)
+
+// The kinds of failure that Ping distinguishes, which can be tested for with errors.Is
+var (
+	ErrBrokerUnreachable    = errors.New("could not connect to broker")            // e.g. connection refused, unknown host, dial timeout
+	ErrBrokerTLS            = errors.New("TLS handshake with broker failed")       // e.g. untrusted certificate, server name mismatch
+	ErrBrokerAuthentication = errors.New("SASL authentication with broker failed") // e.g. wrong credentials or mechanism
+)
+
+// pingError is the failure to ping a single broker, which is one of the kinds above (if it could be determined)
+type pingError struct {
+	broker string
+	kind   error // One of the ErrBroker... errors, or nil
+	err    error
+}
+
+func (e *pingError) Error() string {
+	if e.kind == nil {
+		return fmt.Sprintf("could not fetch metadata from broker '%s' - %v", e.broker, e.err)
+	}
+	return fmt.Sprintf("%v '%s' - %v", e.kind, e.broker, e.err)
+}
+
+func (e *pingError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+func (e *pingError) Unwrap() error {
+	return e.err
+}
+
+// Ping checks that the brokers of the default cluster can be reached with the current settings (as passed to
+// NewConsumerGroupManager or Reconfigure), by opening a short-lived connection to each broker in turn and fetching
+// the cluster metadata, and returns nil as soon as one of them succeeds.  Otherwise the returned error aggregates
+// the failures of the individual brokers, each of which can be tested for the kind of failure with errors.Is and
+// ErrBrokerUnreachable, ErrBrokerTLS or ErrBrokerAuthentication.  The connection timeouts of the settings are
+// shortened to the deadline of the context, if any, and the context error is returned if it is done first.
+// Ping does not affect the managed groups, and may be used by a readiness probe.
+func (m *kafkaConsumerGroupManagerImpl) Ping(ctx context.Context) error {
+	factory := m.getFactory()
+	if len(factory.addrs) == 0 {
+		return fmt.Errorf("could not ping brokers - no brokers are configured")
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not ping brokers - %w", err)
+	}
+	var errs error
+	for _, addr := range factory.addrs {
+		err := pingBroker(ctx, addr, factory.config)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("could not ping brokers - %w", err)
+		}
+		errs = multierr.Append(errs, err)
+	}
+	return errs
+}
+
+// pingBroker opens a connection to the broker at the given address and requests the cluster metadata, returning
+// a pingError if either fails, or the context error if the context is done first
+func pingBroker(ctx context.Context, addr string, config *sarama.Config) error {
+	pingConfig := sarama.NewConfig()
+	if config != nil {
+		copied := *config
+		pingConfig = &copied
+	}
+	pingConfig.MetricRegistry = metrics.NewRegistry() // Keeps the metrics of the short-lived connection separate
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		remaining := time.Until(deadline)
+		for _, timeout := range []*time.Duration{&pingConfig.Net.DialTimeout, &pingConfig.Net.ReadTimeout, &pingConfig.Net.WriteTimeout} {
+			if *timeout <= 0 || *timeout > remaining {
+				*timeout = remaining
+			}
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		broker := sarama.NewBroker(addr)
+		if err := broker.Open(pingConfig); err != nil {
+			result <- &pingError{broker: addr, err: err} // An invalid config, as the connection is opened asynchronously
+			return
+		}
+		defer func() { _ = broker.Close() }()
+		if connected, err := broker.Connected(); err != nil || !connected {
+			if err == nil {
+				err = sarama.ErrNotConnected
+			}
+			result <- &pingError{broker: addr, kind: classifyPingError(err, pingConfig.Net.TLS.Enable, pingConfig.Net.SASL.Enable), err: err}
+			return
+		}
+		if _, err := broker.GetMetadata(&sarama.MetadataRequest{}); err != nil {
+			result <- &pingError{broker: addr, kind: classifyPingError(err, pingConfig.Net.TLS.Enable, false), err: err}
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil && hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded // A shortened timeout expired just before the context
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err() // The goroutine closes the broker once its (shortened) timeouts expire
+	}
+}
+
+// classifyPingError returns the kind of failure (one of the ErrBroker... errors) that the error of opening a
+// connection, or of its first request, represents.  Since the TLS handshake happens on first use, it may fail
+// either during authentication or during the metadata request, and when tlsEnabled is true a connection that is
+// closed at that point (e.g. by a broker that does not expect TLS) is also assumed to be a TLS failure.  Any other
+// failure of authentication is assumed to be a SASL failure when saslEnabled is true.
+func classifyPingError(err error, tlsEnabled bool, saslEnabled bool) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrBrokerUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrBrokerUnreachable
+	}
+
+	var recordErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateErr) || strings.Contains(err.Error(), "tls:") || strings.Contains(err.Error(), "x509:") {
+		return ErrBrokerTLS
+	}
+	if tlsEnabled && (errors.Is(err, io.EOF) || opErr != nil) {
+		return ErrBrokerTLS
+	}
+
+	var kerr sarama.KError
+	if errors.As(err, &kerr) && (kerr == sarama.ErrSASLAuthenticationFailed || kerr == sarama.ErrUnsupportedSASLMechanism ||
+		kerr == sarama.ErrIllegalSASLState) {
+		return ErrBrokerAuthentication
+	}
+	if saslEnabled {
+		return ErrBrokerAuthentication
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestPing(t *testing.T) {
+	// A healthy broker that answers metadata requests
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	// A broker that rejects the SASL mechanism
+	saslBroker := sarama.NewMockBroker(t, 2)
+	defer saslBroker.Close()
+	saslBroker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"SaslHandshakeRequest": sarama.NewMockSaslHandshakeResponse(t).SetError(sarama.ErrUnsupportedSASLMechanism),
+	})
+
+	// A TLS server whose certificate is not trusted
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+
+	// A plaintext listener that closes the connection on receiving a TLS handshake, as a broker would
+	plaintext, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = plaintext.Close() }()
+	go func() {
+		for {
+			conn, err := plaintext.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Read(make([]byte, 4))
+			_ = conn.Close()
+		}
+	}()
+
+	// An address with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedAddr := listener.Addr().String()
+	assert.Nil(t, listener.Close())
+
+	saslConfig := sarama.NewConfig()
+	saslConfig.Net.SASL.Enable = true
+	saslConfig.Net.SASL.User = "user"
+	saslConfig.Net.SASL.Password = "password"
+	tlsConfig := sarama.NewConfig()
+	tlsConfig.Net.TLS.Enable = true
+
+	for _, testCase := range []struct {
+		name      string
+		brokers   []string
+		config    *sarama.Config
+		expectErr error
+	}{
+		{name: "Reachable", brokers: []string{broker.Addr()}, config: sarama.NewConfig()},
+		{name: "First Broker Unreachable", brokers: []string{refusedAddr, broker.Addr()}, config: sarama.NewConfig()},
+		{name: "Connection Refused", brokers: []string{refusedAddr}, config: sarama.NewConfig(), expectErr: ErrBrokerUnreachable},
+		{name: "Untrusted Certificate", brokers: []string{tlsServer.Listener.Addr().String()}, config: tlsConfig, expectErr: ErrBrokerTLS},
+		{name: "Plaintext Broker", brokers: []string{plaintext.Addr().String()}, config: tlsConfig, expectErr: ErrBrokerTLS},
+		{name: "SASL Failure", brokers: []string{saslBroker.Addr()}, config: saslConfig, expectErr: ErrBrokerAuthentication},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), testCase.brokers, testCase.config)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := manager.Ping(ctx)
+			if testCase.expectErr == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, testCase.expectErr), err)
+			for _, other := range []error{ErrBrokerUnreachable, ErrBrokerTLS, ErrBrokerAuthentication} {
+				if other != testCase.expectErr {
+					assert.False(t, errors.Is(err, other), err)
+				}
+			}
+			assert.Contains(t, err.Error(), testCase.brokers[0])
+		})
+	}
+}
+
+func TestPingContext(t *testing.T) {
+	// A listener that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{listener.Addr().String()}, sarama.NewConfig())
+
+	// The deadline of the context shortens the read timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = manager.Ping(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	// A done context fails immediately
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	assert.True(t, errors.Is(manager.Ping(cancelled), context.Canceled))
+
+	// No brokers
+	manager = NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	assert.NotNil(t, manager.Ping(context.Background()))
+}
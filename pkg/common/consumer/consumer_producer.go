@@ -0,0 +1,46 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+
+	"github.com/Shopify/sarama"
+)
+
+// newSyncProducer is a wrapper for the Sarama NewSyncProducer function, to facilitate unit testing
+var newSyncProducer = sarama.NewSyncProducer
+
+// producerContextKey is the key of the group's producer in the context passed to the KafkaConsumerHandler
+type producerContextKey struct{}
+
+// WithProducer makes the KafkaConsumerGroupFactory create a sarama SyncProducer along with the ConsumerGroup, using
+// the same brokers and config (including any TLS and SASL settings).  The producer is passed to the handler in the
+// context of each message (see ProducerFromContext), so that transformed messages can be re-published within the
+// lifecycle of the group, and it is closed when the group is closed.  Default is no producer.
+func WithProducer() SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.producerRequested = true
+	}
+}
+
+// ProducerFromContext returns the producer of the ConsumerGroup that is handling the message, or nil if the group
+// was not started with the WithProducer option.  The producer must not be closed by the handler.
+func ProducerFromContext(ctx context.Context) sarama.SyncProducer {
+	producer, _ := ctx.Value(producerContextKey{}).(sarama.SyncProducer)
+	return producer
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// closeRecordingProducer is a sarama.SyncProducer that only records whether it has been closed
+type closeRecordingProducer struct {
+	sarama.SyncProducer
+	closed bool
+}
+
+func (p *closeRecordingProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func restoreNewSyncProducer(fn func(addrs []string, config *sarama.Config) (sarama.SyncProducer, error)) {
+	newSyncProducer = fn
+}
+
+func TestCreateProducer(t *testing.T) {
+	defer restoreNewSyncProducer(newSyncProducer)
+	for _, testCase := range []struct {
+		name        string
+		options     []SaramaConsumerHandlerOption
+		producerErr bool
+		expectNil   bool
+		expectErr   bool
+	}{
+		{
+			name:      "No Producer Requested",
+			expectNil: true,
+		},
+		{
+			name:    "Producer Requested",
+			options: []SaramaConsumerHandlerOption{WithProducer()},
+		},
+		{
+			name:        "Producer Creation Error",
+			options:     []SaramaConsumerHandlerOption{WithProducer()},
+			producerErr: true,
+			expectNil:   true,
+			expectErr:   true,
+		},
+		{
+			name:      "Invalid Group Config",
+			options:   []SaramaConsumerHandlerOption{WithProducer(), WithMaxPartitionFetchRecords(0)},
+			expectNil: true,
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var producerConfig *sarama.Config
+			newSyncProducer = func(addrs []string, config *sarama.Config) (sarama.SyncProducer, error) {
+				producerConfig = config
+				if testCase.producerErr {
+					return nil, fmt.Errorf("producer error")
+				}
+				return &closeRecordingProducer{}, nil
+			}
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+			factory.config.Net.SASL.Enable = true
+
+			producer, err := factory.createProducer(testCase.options...)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			assert.Equal(t, testCase.expectNil, producer == nil)
+			if !testCase.expectNil {
+				// The producer shares the auth settings of the group, but must not modify the factory's config
+				assert.True(t, producerConfig.Net.SASL.Enable)
+				assert.True(t, producerConfig.Producer.Return.Successes)
+				assert.False(t, factory.config.Producer.Return.Successes)
+			}
+		})
+	}
+}
+
+func TestProducerFromContext(t *testing.T) {
+	producer := &closeRecordingProducer{}
+
+	handler := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, withGroupState(&groupState{producer: producer}))
+	assert.Same(t, producer, ProducerFromContext(handler.decorateContext(&sarama.ConsumerMessage{})))
+
+	handler = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil)
+	assert.Nil(t, ProducerFromContext(handler.decorateContext(&sarama.ConsumerMessage{})))
+}
+
+func TestProducerClosedWithGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer restoreNewSyncProducer(newSyncProducer)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+	producer := &closeRecordingProducer{}
+	newSyncProducer = func(addrs []string, config *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+
+	// A group started by the factory
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	group, err := factory.StartConsumerGroup("bla", []string{}, zap.NewNop().Sugar(), mockMessageHandler{}, WithProducer())
+	assert.Nil(t, err)
+	assert.False(t, producer.closed)
+	assert.Nil(t, group.Close())
+	assert.True(t, producer.closed)
+
+	// A managed group
+	producer = &closeRecordingProducer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	managedGrp := createManagedGroup(ctx, zap.NewNop(), &mockConsumerGroup{}, cancel, func() {}, &groupState{producer: producer})
+	assert.Nil(t, managedGrp.stop())
+	assert.False(t, producer.closed)
+	assert.Nil(t, managedGrp.close())
+	assert.True(t, producer.closed)
+}
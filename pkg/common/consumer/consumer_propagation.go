@@ -0,0 +1,151 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	// TraceParentHeader is the key of the W3C Trace Context header that identifies the span of the producer
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader is the key of the W3C Trace Context header that carries vendor-specific trace data
+	TraceStateHeader = "tracestate"
+)
+
+// traceParentPattern matches a traceparent value of any version: version, trace ID, parent span ID and flags (a
+// future version may append more fields)
+var traceParentPattern = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}(-.*)?$`)
+
+// HeaderCarrier gives a Propagator access to the headers of a message.  It has the methods of the TextMapCarrier of
+// OpenTelemetry, so that it can be passed to the Extract of an OpenTelemetry TextMapPropagator.
+type HeaderCarrier interface {
+	// Get returns the value of the header with the given key, or "" if there is none
+	Get(key string) string
+	// Set replaces the value of the header with the given key, adding the header if there is none
+	Set(key string, value string)
+	// Keys returns the keys of the headers
+	Keys() []string
+}
+
+// Propagator extracts the trace context (or any other propagated data) that the producer of a message put into its
+// headers, and returns a context carrying it
+type Propagator interface {
+	Extract(ctx context.Context, carrier HeaderCarrier) context.Context
+}
+
+// PropagatorFunc allows a function to be used as a Propagator, such as one that calls an OpenTelemetry propagator:
+//
+//	consumer.PropagatorFunc(func(ctx context.Context, carrier consumer.HeaderCarrier) context.Context {
+//		return otel.GetTextMapPropagator().Extract(ctx, carrier)
+//	})
+type PropagatorFunc func(ctx context.Context, carrier HeaderCarrier) context.Context
+
+// Extract calls the function
+func (f PropagatorFunc) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	return f(ctx, carrier)
+}
+
+// WithPropagator extracts the trace context of each message from its headers with the given Propagator, into the
+// context passed to the handler (and to any interceptors), so that the spans that the handler starts are children of
+// the span of the producer.  For OpenTelemetry, the Propagator calls the Extract of an OpenTelemetry propagator (see
+// PropagatorFunc); TraceContextPropagator extracts the W3C Trace Context headers without depending on a tracing
+// library.  Default is no extraction.
+func WithPropagator(propagator Propagator) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.propagator = propagator
+	}
+}
+
+// TraceContext is the W3C Trace Context that TraceContextPropagator extracts from the headers of a message
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+// traceContextKey is the key of the TraceContext in the context passed to the KafkaConsumerHandler
+type traceContextKey struct{}
+
+// TraceContextPropagator is a Propagator that extracts the W3C Trace Context headers (traceparent and tracestate) of
+// a message into the context, where they are obtained with TraceContextFromContext.  A traceparent that is not well
+// formed is ignored, along with the tracestate.
+var TraceContextPropagator Propagator = PropagatorFunc(extractTraceContext)
+
+// extractTraceContext returns a context carrying the TraceContext of the headers, if they have a valid traceparent
+func extractTraceContext(ctx context.Context, carrier HeaderCarrier) context.Context {
+	traceParent := carrier.Get(TraceParentHeader)
+	if !traceParentPattern.MatchString(traceParent) {
+		return ctx
+	}
+	return context.WithValue(ctx, traceContextKey{}, TraceContext{TraceParent: traceParent, TraceState: carrier.Get(TraceStateHeader)})
+}
+
+// TraceContextFromContext returns the TraceContext that TraceContextPropagator extracted from the message being
+// handled, and false if there is none
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	traceContext, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return traceContext, ok
+}
+
+// messageHeaders is the HeaderCarrier of the headers of a message
+type messageHeaders struct {
+	message *sarama.ConsumerMessage
+}
+
+// Get returns the value of the first header with the given key, or "" if there is none
+func (h messageHeaders) Get(key string) string {
+	for _, header := range h.message.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Set replaces the value of the first header with the given key, adding a header if there is none
+func (h messageHeaders) Set(key string, value string) {
+	for _, header := range h.message.Headers {
+		if header != nil && string(header.Key) == key {
+			header.Value = []byte(value)
+			return
+		}
+	}
+	h.message.Headers = append(h.message.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+// Keys returns the keys of the headers
+func (h messageHeaders) Keys() []string {
+	keys := make([]string, 0, len(h.message.Headers))
+	for _, header := range h.message.Headers {
+		if header != nil {
+			keys = append(keys, string(header.Key))
+		}
+	}
+	return keys
+}
+
+// extractPropagated returns a context carrying what the Propagator of WithPropagator extracted from the headers
+// of the message, if there is a Propagator
+func (consumer *SaramaConsumerHandler) extractPropagated(ctx context.Context, message *sarama.ConsumerMessage) context.Context {
+	if consumer.propagator == nil {
+		return ctx
+	}
+	return consumer.propagator.Extract(ctx, messageHeaders{message: message})
+}
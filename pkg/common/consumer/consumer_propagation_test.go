@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const validTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceContextPropagator(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		headers     []*sarama.RecordHeader
+		options     []SaramaConsumerHandlerOption
+		expect      TraceContext
+		expectFound bool
+	}{
+		{
+			name:    "No Propagator",
+			headers: []*sarama.RecordHeader{{Key: []byte(TraceParentHeader), Value: []byte(validTraceParent)}},
+		},
+		{
+			name: "Trace Context Extracted",
+			headers: []*sarama.RecordHeader{
+				{Key: []byte(TraceParentHeader), Value: []byte(validTraceParent)},
+				{Key: []byte(TraceStateHeader), Value: []byte("vendor=value")},
+			},
+			options:     []SaramaConsumerHandlerOption{WithPropagator(TraceContextPropagator)},
+			expect:      TraceContext{TraceParent: validTraceParent, TraceState: "vendor=value"},
+			expectFound: true,
+		},
+		{
+			name:    "Malformed Trace Parent",
+			headers: []*sarama.RecordHeader{{Key: []byte(TraceParentHeader), Value: []byte("00-not-a-trace-01")}},
+			options: []SaramaConsumerHandlerOption{WithPropagator(TraceContextPropagator)},
+		},
+		{
+			name:    "No Headers",
+			options: []SaramaConsumerHandlerOption{WithPropagator(TraceContextPropagator)},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := contextRecordingHandler{ctx: make(chan context.Context, 1)}
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, testCase.options...)
+			message := &sarama.ConsumerMessage{Topic: "topic", Value: []byte("value"), Headers: testCase.headers}
+			_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, mockConsumerGroupClaim{msg: message})
+
+			traceContext, found := TraceContextFromContext(<-handler.ctx)
+			assert.Equal(t, testCase.expectFound, found)
+			assert.Equal(t, testCase.expect, traceContext)
+			close(errorCh)
+		})
+	}
+}
+
+func TestPropagatorFunc(t *testing.T) {
+	type spanKey struct{}
+	propagator := PropagatorFunc(func(ctx context.Context, carrier HeaderCarrier) context.Context {
+		return context.WithValue(ctx, spanKey{}, carrier.Get("span"))
+	})
+	handler := contextRecordingHandler{ctx: make(chan context.Context, 1)}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, make(chan error, 1), WithPropagator(propagator))
+	message := &sarama.ConsumerMessage{Headers: []*sarama.RecordHeader{{Key: []byte("span"), Value: []byte("parent")}}}
+	_ = cgh.ConsumeClaim(&mockConsumerGroupSession{}, mockConsumerGroupClaim{msg: message})
+	assert.Equal(t, "parent", (<-handler.ctx).Value(spanKey{}))
+}
+
+func TestMessageHeaders(t *testing.T) {
+	message := &sarama.ConsumerMessage{Headers: []*sarama.RecordHeader{
+		{Key: []byte("a"), Value: []byte("1")},
+		nil,
+		{Key: []byte("a"), Value: []byte("2")},
+	}}
+	carrier := messageHeaders{message: message}
+	assert.Equal(t, "1", carrier.Get("a"))
+	assert.Equal(t, "", carrier.Get("b"))
+	assert.Equal(t, []string{"a", "a"}, carrier.Keys())
+
+	carrier.Set("a", "3")
+	carrier.Set("b", "4")
+	assert.Equal(t, "3", carrier.Get("a"))
+	assert.Equal(t, "4", carrier.Get("b"))
+	assert.Equal(t, []string{"a", "a", "b"}, carrier.Keys())
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"github.com/Shopify/sarama"
+	"golang.org/x/time/rate"
+)
+
+// WithRateLimit caps the number of messages per second that are passed to the handler, using a token bucket that
+// allows bursts of up to the given size.  Each ConsumerGroup that the option is given to has a limiter of its own,
+// which is shared by all of its partitions and sessions, and waiting for it holds the message the same way as a
+// paused partition, so consumption (and eventually fetching) slows down to the configured rate.  The wait ends early
+// if the session ends, so the limiter does not delay a rebalance or shutdown.  Default is unlimited; a rate of zero
+// or less also means unlimited, and a burst smaller than one means one.
+func WithRateLimit(rps float64, burst int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.rateLimit = rps
+		handler.rateBurst = burst
+	}
+}
+
+// newRateLimiter returns the limiter of the rate and burst of WithRateLimit, or nil if the rate is unlimited
+func newRateLimiter(rps float64, burst int) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(rps), burst)
+}
+
+// waitForRateLimit blocks until the rate limiter (if any, preferring that of WithAdaptiveRateLimit) allows another
+// message, returning false if the session ends first
+func (consumer *SaramaConsumerHandler) waitForRateLimit(session sarama.ConsumerGroupSession) bool {
+	limiter := consumer.rateLimiter
+	if consumer.adaptiveRate != nil {
+		limiter = consumer.adaptiveRate.limiter
+	}
+	if limiter == nil {
+		return true
+	}
+	return limiter.Wait(session.Context()) == nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRateLimit(t *testing.T) {
+	for _, testCase := range []struct {
+		name       string
+		rps        float64
+		burst      int
+		messages   int
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{
+			name:       "Unlimited",
+			messages:   20,
+			maxElapsed: 100 * time.Millisecond,
+		},
+		{
+			name:       "Throttled",
+			rps:        100,
+			burst:      1,
+			messages:   21, // The first message uses the initial token, and the rest wait 10ms each
+			minElapsed: 180 * time.Millisecond,
+			maxElapsed: 2 * time.Second,
+		},
+		{
+			name:       "Burst",
+			rps:        1,
+			burst:      10,
+			messages:   10,
+			maxElapsed: 100 * time.Millisecond,
+		},
+		{
+			name:       "Burst Below One",
+			rps:        100,
+			messages:   11,
+			minElapsed: 80 * time.Millisecond,
+			maxElapsed: 2 * time.Second,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			messages := make([]*sarama.ConsumerMessage, testCase.messages)
+			for i := range messages {
+				messages[i] = &sarama.ConsumerMessage{Offset: int64(i)}
+			}
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, nil, WithRateLimit(testCase.rps, testCase.burst))
+
+			start := time.Now()
+			assert.Nil(t, cgh.ConsumeClaim(&mockConsumerGroupSession{}, multiMessageClaim{messages: messages}))
+			elapsed := time.Since(start)
+
+			assert.Equal(t, int32(testCase.messages), atomic.LoadInt32(&handler.handled))
+			assert.GreaterOrEqual(t, int64(elapsed), int64(testCase.minElapsed))
+			assert.Less(t, int64(elapsed), int64(testCase.maxElapsed))
+		})
+	}
+}
+
+func TestRateLimitInterruptedBySession(t *testing.T) {
+	handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, nil, WithRateLimit(0.1, 1))
+	messages := []*sarama.ConsumerMessage{{Offset: 0}, {Offset: 1}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = cgh.ConsumeClaim(&committingSession{ctx: ctx}, multiMessageClaim{messages: messages})
+		close(done)
+	}()
+
+	// The second message would be delayed for ten seconds if the wait were not interrupted
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim did not return")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handler.handled))
+}
+
+func TestRateLimiterPerGroup(t *testing.T) {
+	option := WithRateLimit(1, 1)
+
+	// Each group that is given the option has its own limiter
+	first := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, option)
+	second := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, option)
+	assert.NotNil(t, first.rateLimiter)
+	assert.NotSame(t, first.rateLimiter, second.rateLimiter)
+
+	// The sessions of a group share the limiter that the factory created for it
+	limiter := newRateLimiter(1, 0)
+	assert.Equal(t, 1, limiter.Burst())
+	first = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, withGroupState(&groupState{rateLimiter: limiter}), option)
+	second = NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, withGroupState(&groupState{rateLimiter: limiter}), option)
+	assert.Same(t, limiter, first.rateLimiter)
+	assert.Same(t, limiter, second.rateLimiter)
+
+	assert.Nil(t, newRateLimiter(0, 1))
+}
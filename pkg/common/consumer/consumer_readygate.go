@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// defaultReadyGatePollInterval is how often a closed ReadyGate is polled, if no interval is given
+const defaultReadyGatePollInterval = time.Second
+
+// ReadyGate reports whether the downstream of a handler (a queue, a service, etc.) can accept messages
+type ReadyGate interface {
+	Ready() bool
+}
+
+// WithReadyGate makes the consumer consult the gate before passing each message to the handler.  While the gate
+// is not ready, consumption of the partition pauses (polling the gate at the given interval) instead of sending
+// messages that the handler would fail.  The session and its heartbeats are unaffected, so the group membership
+// stays stable during a downstream outage, and sarama stops fetching for the partition once its buffer is full.
+// A rebalance still ends the pause.  Sarama v1.29.1 has no Pause/Resume functions, so the partition consumer
+// is paused by not reading from it rather than explicitly.  Default is no gate (always ready); an interval of
+// zero or less means one second.
+func WithReadyGate(gate ReadyGate, pollInterval time.Duration) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.readyGate = gate
+		handler.readyGatePollInterval = pollInterval
+	}
+}
+
+// waitForReadyGate blocks until the ReadyGate (if any) is ready, returning false if the session ends first
+func (consumer *SaramaConsumerHandler) waitForReadyGate(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) bool {
+	if consumer.readyGate == nil || consumer.readyGate.Ready() {
+		return true
+	}
+
+	interval := consumer.readyGatePollInterval
+	if interval <= 0 {
+		interval = defaultReadyGatePollInterval
+	}
+	consumer.logger.Infow("Downstream not ready - pausing partition consumer", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.Context().Done():
+			return false
+		case <-ticker.C:
+			if consumer.readyGate.Ready() {
+				consumer.logger.Infow("Downstream ready - resuming partition consumer", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// switchableGate is a ReadyGate whose readiness may be changed by the test
+type switchableGate struct {
+	ready int32
+	polls int32
+}
+
+func (g *switchableGate) Ready() bool {
+	atomic.AddInt32(&g.polls, 1)
+	return atomic.LoadInt32(&g.ready) == 1
+}
+
+func TestReadyGate(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		becomeReady   bool
+		expectHandled int32
+	}{
+		{
+			name:          "Downstream Becomes Ready",
+			becomeReady:   true,
+			expectHandled: 1,
+		},
+		{
+			name: "Session Ends While Paused",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			gate := &switchableGate{}
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			errorCh := make(chan error, 1)
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, WithReadyGate(gate, 5*time.Millisecond))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			session := &committingSession{ctx: ctx}
+			done := make(chan struct{})
+			go func() {
+				_ = cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &mockMessage})
+				close(done)
+			}()
+
+			// The message is held while the gate is not ready
+			time.Sleep(30 * time.Millisecond)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&handler.handled))
+			assert.Greater(t, atomic.LoadInt32(&gate.polls), int32(1))
+
+			if testCase.becomeReady {
+				atomic.StoreInt32(&gate.ready, 1)
+			} else {
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("ConsumeClaim did not return")
+			}
+			cancel()
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.Equal(t, testCase.becomeReady, session.marked)
+			close(errorCh)
+		})
+	}
+}
+
+func TestReadyGateAlreadyReady(t *testing.T) {
+	gate := &switchableGate{ready: 1}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, WithReadyGate(gate, 0))
+	assert.True(t, cgh.waitForReadyGate(&mockConsumerGroupSession{}, mockConsumerGroupClaim{}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gate.polls))
+}
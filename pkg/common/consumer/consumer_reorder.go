@@ -0,0 +1,281 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// WithTimestampOrdering makes the ConsumerGroup pass the messages of all of its claimed partitions to the handler
+// in approximate timestamp order, for consumers that prefer event-time ordering across partitions (such as those
+// of time series) and can accept some added latency.  Each message is held in a buffer shared by the partitions
+// of the session for the given window after it is received, and the buffered message with the earliest timestamp
+// is released to the handler once it has been held for the window, so a message of one partition is handled
+// before a later one of another partition if it is received at most the window after it.  The buffer holds at
+// most maxBuffered messages; when it is full, the earliest message is released without waiting, and the claims
+// stop receiving (and eventually fetching) until there is room again.
+//
+// The ordering is approximate:  the messages of each partition are still handled in offset order, so a message
+// whose timestamp is earlier than that of a message before it (which is possible with CreateTime timestamps) is
+// held behind it; a message that is received more than the window late is handled after later messages that were
+// already released; and the order only covers the partitions that are claimed by the same session.  Messages
+// without a timestamp are ordered by the time they were received.  The messages are handled one at a time, so
+// WithMaxInFlightPerPartition and WithClaimWorkers have no effect.
+//
+// A message is only marked once it has been released and handled, and each partition is marked in offset order,
+// so that the committed offsets never pass a buffered message.  When the session ends (e.g. on a rebalance) the
+// buffered messages are discarded without being marked, so they are consumed again by whichever member claims
+// their partitions next; delivery remains at-least-once.  The window must be positive and maxBuffered must be at
+// least one.  Default is no reordering (the partitions are consumed independently).
+func WithTimestampOrdering(window time.Duration, maxBuffered int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.reorderWindow = window
+		handler.reorderMaxBuffered = maxBuffered
+		handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+			if window <= 0 {
+				return fmt.Errorf("invalid timestamp ordering window: %v (must be positive)", window)
+			}
+			if maxBuffered < 1 {
+				return fmt.Errorf("invalid timestamp ordering buffer size: %d (must be at least 1)", maxBuffered)
+			}
+			return nil
+		})
+	}
+}
+
+// reorderedMessage is a message held by the timestampReorderer, with what is needed to handle it once it is released
+type reorderedMessage struct {
+	message   *sarama.ConsumerMessage
+	handler   KafkaConsumerHandler
+	claim     sarama.ConsumerGroupClaim
+	timestamp time.Time // The timestamp of the message, or the time it was received if it has none
+	received  time.Time
+}
+
+// topicPartition identifies a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// reorderQueue holds the buffered messages of one partition, in offset order
+type reorderQueue struct {
+	messages []*reorderedMessage
+	index    int // The position of the queue in the reorderHeap (-1 while it is empty)
+}
+
+// reorderHeap orders the non-empty reorderQueues by the timestamp of their first message (then by topic and
+// partition, so that the order is deterministic), so that the first one holds the earliest message that may be
+// released
+type reorderHeap []*reorderQueue
+
+func (h reorderHeap) Len() int { return len(h) }
+
+func (h reorderHeap) Less(i, j int) bool {
+	a, b := h[i].messages[0], h[j].messages[0]
+	if !a.timestamp.Equal(b.timestamp) {
+		return a.timestamp.Before(b.timestamp)
+	}
+	if a.message.Topic != b.message.Topic {
+		return a.message.Topic < b.message.Topic
+	}
+	return a.message.Partition < b.message.Partition
+}
+
+func (h reorderHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *reorderHeap) Push(x interface{}) {
+	queue := x.(*reorderQueue)
+	queue.index = len(*h)
+	*h = append(*h, queue)
+}
+
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	queue := old[len(old)-1]
+	old[len(old)-1] = nil
+	queue.index = -1
+	*h = old[:len(old)-1]
+	return queue
+}
+
+// timestampReorderer buffers the messages that the claims of a session receive, and passes them to the handler
+// (in its dispatch goroutine, one at a time) in the order described by WithTimestampOrdering
+type timestampReorderer struct {
+	consumer    *SaramaConsumerHandler
+	session     sarama.ConsumerGroupSession
+	window      time.Duration
+	maxBuffered int
+
+	incoming chan *reorderedMessage           // Messages received by the claims
+	drops    chan topicPartition              // Partitions whose claims ended before the session did
+	stopped  chan struct{}                    // Closed by stop
+	done     chan struct{}                    // Closed when the dispatch goroutine exits
+	queues   map[topicPartition]*reorderQueue // Owned by the dispatch goroutine, as are the heads and the count
+	heads    reorderHeap
+	buffered int
+}
+
+// newTimestampReorderer returns a timestampReorderer for the given session, with its dispatch goroutine started
+func newTimestampReorderer(consumer *SaramaConsumerHandler, session sarama.ConsumerGroupSession) *timestampReorderer {
+	r := &timestampReorderer{
+		consumer:    consumer,
+		session:     session,
+		window:      consumer.reorderWindow,
+		maxBuffered: consumer.reorderMaxBuffered,
+		incoming:    make(chan *reorderedMessage),
+		drops:       make(chan topicPartition),
+		stopped:     make(chan struct{}),
+		done:        make(chan struct{}),
+		queues:      make(map[topicPartition]*reorderQueue),
+	}
+	if r.maxBuffered < 1 {
+		r.maxBuffered = 1
+	}
+	go r.dispatch()
+	return r
+}
+
+// add passes a message received by a claim to the dispatch goroutine, returning false if the session ends first
+func (r *timestampReorderer) add(handler KafkaConsumerHandler, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage) bool {
+	received := time.Now()
+	timestamp := message.Timestamp
+	if timestamp.IsZero() {
+		timestamp = received
+	}
+	select {
+	case r.incoming <- &reorderedMessage{message: message, handler: handler, claim: claim, timestamp: timestamp, received: received}:
+		return true
+	case <-r.session.Context().Done():
+		return false
+	case <-r.stopped:
+		return false
+	}
+}
+
+// drop discards the buffered messages of a partition whose claim ended while the session continues (such as when
+// its offset was out of range), so that they are not handled after ConsumeClaim returns
+func (r *timestampReorderer) drop(topic string, partition int32) {
+	select {
+	case r.drops <- topicPartition{topic: topic, partition: partition}:
+	case <-r.session.Context().Done():
+	case <-r.stopped:
+	}
+}
+
+// stop ends the dispatch goroutine, discarding any buffered messages, and waits for it to exit
+func (r *timestampReorderer) stop() {
+	close(r.stopped)
+	<-r.done
+}
+
+// dispatch receives the messages of the claims and releases them to the handler until the session ends
+func (r *timestampReorderer) dispatch() {
+	defer close(r.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var release <-chan time.Time
+		if r.buffered >= r.maxBuffered {
+			r.release()
+			continue
+		} else if r.buffered > 0 {
+			wait := time.Until(r.heads[0].messages[0].received.Add(r.window))
+			if wait <= 0 {
+				r.release()
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			release = timer.C
+		}
+
+		select {
+		case message := <-r.incoming:
+			r.push(message)
+		case partition := <-r.drops:
+			r.discard(partition)
+		case <-release:
+			r.release()
+		case <-r.session.Context().Done():
+			return
+		case <-r.stopped:
+			return
+		}
+	}
+}
+
+// push adds a message to the end of the queue of its partition
+func (r *timestampReorderer) push(message *reorderedMessage) {
+	key := topicPartition{topic: message.message.Topic, partition: message.message.Partition}
+	queue, ok := r.queues[key]
+	if !ok {
+		queue = &reorderQueue{index: -1}
+		r.queues[key] = queue
+	}
+	queue.messages = append(queue.messages, message)
+	r.buffered++
+	if queue.index < 0 {
+		heap.Push(&r.heads, queue)
+	}
+}
+
+// discard removes the buffered messages of a partition without handling them
+func (r *timestampReorderer) discard(partition topicPartition) {
+	queue, ok := r.queues[partition]
+	if !ok {
+		return
+	}
+	if queue.index >= 0 {
+		heap.Remove(&r.heads, queue.index)
+	}
+	r.buffered -= len(queue.messages)
+	delete(r.queues, partition)
+}
+
+// release removes the earliest buffered message and passes it to the handler, marking it if the handler asks
+// for it, unless the session has ended
+func (r *timestampReorderer) release() {
+	queue := r.heads[0]
+	next := queue.messages[0]
+	queue.messages[0] = nil
+	queue.messages = queue.messages[1:]
+	r.buffered--
+	if len(queue.messages) == 0 {
+		heap.Pop(&r.heads)
+	} else {
+		heap.Fix(&r.heads, 0)
+	}
+
+	if r.session.Context().Err() != nil {
+		return
+	}
+	r.consumer.finishHandling(r.session, r.consumer.startHandling(next.handler, next.claim, next.message, nil), r.consumer.newDrainDeadline())
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// orderRecordingHandler is a KafkaConsumerHandler that records the partition and offset of each message it handles
+type orderRecordingHandler struct {
+	lock    sync.Mutex
+	handled []string
+}
+
+func (h *orderRecordingHandler) Handle(_ context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handled = append(h.handled, fmt.Sprintf("%d/%d", message.Partition, message.Offset))
+	return true, nil
+}
+
+func (h *orderRecordingHandler) SetReady(int32, bool) {}
+
+func (h *orderRecordingHandler) GetConsumerGroup() string {
+	return "group"
+}
+
+func (h *orderRecordingHandler) getHandled() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.handled...)
+}
+
+// reorderSession is a mockConsumerGroupSession with a context that can be cancelled, which records the marked
+// messages by partition
+type reorderSession struct {
+	mockConsumerGroupSession
+	ctx    context.Context
+	lock   sync.Mutex
+	marked map[int32][]int64
+}
+
+func (s *reorderSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.marked[msg.Partition] = append(s.marked[msg.Partition], msg.Offset)
+}
+
+func (s *reorderSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *reorderSession) getMarked() map[int32][]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	marked := make(map[int32][]int64)
+	for partition, offsets := range s.marked {
+		marked[partition] = append([]int64(nil), offsets...)
+	}
+	return marked
+}
+
+// partitionClaim is a channelClaim of a given partition
+type partitionClaim struct {
+	channelClaim
+	partition int32
+}
+
+func (c partitionClaim) Topic() string {
+	return "topic"
+}
+
+func (c partitionClaim) Partition() int32 {
+	return c.partition
+}
+
+func TestTimestampOrdering(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	message := func(partition int32, offset int64, second int) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Topic: "topic", Partition: partition, Offset: offset, Timestamp: start.Add(time.Duration(second) * time.Second)}
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		window        time.Duration
+		maxBuffered   int
+		messages      []*sarama.ConsumerMessage
+		closeClaim    bool // Close the claim of partition 0 (as if its offset was out of range) after sending
+		expectHandled []string
+		expectMarked  map[int32][]int64
+	}{
+		{
+			name:        "Ordered Across Partitions",
+			window:      200 * time.Millisecond,
+			maxBuffered: 100,
+			messages: []*sarama.ConsumerMessage{message(0, 10, 1), message(0, 11, 4), message(0, 12, 5),
+				message(1, 20, 2), message(1, 21, 3), message(1, 22, 6)},
+			expectHandled: []string{"0/10", "1/20", "1/21", "0/11", "0/12", "1/22"},
+			expectMarked:  map[int32][]int64{0: {10, 11, 12}, 1: {20, 21, 22}},
+		},
+		{
+			name:        "Partition Order Preserved",
+			window:      200 * time.Millisecond,
+			maxBuffered: 100,
+			messages:    []*sarama.ConsumerMessage{message(0, 10, 5), message(0, 11, 1), message(1, 20, 3)},
+			// The message at offset 11 is held behind the later one at offset 10, so 1/20 comes first
+			expectHandled: []string{"1/20", "0/10", "0/11"},
+			expectMarked:  map[int32][]int64{0: {10, 11}, 1: {20}},
+		},
+		{
+			name:          "Buffer Full",
+			window:        time.Hour,
+			maxBuffered:   1,
+			messages:      []*sarama.ConsumerMessage{message(0, 10, 2), message(0, 11, 1)},
+			expectHandled: []string{"0/10", "0/11"},
+			expectMarked:  map[int32][]int64{0: {10, 11}},
+		},
+		{
+			name:          "Session Ends With Buffered Messages",
+			window:        time.Hour,
+			maxBuffered:   100,
+			messages:      []*sarama.ConsumerMessage{message(0, 10, 1), message(1, 20, 2)},
+			expectHandled: nil,
+			expectMarked:  map[int32][]int64{},
+		},
+		{
+			name:          "Claim Ends Before Session",
+			window:        200 * time.Millisecond,
+			maxBuffered:   100,
+			messages:      []*sarama.ConsumerMessage{message(0, 10, 1), message(1, 20, 2)},
+			closeClaim:    true,
+			expectHandled: []string{"1/20"},
+			expectMarked:  map[int32][]int64{1: {20}},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := &orderRecordingHandler{}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, make(chan error, 10), WithTimestampOrdering(testCase.window, testCase.maxBuffered))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			session := &reorderSession{ctx: ctx, marked: make(map[int32][]int64)}
+			claims := []partitionClaim{
+				{channelClaim: channelClaim{messages: make(chan *sarama.ConsumerMessage, 10)}, partition: 0},
+				{channelClaim: channelClaim{messages: make(chan *sarama.ConsumerMessage, 10)}, partition: 1},
+			}
+
+			assert.Nil(t, cgh.Setup(session))
+			var claimsDone sync.WaitGroup
+			for _, claim := range claims {
+				claimsDone.Add(1)
+				go func(claim partitionClaim) {
+					defer claimsDone.Done()
+					assert.Nil(t, cgh.ConsumeClaim(session, claim))
+				}(claim)
+			}
+
+			// All of the messages are received before the first one is released
+			for _, message := range testCase.messages {
+				claims[message.Partition].messages <- message
+			}
+			if testCase.closeClaim {
+				close(claims[0].messages)
+				claims[0].messages = nil
+			}
+			if testCase.expectHandled != nil {
+				assert.Eventually(t, func() bool { return len(handler.getHandled()) >= len(testCase.expectHandled) }, 5*time.Second, 5*time.Millisecond)
+			}
+			if testCase.window < time.Second {
+				time.Sleep(2 * testCase.window) // Nothing else is released
+			}
+
+			cancel()
+			for _, claim := range claims {
+				if claim.messages != nil {
+					close(claim.messages)
+				}
+			}
+			claimsDone.Wait()
+			assert.Nil(t, cgh.Cleanup(session))
+
+			assert.Equal(t, testCase.expectHandled, handler.getHandled())
+			assert.Equal(t, testCase.expectMarked, session.getMarked())
+		})
+	}
+}
+
+func TestTimestampOrderingValidation(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		window      time.Duration
+		maxBuffered int
+		expectErr   bool
+	}{
+		{name: "Valid", window: time.Second, maxBuffered: 1},
+		{name: "Zero Window", window: 0, maxBuffered: 10, expectErr: true},
+		{name: "Negative Window", window: -time.Second, maxBuffered: 10, expectErr: true},
+		{name: "Zero Buffer", window: time.Second, maxBuffered: 0, expectErr: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1), WithTimestampOrdering(testCase.window, testCase.maxBuffered))
+			assert.Len(t, cgh.configModifiers, 0) // Validation only, which does not require a config of its own
+			assert.Len(t, cgh.configValidators, 1)
+			err := cgh.configValidators[0](sarama.NewConfig())
+			assert.Equal(t, testCase.expectErr, err != nil)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// WithStartOffsets makes the consumer begin each of the given partitions (by topic) at the given offset, instead of
+// at the committed offset, the first time that the partition is claimed by this member of the group.  The offset
+// is applied (and committed along with the marked offsets) when the session that claims the partition is set up,
+// so a later session of the same group continues from the marked offsets rather than starting over, even if the
+// group is stopped and started by the manager.  The partitions that are not in the map begin at the committed
+// offset as usual.  Default is to begin every partition at its committed offset.
+func WithStartOffsets(offsets map[string]map[int32]int64) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.startOffsets = offsets
+	}
+}
+
+// WithEndOffsets makes the consumer stop delivering the messages of each of the given partitions (by topic) once it
+// reaches the given offset, which is exclusive: the messages before it are passed to the handler, and those at or
+// after it are not.  Each partition stops independently, without affecting the session (its messages are simply
+// no longer read, so sarama stops fetching them once its buffer is full), and once all of them have stopped, the
+// consume loop of a ConsumerGroup started by the factory ends with a GroupReplayFinished event; a managed group is
+// then closed (and removed from management).  Together with WithStartOffsets, this replays a bounded window of
+// each partition.
+//
+// The boundary is at-least-once, as for any other message: a message before the end offset may be delivered again
+// if its session ends before it was committed (such as on a rebalance), but a message at or after the end offset
+// is never delivered.  A partition only stops when a message at or after the offset just before the end offset has
+// been received (or when the partition is claimed at or beyond the end offset), so an end offset beyond the last
+// message of a partition keeps it waiting for new messages, and the group is only closed once this member has
+// stopped every partition in the map, so a replay is meant for a group with a single member.  The partitions that
+// are not in the map are consumed as usual.  Default is no end offsets.
+func WithEndOffsets(offsets map[string]map[int32]int64) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.endOffsets = offsets
+	}
+}
+
+// replayTracker records the partitions of a ConsumerGroup that WithStartOffsets has positioned, and those that have
+// reached their WithEndOffsets offset.
+type replayTracker struct {
+	lock      sync.Mutex
+	started   map[topicPartition]bool // The partitions whose start offset was applied
+	remaining map[topicPartition]bool // The partitions whose end offset has not been reached
+	bounded   bool                    // Whether there are any end offsets
+}
+
+// newReplayTracker returns a replayTracker that waits for the partitions of the given end offsets
+func newReplayTracker(endOffsets map[string]map[int32]int64) *replayTracker {
+	tracker := &replayTracker{started: make(map[topicPartition]bool), remaining: make(map[topicPartition]bool)}
+	for topic, partitions := range endOffsets {
+		for partition := range partitions {
+			tracker.remaining[topicPartition{topic: topic, partition: partition}] = true
+			tracker.bounded = true
+		}
+	}
+	return tracker
+}
+
+// startOnce returns true the first time it is called for the partition
+func (t *replayTracker) startOnce(topic string, partition int32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := topicPartition{topic: topic, partition: partition}
+	if t.started[key] {
+		return false
+	}
+	t.started[key] = true
+	return true
+}
+
+// reached records that the partition has reached its end offset
+func (t *replayTracker) reached(topic string, partition int32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.remaining, topicPartition{topic: topic, partition: partition})
+}
+
+// hasReached returns true if the partition has reached its end offset
+func (t *replayTracker) hasReached(topic string, partition int32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.bounded && !t.remaining[topicPartition{topic: topic, partition: partition}]
+}
+
+// finished returns true if there are end offsets, and every partition has reached its end offset
+func (t *replayTracker) finished() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.bounded && len(t.remaining) == 0
+}
+
+// applyStartOffsets moves the claimed partitions of WithStartOffsets to their start offset, if they have not been
+// moved already.  It must be called by Setup, before sarama begins consuming the claims.
+func (consumer *SaramaConsumerHandler) applyStartOffsets(session sarama.ConsumerGroupSession) {
+	if len(consumer.startOffsets) == 0 {
+		return
+	}
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			offset, ok := consumer.startOffsets[topic][partition]
+			if !ok || !consumer.replay.startOnce(topic, partition) {
+				continue
+			}
+			moveOffset(session, topic, partition, offset)
+			consumer.logger.Infow("Moved partition to its start offset", zap.String("topic", topic), zap.Int32("partition", partition),
+				zap.Int64("offset", offset))
+		}
+	}
+}
+
+// moveOffset moves the offset of a claimed partition of the session to the given offset, in either direction
+func moveOffset(session sarama.ConsumerGroupSession, topic string, partition int32, offset int64) {
+	// Sarama only moves the offset backwards with ResetOffset, and forwards with MarkOffset
+	session.ResetOffset(topic, partition, offset, "")
+	session.MarkOffset(topic, partition, offset, "")
+}
+
+// endOffset returns the end offset of the partition, if it has one
+func (consumer *SaramaConsumerHandler) endOffset(topic string, partition int32) (int64, bool) {
+	offset, ok := consumer.endOffsets[topic][partition]
+	return offset, ok
+}
+
+// claimEnded returns true if the claimed partition has already reached its end offset, recording that if the claim
+// begins at or beyond it
+func (consumer *SaramaConsumerHandler) claimEnded(claim sarama.ConsumerGroupClaim) bool {
+	end, ok := consumer.endOffset(claim.Topic(), claim.Partition())
+	if !ok {
+		return false
+	}
+	if claim.InitialOffset() >= end {
+		consumer.replay.reached(claim.Topic(), claim.Partition())
+	}
+	return consumer.replay.hasReached(claim.Topic(), claim.Partition())
+}
+
+// reachEnd records that the partition of the claim has reached its end offset
+func (consumer *SaramaConsumerHandler) reachEnd(claim sarama.ConsumerGroupClaim) {
+	consumer.logger.Infow("Partition reached its end offset", zap.String("topic", claim.Topic()), zap.Int32("partition", claim.Partition()))
+	consumer.replay.reached(claim.Topic(), claim.Partition())
+}
+
+// waitAfterEnd keeps the ConsumeClaim of a partition that reached its end offset from returning (which would end the
+// session) until the session ends, ending it right away if every partition has reached its end offset
+func (consumer *SaramaConsumerHandler) waitAfterEnd(session sarama.ConsumerGroupSession) {
+	if consumer.replay.finished() && consumer.rejoin != nil {
+		consumer.logger.Info("All partitions reached their end offsets, ending the session")
+		consumer.rejoin()
+	}
+	<-session.Context().Done()
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// replaySession is a mockConsumerGroupSession with claims and a context, which records the offsets it is given
+type replaySession struct {
+	mockConsumerGroupSession
+	ctx     context.Context
+	claims  map[string][]int32
+	lock    sync.Mutex
+	offsets []string
+}
+
+func (s *replaySession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *replaySession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *replaySession) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.record("reset", topic, partition, offset)
+}
+
+func (s *replaySession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.record("mark", topic, partition, offset)
+}
+
+func (s *replaySession) record(action string, topic string, partition int32, offset int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.offsets = append(s.offsets, fmt.Sprintf("%s %s/%d %d", action, topic, partition, offset))
+}
+
+// replayClaim is a claim of the "topic" partition 0 whose messages channel stays open, as it does in sarama
+type replayClaim struct {
+	initial  int64
+	messages chan *sarama.ConsumerMessage
+}
+
+func newReplayClaim(initial int64, offsets ...int64) replayClaim {
+	claim := replayClaim{initial: initial, messages: make(chan *sarama.ConsumerMessage, len(offsets))}
+	for _, offset := range offsets {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: offset}
+	}
+	return claim
+}
+
+func (c replayClaim) Topic() string                            { return "topic" }
+func (c replayClaim) Partition() int32                         { return 0 }
+func (c replayClaim) InitialOffset() int64                     { return c.initial }
+func (c replayClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c replayClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestStartOffsets(t *testing.T) {
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1),
+		WithStartOffsets(map[string]map[int32]int64{"topic": {0: 5, 1: 7}}))
+	session := &replaySession{ctx: context.Background(), claims: map[string][]int32{"topic": {0, 2}}}
+
+	_ = cgh.Setup(session)
+	assert.Equal(t, []string{"reset topic/0 5", "mark topic/0 5"}, session.offsets)
+
+	// A later session continues from the marked offsets
+	session.claims = map[string][]int32{"topic": {0, 1}}
+	_ = cgh.Setup(session)
+	assert.Equal(t, []string{"reset topic/0 5", "mark topic/0 5", "reset topic/1 7", "mark topic/1 7"}, session.offsets)
+}
+
+func TestEndOffsets(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		claim         replayClaim
+		expectHandled int32
+	}{
+		{
+			name:          "Message Before End Offset",
+			claim:         newReplayClaim(0, 0, 1, 2, 3, 4),
+			expectHandled: 3,
+		},
+		{
+			name:          "Message At End Offset",
+			claim:         newReplayClaim(0, 0, 1, 5),
+			expectHandled: 2,
+		},
+		{
+			name:  "Claimed At End Offset",
+			claim: newReplayClaim(3, 3, 4),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, make(chan error, 1), withRejoin(cancel),
+				WithEndOffsets(map[string]map[int32]int64{"topic": {0: 3}}))
+			session := &replaySession{ctx: ctx}
+
+			done := make(chan struct{})
+			go func() {
+				_ = cgh.ConsumeClaim(session, testCase.claim)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(shortTimeout):
+				assert.Fail(t, "ConsumeClaim did not return after the end offset was reached")
+			}
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.True(t, cgh.replay.finished())
+		})
+	}
+}
+
+func TestEndOffsetsWaitForAllPartitions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, make(chan error, 1), withRejoin(cancel),
+		WithEndOffsets(map[string]map[int32]int64{"topic": {0: 2, 1: 2}}))
+	session := &replaySession{ctx: ctx}
+
+	// Partition 0 stops delivering, but keeps the session going while partition 1 has not reached its end
+	done := make(chan struct{})
+	go func() {
+		_ = cgh.ConsumeClaim(session, newReplayClaim(0, 0, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.Fail(t, "ConsumeClaim returned before the other partition reached its end offset")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.False(t, cgh.replay.finished())
+	cancel()
+	<-done
+}
+
+// replayConsumerGroup is a closableConsumerGroup whose Consume runs one session of the claim
+type replayConsumerGroup struct {
+	closableConsumerGroup
+	claim replayClaim
+}
+
+func (g *replayConsumerGroup) Consume(ctx context.Context, _ []string, handler sarama.ConsumerGroupHandler) error {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session := &replaySession{ctx: sessionCtx, claims: map[string][]int32{"topic": {0}}}
+	_ = handler.Setup(session)
+	_ = handler.ConsumeClaim(session, g.claim)
+	_ = handler.Cleanup(session)
+	return nil
+}
+
+func TestReplayFinishedClosesManagedGroup(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &replayConsumerGroup{closableConsumerGroup: closableConsumerGroup{closed: make(chan struct{})}, claim: newReplayClaim(1, 1, 2)}, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, sarama.NewConfig())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true},
+		WithStartOffsets(map[string]map[int32]int64{"topic": {0: 1}}), WithEndOffsets(map[string]map[int32]int64{"topic": {0: 3}})))
+	managedGrp := impl.getGroup("group-id")
+	assert.Nil(t, managedGrp.waitForConsumeExit(shortTimeout))
+	// The events are not checked, since the GroupReplayFinished and GroupClosed events follow each other too closely
+	// for a listener to be sure of receiving both
+	assert.False(t, manager.IsManaged("group-id"))
+}
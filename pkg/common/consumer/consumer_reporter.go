@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// ConsumerGroupMetricsReporter receives the activity of the ConsumerGroups, so that it can be exported to a metrics
+// system (the prometheus subpackage provides one for Prometheus).  Its functions are called from the goroutines of
+// the groups, so they must be safe for concurrent use and return quickly.  A reporter may also implement
+// GenerationReporter to receive the generations of the groups, and CommitGapReporter to receive their commit gaps.
+type ConsumerGroupMetricsReporter interface {
+	// GroupStarted is called when a managed group is created, or started again after it was stopped
+	GroupStarted(groupId string)
+	// GroupStopped is called when a managed group is stopped or closed
+	GroupStopped(groupId string)
+	// GroupRestarted is called when the consume loop of a group begins a new session after a failed one, and when
+	// a supervised group is re-created (see WithSupervision)
+	GroupRestarted(groupId string)
+	// GroupError is called for each error sent to the handler errors channel of a group (including those dropped
+	// by the policy of WithErrorChannel)
+	GroupError(groupId string, err error)
+	// MessageConsumed is called when a message is received from a partition, before it is passed to the handler
+	MessageConsumed(groupId string, topic string, partition int32)
+	// PartitionLag is called along with MessageConsumed, with the number of messages of the partition that follow
+	// the one received (according to the high water mark that the broker last reported)
+	PartitionLag(groupId string, topic string, partition int32, lag int64)
+}
+
+// WithMetricsReporter makes the factory's ConsumerGroups report their activity to the given reporter.  The starts
+// and stops are those of the groups of a manager.  Default is no reporting.
+func WithMetricsReporter(reporter ConsumerGroupMetricsReporter) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.metricsReporter = reporter
+	}
+}
+
+// groupMetrics reports the activity of one ConsumerGroup to a ConsumerGroupMetricsReporter.  A nil groupMetrics
+// reports nothing.
+type groupMetrics struct {
+	reporter ConsumerGroupMetricsReporter
+	groupId  string
+}
+
+// newGroupMetrics returns the groupMetrics of the group, or nil if there is no reporter
+func newGroupMetrics(reporter ConsumerGroupMetricsReporter, groupId string) *groupMetrics {
+	if reporter == nil {
+		return nil
+	}
+	return &groupMetrics{reporter: reporter, groupId: groupId}
+}
+
+// restarted reports that the consume loop is beginning a new session after a failed one
+func (g *groupMetrics) restarted() {
+	if g != nil {
+		g.reporter.GroupRestarted(g.groupId)
+	}
+}
+
+// failed reports an error of the group
+func (g *groupMetrics) failed(err error) {
+	if g != nil {
+		g.reporter.GroupError(g.groupId, err)
+	}
+}
+
+// consumed reports a message received from the claim, and the lag of its partition
+func (g *groupMetrics) consumed(claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage) {
+	if g == nil {
+		return
+	}
+	g.reporter.MessageConsumed(g.groupId, message.Topic, message.Partition)
+	lag := claim.HighWaterMarkOffset() - message.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	g.reporter.PartitionLag(g.groupId, message.Topic, message.Partition, lag)
+}
+
+// generation reports the generation of a new session, if the reporter is a GenerationReporter
+func (g *groupMetrics) generation(generationId int32) {
+	if g == nil {
+		return
+	}
+	if reporter, ok := g.reporter.(GenerationReporter); ok {
+		reporter.GroupGeneration(g.groupId, generationId)
+	}
+}
+
+// generationChurn reports the churn of the generation, if the reporter is a GenerationReporter
+func (g *groupMetrics) generationChurn(increments int, window time.Duration) {
+	if g == nil {
+		return
+	}
+	if reporter, ok := g.reporter.(GenerationReporter); ok {
+		reporter.GenerationChurn(g.groupId, increments, window)
+	}
+}
+
+// commitGaps reports the commit gaps of the partitions, if the reporter is a CommitGapReporter
+func (g *groupMetrics) commitGaps(gaps map[string]map[int32]int64) {
+	if g == nil {
+		return
+	}
+	if reporter, ok := g.reporter.(CommitGapReporter); ok {
+		for topic, partitions := range gaps {
+			for partition, gap := range partitions {
+				reporter.CommitGap(g.groupId, topic, partition, gap)
+			}
+		}
+	}
+}
+
+// commitGapsReleased reports the partitions whose commit gaps are no longer tracked, if the reporter is a
+// CommitGapReporter
+func (g *groupMetrics) commitGapsReleased(partitions []topicPartition) {
+	if g == nil {
+		return
+	}
+	if reporter, ok := g.reporter.(CommitGapReporter); ok {
+		for _, partition := range partitions {
+			reporter.CommitGapReleased(g.groupId, partition.topic, partition.partition)
+		}
+	}
+}
+
+// reportEvent reports the starts, stops and re-creations among the events of the manager to the reporter of its
+// default factory (which has the same options as the factories of the other clusters)
+func (m *kafkaConsumerGroupManagerImpl) reportEvent(event ManagerEvent) {
+	factory := m.getFactory()
+	if factory == nil || factory.metricsReporter == nil {
+		return
+	}
+	switch event.Event {
+	case GroupCreated, GroupStarted:
+		factory.metricsReporter.GroupStarted(event.GroupId)
+	case GroupStopped, GroupClosed:
+		factory.metricsReporter.GroupStopped(event.GroupId)
+	case GroupRecreated:
+		factory.metricsReporter.GroupRestarted(event.GroupId)
+	}
+}
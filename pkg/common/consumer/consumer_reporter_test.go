@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// recordingReporter is a ConsumerGroupMetricsReporter that records the calls made to it
+type recordingReporter struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (r *recordingReporter) record(call string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recordingReporter) recorded() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+func (r *recordingReporter) GroupStarted(groupId string) { r.record("started " + groupId) }
+func (r *recordingReporter) GroupStopped(groupId string) { r.record("stopped " + groupId) }
+func (r *recordingReporter) GroupRestarted(groupId string) {
+	r.record("restarted " + groupId)
+}
+func (r *recordingReporter) GroupError(groupId string, err error) {
+	r.record(fmt.Sprintf("error %s %v", groupId, err))
+}
+func (r *recordingReporter) MessageConsumed(groupId string, topic string, partition int32) {
+	r.record(fmt.Sprintf("consumed %s %s/%d", groupId, topic, partition))
+}
+func (r *recordingReporter) PartitionLag(groupId string, topic string, partition int32, lag int64) {
+	r.record(fmt.Sprintf("lag %s %s/%d %d", groupId, topic, partition, lag))
+}
+
+// highWaterMarkClaim is a mockConsumerGroupClaim with a high water mark
+type highWaterMarkClaim struct {
+	mockConsumerGroupClaim
+	highWaterMark int64
+}
+
+func (c highWaterMarkClaim) HighWaterMarkOffset() int64 {
+	return c.highWaterMark
+}
+
+func TestGroupMetrics(t *testing.T) {
+	// A nil groupMetrics reports nothing
+	var metrics *groupMetrics
+	assert.Nil(t, newGroupMetrics(nil, "group-id"))
+	metrics.restarted()
+	metrics.failed(fmt.Errorf("test error"))
+	metrics.consumed(highWaterMarkClaim{}, &sarama.ConsumerMessage{})
+
+	reporter := &recordingReporter{}
+	metrics = newGroupMetrics(reporter, "group-id")
+	message := &sarama.ConsumerMessage{Topic: "topic", Partition: 2, Offset: 4}
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error, 1), withGroupState(&groupState{metrics: metrics}))
+	_ = cgh.ConsumeClaim(&committingSession{ctx: context.Background()}, highWaterMarkClaim{mockConsumerGroupClaim: mockConsumerGroupClaim{msg: message}, highWaterMark: 10})
+	cgh.sendError(fmt.Errorf("test error"))
+	metrics.consumed(highWaterMarkClaim{highWaterMark: 2}, message) // A stale high water mark is not a negative lag
+	assert.Equal(t, []string{"consumed group-id topic/2", "lag group-id topic/2 5", "error group-id test error",
+		"consumed group-id topic/2", "lag group-id topic/2 0"}, reporter.recorded())
+}
+
+// failOnceConsumerGroup is a mockConsumerGroup whose first Consume fails, and whose later ones last until the
+// context is done
+type failOnceConsumerGroup struct {
+	mockConsumerGroup
+	calls int32
+}
+
+func (g *failOnceConsumerGroup) Consume(ctx context.Context, _ []string, _ sarama.ConsumerGroupHandler) error {
+	if atomic.AddInt32(&g.calls, 1) == 1 {
+		return fmt.Errorf("session error")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestManagerMetricsReporter(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	group := &failOnceConsumerGroup{}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return group, nil
+	}
+	reporter := &recordingReporter{}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{}, WithMetricsReporter(reporter))
+
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&group.calls) == 2 }, shortTimeout, time.Millisecond)
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-id", shortTimeout))
+	assert.Equal(t, []string{"started group-id", "error group-id session error", "restarted group-id", "stopped group-id"}, reporter.recorded())
+}
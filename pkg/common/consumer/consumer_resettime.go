@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+)
+
+// resetOffsets commits the offsets of the given time (in milliseconds since the epoch, or sarama.OffsetOldest or
+// sarama.OffsetNewest) as those of every partition of the topics of a stopped managed group, so that the group
+// resumes from the first message at or after that time when it is started again.  The offsets are looked up with
+// the offset-for-times request of the brokers; a partition that has no message at or after the time is reset to
+// its newest offset.  It is the handler of the ResetOffsetsOpCode of the control-protocol, which locks and unlocks
+// the group in the same manner as the commands that stop and start it, so that a remote reset is a sequence of a
+// stop (locking the group), a reset, and a start (unlocking it).  Nothing is committed if the offset of any
+// partition cannot be looked up.
+func (m *kafkaConsumerGroupManagerImpl) resetOffsets(lock *commands.CommandLock, groupId string, offsetTime int64) error {
+	groupLogger := m.logger.With(zap.String("GroupId", groupId), zap.Int64("OffsetTime", offsetTime))
+	managedGrp := m.getGroup(groupId)
+
+	// Lock the managedGroup before resetting its offsets, if lock.LockBefore is true
+	if err := m.lockBefore(lock, groupId, managedGrp); err != nil {
+		groupLogger.Error("Failed to lock consumer group prior to resetting offsets", zap.Error(err))
+		return err
+	}
+
+	groupLogger.Info("Resetting Offsets Of Managed ConsumerGroup")
+	if managedGrp == nil {
+		groupLogger.Info("ConsumerGroup Not Managed - Ignoring Reset Request")
+		return fmt.Errorf("offset reset requested for consumer group not in managed list: %s", groupId)
+	}
+	if offsetTime < sarama.OffsetOldest {
+		return fmt.Errorf("could not reset offsets of consumer group with id '%s' - invalid offset time %d", groupId, offsetTime)
+	}
+	if !managedGrp.isStopped() {
+		return fmt.Errorf("could not reset offsets of consumer group with id '%s' - group is not stopped", groupId)
+	}
+
+	factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+	if err != nil {
+		return err
+	}
+	client, err := newCommitClient(factory)
+	if err != nil {
+		return fmt.Errorf("could not reset offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	defer func() {
+		if closeErr := client.Close(); closeErr != nil {
+			groupLogger.Warn("Failed To Close Sarama Client", zap.Error(closeErr))
+		}
+	}()
+
+	offsets, err := offsetsForTime(client, managedGrp.topics(), offsetTime)
+	if err != nil {
+		return fmt.Errorf("could not reset offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	if err := commitOffsets(client, factory.brokerGroupId(groupId), offsets); err != nil {
+		return fmt.Errorf("could not reset offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	groupLogger.Info("Reset Offsets Of Managed ConsumerGroup", zap.Any("Offsets", offsets))
+
+	// Unlock the managedGroup after resetting its offsets, if lock.UnlockAfter is true
+	if err := m.unlockAfter(lock, groupId, managedGrp); err != nil {
+		groupLogger.Error("Failed to unlock consumer group after resetting offsets", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// offsetsForTime returns the offset of the first message at or after the given time of every partition of the
+// topics, or the newest offset of a partition that has no such message
+func offsetsForTime(client sarama.Client, topics []string, offsetTime int64) (map[string]map[int32]int64, error) {
+	offsets := make(map[string]map[int32]int64, len(topics))
+	sorted := append([]string(nil), topics...)
+	sort.Strings(sorted)
+	for _, topic := range sorted {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the partitions of topic %s: %w", topic, err)
+		}
+		offsets[topic] = make(map[int32]int64, len(partitions))
+		for _, partition := range partitions {
+			offset, err := client.GetOffset(topic, partition, offsetTime)
+			if err == nil && offset < 0 {
+				offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest) // No message at or after the time
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get the offset of topic %s, partition %d: %w", topic, partition, err)
+			}
+			offsets[topic][partition] = offset
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+	controltesting "knative.dev/eventing-kafka/pkg/common/controlprotocol/testing"
+)
+
+func TestResetOffsets(t *testing.T) {
+	const offsetTime = int64(1600000000000)
+	for _, testCase := range []struct {
+		name          string
+		groupId       string
+		running       bool
+		command       *commands.ConsumerGroupAsyncCommand
+		expectErr     string
+		expectCommits map[int32]int64
+	}{
+		{
+			name:      "Unmanaged Group",
+			command:   commands.NewResetOffsetsAsyncCommand(1, "", "other", offsetTime, nil),
+			expectErr: "consumer group not in managed list",
+		},
+		{
+			name:      "Running Group",
+			running:   true,
+			command:   commands.NewResetOffsetsAsyncCommand(1, "", "group", offsetTime, nil),
+			expectErr: "not stopped",
+		},
+		{
+			name:      "No Offset Time",
+			command:   commands.NewConsumerGroupAsyncCommand(1, "", "group", nil),
+			expectErr: "no offset time",
+		},
+		{
+			name:      "Invalid Offset Time",
+			command:   commands.NewResetOffsetsAsyncCommand(1, "", "group", -3, nil),
+			expectErr: "invalid offset time",
+		},
+		{
+			name:          "Offsets Reset To Time",
+			command:       commands.NewResetOffsetsAsyncCommand(1, "", "group", offsetTime, nil),
+			expectCommits: map[int32]int64{0: 10, 1: 70, 2: 100}, // Backwards, forwards, and no message after the time
+		},
+		{
+			name:          "Offsets Reset To Oldest",
+			command:       commands.NewResetOffsetsAsyncCommand(1, "", "group", sarama.OffsetOldest, nil),
+			expectCommits: map[int32]int64{0: 5, 1: 5, 2: 5},
+		},
+		{
+			name:          "Locked Group",
+			command:       commands.NewResetOffsetsAsyncCommand(1, "", "group", offsetTime, commands.NewCommandLock("token", time.Minute, true, true)),
+			expectCommits: map[int32]int64{0: 10, 1: 70, 2: 100},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			metadataResponse := sarama.NewMockMetadataResponse(t).SetController(broker.BrokerID()).SetBroker(broker.Addr(), broker.BrokerID())
+			offsetResponse := sarama.NewMockOffsetResponse(t).SetVersion(1).
+				SetOffset("topic", 0, offsetTime, 10).
+				SetOffset("topic", 1, offsetTime, 70).
+				SetOffset("topic", 2, offsetTime, -1) // No message at or after the time
+			for partition := int32(0); partition < 3; partition++ {
+				offsetResponse.SetOffset("topic", partition, sarama.OffsetOldest, 5).SetOffset("topic", partition, sarama.OffsetNewest, 100)
+				metadataResponse.SetLeader("topic", partition, broker.BrokerID())
+			}
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": metadataResponse,
+				"OffsetRequest":   offsetResponse,
+				"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+					SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+				"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+					SetOffset("group", "topic", 0, 50, "", sarama.ErrNoError).
+					SetOffset("group", "topic", 1, 50, "", sarama.ErrNoError).
+					SetOffset("group", "topic", 2, 50, "", sarama.ErrNoError),
+				"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+			})
+
+			config := sarama.NewConfig()
+			config.Version = sarama.V2_0_0_0
+			config.Metadata.Retry.Max = 0
+			server := controltesting.NewFakeServerHandler()
+			manager := NewConsumerGroupManager(zap.NewNop(), server, []string{broker.Addr()}, config)
+			group := &mockManagedGroup{}
+			group.On("isStopped").Return(!testCase.running)
+			group.On("handlerOptions").Return(nil)
+			group.On("topics").Return([]string{"topic"})
+			group.On("processLock", testCase.command.Lock, mock.Anything).Return(nil)
+			manager.(*kafkaConsumerGroupManagerImpl).groups["group"] = group
+
+			result, err := server.SendAsyncCommand(context.Background(), commands.ResetOffsetsOpCode, testCase.command)
+			assert.Nil(t, err)
+			if testCase.expectErr != "" {
+				assert.Contains(t, result.Error, testCase.expectErr)
+			} else {
+				assert.Empty(t, result.Error)
+				// The group is locked and unlocked in the same manner as by the stop and start commands
+				group.AssertCalled(t, "processLock", testCase.command.Lock, true)
+				group.AssertCalled(t, "processLock", testCase.command.Lock, false)
+			}
+
+			commits := make(map[int32]int64)
+			for _, requestResponse := range broker.History() {
+				if request, ok := requestResponse.Request.(*sarama.OffsetCommitRequest); ok {
+					for partition := int32(0); partition < 3; partition++ {
+						if offset, _, err := request.Offset("topic", partition); err == nil {
+							commits[partition] = offset
+						}
+					}
+				}
+			}
+			if testCase.expectCommits != nil {
+				assert.Equal(t, testCase.expectCommits, commits)
+			} else {
+				assert.Empty(t, commits)
+			}
+		})
+	}
+}
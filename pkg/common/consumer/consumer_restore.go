@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// RestoreOffsets commits the given offsets (keyed by topic and partition, such as a snapshot returned by
+// CommittedOffsets) as those of a stopped managed group, so that the group resumes from them when it is started
+// again.  Each offset must be within the range of the offsets of its partition (at least the oldest offset that
+// retention has kept, and at most the offset that the next message will have), and nothing is committed if any of
+// them is not.  The partitions that are not in the map keep their committed offsets.  The offsets are committed
+// (in a single request) with a short-lived client of the cluster of the group, since the ClusterAdmin of sarama
+// cannot alter the offsets of a group, and the broker rejects the commit while any member (such as another
+// replica) is still in the group.
+//
+// Restoring offsets is not exactly-once: the messages after a restored offset that were already handled (after
+// the snapshot was taken) are delivered again, and the messages that were skipped over (if the restored offset
+// is ahead of what was handled) are never delivered.  Since retention may have deleted the data of an old snapshot,
+// such a snapshot may also no longer be valid to restore.
+func (m *kafkaConsumerGroupManagerImpl) RestoreOffsets(groupId string, offsets map[string]map[int32]int64) error {
+	if err := validateGroupId(groupId); err != nil {
+		return fmt.Errorf("could not restore offsets of consumer group - %w", err)
+	}
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil {
+		return fmt.Errorf("could not restore offsets of consumer group with id '%s' - group is not present in the managed map", groupId)
+	}
+	if !managedGrp.isStopped() {
+		return fmt.Errorf("could not restore offsets of consumer group with id '%s' - group is not stopped", groupId)
+	}
+
+	factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+	if err != nil {
+		return err
+	}
+	client, err := newCommitClient(factory)
+	if err != nil {
+		return fmt.Errorf("could not restore offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	defer func() {
+		if closeErr := client.Close(); closeErr != nil {
+			m.logger.Warn("Failed To Close Sarama Client", zap.Error(closeErr))
+		}
+	}()
+
+	if err := checkOffsetRanges(client, offsets); err != nil {
+		return fmt.Errorf("could not restore offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	if err := commitOffsets(client, factory.brokerGroupId(groupId), offsets); err != nil {
+		return fmt.Errorf("could not restore offsets of consumer group with id '%s' - %w", groupId, err)
+	}
+	m.logger.Info("Restored Offsets Of Managed ConsumerGroup", zap.String("GroupId", groupId), zap.Any("Offsets", offsets))
+	return nil
+}
+
+// newCommitClient returns a short-lived client of the cluster of the factory, with which offsets are committed (and
+// looked up, as by WithDeferredStart and the stall check)
+func newCommitClient(factory *kafkaConsumerGroupFactoryImpl) (sarama.Client, error) {
+	config := sarama.NewConfig()
+	if factory.config != nil {
+		copied := *factory.config
+		config = &copied
+	}
+	config.Consumer.Return.Errors = true              // So that the failed commits can be returned
+	config.Consumer.Offsets.AutoCommit.Enable = false // The offsets are committed once, explicitly
+	config.MetricRegistry = metrics.NewRegistry()     // Keeps the metrics of the short-lived client separate
+	return newClient(factory.addrs, config)
+}
+
+// checkOffsetRanges returns an error describing each of the offsets that is outside of the range of the offsets of
+// its partition
+func checkOffsetRanges(client sarama.Client, offsets map[string]map[int32]int64) error {
+	var errs error
+	for _, topic := range sortedTopics(offsets) {
+		partitions := offsets[topic]
+		for _, partition := range sortedPartitions(partitions) {
+			offset := partitions[partition]
+			oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("could not get the oldest offset of topic %s, partition %d: %w", topic, partition, err))
+				continue
+			}
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("could not get the newest offset of topic %s, partition %d: %w", topic, partition, err))
+				continue
+			}
+			if offset < oldest || offset > newest {
+				errs = multierr.Append(errs, fmt.Errorf("offset %d of topic %s, partition %d is outside of the range [%d, %d]",
+					offset, topic, partition, oldest, newest))
+			}
+		}
+	}
+	return errs
+}
+
+// commitOffsets commits the offsets as those of the group (as known to the broker), returning the errors of the
+// commit
+func commitOffsets(client sarama.Client, brokerGroupId string, offsets map[string]map[int32]int64) error {
+	offsetManager, err := sarama.NewOffsetManagerFromClient(brokerGroupId, client)
+	if err != nil {
+		return err
+	}
+	var partitionManagers []sarama.PartitionOffsetManager
+	var errs error
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			partitionManager, err := offsetManager.ManagePartition(topic, partition)
+			if err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("could not manage the offset of topic %s, partition %d: %w", topic, partition, err))
+				continue
+			}
+			partitionManagers = append(partitionManagers, partitionManager)
+			// Sarama only moves the offset backwards with ResetOffset, and forwards with MarkOffset
+			partitionManager.ResetOffset(offset, "")
+			partitionManager.MarkOffset(offset, "")
+		}
+	}
+	if errs == nil {
+		offsetManager.Commit()
+	}
+	_ = offsetManager.Close() // Releases the partition managers, so that their errors can be drained
+	for _, partitionManager := range partitionManagers {
+		for err := range partitionManager.Errors() {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// sortedTopics returns the topics of the map in ascending order
+func sortedTopics(offsets map[string]map[int32]int64) []string {
+	sorted := make([]string, 0, len(offsets))
+	for topic := range offsets {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// sortedPartitions returns the partitions of the map in ascending order
+func sortedPartitions(partitions map[int32]int64) []int32 {
+	sorted := make([]int32, 0, len(partitions))
+	for partition := range partitions {
+		sorted = append(sorted, partition)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
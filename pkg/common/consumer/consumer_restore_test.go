@@ -0,0 +1,138 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRestoreOffsets(t *testing.T) {
+	const brokerGroupId = "prod.group"
+	for _, testCase := range []struct {
+		name          string
+		groupId       string
+		running       bool
+		offsets       map[string]map[int32]int64
+		commitErr     sarama.KError
+		expectErr     string
+		expectCommits map[int32]int64
+	}{
+		{
+			name:      "Unmanaged Group",
+			groupId:   "other",
+			offsets:   map[string]map[int32]int64{"topic": {0: 10}},
+			expectErr: "not present in the managed map",
+		},
+		{
+			name:      "Running Group",
+			groupId:   "group",
+			running:   true,
+			offsets:   map[string]map[int32]int64{"topic": {0: 10}},
+			expectErr: "not stopped",
+		},
+		{
+			name:      "Offset Below The Oldest",
+			groupId:   "group",
+			offsets:   map[string]map[int32]int64{"topic": {0: 10, 1: 4}},
+			expectErr: "offset 4 of topic topic, partition 1 is outside of the range [5, 100]",
+		},
+		{
+			name:      "Offset Beyond The Newest",
+			groupId:   "group",
+			offsets:   map[string]map[int32]int64{"topic": {0: 101}},
+			expectErr: "offset 101 of topic topic, partition 0 is outside of the range [5, 100]",
+		},
+		{
+			name:      "Commit Error",
+			groupId:   "group",
+			offsets:   map[string]map[int32]int64{"topic": {0: 10}},
+			commitErr: sarama.ErrUnknownMemberId,
+			expectErr: sarama.ErrUnknownMemberId.Error(),
+		},
+		{
+			name:          "Offsets Restored",
+			groupId:       "group",
+			offsets:       map[string]map[int32]int64{"topic": {0: 10, 1: 100, 2: 5}},
+			expectCommits: map[int32]int64{0: 10, 1: 100, 2: 5}, // Backwards, forwards, and not previously committed
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			offsetResponse := sarama.NewMockOffsetResponse(t).SetVersion(1)
+			metadataResponse := sarama.NewMockMetadataResponse(t).SetController(broker.BrokerID()).SetBroker(broker.Addr(), broker.BrokerID())
+			commitResponse := sarama.NewMockOffsetCommitResponse(t)
+			for partition := int32(0); partition < 3; partition++ {
+				offsetResponse.SetOffset("topic", partition, sarama.OffsetOldest, 5).SetOffset("topic", partition, sarama.OffsetNewest, 100)
+				metadataResponse.SetLeader("topic", partition, broker.BrokerID())
+				commitResponse.SetError(brokerGroupId, "topic", partition, testCase.commitErr)
+			}
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": metadataResponse,
+				"OffsetRequest":   offsetResponse,
+				"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+					SetCoordinator(sarama.CoordinatorGroup, brokerGroupId, broker),
+				"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+					SetOffset(brokerGroupId, "topic", 0, 50, "", sarama.ErrNoError).
+					SetOffset(brokerGroupId, "topic", 1, 50, "", sarama.ErrNoError).
+					SetOffset(brokerGroupId, "topic", 2, -1, "", sarama.ErrNoError),
+				"OffsetCommitRequest": commitResponse,
+			})
+
+			config := sarama.NewConfig()
+			config.Version = sarama.V2_0_0_0
+			config.Metadata.Retry.Max = 0
+			group := &mockManagedGroup{}
+			group.On("isStopped").Return(!testCase.running)
+			group.On("handlerOptions").Return(nil)
+			manager := &kafkaConsumerGroupManagerImpl{
+				logger: zap.NewNop(),
+				groups: groupMap{"group": group},
+				factory: &kafkaConsumerGroupFactoryImpl{addrs: []string{broker.Addr()}, config: config,
+					groupIdTransformer: func(string) string { return brokerGroupId }},
+			}
+
+			err := manager.RestoreOffsets(testCase.groupId, testCase.offsets)
+			if testCase.expectErr != "" {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), testCase.expectErr)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			commits := make(map[int32]int64)
+			for _, requestResponse := range broker.History() {
+				if request, ok := requestResponse.Request.(*sarama.OffsetCommitRequest); ok {
+					for partition := int32(0); partition < 3; partition++ {
+						if offset, _, err := request.Offset("topic", partition); err == nil {
+							commits[partition] = offset
+						}
+					}
+				}
+			}
+			if testCase.expectCommits != nil {
+				assert.Equal(t, testCase.expectCommits, commits)
+			} else if testCase.commitErr == sarama.ErrNoError {
+				assert.Empty(t, commits)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+
+	"github.com/Shopify/sarama"
+)
+
+// headerRoutes holds the settings of the WithHeaderRouter option
+type headerRoutes struct {
+	headerKey      string
+	routes         map[string]KafkaConsumerHandler
+	defaultHandler KafkaConsumerHandler
+}
+
+// WithHeaderRouter dispatches each message to the handler that is registered in the routes for the value of its
+// headerKey header (the first one, if the message has several), so that one ConsumerGroup can serve several logical
+// streams that are multiplexed onto the same topics.  A message without the header, or with a value that has no
+// route, is passed to the defaultHandler, or to the handler of the ConsumerGroup if the defaultHandler is nil.
+//
+// Routing does not change the order in which the messages are handled or marked: the messages of a partition are
+// still handled one at a time (see WithMaxInFlightPerPartition) in partition order, whatever their route, so the
+// messages of each route are received in partition order, a slow route delays the other routes of the same
+// partition, and the offsets advance in partition order.  There is no ordering between partitions, as usual.  The
+// SetReady calls are passed to the handler of the ConsumerGroup, the defaultHandler and every route, and the
+// interceptors (see WithInterceptor) wrap the routed Handle call.  Default is no routing.
+func WithHeaderRouter(headerKey string, routes map[string]KafkaConsumerHandler, defaultHandler KafkaConsumerHandler) SaramaConsumerHandlerOption {
+	copied := make(map[string]KafkaConsumerHandler, len(routes))
+	for value, handler := range routes {
+		copied[value] = handler
+	}
+	return func(handler *SaramaConsumerHandler) {
+		handler.headerRoutes = &headerRoutes{headerKey: headerKey, routes: copied, defaultHandler: defaultHandler}
+	}
+}
+
+// headerRouter is the KafkaConsumerHandler that applies the headerRoutes to the handler of the ConsumerGroup
+type headerRouter struct {
+	*headerRoutes
+	handler KafkaConsumerHandler
+}
+
+// Verify that the headerRouter satisfies the KafkaConsumerHandler interface
+var _ KafkaConsumerHandler = headerRouter{}
+
+// route returns the handler that the message is dispatched to
+func (r headerRouter) route(message *sarama.ConsumerMessage) KafkaConsumerHandler {
+	for _, header := range message.Headers {
+		if header != nil && string(header.Key) == r.headerKey {
+			if handler, ok := r.routes[string(header.Value)]; ok {
+				return handler
+			}
+			break
+		}
+	}
+	if r.defaultHandler != nil {
+		return r.defaultHandler
+	}
+	return r.handler
+}
+
+func (r headerRouter) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	return r.route(message).Handle(ctx, message)
+}
+
+func (r headerRouter) SetReady(partition int32, ready bool) {
+	r.handler.SetReady(partition, ready)
+	if r.defaultHandler != nil {
+		r.defaultHandler.SetReady(partition, ready)
+	}
+	for _, handler := range r.routes {
+		handler.SetReady(partition, ready)
+	}
+}
+
+func (r headerRouter) GetConsumerGroup() string {
+	return r.handler.GetConsumerGroup()
+}
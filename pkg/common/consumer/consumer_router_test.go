@@ -0,0 +1,113 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// routeRecordingHandler is a KafkaConsumerHandler that records the values of the messages it handles (under its
+// name, in a log shared by several handlers) and the SetReady calls it receives
+type routeRecordingHandler struct {
+	name  string
+	log   *[]string
+	ready map[int32]bool
+}
+
+func (h *routeRecordingHandler) Handle(_ context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	*h.log = append(*h.log, h.name+":"+string(message.Value))
+	return true, nil
+}
+
+func (h *routeRecordingHandler) SetReady(partition int32, ready bool) {
+	h.ready[partition] = ready
+}
+
+func (h *routeRecordingHandler) GetConsumerGroup() string {
+	return "group-" + h.name
+}
+
+func TestHeaderRouter(t *testing.T) {
+	message := func(offset int64, value string, headers ...*sarama.RecordHeader) *sarama.ConsumerMessage {
+		return &sarama.ConsumerMessage{Offset: offset, Value: []byte(value), Headers: headers}
+	}
+	header := func(key string, value string) *sarama.RecordHeader {
+		return &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+	}
+	messages := []*sarama.ConsumerMessage{
+		message(0, "a1", header("stream", "a")),
+		message(1, "b1", header("other", "x"), header("stream", "b")),
+		message(2, "none"),
+		message(3, "unknown", header("stream", "c")),
+		message(4, "a2", header("stream", "a"), header("stream", "b")), // Only the first header counts
+		message(5, "b2", nil, header("stream", "b")),
+	}
+
+	for _, testCase := range []struct {
+		name        string
+		withDefault bool
+		expectLog   []string
+	}{
+		{
+			name:        "With Default Handler",
+			withDefault: true,
+			expectLog:   []string{"a:a1", "b:b1", "default:none", "default:unknown", "a:a2", "b:b2"},
+		},
+		{
+			name:      "Without Default Handler",
+			expectLog: []string{"a:a1", "b:b1", "group:none", "group:unknown", "a:a2", "b:b2"},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			var log []string
+			newHandler := func(name string) *routeRecordingHandler {
+				return &routeRecordingHandler{name: name, log: &log, ready: make(map[int32]bool)}
+			}
+			group, routeA, routeB, defaults := newHandler("group"), newHandler("a"), newHandler("b"), newHandler("default")
+			var defaultHandler KafkaConsumerHandler
+			if testCase.withDefault {
+				defaultHandler = defaults
+			}
+			routes := map[string]KafkaConsumerHandler{"a": routeA, "b": routeB}
+			option := WithHeaderRouter("stream", routes, defaultHandler)
+			delete(routes, "a") // The routes are copied by the option
+
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), group, make(chan error, 10), option)
+			session := &markRecordingSession{}
+			assert.Nil(t, cgh.ConsumeClaim(session, multiMessageClaim{messages: messages}))
+
+			// The messages are handled and marked in partition order, whatever their route
+			assert.Equal(t, testCase.expectLog, log)
+			assert.Equal(t, []int64{0, 1, 2, 3, 4, 5}, session.offsets)
+
+			// Every handler is told that the partition is ready
+			assert.True(t, group.ready[0])
+			assert.True(t, routeA.ready[0])
+			assert.True(t, routeB.ready[0])
+			assert.Equal(t, testCase.withDefault, defaults.ready[0])
+
+			// The router identifies itself by the group handler
+			handler, _ := cgh.getHandler()
+			assert.Equal(t, "group-group", handler.GetConsumerGroup())
+		})
+	}
+}
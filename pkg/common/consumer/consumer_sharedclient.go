@@ -0,0 +1,130 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/multierr"
+)
+
+// newClient is a wrapper for the Sarama NewClient function, to facilitate unit testing
+var newClient = sarama.NewClient
+
+// newConsumerGroupFromClient is a wrapper for the Sarama NewConsumerGroupFromClient function, to facilitate unit testing
+var newConsumerGroupFromClient = sarama.NewConsumerGroupFromClient
+
+// WithSharedClient makes the factory create its ConsumerGroups from a single sarama Client (via
+// NewConsumerGroupFromClient) rather than giving each one a client of its own, so that the groups share the
+// connections to the brokers of the cluster (and the metadata that the client keeps) instead of each opening its
+// own, which matters when hundreds of groups are managed.  Since a client has a single config, a group whose
+// options modify the sarama config (such as WithIsolationLevel or WithBalanceStrategy) still gets a client of its
+// own.  The shared client is created along with the first group, and closed once the groups that use it have
+// been closed and the factory is no longer used by the manager (when it is reconfigured or shut down); a
+// KafkaConsumerGroupFactory that is used directly keeps its shared client open.  Note that the groups also share
+// the broker connections' bandwidth and request queues, so a slow fetch for one group can delay the others.
+// Default is a client for each ConsumerGroup.
+func WithSharedClient() FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.sharedClient = &sharedClient{}
+	}
+}
+
+// sharedClient is the sarama Client that the ConsumerGroups of a factory share (see WithSharedClient), which is
+// created on first use and closed once it is both retired and no longer used by any group
+type sharedClient struct {
+	lock    sync.Mutex
+	client  sarama.Client
+	users   int  // The number of open ConsumerGroups created from the client
+	retired bool // Whether the factory of the client has been replaced or shut down
+}
+
+// createConsumerGroup creates a ConsumerGroup from the shared client, creating the client first if necessary
+func (s *sharedClient) createConsumerGroup(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client == nil || s.client.Closed() {
+		client, err := newClient(addrs, config)
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	group, err := newConsumerGroupFromClient(groupID, s.client)
+	if err != nil {
+		return nil, err
+	}
+	s.users++
+	return &sharedClientConsumerGroup{ConsumerGroup: group, shared: s}, nil
+}
+
+// release records that a ConsumerGroup created from the client has been closed
+func (s *sharedClient) release() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users--
+	return s.closeIfUnused()
+}
+
+// retire records that no more ConsumerGroups will be created from the client, closing it if it is not used
+func (s *sharedClient) retire() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retired = true
+	return s.closeIfUnused()
+}
+
+// closeIfUnused closes the client if it is retired and not used by any ConsumerGroup.  The caller must hold the lock.
+func (s *sharedClient) closeIfUnused() error {
+	if s.client == nil || s.users > 0 || !s.retired {
+		return nil
+	}
+	client := s.client
+	s.client = nil
+	if client.Closed() {
+		return nil
+	}
+	return client.Close()
+}
+
+// sharedClientConsumerGroup is a ConsumerGroup created from a sharedClient, which releases the client when closed
+type sharedClientConsumerGroup struct {
+	sarama.ConsumerGroup
+	shared *sharedClient
+	once   sync.Once
+}
+
+// Close closes the ConsumerGroup, which leaves the shared client open, and then releases the client
+func (g *sharedClientConsumerGroup) Close() error {
+	err := g.ConsumerGroup.Close()
+	g.once.Do(func() {
+		err = multierr.Append(err, g.shared.release())
+	})
+	return err
+}
+
+var _ sarama.ConsumerGroup = (*sharedClientConsumerGroup)(nil)
+
+// retireSharedClient records that the factory is no longer used to create ConsumerGroups, so that its shared client
+// (if it has one) is closed once the groups that use it are closed
+func (c kafkaConsumerGroupFactoryImpl) retireSharedClient() error {
+	if c.sharedClient == nil {
+		return nil
+	}
+	return c.sharedClient.retire()
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// countingListener is a net.Listener that counts the connections that it accepts
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func (l *countingListener) connections() int {
+	return int(atomic.LoadInt64(&l.accepted))
+}
+
+// newCountingBroker returns a MockBroker that answers metadata requests, and the listener that counts its connections
+func newCountingBroker(t sarama.TestReporter) (*sarama.MockBroker, *countingListener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener}
+	broker := sarama.NewMockBrokerListener(t, 1, counting)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	return broker, counting
+}
+
+func TestSharedClient(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = sarama.NewConsumerGroup
+	broker, listener := newCountingBroker(t)
+	defer broker.Close()
+
+	for _, testCase := range []struct {
+		name              string
+		options           []FactoryOption
+		groupOptions      []SaramaConsumerHandlerOption
+		expectConnections int
+	}{
+		{name: "Dedicated Clients", expectConnections: 3},
+		{name: "Shared Client", options: []FactoryOption{WithSharedClient()}, expectConnections: 1},
+		{
+			name:              "Modified Config",
+			options:           []FactoryOption{WithSharedClient()},
+			groupOptions:      []SaramaConsumerHandlerOption{WithIsolationLevel(sarama.ReadCommitted)},
+			expectConnections: 3,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			before := listener.connections()
+			factory := newConsumerGroupFactory([]string{broker.Addr()}, sarama.NewConfig(), testCase.options...)
+			var groups []sarama.ConsumerGroup
+			for i := 0; i < 3; i++ {
+				group, err := factory.createConsumerGroup(fmt.Sprintf("group-%d", i), testCase.groupOptions...)
+				assert.Nil(t, err)
+				groups = append(groups, group)
+			}
+			assert.Equal(t, testCase.expectConnections, listener.connections()-before)
+			for _, group := range groups {
+				assert.Nil(t, group.Close())
+			}
+			assert.Nil(t, factory.retireSharedClient())
+		})
+	}
+}
+
+func TestSharedClientLifecycle(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = sarama.NewConsumerGroup
+	broker, listener := newCountingBroker(t)
+	defer broker.Close()
+
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, sarama.NewConfig(), WithSharedClient())
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	factory := impl.getFactory()
+	group1, err := factory.createConsumerGroup("group-1")
+	assert.Nil(t, err)
+	group2, err := factory.createConsumerGroup("group-2")
+	assert.Nil(t, err)
+	shared := factory.sharedClient.client
+	assert.False(t, shared.Closed())
+
+	// Closing a group leaves the client open for the other groups, and for the next group to be created
+	assert.Nil(t, group1.Close())
+	assert.Nil(t, group1.Close()) // A repeated close does not release the client again
+	assert.False(t, shared.Closed())
+
+	// Replacing the factory (as Reconfigure does) retires the client, which is closed along with its last group
+	impl.setFactory(impl.newFactory(DefaultCluster, []string{broker.Addr()}, sarama.NewConfig()))
+	assert.False(t, shared.Closed())
+	assert.Nil(t, group2.Close())
+	assert.True(t, shared.Closed())
+
+	// The new factory has a client of its own, which is closed by Shutdown once it is unused
+	connections := listener.connections()
+	group3, err := impl.getFactory().createConsumerGroup("group-3")
+	assert.Nil(t, err)
+	assert.Equal(t, connections+1, listener.connections())
+	renewed := impl.getFactory().sharedClient.client
+	assert.NotEqual(t, shared, renewed)
+	assert.Nil(t, group3.Close())
+	assert.False(t, renewed.Closed())
+	_, err = manager.Shutdown(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, renewed.Closed())
+}
+
+// BenchmarkConsumerGroupConnections compares the number of broker connections that are opened when creating
+// ConsumerGroups with a client each and with a shared client (reported as connections/group)
+func BenchmarkConsumerGroupConnections(b *testing.B) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = sarama.NewConsumerGroup
+	const groupsPerFactory = 100
+
+	for _, benchmark := range []struct {
+		name    string
+		options []FactoryOption
+	}{
+		{name: "Dedicated Clients"},
+		{name: "Shared Client", options: []FactoryOption{WithSharedClient()}},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			broker, listener := newCountingBroker(b)
+			defer broker.Close()
+			config := sarama.NewConfig()
+			config.Metadata.RefreshFrequency = 0 // No background refreshes opening connections during the benchmark
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				factory := newConsumerGroupFactory([]string{broker.Addr()}, config, benchmark.options...)
+				groups := make([]sarama.ConsumerGroup, 0, groupsPerFactory)
+				for g := 0; g < groupsPerFactory; g++ {
+					group, err := factory.createConsumerGroup(fmt.Sprintf("group-%d", g))
+					if err != nil {
+						b.Fatal(err)
+					}
+					groups = append(groups, group)
+				}
+				for _, group := range groups {
+					_ = group.Close()
+				}
+				_ = factory.retireSharedClient()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(listener.connections())/float64(b.N*groupsPerFactory), "connections/group")
+		})
+	}
+}
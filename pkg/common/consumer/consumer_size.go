@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/zap"
+)
+
+// oversizedMessagesMetric is the name of the counter, in the MetricRegistry of the sarama config, that counts the
+// messages skipped by WithMaxMessageSize
+const oversizedMessagesMetric = "consumer-oversized-messages"
+
+// ErrMessageTooLarge is wrapped by the cause of the failure metadata of a message that WithMaxMessageSize sends to
+// the dead letter topic
+var ErrMessageTooLarge = errors.New("message value exceeds the maximum message size")
+
+// WithMaxMessageSize keeps the messages whose value is larger than the given number of bytes from the handler (and
+// from any deserializer and interceptors), to protect a handler with a bounded processing capacity from
+// pathologically large records.  Such a message is logged, counted (by the "consumer-oversized-messages" counter in
+// the MetricRegistry of the sarama config), and sent to the topic of the WithDeadLetterTopic option if there is one,
+// and then marked, so that the offset still advances.  If it cannot be sent to the dead letter topic (note that the
+// producer rejects messages larger than its Producer.MaxMessageBytes), the error is sent to the errors channel and
+// the message is not marked, as if the handler had returned that error.  Default is no limit (non-positive values
+// mean the same).
+func WithMaxMessageSize(bytes int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.maxMessageSize = bytes
+	}
+}
+
+// newOversizedMessageCounter returns the counter of the oversized messages in the given registry (nil if there is no
+// registry)
+func newOversizedMessageCounter(registry gometrics.Registry) gometrics.Counter {
+	if registry == nil {
+		return nil
+	}
+	return gometrics.GetOrRegisterCounter(oversizedMessagesMetric, registry)
+}
+
+// skipOversized skips the message if its value is larger than the WithMaxMessageSize limit, sending it to the dead
+// letter topic if there is one, in which case handled is true and the remaining values are the outcome of the message
+func (consumer *SaramaConsumerHandler) skipOversized(message *sarama.ConsumerMessage) (handled bool, mustMark bool, err error) {
+	if consumer.maxMessageSize <= 0 || len(message.Value) <= consumer.maxMessageSize {
+		return false, false, nil
+	}
+	consumer.logger.Warnw("Skipping a message that exceeds the maximum message size", zap.String("topic", message.Topic),
+		zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Int("size", len(message.Value)),
+		zap.Int("maxMessageSize", consumer.maxMessageSize))
+	if consumer.oversizedMessages != nil {
+		consumer.oversizedMessages.Inc(1)
+	}
+	if consumer.deadLetterTopic == "" {
+		return true, true, nil
+	}
+	cause := fmt.Errorf("%w: %d bytes, the maximum is %d", ErrMessageTooLarge, len(message.Value), consumer.maxMessageSize)
+	if err := consumer.sendToDeadLetterTopic(message, cause); err != nil {
+		return true, false, fmt.Errorf("could not send the oversized message to the dead letter topic: %w", err)
+	}
+	return true, true, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMaxMessageSize(t *testing.T) {
+	errProduce := errors.New("produce error")
+	for _, testCase := range []struct {
+		name          string
+		maxSize       int
+		deadLetter    bool
+		producer      *sendingProducer
+		expectHandled int32
+		expectCounted int64
+		expectErr     error
+	}{
+		{
+			name:          "No Limit",
+			expectHandled: 1,
+		},
+		{
+			name:          "Within The Limit",
+			maxSize:       5,
+			expectHandled: 1,
+		},
+		{
+			name:          "Skipped",
+			maxSize:       4,
+			expectCounted: 1,
+		},
+		{
+			name:          "Sent To The Dead Letter Topic",
+			maxSize:       4,
+			deadLetter:    true,
+			producer:      &sendingProducer{},
+			expectCounted: 1,
+		},
+		{
+			name:          "Dead Letter Failure",
+			maxSize:       4,
+			deadLetter:    true,
+			producer:      &sendingProducer{err: errProduce},
+			expectCounted: 1,
+			expectErr:     errProduce,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			counter := gometrics.NewCounter()
+			handler := &countingMessageHandler{mockMessageHandler: mockMessageHandler{shouldMark: true}}
+			errorCh := make(chan error, 1)
+			state := &groupState{oversized: counter}
+			options := []SaramaConsumerHandlerOption{WithMaxMessageSize(testCase.maxSize), withGroupState(state)}
+			if testCase.deadLetter {
+				state.producer = testCase.producer
+				options = append(options, WithDeadLetterTopic("dlq"))
+			}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, options...)
+			session := &mockConsumerGroupSession{}
+			message := &sarama.ConsumerMessage{Topic: "topic", Key: []byte("key"), Value: []byte("value")}
+
+			assert.Nil(t, cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: message}))
+			assert.Equal(t, testCase.expectHandled, atomic.LoadInt32(&handler.handled))
+			assert.Equal(t, testCase.expectErr == nil, session.marked) // Unless it failed, whether or not the message was handled
+			assert.Equal(t, testCase.expectCounted, counter.Count())
+			if testCase.producer != nil {
+				assert.Len(t, testCase.producer.sent, 1)
+				assert.Equal(t, "dlq", testCase.producer.sent[0].Topic)
+				assert.Equal(t, sarama.ByteEncoder("value"), testCase.producer.sent[0].Value)
+			}
+			if testCase.expectErr != nil {
+				assert.True(t, errors.Is(<-errorCh, testCase.expectErr))
+			} else {
+				assert.Empty(t, errorCh)
+			}
+		})
+	}
+}
+
+func TestOversizedMessageCounter(t *testing.T) {
+	assert.Nil(t, newOversizedMessageCounter(nil))
+	registry := gometrics.NewRegistry()
+	newOversizedMessageCounter(registry).Inc(2)
+	assert.Equal(t, int64(2), registry.Get(oversizedMessagesMetric).(gometrics.Counter).Count())
+}
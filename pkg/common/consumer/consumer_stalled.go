@@ -0,0 +1,287 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// minStallCheckInterval is the shortest interval at which the partitions of a group are checked for stalls
+const minStallCheckInterval = time.Second
+
+// WithStalledPartitionDetection makes the manager report each partition of a managed group that is claimed by the
+// current session but has received no message for at least the given threshold, even though the partition has
+// messages after the last one received (or its newest offset cannot be obtained at all, such as when its leader is
+// down).  Such a partition is typically one whose leader is unavailable during a partial broker outage, while the
+// other partitions of the group keep flowing.  A partition that is idle because it has no new messages is not
+// stalled, nor is one that is paused (see PausePartitions); a partition whose messages are held back by a slow
+// handler, a ready gate, or a rate limit is, since its consumption is equally stalled.
+//
+// The partitions are checked at a quarter of the threshold (but at most once a second), and a stalled partition is
+// reported once (until it receives a message again) with a warning and a GroupPartitionStalled event whose Topic and
+// Partition identify it.  The check looks up the newest offsets of the idle partitions with a client of the cluster
+// of the group, which is kept until the group is closed.  A partition that is found idle with nothing to consume is
+// not looked up again until its high watermark moves (as seen by the session), or otherwise for the threshold.  A
+// stopped group is not checked, and a new claim of a partition (e.g. after a rebalance) starts its threshold anew.
+// This option has no effect on a factory that is not used by a manager.  Default is no detection (a threshold that
+// is not positive also means no detection).
+func WithStalledPartitionDetection(threshold time.Duration) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.stallThreshold = threshold
+	}
+}
+
+// stallThresholdOf returns the threshold of the WithStalledPartitionDetection option among the given ones (zero if
+// there is none)
+func stallThresholdOf(options []SaramaConsumerHandlerOption) time.Duration {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	return scratch.stallThreshold
+}
+
+// partitionState is the progress of a claimed partition
+type partitionState struct {
+	claim    sarama.ConsumerGroupClaim
+	since    time.Time // When the partition was claimed, or received its last message
+	next     int64     // The offset of the next message (which may be OffsetOldest or OffsetNewest until one is received)
+	stalled  bool      // Whether the partition has been reported as stalled since its last progress
+	idleAt   time.Time // When the partition was last found idle with nothing to consume (zero if it was not)
+	idleMark int64     // The high watermark of the claim at that time
+}
+
+// partitionProgress tracks the progress of the partitions claimed by the sessions of a ConsumerGroup, across the
+// sessions of its consume loop.  A nil partitionProgress tracks nothing.
+type partitionProgress struct {
+	lock       sync.Mutex
+	partitions map[topicPartition]*partitionState
+}
+
+// newPartitionProgress returns a partitionProgress with no claimed partitions
+func newPartitionProgress() *partitionProgress {
+	return &partitionProgress{partitions: make(map[topicPartition]*partitionState)}
+}
+
+// claimed records that the partition of the claim has been claimed by a session
+func (p *partitionProgress) claimed(claim sarama.ConsumerGroupClaim) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.partitions[topicPartition{topic: claim.Topic(), partition: claim.Partition()}] =
+		&partitionState{claim: claim, since: time.Now(), next: claim.InitialOffset()}
+}
+
+// released records that the session no longer consumes the partition
+func (p *partitionProgress) released(topic string, partition int32) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.partitions, topicPartition{topic: topic, partition: partition})
+}
+
+// received records a message received from a claimed partition
+func (p *partitionProgress) received(message *sarama.ConsumerMessage) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if state, ok := p.partitions[topicPartition{topic: message.Topic, partition: message.Partition}]; ok {
+		state.since, state.next, state.stalled, state.idleAt = time.Now(), message.Offset+1, false, time.Time{}
+	}
+}
+
+// stallCandidate is a partition that has made no progress for the threshold, along with its next offset and the
+// high watermark of its claim
+type stallCandidate struct {
+	topicPartition
+	next int64
+	mark int64
+}
+
+// idle returns the claimed partitions that have received no message since the given time and have not been
+// reported as stalled, in topic and partition order.  A partition that was found to have nothing to consume since
+// the given time (see markIdle) is left out, unless the high watermark of its claim has moved since.
+func (p *partitionProgress) idle(before time.Time) []stallCandidate {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var candidates []stallCandidate
+	for key, state := range p.partitions {
+		if state.stalled || state.since.After(before) {
+			continue
+		}
+		mark := state.claim.HighWaterMarkOffset()
+		if state.idleAt.After(before) && mark == state.idleMark {
+			continue
+		}
+		candidates = append(candidates, stallCandidate{topicPartition: key, next: state.next, mark: mark})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].topic != candidates[j].topic {
+			return candidates[i].topic < candidates[j].topic
+		}
+		return candidates[i].partition < candidates[j].partition
+	})
+	return candidates
+}
+
+// markStalled records that the partition has been reported as stalled, returning false if it has made progress
+// (or was released) since it was found idle, in which case it must not be reported
+func (p *partitionProgress) markStalled(candidate stallCandidate) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	state, ok := p.partitions[candidate.topicPartition]
+	if !ok || state.stalled || state.next != candidate.next {
+		return false
+	}
+	state.stalled = true
+	return true
+}
+
+// markIdle records that the partition has nothing to consume, unless it has made progress since it was found idle
+func (p *partitionProgress) markIdle(candidate stallCandidate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if state, ok := p.partitions[candidate.topicPartition]; ok && state.next == candidate.next {
+		state.idleAt, state.idleMark = time.Now(), candidate.mark
+	}
+}
+
+// stallCheckClient is the client with which the partitions of a managed group are checked for stalls, which is
+// kept for as long as the cluster of the group has the same factory
+type stallCheckClient struct {
+	factory *kafkaConsumerGroupFactoryImpl
+	client  sarama.Client
+}
+
+// get returns the client of the cluster of the given factory, creating it if there is none (or if it belongs to a
+// previous factory of the cluster, such as before a Reconfigure)
+func (c *stallCheckClient) get(factory *kafkaConsumerGroupFactoryImpl) (sarama.Client, error) {
+	if c.client != nil && (c.factory != factory || c.client.Closed()) {
+		c.close()
+	}
+	if c.client == nil {
+		client, err := newCommitClient(factory)
+		if err != nil {
+			return nil, err
+		}
+		c.factory, c.client = factory, client
+	}
+	return c.client, nil
+}
+
+// close closes the client, if there is one
+func (c *stallCheckClient) close() {
+	if c.client != nil {
+		_ = c.client.Close()
+		c.factory, c.client = nil, nil
+	}
+}
+
+// watchStalledPartitions checks the partitions of a managed group for stalls at a quarter of the threshold, until
+// the context is done (which happens when the group is closed)
+func (m *kafkaConsumerGroupManagerImpl) watchStalledPartitions(ctx context.Context, groupId string, progress *partitionProgress, threshold time.Duration) {
+	interval := threshold / 4
+	if interval < minStallCheckInterval {
+		interval = minStallCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	client := &stallCheckClient{}
+	defer client.close()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkStalledPartitions(groupId, progress, threshold, client)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkStalledPartitions reports the partitions of a managed group that have been idle for the threshold while
+// they have messages to consume (or their newest offset cannot be obtained)
+func (m *kafkaConsumerGroupManagerImpl) checkStalledPartitions(groupId string, progress *partitionProgress, threshold time.Duration,
+	stallClient *stallCheckClient) {
+	managedGrp := m.getGroup(groupId)
+	if managedGrp == nil || managedGrp.isStopped() {
+		return
+	}
+	var candidates []stallCandidate
+	pauser := managedGrp.state().pauser
+	for _, candidate := range progress.idle(time.Now().Add(-threshold)) {
+		if pauser != nil {
+			if paused, _ := pauser.isPaused(candidate.topic, candidate.partition); paused {
+				continue
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	factory, err := m.getClusterFactory(clusterOf(managedGrp.handlerOptions()))
+	if err != nil {
+		groupLogger.Warn("Failed To Check Managed ConsumerGroup For Stalled Partitions", zap.Error(err))
+		return
+	}
+	client, err := stallClient.get(factory)
+	if err != nil {
+		groupLogger.Warn("Failed To Check Managed ConsumerGroup For Stalled Partitions", zap.Error(err))
+		return
+	}
+	for _, candidate := range candidates {
+		partitionLogger := groupLogger.With(zap.String("Topic", candidate.topic), zap.Int32("Partition", candidate.partition))
+		newest, err := client.GetOffset(candidate.topic, candidate.partition, sarama.OffsetNewest)
+		if err == nil {
+			next := candidate.next
+			if next < 0 {
+				// Nothing was received since the partition was claimed at the oldest or newest offset
+				if next, err = client.GetOffset(candidate.topic, candidate.partition, next); err != nil {
+					partitionLogger.Warn("Failed To Check Partition Of Managed ConsumerGroup For A Stall", zap.Error(err))
+					continue
+				}
+			}
+			if newest <= next {
+				progress.markIdle(candidate) // Idle, with nothing to consume
+				continue
+			}
+		}
+		if !progress.markStalled(candidate) {
+			continue
+		}
+		partitionLogger.Warn("Partition Of Managed ConsumerGroup Is Stalled", zap.Duration("Threshold", threshold),
+			zap.Int64("NextOffset", candidate.next), zap.Int64("NewestOffset", newest), zap.NamedError("OffsetError", err))
+		m.notify(ManagerEvent{Event: GroupPartitionStalled, GroupId: groupId, Topic: candidate.topic, Partition: candidate.partition})
+	}
+}
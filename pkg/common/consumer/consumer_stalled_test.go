@@ -0,0 +1,188 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// initialOffsetClaim is a mockConsumerGroupClaim of a given partition and initial offset
+type initialOffsetClaim struct {
+	mockConsumerGroupClaim
+	topic     string
+	partition int32
+	initial   int64
+}
+
+func (c initialOffsetClaim) Topic() string        { return c.topic }
+func (c initialOffsetClaim) Partition() int32     { return c.partition }
+func (c initialOffsetClaim) InitialOffset() int64 { return c.initial }
+
+func TestWithStalledPartitionDetection(t *testing.T) {
+	assert.Equal(t, time.Duration(0), stallThresholdOf(nil))
+	assert.Equal(t, time.Minute, stallThresholdOf([]SaramaConsumerHandlerOption{WithStalledPartitionDetection(time.Minute)}))
+}
+
+func TestPartitionProgress(t *testing.T) {
+	// A nil partitionProgress tracks nothing
+	var progress *partitionProgress
+	progress.claimed(initialOffsetClaim{topic: "topic"})
+	progress.received(&sarama.ConsumerMessage{Topic: "topic"})
+	progress.released("topic", 0)
+	assert.Nil(t, progress.idle(time.Now()))
+
+	progress = newPartitionProgress()
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 1, initial: 10})
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 0, initial: sarama.OffsetOldest})
+	claimedAt := time.Now()
+	assert.Empty(t, progress.idle(claimedAt.Add(-time.Second)))
+	assert.Equal(t, []stallCandidate{
+		{topicPartition: topicPartition{topic: "topic", partition: 0}, next: sarama.OffsetOldest},
+		{topicPartition: topicPartition{topic: "topic", partition: 1}, next: 10},
+	}, progress.idle(claimedAt))
+
+	// A received message is progress, and a reported partition is not idle until it makes progress again
+	progress.received(&sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 20})
+	candidates := progress.idle(claimedAt)
+	assert.Equal(t, []stallCandidate{{topicPartition: topicPartition{topic: "topic", partition: 1}, next: 10}}, candidates)
+	assert.True(t, progress.markStalled(candidates[0]))
+	assert.False(t, progress.markStalled(candidates[0]))
+	assert.Empty(t, progress.idle(claimedAt))
+	progress.received(&sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 10})
+	assert.Len(t, progress.idle(time.Now()), 2)
+
+	// A partition that made progress after it was found idle is not reported
+	candidates = progress.idle(time.Now())
+	progress.received(&sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 21})
+	assert.False(t, progress.markStalled(candidates[0]))
+
+	progress.released("topic", 0)
+	progress.released("topic", 1)
+	assert.Empty(t, progress.idle(time.Now()))
+	assert.False(t, progress.markStalled(candidates[1]))
+}
+
+func TestPartitionProgressIdle(t *testing.T) {
+	progress := newPartitionProgress()
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 0, initial: 10})
+	progress.partitions[topicPartition{topic: "topic", partition: 0}].since = time.Now().Add(-time.Hour)
+	candidates := progress.idle(time.Now())
+	assert.Len(t, candidates, 1)
+
+	// A partition with nothing to consume is left out until its high watermark moves, or for the threshold
+	progress.markIdle(candidates[0])
+	foundIdleAt := time.Now()
+	assert.Empty(t, progress.idle(foundIdleAt.Add(-time.Second)))
+	assert.Len(t, progress.idle(foundIdleAt), 1)
+	progress.partitions[topicPartition{topic: "topic", partition: 0}].idleMark = 5 // The high watermark moved
+	assert.Len(t, progress.idle(foundIdleAt.Add(-time.Second)), 1)
+
+	// Progress since the partition was found idle is not overwritten, and makes it idle anew
+	candidates = progress.idle(time.Now())
+	progress.received(&sarama.ConsumerMessage{Topic: "topic", Partition: 0, Offset: 10})
+	progress.markIdle(candidates[0])
+	assert.True(t, progress.partitions[topicPartition{topic: "topic", partition: 0}].idleAt.IsZero())
+}
+
+func TestCheckStalledPartitions(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	metadataResponse := sarama.NewMockMetadataResponse(t).SetController(broker.BrokerID()).SetBroker(broker.Addr(), broker.BrokerID())
+	offsetResponse := sarama.NewMockOffsetResponse(t).SetVersion(1)
+	for partition := int32(0); partition < 4; partition++ {
+		metadataResponse.SetLeader("topic", partition, broker.BrokerID())
+		offsetResponse.SetOffset("topic", partition, sarama.OffsetOldest, 5).SetOffset("topic", partition, sarama.OffsetNewest, 100)
+	}
+	metadataResponse.SetLeader("topic", 4, -1) // The leader of partition 4 is down
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadataResponse,
+		"OffsetRequest":   offsetResponse,
+	})
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_0_0
+	config.Metadata.Retry.Max = 0
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, config)
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	managerEvents := manager.GetNotificationChannel()
+	notifications := make(chan ManagerEvent, 10)
+	go func() {
+		for event := range managerEvents {
+			notifications <- event
+		}
+	}()
+	pauser := newPartitionPauser()
+	pauser.setAssigned(map[string][]int32{"topic": {0, 1, 2, 3, 4}})
+	assert.Nil(t, pauser.pause(map[string][]int32{"topic": {2}}))
+	group := &mockManagedGroup{}
+	group.On("isStopped").Return(false)
+	group.On("handlerOptions").Return(nil)
+	group.On("state").Return(&groupState{pauser: pauser})
+	impl.groups["group"] = group
+
+	progress := newPartitionProgress()
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 0, initial: 10})                  // Behind the newest offset
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 1, initial: 100})                 // Caught up
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 2, initial: 10})                  // Paused
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 3, initial: sarama.OffsetOldest}) // Nothing received yet
+	progress.claimed(initialOffsetClaim{topic: "topic", partition: 4, initial: 10})                  // Leader down
+
+	client := &stallCheckClient{}
+	defer client.close()
+
+	// Nothing is stalled before the threshold
+	impl.checkStalledPartitions("group", progress, time.Hour, client)
+	assert.Empty(t, broker.History())
+
+	impl.checkStalledPartitions("group", progress, 0, client)
+	var stalled []ManagerEvent
+	for len(stalled) < 3 {
+		select {
+		case event := <-notifications:
+			stalled = append(stalled, event)
+		case <-time.After(shortTimeout):
+			assert.FailNow(t, "stalled partitions were not reported", stalled)
+		}
+	}
+	assert.Equal(t, []ManagerEvent{
+		{Event: GroupPartitionStalled, GroupId: "group", Topic: "topic", Partition: 0},
+		{Event: GroupPartitionStalled, GroupId: "group", Topic: "topic", Partition: 3},
+		{Event: GroupPartitionStalled, GroupId: "group", Topic: "topic", Partition: 4},
+	}, stalled)
+
+	// The stalled partitions are only reported once, and the idle partition is not looked up again (with the same
+	// client) until its high watermark moves
+	progress.partitions[topicPartition{topic: "topic", partition: 1}].idleAt = time.Now().Add(time.Hour)
+	requests := len(broker.History())
+	impl.checkStalledPartitions("group", progress, 0, client)
+	select {
+	case event := <-notifications:
+		assert.Fail(t, "stalled partition reported again", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Len(t, broker.History(), requests)
+	kept := client.client
+	progress.partitions[topicPartition{topic: "topic", partition: 1}].idleMark = 200
+	impl.checkStalledPartitions("group", progress, 0, client)
+	assert.Len(t, broker.History(), requests+1)
+	assert.Same(t, kept, client.client)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The backoff between the attempts to re-create a supervised group, if not specified
+const (
+	defaultSupervisionBackoff    = time.Second
+	defaultSupervisionMaxBackoff = time.Minute
+)
+
+// supervision is the backoff of WithSupervision
+type supervision struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// WithSupervision makes the manager re-create any group it started whose consume loop exits without the group
+// having been closed via the manager, such as when the sarama ConsumerGroup is closed by something else, or when
+// the consume loop gives up (see WithMaxRestartAttempts).  A GroupExited event is sent when that is detected, and
+// the group is then started again (in the manner of StartConsumerGroup, with its current topics, handler and
+// options) after the backoff, which doubles after each failed attempt up to maxBackoff (non-positive values mean one
+// second and one minute, respectively).  The attempts continue until one succeeds, which sends a GroupRecreated
+// event, or until the group is closed or the manager is shut down.  The re-created group has a new Errors()
+// channel.  The groups added via AddExistingGroup are not supervised.  Default is no supervision, so that the group
+// stays under management (but consumes nothing) until it is closed.
+func WithSupervision(backoff time.Duration, maxBackoff time.Duration) FactoryOption {
+	if backoff <= 0 {
+		backoff = defaultSupervisionBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultSupervisionMaxBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.supervision = &supervision{backoff: backoff, maxBackoff: maxBackoff}
+	}
+}
+
+// superviseConsumerGroup waits for the consume loop of the managed group to exit and, unless the group was closed
+// (which cancels the context), re-creates it with the given logger and the handler of the handler reference
+func (m *kafkaConsumerGroupManagerImpl) superviseConsumerGroup(ctx context.Context, groupId string, managedGrp managedGroup,
+	consumeDone <-chan struct{}, logger *zap.SugaredLogger, handlerRef *handlerReference, supervision supervision) {
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-consumeDone:
+	}
+	if ctx.Err() != nil || m.isShutdown() {
+		return // Closed via the manager while the consume loop was exiting
+	}
+	groupLogger := m.logger.With(zap.String("GroupId", groupId))
+	groupLogger.Warn("Consume Loop Of Supervised ConsumerGroup Exited Unexpectedly")
+	m.notify(ManagerEvent{Event: GroupExited, GroupId: groupId})
+
+	backoff := supervision.backoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if m.isShutdown() || m.getGroup(groupId) != managedGrp {
+			return
+		}
+		err := m.recreateConsumerGroup(ctx, groupId, managedGrp, logger, handlerRef)
+		if err == nil {
+			return
+		}
+		groupLogger.Warn("Failed To Re-create Supervised ConsumerGroup", zap.Duration("Backoff", backoff), zap.Error(err))
+		if backoff *= 2; backoff > supervision.maxBackoff {
+			backoff = supervision.maxBackoff
+		}
+	}
+}
+
+// recreateConsumerGroup starts a new managed group in place of the given one, whose consume loop has exited, and
+// then closes the old one.  If the old group is closed via the manager in the meantime, so is the new one.
+func (m *kafkaConsumerGroupManagerImpl) recreateConsumerGroup(ctx context.Context, groupId string, managedGrp managedGroup,
+	logger *zap.SugaredLogger, handlerRef *handlerReference) error {
+
+	handler, options, _ := handlerRef.get()
+	if err := m.StartConsumerGroup(groupId, managedGrp.topics(), logger, handler, options...); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return m.CloseConsumerGroup(groupId)
+	}
+	if err := managedGrp.close(); err != nil {
+		// The sarama ConsumerGroup of the old group has usually been closed already
+		m.logger.Debug("Error Closing Replaced Supervised ConsumerGroup", zap.String("GroupId", groupId), zap.Error(err))
+	}
+	m.logger.Info("Re-created Supervised ConsumerGroup", zap.String("GroupId", groupId))
+	m.notify(ManagerEvent{Event: GroupRecreated, GroupId: groupId})
+	return nil
+}
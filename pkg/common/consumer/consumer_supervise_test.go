@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestWithSupervision(t *testing.T) {
+	factory := &kafkaConsumerGroupFactoryImpl{}
+	WithSupervision(0, 0)(factory)
+	assert.Equal(t, supervision{backoff: defaultSupervisionBackoff, maxBackoff: defaultSupervisionMaxBackoff}, *factory.supervision)
+	WithSupervision(time.Second, time.Millisecond)(factory)
+	assert.Equal(t, supervision{backoff: time.Second, maxBackoff: time.Second}, *factory.supervision)
+}
+
+// closableConsumerGroup is a mockConsumerGroup whose Consume lasts until the context is done or the group is
+// closed, returning sarama.ErrClosedConsumerGroup in the latter case (as sarama does)
+type closableConsumerGroup struct {
+	mockConsumerGroup
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (g *closableConsumerGroup) Consume(ctx context.Context, _ []string, _ sarama.ConsumerGroupHandler) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	}
+}
+
+func (g *closableConsumerGroup) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return nil
+}
+
+func TestSupervision(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	var created int32
+	var failCreate int32
+	groups := make(chan *closableConsumerGroup, 10)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		if atomic.LoadInt32(&failCreate) > 0 {
+			atomic.AddInt32(&failCreate, -1)
+			return nil, fmt.Errorf("create error")
+		}
+		atomic.AddInt32(&created, 1)
+		group := &closableConsumerGroup{closed: make(chan struct{})}
+		groups <- group
+		return group, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{},
+		WithSupervision(time.Millisecond, 2*time.Millisecond))
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	events := make(chan ManagerEvent, 10)
+	notifications := manager.GetNotificationChannel()
+	go func() {
+		for event := range notifications {
+			if event.Event == GroupExited {
+				events <- event
+			}
+		}
+	}()
+	expectEvent := func(expected EventIndex) {
+		select {
+		case event := <-events:
+			assert.Equal(t, ManagerEvent{Event: expected, GroupId: "group-id"}, event)
+		case <-time.After(shortTimeout):
+			assert.Fail(t, "event was not sent", expected)
+		}
+	}
+
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	first := <-groups
+	original := impl.getGroup("group-id")
+
+	// The group is closed by something other than the manager, and the first attempt to re-create it fails
+	atomic.StoreInt32(&failCreate, 1)
+	_ = first.Close()
+	expectEvent(GroupExited)
+	<-groups
+	// The GroupRecreated event immediately follows GroupCreated, so the listener may miss it
+	assert.Eventually(t, func() bool { return impl.getGroup("group-id") != original }, shortTimeout, time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&created))
+	assert.Nil(t, original.waitForConsumeExit(shortTimeout))
+	assert.True(t, manager.IsManaged("group-id"))
+	topics, err := manager.Topics("group-id")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic"}, topics)
+
+	// The re-created group is supervised as well, but closing it via the manager does not re-create it
+	assert.Nil(t, manager.CloseConsumerGroupAndWait("group-id", shortTimeout))
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected event", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&created))
+	assert.False(t, manager.IsManaged("group-id"))
+}
+
+func TestNoSupervision(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	group := &closableConsumerGroup{closed: make(chan struct{})}
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return group, nil
+	}
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{}, &sarama.Config{})
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}))
+	managedGrp := impl.getGroup("group-id")
+	_ = group.Close()
+	assert.Nil(t, managedGrp.waitForConsumeExit(shortTimeout))
+	assert.True(t, manager.IsManaged("group-id"))
+	assert.Equal(t, managedGrp, impl.getGroup("group-id")) // Not re-created
+	assert.Equal(t, 0, manager.ActiveConsumers())
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// DefaultSuppressedErrors are the errors that are suppressed when WithSuppressedErrors is not given.  Sarama reports
+// them (such as when a commit or heartbeat races with a rebalance) during every rebalance, and recovers from them by
+// itself by rejoining the group:
+//
+//   - sarama.ErrRebalanceInProgress: the group began rebalancing
+//   - sarama.ErrIllegalGeneration: the group was rebalanced, so the session belongs to a previous generation
+//
+// sarama.ErrUnknownMemberId is not among them, since it also means that the member was removed from the group for
+// missing its session timeout, which is worth knowing about.
+var DefaultSuppressedErrors = []error{sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration}
+
+// WithSuppressedErrors replaces the errors (DefaultSuppressedErrors) that the ConsumerGroup started by the factory
+// keeps out of its Errors() channel, because they are benign and transient and would drown out the real problems.
+// An error is suppressed if it matches one of the given errors with errors.Is, which sees through the
+// sarama.ConsumerError that sarama wraps the errors of a partition in.  The suppressed errors are the errors that
+// sarama sends to the Errors() channel and those that a session fails with, which are logged at debug level
+// instead, and a suppressed session failure is not counted towards WithMaxRestartAttempts (as with
+// ErrorClassIgnore); the errors returned by the handler are never suppressed.  No arguments disable the
+// suppression.  Default is DefaultSuppressedErrors.
+func WithSuppressedErrors(errs ...error) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.suppressedErrors = &errs
+	}
+}
+
+// isSuppressed returns true if the error matches one of the suppressed errors
+func (consumer *SaramaConsumerHandler) isSuppressed(err error) bool {
+	return matchesAny(err, consumer.suppressed())
+}
+
+// suppressed returns the errors of the WithSuppressedErrors option, or DefaultSuppressedErrors
+func (consumer *SaramaConsumerHandler) suppressed() []error {
+	if consumer.suppressedErrors == nil {
+		return DefaultSuppressedErrors
+	}
+	return *consumer.suppressedErrors
+}
+
+// matchesAny returns true if the error matches one of the given errors with errors.Is
+func matchesAny(err error, errs []error) bool {
+	for _, target := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressErrors returns a channel with the errors of the given channel, except those that match one of the
+// suppressed errors, which are logged at debug level instead
+func suppressErrors(errorCh <-chan error, suppressed []error, logger *zap.SugaredLogger) <-chan error {
+	if len(suppressed) == 0 {
+		return errorCh
+	}
+	out := make(chan error)
+	go func() {
+		defer close(out)
+		for err := range errorCh {
+			if matchesAny(err, suppressed) {
+				logger.Debugw("Suppressing a benign ConsumerGroup error", zap.Error(err))
+				continue
+			}
+			out <- err
+		}
+	}()
+	return out
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// erroringConsumerGroup is a mockConsumerGroup whose Errors() channel carries the given errors
+type erroringConsumerGroup struct {
+	mockConsumerGroup
+	errs []error
+}
+
+func (g *erroringConsumerGroup) Errors() <-chan error {
+	ch := make(chan error, len(g.errs))
+	for _, err := range g.errs {
+		ch <- err
+	}
+	close(ch)
+	return ch
+}
+
+func TestSuppressedSaramaErrors(t *testing.T) {
+	errReal := errors.New("real problem")
+	saramaErrs := []error{
+		sarama.ErrRebalanceInProgress,
+		&sarama.ConsumerError{Topic: "topic", Partition: 1, Err: sarama.ErrIllegalGeneration},
+		sarama.ErrUnknownMemberId,
+		errReal,
+	}
+	for _, testCase := range []struct {
+		name       string
+		options    []SaramaConsumerHandlerOption
+		expectErrs []error
+	}{
+		{
+			name:       "Default Suppressed Errors",
+			expectErrs: []error{sarama.ErrUnknownMemberId, errReal},
+		},
+		{
+			name:       "Custom Suppressed Errors",
+			options:    []SaramaConsumerHandlerOption{WithSuppressedErrors(errReal)},
+			expectErrs: []error{sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration, sarama.ErrUnknownMemberId},
+		},
+		{
+			name:       "Suppression Disabled",
+			options:    []SaramaConsumerHandlerOption{WithSuppressedErrors()},
+			expectErrs: saramaErrs,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, nil, testCase.options...)
+			group := &customConsumerGroup{
+				ConsumerGroup: &erroringConsumerGroup{errs: saramaErrs},
+				sources:       ErrorsFromSarama,
+				suppressed:    handler.suppressed(),
+				logger:        zap.NewNop().Sugar(),
+			}
+			var errs []error
+			for err := range group.Errors() {
+				errs = append(errs, err)
+			}
+			assert.Len(t, errs, len(testCase.expectErrs))
+			for i := range errs {
+				assert.True(t, errors.Is(errs[i], testCase.expectErrs[i]), errs[i])
+			}
+		})
+	}
+}
+
+func TestSuppressedSessionErrors(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	results := []error{sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration, sarama.ErrRebalanceInProgress, sarama.ErrUnknownMemberId}
+	sessions := 0
+	consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+		sessions++
+		if sessions > len(results) {
+			return sarama.ErrClosedConsumerGroup
+		}
+		return results[sessions-1]
+	}
+
+	// The suppressed failures are not counted, so the group is not dead after three failed sessions
+	group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{}, zap.NewNop().Sugar(),
+		mockMessageHandler{}, nil, WithMaxRestartAttempts(2))
+	var errs []error
+	for err := range group.handlerErrorChannel {
+		errs = append(errs, err)
+	}
+	<-group.state.done
+	assert.Equal(t, len(results)+1, sessions)
+	assert.Equal(t, []error{sarama.ErrUnknownMemberId}, errs)
+	group.cancel()
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+// ErrMessageTimeout is wrapped by the error that the MessageTimeoutError action of WithMessageTimeout reports
+var ErrMessageTimeout = errors.New("message handling timed out")
+
+// MessageTimeoutAction determines what happens to a message whose handling exceeds the WithMessageTimeout duration
+type MessageTimeoutAction int
+
+const (
+	// MessageTimeoutSkip marks the message as consumed without any further action
+	MessageTimeoutSkip MessageTimeoutAction = iota
+	// MessageTimeoutDeadLetter sends the message to the topic of the WithDeadLetterTopic option, and marks it (if it
+	// cannot be sent, the error is reported in the errors channel and the message is not marked)
+	MessageTimeoutDeadLetter
+	// MessageTimeoutError reports an error wrapping ErrMessageTimeout in the errors channel, without marking the
+	// message (as if the handler had returned that error)
+	MessageTimeoutError
+)
+
+// String returns a human-readable name of the action, for logging
+func (a MessageTimeoutAction) String() string {
+	switch a {
+	case MessageTimeoutSkip:
+		return "skip"
+	case MessageTimeoutDeadLetter:
+		return "dead-letter"
+	case MessageTimeoutError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(a))
+	}
+}
+
+// WithMessageTimeout limits the time that the handler may spend on a single message.  The context passed to Handle
+// carries the deadline, so that a cooperative handler can give up; if Handle has not returned by then, the message
+// is abandoned (and logged) and the partition moves on to the next message, so that one pathological message cannot
+// stall it forever.  What happens to the abandoned message is determined by the action.  The Handle call itself
+// cannot be stopped, so a handler that ignores the context keeps running in the background, and its result is
+// discarded.  Default is no timeout.
+func WithMessageTimeout(timeout time.Duration, action MessageTimeoutAction) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.messageTimeout = timeout
+		handler.messageTimeoutAction = action
+		if action == MessageTimeoutDeadLetter {
+			handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+				if handler.deadLetterTopic == "" {
+					return fmt.Errorf("the %s message timeout action requires a dead letter topic", action)
+				}
+				return nil
+			})
+		}
+	}
+}
+
+// WithDeadLetterTopic sets the topic that the MessageTimeoutDeadLetter action of WithMessageTimeout sends the
+// abandoned messages to (with their original key, value and headers, plus those of WithDeadLetterHeaders if given).
+// The name may be a template, in which DeadLetterTopicPlaceholder is replaced by the topic of each message and
+// DeadLetterGroupPlaceholder by the GroupId of the ConsumerGroup (e.g. "{topic}.dlq"), so that a group with several
+// topics has a dead letter topic for each of them.  The ConsumerGroup is not started if the name (with its
+// placeholders replaced) is not a legal topic name, and a message whose dead letter topic is not legal (e.g. because
+// of the characters of the GroupId) is not sent, and reported as an error instead.  The messages are sent with the
+// producer of the ConsumerGroup, so this option implies WithProducer.  Default is no topic.
+func WithDeadLetterTopic(topic string) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.deadLetterTopic = topic
+		handler.producerRequested = true
+		handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+			_, err := resolveDeadLetterTopic(topic, "topic", "group")
+			return err
+		})
+	}
+}
+
+// handleWithTimeout passes the message to the handler in the same manner as handleMessage, but abandons it if the
+// handler has not returned when the WithMessageTimeout duration expires
+func (consumer *SaramaConsumerHandler) handleWithTimeout(ctx context.Context, handler KafkaConsumerHandler, message *sarama.ConsumerMessage) (bool, error) {
+	if consumer.messageTimeout <= 0 {
+		return consumer.handleMessage(ctx, handler, message)
+	}
+
+	type handleResult struct {
+		mustMark bool
+		err      error
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, consumer.messageTimeout)
+	defer cancel()
+	done := make(chan handleResult, 1) // Buffered so that an abandoned Handle call can still finish
+	go func() {
+		mustMark, err := consumer.handleMessage(timeoutCtx, handler, message)
+		done <- handleResult{mustMark: mustMark, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.mustMark, result.err
+	case <-timeoutCtx.Done():
+		if ctx.Err() != nil {
+			// The handler context itself was canceled (the session ended), so wait for Handle as usual
+			result := <-done
+			return result.mustMark, result.err
+		}
+		return consumer.abandonMessage(message)
+	}
+}
+
+// abandonMessage applies the WithMessageTimeout action to a message whose handling timed out
+func (consumer *SaramaConsumerHandler) abandonMessage(message *sarama.ConsumerMessage) (bool, error) {
+	consumer.logger.Warnw("Abandoning a message whose handling timed out", zap.String("topic", message.Topic),
+		zap.Int32("partition", message.Partition), zap.Int64("offset", message.Offset),
+		zap.Duration("timeout", consumer.messageTimeout), zap.Stringer("action", consumer.messageTimeoutAction))
+
+	switch consumer.messageTimeoutAction {
+	case MessageTimeoutDeadLetter:
+		if err := consumer.sendToDeadLetterTopic(message, fmt.Errorf("%w after %v", ErrMessageTimeout, consumer.messageTimeout)); err != nil {
+			return false, fmt.Errorf("could not send the timed out message to the dead letter topic: %w", err)
+		}
+		return true, nil
+	case MessageTimeoutError:
+		return false, fmt.Errorf("%w after %v", ErrMessageTimeout, consumer.messageTimeout)
+	default:
+		return true, nil
+	}
+}
+
+// sendToDeadLetterTopic publishes a copy of the message to the topic of the WithDeadLetterTopic option, with the
+// failure metadata headers of the WithDeadLetterHeaders option describing the cause (if given)
+func (consumer *SaramaConsumerHandler) sendToDeadLetterTopic(message *sarama.ConsumerMessage, cause error) error {
+	if consumer.producer == nil || consumer.deadLetterTopic == "" {
+		return fmt.Errorf("no dead letter topic (and producer) for a ConsumerGroup that was not started by the factory with WithDeadLetterTopic")
+	}
+	topic, err := consumer.deadLetterTopicOf(message)
+	if err != nil {
+		return err
+	}
+	deadLetter := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(message.Value),
+		Headers: consumer.deadLetterHeaders(message, cause)}
+	if message.Key != nil {
+		deadLetter.Key = sarama.ByteEncoder(message.Key) // A nil key would otherwise become an empty one
+	}
+	_, _, err = consumer.producer.SendMessage(deadLetter)
+	return err
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// stuckMessageHandler is a KafkaConsumerHandler whose Handle ignores the context and blocks until it is released
+type stuckMessageHandler struct {
+	mockMessageHandler
+	release     chan struct{}
+	hasDeadline chan bool
+}
+
+func (h stuckMessageHandler) Handle(ctx context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	_, ok := ctx.Deadline()
+	h.hasDeadline <- ok
+	<-h.release
+	return true, nil
+}
+
+// sendingProducer is a sarama.SyncProducer that records the messages sent to it
+type sendingProducer struct {
+	sarama.SyncProducer
+	sent []*sarama.ProducerMessage
+	err  error
+}
+
+func (p *sendingProducer) SendMessage(message *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = append(p.sent, message)
+	return 0, 0, p.err
+}
+
+func TestMessageTimeout(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		action      MessageTimeoutAction
+		producer    *sendingProducer
+		expectMark  bool
+		expectError error
+	}{
+		{
+			name:       "Skip",
+			action:     MessageTimeoutSkip,
+			expectMark: true,
+		},
+		{
+			name:        "Error",
+			action:      MessageTimeoutError,
+			expectError: ErrMessageTimeout,
+		},
+		{
+			name:       "Dead Letter",
+			action:     MessageTimeoutDeadLetter,
+			producer:   &sendingProducer{},
+			expectMark: true,
+		},
+		{
+			name:        "Dead Letter Failure",
+			action:      MessageTimeoutDeadLetter,
+			producer:    &sendingProducer{err: fmt.Errorf("produce error")},
+			expectError: fmt.Errorf("produce error"),
+		},
+		{
+			name:        "Dead Letter Without Producer",
+			action:      MessageTimeoutDeadLetter,
+			expectError: fmt.Errorf("no dead letter topic"),
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			handler := stuckMessageHandler{release: make(chan struct{}), hasDeadline: make(chan bool, 1)}
+			defer close(handler.release)
+			errorCh := make(chan error, 1)
+			options := []SaramaConsumerHandlerOption{WithMessageTimeout(20*time.Millisecond, testCase.action), WithDeadLetterTopic("dlq")}
+			if testCase.producer != nil {
+				options = append(options, withGroupState(&groupState{producer: testCase.producer}))
+			}
+			cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, options...)
+			session := &mockConsumerGroupSession{}
+			message := &sarama.ConsumerMessage{Topic: "topic", Key: []byte("key"), Value: []byte("value"),
+				Headers: []*sarama.RecordHeader{{Key: []byte("header"), Value: []byte("1")}}}
+
+			start := time.Now()
+			assert.Nil(t, cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: message}))
+			assert.Less(t, int64(time.Since(start)), int64(time.Second)) // The stuck message did not hold the partition
+			assert.True(t, <-handler.hasDeadline)
+			assert.Equal(t, testCase.expectMark, session.marked)
+
+			if testCase.expectError != nil {
+				select {
+				case err := <-errorCh:
+					if errors.Is(testCase.expectError, ErrMessageTimeout) {
+						assert.True(t, errors.Is(err, ErrMessageTimeout))
+					} else {
+						assert.Contains(t, err.Error(), testCase.expectError.Error())
+					}
+				default:
+					t.Fatal("no error was reported")
+				}
+			} else {
+				assert.Len(t, errorCh, 0)
+			}
+
+			if testCase.producer != nil {
+				assert.Len(t, testCase.producer.sent, 1)
+				sent := testCase.producer.sent[0]
+				assert.Equal(t, "dlq", sent.Topic)
+				assert.Equal(t, sarama.ByteEncoder("key"), sent.Key)
+				assert.Equal(t, sarama.ByteEncoder("value"), sent.Value)
+				assert.Equal(t, []sarama.RecordHeader{{Key: []byte("header"), Value: []byte("1")}}, sent.Headers)
+			}
+		})
+	}
+}
+
+func TestMessageTimeoutNotExceeded(t *testing.T) {
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{shouldMark: true}, errorCh, WithMessageTimeout(time.Second, MessageTimeoutError))
+	session := &mockConsumerGroupSession{}
+	assert.Nil(t, cgh.ConsumeClaim(session, mockConsumerGroupClaim{msg: &sarama.ConsumerMessage{}}))
+	assert.True(t, session.marked)
+	assert.Len(t, errorCh, 0)
+}
+
+func TestDeadLetterTopicRequired(t *testing.T) {
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	_, err := factory.groupConfig([]SaramaConsumerHandlerOption{WithMessageTimeout(time.Second, MessageTimeoutDeadLetter)})
+	assert.NotNil(t, err)
+	_, err = factory.groupConfig([]SaramaConsumerHandlerOption{WithMessageTimeout(time.Second, MessageTimeoutDeadLetter), WithDeadLetterTopic("dlq")})
+	assert.Nil(t, err)
+	_, err = factory.groupConfig([]SaramaConsumerHandlerOption{WithDeadLetterTopic("dlq"), WithMessageTimeout(time.Second, MessageTimeoutDeadLetter)})
+	assert.Nil(t, err)
+}
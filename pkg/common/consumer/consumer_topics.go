@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// WithTopicCheck makes the KafkaConsumerGroupFactory (and the manager) check that the topics of the ConsumerGroup
+// exist when it is started, since a group that subscribes to a missing topic (with auto-creation disabled) joins
+// without error but consumes nothing.  Missing topics are logged as a warning, unless failOnMissing is true, in
+// which case the group is not started and an error listing them is returned.  The topics are only checked when
+// the group is first started, not when it is restarted.  Default is no check.
+func WithTopicCheck(failOnMissing bool) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.topicCheck = true
+		handler.failOnMissingTopics = failOnMissing
+	}
+}
+
+// checkTopics verifies that the given topics exist, via a ClusterAdmin with the factory's brokers and the group's
+// config, if the WithTopicCheck option is among the given ones
+func (c kafkaConsumerGroupFactoryImpl) checkTopics(groupID string, topics []string, logger *zap.SugaredLogger, options ...SaramaConsumerHandlerOption) error {
+	scratch := SaramaConsumerHandler{}
+	for _, option := range options {
+		option(&scratch)
+	}
+	if !scratch.topicCheck {
+		return nil
+	}
+
+	missing, err := c.missingTopics(topics, options)
+	if err != nil {
+		if scratch.failOnMissingTopics {
+			return fmt.Errorf("could not check the topics of consumer group with id '%s': %w", groupID, err)
+		}
+		logger.Warnw("Failed To Check The Topics Of ConsumerGroup", zap.String("GroupId", groupID), zap.Error(err))
+		return nil
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if scratch.failOnMissingTopics {
+		return fmt.Errorf("could not start consumer group with id '%s' - topics do not exist: %s", groupID, strings.Join(missing, ", "))
+	}
+	logger.Warnw("Topics Of ConsumerGroup Do Not Exist - Nothing Will Be Consumed From Them",
+		zap.String("GroupId", groupID), zap.Strings("MissingTopics", missing))
+	return nil
+}
+
+// missingTopics returns those of the given topics that the brokers do not know of
+func (c kafkaConsumerGroupFactoryImpl) missingTopics(topics []string, options []SaramaConsumerHandlerOption) ([]string, error) {
+	config, err := c.groupConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := newClusterAdmin(c.addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = admin.Close()
+	}()
+
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, topic := range topics {
+		if _, ok := existing[topic]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// topicsClusterAdmin is a sarama.ClusterAdmin that only supports listing topics
+type topicsClusterAdmin struct {
+	sarama.ClusterAdmin
+	topics map[string]sarama.TopicDetail
+	err    error
+	closed bool
+}
+
+func (a *topicsClusterAdmin) ListTopics() (map[string]sarama.TopicDetail, error) {
+	return a.topics, a.err
+}
+
+func (a *topicsClusterAdmin) Close() error {
+	a.closed = true
+	return nil
+}
+
+func TestCheckTopics(t *testing.T) {
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+
+	for _, testCase := range []struct {
+		name         string
+		options      []SaramaConsumerHandlerOption
+		adminErr     error
+		listErr      error
+		expectErr    bool
+		expectWarn   bool
+		expectListed bool
+	}{
+		{
+			name: "No Check",
+		},
+		{
+			name:         "Missing Topic Warning",
+			options:      []SaramaConsumerHandlerOption{WithTopicCheck(false)},
+			expectWarn:   true,
+			expectListed: true,
+		},
+		{
+			name:         "Missing Topic Error",
+			options:      []SaramaConsumerHandlerOption{WithTopicCheck(true)},
+			expectErr:    true,
+			expectListed: true,
+		},
+		{
+			name:       "Admin Error Warning",
+			options:    []SaramaConsumerHandlerOption{WithTopicCheck(false)},
+			adminErr:   fmt.Errorf("admin error"),
+			expectWarn: true,
+		},
+		{
+			name:      "Admin Error",
+			options:   []SaramaConsumerHandlerOption{WithTopicCheck(true)},
+			adminErr:  fmt.Errorf("admin error"),
+			expectErr: true,
+		},
+		{
+			name:         "List Error",
+			options:      []SaramaConsumerHandlerOption{WithTopicCheck(true)},
+			listErr:      fmt.Errorf("list error"),
+			expectErr:    true,
+			expectListed: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			admin := &topicsClusterAdmin{topics: map[string]sarama.TopicDetail{"topic1": {}}, err: testCase.listErr}
+			listed := false
+			newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) {
+				if testCase.adminErr != nil {
+					return nil, testCase.adminErr
+				}
+				listed = true
+				return admin, nil
+			}
+			core, logs := observer.New(zapcore.WarnLevel)
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+
+			err := factory.checkTopics("bla", []string{"topic1", "topic2"}, zap.New(core).Sugar(), testCase.options...)
+			assert.Equal(t, testCase.expectErr, err != nil)
+			assert.Equal(t, testCase.expectWarn, logs.Len() > 0)
+			assert.Equal(t, testCase.expectListed, listed)
+			assert.Equal(t, testCase.expectListed, admin.closed)
+			if testCase.expectErr && testCase.listErr == nil && testCase.adminErr == nil {
+				assert.Contains(t, err.Error(), "topic2")
+				assert.NotContains(t, err.Error(), "topic1")
+			}
+		})
+	}
+}
+
+func TestStartConsumerGroupWithMissingTopic(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	defer func(fn func([]string, *sarama.Config) (sarama.ClusterAdmin, error)) { newClusterAdmin = fn }(newClusterAdmin)
+	created := false
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		created = true
+		return &mockConsumerGroup{}, nil
+	}
+	newClusterAdmin = func([]string, *sarama.Config) (sarama.ClusterAdmin, error) {
+		return &topicsClusterAdmin{}, nil
+	}
+
+	// The group is not created if its topics are missing
+	factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+	_, err := factory.StartConsumerGroup("bla", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}, WithTopicCheck(true))
+	assert.NotNil(t, err)
+	assert.False(t, created)
+
+	manager, _, _, _ := getManagerWithMockGroup(t, "", false)
+	assert.NotNil(t, manager.StartConsumerGroup("bla", []string{"topic"}, zap.NewNop().Sugar(), mockMessageHandler{}, WithTopicCheck(true)))
+	assert.False(t, manager.IsManaged("bla"))
+}
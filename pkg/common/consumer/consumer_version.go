@@ -0,0 +1,184 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/rcrowley/go-metrics"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// ErrUnsupportedVersion is wrapped by the error of WithVersionCheck when the Version of the sarama config is newer
+// than the brokers support, and can be tested for with errors.Is
+var ErrUnsupportedVersion = errors.New("kafka version of the config is newer than the brokers support")
+
+// VersionCheckPolicy determines what happens when the check of WithVersionCheck finds that the Version of the
+// sarama config is newer than the brokers support
+type VersionCheckPolicy int
+
+const (
+	// WarnOnVersionMismatch logs a warning, and starts the group anyway
+	WarnOnVersionMismatch VersionCheckPolicy = iota
+	// FailOnVersionMismatch does not start the group, returning an error that wraps ErrUnsupportedVersion
+	FailOnVersionMismatch
+)
+
+// fetchApiKey is the key of the fetch request in the ApiVersions response of a broker
+const fetchApiKey = 1
+
+// fetchRequestVersions are the versions of the fetch request that the sarama consumer sends with each Kafka
+// version of the config (newest first), which a broker must support for the consumer to work
+var fetchRequestVersions = []struct {
+	kafkaVersion sarama.KafkaVersion
+	fetchVersion int16
+}{
+	{sarama.V2_3_0_0, 11},
+	{sarama.V2_1_0_0, 10},
+	{sarama.V1_1_0_0, 7},
+	{sarama.V0_11_0_0, 4},
+	{sarama.V0_10_1_0, 3},
+	{sarama.V0_10_0_0, 2},
+	{sarama.V0_9_0_0, 1},
+}
+
+// WithVersionCheck makes the factory (and the manager) check, before its first ConsumerGroup is started, that the
+// brokers support the Kafka Version of its sarama config, since a Version that is newer than the brokers (such as
+// when the clients are upgraded before the brokers) otherwise fails with obscure errors, or not at all.  The check
+// asks the brokers for the versions of the requests that they support, which adds a round trip to the brokers (via
+// a short-lived connection) when the first group of the factory is started; since Reconfigure replaces the
+// factory, the check is repeated for the new settings.  A Version that is too new is logged as a warning (with
+// WarnOnVersionMismatch) or prevents the group from starting (with FailOnVersionMismatch).  If the brokers cannot
+// be asked, the check is attempted again for the next group, and the group is only prevented from starting with
+// FailOnVersionMismatch.  Brokers older than 0.10.0 cannot be asked.  Default is no check.
+func WithVersionCheck(policy VersionCheckPolicy) FactoryOption {
+	return func(factory *kafkaConsumerGroupFactoryImpl) {
+		factory.versionCheck = &versionCheck{policy: policy}
+	}
+}
+
+// versionCheck is the outcome of the check of WithVersionCheck, which is shared by the copies of a factory
+type versionCheck struct {
+	policy  VersionCheckPolicy
+	lock    sync.Mutex
+	checked bool  // Whether the brokers were asked successfully
+	err     error // The version mismatch that was found (nil if there is none)
+}
+
+// checkVersion checks the Version of the factory's sarama config against the brokers, the first time it is called
+// after the brokers could be asked, if the WithVersionCheck option was given.  A mismatch (or a failure to ask the
+// brokers) is returned with FailOnVersionMismatch, and logged otherwise.
+func (c kafkaConsumerGroupFactoryImpl) checkVersion(logger *zap.SugaredLogger) error {
+	if c.versionCheck == nil {
+		return nil
+	}
+	c.versionCheck.lock.Lock()
+	defer c.versionCheck.lock.Unlock()
+	if !c.versionCheck.checked {
+		err := c.verifyVersion()
+		if err != nil && !errors.Is(err, ErrUnsupportedVersion) {
+			if c.versionCheck.policy == FailOnVersionMismatch {
+				return fmt.Errorf("could not check the kafka version of the config: %w", err)
+			}
+			logger.Warnw("Failed To Check The Kafka Version Of The Config", zap.Error(err))
+			return nil
+		}
+		c.versionCheck.checked = true
+		c.versionCheck.err = err
+		if err != nil && c.versionCheck.policy != FailOnVersionMismatch {
+			logger.Warnw("Kafka Version Of The Config Is Newer Than The Brokers Support", zap.Error(err))
+		}
+	}
+	if c.versionCheck.policy == FailOnVersionMismatch {
+		return c.versionCheck.err
+	}
+	return nil
+}
+
+// verifyVersion asks the factory's brokers, in turn, for the versions of the requests they support, and returns
+// an error wrapping ErrUnsupportedVersion if the first one that answers does not support the fetch requests that
+// the consumer sends with the Version of the config
+func (c kafkaConsumerGroupFactoryImpl) verifyVersion() error {
+	if len(c.addrs) == 0 {
+		return fmt.Errorf("no brokers are configured")
+	}
+	config := sarama.NewConfig()
+	if c.config != nil {
+		copied := *c.config
+		config = &copied
+	}
+	config.MetricRegistry = metrics.NewRegistry() // Keeps the metrics of the short-lived connection separate
+
+	var errs error
+	for _, addr := range c.addrs {
+		response, err := requestApiVersions(addr, config)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not request api versions from broker '%s': %w", addr, err))
+			continue
+		}
+		return compareVersions(config.Version, response)
+	}
+	return errs
+}
+
+// requestApiVersions opens a connection to the broker at the given address and sends it an ApiVersions request
+func requestApiVersions(addr string, config *sarama.Config) (*sarama.ApiVersionsResponse, error) {
+	broker := sarama.NewBroker(addr)
+	if err := broker.Open(config); err != nil {
+		return nil, err
+	}
+	defer func() { _ = broker.Close() }()
+	response, err := broker.ApiVersions(&sarama.ApiVersionsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if response.Err != sarama.ErrNoError {
+		return nil, response.Err
+	}
+	return response, nil
+}
+
+// compareVersions returns an error wrapping ErrUnsupportedVersion if the broker that sent the ApiVersions response
+// does not support the version of the fetch request that the consumer sends with the given Kafka version
+func compareVersions(configured sarama.KafkaVersion, response *sarama.ApiVersionsResponse) error {
+	var required int16
+	for _, versions := range fetchRequestVersions {
+		if configured.IsAtLeast(versions.kafkaVersion) {
+			required = versions.fetchVersion
+			break
+		}
+	}
+	for _, block := range response.ApiVersions {
+		if block.ApiKey != fetchApiKey || block.MaxVersion >= required {
+			continue
+		}
+		supported := sarama.V0_8_2_0
+		for _, versions := range fetchRequestVersions {
+			if versions.fetchVersion <= block.MaxVersion {
+				supported = versions.kafkaVersion
+				break
+			}
+		}
+		return fmt.Errorf("%w: the config has version %v, but the brokers only support the fetch requests of version %v",
+			ErrUnsupportedVersion, configured, supported)
+	}
+	return nil
+}
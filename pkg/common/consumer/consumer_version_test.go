@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// apiVersionsResponse returns an ApiVersions response with the given maximum version of the fetch request
+func apiVersionsResponse(maxFetchVersion int16) *sarama.ApiVersionsResponse {
+	return &sarama.ApiVersionsResponse{ApiVersions: []*sarama.ApiVersionsResponseBlock{
+		{ApiKey: 0, MinVersion: 0, MaxVersion: 8},
+		{ApiKey: fetchApiKey, MinVersion: 0, MaxVersion: maxFetchVersion},
+	}}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, testCase := range []struct {
+		name       string
+		configured sarama.KafkaVersion
+		maxFetch   int16
+		expectErr  string
+	}{
+		{name: "Same Version", configured: sarama.V2_3_0_0, maxFetch: 11},
+		{name: "Older Version", configured: sarama.V1_0_0_0, maxFetch: 11},
+		{name: "Same Fetch Request", configured: sarama.V2_2_0_0, maxFetch: 10},
+		{name: "Newer Version", configured: sarama.V2_3_0_0, maxFetch: 8,
+			expectErr: "the config has version 2.3.0, but the brokers only support the fetch requests of version 1.1.0"},
+		{name: "Much Newer Version", configured: sarama.V2_0_0_0, maxFetch: 0,
+			expectErr: "the config has version 2.0.0, but the brokers only support the fetch requests of version 0.8.2"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := compareVersions(testCase.configured, apiVersionsResponse(testCase.maxFetch))
+			if testCase.expectErr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+				assert.Contains(t, err.Error(), testCase.expectErr)
+			}
+		})
+	}
+	// A broker that does not list the fetch request is not a mismatch
+	assert.Nil(t, compareVersions(sarama.V2_3_0_0, &sarama.ApiVersionsResponse{}))
+}
+
+func TestCheckVersion(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockWrapper(apiVersionsResponse(7)),
+	})
+
+	// An address with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedAddr := listener.Addr().String()
+	_ = listener.Close()
+
+	newConfig := func(version sarama.KafkaVersion) *sarama.Config {
+		config := sarama.NewConfig()
+		config.Version = version
+		config.Net.DialTimeout = time.Second
+		return config
+	}
+	logger := zap.NewNop().Sugar()
+
+	for _, testCase := range []struct {
+		name      string
+		addrs     []string
+		version   sarama.KafkaVersion
+		options   []FactoryOption
+		expectErr error
+	}{
+		{name: "No Check", addrs: []string{refusedAddr}, version: sarama.V2_3_0_0},
+		{name: "Supported", addrs: []string{broker.Addr()}, version: sarama.V1_1_0_0, options: []FactoryOption{WithVersionCheck(FailOnVersionMismatch)}},
+		{name: "Mismatch Warned", addrs: []string{broker.Addr()}, version: sarama.V2_3_0_0, options: []FactoryOption{WithVersionCheck(WarnOnVersionMismatch)}},
+		{name: "Mismatch Failed", addrs: []string{refusedAddr, broker.Addr()}, version: sarama.V2_3_0_0,
+			options: []FactoryOption{WithVersionCheck(FailOnVersionMismatch)}, expectErr: ErrUnsupportedVersion},
+		{name: "Unreachable Warned", addrs: []string{refusedAddr}, version: sarama.V2_3_0_0, options: []FactoryOption{WithVersionCheck(WarnOnVersionMismatch)}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			factory := newConsumerGroupFactory(testCase.addrs, newConfig(testCase.version), testCase.options...)
+			err := factory.checkVersion(logger)
+			if testCase.expectErr != nil {
+				assert.True(t, errors.Is(err, testCase.expectErr))
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+
+	// The outcome is kept once the brokers have been asked, but not while they cannot be
+	factory := newConsumerGroupFactory([]string{refusedAddr}, newConfig(sarama.V2_3_0_0), WithVersionCheck(FailOnVersionMismatch))
+	assert.NotNil(t, factory.checkVersion(logger))
+	assert.False(t, errors.Is(factory.checkVersion(logger), ErrUnsupportedVersion))
+	factory.addrs = []string{broker.Addr()}
+	assert.True(t, errors.Is(factory.checkVersion(logger), ErrUnsupportedVersion))
+	factory.addrs = []string{refusedAddr}
+	assert.True(t, errors.Is(factory.checkVersion(logger), ErrUnsupportedVersion))
+
+	_, err = factory.StartConsumerGroup("group-id", []string{"topic"}, logger, mockMessageHandler{})
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, newConfig(sarama.V2_3_0_0),
+		WithVersionCheck(FailOnVersionMismatch))
+	err = manager.StartConsumerGroup("group-id", []string{"topic"}, logger, mockMessageHandler{})
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+	assert.False(t, manager.IsManaged("group-id"))
+}
+
+func TestCheckVersionOncePerStart(t *testing.T) {
+	defer restoreNewConsumerGroup(newConsumerGroup)
+	newConsumerGroup = func(addrs []string, groupID string, config *sarama.Config) (sarama.ConsumerGroup, error) {
+		return &mockConsumerGroup{}, nil
+	}
+
+	// A broker that fails to answer is asked again by each check, since a warned failure is not remembered
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockWrapper(&sarama.ApiVersionsResponse{Err: sarama.ErrUnknown}),
+	})
+	requests := func() int {
+		count := 0
+		for _, exchange := range broker.History() {
+			if _, ok := exchange.Request.(*sarama.ApiVersionsRequest); ok {
+				count++
+			}
+		}
+		return count
+	}
+
+	logger := zap.NewNop().Sugar()
+	manager := NewConsumerGroupManager(zap.NewNop(), getMockServerHandler(), []string{broker.Addr()}, sarama.NewConfig(),
+		WithVersionCheck(WarnOnVersionMismatch))
+	impl := manager.(*kafkaConsumerGroupManagerImpl)
+	assert.Nil(t, manager.StartConsumerGroup("group-id", []string{"topic"}, logger, mockMessageHandler{}))
+	assert.Equal(t, 1, requests())
+	assert.Nil(t, impl.stopConsumerGroup(nil, "group-id"))
+	assert.Nil(t, impl.startConsumerGroup(nil, "group-id"))
+	assert.Equal(t, 2, requests())
+
+	// A group created in the stopped state is only checked when it is started
+	assert.Nil(t, impl.newManagedConsumerGroup("stopped-group-id", []string{"topic"}, logger, mockMessageHandler{}, true, false))
+	assert.Equal(t, 2, requests())
+	assert.Nil(t, impl.startConsumerGroup(nil, "stopped-group-id"))
+	assert.Equal(t, 3, requests())
+	assert.Nil(t, manager.CloseConsumerGroup("group-id"))
+	assert.Nil(t, manager.CloseConsumerGroup("stopped-group-id"))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// claimWorkersBacklog is the number of messages per worker that may be dispatched and not yet marked, which bounds
+// the messages held behind one that is slow to be handled
+const claimWorkersBacklog = 64
+
+// WithClaimWorkers hands the messages of each claimed partition to up to n concurrent calls of the handler, for
+// CPU-bound handlers of a few busy partitions whose messages may be processed in any order.  Using this option is
+// the handler's agreement to out-of-order processing:  the messages of a partition are dispatched in offset order,
+// but as soon as any of the n calls returns (rather than the oldest one, as with WithMaxInFlightPerPartition), so a
+// message may be handled before, after, or at the same time as any other message of its partition, including one
+// with the same key.
+//
+// The offsets remain safe for at-least-once delivery:  a message is only marked once it and every earlier message
+// of its partition have been handled, so the committed offset of a partition never passes a message that is still
+// in the handler, and the offsets are marked in order.  While the oldest unmarked message is still being handled,
+// the others keep being dispatched until n*64 messages of the partition are awaiting their marks, at which point
+// the partition waits for the oldest.  When the session ends, the messages in the handler are waited for (and
+// cancelled after the timeout of WithTimeout) in order, as usual.  Any message handled after the committed offset
+// (up to n*64 per partition) is delivered again after a crash or a rebalance that happens before it is committed.
+//
+// This option takes precedence over WithMaxInFlightPerPartition, and has no effect with WithTimestampOrdering
+// (which hands the messages to the handler one at a time).  The value of n must be positive.  Default is 1 (the
+// messages of a partition are handled sequentially).
+func WithClaimWorkers(n int) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.claimWorkers = n
+		handler.configValidators = append(handler.configValidators, func(*sarama.Config) error {
+			if n < 1 {
+				return fmt.Errorf("invalid number of claim workers: %d (must be positive)", n)
+			}
+			return nil
+		})
+	}
+}
+
+// claimDispatcher hands the messages of a claim to the workers of the WithClaimWorkers option, and marks the
+// contiguous prefix of the dispatched messages that have been handled.  It is only used by the ConsumeClaim
+// goroutine of its claim.
+type claimDispatcher struct {
+	consumer *SaramaConsumerHandler
+	session  sarama.ConsumerGroupSession
+	workers  int
+	inFlight []*inFlightMessage        // The dispatched messages that have not been marked, in offset order
+	running  int                       // The number of dispatched messages whose handler has not returned
+	returned chan *inFlightMessage     // Receives each dispatched message once its handler has returned
+	handled  map[*inFlightMessage]bool // The messages among inFlight whose return has been received
+	drain    *drainDeadline            // The deadline of the messages that are still in flight when the session ends
+}
+
+// newClaimDispatcher returns a claimDispatcher for a claim of the session if the WithClaimWorkers option allows
+// more than one worker, or nil otherwise
+func (consumer *SaramaConsumerHandler) newClaimDispatcher(session sarama.ConsumerGroupSession) *claimDispatcher {
+	if consumer.claimWorkers <= 1 {
+		return nil
+	}
+	return &claimDispatcher{
+		consumer: consumer,
+		session:  session,
+		workers:  consumer.claimWorkers,
+		returned: make(chan *inFlightMessage, consumer.claimWorkers*claimWorkersBacklog), // Never blocks a handler
+		handled:  make(map[*inFlightMessage]bool),
+		drain:    consumer.newDrainDeadline(),
+	}
+}
+
+// dispatch waits for a worker to be available and hands it the message.  It returns false, without handing the
+// message to the handler, if the session ends while waiting.
+func (d *claimDispatcher) dispatch(handler KafkaConsumerHandler, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage) bool {
+	d.collect()
+	for d.running >= d.workers || len(d.inFlight) >= d.workers*claimWorkersBacklog {
+		select {
+		case pending := <-d.returned:
+			d.receive(pending)
+			d.collect()
+		case <-d.session.Context().Done():
+			return false
+		}
+	}
+	d.inFlight = append(d.inFlight, d.consumer.startHandling(handler, claim, message, d.returned))
+	d.running++
+	return true
+}
+
+// collect receives the messages whose handler has returned without waiting, and marks those that follow the
+// contiguous prefix of handled messages
+func (d *claimDispatcher) collect() {
+	for {
+		select {
+		case pending := <-d.returned:
+			d.receive(pending)
+		default:
+			for len(d.inFlight) > 0 && d.handled[d.inFlight[0]] {
+				delete(d.handled, d.inFlight[0])
+				d.consumer.finishHandling(d.session, d.inFlight[0], d.drain) // Returns at once, since the handler has returned
+				d.inFlight = d.inFlight[1:]
+			}
+			return
+		}
+	}
+}
+
+// receive records that the handler of a dispatched message has returned
+func (d *claimDispatcher) receive(pending *inFlightMessage) {
+	d.handled[pending] = true
+	d.running--
+}
+
+// finish waits for the handler to return for each of the remaining messages, and marks them in order
+func (d *claimDispatcher) finish() {
+	for _, pending := range d.inFlight {
+		d.consumer.finishHandling(d.session, pending, d.drain)
+	}
+	d.inFlight = nil
+}
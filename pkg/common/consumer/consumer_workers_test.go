@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// blockingFirstHandler holds the message with offset zero until it is released, and counts the others
+type blockingFirstHandler struct {
+	mockMessageHandler
+	release chan struct{}
+	handled int32
+}
+
+func (m *blockingFirstHandler) Handle(_ context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	if message.Offset == 0 {
+		<-m.release
+	} else {
+		atomic.AddInt32(&m.handled, 1)
+	}
+	return true, nil
+}
+
+// lockedMarkSession is a mockConsumerGroupSession that records the offsets of the marked messages, which may be
+// read while the claim is consumed
+type lockedMarkSession struct {
+	mockConsumerGroupSession
+	lock    sync.Mutex
+	offsets []int64
+}
+
+func (s *lockedMarkSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.offsets = append(s.offsets, msg.Offset)
+}
+
+func (s *lockedMarkSession) marked() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int64(nil), s.offsets...)
+}
+
+// offsetMessages returns messages with the offsets from zero to count-1
+func offsetMessages(count int64) []*sarama.ConsumerMessage {
+	var messages []*sarama.ConsumerMessage
+	for offset := int64(0); offset < count; offset++ {
+		messages = append(messages, &sarama.ConsumerMessage{Offset: offset})
+	}
+	return messages
+}
+
+func TestWithClaimWorkers(t *testing.T) {
+	handler := SaramaConsumerHandler{}
+	WithClaimWorkers(0)(&handler)
+	assert.NotNil(t, handler.configValidators[0](sarama.NewConfig()))
+	handler = SaramaConsumerHandler{}
+	WithClaimWorkers(4)(&handler)
+	assert.Equal(t, 4, handler.claimWorkers)
+	assert.Nil(t, handler.configValidators[0](sarama.NewConfig()))
+}
+
+func TestClaimWorkersConcurrency(t *testing.T) {
+	// The later messages are handled faster, so they return before the earlier ones
+	handler := &concurrentMessageHandler{}
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, WithClaimWorkers(3), WithMaxInFlightPerPartition(5))
+	session := &lockedMarkSession{}
+	_ = cgh.ConsumeClaim(session, multiMessageClaim{messages: offsetMessages(6)})
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&handler.max))
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 5}, session.marked())
+	close(errorCh)
+}
+
+func TestClaimWorkersOutOfOrder(t *testing.T) {
+	handler := &blockingFirstHandler{release: make(chan struct{})}
+	errorCh := make(chan error, 1)
+	cgh := NewConsumerHandler(zap.NewNop().Sugar(), handler, errorCh, WithClaimWorkers(2))
+	session := &lockedMarkSession{}
+	done := make(chan struct{})
+	go func() {
+		_ = cgh.ConsumeClaim(session, multiMessageClaim{messages: offsetMessages(200)})
+		close(done)
+	}()
+
+	// The other worker handles the later messages while the first one is held, until the backlog is full, and
+	// nothing is marked past the held message
+	backlog := int32(2*claimWorkersBacklog - 1)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&handler.handled) == backlog }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, backlog, atomic.LoadInt32(&handler.handled))
+	assert.Empty(t, session.marked())
+
+	// Once the first message is handled, every message is handled and marked in order
+	close(handler.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "ConsumeClaim did not return")
+	}
+	assert.Equal(t, int32(199), atomic.LoadInt32(&handler.handled))
+	marked := session.marked()
+	assert.Len(t, marked, 200)
+	for i, offset := range marked {
+		assert.Equal(t, int64(i), offset)
+	}
+	close(errorCh)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// HandlerWrapper wraps the sarama.ConsumerGroupHandler that a ConsumerGroup started by the factory passes to Consume
+type HandlerWrapper func(next sarama.ConsumerGroupHandler) sarama.ConsumerGroupHandler
+
+// WithHandlerWrapper wraps the whole sarama.ConsumerGroupHandler of each session (not only the handling of each
+// message, as WithInterceptor does), so that the Setup, Cleanup and ConsumeClaim of the session can be customized
+// while the group is still started, stopped and restarted by the factory and the manager.  Wrappers are applied in
+// the order in which they are registered, so the first one registered is the outermost.  This option has no effect
+// on a SaramaConsumerHandler that is not created by the factory.  Default is no wrappers.
+//
+// The wrapped handler is the SaramaConsumerHandler, which marks the offsets of the handled messages and sends the
+// handler errors to the Errors() channel, and on which most of the other options rely.  A wrapper that does not
+// delegate a call (such as one that consumes a claim itself) takes over those responsibilities for it: it must
+// mark the messages that it handles with the session, and its errors are only reported if it returns them from
+// Setup, Cleanup or ConsumeClaim, in which case the session fails and sarama sends them to the Errors() channel
+// (if Consumer.Return.Errors is set).
+func WithHandlerWrapper(wrapper HandlerWrapper) SaramaConsumerHandlerOption {
+	return func(handler *SaramaConsumerHandler) {
+		handler.wrappers = append(handler.wrappers, wrapper)
+	}
+}
+
+// wrapped returns the handler, wrapped in the wrappers of WithHandlerWrapper (if any)
+func (consumer *SaramaConsumerHandler) wrapped() sarama.ConsumerGroupHandler {
+	var wrapped sarama.ConsumerGroupHandler = consumer
+	for i := len(consumer.wrappers) - 1; i >= 0; i-- {
+		wrapped = consumer.wrappers[i](wrapped)
+	}
+	return wrapped
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// recordingWrapper is a sarama.ConsumerGroupHandler that records its calls before delegating them, unless it
+// consumes the claims itself
+type recordingWrapper struct {
+	sarama.ConsumerGroupHandler
+	name         string
+	calls        *[]string
+	consumeClaim bool
+}
+
+func (w recordingWrapper) Setup(session sarama.ConsumerGroupSession) error {
+	*w.calls = append(*w.calls, w.name+" setup")
+	return w.ConsumerGroupHandler.Setup(session)
+}
+
+func (w recordingWrapper) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	*w.calls = append(*w.calls, w.name+" consume")
+	if w.consumeClaim {
+		for range claim.Messages() {
+		}
+		return nil
+	}
+	return w.ConsumerGroupHandler.ConsumeClaim(session, claim)
+}
+
+func TestHandlerWrapper(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		consumeClaim bool
+		expectMarked bool
+	}{
+		{
+			name:         "Delegating Wrappers",
+			expectMarked: true,
+		},
+		{
+			name:         "Wrapper Consumes The Claims",
+			consumeClaim: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			factory := kafkaConsumerGroupFactoryImpl{config: sarama.NewConfig(), addrs: []string{"b1"}}
+			var calls []string
+			wrapper := func(name string, consumeClaim bool) HandlerWrapper {
+				return func(next sarama.ConsumerGroupHandler) sarama.ConsumerGroupHandler {
+					return recordingWrapper{ConsumerGroupHandler: next, name: name, calls: &calls, consumeClaim: consumeClaim}
+				}
+			}
+			session := &mockConsumerGroupSession{}
+			consume := func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+				_ = handler.Setup(session)
+				_ = handler.ConsumeClaim(session, mockConsumerGroupClaim{msg: &sarama.ConsumerMessage{Topic: "test-topic"}})
+				_ = handler.Cleanup(session)
+				return sarama.ErrClosedConsumerGroup
+			}
+
+			group := factory.startExistingConsumerGroup("group", &mockConsumerGroup{}, consume, []string{"test-topic"}, zap.NewNop().Sugar(),
+				mockMessageHandler{shouldMark: true}, nil, WithHandlerWrapper(wrapper("outer", false)),
+				WithHandlerWrapper(wrapper("inner", testCase.consumeClaim)))
+			<-group.state.done
+			assert.Equal(t, []string{"outer setup", "inner setup", "outer consume", "inner consume"}, calls)
+			assert.Equal(t, testCase.expectMarked, session.marked)
+		})
+	}
+}
+
+func TestWrappedWithoutWrappers(t *testing.T) {
+	handler := NewConsumerHandler(zap.NewNop().Sugar(), mockMessageHandler{}, make(chan error))
+	assert.Same(t, &handler, handler.wrapped())
+}
@@ -26,6 +26,7 @@ import (
 	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
 
 	"github.com/Shopify/sarama"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
@@ -44,6 +45,23 @@ type managedGroup interface {
 	errors() chan error
 	processLock(*commands.CommandLock, bool) error
 	isStopped() bool
+	swapHandler(KafkaConsumerHandler, []SaramaConsumerHandlerOption) error
+	handlerOptions() []SaramaConsumerHandlerOption
+	waitForConsumeExit(time.Duration) error
+	markJoined()
+	waitForJoin(time.Duration) error
+	markConsuming()
+	waitForConsuming(time.Duration) error
+	topics() []string
+	setTopics([]string)
+	followTopics()
+	createGroupFn() createSaramaGroupFn
+	setCreateGroupFn(createSaramaGroupFn)
+	state() *groupState
+	lockToken() string
+	isDead() bool
+	setLockExpiredNotifier(func())
+	withStateLocked(func())
 }
 
 // managedGroupImpl implements the managedGroup interface
@@ -57,13 +75,40 @@ type managedGroupImpl struct {
 	cancelConsume      func()               // Called by the manager during CloseConsumerGroup
 	lockedBy           atomic.Value         // The LockToken of the ConsumerGroupAsyncCommand that requested the lock
 	cancelLockTimeout  func()               // Called internally to stop the lock timeout when a lock is removed
+	lockedAt           time.Time            // When the current lockedBy token first locked the group
+	lockExpired        func()               // Called when a lock is released by its timeout (nil if not needed)
+	lockMutex          sync.Mutex           // Serializes changes to the lockedBy token, lockedAt and cancelLockTimeout
 	groupMutex         sync.RWMutex         // Used to synchronize access to the internal sarama ConsumerGroup
+	stateMutex         sync.Mutex           // Serializes the stop, start, and close transitions of this group
+	restartMutex       sync.RWMutex         // Used to synchronize access to the restartWaitChannel
+	handlerRef         *handlerReference    // The handler used by the factory's consume loop (may be swapped)
+	consumeDone        <-chan struct{}      // Closed when the factory's consume goroutine has exited
+	joinedChannel      chan struct{}        // Closed when a session has been set up since the group was (re)started
+	joinedOnce         *sync.Once           // Ensures that the current joinedChannel is only closed once
+	consumingChannel   chan struct{}        // Closed when every claim of such a session has begun consuming
+	consumingOnce      *sync.Once           // Ensures that the current consumingChannel is only closed once
+	joinMutex          sync.Mutex           // Used to synchronize access to the joined and consuming channels
+	subscribedTopics   []string             // The topics that the group consumes
+	topicsChanged      chan struct{}        // Closed when the subscribedTopics are replaced
+	topicsMutex        sync.RWMutex         // Used to synchronize access to the subscribedTopics and topicsChanged
+	followsTopics      bool                 // Whether consume uses the subscribedTopics instead of those it is given
+	createGroup        createSaramaGroupFn  // Re-creates a group added via AddExistingGroup (nil for others)
+	groupState         *groupState          // The state of the factory's consume loop (empty if there is none)
 }
 
 // createManagedGroup associates a Sarama ConsumerGroup and cancel function (usually from the factory)
-// inside a new managedGroup struct.  If a timeout is given (nonzero), the lockId will be reset to an
+// inside a new managedGroup struct, along with the groupState of the factory's consume loop (nil if the
+// group was not started by the factory).  If a timeout is given (nonzero), the lockId will be reset to an
 // empty string (i.e. "unlocked") after that time has passed.
-func createManagedGroup(ctx context.Context, logger *zap.Logger, group sarama.ConsumerGroup, cancelErrors func(), cancelConsume func()) managedGroup {
+func createManagedGroup(ctx context.Context, logger *zap.Logger, group sarama.ConsumerGroup, cancelErrors func(), cancelConsume func(), state *groupState) managedGroup {
+	var handlerRef *handlerReference
+	var consumeDone <-chan struct{}
+	if state == nil {
+		state = &groupState{}
+	} else {
+		handlerRef = state.handlerRef
+		consumeDone = state.done
+	}
 
 	managedGrp := &managedGroupImpl{
 		logger:            logger,
@@ -72,6 +117,13 @@ func createManagedGroup(ctx context.Context, logger *zap.Logger, group sarama.Co
 		cancelErrors:      cancelErrors,
 		cancelConsume:     cancelConsume,
 		groupMutex:        sync.RWMutex{},
+		handlerRef:        handlerRef,
+		consumeDone:       consumeDone,
+		joinedChannel:     make(chan struct{}),
+		joinedOnce:        &sync.Once{},
+		consumingChannel:  make(chan struct{}),
+		consumingOnce:     &sync.Once{},
+		groupState:        state,
 	}
 
 	// Atomic values must be initialized with their desired type before being accessed, or a nil
@@ -87,6 +139,9 @@ func createManagedGroup(ctx context.Context, logger *zap.Logger, group sarama.Co
 
 // stop stops the managed group (which means closing the internal ConsumerGroup and marking the managed group as stopped)
 func (m *managedGroupImpl) stop() error {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+
 	// The managedGroup's start channel must be created (that is, the managedGroup must be marked
 	// as "stopped") before closing the internal ConsumerGroup, otherwise the consume function would
 	// return control to the factory.
@@ -105,11 +160,15 @@ func (m *managedGroupImpl) stop() error {
 // start creates a Sarama ConsumerGroup using the provided createGroup function and marks the
 // managedGroup as "started" by closing the restartWaitChannel
 func (m *managedGroupImpl) start(createGroup createSaramaGroupFn) error {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+
 	group, err := createGroup()
 	if err != nil {
 		return err
 	}
 	m.setSaramaGroup(group)
+	m.resetJoined()         // The restarted group has not joined until its first new session is set up
 	m.closeRestartChannel() // Closing this allows the waitForStart function to finish
 	return nil
 }
@@ -118,6 +177,9 @@ func (m *managedGroupImpl) start(createGroup createSaramaGroupFn) error {
 // loops first.  This is distinct from "stop" which expects the consume/error loops to continue while
 // waiting for a restart.
 func (m *managedGroupImpl) close() error {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+
 	// Make sure a managed group is "started" before closing the inner ConsumerGroup; otherwise anything
 	// waiting for the manager to restart the group will never return.
 	m.closeRestartChannel()
@@ -133,12 +195,39 @@ func (m *managedGroupImpl) close() error {
 	} else {
 		m.cancelConsume() // This will stop the factory's consume loop after the ConsumerGroup is closed
 	}
-	return m.getSaramaGroup().Close()
+	err := m.getSaramaGroup().Close()
+	if m.groupState.producer != nil {
+		// The producer outlives stop/start cycles, so it is only closed along with the managed group
+		err = multierr.Append(err, m.groupState.producer.Close())
+	}
+	return err
+}
+
+// waitForConsumeExit blocks until the factory's consume goroutine for this group has exited, returning an
+// error if that does not happen within the given timeout.  If there is no consume goroutine associated with
+// this managed group, it returns immediately.
+func (m *managedGroupImpl) waitForConsumeExit(timeout time.Duration) error {
+	if m.consumeDone == nil {
+		return nil
+	}
+	select {
+	case <-m.consumeDone:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for the consume goroutine to exit", timeout)
+	}
 }
 
 // consume calls the Consume function on the managed ConsumerGroup, supporting the stop/start functionality
 func (m *managedGroupImpl) consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
 	for {
+		if m.followsTopics {
+			// Obtain the topics each time, as they may have been replaced while the group was stopped
+			if topics = m.waitForTopics(ctx); topics == nil {
+				m.logger.Debug("Managed Consume Canceled")
+				return fmt.Errorf("context was canceled waiting for topics to consume")
+			}
+		}
 		// Call the internal sarama ConsumerGroup's Consume function directly
 		err := m.getSaramaGroup().Consume(ctx, topics, handler)
 		if !m.isStopped() {
@@ -156,6 +245,153 @@ func (m *managedGroupImpl) consume(ctx context.Context, topics []string, handler
 	}
 }
 
+// swapHandler replaces the handler used by the consume loop.  The new handler is used starting with the
+// next message delivered to any current claim, and the new options take effect when the next session begins,
+// so swapping a handler does not cause a rebalance.
+func (m *managedGroupImpl) swapHandler(handler KafkaConsumerHandler, options []SaramaConsumerHandlerOption) error {
+	if m.handlerRef == nil {
+		return fmt.Errorf("managed group has no handler reference")
+	}
+	if handler == nil {
+		return fmt.Errorf("cannot swap in a nil handler")
+	}
+	m.handlerRef.set(handler, options)
+	return nil
+}
+
+// markJoined records that a session of the group has been set up since the group was created or restarted
+func (m *managedGroupImpl) markJoined() {
+	m.joinMutex.Lock()
+	defer m.joinMutex.Unlock()
+	m.joinedOnce.Do(func() { close(m.joinedChannel) })
+}
+
+// resetJoined replaces the joinedChannel and consumingChannel with new ones, which are closed when the next session
+// is set up and has begun consuming
+func (m *managedGroupImpl) resetJoined() {
+	m.joinMutex.Lock()
+	defer m.joinMutex.Unlock()
+	m.joinedChannel = make(chan struct{})
+	m.joinedOnce = &sync.Once{}
+	m.consumingChannel = make(chan struct{})
+	m.consumingOnce = &sync.Once{}
+}
+
+// waitForJoin blocks until a session of the group has been set up since the group was created or
+// restarted, returning an error if that does not happen within the given timeout
+func (m *managedGroupImpl) waitForJoin(timeout time.Duration) error {
+	m.joinMutex.Lock()
+	joined := m.joinedChannel
+	m.joinMutex.Unlock()
+	select {
+	case <-joined:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for the group to join", timeout)
+	}
+}
+
+// markConsuming records that every claim of a session has begun consuming since the group was created or restarted
+func (m *managedGroupImpl) markConsuming() {
+	m.joinMutex.Lock()
+	defer m.joinMutex.Unlock()
+	m.consumingOnce.Do(func() { close(m.consumingChannel) })
+}
+
+// waitForConsuming blocks until every claim of a session has begun consuming since the group was created or
+// restarted, returning an error if that does not happen within the given timeout
+func (m *managedGroupImpl) waitForConsuming(timeout time.Duration) error {
+	m.joinMutex.Lock()
+	consuming := m.consumingChannel
+	m.joinMutex.Unlock()
+	select {
+	case <-consuming:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v waiting for the group to begin consuming", timeout)
+	}
+}
+
+// topics returns a copy of the topics that the group consumes
+func (m *managedGroupImpl) topics() []string {
+	m.topicsMutex.RLock()
+	defer m.topicsMutex.RUnlock()
+	return append([]string{}, m.subscribedTopics...)
+}
+
+// setTopics stores a copy of the topics that the group consumes
+func (m *managedGroupImpl) setTopics(topics []string) {
+	m.topicsMutex.Lock()
+	defer m.topicsMutex.Unlock()
+	m.subscribedTopics = append([]string{}, topics...)
+	if m.topicsChanged != nil {
+		close(m.topicsChanged)
+	}
+	m.topicsChanged = make(chan struct{})
+}
+
+// followTopics makes consume subscribe to the current topics of the group (see setTopics) each time the group is
+// started, rather than to those it is given, and wait while there are none.  It must be called before the managed
+// group is added to the manager's map, since it is not synchronized.
+func (m *managedGroupImpl) followTopics() {
+	m.followsTopics = true
+}
+
+// waitForTopics blocks until the group has topics to consume, returning a copy of them, or nil if the context is
+// done first
+func (m *managedGroupImpl) waitForTopics(ctx context.Context) []string {
+	for {
+		m.topicsMutex.RLock()
+		topics, changed := append([]string{}, m.subscribedTopics...), m.topicsChanged
+		m.topicsMutex.RUnlock()
+		if len(topics) > 0 {
+			return topics
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// createGroupFn returns the function that re-creates the sarama ConsumerGroup when the managed group is started
+// after a stop, if the group was not created by the manager's own factory (otherwise it returns nil)
+func (m *managedGroupImpl) createGroupFn() createSaramaGroupFn {
+	return m.createGroup
+}
+
+// setCreateGroupFn sets the function returned by createGroupFn.  It must be called before the managed group
+// is added to the manager's map, since it is not synchronized.
+func (m *managedGroupImpl) setCreateGroupFn(createGroup createSaramaGroupFn) {
+	m.createGroup = createGroup
+}
+
+// state returns the groupState of the factory's consume loop, whose fields are all nil if there is none
+func (m *managedGroupImpl) state() *groupState {
+	return m.groupState
+}
+
+// isDead returns true if the factory's consume loop of this group has given up, so the group cannot be restarted
+func (m *managedGroupImpl) isDead() bool {
+	select {
+	case <-m.groupState.dead:
+		return true
+	default:
+		return false // Including when there is no dead channel, since receiving from a nil channel blocks
+	}
+}
+
+// handlerOptions returns the current options of the handler used by the consume loop, which may be
+// needed in order to re-create the sarama ConsumerGroup
+func (m *managedGroupImpl) handlerOptions() []SaramaConsumerHandlerOption {
+	if m.handlerRef == nil {
+		return nil
+	}
+	_, options, _ := m.handlerRef.get()
+	return options
+}
+
 // getErrors returns the error channel, which is relayed from the internal managed ConsumerGroup
 func (m *managedGroupImpl) errors() chan error {
 	return m.transferredErrors
@@ -179,6 +415,8 @@ func (m *managedGroupImpl) setSaramaGroup(group sarama.ConsumerGroup) {
 // existing one) and reset the timer to the provided timeout.  After the timer expires, the lockToken
 // will be set to an empty string (representing "unlocked")
 func (m *managedGroupImpl) resetLock(lockToken string, timeout time.Duration) {
+	m.lockMutex.Lock()
+	defer m.lockMutex.Unlock()
 
 	// Stop any existing timer (without releasing the lock) so that it won't inadvertently do an unlock later
 	if m.cancelLockTimeout != nil {
@@ -192,6 +430,11 @@ func (m *managedGroupImpl) resetLock(lockToken string, timeout time.Duration) {
 		// for the purpose of stopping the lockTimer without clearing the token
 		ctx, cancel := context.WithCancel(context.Background())
 		m.cancelLockTimeout = cancel
+		// Extending an existing lock does not reset the time it has been held for
+		if m.lockedBy.Load() != lockToken {
+			m.lockedAt = time.Now()
+		}
+		lockedAt := m.lockedAt
 		// Mark this group as "locked" by the provided token
 		m.lockedBy.Store(lockToken)
 		m.logger.Info("Managed group locked", zap.String("token", lockToken), zap.Duration("Timeout", timeout))
@@ -202,8 +445,7 @@ func (m *managedGroupImpl) resetLock(lockToken string, timeout time.Duration) {
 		go func() {
 			select {
 			case <-lockTimer.C:
-				m.logger.Debug("Managed Group lock timer expired")
-				m.removeLock()
+				m.expireLock(ctx, lockToken, lockedAt)
 			case <-ctx.Done():
 				m.logger.Debug("Managed Group lock timer canceled")
 				if lockTimer.Stop() {
@@ -217,7 +459,7 @@ func (m *managedGroupImpl) resetLock(lockToken string, timeout time.Duration) {
 		// If a lockToken and a timeout were not both provided, remove any existing lock
 		// (locking a managed group for literally forever is not supported, although an
 		// arbitrarily long time may be used).
-		m.removeLock()
+		m.removeLockLocked()
 	}
 }
 
@@ -228,15 +470,66 @@ func (m *managedGroupImpl) canUnlock(token string) bool {
 	return lockToken == "" || lockToken == token
 }
 
+// lockToken returns the token that the group is locked by, or an empty string if it is unlocked
+func (m *managedGroupImpl) lockToken() string {
+	token, _ := m.lockedBy.Load().(string)
+	return token
+}
+
 // removeLock sets the lockedBy token to an empty string, meaning "unlocked"
 func (m *managedGroupImpl) removeLock() {
+	m.lockMutex.Lock()
+	defer m.lockMutex.Unlock()
+	m.removeLockLocked()
+}
+
+// removeLockLocked removes the lock in the manner of removeLock.  The caller must hold the lockMutex.
+func (m *managedGroupImpl) removeLockLocked() {
 	if m.lockedBy.Load() != "" {
 		m.logger.Debug("Managed Group lock removed")
+		m.lockedAt = time.Time{}
 		m.lockedBy.Store("")
 		m.cancelLockTimeout() // Make sure an existing timer doesn't re-clear the token later
 	}
 }
 
+// expireLock removes the lock when its timer expires.  Since the holder of a lock is expected to release it
+// explicitly (via UnlockAfter), an expired lock usually means that a control-protocol client failed to do so,
+// and is therefore logged as a warning.  The context is that of the timer, which is canceled when the lock is
+// renewed or removed.
+func (m *managedGroupImpl) expireLock(timerCtx context.Context, lockToken string, lockedAt time.Time) {
+	m.lockMutex.Lock()
+	if timerCtx.Err() != nil || m.lockedBy.Load() != lockToken {
+		// The lock was renewed, removed or replaced since the timer expired
+		m.lockMutex.Unlock()
+		return
+	}
+	m.logger.Warn("Managed Group Lock Expired Without Being Unlocked",
+		zap.String("Token", lockToken), zap.Duration("HeldFor", time.Since(lockedAt)))
+	m.removeLockLocked()
+	m.lockMutex.Unlock()
+	if m.lockExpired != nil {
+		m.lockExpired()
+	}
+}
+
+// withStateLocked calls the function while the group can neither be stopped, started or closed, nor locked or
+// unlocked, so that the function sees a coherent state of the group
+func (m *managedGroupImpl) withStateLocked(fn func()) {
+	m.stateMutex.Lock()
+	defer m.stateMutex.Unlock()
+	m.lockMutex.Lock()
+	defer m.lockMutex.Unlock()
+	fn()
+}
+
+// setLockExpiredNotifier sets the function that is called when a lock is released by its timeout rather than
+// explicitly.  It must be called before the managed group is added to the manager's map, since it is not
+// synchronized.
+func (m *managedGroupImpl) setLockExpiredNotifier(notifier func()) {
+	m.lockExpired = notifier
+}
+
 // processLock handles setting and removing the managedGroup's lock status:
 // - Lock the group, if "lock" is true and cmdLock.LockBefore is true
 // - Unlock the group, if "lock" is false and cmdLock.UnlockAfter is true
@@ -282,6 +575,8 @@ func (m *managedGroupImpl) isStopped() bool {
 // createRestartChannel sets the state of the managed group to "stopped" by creating the restartWaitChannel
 // channel that will be closed when the group is restarted.
 func (m *managedGroupImpl) createRestartChannel() {
+	m.restartMutex.Lock()
+	defer m.restartMutex.Unlock()
 	// Don't re-create the channel if it already exists (the managed group is already stopped)
 	if !m.isStopped() {
 		m.restartWaitChannel = make(chan struct{})
@@ -291,6 +586,8 @@ func (m *managedGroupImpl) createRestartChannel() {
 
 // closeRestartChannel sets the state of the managed group to "started" by closing the restartWaitChannel channel.
 func (m *managedGroupImpl) closeRestartChannel() {
+	m.restartMutex.Lock()
+	defer m.restartMutex.Unlock()
 	// If the managed group is already started, don't try to close the restart wait channel
 	if m.isStopped() {
 		m.stopped.Store(false)
@@ -301,12 +598,17 @@ func (m *managedGroupImpl) closeRestartChannel() {
 // waitForStart will block until a stopped ("paused") ConsumerGroup has been restarted by the
 // KafkaConsumerGroupManager, returning true in that case or false if the context's cancel function is called
 func (m *managedGroupImpl) waitForStart(ctx context.Context) bool {
+	m.restartMutex.RLock()
 	if !m.isStopped() {
+		m.restartMutex.RUnlock()
 		return true // group is already started; don't try to read from closed channel
 	}
+	restartWaitChannel := m.restartWaitChannel
+	m.restartMutex.RUnlock()
+
 	// Wait for either the restartWaitChannel to be closed, or for the provided context to have its cancel function called.
 	select {
-	case <-m.restartWaitChannel:
+	case <-restartWaitChannel:
 		return true
 	case <-ctx.Done():
 		return false
@@ -316,8 +618,14 @@ func (m *managedGroupImpl) waitForStart(ctx context.Context) bool {
 // transferErrors starts a goroutine that reads errors from the managedGroup's internal group.Errors() channel
 // and sends them to the m.errors channel.  This is done so that when the group.Errors() channel is closed during
 // a stop ("pause") of the group, the m.errors channel can remain open (so that users of the manager do not
-// receive a closed error channel during stop/start events).
+// receive a closed error channel during stop/start events).  The handler errors of the factory's consume loop
+// are relayed to the m.errors channel as well, and it is only closed once neither relay can send to it.
 func (m *managedGroupImpl) transferErrors(ctx context.Context) {
+	handlerErrorsDone := make(chan struct{})
+	go func() {
+		defer close(handlerErrorsDone)
+		m.transferHandlerErrors(ctx)
+	}()
 	go func() {
 		for {
 			m.logger.Debug("Starting managed group error transfer")
@@ -328,6 +636,7 @@ func (m *managedGroupImpl) transferErrors(ctx context.Context) {
 				// If the error channel was closed without the consumergroup being marked as stopped,
 				// or if we were unable to wait for the group to be restarted, that is outside
 				// of the manager's responsibility, so we are finished transferring errors.
+				<-handlerErrorsDone
 				close(m.transferredErrors)
 				return
 			}
@@ -340,3 +649,27 @@ func (m *managedGroupImpl) transferErrors(ctx context.Context) {
 		}
 	}()
 }
+
+// transferHandlerErrors sends the handler errors of the factory's consume loop to the m.errors channel, until
+// the consume loop has exited or the context is canceled.  The handler error channel outlives stop/start cycles,
+// so unlike the errors of the sarama ConsumerGroup it does not need to be obtained again after a restart.
+func (m *managedGroupImpl) transferHandlerErrors(ctx context.Context) {
+	if m.groupState.errors == nil {
+		return
+	}
+	for {
+		select {
+		case handlerErr, ok := <-m.groupState.errors:
+			if !ok {
+				return
+			}
+			select {
+			case m.transferredErrors <- handlerErr:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
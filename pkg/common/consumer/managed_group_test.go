@@ -20,12 +20,16 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	logtesting "knative.dev/pkg/logging/testing"
 
 	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
@@ -63,7 +67,7 @@ func TestManagedGroup(t *testing.T) {
 
 			mockGroup := kafkatesting.NewMockConsumerGroup()
 			mockGroup.On("Errors").Return(make(chan error))
-			group := createManagedGroup(ctx, logtesting.TestLogger(t).Desugar(), mockGroup, cancel, func() {}).(*managedGroupImpl)
+			group := createManagedGroup(ctx, logtesting.TestLogger(t).Desugar(), mockGroup, cancel, func() {}, nil).(*managedGroupImpl)
 			waitGroup := sync.WaitGroup{}
 			assert.False(t, group.isStopped())
 
@@ -284,6 +288,85 @@ func TestResetLockTimer(t *testing.T) {
 	}
 }
 
+func TestLockExpiry(t *testing.T) {
+	for _, testCase := range []struct {
+		name         string
+		unlock       bool
+		expectExpiry bool
+	}{
+		{
+			name:         "Expired",
+			expectExpiry: true,
+		},
+		{
+			name:   "Explicitly Unlocked",
+			unlock: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			mockGroup := kafkatesting.NewMockConsumerGroup()
+			mockGroup.On("Errors").Return(make(chan error))
+			core, logs := observer.New(zapcore.WarnLevel)
+			managedGrp := createManagedGroup(context.Background(), zap.New(core), mockGroup, func() {}, func() {}, nil).(*managedGroupImpl)
+			var expired int32
+			managedGrp.setLockExpiredNotifier(func() { atomic.AddInt32(&expired, 1) })
+
+			lock := &commands.CommandLock{LockBefore: true, UnlockAfter: true, Token: "token", Timeout: shortTimeout / 2}
+			assert.Nil(t, managedGrp.processLock(lock, true))
+			time.Sleep(shortTimeout / 4)
+			assert.Nil(t, managedGrp.processLock(lock, true)) // Extending the lock keeps the original lock time
+			if testCase.unlock {
+				assert.Nil(t, managedGrp.processLock(lock, false))
+			}
+			time.Sleep(shortTimeout)
+
+			assert.Equal(t, "", managedGrp.lockedBy.Load())
+			if !testCase.expectExpiry {
+				assert.Equal(t, int32(0), atomic.LoadInt32(&expired))
+				assert.Equal(t, 0, logs.Len())
+				return
+			}
+			assert.Equal(t, int32(1), atomic.LoadInt32(&expired))
+			assert.Equal(t, 1, logs.Len())
+			fields := logs.All()[0].ContextMap()
+			assert.Equal(t, "token", fields["Token"])
+			assert.GreaterOrEqual(t, int64(fields["HeldFor"].(time.Duration)), int64(shortTimeout*5/8)) // Longer than the timeout itself
+		})
+	}
+}
+
+func TestLockRenewExpireRace(t *testing.T) {
+	_, managedGrp := createMockAndManagedGroups(t)
+	var expired int32
+	managedGrp.setLockExpiredNotifier(func() { atomic.AddInt32(&expired, 1) })
+
+	// A timer that expired just before its lock was renewed must not remove the renewed lock
+	managedGrp.resetLock("token", time.Hour)
+	staleCtx, cancel := context.WithCancel(context.Background())
+	cancel() // As resetLock does when it renews the lock
+	managedGrp.expireLock(staleCtx, "token", time.Now())
+	assert.Equal(t, "token", managedGrp.lockToken())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&expired))
+
+	// Renew the lock with timers that expire while it is being renewed (and its lock time read) by other goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				managedGrp.resetLock("token", time.Microsecond)
+				_ = managedGrp.canUnlock("token")
+			}
+		}()
+	}
+	wg.Wait()
+	managedGrp.resetLock("token", time.Hour)
+	time.Sleep(10 * time.Millisecond) // Let any of the expired timers that are still running finish
+	assert.Equal(t, "token", managedGrp.lockToken())
+	managedGrp.removeLock()
+}
+
 func TestManagedGroupConsume(t *testing.T) {
 
 	for _, testCase := range []struct {
@@ -443,6 +526,94 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestWaitForConsumeExit(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		noChannel bool
+		exit      bool
+		expectErr bool
+	}{
+		{
+			name:      "No Consume Goroutine",
+			noChannel: true,
+		},
+		{
+			name: "Goroutine Exits",
+			exit: true,
+		},
+		{
+			name:      "Timeout",
+			expectErr: true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, mgdGroup := createMockAndManagedGroups(t)
+			doneCh := make(chan struct{})
+			if !testCase.noChannel {
+				mgdGroup.consumeDone = doneCh
+			}
+			if testCase.exit {
+				go close(doneCh)
+			}
+			err := mgdGroup.waitForConsumeExit(shortTimeout)
+			assert.Equal(t, testCase.expectErr, err != nil)
+		})
+	}
+}
+
+func TestWaitForJoin(t *testing.T) {
+	mockGroup, mgdGroup := createMockAndManagedGroups(t)
+
+	// Not joined yet
+	assert.NotNil(t, mgdGroup.waitForJoin(shortTimeout))
+
+	// Joined (marking more than once is harmless)
+	mgdGroup.markJoined()
+	mgdGroup.markJoined()
+	assert.Nil(t, mgdGroup.waitForJoin(shortTimeout))
+
+	// A restarted group has not joined until it is marked again
+	mockGroup.On("Close").Return(nil)
+	assert.Nil(t, mgdGroup.stop())
+	assert.Nil(t, mgdGroup.start(func() (sarama.ConsumerGroup, error) { return &mockConsumerGroup{}, nil }))
+	assert.NotNil(t, mgdGroup.waitForJoin(shortTimeout))
+	go mgdGroup.markJoined()
+	assert.Nil(t, mgdGroup.waitForJoin(shortTimeout))
+}
+
+func TestWaitForConsuming(t *testing.T) {
+	mockGroup, mgdGroup := createMockAndManagedGroups(t)
+
+	// Joining is not enough
+	mgdGroup.markJoined()
+	assert.NotNil(t, mgdGroup.waitForConsuming(shortTimeout))
+	mgdGroup.markConsuming()
+	mgdGroup.markConsuming()
+	assert.Nil(t, mgdGroup.waitForConsuming(shortTimeout))
+
+	// A restarted group is not consuming until it is marked again
+	mockGroup.On("Close").Return(nil)
+	assert.Nil(t, mgdGroup.stop())
+	assert.Nil(t, mgdGroup.start(func() (sarama.ConsumerGroup, error) { return &mockConsumerGroup{}, nil }))
+	assert.NotNil(t, mgdGroup.waitForConsuming(shortTimeout))
+	go mgdGroup.markConsuming()
+	assert.Nil(t, mgdGroup.waitForConsuming(shortTimeout))
+}
+
+func TestManagedGroupTopics(t *testing.T) {
+	_, mgdGroup := createMockAndManagedGroups(t)
+	assert.Equal(t, []string{}, mgdGroup.topics())
+
+	topics := []string{"topic-1", "topic-2"}
+	mgdGroup.setTopics(topics)
+	topics[0] = "modified"
+	assert.Equal(t, []string{"topic-1", "topic-2"}, mgdGroup.topics())
+
+	returned := mgdGroup.topics()
+	returned[1] = "modified"
+	assert.Equal(t, []string{"topic-1", "topic-2"}, mgdGroup.topics())
+}
+
 func TestTransferErrors(t *testing.T) {
 	for _, testCase := range []struct {
 		name       string
@@ -477,6 +648,7 @@ func TestTransferErrors(t *testing.T) {
 				saramaGroup:       mockGrp,
 				transferredErrors: make(chan error),
 				groupMutex:        sync.RWMutex{},
+				groupState:        &groupState{},
 			}
 			managedGrp.lockedBy.Store("")
 			managedGrp.stopped.Store(false)
@@ -556,3 +728,80 @@ func (m *mockManagedGroup) processLock(cmdLock *commands.CommandLock, lock bool)
 func (m *mockManagedGroup) isStopped() bool {
 	return m.Called().Bool(0)
 }
+
+func (m *mockManagedGroup) waitForConsumeExit(timeout time.Duration) error {
+	return m.Called(timeout).Error(0)
+}
+
+func (m *mockManagedGroup) swapHandler(handler KafkaConsumerHandler, options []SaramaConsumerHandlerOption) error {
+	return m.Called(handler, options).Error(0)
+}
+
+func (m *mockManagedGroup) handlerOptions() []SaramaConsumerHandlerOption {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil
+	}
+	return args.Get(0).([]SaramaConsumerHandlerOption)
+}
+
+func (m *mockManagedGroup) markJoined() {
+	m.Called()
+}
+
+func (m *mockManagedGroup) waitForJoin(timeout time.Duration) error {
+	return m.Called(timeout).Error(0)
+}
+
+func (m *mockManagedGroup) markConsuming() {
+	m.Called()
+}
+
+func (m *mockManagedGroup) waitForConsuming(timeout time.Duration) error {
+	return m.Called(timeout).Error(0)
+}
+
+func (m *mockManagedGroup) topics() []string {
+	return m.Called().Get(0).([]string)
+}
+
+func (m *mockManagedGroup) setTopics(topics []string) {
+	m.Called(topics)
+}
+
+func (m *mockManagedGroup) followTopics() {
+	m.Called()
+}
+
+func (m *mockManagedGroup) createGroupFn() createSaramaGroupFn {
+	fn := m.Called().Get(0)
+	if fn == nil {
+		return nil
+	}
+	return fn.(createSaramaGroupFn)
+}
+
+func (m *mockManagedGroup) setCreateGroupFn(createGroup createSaramaGroupFn) {
+	m.Called(createGroup)
+}
+
+func (m *mockManagedGroup) state() *groupState {
+	return m.Called().Get(0).(*groupState)
+}
+
+func (m *mockManagedGroup) lockToken() string {
+	return m.Called().String(0)
+}
+
+func (m *mockManagedGroup) isDead() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *mockManagedGroup) setLockExpiredNotifier(notifier func()) {
+	m.Called(notifier)
+}
+
+func (m *mockManagedGroup) withStateLocked(fn func()) {
+	m.Called()
+	fn()
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package prometheus provides a ConsumerGroupMetricsReporter that exports the activity of the ConsumerGroups as
+Prometheus metrics, so that it can be scraped without implementing a reporter.  It is kept apart from the consumer
+package so that only its users depend on the Prometheus client.
+
+Usage:
+- Create a Reporter with NewReporter() (e.g. with prometheus.DefaultRegisterer)
+- Pass it to NewConsumerGroupManager() (or NewConsumerGroupFactory()) via the consumer.WithMetricsReporter() option
+- Serve the registry with the promhttp handler (e.g. http.Handle("/metrics", promhttp.Handler()))
+*/
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"knative.dev/eventing-kafka/pkg/common/consumer"
+)
+
+// The namespace and subsystem of the metric names (e.g. eventing_kafka_consumer_group_starts_total)
+const (
+	Namespace = "eventing_kafka"
+	Subsystem = "consumer_group"
+)
+
+// The labels of the metrics
+const (
+	GroupIdLabel   = "group_id"
+	TopicLabel     = "topic"
+	PartitionLabel = "partition"
+)
+
+// Reporter is a consumer.ConsumerGroupMetricsReporter (and consumer.GenerationReporter and CommitGapReporter) that
+// records the activity of the ConsumerGroups in Prometheus collectors, labeled by GroupId
+type Reporter struct {
+	starts     *prometheus.CounterVec
+	stops      *prometheus.CounterVec
+	restarts   *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	consumed   *prometheus.CounterVec
+	lag        *prometheus.GaugeVec
+	generation *prometheus.GaugeVec
+	churn      *prometheus.CounterVec
+	commitGap  *prometheus.GaugeVec
+}
+
+// Verify that the Reporter satisfies the ConsumerGroupMetricsReporter, GenerationReporter and CommitGapReporter
+// interfaces
+var _ consumer.ConsumerGroupMetricsReporter = (*Reporter)(nil)
+var _ consumer.GenerationReporter = (*Reporter)(nil)
+var _ consumer.CommitGapReporter = (*Reporter)(nil)
+
+// NewReporter creates a Reporter and registers its collectors with the given registerer, returning an error if any
+// of them could not be registered (such as when another Reporter has already been registered with it)
+func NewReporter(registerer prometheus.Registerer) (*Reporter, error) {
+	newCounter := func(name string, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: Namespace, Subsystem: Subsystem, Name: name, Help: help}, labels)
+	}
+	reporter := &Reporter{
+		starts:   newCounter("starts_total", "Number of times a managed consumer group was created or started", GroupIdLabel),
+		stops:    newCounter("stops_total", "Number of times a managed consumer group was stopped or closed", GroupIdLabel),
+		restarts: newCounter("restarts_total", "Number of times a consumer group began a new session after a failed one, or was re-created", GroupIdLabel),
+		errors:   newCounter("errors_total", "Number of errors sent to the handler errors channel of a consumer group", GroupIdLabel),
+		consumed: newCounter("messages_consumed_total", "Number of messages received by a consumer group", GroupIdLabel, TopicLabel),
+		lag: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: Namespace, Subsystem: Subsystem, Name: "lag",
+			Help: "Number of messages of a partition that follow the last one received by a consumer group"}, []string{GroupIdLabel, TopicLabel, PartitionLabel}),
+		generation: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: Namespace, Subsystem: Subsystem, Name: "generation",
+			Help: "Generation of the last session of a consumer group, which is incremented by each rebalance"}, []string{GroupIdLabel}),
+		churn: newCounter("generation_churn_total", "Number of times the generation of a consumer group was incremented too often (see WithGenerationChurnThreshold)", GroupIdLabel),
+		commitGap: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: Namespace, Subsystem: Subsystem, Name: "commit_gap",
+			Help: "Number of offsets of a partition that a consumer group has marked but not committed"}, []string{GroupIdLabel, TopicLabel, PartitionLabel}),
+	}
+	for _, collector := range []prometheus.Collector{reporter.starts, reporter.stops, reporter.restarts, reporter.errors, reporter.consumed, reporter.lag,
+		reporter.generation, reporter.churn, reporter.commitGap} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return reporter, nil
+}
+
+// GroupStarted counts a start of the group
+func (r *Reporter) GroupStarted(groupId string) {
+	r.starts.WithLabelValues(groupId).Inc()
+}
+
+// GroupStopped counts a stop of the group
+func (r *Reporter) GroupStopped(groupId string) {
+	r.stops.WithLabelValues(groupId).Inc()
+}
+
+// GroupRestarted counts a restart of the group
+func (r *Reporter) GroupRestarted(groupId string) {
+	r.restarts.WithLabelValues(groupId).Inc()
+}
+
+// GroupError counts an error of the group
+func (r *Reporter) GroupError(groupId string, _ error) {
+	r.errors.WithLabelValues(groupId).Inc()
+}
+
+// MessageConsumed counts a message received by the group
+func (r *Reporter) MessageConsumed(groupId string, topic string, _ int32) {
+	r.consumed.WithLabelValues(groupId, topic).Inc()
+}
+
+// PartitionLag records the lag of a partition consumed by the group
+func (r *Reporter) PartitionLag(groupId string, topic string, partition int32, lag int64) {
+	r.lag.WithLabelValues(groupId, topic, strconv.Itoa(int(partition))).Set(float64(lag))
+}
+
+// GroupGeneration records the generation of the last session of the group
+func (r *Reporter) GroupGeneration(groupId string, generationId int32) {
+	r.generation.WithLabelValues(groupId).Set(float64(generationId))
+}
+
+// GenerationChurn counts a churn of the generation of the group
+func (r *Reporter) GenerationChurn(groupId string, _ int, _ time.Duration) {
+	r.churn.WithLabelValues(groupId).Inc()
+}
+
+// CommitGap records the commit gap of a partition consumed by the group
+func (r *Reporter) CommitGap(groupId string, topic string, partition int32, gap int64) {
+	r.commitGap.WithLabelValues(groupId, topic, strconv.Itoa(int(partition))).Set(float64(gap))
+}
+
+// CommitGapReleased removes the commit gap of a partition that the group no longer consumes
+func (r *Reporter) CommitGapReleased(groupId string, topic string, partition int32) {
+	r.commitGap.DeleteLabelValues(groupId, topic, strconv.Itoa(int(partition)))
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatheredValues returns the values of the gathered metrics, keyed by name and then by the values of their labels
+func gatheredValues(t *testing.T, registry *prometheus.Registry) map[string]map[string]float64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	values := make(map[string]map[string]float64)
+	for _, family := range families {
+		values[family.GetName()] = make(map[string]float64)
+		for _, metric := range family.GetMetric() {
+			labels := ""
+			for _, label := range metric.GetLabel() {
+				labels += label.GetValue() + "/"
+			}
+			if metric.GetCounter() != nil {
+				values[family.GetName()][labels] = metric.GetCounter().GetValue()
+			} else {
+				values[family.GetName()][labels] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestReporter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	reporter, err := NewReporter(registry)
+	assert.Nil(t, err)
+
+	reporter.GroupStarted("group-1")
+	reporter.GroupStarted("group-1")
+	reporter.GroupStarted("group-2")
+	reporter.GroupStopped("group-1")
+	reporter.GroupRestarted("group-2")
+	reporter.GroupError("group-2", fmt.Errorf("test error"))
+	reporter.MessageConsumed("group-1", "topic", 0)
+	reporter.MessageConsumed("group-1", "topic", 1)
+	reporter.PartitionLag("group-1", "topic", 0, 7)
+	reporter.PartitionLag("group-1", "topic", 0, 5)
+	reporter.GroupGeneration("group-1", 3)
+	reporter.GroupGeneration("group-1", 4)
+	reporter.GenerationChurn("group-1", 10, time.Minute)
+	reporter.CommitGap("group-1", "topic", 1, 12)
+	reporter.CommitGap("group-1", "topic", 1, 3)
+	reporter.CommitGap("group-1", "topic", 2, 4)
+	reporter.CommitGapReleased("group-1", "topic", 2)
+
+	assert.Equal(t, map[string]map[string]float64{
+		"eventing_kafka_consumer_group_starts_total":            {"group-1/": 2, "group-2/": 1},
+		"eventing_kafka_consumer_group_stops_total":             {"group-1/": 1},
+		"eventing_kafka_consumer_group_restarts_total":          {"group-2/": 1},
+		"eventing_kafka_consumer_group_errors_total":            {"group-2/": 1},
+		"eventing_kafka_consumer_group_messages_consumed_total": {"group-1/topic/": 2},
+		"eventing_kafka_consumer_group_lag":                     {"group-1/0/topic/": 5},
+		"eventing_kafka_consumer_group_generation":              {"group-1/": 4},
+		"eventing_kafka_consumer_group_generation_churn_total":  {"group-1/": 1},
+		"eventing_kafka_consumer_group_commit_gap":              {"group-1/1/topic/": 3},
+	}, gatheredValues(t, registry))
+
+	// The collectors of a second reporter conflict with those of the first
+	_, err = NewReporter(registry)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package schemaregistry provides a consumer.Deserializer for the messages that are serialized in the wire format of
+the Confluent Schema Registry (a zero "magic byte" and the 4-byte ID of the schema, followed by the encoded data),
+which fetches the schema of each message from the registry (once per schema ID) and decodes the data with it.  The
+decoding of each schema type is done by a Decoder, so that only the users of a type depend on its library (such as
+an Avro library); the JSON schema type is decoded with encoding/json unless another Decoder is given.
+
+Usage:
+  - Create a Deserializer with NewDeserializer(), passing the URL of the registry, the Decoder of each schema type of
+    the topics (e.g. WithDecoder(schemaregistry.Avro, avroDecoder)), and its credentials (e.g. WithBasicAuth())
+  - Pass it to StartConsumerGroup() (or NewConsumerGroupFactory()) via the consumer.WithDeserializer() option
+  - Obtain the decoded value in the handler with consumer.DeserializedValue(ctx)
+
+A message that cannot be decoded (including one whose schema cannot be fetched) is given to the handler of the
+consumer.WithDeserializationErrorHandler() option, as is the error of any Deserializer.
+*/
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"knative.dev/eventing-kafka/pkg/common/consumer"
+)
+
+// The schema types of the registry
+const (
+	Avro     = "AVRO"
+	Protobuf = "PROTOBUF"
+	JSON     = "JSON"
+)
+
+// magicByte is the first byte of a message in the wire format of the registry
+const magicByte = 0
+
+// headerLength is the length of the magic byte and the schema ID
+const headerLength = 5
+
+// defaultTimeout is the timeout of the requests to the registry, if no http.Client is given
+const defaultTimeout = 10 * time.Second
+
+// defaultFailureCacheDuration is how long a failure to fetch a schema is returned without asking the registry again
+const defaultFailureCacheDuration = 5 * time.Second
+
+// ErrInvalidWireFormat is the error (wrapped) of a message that is not in the wire format of the registry
+var ErrInvalidWireFormat = errors.New("message is not in the schema registry wire format")
+
+// ErrNoDecoder is the error (wrapped) of a message whose schema type has no Decoder
+var ErrNoDecoder = errors.New("no decoder for the schema type")
+
+// Schema is a schema of the registry
+type Schema struct {
+	ID         int
+	Type       string      // One of Avro, Protobuf, or JSON
+	Schema     string      // The definition of the schema (e.g. the JSON of an Avro schema)
+	References []Reference // The other schemas that the schema refers to (which are not fetched)
+}
+
+// Reference is a reference of a schema to another schema of the registry
+type Reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Decoder decodes the data of a message with its schema.  The message indexes are those of the Protobuf wire format
+// (which locate the message type within the schema, [0] being the first one), and are nil for the other types.
+type Decoder interface {
+	Decode(schema *Schema, messageIndexes []int, data []byte) (interface{}, error)
+}
+
+// DecoderFunc allows a function to be used as a Decoder
+type DecoderFunc func(schema *Schema, messageIndexes []int, data []byte) (interface{}, error)
+
+// Decode calls the function
+func (f DecoderFunc) Decode(schema *Schema, messageIndexes []int, data []byte) (interface{}, error) {
+	return f(schema, messageIndexes, data)
+}
+
+// JSONDecoder is the default Decoder of the JSON schema type, which unmarshals the data into an interface{} without
+// validating it against the schema
+var JSONDecoder Decoder = DecoderFunc(func(_ *Schema, _ []int, data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+})
+
+// RegistryError is the error of a message whose schema could not be fetched from the registry
+type RegistryError struct {
+	SchemaID   int
+	StatusCode int   // The HTTP status of the response of the registry (zero if there was none)
+	Err        error // The cause of the failure
+}
+
+// Error returns the cause of the failure, prefixed with the schema ID
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("could not fetch schema %d from the schema registry: %v", e.SchemaID, e.Err)
+}
+
+// Unwrap returns the cause of the failure
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures a Deserializer
+type Option func(deserializer *Deserializer)
+
+// WithBasicAuth authenticates the requests to the registry with the given username and password (such as the API
+// key and secret of Confluent Cloud).  Default is no authentication.
+func WithBasicAuth(username string, password string) Option {
+	return func(deserializer *Deserializer) {
+		deserializer.authorize = func(request *http.Request) error {
+			request.SetBasicAuth(username, password)
+			return nil
+		}
+	}
+}
+
+// WithBearerToken authenticates the requests to the registry with the bearer token returned by the given function,
+// which is called for each request (so that it can refresh the token), and whose error fails the request.  Default
+// is no authentication.
+func WithBearerToken(token func() (string, error)) Option {
+	return func(deserializer *Deserializer) {
+		deserializer.authorize = func(request *http.Request) error {
+			value, err := token()
+			if err != nil {
+				return fmt.Errorf("could not get the bearer token: %w", err)
+			}
+			request.Header.Set("Authorization", "Bearer "+value)
+			return nil
+		}
+	}
+}
+
+// WithHTTPClient sends the requests to the registry with the given http.Client (such as one with TLS client
+// certificates).  Default is a client with a timeout of ten seconds.
+func WithHTTPClient(client *http.Client) Option {
+	return func(deserializer *Deserializer) {
+		deserializer.client = client
+	}
+}
+
+// WithFailureCacheDuration sets how long a failure to fetch a schema is returned for the messages of that schema
+// without asking the registry again, so that a missing schema (or an unavailable registry) does not cost a request
+// for every message.  A non-positive duration asks the registry for every message.  Default is five seconds.
+func WithFailureCacheDuration(duration time.Duration) Option {
+	return func(deserializer *Deserializer) {
+		deserializer.failureCacheDuration = duration
+	}
+}
+
+// WithDecoder decodes the data of the messages whose schema is of the given type with the given Decoder.  Default
+// is JSONDecoder for the JSON type, and no Decoder (failing the message with ErrNoDecoder) for the other types.
+func WithDecoder(schemaType string, decoder Decoder) Option {
+	return func(deserializer *Deserializer) {
+		deserializer.decoders[strings.ToUpper(schemaType)] = decoder
+	}
+}
+
+// Deserializer is a consumer.Deserializer of the messages in the wire format of the registry.  The schemas that it
+// fetches are cached for its lifetime, since the registry never changes the schema of an ID, and the failures to
+// fetch them are cached briefly (see WithFailureCacheDuration).
+type Deserializer struct {
+	url                  string
+	client               *http.Client
+	authorize            func(request *http.Request) error
+	decoders             map[string]Decoder
+	failureCacheDuration time.Duration
+	now                  func() time.Time
+
+	lock     sync.RWMutex
+	schemas  map[int]*Schema
+	failures map[int]schemaFailure
+}
+
+// schemaFailure is a failure to fetch a schema, which is returned until it expires
+type schemaFailure struct {
+	err     error
+	expires time.Time
+}
+
+// Verify that the Deserializer satisfies the consumer.Deserializer interface
+var _ consumer.Deserializer = (*Deserializer)(nil)
+
+// NewDeserializer returns a Deserializer that fetches the schemas from the registry with the given URL (such as
+// "https://schema-registry:8081")
+func NewDeserializer(url string, options ...Option) *Deserializer {
+	deserializer := &Deserializer{
+		url:                  strings.TrimSuffix(url, "/"),
+		client:               &http.Client{Timeout: defaultTimeout},
+		authorize:            func(*http.Request) error { return nil },
+		decoders:             map[string]Decoder{JSON: JSONDecoder},
+		now:                  time.Now,
+		schemas:              make(map[int]*Schema),
+		failures:             make(map[int]schemaFailure),
+		failureCacheDuration: defaultFailureCacheDuration,
+	}
+	for _, option := range options {
+		option(deserializer)
+	}
+	return deserializer
+}
+
+// Deserialize decodes the value of the message with the schema whose ID precedes it.  A message whose value is nil
+// (a tombstone) is decoded as nil.
+func (d *Deserializer) Deserialize(message *sarama.ConsumerMessage) (interface{}, error) {
+	if message.Value == nil {
+		return nil, nil
+	}
+	if len(message.Value) < headerLength || message.Value[0] != magicByte {
+		return nil, ErrInvalidWireFormat
+	}
+	schema, err := d.Schema(int(binary.BigEndian.Uint32(message.Value[1:headerLength])))
+	if err != nil {
+		return nil, err
+	}
+	decoder, ok := d.decoders[schema.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %s of schema %d", ErrNoDecoder, schema.Type, schema.ID)
+	}
+	data := message.Value[headerLength:]
+	var messageIndexes []int
+	if schema.Type == Protobuf {
+		if messageIndexes, data, err = readMessageIndexes(data); err != nil {
+			return nil, err
+		}
+	}
+	return decoder.Decode(schema, messageIndexes, data)
+}
+
+// Schema returns the schema with the given ID, which is fetched from the registry unless it has been already (or
+// unless fetching it failed recently, in which case that failure is returned)
+func (d *Deserializer) Schema(id int) (*Schema, error) {
+	d.lock.RLock()
+	schema, ok := d.schemas[id]
+	failure, failed := d.failures[id]
+	d.lock.RUnlock()
+	if ok {
+		return schema, nil
+	}
+	if failed && d.now().Before(failure.expires) {
+		return nil, failure.err
+	}
+
+	schema, err := d.fetchSchema(id)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err != nil {
+		if d.failureCacheDuration > 0 {
+			d.failures[id] = schemaFailure{err: err, expires: d.now().Add(d.failureCacheDuration)}
+		}
+		return nil, err
+	}
+	delete(d.failures, id)
+	d.schemas[id] = schema
+	return schema, nil
+}
+
+// schemaResponse is the body of the response of the registry to a request for a schema by ID
+type schemaResponse struct {
+	Schema     string      `json:"schema"`
+	SchemaType string      `json:"schemaType"`
+	References []Reference `json:"references"`
+}
+
+// fetchSchema requests the schema with the given ID from the registry
+func (d *Deserializer) fetchSchema(id int) (*Schema, error) {
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/schemas/ids/%d", d.url, id), nil)
+	if err != nil {
+		return nil, &RegistryError{SchemaID: id, Err: err}
+	}
+	request.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if err = d.authorize(request); err != nil {
+		return nil, &RegistryError{SchemaID: id, Err: err}
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, &RegistryError{SchemaID: id, Err: err}
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, &RegistryError{SchemaID: id, StatusCode: response.StatusCode,
+			Err: fmt.Errorf("unexpected status %s: %s", response.Status, strings.TrimSpace(string(body)))}
+	}
+	var body schemaResponse
+	if err = json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, &RegistryError{SchemaID: id, StatusCode: response.StatusCode, Err: err}
+	}
+	schemaType := strings.ToUpper(body.SchemaType)
+	if schemaType == "" {
+		schemaType = Avro // The registry omits the type of Avro schemas
+	}
+	return &Schema{ID: id, Type: schemaType, Schema: body.Schema, References: body.References}, nil
+}
+
+// readMessageIndexes reads the message indexes that precede the data in the Protobuf wire format (a zigzag varint
+// count followed by that many zigzag varint indexes, where a count of zero stands for [0]), and returns them along
+// with the data that follows them
+func readMessageIndexes(data []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 || count > int64(len(data)) {
+		return nil, nil, fmt.Errorf("%w: invalid protobuf message indexes", ErrInvalidWireFormat)
+	}
+	data = data[n:]
+	if count == 0 {
+		return []int{0}, data, nil
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("%w: invalid protobuf message indexes", ErrInvalidWireFormat)
+		}
+		indexes[i] = int(index)
+		data = data[n:]
+	}
+	return indexes, data, nil
+}
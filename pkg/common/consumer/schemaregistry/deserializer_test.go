@@ -0,0 +1,154 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRegistry returns a test server with the schemas 1 (JSON), 2 (Avro, without a type) and 3 (Protobuf), which
+// counts the requests and checks that they have the given Authorization header
+func newRegistry(t *testing.T, authorization string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(requests, 1)
+		assert.Equal(t, authorization, request.Header.Get("Authorization"))
+		switch request.URL.Path {
+		case "/schemas/ids/1":
+			_, _ = fmt.Fprint(writer, `{"schema": "{\"type\": \"object\"}", "schemaType": "JSON"}`)
+		case "/schemas/ids/2":
+			_, _ = fmt.Fprint(writer, `{"schema": "\"string\""}`)
+		case "/schemas/ids/3":
+			_, _ = fmt.Fprint(writer, `{"schema": "message A {} message B {}", "schemaType": "PROTOBUF",
+				"references": [{"name": "other.proto", "subject": "other", "version": 2}]}`)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprint(writer, `{"error_code": 40403, "message": "Schema not found"}`)
+		}
+	}))
+}
+
+// wireFormat returns the value of a message with the given schema ID and data
+func wireFormat(id uint32, data ...byte) []byte {
+	value := []byte{magicByte, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(value[1:], id)
+	return append(value, data...)
+}
+
+func TestDeserializer(t *testing.T) {
+	var requests int32
+	registry := newRegistry(t, "", &requests)
+	defer registry.Close()
+	avroDecoder := DecoderFunc(func(schema *Schema, messageIndexes []int, data []byte) (interface{}, error) {
+		assert.Nil(t, messageIndexes)
+		return fmt.Sprintf("%s:%s", schema.Schema, data), nil
+	})
+	protobufDecoder := DecoderFunc(func(schema *Schema, messageIndexes []int, data []byte) (interface{}, error) {
+		assert.Equal(t, []Reference{{Name: "other.proto", Subject: "other", Version: 2}}, schema.References)
+		return fmt.Sprintf("%v:%s", messageIndexes, data), nil
+	})
+	deserializer := NewDeserializer(registry.URL+"/", WithDecoder("avro", avroDecoder), WithDecoder(Protobuf, protobufDecoder))
+
+	for _, testCase := range []struct {
+		name        string
+		value       []byte
+		expectValue interface{}
+		expectErr   error
+	}{
+		{name: "Tombstone", value: nil, expectValue: nil},
+		{name: "Too Short", value: []byte{magicByte, 0, 0}, expectErr: ErrInvalidWireFormat},
+		{name: "Wrong Magic Byte", value: []byte(`{"id": 1}`), expectErr: ErrInvalidWireFormat},
+		{name: "JSON", value: wireFormat(1, []byte(`{"id": 1}`)...), expectValue: map[string]interface{}{"id": float64(1)}},
+		{name: "Avro", value: wireFormat(2, 'a', 'b'), expectValue: `"string":ab`},
+		{name: "Protobuf First Message", value: wireFormat(3, 0, 'a'), expectValue: "[0]:a"},
+		{name: "Protobuf Nested Message", value: wireFormat(3, 4, 2, 6, 'a'), expectValue: "[1 3]:a"},
+		{name: "Protobuf Invalid Indexes", value: wireFormat(3, 4, 2), expectErr: ErrInvalidWireFormat},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := deserializer.Deserialize(&sarama.ConsumerMessage{Value: testCase.value})
+			if testCase.expectErr != nil {
+				assert.True(t, errors.Is(err, testCase.expectErr), err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, testCase.expectValue, value)
+			}
+		})
+	}
+
+	// Each schema is fetched once
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	_, err := deserializer.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(2, 'c')})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// An unknown schema fails with a RegistryError, which is returned again without a request until it expires
+	now := time.Now()
+	deserializer.now = func() time.Time { return now }
+	_, err = deserializer.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(4)})
+	var registryErr *RegistryError
+	assert.True(t, errors.As(err, &registryErr))
+	assert.Equal(t, 4, registryErr.SchemaID)
+	assert.Equal(t, http.StatusNotFound, registryErr.StatusCode)
+	assert.Contains(t, err.Error(), "Schema not found")
+	_, cachedErr := deserializer.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(4)})
+	assert.Equal(t, err, cachedErr)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	now = now.Add(defaultFailureCacheDuration)
+	_, _ = deserializer.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(4)})
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+
+	// Without the failure cache, every message of the unknown schema asks the registry
+	uncached := NewDeserializer(registry.URL, WithFailureCacheDuration(0))
+	_, _ = uncached.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(4)})
+	_, _ = uncached.Deserialize(&sarama.ConsumerMessage{Value: wireFormat(4)})
+	assert.Equal(t, int32(7), atomic.LoadInt32(&requests))
+
+	// A schema type without a Decoder fails with ErrNoDecoder
+	_, err = NewDeserializer(registry.URL).Deserialize(&sarama.ConsumerMessage{Value: wireFormat(2, 'a')})
+	assert.True(t, errors.Is(err, ErrNoDecoder))
+}
+
+func TestDeserializerAuth(t *testing.T) {
+	var requests int32
+	registry := newRegistry(t, "Basic dXNlcjpzZWNyZXQ=", &requests)
+	defer registry.Close()
+	schema, err := NewDeserializer(registry.URL, WithBasicAuth("user", "secret")).Schema(1)
+	assert.Nil(t, err)
+	assert.Equal(t, &Schema{ID: 1, Type: JSON, Schema: `{"type": "object"}`}, schema)
+
+	tokenRegistry := newRegistry(t, "Bearer token", &requests)
+	defer tokenRegistry.Close()
+	token := func() (string, error) { return "token", nil }
+	_, err = NewDeserializer(tokenRegistry.URL, WithBearerToken(token), WithHTTPClient(tokenRegistry.Client())).Schema(1)
+	assert.Nil(t, err)
+
+	// A token that cannot be obtained fails the request without sending it
+	failingToken := func() (string, error) { return "", fmt.Errorf("token error") }
+	_, err = NewDeserializer(tokenRegistry.URL, WithBearerToken(failingToken)).Schema(1)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "token error")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
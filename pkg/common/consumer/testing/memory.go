@@ -0,0 +1,456 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"knative.dev/eventing-kafka/pkg/common/consumer"
+)
+
+//
+// In-Memory KafkaConsumerGroupFactory
+//
+
+// MemoryConsumerGroupFactory is a KafkaConsumerGroupFactory whose ConsumerGroups consume the messages of in-memory
+// topics (see Enqueue) instead of those of a broker, so that KafkaConsumerHandlers can be tested without Kafka.
+// The handler is wrapped in a SaramaConsumerHandler, so that the options that affect the handling of the messages
+// (such as WithTimeout) apply; the options that require a broker (such as WithProducer) have no effect.
+//
+// Each ConsumerGroup claims every partition of its topics (creating a one-partition topic for any that do not exist
+// yet) and delivers the messages of each partition in order, starting at the offset committed by its GroupId.
+// Marking an offset commits it immediately, so a restarted (or replacement) group continues where the previous one
+// left off.  Partitions added to a topic while a group is consuming are claimed from its next session.
+//
+// If a KafkaConsumerGroupManager is provided, each ConsumerGroup is placed under management via AddExistingGroup and
+// consumes via the manager's Consume function, so that it can be stopped and started by control-protocol commands.
+type MemoryConsumerGroupFactory struct {
+	manager   consumer.KafkaConsumerGroupManager
+	lock      sync.Mutex
+	changed   chan struct{}                          // Closed (and replaced) whenever a message is enqueued or an offset committed
+	topics    map[string][][]*sarama.ConsumerMessage // The messages of each partition of each topic
+	committed map[string]map[string]map[int32]int64  // The next offset to consume, by GroupId, topic and partition
+	sessions  map[string]int32                       // The number of sessions of each GroupId, for the GenerationID
+}
+
+var _ consumer.KafkaConsumerGroupFactory = (*MemoryConsumerGroupFactory)(nil)
+
+// NewMemoryConsumerGroupFactory returns a MemoryConsumerGroupFactory without any topics.  The manager is optional.
+func NewMemoryConsumerGroupFactory(manager consumer.KafkaConsumerGroupManager) *MemoryConsumerGroupFactory {
+	return &MemoryConsumerGroupFactory{
+		manager:   manager,
+		changed:   make(chan struct{}),
+		topics:    make(map[string][][]*sarama.ConsumerMessage),
+		committed: make(map[string]map[string]map[int32]int64),
+		sessions:  make(map[string]int32),
+	}
+}
+
+// CreateTopic creates an empty topic with the given number of partitions, or adds partitions to an existing topic
+// that has fewer.
+func (f *MemoryConsumerGroupFactory) CreateTopic(topic string, partitions int32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.createTopic(topic, partitions)
+}
+
+// createTopic is CreateTopic for a caller that holds the lock
+func (f *MemoryConsumerGroupFactory) createTopic(topic string, partitions int32) {
+	for int32(len(f.topics[topic])) < partitions {
+		f.topics[topic] = append(f.topics[topic], nil)
+	}
+}
+
+// Enqueue appends a message to a partition of a topic (creating a one-partition topic if the topic does not exist)
+// and returns the offset of the message.
+func (f *MemoryConsumerGroupFactory) Enqueue(topic string, partition int32, key []byte, value []byte, headers ...*sarama.RecordHeader) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.createTopic(topic, 1)
+	if partition < 0 || partition >= int32(len(f.topics[topic])) {
+		return 0, fmt.Errorf("topic '%s' has no partition %d", topic, partition)
+	}
+	offset := int64(len(f.topics[topic][partition]))
+	f.topics[topic][partition] = append(f.topics[topic][partition], &sarama.ConsumerMessage{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		Key:       key,
+		Value:     value,
+		Headers:   headers,
+		Timestamp: time.Now(),
+	})
+	f.notifyChanged()
+	return offset, nil
+}
+
+// CommittedOffset returns the offset (of the next message to consume) committed by the group for the partition,
+// and false if the group has not committed an offset for it.
+func (f *MemoryConsumerGroupFactory) CommittedOffset(groupId string, topic string, partition int32) (int64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	offset, ok := f.committed[groupId][topic][partition]
+	return offset, ok
+}
+
+// WaitForCommit blocks until the group has committed at least the given offset for the partition (that is, until
+// the messages before that offset have been consumed), or returns an error after the timeout.
+func (f *MemoryConsumerGroupFactory) WaitForCommit(groupId string, topic string, partition int32, offset int64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.lock.Lock()
+		committed, ok := f.committed[groupId][topic][partition]
+		changed := f.changed
+		f.lock.Unlock()
+		if ok && committed >= offset {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v waiting for group '%s' to commit offset %d of topic '%s' partition %d", timeout, groupId, offset, topic, partition)
+		}
+	}
+}
+
+// StartConsumerGroup creates an in-memory ConsumerGroup and starts a Consume goroutine on it, in the same manner as
+// the KafkaConsumerGroupFactory of the consumer package.  Closing the returned ConsumerGroup ends the goroutine (and
+// closes the group via the manager, if there is one).
+func (f *MemoryConsumerGroupFactory) StartConsumerGroup(groupId string, topics []string, logger *zap.SugaredLogger, handler consumer.KafkaConsumerHandler, options ...consumer.SaramaConsumerHandlerOption) (sarama.ConsumerGroup, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	group := &memoryStartedGroup{
+		memoryConsumerGroup: f.newConsumerGroup(groupId),
+		factory:             f,
+		groupId:             groupId,
+		cancel:              cancel,
+		errorCh:             make(chan error, 10),
+		doneCh:              make(chan struct{}),
+	}
+	consume := group.memoryConsumerGroup.Consume
+	if f.manager != nil {
+		createGroup := func() (sarama.ConsumerGroup, error) {
+			return f.newConsumerGroup(groupId), nil
+		}
+		if err := f.manager.AddExistingGroup(groupId, group.memoryConsumerGroup, topics, createGroup, cancel); err != nil {
+			cancel()
+			return nil, err
+		}
+		consume = func(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+			return f.manager.Consume(ctx, groupId, topics, handler)
+		}
+	}
+
+	go func() {
+		defer func() {
+			close(group.errorCh)
+			close(group.doneCh)
+		}()
+		for {
+			consumerHandler := consumer.NewConsumerHandler(logger, handler, group.errorCh, options...)
+			err := consume(ctx, topics, &consumerHandler)
+			if err == sarama.ErrClosedConsumerGroup || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				select {
+				case group.errorCh <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return group, nil
+}
+
+// newConsumerGroup returns an in-memory ConsumerGroup that consumes the topics of the factory
+func (f *MemoryConsumerGroupFactory) newConsumerGroup(groupId string) *memoryConsumerGroup {
+	return &memoryConsumerGroup{factory: f, groupId: groupId, errors: make(chan error), closed: make(chan struct{})}
+}
+
+// notifyChanged wakes up everything waiting for a message or a commit; the caller must hold the lock
+func (f *MemoryConsumerGroupFactory) notifyChanged() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// startSession claims every partition of the topics for a new session of the group, and returns the claimed
+// partitions by topic and the GenerationID of the session
+func (f *MemoryConsumerGroupFactory) startSession(groupId string, topics []string) (map[string][]int32, int32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	claims := make(map[string][]int32, len(topics))
+	for _, topic := range topics {
+		f.createTopic(topic, 1)
+		for partition := range f.topics[topic] {
+			claims[topic] = append(claims[topic], int32(partition))
+		}
+	}
+	f.sessions[groupId]++
+	return claims, f.sessions[groupId]
+}
+
+// commit stores the offset for the group and partition (if it is beyond the committed one, unless reset is true)
+func (f *MemoryConsumerGroupFactory) commit(groupId string, topic string, partition int32, offset int64, reset bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if committed, ok := f.committed[groupId][topic][partition]; ok && !reset && offset <= committed {
+		return
+	}
+	if f.committed[groupId] == nil {
+		f.committed[groupId] = make(map[string]map[int32]int64)
+	}
+	if f.committed[groupId][topic] == nil {
+		f.committed[groupId][topic] = make(map[int32]int64)
+	}
+	f.committed[groupId][topic][partition] = offset
+	f.notifyChanged()
+}
+
+// feed sends the messages of the partition, starting at the given offset, to the channel until the context is done
+func (f *MemoryConsumerGroupFactory) feed(ctx context.Context, topic string, partition int32, offset int64, messages chan<- *sarama.ConsumerMessage) {
+	defer close(messages)
+	for {
+		f.lock.Lock()
+		queue := f.topics[topic][partition]
+		changed := f.changed
+		f.lock.Unlock()
+		if offset < int64(len(queue)) {
+			select {
+			case messages <- queue[offset]:
+				offset++
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// highWaterMark returns the offset of the next message that will be enqueued to the partition
+func (f *MemoryConsumerGroupFactory) highWaterMark(topic string, partition int32) int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return int64(len(f.topics[topic][partition]))
+}
+
+// memoryConsumerGroup is a sarama.ConsumerGroup that consumes the in-memory topics of a MemoryConsumerGroupFactory.
+// Its Errors channel never receives anything, since there is no broker to fail.
+type memoryConsumerGroup struct {
+	factory   *MemoryConsumerGroupFactory
+	groupId   string
+	errors    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+	lock      sync.Mutex // Held by Consume for the whole session, so that Close waits for it to end (as in sarama)
+}
+
+var _ sarama.ConsumerGroup = (*memoryConsumerGroup)(nil)
+
+// Consume runs a single session, in the same manner as sarama: Setup, a ConsumeClaim goroutine for each claimed
+// partition, and Cleanup once the context is done, the group is closed, or every ConsumeClaim call has returned
+func (g *memoryConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	select {
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	default:
+	}
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closed:
+			cancel()
+		case <-sessionCtx.Done():
+		}
+	}()
+
+	claims, generation := g.factory.startSession(g.groupId, topics)
+	session := &memorySession{ctx: sessionCtx, factory: g.factory, groupId: g.groupId, claims: claims, generation: generation}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for topic, partitions := range claims {
+		for _, partition := range partitions {
+			offset, ok := g.factory.CommittedOffset(g.groupId, topic, partition)
+			if !ok {
+				offset = 0
+			}
+			claim := &memoryClaim{
+				topic:         topic,
+				partition:     partition,
+				initialOffset: offset,
+				factory:       g.factory,
+				messages:      make(chan *sarama.ConsumerMessage),
+			}
+			go g.factory.feed(sessionCtx, topic, partition, offset, claim.messages)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = handler.ConsumeClaim(session, claim)
+			}()
+		}
+	}
+	if len(claims) > 0 {
+		go func() {
+			wg.Wait()
+			cancel() // As with sarama, the session ends once all of its ConsumeClaim calls have returned
+		}()
+	}
+	<-sessionCtx.Done()
+	wg.Wait()
+	return handler.Cleanup(session)
+}
+
+func (g *memoryConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+// Close ends the current session (if any), waiting for its Cleanup
+func (g *memoryConsumerGroup) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		close(g.errors)
+	})
+	return nil
+}
+
+// memoryStartedGroup is the ConsumerGroup returned by MemoryConsumerGroupFactory.StartConsumerGroup, whose Errors
+// channel receives the handler errors
+type memoryStartedGroup struct {
+	*memoryConsumerGroup
+	factory *MemoryConsumerGroupFactory
+	groupId string
+	cancel  func()
+	errorCh chan error
+	doneCh  chan struct{}
+}
+
+func (g *memoryStartedGroup) Errors() <-chan error {
+	return g.errorCh
+}
+
+// Close ends the Consume goroutine and closes the group (via the manager, if there is one), waiting for the
+// goroutine to exit
+func (g *memoryStartedGroup) Close() error {
+	var err error
+	if g.factory.manager != nil && g.factory.manager.IsManaged(g.groupId) {
+		err = g.factory.manager.CloseConsumerGroup(g.groupId)
+	}
+	g.cancel()
+	_ = g.memoryConsumerGroup.Close()
+	// Release any handler blocked on a full errors channel, so that the goroutine can exit
+	for range g.errorCh {
+	}
+	<-g.doneCh
+	return err
+}
+
+// memorySession is the sarama.ConsumerGroupSession of a memoryConsumerGroup
+type memorySession struct {
+	ctx        context.Context
+	factory    *MemoryConsumerGroupFactory
+	groupId    string
+	claims     map[string][]int32
+	generation int32
+}
+
+var _ sarama.ConsumerGroupSession = (*memorySession)(nil)
+
+func (s *memorySession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *memorySession) MemberID() string {
+	return "memory-member-" + s.groupId
+}
+
+func (s *memorySession) GenerationID() int32 {
+	return s.generation
+}
+
+// MarkOffset commits the offset immediately (if it is beyond the committed one)
+func (s *memorySession) MarkOffset(topic string, partition int32, offset int64, _ string) {
+	s.factory.commit(s.groupId, topic, partition, offset, false)
+}
+
+// Commit has no effect, since marked offsets are committed immediately
+func (s *memorySession) Commit() {}
+
+// ResetOffset commits the offset immediately, even if it is before the committed one, so that it takes effect
+// from the next session
+func (s *memorySession) ResetOffset(topic string, partition int32, offset int64, _ string) {
+	s.factory.commit(s.groupId, topic, partition, offset, true)
+}
+
+func (s *memorySession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *memorySession) Context() context.Context {
+	return s.ctx
+}
+
+// memoryClaim is the sarama.ConsumerGroupClaim of a partition claimed by a memorySession
+type memoryClaim struct {
+	topic         string
+	partition     int32
+	initialOffset int64
+	factory       *MemoryConsumerGroupFactory
+	messages      chan *sarama.ConsumerMessage
+}
+
+var _ sarama.ConsumerGroupClaim = (*memoryClaim)(nil)
+
+func (c *memoryClaim) Topic() string {
+	return c.topic
+}
+
+func (c *memoryClaim) Partition() int32 {
+	return c.partition
+}
+
+func (c *memoryClaim) InitialOffset() int64 {
+	return c.initialOffset
+}
+
+func (c *memoryClaim) HighWaterMarkOffset() int64 {
+	return c.factory.highWaterMark(c.topic, c.partition)
+}
+
+func (c *memoryClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
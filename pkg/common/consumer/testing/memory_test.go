@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	ctrl "knative.dev/control-protocol/pkg"
+
+	"knative.dev/eventing-kafka/pkg/common/consumer"
+	"knative.dev/eventing-kafka/pkg/common/controlprotocol/commands"
+	controltesting "knative.dev/eventing-kafka/pkg/common/controlprotocol/testing"
+)
+
+// recordingHandler is a KafkaConsumerHandler that sends the value of each message it handles to a channel, and
+// returns an error (without marking) for a message whose value is "fail"
+type recordingHandler struct {
+	handled chan string
+}
+
+func (h recordingHandler) Handle(_ context.Context, message *sarama.ConsumerMessage) (bool, error) {
+	h.handled <- string(message.Value)
+	if string(message.Value) == "fail" {
+		return false, fmt.Errorf("handler error")
+	}
+	return true, nil
+}
+
+func (h recordingHandler) SetReady(int32, bool) {}
+
+func (h recordingHandler) GetConsumerGroup() string {
+	return "memory-group"
+}
+
+// receive returns the next value handled, failing the test if there is none
+func (h recordingHandler) receive(t *testing.T) string {
+	select {
+	case value := <-h.handled:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("no message was handled")
+		return ""
+	}
+}
+
+// assertNothingHandled fails the test if a message is handled in the near future
+func (h recordingHandler) assertNothingHandled(t *testing.T) {
+	select {
+	case value := <-h.handled:
+		t.Fatalf("message %q was handled unexpectedly", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func enqueue(t *testing.T, factory *MemoryConsumerGroupFactory, values ...string) {
+	for _, value := range values {
+		_, err := factory.Enqueue("topic", 0, nil, []byte(value))
+		assert.Nil(t, err)
+	}
+}
+
+func TestMemoryConsumerGroupFactory(t *testing.T) {
+	factory := NewMemoryConsumerGroupFactory(nil)
+	handler := recordingHandler{handled: make(chan string, 10)}
+	enqueue(t, factory, "one", "two")
+
+	group, err := factory.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "one", handler.receive(t))
+	assert.Equal(t, "two", handler.receive(t))
+
+	// Messages enqueued while consuming are delivered, and handler errors are sent to the Errors channel
+	enqueue(t, factory, "fail", "three")
+	assert.Equal(t, "fail", handler.receive(t))
+	select {
+	case err := <-group.Errors():
+		assert.Equal(t, "handler error", err.Error())
+	case <-time.After(time.Second):
+		t.Fatal("the handler error was not reported")
+	}
+	assert.Equal(t, "three", handler.receive(t))
+	assert.Nil(t, factory.WaitForCommit("group", "topic", 0, 4, time.Second))
+	assert.Nil(t, group.Close())
+
+	// A new group with the same GroupId continues from the committed offset
+	enqueue(t, factory, "four")
+	group, err = factory.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "four", handler.receive(t))
+	assert.Nil(t, group.Close())
+	offset, ok := factory.CommittedOffset("group", "topic", 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), offset)
+
+	// A partition that does not exist cannot be enqueued to, and waiting for an unreachable commit times out
+	_, err = factory.Enqueue("topic", 1, nil, []byte("value"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, factory.WaitForCommit("group", "topic", 0, 6, 10*time.Millisecond))
+}
+
+func TestMemoryConsumerGroupFactoryPartitions(t *testing.T) {
+	factory := NewMemoryConsumerGroupFactory(nil)
+	factory.CreateTopic("topic", 3)
+	handler := recordingHandler{handled: make(chan string, 10)}
+	for partition := int32(0); partition < 3; partition++ {
+		_, err := factory.Enqueue("topic", partition, nil, []byte(fmt.Sprintf("partition-%d", partition)))
+		assert.Nil(t, err)
+	}
+
+	group, err := factory.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), handler)
+	assert.Nil(t, err)
+	received := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		received[handler.receive(t)] = true
+	}
+	assert.Equal(t, map[string]bool{"partition-0": true, "partition-1": true, "partition-2": true}, received)
+	assert.Nil(t, group.Close())
+}
+
+func TestMemoryConsumerGroupFactoryManaged(t *testing.T) {
+	server := controltesting.NewFakeServerHandler()
+	manager := consumer.NewConsumerGroupManager(zap.NewNop(), server, []string{}, sarama.NewConfig())
+	factory := NewMemoryConsumerGroupFactory(manager)
+	handler := recordingHandler{handled: make(chan string, 10)}
+
+	group, err := factory.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), handler)
+	assert.Nil(t, err)
+	assert.True(t, manager.IsManaged("group"))
+	topics, err := manager.Topics("group")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"topic"}, topics)
+
+	// A group cannot be started twice under the same GroupId
+	_, err = factory.StartConsumerGroup("group", []string{"topic"}, zap.NewNop().Sugar(), handler)
+	assert.NotNil(t, err)
+
+	enqueue(t, factory, "one")
+	assert.Equal(t, "one", handler.receive(t))
+
+	sendCommand := func(opcode ctrl.OpCode) {
+		result, err := server.SendAsyncCommand(context.Background(), opcode, &commands.ConsumerGroupAsyncCommand{
+			Version: commands.ConsumerGroupAsyncCommandVersion,
+			GroupId: "group",
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "", result.Error)
+	}
+
+	// Nothing is consumed while the group is stopped, and consumption continues once it is started again
+	sendCommand(commands.StopConsumerGroupOpCode)
+	assert.True(t, manager.IsStopped("group"))
+	enqueue(t, factory, "two")
+	handler.assertNothingHandled(t)
+	sendCommand(commands.StartConsumerGroupOpCode)
+	assert.False(t, manager.IsStopped("group"))
+	assert.Equal(t, "two", handler.receive(t))
+
+	assert.Nil(t, group.Close())
+	assert.False(t, manager.IsManaged("group"))
+	enqueue(t, factory, "three")
+	handler.assertNothingHandled(t)
+}
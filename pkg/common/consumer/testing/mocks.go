@@ -17,10 +17,14 @@ limitations under the License.
 package testing
 
 import (
+	"context"
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
 
+	"knative.dev/eventing-kafka/pkg/common/client"
 	"knative.dev/eventing-kafka/pkg/common/consumer"
 )
 
@@ -60,11 +64,59 @@ func (m *MockConsumerGroupManager) Reconfigure(brokers []string, config *sarama.
 	return m.Called(brokers, config).Error(0)
 }
 
+func (m *MockConsumerGroupManager) ReconfigureWithReport(brokers []string, config *sarama.Config) (consumer.ReconfigureReport, error) {
+	args := m.Called(brokers, config)
+	return args.Get(0).(consumer.ReconfigureReport), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) RollingReconfigure(brokers []string, config *sarama.Config, options consumer.RollingReconfigureOptions) error {
+	return m.Called(brokers, config, options).Error(0)
+}
+
+func (m *MockConsumerGroupManager) ReconfigureAuth(authConfig *client.KafkaAuthConfig) error {
+	return m.Called(authConfig).Error(0)
+}
+
+func (m *MockConsumerGroupManager) RegisterCluster(name string, brokers []string, config *sarama.Config) error {
+	return m.Called(name, brokers, config).Error(0)
+}
+
+func (m *MockConsumerGroupManager) ReconfigureCluster(name string, brokers []string, config *sarama.Config) error {
+	return m.Called(name, brokers, config).Error(0)
+}
+
+func (m *MockConsumerGroupManager) BrokerGroupId(groupId string) (string, error) {
+	args := m.Called(groupId)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) Ping(ctx context.Context) error {
+	return m.Called(ctx).Error(0)
+}
+
+func (m *MockConsumerGroupManager) ReconnectCluster(name string) error {
+	return m.Called(name).Error(0)
+}
+
 func (m *MockConsumerGroupManager) StartConsumerGroup(groupId string, topics []string, logger *zap.SugaredLogger,
 	handler consumer.KafkaConsumerHandler, options ...consumer.SaramaConsumerHandlerOption) error {
 	return m.Called(groupId, topics, logger, handler, options).Error(0)
 }
 
+func (m *MockConsumerGroupManager) StartConsumerGroupSync(ctx context.Context, groupId string, topics []string, logger *zap.SugaredLogger,
+	handler consumer.KafkaConsumerHandler, options ...consumer.SaramaConsumerHandlerOption) error {
+	return m.Called(ctx, groupId, topics, logger, handler, options).Error(0)
+}
+
+func (m *MockConsumerGroupManager) StartChannelConsumer(groupId string, topics []string, logger *zap.SugaredLogger,
+	options ...consumer.SaramaConsumerHandlerOption) (<-chan *sarama.ConsumerMessage, func() error, error) {
+	args := m.Called(groupId, topics, logger, options)
+	if args.Get(0) == nil {
+		return nil, nil, args.Error(2)
+	}
+	return args.Get(0).(<-chan *sarama.ConsumerMessage), args.Get(1).(func() error), args.Error(2)
+}
+
 func (m *MockConsumerGroupManager) CloseConsumerGroup(groupId string) error {
 	if group, ok := m.Groups[groupId]; ok {
 		_ = group.Close()
@@ -73,10 +125,129 @@ func (m *MockConsumerGroupManager) CloseConsumerGroup(groupId string) error {
 	return m.Called(groupId).Error(0)
 }
 
+func (m *MockConsumerGroupManager) CloseConsumerGroupAndWait(groupId string, timeout time.Duration) error {
+	if group, ok := m.Groups[groupId]; ok {
+		_ = group.Close()
+		delete(m.Groups, groupId)
+	}
+	return m.Called(groupId, timeout).Error(0)
+}
+
+func (m *MockConsumerGroupManager) SwapHandler(groupId string, handler consumer.KafkaConsumerHandler, options ...consumer.SaramaConsumerHandlerOption) error {
+	return m.Called(groupId, handler, options).Error(0)
+}
+
 func (m *MockConsumerGroupManager) IsManaged(groupId string) bool {
 	return m.Called(groupId).Bool(0)
 }
 
+func (m *MockConsumerGroupManager) Topics(groupId string) ([]string, error) {
+	args := m.Called(groupId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) PausePartitions(groupId string, assignments map[string][]int32) error {
+	return m.Called(groupId, assignments).Error(0)
+}
+
+func (m *MockConsumerGroupManager) ResumePartitions(groupId string, assignments map[string][]int32) error {
+	return m.Called(groupId, assignments).Error(0)
+}
+
+func (m *MockConsumerGroupManager) PausedPartitions(groupId string) (map[string][]int32, error) {
+	args := m.Called(groupId)
+	return args.Get(0).(map[string][]int32), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) AddExistingGroup(groupId string, group sarama.ConsumerGroup, topics []string, createGroup func() (sarama.ConsumerGroup, error), cancel func()) error {
+	return m.Called(groupId, group, topics, createGroup, cancel).Error(0)
+}
+
+func (m *MockConsumerGroupManager) Consume(ctx context.Context, groupId string, topics []string, handler sarama.ConsumerGroupHandler) error {
+	return m.Called(ctx, groupId, topics, handler).Error(0)
+}
+
+func (m *MockConsumerGroupManager) IsDead(groupId string) bool {
+	return m.Called(groupId).Bool(0)
+}
+
+func (m *MockConsumerGroupManager) ActiveConsumers() int {
+	return m.Called().Int(0)
+}
+
+func (m *MockConsumerGroupManager) SetActive(active bool) error {
+	return m.Called(active).Error(0)
+}
+
+func (m *MockConsumerGroupManager) IsActive() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *MockConsumerGroupManager) DroppedErrors(groupId string) (int64, error) {
+	args := m.Called(groupId)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) Describe() consumer.ManagerSnapshot {
+	return m.Called().Get(0).(consumer.ManagerSnapshot)
+}
+
+func (m *MockConsumerGroupManager) DrainConsumerGroup(groupId string, timeout time.Duration, mode consumer.DrainCommitMode) error {
+	if group, ok := m.Groups[groupId]; ok {
+		_ = group.Close()
+		delete(m.Groups, groupId)
+	}
+	return m.Called(groupId, timeout, mode).Error(0)
+}
+
+func (m *MockConsumerGroupManager) Shutdown(ctx context.Context) (consumer.ShutdownResult, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(consumer.ShutdownResult), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) EnableSaramaLogging() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *MockConsumerGroupManager) Export() []consumer.ManagedGroupState {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil
+	}
+	return args.Get(0).([]consumer.ManagedGroupState)
+}
+
+func (m *MockConsumerGroupManager) Import(states []consumer.ManagedGroupState, logger *zap.SugaredLogger, resolver consumer.HandlerResolver) error {
+	return m.Called(states, logger, resolver).Error(0)
+}
+
+func (m *MockConsumerGroupManager) CommittedOffsets(groupId string) (map[string]map[int32]int64, error) {
+	args := m.Called(groupId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]map[int32]int64), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) CommitGap(groupId string) (map[string]map[int32]int64, error) {
+	args := m.Called(groupId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]map[int32]int64), args.Error(1)
+}
+
+func (m *MockConsumerGroupManager) RestoreOffsets(groupId string, offsets map[string]map[int32]int64) error {
+	return m.Called(groupId, offsets).Error(0)
+}
+
+func (m *MockConsumerGroupManager) AddStartDependency(groupId string, dependsOn string) error {
+	return m.Called(groupId, dependsOn).Error(0)
+}
+
 func (m *MockConsumerGroupManager) IsStopped(groupId string) bool {
 	return m.Called(groupId).Bool(0)
 }
@@ -30,6 +30,8 @@ const (
 	StopConsumerGroupResultOpCode  ctrl.OpCode = 11
 	StartConsumerGroupOpCode       ctrl.OpCode = 12
 	StartConsumerGroupResultOpCode ctrl.OpCode = 13
+	ResetOffsetsOpCode             ctrl.OpCode = 14
+	ResetOffsetsResultOpCode       ctrl.OpCode = 15
 )
 
 // Verify The ConsumerGroupAsyncCommand Implements The Control-Protocol AsyncCommand Interface
@@ -42,6 +44,11 @@ type ConsumerGroupAsyncCommand struct {
 	TopicName string       `json:"topicName"`
 	GroupId   string       `json:"groupId"`
 	Lock      *CommandLock `json:"lock,omitempty"`
+
+	// OffsetTime is the time (in milliseconds since the epoch) that the ResetOffsetsOpCode resets the offsets of
+	// the group to, or sarama.OffsetOldest / sarama.OffsetNewest.  It is required by that command, and ignored by
+	// the others.
+	OffsetTime *int64 `json:"offsetTime,omitempty"`
 }
 
 // NewConsumerGroupAsyncCommand constructs and returns a new ConsumerGroupAsyncCommand.
@@ -56,6 +63,14 @@ func NewConsumerGroupAsyncCommand(commandId int64, topicName string, groupId str
 	}
 }
 
+// NewResetOffsetsAsyncCommand constructs and returns a new ConsumerGroupAsyncCommand for the ResetOffsetsOpCode,
+// which resets the offsets of the group to those of the given offsetTime.
+func NewResetOffsetsAsyncCommand(commandId int64, topicName string, groupId string, offsetTime int64, lock *CommandLock) *ConsumerGroupAsyncCommand {
+	command := NewConsumerGroupAsyncCommand(commandId, topicName, groupId, lock)
+	command.OffsetTime = &offsetTime
+	return command
+}
+
 // MarshalBinary implements the Control-Protocol AsyncCommand interface.
 func (s *ConsumerGroupAsyncCommand) MarshalBinary() (data []byte, err error) {
 	return json.Marshal(s)
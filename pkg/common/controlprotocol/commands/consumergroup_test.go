@@ -63,6 +63,26 @@ func TestNewConsumerGroupAsyncCommand(t *testing.T) {
 	}
 }
 
+func TestNewResetOffsetsAsyncCommand(t *testing.T) {
+	lock := NewCommandLock("TestLockToken", 1*time.Minute, false, false)
+	command := NewResetOffsetsAsyncCommand(int64(1234), "TestTopicName", "TestGroupId", int64(1600000000000), lock)
+	assert.Equal(t, ConsumerGroupAsyncCommandVersion, command.Version)
+	assert.Equal(t, "TestGroupId", command.GroupId)
+	assert.Equal(t, lock, command.Lock)
+	assert.Equal(t, int64(1600000000000), *command.OffsetTime)
+
+	// The offset time survives a round trip, and is omitted from the other commands
+	binaryData, err := command.MarshalBinary()
+	assert.Nil(t, err)
+	unmarshaled := &ConsumerGroupAsyncCommand{}
+	assert.Nil(t, unmarshaled.UnmarshalBinary(binaryData))
+	assert.Equal(t, command, unmarshaled)
+
+	binaryData, err = NewConsumerGroupAsyncCommand(int64(1234), "TestTopicName", "TestGroupId", nil).MarshalBinary()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(binaryData), "offsetTime")
+}
+
 func TestConsumerGroupAsyncCommand_MarshalUnmarshal(t *testing.T) {
 
 	// Test Data
@@ -0,0 +1,182 @@
+/*
+Copyright 2021 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"fmt"
+	"sync"
+	"time"
+
+	ctrl "knative.dev/control-protocol/pkg"
+	ctrlmessage "knative.dev/control-protocol/pkg/message"
+	ctrlservice "knative.dev/control-protocol/pkg/service"
+)
+
+//
+// Fake (In-Memory) Control-Protocol ServerHandler
+//
+
+// FakeServerHandler is an in-memory implementation of the controlprotocol.ServerHandler interface.  It records
+// the handlers that are added to it and lets tests deliver commands to them directly, capturing the results
+// that the handlers report via NotifySuccess and NotifyFailed.  No network connections are made.
+type FakeServerHandler struct {
+	lock          sync.Mutex
+	router        ctrlservice.MessageRouter
+	resultOpcodes map[ctrl.OpCode]ctrl.OpCode
+	service       *fakeResultService
+	shutdown      bool
+}
+
+// NewFakeServerHandler returns a FakeServerHandler with no handlers
+func NewFakeServerHandler() *FakeServerHandler {
+	return &FakeServerHandler{
+		router:        make(ctrlservice.MessageRouter),
+		resultOpcodes: make(map[ctrl.OpCode]ctrl.OpCode),
+		service:       &fakeResultService{results: make(map[ctrl.OpCode][]ctrlmessage.AsyncCommandResult)},
+	}
+}
+
+// AddAsyncHandler records the handler for the given opcode, replacing any existing one
+func (s *FakeServerHandler) AddAsyncHandler(opcode ctrl.OpCode, resultOpcode ctrl.OpCode, payloadType ctrlmessage.AsyncCommand,
+	handler func(ctx context.Context, commandMessage ctrlservice.AsyncCommandMessage)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.router[opcode] = ctrlservice.NewAsyncCommandHandler(s.service, payloadType, resultOpcode, handler)
+	s.resultOpcodes[opcode] = resultOpcode
+}
+
+// AddSyncHandler records the handler for the given opcode, replacing any existing one
+func (s *FakeServerHandler) AddSyncHandler(opcode ctrl.OpCode, handler ctrl.MessageHandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.router[opcode] = handler
+	delete(s.resultOpcodes, opcode)
+}
+
+// RemoveHandler removes the handler for the given opcode
+func (s *FakeServerHandler) RemoveHandler(opcode ctrl.OpCode) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.router, opcode)
+	delete(s.resultOpcodes, opcode)
+}
+
+// Shutdown records that the server handler was shut down
+func (s *FakeServerHandler) Shutdown(_ time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shutdown = true
+}
+
+// IsShutdown returns true if Shutdown has been called
+func (s *FakeServerHandler) IsShutdown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shutdown
+}
+
+// HasHandler returns true if a handler is registered for the given opcode
+func (s *FakeServerHandler) HasHandler(opcode ctrl.OpCode) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.router[opcode]
+	return ok
+}
+
+// Send delivers a message with the given opcode and payload to the registered handler and returns the
+// error with which the handler acknowledged the message (nil for a successful acknowledgement).
+// Registered handlers are called synchronously, so this returns after the handler does.
+func (s *FakeServerHandler) Send(ctx context.Context, opcode ctrl.OpCode, payload encoding.BinaryMarshaler) error {
+	s.lock.Lock()
+	handler, ok := s.router[opcode]
+	s.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no handler registered for opcode %d", opcode)
+	}
+
+	data, err := payload.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var ackErr error
+	msg := ctrl.NewMessage([16]byte{}, uint8(opcode), data)
+	handler.HandleServiceMessage(ctx, ctrl.NewServiceMessage(&msg, func(err error) { ackErr = err }))
+	return ackErr
+}
+
+// SendAsyncCommand delivers the command to the async handler registered for the given opcode, and returns
+// the result that the handler reported via NotifySuccess or NotifyFailed.  An error is returned if there is no
+// async handler for the opcode, the message was not acknowledged successfully, or the handler reported no result.
+func (s *FakeServerHandler) SendAsyncCommand(ctx context.Context, opcode ctrl.OpCode, command ctrlmessage.AsyncCommand) (*ctrlmessage.AsyncCommandResult, error) {
+	s.lock.Lock()
+	resultOpcode, ok := s.resultOpcodes[opcode]
+	s.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no async handler registered for opcode %d", opcode)
+	}
+
+	if err := s.Send(ctx, opcode, command); err != nil {
+		return nil, err
+	}
+	// Use the most recent result, in case the same command was sent more than once
+	results := s.Results(resultOpcode)
+	for i := len(results) - 1; i >= 0; i-- {
+		if bytes.Equal(results[i].CommandId, command.SerializedId()) {
+			return &results[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no result was reported for the command")
+}
+
+// Results returns all of the results that were reported by async handlers using the given result opcode
+func (s *FakeServerHandler) Results(resultOpcode ctrl.OpCode) []ctrlmessage.AsyncCommandResult {
+	return s.service.getResults(resultOpcode)
+}
+
+// fakeResultService is a control-protocol Service that records the async command results sent through it
+type fakeResultService struct {
+	lock    sync.Mutex
+	results map[ctrl.OpCode][]ctrlmessage.AsyncCommandResult
+}
+
+var _ ctrl.Service = (*fakeResultService)(nil)
+
+// SendAndWaitForAck records the payload if it is an async command result
+func (f *fakeResultService) SendAndWaitForAck(opcode ctrl.OpCode, payload encoding.BinaryMarshaler) error {
+	result, ok := payload.(ctrlmessage.AsyncCommandResult)
+	if !ok {
+		return fmt.Errorf("unexpected payload type %T", payload)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.results[opcode] = append(f.results[opcode], result)
+	return nil
+}
+
+func (f *fakeResultService) MessageHandler(_ ctrl.MessageHandler) {}
+
+func (f *fakeResultService) ErrorHandler(_ ctrl.ErrorHandler) {}
+
+// getResults returns a copy of the results recorded for the given opcode
+func (f *fakeResultService) getResults(opcode ctrl.OpCode) []ctrlmessage.AsyncCommandResult {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]ctrlmessage.AsyncCommandResult{}, f.results[opcode]...)
+}
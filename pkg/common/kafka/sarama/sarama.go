@@ -22,9 +22,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/Shopify/sarama"
 	"github.com/ghodss/yaml"
+	"go.uber.org/zap"
 	"knative.dev/pkg/system"
 
 	"knative.dev/eventing-kafka/pkg/common/client"
@@ -40,8 +43,17 @@ const (
 	DefaultRetentionMillis   = 604800000 // 1 week
 )
 
+// The Sarama Logger Is A Package-Global, So Installing A Zap Logger Is Tracked In Order To Prevent Multiple Installs
+var (
+	zapLoggerMutex     sync.Mutex
+	zapLoggerInstalled bool
+)
+
 // EnableSaramaLogging Is A Utility Function For Enabling Sarama Logging (Debugging)
 func EnableSaramaLogging(enable bool) {
+	zapLoggerMutex.Lock()
+	defer zapLoggerMutex.Unlock()
+	zapLoggerInstalled = false
 	if enable {
 		sarama.Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
 	} else {
@@ -49,6 +61,43 @@ func EnableSaramaLogging(enable bool) {
 	}
 }
 
+// zapStdLogger Adapts A Zap Logger To The Sarama StdLogger Interface, Writing Every Message At The Debug Level
+type zapStdLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l zapStdLogger) Print(v ...interface{}) {
+	l.logger.Debug(strings.TrimSuffix(fmt.Sprint(v...), "\n"))
+}
+
+func (l zapStdLogger) Printf(format string, v ...interface{}) {
+	l.logger.Debug(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+func (l zapStdLogger) Println(v ...interface{}) {
+	l.logger.Debug(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// NewZapSaramaLogger Returns A Sarama StdLogger That Writes The Sarama Logs Via The Provided Zap Logger
+func NewZapSaramaLogger(logger *zap.Logger) sarama.StdLogger {
+	return zapStdLogger{logger: logger.With(zap.String("component", "sarama")).Sugar()}
+}
+
+// InstallZapSaramaLogger Sets The Sarama Logger To Write Via The Provided Zap Logger, Returning False (And Leaving The
+// Current Logger In Place) If A Zap Logger Was Already Installed.  Note That The Sarama Logger Is Global To The Process,
+// So The Logs Of Every Sarama Client (Not Only Those Of The Caller) Are Written Via This Logger.  A Subsequent Call To
+// EnableSaramaLogging Replaces It.
+func InstallZapSaramaLogger(logger *zap.Logger) bool {
+	zapLoggerMutex.Lock()
+	defer zapLoggerMutex.Unlock()
+	if zapLoggerInstalled {
+		return false
+	}
+	sarama.Logger = NewZapSaramaLogger(logger)
+	zapLoggerInstalled = true
+	return true
+}
+
 // GetAuth Is The Function Type Used To Delay Loading Auth Config Until The Secret Name/Namespace Are Known
 type GetAuth func(ctx context.Context, authSecretName string, authSecretNamespace string) *client.KafkaAuthConfig
 
@@ -19,12 +19,15 @@ package sarama
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -138,6 +141,35 @@ func TestEnableSaramaLogging(t *testing.T) {
 	sarama.Logger.Print("TestMessage - Should Be Hidden")
 }
 
+// Test Installing A Zap Logger For Sarama
+func TestInstallZapSaramaLogger(t *testing.T) {
+
+	// Restore Sarama Logger After Test
+	saramaLoggerPlaceholder := sarama.Logger
+	defer func() {
+		EnableSaramaLogging(false)
+		sarama.Logger = saramaLoggerPlaceholder
+	}()
+
+	core, logs := observer.New(zap.DebugLevel)
+	assert.True(t, InstallZapSaramaLogger(zap.New(core)))
+	assert.False(t, InstallZapSaramaLogger(zap.NewNop())) // Already installed
+
+	sarama.Logger.Print("TestMessage ", 1)
+	sarama.Logger.Printf("TestMessage %d\n", 2)
+	sarama.Logger.Println("TestMessage", 3)
+	assert.Equal(t, 3, logs.Len())
+	for index, entry := range logs.All() {
+		assert.Equal(t, fmt.Sprintf("TestMessage %d", index+1), entry.Message)
+		assert.Equal(t, zap.DebugLevel, entry.Level)
+		assert.Equal(t, "sarama", entry.ContextMap()["component"])
+	}
+
+	// Enabling Standard Sarama Logging Replaces The Zap Logger, After Which It May Be Installed Again
+	EnableSaramaLogging(false)
+	assert.True(t, InstallZapSaramaLogger(zap.NewNop()))
+}
+
 // mockGetAuth returns a function that satisfies the GetAuth prototype, returning the provided values
 func mockGetAuth(authConfig *client.KafkaAuthConfig) GetAuth {
 	return func(_ context.Context, _ string, _ string) *client.KafkaAuthConfig {
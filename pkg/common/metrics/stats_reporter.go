@@ -66,9 +66,13 @@ var regexDescriptions = []struct {
 	// Sarama Counters
 	{regexp.MustCompile(`^requests-in-flight`), `The current number of in-flight requests awaiting a response for all brokers`},
 
-	// Touch-ups for specific topics/brokers
+	// Consumer Group Histograms (recorded by the consumer package rather than Sarama)
+	{regexp.MustCompile(`^consumer-join-latency-in-ms`), `Distribution of the time in ms from the start of a consume call to the joining of the group for all groups`},
+
+	// Touch-ups for specific topics/brokers/groups
 	{regexp.MustCompile(`all topics-for-topic-(.*)`), `topic "${1}"`},
 	{regexp.MustCompile(`all brokers-for-broker-`), `broker `},
+	{regexp.MustCompile(`all groups-for-group-(.*)`), `group "${1}"`},
 }
 
 // The saramaMetricInfo struct holds information related to a particular Sarama metric, used when creating TimeSeries
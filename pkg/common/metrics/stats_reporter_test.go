@@ -99,6 +99,8 @@ func TestGetMetricSubInfo(t *testing.T) {
 		{name: "records-per-request", want: "Distribution of the number of records sent per request for all topics: " + subMetric},
 		{name: "compression-ratio", want: "Distribution of the compression ratio times 100 of record batches for all topics: " + subMetric},
 		{name: "consumer-batch-size", want: "Distribution of the number of messages in a batch: " + subMetric},
+		{name: "consumer-join-latency-in-ms", want: "Distribution of the time in ms from the start of a consume call to the joining of the group for all groups: " + subMetric},
+		{name: "consumer-join-latency-in-ms-for-group-test-group", want: "Distribution of the time in ms from the start of a consume call to the joining of the group for group \"test-group\": " + subMetric},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {